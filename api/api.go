@@ -7,8 +7,11 @@
 package fossil
 
 import (
+	"time"
+
 	"github.com/dburkart/fossil/pkg/database"
 	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/tracing"
 )
 
 type Client interface {
@@ -16,7 +19,107 @@ type Client interface {
 	Close() error
 	Send(proto.Message) (proto.Message, error)
 	Append(string, []byte) error
+	// AppendWithTTL appends data which expires once the duration has passed
+	AppendWithTTL(string, []byte, time.Duration) error
+	// AppendWithReceipt appends like AppendWithTTL, returning the time and
+	// sequence number the data was appended with, so that it can be found
+	// again by later queries
+	AppendWithReceipt(string, []byte, time.Duration) (database.AppendReceipt, error)
+	// AppendStream opens a stream of appends, which are sent without
+	// waiting for each to be acknowledged, and whose failures are reported
+	// asynchronously. The stream must be closed once it's done with.
+	AppendStream(StreamOptions) (*AppendStream, error)
 	Query(string) (database.Entries, error)
+	// QueryWithMetadata queries like Query, also returning metadata which
+	// describes how many entries matched, and whether they were truncated
+	QueryWithMetadata(string) (database.Entries, proto.QueryMetadata, error)
+	// CreateTopic creates a topic with the given schema, which defaults to
+	// string if it's empty
+	CreateTopic(topic, schema string) error
+	// Validate checks whether data would be appended to topic, without
+	// appending it
+	Validate(topic string, data []byte) error
+	// Changes returns up to limit changes committed to the database with
+	// offsets of at least from, and the offset to ask for next. If there are
+	// none, it waits up to wait for some. A from of 0 starts with the oldest
+	// change the database holds.
+	Changes(from uint64, limit int, wait time.Duration) ([]database.Change, uint64, error)
+	// Ping checks that the server is responding, returning the round trip
+	// time to it
+	Ping() (time.Duration, error)
+	// ListTopics returns every topic starting with prefix, sorted by name
+	ListTopics(prefix string) ([]TopicInfo, error)
+	// Instrument sets the Instrumentation notified of the client's activity.
+	// It should be called before the client is used.
+	Instrument(Instrumentation)
+	// Trace sets the Tracer spans are created with around sending messages,
+	// appending, and querying, so that they show up in distributed traces.
+	// It should be called before the client is used.
+	Trace(tracing.Tracer)
+	// Limit sets the limits messages are checked against before they are
+	// sent, so that messages the server would reject aren't sent at all.
+	// Clients use proto.DefaultLimits unless told otherwise.
+	Limit(proto.Limits)
+	// HandleNotices sets the handler called with the notices the server
+	// sends, which tell the client something that isn't an error. Notices
+	// are ignored until a handler is set. It should be called before the
+	// client is used.
+	HandleNotices(NoticeHandler)
+	// PoolStats returns a snapshot of the client's connection pool.
+	PoolStats() PoolStats
+}
+
+// PoolStats counts the connections in a client's pool. Connections move
+// between states as requests are sent, so the counts are only a snapshot.
+type PoolStats struct {
+	// Target is the number of connections the pool tries to keep open
+	Target int
+	// Active connections are in use by a request
+	Active int
+	// Idle connections are open and waiting to be used
+	Idle int
+	// Broken connections have failed, or couldn't be opened, and are being
+	// replaced in the background
+	Broken int
+}
+
+// PoolOptions configure the pool of a client created by
+// NewClientPoolWithOptions.
+type PoolOptions struct {
+	// Size is the number of connections the pool keeps open
+	Size uint
+	// Degrade lets the pool open with fewer than Size connections, so long as
+	// at least one could be opened, and replaces the rest in the background.
+	// Otherwise the pool fails fast, and isn't opened unless every connection
+	// could be.
+	Degrade bool
+	// ReconnectDelay is how long to wait after failing to replace a broken
+	// connection before trying again. It doubles with each failure, up to a
+	// minute. Defaults to one second.
+	ReconnectDelay time.Duration
+	// WaitTimeout is how long a request waits for a connection when every
+	// connection in the pool is broken. Defaults to ten seconds.
+	WaitTimeout time.Duration
+	// Retry configures how requests which fail are retried
+	Retry RetryPolicy
+	// Spool configures the on-disk spool appends are buffered in while the
+	// server can't be reached. Appends aren't spooled unless its Path is set.
+	Spool SpoolOptions
+}
+
+func (o PoolOptions) withDefaults() PoolOptions {
+	if o.Size == 0 {
+		o.Size = 1
+	}
+	if o.ReconnectDelay == 0 {
+		o.ReconnectDelay = time.Second
+	}
+	if o.WaitTimeout == 0 {
+		o.WaitTimeout = 10 * time.Second
+	}
+	o.Retry = o.Retry.withDefaults(o.Size)
+	o.Spool = o.Spool.withDefaults()
+	return o
 }
 
 // NewClient creates a new Client struct which can be used to interact with a
@@ -33,23 +136,33 @@ func NewClient(connstr string) (Client, error) {
 
 // NewClientPool creates a new Client struct which holds a pool of net.Conn
 // resources open to a remote fossil database. This is useful for sending large
-// volumes of data to fossil.
+// volumes of data to fossil. If any connection can't be opened, no client is
+// returned; see NewClientPoolWithOptions for a pool which degrades instead.
 func NewClientPool(connstr string, size uint) (Client, error) {
+	return NewClientPoolWithOptions(connstr, PoolOptions{Size: size})
+}
+
+// NewClientPoolWithOptions creates a new Client struct like NewClientPool, with
+// a pool configured by opts. Connections which fail once the pool is open are
+// replaced in the background.
+func NewClientPoolWithOptions(connstr string, opts PoolOptions) (Client, error) {
 	var client Client
 	var err error
 
+	opts = opts.withDefaults()
+
 	target, err := proto.ParseConnectionString(connstr)
 	if err != nil {
 		return nil, err
 	}
 
 	if target.Local == true {
-		client = &LocalClient{}
+		client = &LocalClient{limits: proto.DefaultLimits}
 	} else {
-		client = &RemoteClient{}
+		client = &RemoteClient{limits: proto.DefaultLimits, options: opts}
 	}
 
-	err = client.Open(target, size)
+	err = client.Open(target, opts.Size)
 	if err != nil {
 		return nil, err
 	}
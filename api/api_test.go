@@ -0,0 +1,378 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/tracing"
+)
+
+func TestClientLimits(t *testing.T) {
+	client, err := NewClient(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recordingInstrumentation{}
+	client.Instrument(rec)
+	client.Limit(proto.Limits{MaxAppendSize: 4})
+
+	err = client.Append("/foo", []byte("too big"))
+	var limitErr proto.LimitError
+	if !errors.As(err, &limitErr) {
+		t.Errorf("expected a LimitError, got %v", err)
+	}
+
+	if len(rec.sent) != 0 {
+		t.Errorf("expected the oversized append not to be sent, got %v", rec.sent)
+	}
+
+	if err = client.Append("/foo", []byte("ok")); err != nil {
+		t.Errorf("expected append within limits to succeed, got %v", err)
+	}
+}
+
+func TestListTopicsPagination(t *testing.T) {
+	client, err := NewClient(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range []string{"/b", "/a", "/c", "/a", "/with space"} {
+		if err = client.Append(topic, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var topics []proto.TopicSummary
+	req := proto.ListTopicsRequest{Limit: 2}
+	for pages := 1; ; pages++ {
+		msg, err := client.Send(proto.NewMessageWithType(proto.CommandTopics, req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := proto.ListTopicsResponse{}
+		if err = resp.Unmarshal(msg.Data()); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Topics) > 2 {
+			t.Errorf("expected at most 2 topics per page, got %d", len(resp.Topics))
+		}
+		topics = append(topics, resp.Topics...)
+
+		if resp.Next == "" {
+			if pages != 3 {
+				t.Errorf("expected 3 pages, got %d", pages)
+			}
+			break
+		}
+		req.After = resp.Next
+	}
+
+	expected := []string{"/", "/a", "/b", "/c", "/with space"}
+	if len(topics) != len(expected) {
+		t.Fatalf("expected topics %v, got %v", expected, topics)
+	}
+	for i, topic := range topics {
+		if topic.Topic != expected[i] {
+			t.Errorf("expected topic %d to be %s, got %s", i, expected[i], topic.Topic)
+		}
+		if topic.Schema != "string" {
+			t.Errorf("expected %s to have schema string, got %s", topic.Topic, topic.Schema)
+		}
+	}
+	if topics[1].Count != 2 {
+		t.Errorf("expected 2 entries in /a, got %d", topics[1].Count)
+	}
+
+	// Prefixes narrow down the topics listed
+	msg, err := client.Send(proto.NewMessageWithType(proto.CommandTopics, proto.ListTopicsRequest{Prefix: "/w"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := proto.ListTopicsResponse{}
+	if err = resp.Unmarshal(msg.Data()); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Topics) != 1 || resp.Topics[0].Topic != "/with space" || resp.Next != "" {
+		t.Errorf("expected only /with space, got %+v", resp)
+	}
+}
+
+func TestCreateAndListTopics(t *testing.T) {
+	client, err := NewClient(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range [][2]string{{"/sensors", "float32"}, {"/sensors/temp", "float32"}, {"/logs", ""}} {
+		if err = client.CreateTopic(topic[0], topic[1]); err != nil {
+			t.Fatalf("creating %s: %s", topic[0], err)
+		}
+	}
+
+	if err = client.CreateTopic("/sensors/humidity", "string"); err == nil {
+		t.Error("expected a schema which conflicts with the parent to fail")
+	}
+
+	topics, err := client.ListTopics("/sensors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 2 || topics[0].Topic != "/sensors" || topics[1].Topic != "/sensors/temp" {
+		t.Fatalf("unexpected topics %+v", topics)
+	}
+	if topics[0].Schema != "float32" {
+		t.Errorf("expected /sensors to be float32, got %s", topics[0].Schema)
+	}
+
+	all, err := client.ListTopics("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Including the root topic
+	if len(all) != 4 {
+		t.Errorf("expected 4 topics, got %+v", all)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	client, err := NewClient(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.CreateTopic("/points", `{"x": int32, "y": enum("a", "b")}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = client.Validate("/points", []byte{1, 0, 0, 0, 1}); err != nil {
+		t.Errorf("expected a conforming payload to validate, got %s", err)
+	}
+	err = client.Validate("/points", []byte{1, 0, 0, 0, 9})
+	if err == nil || !strings.Contains(err.Error(), "key 'y'") {
+		t.Errorf("expected an error naming key y, got %v", err)
+	}
+
+	entries, err := client.Query("all in /points")
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected nothing to be appended, got %v, %v", entries, err)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	client, err := NewClient(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.CreateTopic("/counts", "int32"); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Append("/counts", []byte{1, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, next, err := client.Changes(0, 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) == 0 {
+		t.Fatal("expected changes")
+	}
+	last := changes[len(changes)-1]
+	if last.Kind != database.ChangeAppend || last.Topic != "/counts" || !bytes.Equal(last.Data, []byte{1, 0, 0, 0}) {
+		t.Errorf("expected the append to be the last change, got %+v", last)
+	}
+	if next != last.Offset+1 {
+		t.Errorf("expected next to follow %d, got %d", last.Offset, next)
+	}
+
+	changes, _, err = client.Changes(next, 0, time.Millisecond)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("expected no more changes, got %v, %v", changes, err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	client, err := NewClient(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rtt, err := client.Ping()
+	if err != nil || rtt <= 0 {
+		t.Errorf("expected a positive round trip, got %s, %v", rtt, err)
+	}
+}
+
+func TestAppendWithReceipt(t *testing.T) {
+	client, err := NewClient(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := client.AppendWithReceipt("/foo", []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.AppendWithReceipt("/foo", []byte("b"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Sequence <= first.Sequence || second.Time.Before(first.Time) || first.Duplicate {
+		t.Errorf("expected receipts in append order, got %+v then %+v", first, second)
+	}
+
+	// Receipts find the entries they were given for
+	entries, err := client.Query("all in /foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || !entries[1].Time.Equal(second.Time) || string(entries[1].Data) != "b" {
+		t.Errorf("expected the second entry to be at %s, got %+v", second.Time, entries)
+	}
+}
+
+func TestAppendStream(t *testing.T) {
+	client, err := NewClient(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.CreateTopic("/numbers", "int32"); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := client.AppendStream(StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = stream.Append("/foo", []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Appends the database rejects are reported asynchronously
+	if err = stream.Append("/numbers", []byte("not a number")); err != nil {
+		t.Fatal(err)
+	}
+	if err = stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var failed []*StreamError
+	for e := range stream.Errors() {
+		failed = append(failed, e)
+	}
+	if len(failed) != 1 || failed[0].Topic != "/numbers" {
+		t.Errorf("expected the append to /numbers to fail, got %v", failed)
+	}
+
+	entries, err := client.Query("all in /foo")
+	if err != nil || len(entries) != 10 {
+		t.Errorf("expected 10 entries, got %d, %v", len(entries), err)
+	}
+}
+
+func TestClientTracing(t *testing.T) {
+	client, err := NewClient(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &tracing.Recorder{}
+	client.Trace(recorder)
+
+	err = client.Append("/foo", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Query("all in /foo | bar")
+	if err == nil {
+		t.Fatal("expected a malformed query to fail")
+	}
+
+	spans := recorder.Spans()
+	expected := []struct{ name, parent string }{
+		{"fossil.client.send", "fossil.client.append"},
+		{"fossil.client.append", ""},
+		{"fossil.client.send", "fossil.client.query"},
+		{"fossil.client.query", ""},
+	}
+	if len(spans) != len(expected) {
+		t.Fatalf("expected %d spans, got %+v", len(expected), spans)
+	}
+	for i, e := range expected {
+		if spans[i].Name != e.name || spans[i].Parent != e.parent {
+			t.Errorf("expected span %d to be %s under %q, got %+v", i, e.name, e.parent, spans[i])
+		}
+	}
+	if spans[1].Attributes["fossil.topic"] != "/foo" || len(spans[1].Errors) != 0 {
+		t.Errorf("unexpected append span %+v", spans[1])
+	}
+	if len(spans[2].Errors) != 1 || len(spans[3].Errors) != 1 {
+		t.Errorf("expected the query's error to be recorded, got %+v", spans[2:])
+	}
+}
+
+func TestQueryWithMetadata(t *testing.T) {
+	client, err := NewClient(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = client.Append("/foo", []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, md, err := client.QueryWithMetadata("all in /foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || md.Matched != 3 || md.Returned != 3 || md.Truncated {
+		t.Errorf("expected 3 entries, got %d with metadata %+v", len(entries), md)
+	}
+	if md.End.Before(md.Start) {
+		t.Errorf("expected the range to end after it starts, got %+v", md)
+	}
+}
+
+func TestHandleNotices(t *testing.T) {
+	client, err := NewClient(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var notices []proto.Notice
+	client.HandleNotices(func(n proto.Notice) {
+		notices = append(notices, n)
+	})
+
+	if err = client.CreateTopic("/sensors", "int32"); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Append("/sensors", []byte{1, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if len(notices) != 0 {
+		t.Errorf("expected no notices appending to an existing topic, got %+v", notices)
+	}
+
+	if err = client.Append("/sensors/temp", []byte{1, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if len(notices) != 1 || notices[0].Level != proto.NoticeInfo || !strings.Contains(notices[0].Message, "int32") {
+		t.Errorf("expected a notice that /sensors/temp inherited int32, got %+v", notices)
+	}
+}
@@ -0,0 +1,31 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+// appendError returns the error resp holds, if it isn't the response req
+// expects: an AppendResponse if it asked for an acknowledgment, or an Ok
+func appendError(req proto.AppendRequest, resp proto.Message) error {
+	if req.Ack {
+		return responseError(proto.CommandAppend, resp)
+	}
+	return responseError(proto.CommandOk, resp)
+}
+
+// appendReceipt returns the receipt an AppendResponse holds
+func appendReceipt(resp proto.Message) (database.AppendReceipt, error) {
+	ack := proto.AppendResponse{}
+	err := proto.Unmarshal(resp.Data(), &ack)
+	if err != nil {
+		return database.AppendReceipt{}, err
+	}
+	return database.AppendReceipt{Time: ack.Time, Sequence: ack.Sequence, Duplicate: ack.Code == 208}, nil
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"time"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+// changes retrieves changes committed after from, using c to send the request
+func changes(c Client, from uint64, limit int, wait time.Duration) ([]database.Change, uint64, error) {
+	msg, err := c.Send(proto.NewMessageWithType(proto.CommandChanges, proto.ChangesRequest{
+		From:  from,
+		Limit: uint32(limit),
+		Wait:  wait,
+	}))
+	if err != nil {
+		return nil, from, err
+	}
+	err = responseError(proto.CommandChanges, msg)
+	if err != nil {
+		return nil, from, err
+	}
+
+	resp := proto.ChangesResponse{}
+	err = resp.Unmarshal(msg.Data())
+	if err != nil {
+		return nil, from, err
+	}
+	return resp.Changes, resp.Next, nil
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/query"
+	"github.com/dburkart/fossil/pkg/query/types"
+)
+
+// Database is a fossil database embedded in the calling program. Unlike a
+// LocalClient, it calls into the database directly, so nothing is marshaled
+// into or out of protocol messages along the way.
+type Database struct {
+	db *database.Database
+}
+
+// Result is an entry returned by a query on an embedded Database, with its
+// data decoded according to its schema
+type Result struct {
+	Time  time.Time
+	Topic string
+	// Schema is the schema the data was decoded with
+	Schema string
+	// Value holds the data, which is read with the accessors of pkg/query/types,
+	// such as types.IntVal or types.CompositeVal
+	Value types.Value
+}
+
+// OpenDatabase opens the fossil database at path, creating it if it doesn't
+// exist yet. The database is named after the last element of path.
+func OpenDatabase(path string) (*Database, error) {
+	return OpenDatabaseWithConfig(path, database.DefaultConfig)
+}
+
+// OpenDatabaseWithConfig opens the fossil database at path like OpenDatabase,
+// tuning its behavior with config.
+func OpenDatabaseWithConfig(path string, config database.Config) (*Database, error) {
+	db, err := database.NewDatabaseWithConfig(filepath.Base(path), path, config)
+	if err != nil {
+		return nil, err
+	}
+	return &Database{db: db}, nil
+}
+
+// Close flushes the database to disk. The Database shouldn't be used once it
+// has been closed.
+func (d *Database) Close() error {
+	return d.db.Flush()
+}
+
+// Append appends data to topic, creating the topic if it doesn't exist and
+// the database doesn't have strict topics. Data is in fossil's binary
+// encoding of the topic's schema; topic codecs only apply to clients.
+func (d *Database) Append(topic string, data []byte) error {
+	return d.AppendWithTTL(topic, data, 0)
+}
+
+// AppendWithTTL appends data to topic like Append, which expires once ttl has
+// passed.
+func (d *Database) AppendWithTTL(topic string, data []byte, ttl time.Duration) error {
+	if d.db.StrictTopics() && !d.db.TopicExists(topic) {
+		return database.ErrTopicNotFound
+	}
+	return d.db.AppendOrCreateWithTTL(data, topic, ttl)
+}
+
+// AppendWithReceipt appends data to topic like AppendWithTTL, returning the
+// time and sequence number it was appended with.
+func (d *Database) AppendWithReceipt(topic string, data []byte, ttl time.Duration) (database.AppendReceipt, error) {
+	if d.db.StrictTopics() && !d.db.TopicExists(topic) {
+		return database.AppendReceipt{}, database.ErrTopicNotFound
+	}
+	return d.db.AppendOrCreateWithReceipt(data, topic, ttl)
+}
+
+// CreateTopic creates a topic with the given schema, which defaults to string
+// if it's empty.
+func (d *Database) CreateTopic(topic, schema string) error {
+	_, err := d.db.CreateTopic(topic, schema, "")
+	return err
+}
+
+// SetTopicEncoding sets the encoding the data of topic is stored with on disk,
+// such as database.EncodingGorilla for float topics, or the empty string to
+// store data as it's appended.
+func (d *Database) SetTopicEncoding(topic, encoding string) error {
+	return d.db.SetTopicEncoding(topic, encoding)
+}
+
+// Query runs the query q, returning its results decoded into typed values.
+// Queries returning more results than the database allows fail with
+// query.ErrLimitExceeded.
+func (d *Database) Query(q string) ([]Result, error) {
+	entries, err := d.Entries(q)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, len(entries))
+	for i, entry := range entries {
+		results[i] = Result{
+			Time:   entry.Time,
+			Topic:  entry.Topic,
+			Schema: entry.Schema,
+			Value:  types.MakeFromEntry(entry),
+		}
+	}
+	return results, nil
+}
+
+// Entries runs the query q like Query, returning its results as the raw
+// entries a Client would receive.
+func (d *Database) Entries(q string) (database.Entries, error) {
+	stmt, err := query.Prepare(d.db, q)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.Execute()
+	if err = stmt.CheckResults(result); err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/dburkart/fossil/pkg/query/types"
+)
+
+func TestEmbeddedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := OpenDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.CreateTopic("/temp", "int32"); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []uint32{20, 21, 22} {
+		if err = db.Append("/temp", binary.LittleEndian.AppendUint32(nil, v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Append("/temp", []byte("not an int")); err == nil {
+		t.Error("expected data not matching the schema to be rejected")
+	}
+
+	results, err := db.Query("all in /temp | map x -> x * 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	for i, r := range results {
+		if r.Value.Kind() != types.Int || types.IntVal(r.Value) != int64(40+2*i) {
+			t.Errorf("expected result %d to be %d, got %v", i, 40+2*i, r.Value)
+		}
+	}
+
+	if _, err = db.Query("all in"); err == nil {
+		t.Error("expected an invalid query to fail")
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything appended survives reopening the database
+	db, err = OpenDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = db.Query("all in /temp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Topic != "/temp" || results[0].Schema != "int32" {
+		t.Errorf("expected the appended entries after reopening, got %v", results)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+// Instrumentation receives events from a Client as it talks to fossil, which
+// applications can use to monitor their usage. Implementations must be safe
+// for concurrent use, since a client pool sends messages from many goroutines.
+type Instrumentation interface {
+	// OnSend is called before a message with the given command is sent
+	OnSend(command string)
+	// OnResponse is called once a response is received, with the time taken
+	// for the round trip
+	OnResponse(command string, latency time.Duration)
+	// OnError is called when sending a message fails, or when the server
+	// responds with an error
+	OnError(command string, err error)
+	// OnPoolWait is called once a connection is taken from the pool, with the
+	// time spent waiting for it and the number of connections now in use out
+	// of the pool's size
+	OnPoolWait(wait time.Duration, inUse, size int)
+}
+
+// NopInstrumentation ignores all events. It can be embedded in types which
+// only care about a subset of the Instrumentation interface.
+type NopInstrumentation struct{}
+
+func (NopInstrumentation) OnSend(string)                      {}
+func (NopInstrumentation) OnResponse(string, time.Duration)   {}
+func (NopInstrumentation) OnError(string, error)              {}
+func (NopInstrumentation) OnPoolWait(time.Duration, int, int) {}
+
+func instrumentationOrNop(i Instrumentation) Instrumentation {
+	if i == nil {
+		return NopInstrumentation{}
+	}
+	return i
+}
+
+// observeResponse reports the outcome of sending a message with the given
+// command, which was sent at start
+func observeResponse(i Instrumentation, command string, start time.Time, resp proto.Message, err error) {
+	if err != nil {
+		i.OnError(command, err)
+		return
+	}
+
+	i.OnResponse(command, time.Since(start))
+
+	if resp.Command() == proto.CommandError {
+		e := proto.ErrResponse{}
+		if proto.Unmarshal(resp.Data(), &e) != nil || e.Err == nil {
+			e.Err = errors.New("unknown error")
+		}
+		i.OnError(command, e.Err)
+	}
+}
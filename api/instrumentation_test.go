@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type recordingInstrumentation struct {
+	NopInstrumentation
+	sent      []string
+	responses []string
+	errors    []string
+}
+
+func (r *recordingInstrumentation) OnSend(command string) {
+	r.sent = append(r.sent, command)
+}
+
+func (r *recordingInstrumentation) OnResponse(command string, _ time.Duration) {
+	r.responses = append(r.responses, command)
+}
+
+func (r *recordingInstrumentation) OnError(command string, _ error) {
+	r.errors = append(r.errors, command)
+}
+
+func TestInstrumentation(t *testing.T) {
+	client, err := NewClient(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recordingInstrumentation{}
+	client.Instrument(rec)
+
+	err = client.Append("/foo", []byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Send(proto.NewMessageWithType(proto.CommandStats, proto.StatsRequest{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.sent) != 2 || rec.sent[0] != proto.CommandAppend || rec.sent[1] != proto.CommandStats {
+		t.Errorf("expected APPEND and STATS to be sent, got %v", rec.sent)
+	}
+
+	if len(rec.responses) != 2 {
+		t.Errorf("expected 2 responses, got %v", rec.responses)
+	}
+
+	if len(rec.errors) != 1 || rec.errors[0] != proto.CommandStats {
+		t.Errorf("expected the unsupported STATS request to be reported as an error, got %v", rec.errors)
+	}
+}
+
+func TestPrometheusInstrumentation(t *testing.T) {
+	client, err := NewClient(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	client.Instrument(NewPrometheusInstrumentation(reg))
+
+	for i := 0; i < 3; i++ {
+		err = client.Append("/foo", []byte("bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]bool{}
+	for _, f := range families {
+		found[f.GetName()] = true
+		if f.GetName() != "fossil_client_requests" {
+			continue
+		}
+		m := f.GetMetric()
+		if len(m) != 1 || m[0].GetCounter().GetValue() != 3 {
+			t.Errorf("expected 3 APPEND requests, got %v", m)
+		}
+	}
+
+	for _, name := range []string{"fossil_client_requests", "fossil_client_response_ns"} {
+		if !found[name] {
+			t.Errorf("expected %s to be collected", name)
+		}
+	}
+}
@@ -7,26 +7,39 @@
 package fossil
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/dburkart/fossil/pkg/database"
 	"github.com/dburkart/fossil/pkg/proto"
 	"github.com/dburkart/fossil/pkg/server"
+	"github.com/dburkart/fossil/pkg/tracing"
+	"time"
 )
 
 type LocalClient struct {
-	target proto.ConnectionString
-	db     *database.Database
+	target          proto.ConnectionString
+	db              *database.Database
+	instrumentation Instrumentation
+	tracer          tracing.Tracer
+	limits          proto.Limits
+	notices         NoticeHandler
+	// opened is when the database was opened
+	opened time.Time
 }
 
 func (client *LocalClient) Open(target proto.ConnectionString, _ uint) error {
 	var err error
 
 	client.target = target
+	client.instrumentation = instrumentationOrNop(client.instrumentation)
+	client.tracer = tracing.OrNop(client.tracer)
+	client.notices = noticeHandlerOrNop(client.notices)
 	client.db, err = database.NewDatabase(target.Address, target.Database)
 	if err != nil {
 		return err
 	}
+	client.opened = time.Now()
 
 	return nil
 }
@@ -35,7 +48,44 @@ func (client *LocalClient) Close() error {
 	return nil
 }
 
+// Instrument sets the Instrumentation notified of the client's activity.
+// Local clients have no connection pool, so OnPoolWait is never called.
+func (client *LocalClient) Instrument(i Instrumentation) {
+	client.instrumentation = instrumentationOrNop(i)
+}
+
+// Trace sets the Tracer spans are created with around sending messages,
+// appending, and querying.
+func (client *LocalClient) Trace(t tracing.Tracer) {
+	client.tracer = tracing.OrNop(t)
+}
+
+// Limit sets the limits messages are checked against before they are sent.
+func (client *LocalClient) Limit(l proto.Limits) {
+	client.limits = l
+}
+
+// HandleNotices sets the handler called with notices about requests.
+func (client *LocalClient) HandleNotices(h NoticeHandler) {
+	client.notices = noticeHandlerOrNop(h)
+}
+
+// PoolStats returns an empty PoolStats, since local clients have no
+// connection pool.
+func (client *LocalClient) PoolStats() PoolStats {
+	return PoolStats{}
+}
+
 func (client *LocalClient) Send(message proto.Message) (proto.Message, error) {
+	return client.sendContext(context.Background(), message)
+}
+
+// sendContext sends message in a span which is a child of the one in ctx
+func (client *LocalClient) sendContext(ctx context.Context, message proto.Message) (proto.Message, error) {
+	return sendTraced(ctx, client.tracer, client.instrumentation, message, client.send)
+}
+
+func (client *LocalClient) send(message proto.Message) (proto.Message, error) {
 	switch message.Command() {
 	case proto.CommandVersion:
 		var versionReq proto.VersionRequest
@@ -50,21 +100,21 @@ func (client *LocalClient) Send(message proto.Message) (proto.Message, error) {
 		if err != nil {
 			return proto.MessageErrorUnmarshaling, nil
 		}
-		return server.ListResponse(listReq, client.db, nil), nil
+		return server.ListResponse(listReq, client.db, nil, nil), nil
 	case proto.CommandAppend:
 		var appendReq proto.AppendRequest
 		err := proto.Unmarshal(message.Data(), &appendReq)
 		if err != nil {
 			return proto.MessageErrorUnmarshaling, nil
 		}
-		return server.AppendResponse(appendReq, client.db), nil
+		return server.AppendResponseWithNotices(appendReq, client.db, client.notices), nil
 	case proto.CommandQuery:
 		var queryReq proto.QueryRequest
 		err := proto.Unmarshal(message.Data(), &queryReq)
 		if err != nil {
 			return proto.MessageErrorUnmarshaling, nil
 		}
-		return server.QueryResponse(queryReq, client.db), nil
+		return server.QueryResponseWithNotices(queryReq, client.db, client.notices), nil
 	case proto.CommandCreate:
 		var createReq proto.CreateTopicRequest
 		err := proto.Unmarshal(message.Data(), &createReq)
@@ -72,6 +122,69 @@ func (client *LocalClient) Send(message proto.Message) (proto.Message, error) {
 			return proto.MessageErrorUnmarshaling, nil
 		}
 		return server.CreateResponse(createReq, client.db), nil
+	case proto.CommandSchema:
+		var schemaReq proto.CreateSchemaRequest
+		err := proto.Unmarshal(message.Data(), &schemaReq)
+		if err != nil {
+			return proto.MessageErrorUnmarshaling, nil
+		}
+		return server.CreateSchemaResponse(schemaReq, client.db), nil
+	case proto.CommandTemplate:
+		var templateReq proto.CreateTemplateRequest
+		err := proto.Unmarshal(message.Data(), &templateReq)
+		if err != nil {
+			return proto.MessageErrorUnmarshaling, nil
+		}
+		return server.CreateTemplateResponse(templateReq, client.db), nil
+	case proto.CommandValidate:
+		var validateReq proto.ValidateRequest
+		err := proto.Unmarshal(message.Data(), &validateReq)
+		if err != nil {
+			return proto.MessageErrorUnmarshaling, nil
+		}
+		return server.ValidateResponse(validateReq, client.db), nil
+	case proto.CommandChanges:
+		var changesReq proto.ChangesRequest
+		err := proto.Unmarshal(message.Data(), &changesReq)
+		if err != nil {
+			return proto.MessageErrorUnmarshaling, nil
+		}
+		return server.ChangesResponse(context.Background(), changesReq, client.db, nil), nil
+	case proto.CommandPing:
+		var pingReq proto.PingRequest
+		err := proto.Unmarshal(message.Data(), &pingReq)
+		if err != nil {
+			return proto.MessageErrorUnmarshaling, nil
+		}
+		return server.PingResponse(pingReq), nil
+	case proto.CommandFlush:
+		var flushReq proto.FlushRequest
+		err := proto.Unmarshal(message.Data(), &flushReq)
+		if err != nil {
+			return proto.MessageErrorUnmarshaling, nil
+		}
+		return server.FlushResponse(flushReq, client.db), nil
+	case proto.CommandDescribe:
+		var describeReq proto.DescribeRequest
+		err := proto.Unmarshal(message.Data(), &describeReq)
+		if err != nil {
+			return proto.MessageErrorUnmarshaling, nil
+		}
+		return server.DescribeResponse(describeReq, client.db), nil
+	case proto.CommandTopics:
+		var topicsReq proto.ListTopicsRequest
+		err := proto.Unmarshal(message.Data(), &topicsReq)
+		if err != nil {
+			return proto.MessageErrorUnmarshaling, nil
+		}
+		return server.ListTopicsResponse(topicsReq, client.db, nil), nil
+	case proto.CommandDatabaseStatus:
+		var statusReq proto.DatabaseStatusRequest
+		err := proto.Unmarshal(message.Data(), &statusReq)
+		if err != nil {
+			return proto.MessageErrorUnmarshaling, nil
+		}
+		return server.DatabaseStatusResponse(statusReq, client.db, nil, time.Since(client.opened)), nil
 	case proto.CommandStats:
 		return proto.NewMessageWithType(
 			proto.CommandError,
@@ -91,42 +204,143 @@ func (client *LocalClient) Send(message proto.Message) (proto.Message, error) {
 }
 
 func (client *LocalClient) Append(topic string, data []byte) error {
-	appendMsg := proto.NewMessageWithType(proto.CommandAppend,
-		proto.AppendRequest{
-			Topic: topic,
-			Data:  data,
-		})
+	return client.AppendWithTTL(topic, data, 0)
+}
+
+// AppendWithTTL appends data to the specified topic, which expires once ttl
+// has passed.
+func (client *LocalClient) AppendWithTTL(topic string, data []byte, ttl time.Duration) (err error) {
+	ctx, span := client.tracer.Start(context.Background(), "fossil.client.append", tracing.String("fossil.topic", topic))
+	defer func() { endSpan(span, err) }()
 
-	resp, err := client.Send(appendMsg)
+	req := proto.AppendRequest{
+		Topic: topic,
+		Data:  data,
+		TTL:   ttl,
+	}
+	err = client.limits.CheckAppend(req)
 	if err != nil {
 		return err
 	}
 
-	ok := proto.OkResponse{}
-	err = ok.Unmarshal(resp.Data())
+	appendMsg := proto.NewMessageWithType(proto.CommandAppend, req)
+
+	resp, err := client.sendContext(ctx, appendMsg)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return responseError(proto.CommandOk, resp)
+}
+
+// AppendWithReceipt appends data to the specified topic like AppendWithTTL,
+// returning the time and sequence number it was appended with.
+func (client *LocalClient) AppendWithReceipt(topic string, data []byte, ttl time.Duration) (receipt database.AppendReceipt, err error) {
+	ctx, span := client.tracer.Start(context.Background(), "fossil.client.append", tracing.String("fossil.topic", topic))
+	defer func() { endSpan(span, err) }()
+
+	req := proto.AppendRequest{
+		Topic: topic,
+		Data:  data,
+		TTL:   ttl,
+		Ack:   true,
+	}
+	err = client.limits.CheckAppend(req)
+	if err != nil {
+		return receipt, err
+	}
+
+	resp, err := client.sendContext(ctx, proto.NewMessageWithType(proto.CommandAppend, req))
+	if err != nil {
+		return receipt, err
+	}
+	err = appendError(req, resp)
+	if err != nil {
+		return receipt, err
+	}
+	return appendReceipt(resp)
+}
+
+// AppendStream opens a stream of appends, which are appended one after
+// another in the background until the stream is closed.
+func (client *LocalClient) AppendStream(opts StreamOptions) (*AppendStream, error) {
+	s := newAppendStream(opts, client.limits)
+	go s.appendEach(func(req proto.AppendRequest) error {
+		return client.AppendWithTTL(req.Topic, req.Data, req.TTL)
+	})
+	return s, nil
+}
+
+// CreateTopic creates a topic with the given schema.
+func (client *LocalClient) CreateTopic(topic, schema string) error {
+	return createTopic(client, topic, schema)
+}
+
+// Validate checks whether data would be appended to topic, without
+// appending it.
+func (client *LocalClient) Validate(topic string, data []byte) error {
+	return validate(client, topic, data)
+}
+
+// Changes returns the changes committed to the database after from, waiting
+// up to wait for some if there are none.
+func (client *LocalClient) Changes(from uint64, limit int, wait time.Duration) ([]database.Change, uint64, error) {
+	return changes(client, from, limit, wait)
+}
+
+// Ping checks that the server is responding, returning the round trip time
+func (client *LocalClient) Ping() (time.Duration, error) {
+	return ping(client)
+}
+
+// ListTopics returns every topic starting with prefix, sorted by name.
+func (client *LocalClient) ListTopics(prefix string) ([]TopicInfo, error) {
+	return listTopics(client, prefix)
 }
 
 func (client *LocalClient) Query(q string) (database.Entries, error) {
+	resp, err := client.query(q, false)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
+}
+
+// QueryWithMetadata queries the database like Query, also returning metadata
+// describing the results. Results past the database's limit are truncated,
+// rather than failing the query.
+func (client *LocalClient) QueryWithMetadata(q string) (database.Entries, proto.QueryMetadata, error) {
+	resp, err := client.query(q, true)
+	if err != nil {
+		return nil, proto.QueryMetadata{}, err
+	}
+	if resp.Metadata == nil {
+		return resp.Results, proto.QueryMetadata{}, nil
+	}
+	return resp.Results, *resp.Metadata, nil
+}
+
+func (client *LocalClient) query(q string, metadata bool) (_ proto.QueryResponse, err error) {
+	ctx, span := client.tracer.Start(context.Background(), "fossil.client.query", tracing.String("fossil.query", q))
+	defer func() { endSpan(span, err) }()
+
 	queryMsg := proto.NewMessageWithType(proto.CommandQuery,
 		proto.QueryRequest{
-			Query: q,
+			Query:     q,
+			Metadata:  metadata,
+			Sequences: true,
 		})
 
-	resp, err := client.Send(queryMsg)
+	resp, err := client.sendContext(ctx, queryMsg)
 	if err != nil {
-		return nil, err
+		return proto.QueryResponse{}, err
 	}
-
-	queryResponse := proto.QueryResponse{}
-	err = queryResponse.Unmarshal(resp.Data())
+	err = responseError(proto.CommandQuery, resp)
 	if err != nil {
-		return nil, err
+		return proto.QueryResponse{}, err
 	}
 
-	return queryResponse.Results, nil
+	queryResponse := proto.QueryResponse{}
+	err = queryResponse.Unmarshal(resp.Data())
+	return queryResponse, err
 }
@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"io"
+
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+// A NoticeHandler is called with each notice the server sends, such as a
+// warning that a query's results were truncated. Remote clients call it from
+// whichever goroutine reads the response the notice was sent ahead of, so it
+// must be safe for concurrent use.
+type NoticeHandler func(proto.Notice)
+
+func noticeHandlerOrNop(h NoticeHandler) NoticeHandler {
+	if h == nil {
+		return func(proto.Notice) {}
+	}
+	return h
+}
+
+// readResponse reads the response to a message from r, passing any notices
+// sent ahead of it to handle. Notices sent between responses are read ahead
+// of the next one.
+func readResponse(r io.Reader, handle NoticeHandler) (proto.Message, error) {
+	for {
+		m, err := proto.ReadMessageFull(r)
+		if err != nil || m.Command() != proto.CommandNotice {
+			return m, err
+		}
+
+		n := proto.Notice{}
+		if proto.Unmarshal(m.Data(), &n) == nil {
+			handle(n)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"time"
+
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+// ping sends a ping using c, and returns the round trip time
+func ping(c Client) (time.Duration, error) {
+	sent := time.Now()
+	msg, err := c.Send(proto.NewMessageWithType(proto.CommandPing, proto.PingRequest{Sent: sent}))
+	if err != nil {
+		return 0, err
+	}
+	err = responseError(proto.CommandPing, msg)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(sent), nil
+}
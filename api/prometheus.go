@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"time"
+
+	"github.com/dburkart/fossil/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// PrometheusInstrumentation is an Instrumentation which records client
+// activity as prometheus metrics.
+type PrometheusInstrumentation struct {
+	Requests   *prometheus.CounterVec
+	Errors     *prometheus.CounterVec
+	ResponseNS *prometheus.HistogramVec
+	PoolWaitNS prometheus.Histogram
+	PoolInUse  prometheus.Gauge
+	PoolSize   prometheus.Gauge
+}
+
+// NewPrometheusInstrumentation creates a PrometheusInstrumentation, registering
+// its metrics with reg. If reg is nil, prometheus.DefaultRegisterer is used.
+func NewPrometheusInstrumentation(reg prometheus.Registerer) *PrometheusInstrumentation {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	buckets := []float64{}
+	for i := 1; i < 20; i++ {
+		buckets = append(buckets, float64(2*i*int(time.Millisecond)))
+	}
+
+	factory := promauto.With(reg)
+	return &PrometheusInstrumentation{
+		Requests: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "fossil_client_requests",
+			Help: "Requests sent by the fossil client, by command",
+		}, []string{server.CommandLabel}),
+		Errors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "fossil_client_errors",
+			Help: "Failed requests and error responses seen by the fossil client, by command",
+		}, []string{server.CommandLabel}),
+		ResponseNS: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "fossil_client_response_ns",
+			Help:    "Round trip times of requests sent by the fossil client",
+			Buckets: buckets,
+		}, []string{server.CommandLabel}),
+		PoolWaitNS: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "fossil_client_pool_wait_ns",
+			Help:    "Time spent waiting for a connection from the client pool",
+			Buckets: buckets,
+		}),
+		PoolInUse: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "fossil_client_pool_in_use",
+			Help: "Connections in the client pool which are currently in use",
+		}),
+		PoolSize: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "fossil_client_pool_size",
+			Help: "Total connections in the client pool",
+		}),
+	}
+}
+
+func (p *PrometheusInstrumentation) OnSend(command string) {
+	p.Requests.With(prometheus.Labels{server.CommandLabel: command}).Inc()
+}
+
+func (p *PrometheusInstrumentation) OnResponse(command string, latency time.Duration) {
+	p.ResponseNS.
+		With(prometheus.Labels{server.CommandLabel: command}).
+		Observe(float64(latency.Nanoseconds()))
+}
+
+func (p *PrometheusInstrumentation) OnError(command string, _ error) {
+	p.Errors.With(prometheus.Labels{server.CommandLabel: command}).Inc()
+}
+
+func (p *PrometheusInstrumentation) OnPoolWait(wait time.Duration, inUse, size int) {
+	p.PoolWaitNS.Observe(float64(wait.Nanoseconds()))
+	p.PoolInUse.Set(float64(inUse))
+	p.PoolSize.Set(float64(size))
+}
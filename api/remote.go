@@ -7,199 +7,632 @@
 package fossil
 
 import (
+	"context"
 	"github.com/dburkart/fossil/pkg/database"
 	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/tracing"
 	"github.com/pkg/errors"
 	"io"
-	"math"
 	"net"
+	"sync"
 	"syscall"
 	"time"
 )
 
+var (
+	// ErrPoolClosed is returned for requests sent once a client is closed
+	ErrPoolClosed = errors.New("client pool is closed")
+	// ErrPoolUnavailable is returned for requests which time out waiting for
+	// a connection because every connection in the pool is broken
+	ErrPoolUnavailable = errors.New("no connection to the server is available")
+)
+
+// maxReconnectDelay caps how long the pool waits between attempts to replace
+// a broken connection
+const maxReconnectDelay = time.Minute
+
 // A RemoteClient holds the data needed to interact with a fossil database.
 type RemoteClient struct {
-	target proto.ConnectionString
-	conn   chan net.Conn
+	target          proto.ConnectionString
+	options         PoolOptions
+	conn            chan net.Conn
+	instrumentation Instrumentation
+	tracer          tracing.Tracer
+	limits          proto.Limits
+	notices         NoticeHandler
+
+	// server is the VERSION response of the server, from the most recent
+	// connection to it
+	server proto.VersionResponse
+
+	// mu guards closed, broken and server, and is held while returning connections to
+	// the pool so they aren't returned to a closed one
+	mu     sync.Mutex
+	closed bool
+	broken int
+	// done is closed when the client is
+	done chan struct{}
+	// replace has an element for each broken connection the replacer hasn't
+	// started replacing yet
+	replace chan struct{}
+
+	// spool holds appends made while the server couldn't be reached, if
+	// spooling is configured, and spooled wakes the goroutine replaying them
+	spool   *database.Spool
+	spooled chan struct{}
 }
 
 // FIXME: Refactor this into a common Use() API
-func connect(c net.Conn, dbName string) (proto.OkResponse, error) {
+func connect(c net.Conn, dbName string, token string, notices NoticeHandler) (proto.VersionResponse, error) {
 	// First, send a version advertisement
-	versionMsg := proto.NewMessageWithType(proto.CommandVersion, proto.VersionRequest{})
+	versionMsg := proto.NewMessageWithType(proto.CommandVersion, proto.VersionRequest{Compression: proto.SupportedCompression})
 	b, _ := versionMsg.Marshal()
 	c.Write(b)
 	m, err := proto.ReadMessageFull(c)
 	if err != nil {
-		return proto.OkResponse{}, errors.Wrap(err, "unable to parse server version response")
+		return proto.VersionResponse{}, errors.Wrap(err, "unable to parse server version response")
 	}
 	version := proto.VersionResponse{}
 	err = version.Unmarshal(m.Data())
 	if err != nil {
-		return proto.OkResponse{}, errors.Wrap(err, "unable to unmarshal version response")
+		return proto.VersionResponse{}, errors.Wrap(err, "unable to unmarshal version response")
+	}
+	if err = proto.CheckServerVersion(version); err != nil {
+		return proto.VersionResponse{}, err
 	}
 	if version.Code != 200 {
-		return proto.OkResponse{}, errors.New("server rejected client version")
+		return proto.VersionResponse{}, errors.New("server rejected client version")
+	}
+	// Large responses may now be compressed, but ReadMessageFull decompresses
+	// them for us.
+
+	// Connections to the admin port authenticate before anything else
+	if token != "" {
+		authMsg := proto.NewMessageWithType(proto.CommandAuth, proto.AuthRequest{Token: token})
+		b, _ = authMsg.Marshal()
+		c.Write(b)
+		m, err = readResponse(c, notices)
+		if err != nil {
+			return proto.VersionResponse{}, errors.Wrap(err, "unable to parse server auth response")
+		}
+		if m.Command() == proto.CommandError {
+			e := proto.ErrResponse{}
+			if err = e.Unmarshal(m.Data()); err != nil {
+				return proto.VersionResponse{}, errors.Wrap(err, "unable to unmarshal auth response")
+			}
+			return proto.VersionResponse{}, errors.Wrap(e.Err, "server rejected authentication")
+		}
 	}
-	// We don't have any version logic yet
 
 	// Send the server use message
 	useMsg := proto.NewMessageWithType(proto.CommandUse, proto.UseRequest{DbName: dbName})
 	b, _ = useMsg.Marshal()
 	c.Write(b)
-	m, err = proto.ReadMessageFull(c)
+	m, err = readResponse(c, notices)
 	if err != nil {
-		return proto.OkResponse{}, errors.Wrap(err, "unable to parse server use response")
+		return proto.VersionResponse{}, errors.Wrap(err, "unable to parse server use response")
 	}
 	ok := proto.OkResponse{}
 	err = ok.Unmarshal(m.Data())
 	if err != nil {
-		return proto.OkResponse{}, errors.Wrap(err, "unable to unmarshal ok response")
+		return proto.VersionResponse{}, errors.Wrap(err, "unable to unmarshal ok response")
 	}
 
-	return ok, nil
+	return version, nil
 }
 
-func (client *RemoteClient) reconnectWithBackoff() (net.Conn, error) {
-	var conn net.Conn
-	var err error
-
-	// Try for a total of 6 seconds
-	for i := 0; i < 3; i++ {
-		delay := time.Duration(math.Exp2(float64(i)))
-		time.Sleep(delay * time.Second)
-		conn, err = net.Dial("tcp4", client.target.Address)
-
-		if err == nil {
-			_, err = connect(conn, client.target.Database)
-			if err != nil {
-				conn.Close()
-				continue
-			}
-			break
-		}
+// dial opens a connection to the target database
+func (client *RemoteClient) dial() (net.Conn, error) {
+	network := client.target.Network
+	if network == "" {
+		network = "tcp"
 	}
-
-	return conn, err
+	c, err := net.Dial(network, client.target.Address)
+	if err != nil {
+		return nil, err
+	}
+	version, err := connect(c, client.target.Database, client.target.Token, client.notices)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	client.mu.Lock()
+	client.server = version
+	client.mu.Unlock()
+	return c, nil
 }
 
 func (client *RemoteClient) Open(connectionString proto.ConnectionString, size uint) error {
 	client.target = connectionString
+	if client.options.Size == 0 {
+		client.options.Size = size
+	}
+	client.options = client.options.withDefaults()
 	client.conn = make(chan net.Conn, size)
+	client.done = make(chan struct{})
+	client.replace = make(chan struct{}, size)
+	client.instrumentation = instrumentationOrNop(client.instrumentation)
+	client.tracer = tracing.OrNop(client.tracer)
+	client.notices = noticeHandlerOrNop(client.notices)
 
-	for i := uint(0); i < size; i++ {
-		c, err := net.Dial("tcp4", client.target.Address)
+	if client.options.Spool.Path != "" {
+		spool, err := database.OpenSpool(client.options.Spool.Path, client.options.Spool.MaxSize, client.options.Spool.DropPolicy)
 		if err != nil {
-			return err
+			return errors.Wrap(err, "unable to open spool")
 		}
-		_, err = connect(c, client.target.Database)
+		client.spool = spool
+		client.spooled = make(chan struct{}, 1)
+	}
+
+	// A client with a spool is usable while the server is down, so it always
+	// degrades, even to nothing
+	degrade := client.options.Degrade || client.spool != nil
+
+	var openErr error
+	for i := uint(0); i < size; i++ {
+		c, err := client.dial()
 		if err != nil {
-			return err
+			openErr = errors.Wrapf(err, "unable to open connection %d of %d", i+1, size)
+			if !degrade {
+				break
+			}
+			client.broken++
+			continue
 		}
 		client.conn <- c
 	}
 
+	// Degrading is only worthwhile if there's something left to degrade to
+	if openErr != nil && (!degrade || (len(client.conn) == 0 && client.spool == nil)) {
+		client.closed = true
+		close(client.done)
+		client.closeIdle()
+		return openErr
+	}
+
+	for i := 0; i < client.broken; i++ {
+		client.replace <- struct{}{}
+	}
+	go client.replaceBroken()
+
+	if client.spool != nil {
+		go client.replaySpool()
+		if client.spool.Len() > 0 {
+			client.wakeSpool()
+		}
+	}
+
 	return nil
 }
 
-func (client *RemoteClient) Close() error {
-	for i := 0; i < len(client.conn); i++ {
-		conn := <-client.conn
-		err := conn.Close()
-		if err != nil {
+// replaceBroken redials broken connections until the client is closed,
+// backing off while the server can't be reached
+func (client *RemoteClient) replaceBroken() {
+	for {
+		select {
+		case <-client.done:
+			return
+		case <-client.replace:
+		}
+
+		delay := client.options.ReconnectDelay
+		for {
+			c, err := client.dial()
+			if err == nil {
+				client.mu.Lock()
+				client.broken--
+				client.mu.Unlock()
+				client.release(c)
+				break
+			}
+
+			select {
+			case <-client.done:
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		}
+	}
+}
+
+// acquire takes a connection from the pool, waiting for one if they're all
+// in use
+func (client *RemoteClient) acquire() (net.Conn, error) {
+	waitStart := time.Now()
+	timeout := time.NewTimer(client.options.WaitTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case conn := <-client.conn:
+			stats := client.PoolStats()
+			client.instrumentation.OnPoolWait(time.Since(waitStart), stats.Active, stats.Target)
+			return conn, nil
+		case <-client.done:
+			return nil, ErrPoolClosed
+		case <-timeout.C:
+			// Connections in use will be returned eventually, so only give up
+			// if there are none
+			if client.PoolStats().Broken < cap(client.conn) {
+				timeout.Reset(client.options.WaitTimeout)
+				continue
+			}
+			return nil, ErrPoolUnavailable
+		}
+	}
+}
+
+// release returns a connection to the pool, or closes it if the client has
+// been closed
+func (client *RemoteClient) release(conn net.Conn) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.closed {
+		conn.Close()
+		return
+	}
+	client.conn <- conn
+}
+
+// discard closes a connection which has failed, and has it replaced in the
+// background
+func (client *RemoteClient) discard(conn net.Conn) {
+	conn.Close()
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.broken++
+	client.replace <- struct{}{}
+}
+
+// closeIdle closes the connections waiting in the pool
+func (client *RemoteClient) closeIdle() error {
+	var err error
+	for {
+		select {
+		case conn := <-client.conn:
+			if closeErr := conn.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		default:
 			return err
 		}
 	}
-	client.conn = nil
-	return nil
+}
+
+// Close closes the client's idle connections, and any in use once their
+// requests are done.
+func (client *RemoteClient) Close() error {
+	client.mu.Lock()
+	if client.closed {
+		client.mu.Unlock()
+		return nil
+	}
+	client.closed = true
+	close(client.done)
+	client.mu.Unlock()
+
+	return client.closeIdle()
+}
+
+// PoolStats returns a snapshot of the client's connection pool.
+func (client *RemoteClient) PoolStats() PoolStats {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	stats := PoolStats{
+		Target: cap(client.conn),
+		Idle:   len(client.conn),
+		Broken: client.broken,
+	}
+	stats.Active = stats.Target - stats.Idle - stats.Broken
+	if stats.Active < 0 {
+		stats.Active = 0
+	}
+	return stats
+}
+
+// Instrument sets the Instrumentation notified of the client's activity.
+func (client *RemoteClient) Instrument(i Instrumentation) {
+	client.instrumentation = instrumentationOrNop(i)
+}
+
+// Trace sets the Tracer spans are created with around sending messages,
+// appending, and querying.
+func (client *RemoteClient) Trace(t tracing.Tracer) {
+	client.tracer = tracing.OrNop(t)
+}
+
+// Limit sets the limits messages are checked against before they are sent.
+func (client *RemoteClient) Limit(l proto.Limits) {
+	client.limits = l
+}
+
+// HandleNotices sets the handler called with the notices the server sends.
+func (client *RemoteClient) HandleNotices(h NoticeHandler) {
+	client.notices = noticeHandlerOrNop(h)
+}
+
+// ServerVersion returns the VERSION response of the server, with the version
+// of the protocol it speaks and its capabilities.
+func (client *RemoteClient) ServerVersion() proto.VersionResponse {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.server
+}
+
+// Supports returns whether the server supports capability, one of the
+// proto.Capability constants.
+func (client *RemoteClient) Supports(capability string) bool {
+	return client.ServerVersion().Supports(capability)
+}
+
+// unsupported returns the error for a command the server doesn't support
+func unsupported(command string) error {
+	return errors.Errorf("server doesn't support %s; upgrade the server", command)
 }
 
 // Send a general message to the fossil server.
 func (client *RemoteClient) Send(m proto.Message) (proto.Message, error) {
-	data, err := m.Marshal()
+	return client.sendContext(context.Background(), m)
+}
+
+// sendContext sends m in a span which is a child of the one in ctx
+func (client *RemoteClient) sendContext(ctx context.Context, m proto.Message) (proto.Message, error) {
+	return sendTraced(ctx, client.tracer, client.instrumentation, m, client.send)
+}
+
+func (client *RemoteClient) send(m proto.Message) (proto.Message, error) {
+	return client.sendRetrying(m, true)
+}
+
+// sendRetrying sends m, retrying it as the client's RetryPolicy allows if
+// retry is set
+func (client *RemoteClient) sendRetrying(m proto.Message, retry bool) (proto.Message, error) {
+	err := client.limits.CheckMessage(len(m.Data()))
 	if err != nil {
 		return nil, err
 	}
 
-	conn := <-client.conn
-	defer func() {
-		client.conn <- conn
-	}()
+	// Each request is sent with an ID, which the server logs it under and
+	// returns with the response, if it understands them
+	if m.RequestID() == "" && client.Supports(proto.CapabilityRequestIDs) {
+		m = proto.WithRequestID(m, proto.NewRequestID())
+	}
 
-retry:
-	_, err = conn.Write(data)
+	data, err := m.Marshal()
 	if err != nil {
-		// Handle peer reset with reconnect logic
-		if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
-			conn, err = client.reconnectWithBackoff()
-			if err != nil {
-				return nil, err
-			}
-			// We use a goto here because we need to retry sending our message,
-			// however, if we recursively call Send() we'll end up with a
-			// duplicated net.Conn in our connection pool.
-			goto retry
-		} else {
+		return nil, err
+	}
+
+	// A lost connection is replaced and the message retried on another. If
+	// the server went away, every connection in the pool may have been lost,
+	// so by default each gets a chance before giving up.
+	policy := client.options.Retry
+	for attempt := 1; ; attempt++ {
+		resp, err := client.attempt(data)
+		if err == nil {
+			return resp, nil
+		}
+		if !retry || attempt >= policy.MaxAttempts || !policy.retries(err) {
 			return nil, err
 		}
-	}
 
-	resp, err := proto.ReadMessageFull(conn)
-	if err != nil {
-		if errors.Is(err, io.EOF) {
-			conn, err = client.reconnectWithBackoff()
-			if err != nil {
-				return nil, err
+		if delay := policy.backoff(attempt); delay > 0 {
+			select {
+			case <-client.done:
+				return nil, ErrPoolClosed
+			case <-time.After(delay):
 			}
-			// We use a goto here because we need to retry sending our message,
-			// however, if we recursively call Send() we'll end up with a
-			// duplicated net.Conn in our connection pool.
-			goto retry
 		}
+	}
+}
+
+// attempt sends a marshaled message on a connection from the pool, and reads
+// the response. A connection which is lost is discarded.
+func (client *RemoteClient) attempt(data []byte) (proto.Message, error) {
+	conn, err := client.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.roundTrip(conn, data)
+	if err != nil && isConnectionLost(err) {
+		client.discard(conn)
+		return nil, err
+	}
+	client.release(conn)
+	return resp, err
+}
+
+// roundTrip writes a marshaled message to conn, and reads the response
+func (client *RemoteClient) roundTrip(conn net.Conn, data []byte) (proto.Message, error) {
+	_, err := conn.Write(data)
+	if err != nil {
 		return nil, err
 	}
-	return resp, nil
+	return readResponse(conn, client.notices)
+}
+
+// isConnectionLost returns true if err means the connection it happened on
+// can't be used any more
+func isConnectionLost(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed)
 }
 
 // Append data to the specified topic.
 func (client *RemoteClient) Append(topic string, data []byte) error {
-	appendMsg := proto.NewMessageWithType(proto.CommandAppend,
-		proto.AppendRequest{
-			Topic: topic,
-			Data:  data,
-		})
+	return client.AppendWithTTL(topic, data, 0)
+}
+
+// AppendWithTTL appends data to the specified topic, which expires once ttl
+// has passed.
+func (client *RemoteClient) AppendWithTTL(topic string, data []byte, ttl time.Duration) (err error) {
+	ctx, span := client.tracer.Start(context.Background(), "fossil.client.append", tracing.String("fossil.topic", topic))
+	defer func() { endSpan(span, err) }()
 
-	resp, err := client.Send(appendMsg)
+	req := proto.AppendRequest{
+		Topic: topic,
+		Data:  data,
+		TTL:   ttl,
+	}
+	err = client.limits.CheckAppend(req)
 	if err != nil {
 		return err
 	}
 
-	ok := proto.OkResponse{}
-	err = ok.Unmarshal(resp.Data())
+	// Appends queue up behind any which are already spooled, so that they
+	// reach the server in order
+	if client.spool != nil && client.spool.Len() > 0 {
+		return client.spoolAppend(req)
+	}
+
+	_, err = client.sendAppend(ctx, &req)
+	if client.spool != nil && client.spools(err, req) {
+		return client.spoolAppend(req)
+	}
+	return err
+}
+
+// AppendWithReceipt appends data to the specified topic like AppendWithTTL,
+// returning the time and sequence number the server appended it with.
+// Appends which need a receipt aren't spooled, since they haven't been
+// appended until they reach the server.
+func (client *RemoteClient) AppendWithReceipt(topic string, data []byte, ttl time.Duration) (receipt database.AppendReceipt, err error) {
+	if !client.Supports(proto.CapabilityAppendAcks) {
+		return receipt, unsupported("append acknowledgments")
+	}
+
+	ctx, span := client.tracer.Start(context.Background(), "fossil.client.append", tracing.String("fossil.topic", topic))
+	defer func() { endSpan(span, err) }()
+
+	req := proto.AppendRequest{
+		Topic: topic,
+		Data:  data,
+		TTL:   ttl,
+		Ack:   true,
+	}
+	err = client.limits.CheckAppend(req)
 	if err != nil {
-		return err
+		return receipt, err
 	}
 
-	return nil
+	resp, err := client.sendAppend(ctx, &req)
+	if err != nil {
+		return receipt, err
+	}
+	return appendReceipt(resp)
+}
+
+// sendAppend sends req, giving it an idempotency key if the server supports
+// them and it doesn't have one
+func (client *RemoteClient) sendAppend(ctx context.Context, req *proto.AppendRequest) (proto.Message, error) {
+	// An append whose connection was lost may have landed anyway, so it's
+	// only safe to retry if the server can tell it's been retried
+	if req.IdempotencyKey == "" && client.Supports(proto.CapabilityIdempotentAppends) {
+		req.IdempotencyKey = proto.NewIdempotencyKey()
+	}
+	retry := req.IdempotencyKey != "" || client.options.Retry.UnsafeAppends
+
+	appendMsg := proto.NewMessageWithType(proto.CommandAppend, *req)
+
+	resp, err := sendTraced(ctx, client.tracer, client.instrumentation, appendMsg, func(m proto.Message) (proto.Message, error) {
+		return client.sendRetrying(m, retry)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, appendError(*req, resp)
+}
+
+// CreateTopic creates a topic with the given schema.
+func (client *RemoteClient) CreateTopic(topic, schema string) error {
+	return createTopic(client, topic, schema)
+}
+
+// Validate checks whether data would be appended to topic, without
+// appending it.
+func (client *RemoteClient) Validate(topic string, data []byte) error {
+	if !client.Supports(proto.CapabilityValidate) {
+		return unsupported(proto.CommandValidate)
+	}
+	return validate(client, topic, data)
+}
+
+// Changes returns the changes committed to the database after from, waiting
+// up to wait for some if there are none.
+func (client *RemoteClient) Changes(from uint64, limit int, wait time.Duration) ([]database.Change, uint64, error) {
+	if !client.Supports(proto.CapabilityChanges) {
+		return nil, 0, unsupported(proto.CommandChanges)
+	}
+	return changes(client, from, limit, wait)
+}
+
+// Ping checks that the server is responding, returning the round trip time
+func (client *RemoteClient) Ping() (time.Duration, error) {
+	if !client.Supports(proto.CapabilityPing) {
+		return 0, unsupported(proto.CommandPing)
+	}
+	return ping(client)
+}
+
+// ListTopics returns every topic starting with prefix, sorted by name.
+func (client *RemoteClient) ListTopics(prefix string) ([]TopicInfo, error) {
+	return listTopics(client, prefix)
 }
 
 // Query the database for some time-series data.
 func (client *RemoteClient) Query(q string) (database.Entries, error) {
+	resp, err := client.query(q, false)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
+}
+
+// QueryWithMetadata queries the database like Query, also returning metadata
+// describing the results. Results past the database's limit are truncated,
+// rather than failing the query.
+func (client *RemoteClient) QueryWithMetadata(q string) (database.Entries, proto.QueryMetadata, error) {
+	resp, err := client.query(q, true)
+	if err != nil {
+		return nil, proto.QueryMetadata{}, err
+	}
+	if resp.Metadata == nil {
+		return resp.Results, proto.QueryMetadata{}, nil
+	}
+	return resp.Results, *resp.Metadata, nil
+}
+
+func (client *RemoteClient) query(q string, metadata bool) (_ proto.QueryResponse, err error) {
+	ctx, span := client.tracer.Start(context.Background(), "fossil.client.query", tracing.String("fossil.query", q))
+	defer func() { endSpan(span, err) }()
+
 	queryMsg := proto.NewMessageWithType(proto.CommandQuery,
 		proto.QueryRequest{
-			Query: q,
+			Query:     q,
+			Metadata:  metadata,
+			Sequences: true,
 		})
 
-	resp, err := client.Send(queryMsg)
+	resp, err := client.sendContext(ctx, queryMsg)
 	if err != nil {
-		return nil, err
+		return proto.QueryResponse{}, err
 	}
-
-	queryResponse := proto.QueryResponse{}
-	err = queryResponse.Unmarshal(resp.Data())
+	err = responseError(proto.CommandQuery, resp)
 	if err != nil {
-		return nil, err
+		return proto.QueryResponse{}, err
 	}
 
-	return queryResponse.Results, nil
+	queryResponse := proto.QueryResponse{}
+	err = queryResponse.Unmarshal(resp.Data())
+	return queryResponse, err
 }
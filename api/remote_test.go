@@ -0,0 +1,542 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/server"
+)
+
+// fakeServer answers version requests, and every other message with OK. It
+// stops accepting connections after accepting maxConns, if that's non-zero.
+type fakeServer struct {
+	listener net.Listener
+	maxConns int
+	mu       sync.Mutex
+	conns    []net.Conn
+	// capabilities, if set, replaces the capabilities the server advertises
+	capabilities []string
+	// appends records every append received
+	appends []proto.AppendRequest
+	// dropAppends is the number of appends to drop the connection after
+	// receiving, rather than responding to
+	dropAppends int
+	// notice, if set, is sent ahead of the response to every message other
+	// than version requests
+	notice *proto.Notice
+}
+
+func newFakeServer(t *testing.T, maxConns int) *fakeServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startFakeServer(t, l, maxConns)
+}
+
+func startFakeServer(t *testing.T, l net.Listener, maxConns int) *fakeServer {
+	s := &fakeServer{listener: l, maxConns: maxConns}
+	t.Cleanup(func() {
+		l.Close()
+		s.dropConnections()
+	})
+
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) connectionString() string {
+	if s.listener.Addr().Network() == "unix" {
+		return "fossil+unix://" + s.listener.Addr().String() + "/default"
+	}
+	return "fossil://" + s.listener.Addr().String() + "/default"
+}
+
+func (s *fakeServer) serve() {
+	for accepted := 1; ; accepted++ {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		if accepted == s.maxConns {
+			s.listener.Close()
+		}
+
+		s.mu.Lock()
+		s.conns = append(s.conns, c)
+		s.mu.Unlock()
+
+		go func() {
+			for {
+				m, err := proto.ReadMessageFull(c)
+				if err != nil {
+					return
+				}
+				resp := proto.MessageOk
+				if m.Command() == proto.CommandVersion {
+					var v proto.VersionRequest
+					v.Unmarshal(m.Data())
+					resp = server.VersionResponse(v)
+					s.mu.Lock()
+					if s.capabilities != nil {
+						var version proto.VersionResponse
+						version.Unmarshal(resp.Data())
+						version.Capabilities = s.capabilities
+						resp = proto.NewMessageWithType(proto.CommandVersion, version)
+					}
+					s.mu.Unlock()
+				}
+				if m.Command() == proto.CommandAppend && s.receiveAppend(m) {
+					c.Close()
+					return
+				}
+				s.mu.Lock()
+				if s.notice != nil && m.Command() != proto.CommandVersion {
+					b, _ := proto.NewMessageWithType(proto.CommandNotice, *s.notice).Marshal()
+					c.Write(b)
+				}
+				s.mu.Unlock()
+				b, _ := resp.Marshal()
+				c.Write(b)
+			}
+		}()
+	}
+}
+
+// receiveAppend records an append, returning true if its connection should
+// be dropped instead of responding to it
+func (s *fakeServer) receiveAppend(m proto.Message) bool {
+	var a proto.AppendRequest
+	a.Unmarshal(m.Data())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.appends = append(s.appends, a)
+	if s.dropAppends > 0 {
+		s.dropAppends--
+		return true
+	}
+	return false
+}
+
+// dropConnections closes every connection the server has accepted
+func (s *fakeServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func waitForStats(t *testing.T, client Client, want PoolStats) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.PoolStats() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected pool stats %+v, got %+v", want, client.PoolStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientPoolReplacesBrokenConnections(t *testing.T) {
+	s := newFakeServer(t, 0)
+
+	client, err := NewClientPoolWithOptions(s.connectionString(), PoolOptions{Size: 3, ReconnectDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if stats := client.PoolStats(); stats != (PoolStats{Target: 3, Idle: 3}) {
+		t.Errorf("expected 3 idle connections, got %+v", stats)
+	}
+
+	s.dropConnections()
+
+	// Every connection in the pool is dead, but the append should still make
+	// it through on a replacement
+	err = client.Append("/foo", []byte("data"))
+	if err != nil {
+		t.Fatalf("expected append to succeed on a replaced connection, got %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		client.Append("/foo", []byte("data"))
+	}
+	waitForStats(t, client, PoolStats{Target: 3, Idle: 3})
+}
+
+func TestClientUnixSocket(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "fossil.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startFakeServer(t, l, 0)
+
+	client, err := NewClient(s.connectionString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err = client.Append("/foo", []byte("data"))
+	if err != nil {
+		t.Errorf("expected append over a unix socket to succeed, got %v", err)
+	}
+}
+
+func TestClientPoolFailFast(t *testing.T) {
+	s := newFakeServer(t, 1)
+
+	_, err := NewClientPool(s.connectionString(), 3)
+	if err == nil {
+		t.Fatal("expected opening a pool larger than the server allows to fail")
+	}
+}
+
+func TestClientPoolDegrade(t *testing.T) {
+	s := newFakeServer(t, 1)
+
+	client, err := NewClientPoolWithOptions(s.connectionString(), PoolOptions{Size: 3, Degrade: true, ReconnectDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("expected a degraded pool, got %v", err)
+	}
+
+	if stats := client.PoolStats(); stats != (PoolStats{Target: 3, Idle: 1, Broken: 2}) {
+		t.Errorf("expected 1 idle and 2 broken connections, got %+v", stats)
+	}
+
+	err = client.Append("/foo", []byte("data"))
+	if err != nil {
+		t.Errorf("expected append on a degraded pool to succeed, got %v", err)
+	}
+
+	client.Close()
+	err = client.Append("/foo", []byte("data"))
+	if err != ErrPoolClosed {
+		t.Errorf("expected ErrPoolClosed once closed, got %v", err)
+	}
+}
+
+func TestClientPoolUnavailable(t *testing.T) {
+	s := newFakeServer(t, 1)
+
+	client, err := NewClientPoolWithOptions(s.connectionString(), PoolOptions{
+		Size:           1,
+		ReconnectDelay: time.Hour,
+		WaitTimeout:    50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// The server won't accept another connection, so the dropped one can't
+	// be replaced
+	s.dropConnections()
+
+	client.Append("/foo", []byte("data"))
+	err = client.Append("/foo", []byte("data"))
+	if err != ErrPoolUnavailable {
+		t.Errorf("expected ErrPoolUnavailable, got %v", err)
+	}
+}
+
+func TestClientRetriesIdempotentAppends(t *testing.T) {
+	s := newFakeServer(t, 0)
+	s.mu.Lock()
+	s.dropAppends = 1
+	s.mu.Unlock()
+
+	client, err := NewClientPoolWithOptions(s.connectionString(), PoolOptions{Size: 1, ReconnectDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err = client.Append("/foo", []byte("data"))
+	if err != nil {
+		t.Fatalf("expected the append to be retried, got %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.appends) != 2 {
+		t.Fatalf("expected the append to be sent twice, got %d", len(s.appends))
+	}
+	if key := s.appends[0].IdempotencyKey; key == "" || key != s.appends[1].IdempotencyKey {
+		t.Errorf("expected both attempts to carry the same idempotency key, got %q and %q", key, s.appends[1].IdempotencyKey)
+	}
+}
+
+func TestClientAppendStream(t *testing.T) {
+	s := newFakeServer(t, 0)
+	client, err := NewClient(s.connectionString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stream, err := client.AppendStream(StreamOptions{MaxInFlight: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err = stream.Append("/foo", []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-stream.Errors(); ok {
+		t.Error("expected no appends to fail")
+	}
+	if err = stream.Append("/foo", []byte("data")); err != ErrStreamClosed {
+		t.Errorf("expected appends to a closed stream to fail, got %v", err)
+	}
+
+	s.mu.Lock()
+	received := len(s.appends)
+	s.mu.Unlock()
+	if received != 100 {
+		t.Errorf("expected 100 appends, got %d", received)
+	}
+	// The stream's connection is returned to the pool
+	waitForStats(t, client, PoolStats{Target: 1, Idle: 1})
+}
+
+func TestClientHandleNotices(t *testing.T) {
+	s := newFakeServer(t, 0)
+	s.notice = &proto.Notice{Level: proto.NoticeWarning, Message: "heads up"}
+	client, err := NewClient(s.connectionString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var mu sync.Mutex
+	notices := 0
+	client.HandleNotices(func(n proto.Notice) {
+		mu.Lock()
+		defer mu.Unlock()
+		if n != *s.notice {
+			t.Errorf("expected %v, got %v", *s.notice, n)
+		}
+		notices++
+	})
+
+	// Notices are read past, to the response they were sent ahead of
+	if err = client.Append("/foo", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.AppendStream(StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = stream.Append("/foo", []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if notices != 11 {
+		t.Errorf("expected 11 notices, got %d", notices)
+	}
+}
+
+func TestClientAppendStreamLostConnection(t *testing.T) {
+	s := newFakeServer(t, 0)
+	client, err := NewClient(s.connectionString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	s.mu.Lock()
+	s.dropAppends = 1
+	s.mu.Unlock()
+
+	var failed []*StreamError
+	stream, err := client.AppendStream(StreamOptions{
+		OnError: func(e *StreamError) { failed = append(failed, e) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = stream.Append("/foo", []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = stream.Close(); err == nil {
+		t.Error("expected the stream to be broken")
+	}
+	// The first append lost the connection, so none were acknowledged
+	if len(failed) != 10 || failed[0].Topic != "/foo" {
+		t.Errorf("expected every append to fail, got %v", failed)
+	}
+
+	// The broken connection is replaced
+	waitForStats(t, client, PoolStats{Target: 1, Idle: 1})
+	if err = client.Append("/foo", []byte("data")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientAppendWithReceiptUnsupported(t *testing.T) {
+	s := newFakeServer(t, 0)
+	s.capabilities = []string{proto.CapabilityIdempotentAppends}
+
+	client, err := NewClient(s.connectionString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err = client.AppendWithReceipt("/foo", []byte("data"), 0); err == nil {
+		t.Error("expected receipts to be unsupported by a server without append acks")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.appends) != 0 {
+		t.Errorf("expected nothing to be sent, got %d appends", len(s.appends))
+	}
+}
+
+func TestClientRetryPolicy(t *testing.T) {
+	s := newFakeServer(t, 0)
+	s.mu.Lock()
+	s.capabilities = []string{proto.CapabilityRequestIDs}
+	s.dropAppends = 1
+	s.mu.Unlock()
+
+	client, err := NewClientPoolWithOptions(s.connectionString(), PoolOptions{Size: 1, ReconnectDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// The server can't tell a retried append from a new one, so the append
+	// isn't retried
+	err = client.Append("/foo", []byte("data"))
+	if err == nil {
+		t.Fatal("expected an append to a server without idempotency keys to fail rather than be retried")
+	}
+	client.Close()
+
+	s.mu.Lock()
+	s.dropAppends = 2
+	s.mu.Unlock()
+	client, err = NewClientPoolWithOptions(s.connectionString(), PoolOptions{
+		Size:           1,
+		ReconnectDelay: 10 * time.Millisecond,
+		Retry:          RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, UnsafeAppends: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err = client.Append("/foo", []byte("data"))
+	if err != nil {
+		t.Fatalf("expected unsafe appends to be retried, got %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.appends) != 4 {
+		t.Errorf("expected 4 appends in all, got %d", len(s.appends))
+	}
+	for _, a := range s.appends {
+		if a.IdempotencyKey != "" {
+			t.Errorf("expected no idempotency key to be sent to a server without them, got %q", a.IdempotencyKey)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second} {
+		if got := p.backoff(attempts); got != want {
+			t.Errorf("expected a backoff of %s after %d attempts, got %s", want, attempts, got)
+		}
+	}
+}
+
+func TestClientSpoolsAppendsWhileServerIsDown(t *testing.T) {
+	// Find a free address, which nothing listens on until later
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	client, err := NewClientPoolWithOptions("fossil://"+addr+"/default", PoolOptions{
+		Size:           1,
+		ReconnectDelay: 10 * time.Millisecond,
+		WaitTimeout:    50 * time.Millisecond,
+		Spool:          SpoolOptions{Path: filepath.Join(t.TempDir(), "spool")},
+	})
+	if err != nil {
+		t.Fatalf("expected a client with a spool to open while the server is down, got %v", err)
+	}
+	defer client.Close()
+
+	for _, topic := range []string{"/a", "/b", "/c"} {
+		err = client.Append(topic, []byte("data"))
+		if err != nil {
+			t.Fatalf("expected append to be spooled, got %v", err)
+		}
+	}
+	if stats := client.(*RemoteClient).SpoolStats(); stats.Pending != 3 {
+		t.Fatalf("expected 3 spooled appends, got %+v", stats)
+	}
+
+	l, err = net.Listen("tcp4", addr)
+	if err != nil {
+		t.Skipf("unable to listen on %s again: %v", addr, err)
+	}
+	s := startFakeServer(t, l, 0)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.(*RemoteClient).SpoolStats().Pending > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the spool to be replayed, got %+v", client.(*RemoteClient).SpoolStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var topics []string
+	for _, a := range s.appends {
+		topics = append(topics, a.Topic)
+	}
+	if len(topics) != 3 || topics[0] != "/a" || topics[1] != "/b" || topics[2] != "/c" {
+		t.Errorf("expected spooled appends to be replayed in order, got %v", topics)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryClass is a class of failure which a RetryPolicy may retry requests
+// after. Classes are combined with |.
+type RetryClass int
+
+const (
+	// RetryConnectionLost retries requests whose connection was lost before
+	// a response was read. The request may or may not have reached the
+	// server.
+	RetryConnectionLost RetryClass = 1 << iota
+	// RetryUnavailable retries requests which gave up waiting for a
+	// connection because every connection in the pool was broken
+	RetryUnavailable
+)
+
+// RetryPolicy configures how a RemoteClient retries requests which fail.
+//
+// Appends are only retried if the server deduplicates them by idempotency key
+// (see proto.CapabilityIdempotentAppends), since an append whose connection
+// was lost may have landed anyway, unless UnsafeAppends is set.
+type RetryPolicy struct {
+	// MaxAttempts is the most times a request is sent, including the first.
+	// Defaults to one more than the size of the pool, so that a request can
+	// outlast every connection in the pool being lost at once.
+	MaxAttempts int
+	// Backoff is how long to wait before the first retry. It doubles with
+	// each retry after that, up to MaxBackoff. Defaults to retrying straight
+	// away.
+	Backoff time.Duration
+	// MaxBackoff caps the wait between retries. Defaults to a minute.
+	MaxBackoff time.Duration
+	// RetryOn is the classes of failure requests are retried after. Defaults
+	// to RetryConnectionLost.
+	RetryOn RetryClass
+	// UnsafeAppends retries appends to servers which don't deduplicate them,
+	// at the risk of appending the same data twice
+	UnsafeAppends bool
+}
+
+func (p RetryPolicy) withDefaults(poolSize uint) RetryPolicy {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = int(poolSize) + 1
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = time.Minute
+	}
+	if p.RetryOn == 0 {
+		p.RetryOn = RetryConnectionLost
+	}
+	return p
+}
+
+// retries returns whether the policy retries a request which failed with err
+func (p RetryPolicy) retries(err error) bool {
+	switch {
+	case isConnectionLost(err):
+		return p.RetryOn&RetryConnectionLost != 0
+	case errors.Is(err, ErrPoolUnavailable):
+		return p.RetryOn&RetryUnavailable != 0
+	}
+	return false
+}
+
+// backoff returns how long to wait before retrying a request which has been
+// attempted attempts times
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempts && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"context"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/pkg/errors"
+)
+
+// SpoolOptions configure the spool a RemoteClient buffers appends in while
+// the server can't be reached, for clients on flaky connections.
+//
+// An append is spooled instead of failing when no connection is available,
+// or when its connection is lost and it may be retried (see RetryPolicy).
+// While anything is spooled, new appends are spooled behind it, and the
+// spool is replayed in order in the background once the server can be
+// reached. Spooled appends are kept on disk, so a client opened with the same
+// Path replays what an earlier one didn't get to.
+//
+// Replayed appends are timestamped by the server when they're replayed, not
+// when they were made. Their TTL is shortened by the time they spent in the
+// spool, and they're dropped if it runs out. An append the server rejects on
+// replay is dropped, and reported to the client's Instrumentation.
+type SpoolOptions struct {
+	// Path is the file appends are spooled to
+	Path string
+	// MaxSize is the most bytes of appends the spool holds. Defaults to
+	// 64MiB.
+	MaxSize int64
+	// DropPolicy decides which appends are dropped once the spool is full.
+	// Defaults to dropping the oldest.
+	DropPolicy database.SpoolDropPolicy
+}
+
+func (o SpoolOptions) withDefaults() SpoolOptions {
+	if o.MaxSize == 0 {
+		o.MaxSize = 64 << 20
+	}
+	return o
+}
+
+// SpoolStats describes the appends held in a client's spool
+type SpoolStats struct {
+	// Pending is the number of appends waiting to be replayed, and Size their
+	// size on disk in bytes
+	Pending int
+	Size    int64
+	// Dropped is the number of appends dropped because the spool was full
+	Dropped uint64
+}
+
+// SpoolStats returns a snapshot of the client's spool, which is empty if
+// spooling isn't configured.
+func (client *RemoteClient) SpoolStats() SpoolStats {
+	if client.spool == nil {
+		return SpoolStats{}
+	}
+	return SpoolStats{
+		Pending: client.spool.Len(),
+		Size:    client.spool.Size(),
+		Dropped: client.spool.Dropped(),
+	}
+}
+
+// spools returns whether an append which failed with err is spooled to be
+// replayed later
+func (client *RemoteClient) spools(err error, req proto.AppendRequest) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrPoolUnavailable):
+		return true
+	case isConnectionLost(err):
+		// Like retrying, replaying an append which may have landed is only
+		// safe if the server can tell
+		return req.IdempotencyKey != "" || client.options.Retry.UnsafeAppends
+	}
+	return false
+}
+
+// spoolAppend adds req to the spool, and wakes the replayer
+func (client *RemoteClient) spoolAppend(req proto.AppendRequest) error {
+	err := client.spool.Push(database.SpooledAppend{
+		Topic:          req.Topic,
+		Data:           req.Data,
+		TTL:            req.TTL,
+		IdempotencyKey: req.IdempotencyKey,
+		Time:           time.Now(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to spool append")
+	}
+	client.wakeSpool()
+	return nil
+}
+
+func (client *RemoteClient) wakeSpool() {
+	select {
+	case client.spooled <- struct{}{}:
+	default:
+	}
+}
+
+// replaySpool sends spooled appends in order until the client is closed,
+// backing off while the server can't be reached
+func (client *RemoteClient) replaySpool() {
+	for {
+		select {
+		case <-client.done:
+			return
+		case <-client.spooled:
+		}
+
+		delay := client.options.ReconnectDelay
+		// key is the idempotency key given to an append spooled without one,
+		// which it keeps while it's retried
+		var key string
+		for {
+			a, ok := client.spool.Peek()
+			if !ok {
+				break
+			}
+
+			req := proto.AppendRequest{Topic: a.Topic, Data: a.Data, IdempotencyKey: a.IdempotencyKey}
+			if req.IdempotencyKey == "" {
+				req.IdempotencyKey = key
+			}
+			if a.TTL > 0 {
+				req.TTL = a.TTL - time.Since(a.Time)
+			}
+
+			// Appends which expired while spooled are dropped without sending
+			// them
+			if a.TTL <= 0 || req.TTL > 0 {
+				_, err := client.sendAppend(context.Background(), &req)
+				key = req.IdempotencyKey
+				if errors.Is(err, ErrPoolClosed) {
+					return
+				}
+				if client.spools(err, req) {
+					select {
+					case <-client.done:
+						return
+					case <-time.After(delay):
+					}
+					delay *= 2
+					if delay > maxReconnectDelay {
+						delay = maxReconnectDelay
+					}
+					continue
+				}
+			}
+
+			delay, key = client.options.ReconnectDelay, ""
+			client.spool.Pop()
+		}
+	}
+}
@@ -0,0 +1,291 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/pkg/errors"
+)
+
+// ErrStreamClosed is returned for appends made to an AppendStream once it's
+// closed
+var ErrStreamClosed = errors.New("append stream is closed")
+
+// DefaultMaxInFlight is the number of appends an AppendStream sends ahead of
+// their acknowledgments when StreamOptions.MaxInFlight is 0
+const DefaultMaxInFlight = 128
+
+// StreamOptions configure an AppendStream.
+type StreamOptions struct {
+	// MaxInFlight is the most appends sent to the server which it hasn't
+	// acknowledged yet. Appends made beyond it wait for their turn. Defaults
+	// to DefaultMaxInFlight.
+	MaxInFlight int
+	// OnError, if set, is called with each append which failed, rather than
+	// it being sent on the stream's Errors channel. It's called from the
+	// stream's own goroutine, so appends are held up until it returns.
+	OnError func(*StreamError)
+}
+
+func (o StreamOptions) withDefaults() StreamOptions {
+	if o.MaxInFlight <= 0 {
+		o.MaxInFlight = DefaultMaxInFlight
+	}
+	return o
+}
+
+// StreamError is an append made to an AppendStream which failed
+type StreamError struct {
+	Topic string
+	Data  []byte
+	TTL   time.Duration
+	Err   error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("append to %s failed: %s", e.Topic, e.Err)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// An AppendStream sends appends to fossil without waiting for each to be
+// acknowledged, for producers which can't afford a round trip per append.
+// Appends are queued by Append, and their failures are reported
+// asynchronously, on Errors or to StreamOptions.OnError.
+//
+// A stream over a RemoteClient holds one of the pool's connections until it's
+// closed, and pipelines appends over it. The server handles pipelined appends
+// concurrently, so they may be appended in a different order than they were
+// made unless MaxInFlight is 1. If the connection is lost, every append
+// which hadn't been acknowledged, and every append made after, fails with the
+// error it was lost to; appends made on a stream aren't retried or spooled.
+type AppendStream struct {
+	appends chan proto.AppendRequest
+	errs    chan *StreamError
+	onError func(*StreamError)
+	limits  proto.Limits
+
+	// mu guards closed, and is held while appends are queued so that they
+	// aren't queued once appends is closed
+	mu     sync.RWMutex
+	closed bool
+
+	// done is closed once every append queued has been acknowledged, and err
+	// is set to the error which broke the stream, if any, before it is
+	done chan struct{}
+	err  error
+}
+
+func newAppendStream(opts StreamOptions, limits proto.Limits) *AppendStream {
+	opts = opts.withDefaults()
+	return &AppendStream{
+		appends: make(chan proto.AppendRequest, opts.MaxInFlight),
+		errs:    make(chan *StreamError, opts.MaxInFlight),
+		onError: opts.OnError,
+		limits:  limits,
+		done:    make(chan struct{}),
+	}
+}
+
+// Append queues data to be appended to topic.
+func (s *AppendStream) Append(topic string, data []byte) error {
+	return s.AppendWithTTL(topic, data, 0)
+}
+
+// AppendWithTTL queues data to be appended to topic, which expires once ttl
+// has passed. It waits while the stream is backed up by MaxInFlight appends,
+// but otherwise returns once the append is queued, so only appends which
+// break the client's limits, or are made once the stream is closed, fail
+// here. Whether the server appended it is reported asynchronously.
+func (s *AppendStream) AppendWithTTL(topic string, data []byte, ttl time.Duration) error {
+	req := proto.AppendRequest{
+		Topic: topic,
+		Data:  data,
+		TTL:   ttl,
+	}
+	err := s.limits.CheckAppend(req)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return ErrStreamClosed
+	}
+	s.appends <- req
+	return nil
+}
+
+// Errors returns the channel failed appends are sent on, unless
+// StreamOptions.OnError is set. It holds up to MaxInFlight errors, and the
+// stream stalls once it's full, so it must be drained. It's closed once the
+// stream is.
+func (s *AppendStream) Errors() <-chan *StreamError {
+	return s.errs
+}
+
+// Close stops the stream taking appends, and waits for those already queued
+// to be acknowledged. It returns the error which broke the stream, if it
+// was broken.
+func (s *AppendStream) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.appends)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+	return s.err
+}
+
+// fail reports that req failed with err
+func (s *AppendStream) fail(req proto.AppendRequest, err error) {
+	e := &StreamError{Topic: req.Topic, Data: req.Data, TTL: req.TTL, Err: err}
+	if s.onError != nil {
+		s.onError(e)
+		return
+	}
+	s.errs <- e
+}
+
+// finish marks the stream as done, after it was broken by err if it isn't nil
+func (s *AppendStream) finish(err error) {
+	s.err = err
+	close(s.errs)
+	close(s.done)
+}
+
+// appendEach appends each queued append with fn, one after another, for
+// clients which append without a round trip to a server
+func (s *AppendStream) appendEach(fn func(proto.AppendRequest) error) {
+	for req := range s.appends {
+		if err := fn(req); err != nil {
+			s.fail(req, err)
+		}
+	}
+	s.finish(nil)
+}
+
+// AppendStream opens a stream of appends, which are pipelined over one
+// connection from the pool until the stream is closed.
+func (client *RemoteClient) AppendStream(opts StreamOptions) (*AppendStream, error) {
+	conn, err := client.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	s := newAppendStream(opts, client.limits)
+	go client.pipeline(s, conn, cap(s.appends))
+	return s, nil
+}
+
+// inFlight is an append sent on a stream which hasn't been acknowledged
+type inFlight struct {
+	req  proto.AppendRequest
+	sent time.Time
+}
+
+// pipeline writes the appends queued on s to conn as they come in, while
+// their responses are read back, in the order the appends were sent, by
+// another goroutine. At most maxInFlight appends are sent ahead of their
+// responses. Once s is closed and drained, conn is returned to the pool,
+// unless it was broken.
+func (client *RemoteClient) pipeline(s *AppendStream, conn net.Conn, maxInFlight int) {
+	pending := make(chan inFlight, maxInFlight)
+	read := make(chan error, 1)
+
+	go func() {
+		var err error
+		for f := range pending {
+			if err != nil {
+				s.fail(f.req, err)
+				continue
+			}
+
+			var resp proto.Message
+			resp, err = readResponse(conn, client.notices)
+			observeResponse(client.instrumentation, proto.CommandAppend, f.sent, resp, err)
+			if err != nil {
+				// Nothing more can be read, so the rest fail as well
+				conn.Close()
+				s.fail(f.req, err)
+				continue
+			}
+			if appendErr := appendError(f.req, resp); appendErr != nil {
+				s.fail(f.req, appendErr)
+			}
+		}
+		read <- err
+	}()
+
+	w := bufio.NewWriter(conn)
+	var err error
+	for req := range s.appends {
+		if err != nil {
+			s.fail(req, err)
+			continue
+		}
+
+		data, marshalErr := proto.NewMessageWithType(proto.CommandAppend, req).Marshal()
+		if marshalErr != nil {
+			s.fail(req, marshalErr)
+			continue
+		}
+
+		f := inFlight{req: req, sent: time.Now()}
+		select {
+		case pending <- f:
+		default:
+			// Appends waiting in the buffer must reach the server before it
+			// can acknowledge the ones holding things up
+			if err = w.Flush(); err != nil {
+				conn.Close()
+				s.fail(req, err)
+				continue
+			}
+			pending <- f
+		}
+
+		client.instrumentation.OnSend(proto.CommandAppend)
+		_, err = w.Write(data)
+		if err == nil && len(s.appends) == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			// The append is failed by the reader, which is waiting on
+			// responses that will never come
+			conn.Close()
+		}
+	}
+	if err == nil {
+		if err = w.Flush(); err != nil {
+			conn.Close()
+		}
+	}
+	close(pending)
+
+	if readErr := <-read; err == nil {
+		err = readErr
+	}
+	if err != nil {
+		client.discard(conn)
+	} else {
+		client.release(conn)
+	}
+	s.finish(err)
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+// TopicInfo describes a topic returned by ListTopics
+type TopicInfo = proto.TopicSummary
+
+// topicsPageSize is the number of topics fetched at a time by listTopics
+const topicsPageSize = 1000
+
+// responseError returns the error held by resp if it's an ERR, along with the
+// ID of the request it's in response to, or an error if it isn't of the
+// expected command
+func responseError(expected string, resp proto.Message) error {
+	if resp.Command() == proto.CommandError {
+		e := proto.ErrResponse{}
+		if proto.Unmarshal(resp.Data(), &e) != nil || e.Err == nil {
+			e.Err = errors.New("unknown error")
+		}
+		if id := resp.RequestID(); id != "" {
+			return fmt.Errorf("server returned error %d for request %s: %w", e.Code, id, e.Err)
+		}
+		return fmt.Errorf("server returned error %d: %w", e.Code, e.Err)
+	}
+	if resp.Command() != expected {
+		return fmt.Errorf("expected a %s response, got %s", expected, resp.Command())
+	}
+	return nil
+}
+
+// createTopic creates topic with the given schema, using c to send the
+// request
+func createTopic(c Client, topic, schema string) error {
+	resp, err := c.Send(proto.NewMessageWithType(proto.CommandCreate, proto.CreateTopicRequest{Topic: topic, Schema: schema}))
+	if err != nil {
+		return err
+	}
+	return responseError(proto.CommandOk, resp)
+}
+
+// validate checks whether data would be appended to topic, using c to send
+// the request. Data which doesn't conform to the topic's schema is reported
+// with an error for each field which doesn't.
+func validate(c Client, topic string, data []byte) error {
+	if data == nil {
+		data = []byte{}
+	}
+	resp, err := c.Send(proto.NewMessageWithType(proto.CommandValidate, proto.ValidateRequest{Topic: topic, Data: data}))
+	if err != nil {
+		return err
+	}
+	return responseError(proto.CommandOk, resp)
+}
+
+// listTopics pages through every topic starting with prefix, using c to send
+// the requests
+func listTopics(c Client, prefix string) ([]TopicInfo, error) {
+	topics := []TopicInfo{}
+
+	req := proto.ListTopicsRequest{Prefix: prefix, Limit: topicsPageSize}
+	for {
+		msg, err := c.Send(proto.NewMessageWithType(proto.CommandTopics, req))
+		if err != nil {
+			return nil, err
+		}
+		err = responseError(proto.CommandTopics, msg)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := proto.ListTopicsResponse{}
+		err = resp.Unmarshal(msg.Data())
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, resp.Topics...)
+
+		if resp.Next == "" {
+			return topics, nil
+		}
+		req.After = resp.Next
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"context"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/tracing"
+)
+
+// sendTraced sends m with send, reporting it to i, in a span which is a child
+// of the one in ctx
+func sendTraced(ctx context.Context, t tracing.Tracer, i Instrumentation, m proto.Message, send func(proto.Message) (proto.Message, error)) (proto.Message, error) {
+	_, span := t.Start(ctx, "fossil.client.send", tracing.String("fossil.command", m.Command()))
+	defer span.End()
+
+	i.OnSend(m.Command())
+	start := time.Now()
+	resp, err := send(m)
+	observeResponse(i, m.Command(), start, resp, err)
+
+	if err != nil {
+		span.RecordError(err)
+		return resp, err
+	}
+	if id := resp.RequestID(); id != "" {
+		span.SetAttributes(tracing.String("fossil.request_id", id))
+	}
+	if resp.Command() == proto.CommandError {
+		span.RecordError(responseError(proto.CommandError, resp))
+	}
+	return resp, nil
+}
+
+// endSpan ends span, recording err if there was one
+func endSpan(span tracing.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
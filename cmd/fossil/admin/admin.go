@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package admin
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/dburkart/fossil/cmd/fossil/server"
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var Command = &cobra.Command{
+	Use:   "admin",
+	Short: "Administer the databases of a server which isn't running",
+}
+
+var migrateCommand = &cobra.Command{
+	Use:   "migrate [database...]",
+	Short: "Migrate databases in an old on-disk format to the current one",
+	Long: `Migrate the databases configured in the [database] blocks, or the named ones,
+to the current on-disk format. Run it while the server is stopped.
+
+Before a database is migrated, its files are copied to a directory next to it,
+named <database>.v<version>-backup-<time>, which can be removed once the
+migrated database is known to be good. Use --dry-run to see which databases
+need migrating, and check that they can be, without writing anything.`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		log := viper.Get("logger").(zerolog.Logger)
+
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		noBackup, _ := cmd.Flags().GetBool("no-backup")
+
+		configs := server.DatabaseConfigs()
+		for _, name := range databaseNames(args) {
+			config, ok := configs[name]
+			if !ok {
+				log.Fatal().Str("db", name).Msg("no such database is configured")
+			}
+
+			plan, err := database.MigrateDatabase(path.Join(config.Directory, name), database.MigrateOptions{
+				DryRun:   dryRun,
+				NoBackup: noBackup,
+			})
+			if err != nil {
+				log.Fatal().Err(err).Str("db", name).Msg("unable to migrate database")
+			}
+
+			printPlan(name, plan, dryRun)
+		}
+	},
+}
+
+var rebuildIndexCommand = &cobra.Command{
+	Use:   "rebuild-index [database...]",
+	Short: "Rebuild lost or corrupted topics and schemas files from segment data",
+	Long: `Rebuild the topics and schemas files of the databases configured in the
+[database] blocks, or the named ones, if either is missing or corrupted, so that
+they open again. Run it while the server is stopped.
+
+Topics are recovered from the data in each database's segments. Lost topic
+names become /recovered/<id>, and lost schemas become string. Topics which were
+never appended to can't be recovered, so check a rebuilt database before
+appending to it. Files are backed up the same way as by migrate.`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		log := viper.Get("logger").(zerolog.Logger)
+
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		noBackup, _ := cmd.Flags().GetBool("no-backup")
+
+		configs := server.DatabaseConfigs()
+		for _, name := range databaseNames(args) {
+			config, ok := configs[name]
+			if !ok {
+				log.Fatal().Str("db", name).Msg("no such database is configured")
+			}
+
+			plan, err := database.RebuildIndex(path.Join(config.Directory, name), database.RebuildOptions{
+				DryRun:   dryRun,
+				NoBackup: noBackup,
+			})
+			if err != nil {
+				log.Fatal().Err(err).Str("db", name).Msg("unable to rebuild database index")
+			}
+
+			printRebuildPlan(name, plan, dryRun)
+		}
+	},
+}
+
+// databaseNames returns names, or the name of every configured database if
+// none were given
+func databaseNames(names []string) []string {
+	if len(names) > 0 {
+		return names
+	}
+	for name := range server.DatabaseConfigs() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// printRebuildPlan describes the rebuilding of the database name's index
+func printRebuildPlan(name string, plan database.RebuildPlan, dryRun bool) {
+	if !plan.Needed() {
+		fmt.Printf("%s: topics and schemas are intact\n", name)
+		return
+	}
+
+	var lost []string
+	if plan.LostTopics {
+		lost = append(lost, "topics")
+	}
+	if plan.LostSchemas {
+		lost = append(lost, "schemas")
+	}
+	verb := "rebuilt"
+	if dryRun {
+		verb = "would rebuild"
+	}
+	fmt.Printf("%s: %s %s, recovering %d topics, %d of them renamed /recovered/<id>\n", name, verb, strings.Join(lost, " and "), plan.Topics, plan.Recovered)
+	printBackup(plan.Backup, dryRun)
+}
+
+// printPlan describes the migration of the database name
+func printPlan(name string, plan database.MigrationPlan, dryRun bool) {
+	if !plan.Needed() {
+		fmt.Printf("%s: up to date (v%d)\n", name, plan.To)
+		return
+	}
+
+	verb := "migrated"
+	if dryRun {
+		verb = "would migrate"
+	}
+	fmt.Printf("%s: %s from v%d to v%d, holding %d topics in %d segments\n", name, verb, plan.From, plan.To, plan.Topics, plan.Segments)
+	for _, step := range plan.Steps {
+		fmt.Printf("  %s\n", step)
+	}
+	printBackup(plan.Backup, dryRun)
+}
+
+// printBackup describes where a database's files are backed up to, if they are
+func printBackup(backup string, dryRun bool) {
+	if backup == "" {
+		return
+	}
+	if dryRun {
+		fmt.Printf("  files would be backed up to %s\n", backup)
+	} else {
+		fmt.Printf("  files backed up to %s\n", backup)
+	}
+}
+
+func init() {
+	migrateCommand.Flags().Bool("dry-run", false, "Report what would be migrated, without writing anything")
+	migrateCommand.Flags().Bool("no-backup", false, "Don't back up databases before migrating them")
+
+	rebuildIndexCommand.Flags().Bool("dry-run", false, "Report what would be rebuilt, without writing anything")
+	rebuildIndexCommand.Flags().Bool("no-backup", false, "Don't back up databases before rebuilding them")
+
+	Command.AddCommand(migrateCommand)
+	Command.AddCommand(rebuildIndexCommand)
+}
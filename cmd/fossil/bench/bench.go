@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	fossil "github.com/dburkart/fossil/api"
+	"github.com/dburkart/fossil/pkg/schema"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var Command = &cobra.Command{
+	Use:   "bench",
+	Short: "Generate load against a server and report throughput and latency",
+
+	Run: func(cmd *cobra.Command, args []string) {
+		log := viper.Get("logger").(zerolog.Logger)
+
+		opts, err := optionsFromFlags(cmd)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid options")
+		}
+
+		client, err := fossil.NewClientPool(viper.GetString("fossil.host"), uint(opts.concurrency))
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to connect to server")
+		}
+		defer client.Close()
+
+		err = createTopics(client, opts)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error creating topics")
+		}
+
+		log.Info().
+			Int("topics", opts.topics).
+			Int("concurrency", opts.concurrency).
+			Dur("duration", opts.duration).
+			Msg("benchmark started")
+
+		results := run(client, opts)
+		results.print(opts.duration)
+	},
+}
+
+func init() {
+	Command.Flags().String("prefix", "/bench", "Topic the benchmark's topics are created under")
+	Command.Flags().Int("topics", 10, "Number of topics to append to")
+	Command.Flags().String("schema", "binary", "Schema of the topics; string, binary, and fixed-size types are supported")
+	Command.Flags().Int("payload-size", 64, "Size of each appended payload in bytes, for string and binary schemas")
+	Command.Flags().Int("concurrency", 10, "Number of concurrent workers, each with its own connection")
+	Command.Flags().Duration("duration", 10*time.Second, "How long to generate load for")
+	Command.Flags().Float64("query-ratio", 0, "Fraction of operations which are queries rather than appends, from 0 to 1")
+	Command.Flags().String("query", "", "Query to run (default \"latest in <prefix>\")")
+}
+
+type options struct {
+	prefix      string
+	topics      int
+	schema      string
+	payload     []byte
+	concurrency int
+	duration    time.Duration
+	queryRatio  float64
+	query       string
+}
+
+func optionsFromFlags(cmd *cobra.Command) (options, error) {
+	flags := cmd.Flags()
+	opts := options{}
+	opts.prefix, _ = flags.GetString("prefix")
+	opts.topics, _ = flags.GetInt("topics")
+	opts.schema, _ = flags.GetString("schema")
+	opts.concurrency, _ = flags.GetInt("concurrency")
+	opts.duration, _ = flags.GetDuration("duration")
+	opts.queryRatio, _ = flags.GetFloat64("query-ratio")
+	opts.query, _ = flags.GetString("query")
+	payloadSize, _ := flags.GetInt("payload-size")
+
+	switch {
+	case opts.topics < 1:
+		return opts, errors.New("--topics must be at least 1")
+	case opts.concurrency < 1:
+		return opts, errors.New("--concurrency must be at least 1")
+	case opts.duration <= 0:
+		return opts, errors.New("--duration must be positive")
+	case opts.queryRatio < 0 || opts.queryRatio > 1:
+		return opts, errors.New("--query-ratio must be between 0 and 1")
+	case payloadSize < 0:
+		return opts, errors.New("--payload-size can't be negative")
+	}
+
+	if opts.query == "" {
+		opts.query = fmt.Sprintf("latest in %s", opts.prefix)
+	}
+
+	s, err := schema.Parse(opts.schema)
+	if err != nil {
+		return opts, err
+	}
+	opts.payload, err = makePayload(s, payloadSize)
+	return opts, err
+}
+
+// makePayload returns data conforming to s. Only the size of string and
+// binary payloads can be chosen.
+func makePayload(s schema.Object, size int) ([]byte, error) {
+	t, ok := s.(*schema.Type)
+	if !ok {
+		return nil, fmt.Errorf("unsupported schema %s: only string, binary, and fixed-size types are supported", s.ToSchema())
+	}
+
+	if t.Name != "string" && t.Name != "binary" {
+		size = t.Size()
+	}
+
+	payload := make([]byte, size)
+	if t.Name == "string" {
+		for i := range payload {
+			payload[i] = byte('a' + rand.Intn(26))
+		}
+	} else if t.Name != "boolean" {
+		rand.Read(payload)
+	}
+
+	if !t.Validate(payload) {
+		return nil, fmt.Errorf("unable to generate a payload for schema %s", t.ToSchema())
+	}
+	return payload, nil
+}
+
+func (o options) topic(i int) string {
+	return fmt.Sprintf("%s/%d", o.prefix, i)
+}
+
+// createTopics creates the benchmark's topics up front, so that appends
+// measure appending rather than topic creation
+func createTopics(c fossil.Client, opts options) error {
+	for i := 0; i < opts.topics; i++ {
+		err := c.CreateTopic(opts.topic(i), opts.schema)
+		if err != nil {
+			return fmt.Errorf("%s: %w", opts.topic(i), err)
+		}
+	}
+	return nil
+}
+
+// latencies holds the duration of each successful operation of one kind
+type latencies struct {
+	durations []time.Duration
+	errors    int
+}
+
+func (l *latencies) merge(other latencies) {
+	l.durations = append(l.durations, other.durations...)
+	l.errors += other.errors
+}
+
+// percentile returns the duration p percent of operations completed within.
+// durations must be sorted.
+func (l latencies) percentile(p float64) time.Duration {
+	if len(l.durations) == 0 {
+		return 0
+	}
+	i := int(float64(len(l.durations))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(l.durations) {
+		i = len(l.durations) - 1
+	}
+	return l.durations[i]
+}
+
+type results struct {
+	appends latencies
+	queries latencies
+	bytes   int
+}
+
+// run has each worker send operations until the duration has passed
+func run(c fossil.Client, opts options) results {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	total := results{}
+	deadline := time.Now().Add(opts.duration)
+
+	for w := 0; w < opts.concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(w)))
+			local := results{}
+
+			for i := w; time.Now().Before(deadline); i++ {
+				start := time.Now()
+				if rng.Float64() < opts.queryRatio {
+					_, err := c.Query(opts.query)
+					if err != nil {
+						local.queries.errors++
+						continue
+					}
+					local.queries.durations = append(local.queries.durations, time.Since(start))
+				} else {
+					err := c.Append(opts.topic(i%opts.topics), opts.payload)
+					if err != nil {
+						local.appends.errors++
+						continue
+					}
+					local.appends.durations = append(local.appends.durations, time.Since(start))
+					local.bytes += len(opts.payload)
+				}
+			}
+
+			mu.Lock()
+			total.appends.merge(local.appends)
+			total.queries.merge(local.queries)
+			total.bytes += local.bytes
+			mu.Unlock()
+		}(w)
+	}
+	wg.Wait()
+
+	sort.Slice(total.appends.durations, func(i, j int) bool { return total.appends.durations[i] < total.appends.durations[j] })
+	sort.Slice(total.queries.durations, func(i, j int) bool { return total.queries.durations[i] < total.queries.durations[j] })
+	return total
+}
+
+func (r results) print(elapsed time.Duration) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "OPERATION\tCOUNT\tERRORS\tOPS/S\tP50\tP90\tP99\tMAX\t")
+	for _, row := range []struct {
+		name string
+		l    latencies
+	}{{"append", r.appends}, {"query", r.queries}} {
+		if len(row.l.durations) == 0 && row.l.errors == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t\n",
+			row.name,
+			len(row.l.durations),
+			row.l.errors,
+			float64(len(row.l.durations))/elapsed.Seconds(),
+			row.l.percentile(50),
+			row.l.percentile(90),
+			row.l.percentile(99),
+			row.l.percentile(100),
+		)
+	}
+	w.Flush()
+
+	fmt.Printf("\nappended %.2f MiB/s\n", float64(r.bytes)/elapsed.Seconds()/(1<<20))
+}
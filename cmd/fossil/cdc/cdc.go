@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package cdc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	fossil "github.com/dburkart/fossil/api"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var Command = &cobra.Command{
+	Use:   "cdc",
+	Short: "Stream the changes committed to a database as JSON lines",
+	Long: `Stream the changes committed to a database's write-ahead log to stdout, one
+JSON object per line. Each change has an offset, and offsets increase
+monotonically, so a consumer which stops can pick up where it left off by
+passing the offset after the last one it saw to --from.
+
+Only the most recent changes are held by the server. If --from is older than
+the oldest change held, cdc exits with an error, and the consumer should catch
+up by querying the database before following changes again.`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		log := viper.Get("logger").(zerolog.Logger)
+
+		from, _ := cmd.Flags().GetUint64("from")
+		db, _ := cmd.Flags().GetString("db")
+		limit, _ := cmd.Flags().GetInt("limit")
+		wait, _ := cmd.Flags().GetDuration("wait")
+		follow, _ := cmd.Flags().GetBool("follow")
+
+		host, err := connectionString(viper.GetString("fossil.host"), db)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid host")
+		}
+
+		client, err := fossil.NewClient(host)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to connect to server")
+		}
+		defer client.Close()
+
+		enc := json.NewEncoder(os.Stdout)
+		for {
+			changes, next, err := client.Changes(from, limit, wait)
+			if err != nil {
+				log.Fatal().Err(err).Uint64("from", from).Msg("unable to retrieve changes")
+			}
+
+			for _, change := range changes {
+				err = enc.Encode(change)
+				if err != nil {
+					log.Fatal().Err(err).Msg("unable to write change")
+				}
+			}
+
+			if len(changes) == 0 && !follow {
+				return
+			}
+			from = next
+		}
+	},
+}
+
+func init() {
+	Command.Flags().Uint64("from", 0, "Offset of the first change to stream (0 for the oldest change held)")
+	Command.Flags().String("db", "", "Database to stream changes from, instead of the one in --host")
+	Command.Flags().Int("limit", 1000, "Most changes retrieved at once")
+	Command.Flags().Duration("wait", 30*time.Second, "How long the server waits for changes before responding with none")
+	Command.Flags().Bool("follow", true, "Keep waiting for changes, rather than exiting once they're all streamed")
+}
+
+// connectionString returns host, with its database replaced by db if it's set
+func connectionString(host, db string) (string, error) {
+	if db == "" {
+		return host, nil
+	}
+
+	target, err := proto.ParseConnectionString(host)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case target.Local:
+		return "", errors.New("--db can't be used with a local database")
+	case target.Network == "unix":
+		return fmt.Sprintf("fossil+unix://%s/%s", target.Address, db), nil
+	default:
+		return fmt.Sprintf("fossil://%s/%s", target.Address, db), nil
+	}
+}
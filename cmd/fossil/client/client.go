@@ -8,8 +8,10 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -45,9 +47,20 @@ var (
 				log.Fatal().Err(err).Msg("error parsing URL")
 			}
 
+			line, _ := cmd.Flags().GetString("execute")
+
 			client, err := fossil.NewClient(host)
 			if err != nil {
 				log.Error().Err(err).Str("address", target.Address).Msg("unable to connect to server")
+				// Scripts need to be told the command wasn't run
+				if line != "" {
+					os.Exit(1)
+				}
+			}
+
+			if line != "" {
+				execute(client, strings.TrimSpace(line), output)
+				return
 			}
 
 			readlinePrompt(client, output)
@@ -67,9 +80,16 @@ func init() {
 
 	// Flags for this command
 	Command.Flags().StringP("output", "o", "text", "Output format of results in pipe mode [csv, json, text]")
+	Command.Flags().Bool("expand", false, "Print each key of composite query results in a column of its own")
+	Command.Flags().String("history-file", "", "File to persist command history to (default \"~/.fossil_history\")")
+	Command.Flags().Bool("pager", true, "Page output which doesn't fit in the terminal")
+	Command.Flags().StringP("execute", "e", "", "Run a single command, print its result, and exit")
 
 	// Bind flags to viper
 	viper.BindPFlag("fossil.output", Command.Flags().Lookup("output"))
+	viper.BindPFlag("fossil.expand", Command.Flags().Lookup("expand"))
+	viper.BindPFlag("fossil.history-file", Command.Flags().Lookup("history-file"))
+	viper.BindPFlag("fossil.pager", Command.Flags().Lookup("pager"))
 }
 
 func listDatabases(c fossil.Client) func(string) []string {
@@ -92,13 +112,22 @@ func listDatabases(c fossil.Client) func(string) []string {
 	}
 }
 
-func listTopics(c fossil.Client) func(string) []string {
-	msg, err := c.Send(proto.NewMessageWithType(proto.CommandList, proto.ListRequest{Object: "topics"}))
+// topicNames returns the name of every topic in the current database
+func topicNames(c fossil.Client) ([]string, error) {
+	topics, err := c.ListTopics("")
 	if err != nil {
-		return func(string) []string { return []string{} }
+		return nil, err
 	}
-	resp := proto.ListResponse{}
-	err = resp.Unmarshal(msg.Data())
+
+	names := make([]string, 0, len(topics))
+	for _, t := range topics {
+		names = append(names, t.Topic)
+	}
+	return names, nil
+}
+
+func listTopics(c fossil.Client) func(string) []string {
+	names, err := topicNames(c)
 	if err != nil {
 		return func(string) []string { return []string{} }
 	}
@@ -106,30 +135,33 @@ func listTopics(c fossil.Client) func(string) []string {
 		lineTopic := line
 		if strings.HasPrefix(line, "append") {
 			lineTopic = lineTopic[7:]
+		} else if strings.HasPrefix(line, "describe") {
+			lineTopic = lineTopic[9:]
+		} else if strings.HasPrefix(line, "validate") {
+			lineTopic = lineTopic[9:]
 		}
 
-		return filterStringSlice(resp.ObjectList, lineTopic)
+		return filterStringSlice(names, lineTopic)
 	}
 }
 
 func listSchemas(c fossil.Client) map[string]schema.Object {
-	msg, err := c.Send(proto.NewMessageWithType(proto.CommandList, proto.ListRequest{Object: "schemas"}))
-	if err != nil {
-		return nil
-	}
-	resp := proto.ListResponse{}
-	err = resp.Unmarshal(msg.Data())
+	topics, err := c.ListTopics("")
 	if err != nil {
 		return nil
 	}
-	schemaMap := make(map[string]schema.Object, len(resp.ObjectList))
-	for _, line := range resp.ObjectList {
-		pieces := strings.Split(line, " ")
-		obj, err := schema.Parse(pieces[1])
+	schemaMap := make(map[string]schema.Object, len(topics))
+	for _, t := range topics {
+		// Topics with a codec take their payloads as-is, the server does
+		// the conversion, and string payloads need no encoding
+		if (t.Codec != "" && t.Codec != "binary") || t.Schema == "string" {
+			continue
+		}
+		obj, err := schema.Parse(t.Schema)
 		if err != nil {
 			return nil
 		}
-		schemaMap[pieces[0]] = obj
+		schemaMap[t.Topic] = obj
 	}
 	return schemaMap
 }
@@ -154,12 +186,7 @@ func filterInput(r rune) (rune, bool) {
 }
 
 func completeCreateTopic(c fossil.Client) func(string) []string {
-	msg, err := c.Send(proto.NewMessageWithType(proto.CommandList, proto.ListRequest{Object: "topics"}))
-	if err != nil {
-		return func(string) []string { return []string{} }
-	}
-	resp := proto.ListResponse{}
-	err = resp.Unmarshal(msg.Data())
+	names, err := topicNames(c)
 	if err != nil {
 		return func(string) []string { return []string{} }
 	}
@@ -173,7 +200,7 @@ func completeCreateTopic(c fossil.Client) func(string) []string {
 		lineTopic = strings.TrimPrefix(lineTopic[1:], fields[2])
 		lineTopic = strings.TrimPrefix(lineTopic, " ")
 
-		options := filterStringSlice(resp.ObjectList, lineTopic)
+		options := filterStringSlice(names, lineTopic)
 		if len(fields[2]) > 0 {
 			options = append(options, fields[2])
 		}
@@ -205,150 +232,265 @@ func makeSchemaOptions() []readline.PrefixCompleterInterface {
 	return ret
 }
 
+// replCompleter completes queries with repl.CompleteQuery, and everything else
+// with a prefix completer
+type replCompleter struct {
+	*readline.PrefixCompleter
+	topics []string
+}
+
+func (r *replCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	completions, word, ok := repl.CompleteQuery(string(line[:pos]), r.topics)
+	if !ok {
+		return r.PrefixCompleter.Do(line, pos)
+	}
+
+	// readline wants the part of each completion which hasn't been typed yet
+	suffixes := make([][]rune, 0, len(completions))
+	for _, c := range completions {
+		suffixes = append(suffixes, []rune(c[len(word):]))
+	}
+	return suffixes, len([]rune(word))
+}
+
+const (
+	prompt             = "\033[31m>\033[0m "
+	continuationPrompt = "\033[31m.\033[0m "
+	// noticeFormat prints notices from the server dimmed, so that they don't
+	// get mistaken for results
+	noticeFormat = "\033[2m%s\033[0m\n"
+)
+
+// historyFile returns the path REPL history is persisted to, or an empty
+// string if history should not be persisted
+func historyFile() string {
+	if f := viper.GetString("fossil.history-file"); f != "" {
+		return f
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".fossil_history")
+}
+
+// terminalHeight returns the number of lines in the terminal, or 0 if it
+// can't be told
+func terminalHeight() int {
+	_, height, err := readline.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return 0
+	}
+	return height
+}
+
+// newPager returns a Pager which asks whether to show each page after the
+// first with rl. Paging is off unless both ends of the REPL are a terminal.
+func newPager(rl *readline.Instance) *repl.Pager {
+	more := func() bool {
+		rl.SetPrompt(repl.MorePrompt)
+		defer rl.SetPrompt(prompt)
+		line, err := rl.Readline()
+		return err == nil && strings.ToUpper(strings.TrimSpace(line)) != "Q"
+	}
+
+	pager := repl.NewPager(os.Stdout, terminalHeight, more)
+	if !viper.GetBool("fossil.pager") || !readline.DefaultIsTerminal() || !readline.IsTerminal(int(os.Stdout.Fd())) {
+		pager.Disable()
+	}
+	return pager
+}
+
 func readlinePrompt(c fossil.Client, output string) {
 	// Configure the completer
 	useItem := readline.PcItemDynamic(listDatabases(c))
 	appendItem := readline.PcItemDynamic(listTopics(c))
 
 	listItems := []readline.PrefixCompleterInterface{
-		readline.PcItem("topics"), readline.PcItem("databases"), readline.PcItem("schemas"),
+		readline.PcItem("topics"), readline.PcItem("databases"), readline.PcItem("schemas"), readline.PcItem("named-schemas"), readline.PcItem("templates"),
 	}
 
 	completer := readline.NewPrefixCompleter(
 		readline.PcItem("help", useItem),
 		readline.PcItem("use", useItem),
 		readline.PcItem("append", appendItem),
+		readline.PcItem("validate", readline.PcItemDynamic(listTopics(c))),
 		readline.PcItem("insert"),
 		readline.PcItem("query"),
+		readline.PcItem("profile"),
+		readline.PcItem("histogram("),
+		readline.PcItem("flush"),
+		readline.PcItem("ping"),
+		readline.PcItem("describe", readline.PcItemDynamic(listTopics(c))),
+		readline.PcItem("topics", readline.PcItemDynamic(listTopics(c))),
+		readline.PcItem("databases"),
 		readline.PcItem("exit"),
+		readline.PcItem("set"),
+		readline.PcItem("unset"),
+		readline.PcItem("pager", readline.PcItem("on"), readline.PcItem("off")),
 		readline.PcItem("list", listItems...),
 		readline.PcItem("create",
 			readline.PcItem("topic", readline.PcItemDynamic(completeCreateTopic(c), makeSchemaOptions()...)),
+			readline.PcItem("schema"),
+			readline.PcItem("template"),
 		),
 	)
 
+	// Queries are completed with live topic names, which are refreshed along
+	// with the schema cache
+	queryCompleter := &replCompleter{PrefixCompleter: completer}
+	queryCompleter.topics, _ = topicNames(c)
+
 	// Setup the readline executor
 	rl, err := readline.NewEx(&readline.Config{
-		Prompt:          "\033[31m>\033[0m ",
-		AutoComplete:    completer,
+		Prompt:          prompt,
+		AutoComplete:    queryCompleter,
 		InterruptPrompt: "^C",
 		EOFPrompt:       "exit",
+		Stdin:           readline.NewCancelableStdin(repl.NewPasteReader(os.Stdin)),
 
-		HistorySearchFold:   true,
-		FuncFilterInputRune: filterInput,
+		HistoryFile:            historyFile(),
+		DisableAutoSaveHistory: true,
+		HistorySearchFold:      true,
+		FuncFilterInputRune:    filterInput,
 	})
 	if err != nil {
 		panic(err)
 	}
 	defer rl.Close()
 
+	c.HandleNotices(func(n proto.Notice) {
+		fmt.Fprintf(rl.Stdout(), noticeFormat, n)
+	})
+
+	if readline.DefaultIsTerminal() {
+		fmt.Print(repl.BracketedPasteOn)
+		defer fmt.Print(repl.BracketedPasteOff)
+	}
+
 	schemas := listSchemas(c)
 	recomputeSchemaCache := false
 
-	// Configure output writer
-	writer := repl.NewOutputWriter(os.Stdout, output)
+	// Variables set during the session are substituted into queries
+	vars := repl.Variables{}
 
-	// Handle input
+	// Configure output writer, whose output is paged
+	pager := newPager(rl)
+	writer := repl.NewOutputWriter(pager, output)
+	expand := viper.GetBool("fossil.expand")
+
+	// Handle input, collecting lines until we have a complete command
+	var lines []string
 	for {
 		ln := rl.Line()
 		if ln.CanContinue() {
+			// An interrupt abandons any partially entered command
+			lines = nil
+			rl.SetPrompt(prompt)
 			continue
 		} else if ln.CanBreak() {
 			break
 		}
-		line := strings.TrimSpace(ln.Line)
 
-		if strings.ToUpper(line) == "HELP" {
-			fmt.Println("usage:")
-			fmt.Println(completer.Tree("    "))
+		// Lines are kept apart, since a comment in a schema runs until the
+		// end of its line
+		lines = append(lines, ln.Line)
+		line := strings.TrimSpace(strings.Join(lines, "\n"))
+		if repl.NeedsContinuation(line) {
+			rl.SetPrompt(continuationPrompt)
 			continue
 		}
-		if strings.ToUpper(line) == "EXIT" {
-			os.Exit(0)
-		}
+		lines = nil
+		rl.SetPrompt(prompt)
 
-		replMsg, err := repl.ParseREPLCommand([]byte(line), schemas)
-		if err != nil {
-			log.Error().Err(err).Send()
+		if line == "" {
 			continue
 		}
+		// History is line based, so the command is saved as one
+		rl.SaveHistory(strings.ReplaceAll(line, "\n", " "))
 
-		msg, err := c.Send(replMsg)
-		if err != nil {
-			log.Fatal().Err(err).Msg("error sending message to server")
+		if strings.ToUpper(line) == "HELP" {
+			fmt.Println("usage:")
+			fmt.Println(completer.Tree("    "))
+			continue
 		}
-
-		// FIXME: This is quite the hack. We need a better heuristic to invalidate our schema cache
-		//		  than just looking at the command type we sent over the wire. It would be better if
-		//		  we could reach into the message and examine the topic we're appending to or creating
-		if replMsg.Command() == proto.CommandAppend || replMsg.Command() == proto.CommandCreate {
-			recomputeSchemaCache = true
+		if strings.ToUpper(line) == "EXIT" {
+			break
 		}
 
-		switch msg.Command() {
-		case proto.CommandVersion:
-			v := proto.VersionResponse{}
-			err = v.Unmarshal(msg.Data())
+		if handled, err := vars.Handle(line); handled {
 			if err != nil {
 				log.Error().Err(err).Send()
-				continue
 			}
-			writer.Write(v)
-		case proto.CommandStats:
-			t := proto.StatsResponse{}
-			err = t.Unmarshal(msg.Data())
+			continue
+		}
+		if handled, err := pager.Handle(line); handled {
 			if err != nil {
 				log.Error().Err(err).Send()
-				continue
 			}
+			continue
+		}
 
-			writer.Write(t)
-		case proto.CommandQuery:
-			t := proto.QueryResponse{}
-			err = t.Unmarshal(msg.Data())
-			if err != nil {
-				log.Error().Err(err).Send()
-				continue
-			}
+		line, err = vars.Expand(line)
+		if err != nil {
+			log.Error().Err(err).Send()
+			continue
+		}
 
-			writer.Write(t)
-		case proto.CommandError:
-			t := proto.ErrResponse{}
-			err = t.Unmarshal(msg.Data())
-			if err != nil {
-				log.Error().Err(err).Send()
-				continue
-			}
-			fmt.Println(t.Code, t.Err)
-		case proto.CommandOk:
-			t := proto.OkResponse{}
-			err = t.Unmarshal(msg.Data())
+		if bucket, query, ok, err := repl.ParseHistogramCommand(line); ok {
 			if err != nil {
 				log.Error().Err(err).Send()
 				continue
 			}
-			writer.Write(t)
-		case proto.CommandAppend:
-			t := proto.OkResponse{}
-			err = t.Unmarshal(msg.Data())
+			results, err := c.Query(query)
 			if err != nil {
 				log.Error().Err(err).Send()
 				continue
 			}
-			writer.Write(t)
-		case proto.CommandList:
-			t := proto.ListResponse{}
-			err = t.Unmarshal(msg.Data())
+			h, err := repl.NewHistogram(results, bucket)
 			if err != nil {
 				log.Error().Err(err).Send()
 				continue
 			}
-			writer.Write(t)
+			writer.Write(h)
+			pager.Flush()
+			continue
+		}
+
+		replMsg, err := repl.ParseREPLCommand([]byte(line), schemas)
+		if err != nil {
+			log.Error().Err(err).Send()
+			continue
+		}
+
+		msg, err := c.Send(replMsg)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error sending message to server")
+		}
+
+		// FIXME: This is quite the hack. We need a better heuristic to invalidate our schema cache
+		//		  than just looking at the command type we sent over the wire. It would be better if
+		//		  we could reach into the message and examine the topic we're appending to or creating
+		if replMsg.Command() == proto.CommandAppend || replMsg.Command() == proto.CommandCreate ||
+			replMsg.Command() == proto.CommandUse {
+			recomputeSchemaCache = true
+		}
+
+		err = printResponse(pager, output, expand, replMsg, msg)
+		var serverErr serverError
+		if errors.As(err, &serverErr) {
+			fmt.Println(serverErr)
+		} else if err != nil {
+			log.Error().Err(err).Send()
+			continue
 		}
+		pager.Flush()
 		fmt.Println()
 
 		if recomputeSchemaCache {
 			schemas = listSchemas(c)
+			queryCompleter.topics, _ = topicNames(c)
 			recomputeSchemaCache = false
 		}
 	}
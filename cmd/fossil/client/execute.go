@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	fossil "github.com/dburkart/fossil/api"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/repl"
+	"github.com/spf13/viper"
+)
+
+// serverError is an error response from the server
+type serverError struct {
+	code      uint32
+	err       error
+	requestID string
+}
+
+func (e serverError) Error() string {
+	if e.requestID != "" {
+		return fmt.Sprintf("%d %s (request %s)", e.code, e.err, e.requestID)
+	}
+	return fmt.Sprintf("%d %s", e.code, e.err)
+}
+
+// printResponse writes msg, the response to sent, to out in the given output
+// format. If msg is an error response, a serverError is returned instead.
+func printResponse(out io.Writer, output string, expand bool, sent, msg proto.Message) error {
+	writer := repl.NewOutputWriter(out, output)
+
+	switch msg.Command() {
+	case proto.CommandVersion:
+		t := proto.VersionResponse{}
+		err := t.Unmarshal(msg.Data())
+		if err != nil {
+			return err
+		}
+		writer.Write(t)
+	case proto.CommandPing:
+		t := proto.PingResponse{}
+		err := t.Unmarshal(msg.Data())
+		if err != nil {
+			return err
+		}
+		t.RoundTrip = time.Since(t.Sent)
+		writer.Write(t)
+	case proto.CommandStats:
+		t := proto.StatsResponse{}
+		err := t.Unmarshal(msg.Data())
+		if err != nil {
+			return err
+		}
+		writer.Write(t)
+	case proto.CommandQuery:
+		t := proto.QueryResponse{}
+		err := t.Unmarshal(msg.Data())
+		if err != nil {
+			return err
+		}
+
+		if expand && output != "json" {
+			writer.Write(repl.ExpandedResults(t))
+		} else {
+			writer.Write(t)
+		}
+		// JSON output already includes the profile
+		if len(t.Profile) > 0 && output != "json" {
+			fmt.Fprintln(out)
+			writer.Write(t.Profile)
+		}
+	case proto.CommandError:
+		t := proto.ErrResponse{}
+		err := t.Unmarshal(msg.Data())
+		if err != nil {
+			return err
+		}
+		return serverError{code: t.Code, err: t.Err, requestID: msg.RequestID()}
+	case proto.CommandOk:
+		t := proto.OkResponse{}
+		err := t.Unmarshal(msg.Data())
+		if err != nil {
+			return err
+		}
+		writer.Write(t)
+	case proto.CommandAppend:
+		t := proto.AppendResponse{}
+		err := t.Unmarshal(msg.Data())
+		if err != nil {
+			return err
+		}
+		writer.Write(t)
+	case proto.CommandDescribe:
+		t := proto.DescribeResponse{}
+		err := t.Unmarshal(msg.Data())
+		if err != nil {
+			return err
+		}
+		writer.Write(t)
+	case proto.CommandTopics:
+		t := proto.ListTopicsResponse{}
+		err := t.Unmarshal(msg.Data())
+		if err != nil {
+			return err
+		}
+		writer.Write(t)
+		if t.Next != "" {
+			req := proto.ListTopicsRequest{}
+			_ = req.Unmarshal(sent.Data())
+			req.After = t.Next
+			fmt.Fprintf(out, "more topics follow, continue with: %s\n", repl.FormatTopicsCommand(req))
+		}
+	case proto.CommandDatabaseStatus:
+		t := proto.DatabaseStatusResponse{}
+		err := t.Unmarshal(msg.Data())
+		if err != nil {
+			return err
+		}
+		writer.Write(t)
+	case proto.CommandList:
+		t := proto.ListResponse{}
+		err := t.Unmarshal(msg.Data())
+		if err != nil {
+			return err
+		}
+		writer.Write(t)
+	}
+	return nil
+}
+
+// execute runs a single command, as it would be run in the REPL, and prints
+// its result to stdout. Errors are printed to stderr, and exit with a
+// non-zero status, so that scripts can tell whether the command succeeded.
+func execute(c fossil.Client, line, output string) {
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Notices go to stderr, so that they don't end up in the output of
+	// scripts
+	c.HandleNotices(func(n proto.Notice) {
+		fmt.Fprintln(os.Stderr, n)
+	})
+
+	if bucket, query, ok, err := repl.ParseHistogramCommand(line); ok {
+		if err != nil {
+			fail(err)
+		}
+		results, err := c.Query(query)
+		if err != nil {
+			fail(err)
+		}
+		h, err := repl.NewHistogram(results, bucket)
+		if err != nil {
+			fail(err)
+		}
+		repl.NewOutputWriter(os.Stdout, output).Write(h)
+		return
+	}
+
+	replMsg, err := repl.ParseREPLCommand([]byte(line), listSchemas(c))
+	if err != nil {
+		fail(err)
+	}
+
+	msg, err := c.Send(replMsg)
+	if err != nil {
+		fail(fmt.Errorf("error sending message to server: %w", err))
+	}
+
+	err = printResponse(os.Stdout, output, viper.GetBool("fossil.expand"), replMsg, msg)
+	if err != nil {
+		fail(err)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossil
+
+import (
+	"fmt"
+	"os"
+
+	fossil "github.com/dburkart/fossil/api"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/spf13/cobra"
+)
+
+// completionHostEnv names the environment variable holding the server
+// completions of database and topic names are looked up on
+const completionHostEnv = "FOSSIL_HOST"
+
+var completionCmd = &cobra.Command{
+	Use:   "completion bash|zsh|fish",
+	Short: "Generate a shell completion script",
+	Long: fmt.Sprintf(`Generate a completion script for the given shell, and write it to stdout.
+
+If %s is set to the connection string of a running server, database names
+are completed for --host, and topic names for --prefix, by asking that server.
+Local databases are never opened to complete their names.
+
+To load completions in the current bash session:
+
+	source <(fossil completion bash)
+`, completionHostEnv),
+	ValidArgs:             []string{"bash", "zsh", "fish"},
+	Args:                  cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	DisableFlagsInUseLine: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		root := cmd.Root()
+		switch args[0] {
+		case "bash":
+			return root.GenBashCompletionV2(os.Stdout, true)
+		case "zsh":
+			return root.GenZshCompletion(os.Stdout)
+		default:
+			return root.GenFishCompletion(os.Stdout, true)
+		}
+	},
+}
+
+// completionClient connects to the server named by completionHostEnv. Local
+// databases aren't connected to, since that would create them if they don't
+// exist.
+func completionClient() (fossil.Client, proto.ConnectionString, bool) {
+	host := os.Getenv(completionHostEnv)
+	if host == "" {
+		return nil, proto.ConnectionString{}, false
+	}
+	target, err := proto.ParseConnectionString(host)
+	if err != nil || target.Local {
+		return nil, target, false
+	}
+	client, err := fossil.NewClient(host)
+	if err != nil {
+		return nil, target, false
+	}
+	return client, target, true
+}
+
+// completeDatabases completes connection strings for each database on the
+// completion server
+func completeDatabases(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	client, target, ok := completionClient()
+	if !ok {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	defer client.Close()
+
+	msg, err := client.Send(proto.NewMessageWithType(proto.CommandList, proto.ListRequest{}))
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	resp := proto.ListResponse{}
+	err = resp.Unmarshal(msg.Data())
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	scheme := "fossil"
+	if target.Network == "unix" {
+		scheme = "fossil+unix"
+	}
+	hosts := make([]string, 0, len(resp.ObjectList))
+	for _, db := range resp.ObjectList {
+		hosts = append(hosts, fmt.Sprintf("%s://%s/%s", scheme, target.Address, db))
+	}
+	return hosts, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeTopics completes the topics of the completion server's database
+func completeTopics(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	client, _, ok := completionClient()
+	if !ok {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	defer client.Close()
+
+	topics, err := client.ListTopics(toComplete)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	names := make([]string, 0, len(topics))
+	for _, t := range topics {
+		names = append(names, t.Topic)
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
@@ -10,8 +10,12 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/dburkart/fossil/cmd/fossil/admin"
+	"github.com/dburkart/fossil/cmd/fossil/bench"
+	"github.com/dburkart/fossil/cmd/fossil/cdc"
 	"github.com/dburkart/fossil/cmd/fossil/client"
 	"github.com/dburkart/fossil/cmd/fossil/server"
+	"github.com/dburkart/fossil/cmd/fossil/simulate"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -26,6 +30,10 @@ var (
 		Use:   "fossil",
 		Short: "Fossil is a small and fast tsdb",
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			// Completions are written to stdout, so mustn't be mixed with logs
+			if cmd.Name() == cobra.ShellCompRequestCmd || cmd.Name() == cobra.ShellCompNoDescRequestCmd {
+				return
+			}
 			initLogging()
 			initLogLevel()
 			initConfig(cmd.Root().PersistentFlags().Lookup("config").Value.String())
@@ -61,6 +69,18 @@ func init() {
 	client.Command.Version = rootCmd.Version
 	rootCmd.AddCommand(server.Command)
 	rootCmd.AddCommand(client.Command)
+	rootCmd.AddCommand(bench.Command)
+	rootCmd.AddCommand(cdc.Command)
+	rootCmd.AddCommand(simulate.Command)
+	rootCmd.AddCommand(admin.Command)
+
+	// Replace cobra's default completion command with one which also
+	// completes database and topic names from a running server
+	rootCmd.CompletionOptions.DisableDefaultCmd = true
+	rootCmd.AddCommand(completionCmd)
+	rootCmd.RegisterFlagCompletionFunc("host", completeDatabases)
+	bench.Command.RegisterFlagCompletionFunc("prefix", completeTopics)
+	simulate.Command.RegisterFlagCompletionFunc("topic", completeTopics)
 }
 
 func Execute() {
@@ -7,10 +7,17 @@
 package server
 
 import (
+	"context"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/rpc"
 	"github.com/dburkart/fossil/pkg/server"
+	"github.com/dburkart/fossil/pkg/tracing"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -23,30 +30,270 @@ var Command = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		logger := viper.Get("logger").(zerolog.Logger)
 
+		auditLog, err := buildAuditLog()
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error opening audit log")
+		}
+
 		// Initialize database server
 		srv := server.New(
 			logger,
-			buildDatabaseConfigs(),
+			DatabaseConfigs(),
 			viper.GetInt("fossil.port"),
 			viper.GetInt("fossil.prom-port"),
+			buildLimits(),
+			buildTopicACLs(logger),
+			auditLog,
 		)
+		srv.DeduplicateAppends(viper.GetDuration("fossil.idempotency-window"))
+		srv.TimeOut(server.Timeouts{
+			Idle:    viper.GetDuration("fossil.idle-timeout"),
+			Header:  viper.GetDuration("fossil.header-timeout"),
+			Message: viper.GetDuration("fossil.message-timeout"),
+		})
+		if adminPort := viper.GetInt("fossil.admin-port"); adminPort > 0 {
+			token := viper.GetString("fossil.admin-token")
+			if token == "" {
+				logger.Fatal().Msg("an admin token is required to serve an admin port")
+			}
+			srv.SeparateAdmin(adminPort, token)
+		}
+
+		// Export spans over OTLP, if enabled
+		if endpoint := viper.GetString("fossil.otlp-endpoint"); endpoint != "" {
+			tracer, err := tracing.NewOTLP(context.Background(), endpoint, viper.GetBool("fossil.otlp-insecure"), "fossil")
+			if err != nil {
+				logger.Error().Err(err).Msg("error configuring tracing")
+			} else {
+				logger.Info().Str("endpoint", endpoint).Msg("exporting traces over OTLP")
+				srv.Trace(tracer)
+			}
+		}
 
 		// Serve the database
 		go srv.ServeDatabase()
+		go srv.ServeAdmin()
+		if socket := viper.GetString("fossil.unix-socket"); socket != "" {
+			go srv.ServeUnix(socket)
+		}
+		for _, l := range buildListeners(logger) {
+			go srv.ServeListener(l)
+		}
+
+		// Serve the gRPC API, if enabled
+		if grpcPort := viper.GetInt("fossil.grpc-port"); grpcPort > 0 {
+			go func() {
+				logger.Info().Int("port", grpcPort).Msg("gRPC server started")
+				err := rpc.Serve(grpcPort, rpc.NewService(srv.Databases(), srv.ACLs()))
+				if err != nil {
+					logger.Error().Err(err).Msg("error serving gRPC")
+				}
+			}()
+		}
 
 		// Serve the metrics endpoint
 		srv.ServeMetrics()
 	},
 }
 
-func buildDatabaseConfigs() map[string]server.DatabaseConfig {
+func buildLimits() proto.Limits {
+	return proto.Limits{
+		MaxMessageSize: int(viper.GetSizeInBytes("fossil.max-message-size")),
+		MaxAppendSize:  int(viper.GetSizeInBytes("fossil.max-append-size")),
+		MaxTopicLength: viper.GetInt("fossil.max-topic-length"),
+	}
+}
+
+// buildAuditLog opens the audit log configured in the [audit] block, or
+// returns nil if it doesn't configure a file or topic
+func buildAuditLog() (*server.AuditLog, error) {
+	config := server.AuditConfig{
+		File:       viper.GetString("audit.file"),
+		MaxSize:    int64(viper.GetSizeInBytes("audit.max-size")),
+		MaxBackups: viper.GetInt("audit.max-backups"),
+		Topic:      viper.GetString("audit.topic"),
+		Appends:    viper.GetBool("audit.appends"),
+	}
+	if config.File == "" && config.Topic == "" {
+		return nil, nil
+	}
+	return server.NewAuditLog(config)
+}
+
+// buildTopicACLs builds an ACL for each [acl.<name>] block, checked in order
+// of name
+func buildTopicACLs(logger zerolog.Logger) proto.TopicACLs {
+	names := make([]string, 0)
+	for name := range viper.GetStringMap("acl") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	acls := make(proto.TopicACLs, 0, len(names))
+	for _, name := range names {
+		clients, err := proto.ParseClients(viper.GetStringSlice(strings.Join([]string{"acl", name, "clients"}, ".")))
+		if err != nil {
+			logger.Fatal().Err(err).Str("acl", name).Msg("error parsing acl")
+		}
+
+		acls = append(acls, proto.TopicACL{
+			Name:    name,
+			Clients: clients,
+			Allow:   viper.GetStringSlice(strings.Join([]string{"acl", name, "allow"}, ".")),
+			Deny:    viper.GetStringSlice(strings.Join([]string{"acl", name, "deny"}, ".")),
+			// Trusted clients may create topics in strict mode
+			CreateTopics: viper.GetBool(strings.Join([]string{"acl", name, "create-topics"}, ".")),
+		})
+	}
+
+	return acls
+}
+
+// buildListeners builds the config of each extra listener in the
+// [listener.<name>] blocks, in order of name
+func buildListeners(logger zerolog.Logger) []server.ListenerConfig {
+	names := make([]string, 0)
+	for name := range viper.GetStringMap("listener") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	listeners := make([]server.ListenerConfig, 0, len(names))
+	for _, name := range names {
+		key := func(option string) string {
+			return strings.Join([]string{"listener", name, option}, ".")
+		}
+
+		l := server.ListenerConfig{
+			Name:     name,
+			Address:  viper.GetString(key("address")),
+			Port:     viper.GetInt(key("port")),
+			Database: viper.GetString(key("database")),
+			TLSCert:  viper.GetString(key("tls-cert")),
+			TLSKey:   viper.GetString(key("tls-key")),
+		}
+		switch name {
+		case server.DefaultListener, server.UnixListener, server.AdminListener:
+			logger.Fatal().Str("listener", name).Msg("listener name is reserved")
+		}
+		if l.Port <= 0 {
+			logger.Fatal().Str("listener", name).Msg("listener needs a port")
+		}
+		if (l.TLSCert == "") != (l.TLSKey == "") {
+			logger.Fatal().Str("listener", name).Msg("listener needs both a tls-cert and a tls-key to serve TLS")
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners
+}
+
+// dedupWindows parses the dedup windows of the topics listed in key
+func dedupWindows(key string) map[string]time.Duration {
+	windows, err := database.ParseDedupWindows(viper.GetStringSlice(key))
+	if err != nil {
+		logger := viper.Get("logger").(zerolog.Logger)
+		logger.Fatal().Err(err).Str("option", key).Msg("error parsing dedup windows")
+	}
+	return windows
+}
+
+// DatabaseConfigs builds the config of each database in the [database]
+// blocks, keyed by name
+func DatabaseConfigs() map[string]server.DatabaseConfig {
 	ret := make(map[string]server.DatabaseConfig)
 
 	for _, v := range viper.GetStringSlice("database.names") {
 		// If this is a non-default db look up the config value for it
 		dbConfig := server.DatabaseConfig{
-			Name:      v,
-			Directory: viper.GetString(strings.Join([]string{"database", v, "directory"}, ".")),
+			Name:             v,
+			Directory:        viper.GetString(strings.Join([]string{"database", v, "directory"}, ".")),
+			SyncWrites:       viper.GetBool("database.sync-writes"),
+			FlushInterval:    viper.GetDuration("database.flush-interval"),
+			StrictTopics:     viper.GetBool("database.strict-topics"),
+			MaxTopics:        viper.GetInt("database.max-topics"),
+			MaxQueryRange:    viper.GetDuration("database.max-query-range"),
+			MaxQueryResults:  viper.GetInt("database.max-query-results"),
+			RawRetention:     viper.GetDuration("database.raw-retention"),
+			RollupInterval:   viper.GetDuration("database.rollup-interval"),
+			RecoverTopics:    viper.GetBool("database.recover-topics"),
+			ChangeFeedSize:   viper.GetInt("database.change-feed-size"),
+			ManualMigrations: !viper.GetBool("database.auto-migrate"),
+			ColumnarSegments: viper.GetBool("database.columnar-segments"),
+			DedupWindows:     dedupWindows("database.dedup"),
+
+			SlowAppendThreshold: viper.GetDuration("database.slow-append-threshold"),
+			SlowFlushThreshold:  viper.GetDuration("database.slow-flush-threshold"),
+		}
+
+		syncKey := strings.Join([]string{"database", v, "sync-writes"}, ".")
+		if viper.IsSet(syncKey) {
+			dbConfig.SyncWrites = viper.GetBool(syncKey)
+		}
+
+		flushKey := strings.Join([]string{"database", v, "flush-interval"}, ".")
+		if viper.IsSet(flushKey) {
+			dbConfig.FlushInterval = viper.GetDuration(flushKey)
+		}
+
+		strictKey := strings.Join([]string{"database", v, "strict-topics"}, ".")
+		if viper.IsSet(strictKey) {
+			dbConfig.StrictTopics = viper.GetBool(strictKey)
+		}
+
+		maxTopicsKey := strings.Join([]string{"database", v, "max-topics"}, ".")
+		if viper.IsSet(maxTopicsKey) {
+			dbConfig.MaxTopics = viper.GetInt(maxTopicsKey)
+		}
+
+		maxRangeKey := strings.Join([]string{"database", v, "max-query-range"}, ".")
+		if viper.IsSet(maxRangeKey) {
+			dbConfig.MaxQueryRange = viper.GetDuration(maxRangeKey)
+		}
+
+		maxResultsKey := strings.Join([]string{"database", v, "max-query-results"}, ".")
+		if viper.IsSet(maxResultsKey) {
+			dbConfig.MaxQueryResults = viper.GetInt(maxResultsKey)
+		}
+
+		retentionKey := strings.Join([]string{"database", v, "raw-retention"}, ".")
+		if viper.IsSet(retentionKey) {
+			dbConfig.RawRetention = viper.GetDuration(retentionKey)
+		}
+
+		rollupKey := strings.Join([]string{"database", v, "rollup-interval"}, ".")
+		if viper.IsSet(rollupKey) {
+			dbConfig.RollupInterval = viper.GetDuration(rollupKey)
+		}
+
+		recoverKey := strings.Join([]string{"database", v, "recover-topics"}, ".")
+		if viper.IsSet(recoverKey) {
+			dbConfig.RecoverTopics = viper.GetBool(recoverKey)
+		}
+
+		changeFeedKey := strings.Join([]string{"database", v, "change-feed-size"}, ".")
+		if viper.IsSet(changeFeedKey) {
+			dbConfig.ChangeFeedSize = viper.GetInt(changeFeedKey)
+		}
+
+		columnarKey := strings.Join([]string{"database", v, "columnar-segments"}, ".")
+		if viper.IsSet(columnarKey) {
+			dbConfig.ColumnarSegments = viper.GetBool(columnarKey)
+		}
+
+		dedupKey := strings.Join([]string{"database", v, "dedup"}, ".")
+		if viper.IsSet(dedupKey) {
+			dbConfig.DedupWindows = dedupWindows(dedupKey)
+		}
+
+		slowAppendKey := strings.Join([]string{"database", v, "slow-append-threshold"}, ".")
+		if viper.IsSet(slowAppendKey) {
+			dbConfig.SlowAppendThreshold = viper.GetDuration(slowAppendKey)
+		}
+
+		slowFlushKey := strings.Join([]string{"database", v, "slow-flush-threshold"}, ".")
+		if viper.IsSet(slowFlushKey) {
+			dbConfig.SlowFlushThreshold = viper.GetDuration(slowFlushKey)
 		}
 
 		// If this is the default, use the [database] block value
@@ -74,10 +321,70 @@ func init() {
 	// Flags for this command
 	Command.Flags().IntP("port", "p", 8001, "Database server port for data collection")
 	Command.Flags().Int("prom-port", 2112, "Set the port for /metrics")
+	Command.Flags().Int("grpc-port", 0, "Port for the gRPC API (0 to disable)")
+	Command.Flags().String("otlp-endpoint", "", "host:port of an OTLP/HTTP collector to export traces to (empty to disable)")
+	Command.Flags().Bool("otlp-insecure", false, "Export traces to the OTLP collector over plain HTTP, rather than HTTPS")
+	Command.Flags().String("unix-socket", "", "Path of a unix socket to also serve the database on")
+	Command.Flags().Int("admin-port", 0, "Port admin commands are only served on, to clients with the admin token (0 to serve them on every port)")
+	Command.Flags().String("admin-token", "", "Token clients of the admin port authenticate with")
 	Command.Flags().StringP("database", "d", "./", "Path to store database files")
+	Command.Flags().Duration("flush-interval", 5*time.Minute, "How often to flush databases to disk (0 to disable)")
+	Command.Flags().Bool("sync-writes", true, "Flush the write-ahead log and serialized files to stable storage on every write")
+	Command.Flags().Bool("strict-topics", false, "Reject appends to topics which don't exist, rather than creating them")
+	Command.Flags().Int("max-topics", 0, "Most topics a database may hold (0 for no limit)")
+	Command.Flags().Duration("max-query-range", 0, "Longest span of time a query may select (0 for no limit)")
+	Command.Flags().Int("max-query-results", 0, "Most entries a query may return (0 for no limit)")
+	Command.Flags().Duration("raw-retention", 0, "How long to keep raw data before rolling it up (0 to keep it forever)")
+	Command.Flags().Duration("rollup-interval", time.Minute, "Width of the buckets data is rolled up into")
+	Command.Flags().Bool("recover-topics", false, "Rebuild corrupted or missing topics and schemas files from segment data, rather than failing to start")
+	Command.Flags().Int("change-feed-size", database.DefaultChangeFeedSize, "Number of recent changes held for change data capture consumers")
+	Command.Flags().Bool("columnar-segments", false, "Lay out the data of numeric and other fixed-size topics in columns once their segment is full, to speed up scanning them")
+	Command.Flags().StringSlice("dedup", nil, "Acknowledge but don't store appends whose payload was appended to the same topic within a window, as <topic>=<window>")
+	Command.Flags().Duration("slow-append-threshold", 0, "Log appends which take longer than this (0 to disable)")
+	Command.Flags().Duration("slow-flush-threshold", 0, "Log write-ahead log writes and serializations which take longer than this (0 to disable)")
+	Command.Flags().Bool("auto-migrate", true, "Migrate databases in an old on-disk format when they're opened, rather than with 'fossil admin migrate'")
+	Command.Flags().String("max-message-size", "100mb", "Largest message the server accepts (0 for no limit)")
+	Command.Flags().String("max-append-size", "0", "Largest payload the server accepts in an append (0 for no limit)")
+	Command.Flags().Int("max-topic-length", 0, "Longest topic name the server accepts (0 for no limit)")
+	Command.Flags().Duration("idempotency-window", server.DefaultIdempotencyWindow, "How long the idempotency keys of appends are remembered, to acknowledge retries without appending twice (0 to disable)")
+	Command.Flags().Duration("idle-timeout", 0, "How long a connection may go without sending a message before it's closed (0 for no limit)")
+	Command.Flags().Duration("header-timeout", 10*time.Second, "How long a client has to send the header of a message it has started (0 for no limit)")
+	Command.Flags().Duration("message-timeout", time.Minute, "How long a client has to send the whole of a message it has started (0 for no limit)")
 
 	// Bind flags to viper
 	viper.BindPFlag("fossil.port", Command.Flags().Lookup("port"))
 	viper.BindPFlag("fossil.prom-port", Command.Flags().Lookup("prom-port"))
+	viper.BindPFlag("fossil.grpc-port", Command.Flags().Lookup("grpc-port"))
+	viper.BindPFlag("fossil.otlp-endpoint", Command.Flags().Lookup("otlp-endpoint"))
+	viper.BindPFlag("fossil.otlp-insecure", Command.Flags().Lookup("otlp-insecure"))
+	viper.BindPFlag("fossil.unix-socket", Command.Flags().Lookup("unix-socket"))
+	viper.BindPFlag("fossil.admin-port", Command.Flags().Lookup("admin-port"))
+	viper.BindPFlag("fossil.admin-token", Command.Flags().Lookup("admin-token"))
+	viper.BindPFlag("fossil.max-message-size", Command.Flags().Lookup("max-message-size"))
+	viper.BindPFlag("fossil.max-append-size", Command.Flags().Lookup("max-append-size"))
+	viper.BindPFlag("fossil.max-topic-length", Command.Flags().Lookup("max-topic-length"))
+	viper.BindPFlag("fossil.idempotency-window", Command.Flags().Lookup("idempotency-window"))
+	viper.BindPFlag("fossil.idle-timeout", Command.Flags().Lookup("idle-timeout"))
+	viper.BindPFlag("fossil.header-timeout", Command.Flags().Lookup("header-timeout"))
+	viper.BindPFlag("fossil.message-timeout", Command.Flags().Lookup("message-timeout"))
 	viper.BindPFlag("database.directory", Command.Flags().Lookup("database"))
+	viper.BindPFlag("database.flush-interval", Command.Flags().Lookup("flush-interval"))
+	viper.BindPFlag("database.sync-writes", Command.Flags().Lookup("sync-writes"))
+	viper.BindPFlag("database.strict-topics", Command.Flags().Lookup("strict-topics"))
+	viper.BindPFlag("database.max-topics", Command.Flags().Lookup("max-topics"))
+	viper.BindPFlag("database.max-query-range", Command.Flags().Lookup("max-query-range"))
+	viper.BindPFlag("database.max-query-results", Command.Flags().Lookup("max-query-results"))
+	viper.BindPFlag("database.raw-retention", Command.Flags().Lookup("raw-retention"))
+	viper.BindPFlag("database.rollup-interval", Command.Flags().Lookup("rollup-interval"))
+	viper.BindPFlag("database.recover-topics", Command.Flags().Lookup("recover-topics"))
+	viper.BindPFlag("database.change-feed-size", Command.Flags().Lookup("change-feed-size"))
+	viper.BindPFlag("database.columnar-segments", Command.Flags().Lookup("columnar-segments"))
+	viper.BindPFlag("database.dedup", Command.Flags().Lookup("dedup"))
+	viper.BindPFlag("database.slow-append-threshold", Command.Flags().Lookup("slow-append-threshold"))
+	viper.BindPFlag("database.slow-flush-threshold", Command.Flags().Lookup("slow-flush-threshold"))
+	viper.BindPFlag("database.auto-migrate", Command.Flags().Lookup("auto-migrate"))
+
+	// The audit log is only configured in the [audit] block
+	viper.SetDefault("audit.max-size", "100mb")
+	viper.SetDefault("audit.max-backups", 3)
 }
@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package simulate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	fossil "github.com/dburkart/fossil/api"
+	"github.com/dburkart/fossil/pkg/schema"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var Command = &cobra.Command{
+	Use:   "simulate",
+	Short: "Append synthetic time-series data, for demos and tests",
+	Long: `Append synthetic time-series data to a topic at a steady rate, until
+--count values have been appended, --duration has passed, or the command is
+interrupted. Values follow a pattern:
+
+  sine      a sine wave around --offset, with the given --amplitude and --period
+  sawtooth  a ramp from offset - amplitude to offset + amplitude each period
+  square    alternates between offset + amplitude and offset - amplitude each
+            half period
+  random    uniformly distributed within amplitude of offset
+  walk      a random walk starting at offset, moving up to a tenth of the
+            amplitude each step
+  counter   starts at offset and increases by amplitude each step, like a
+            request counter
+
+Periods are measured in steps rather than wall time, so the same flags and
+--seed always produce the same sequence of values.`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		log := viper.Get("logger").(zerolog.Logger)
+
+		opts, err := optionsFromFlags(cmd)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid options")
+		}
+
+		client, err := fossil.NewClient(viper.GetString("fossil.host"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to connect to server")
+		}
+		defer client.Close()
+
+		err = client.CreateTopic(opts.topic, opts.schema.ToSchema())
+		if err != nil {
+			log.Fatal().Err(err).Str("topic", opts.topic).Msg("error creating topic")
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if opts.duration > 0 {
+			ctx, stop = context.WithTimeout(ctx, opts.duration)
+			defer stop()
+		}
+
+		log.Info().
+			Str("topic", opts.topic).
+			Str("pattern", opts.pattern).
+			Dur("interval", opts.interval).
+			Msg("simulation started")
+
+		appended, err := run(ctx, client, opts)
+		if err != nil {
+			log.Fatal().Err(err).Int("appended", appended).Msg("simulation failed")
+		}
+		log.Info().Int("appended", appended).Msg("simulation finished")
+	},
+}
+
+func init() {
+	Command.Flags().String("topic", "/demo", "Topic to append to, which is created if it doesn't exist")
+	Command.Flags().String("schema", "float64", "Schema of the topic; numeric types are supported")
+	Command.Flags().String("rate", "1/s", "How many values to append, per second (/s), minute (/m) or hour (/h)")
+	Command.Flags().String("pattern", "sine", "Pattern the values follow: sine, sawtooth, square, random, walk, or counter")
+	Command.Flags().Float64("offset", 0, "Value the pattern is centered on, or starts from")
+	Command.Flags().Float64("amplitude", 10, "How far the pattern strays from the offset")
+	Command.Flags().Int("period", 60, "Number of steps in each period of the sine, sawtooth and square patterns")
+	Command.Flags().Int64("seed", 1, "Seed for the random and walk patterns")
+	Command.Flags().Int("count", 0, "Number of values to append (0 for no limit)")
+	Command.Flags().Duration("duration", 0, "How long to append values for (0 for no limit)")
+}
+
+type options struct {
+	topic     string
+	schema    *schema.Type
+	interval  time.Duration
+	pattern   string
+	offset    float64
+	amplitude float64
+	period    int
+	seed      int64
+	count     int
+	duration  time.Duration
+}
+
+func optionsFromFlags(cmd *cobra.Command) (options, error) {
+	flags := cmd.Flags()
+	opts := options{}
+	opts.topic, _ = flags.GetString("topic")
+	opts.pattern, _ = flags.GetString("pattern")
+	opts.offset, _ = flags.GetFloat64("offset")
+	opts.amplitude, _ = flags.GetFloat64("amplitude")
+	opts.period, _ = flags.GetInt("period")
+	opts.seed, _ = flags.GetInt64("seed")
+	opts.count, _ = flags.GetInt("count")
+	opts.duration, _ = flags.GetDuration("duration")
+	schemaFlag, _ := flags.GetString("schema")
+	rate, _ := flags.GetString("rate")
+
+	switch {
+	case opts.period < 1:
+		return opts, errors.New("--period must be at least 1")
+	case opts.count < 0:
+		return opts, errors.New("--count can't be negative")
+	case opts.duration < 0:
+		return opts, errors.New("--duration can't be negative")
+	}
+
+	if _, ok := patterns[opts.pattern]; !ok {
+		return opts, fmt.Errorf("unknown pattern '%s'", opts.pattern)
+	}
+
+	s, err := schema.Parse(schemaFlag)
+	if err != nil {
+		return opts, err
+	}
+	t, ok := s.(*schema.Type)
+	if !ok || !t.IsNumeric() {
+		return opts, fmt.Errorf("unsupported schema %s: only numeric types are supported", s.ToSchema())
+	}
+	opts.schema = t
+
+	opts.interval, err = parseRate(rate)
+	return opts, err
+}
+
+// parseRate parses a rate such as "10/s" into the interval between values
+func parseRate(rate string) (time.Duration, error) {
+	count, unit, found := strings.Cut(rate, "/")
+	per := time.Second
+	if found {
+		switch unit {
+		case "s":
+		case "m":
+			per = time.Minute
+		case "h":
+			per = time.Hour
+		default:
+			return 0, fmt.Errorf("invalid rate '%s': expected a unit of s, m, or h", rate)
+		}
+	}
+
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid rate '%s': expected a positive number of values", rate)
+	}
+
+	interval := time.Duration(float64(per) / n)
+	if interval <= 0 {
+		return 0, fmt.Errorf("invalid rate '%s': too fast", rate)
+	}
+	return interval, nil
+}
+
+// generator returns the value at step i. Generators may keep state, so they
+// must be called with consecutive steps.
+type generator func(i int) float64
+
+var patterns = map[string]func(options) generator{
+	"sine": func(o options) generator {
+		return func(i int) float64 {
+			return o.offset + o.amplitude*math.Sin(2*math.Pi*float64(i)/float64(o.period))
+		}
+	},
+	"sawtooth": func(o options) generator {
+		return func(i int) float64 {
+			return o.offset + o.amplitude*(2*float64(i%o.period)/float64(o.period)-1)
+		}
+	},
+	"square": func(o options) generator {
+		return func(i int) float64 {
+			if float64(i%o.period) < float64(o.period)/2 {
+				return o.offset + o.amplitude
+			}
+			return o.offset - o.amplitude
+		}
+	},
+	"random": func(o options) generator {
+		rng := rand.New(rand.NewSource(o.seed))
+		return func(int) float64 {
+			return o.offset + o.amplitude*(2*rng.Float64()-1)
+		}
+	},
+	"walk": func(o options) generator {
+		rng := rand.New(rand.NewSource(o.seed))
+		value := o.offset
+		return func(i int) float64 {
+			if i > 0 {
+				value += o.amplitude / 10 * (2*rng.Float64() - 1)
+			}
+			return value
+		}
+	},
+	"counter": func(o options) generator {
+		return func(i int) float64 {
+			return o.offset + o.amplitude*float64(i)
+		}
+	},
+}
+
+// encode encodes value for t, rounding it for integer types
+func encode(value float64, t *schema.Type) ([]byte, error) {
+	if strings.HasPrefix(t.Name, "float") {
+		return schema.EncodeStringForSchema(strconv.FormatFloat(value, 'g', -1, 64), t)
+	}
+	if strings.HasPrefix(t.Name, "uint") && value < 0 {
+		value = 0
+	}
+	return schema.EncodeStringForSchema(strconv.FormatFloat(math.Round(value), 'f', 0, 64), t)
+}
+
+// run appends a value every interval until ctx is done or count values have
+// been appended, returning how many were
+func run(ctx context.Context, c fossil.Client, opts options) (int, error) {
+	next := patterns[opts.pattern](opts)
+	ticker := time.NewTicker(opts.interval)
+	defer ticker.Stop()
+
+	for i := 0; opts.count == 0 || i < opts.count; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return i, nil
+			case <-ticker.C:
+			}
+		}
+
+		data, err := encode(next(i), opts.schema)
+		if err != nil {
+			return i, fmt.Errorf("%w; try a different --offset or --amplitude for %s", err, opts.schema.Name)
+		}
+		err = c.Append(opts.topic, data)
+		if err != nil {
+			return i, err
+		}
+	}
+	return opts.count, nil
+}
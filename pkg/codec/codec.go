@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+// Package codec converts payloads appended to a topic from the topic's
+// declared payload format into fossil's internal binary encoding.
+package codec
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// Codec decodes documents of a particular payload format
+type Codec interface {
+	// Name is the name used to select this codec for a topic
+	Name() string
+	// Decode converts data into the binary encoding expected by s, returning
+	// an error if data does not conform to s.
+	Decode(data []byte, s schema.Object) ([]byte, error)
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]Codec{}
+)
+
+func init() {
+	Register(Binary{})
+	Register(JSON{})
+	Register(MsgPack{})
+}
+
+// Register makes a codec available by name. Registering a codec with the
+// same name as an existing codec replaces it.
+func Register(c Codec) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[c.Name()] = c
+}
+
+// Lookup returns the codec registered under name. The empty string refers to
+// the Binary codec.
+func Lookup(name string) (Codec, error) {
+	if name == "" {
+		name = Binary{}.Name()
+	}
+
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	c, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec '%s'", name)
+	}
+	return c, nil
+}
+
+// Names returns the names of all registered codecs, sorted
+func Names() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Binary is the default codec, which expects payloads to already be in
+// fossil's binary encoding.
+type Binary struct{}
+
+func (Binary) Name() string { return "binary" }
+
+func (Binary) Decode(data []byte, _ schema.Object) ([]byte, error) {
+	return data, nil
+}
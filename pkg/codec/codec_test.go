@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+func mustParse(t *testing.T, s string) schema.Object {
+	obj, err := schema.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestLookup(t *testing.T) {
+	c, err := Lookup("")
+	if err != nil || c.Name() != "binary" {
+		t.Errorf("expected empty codec name to refer to binary, got %v, %v", c, err)
+	}
+
+	_, err = Lookup("protobuf")
+	if err == nil {
+		t.Error("expected unknown codec to return an error")
+	}
+}
+
+func TestJSONDecode(t *testing.T) {
+	s := mustParse(t, `{"name":string,"temp":float32,"readings":[2]int16,"ok":boolean}`)
+
+	actual, err := JSON{}.Decode([]byte(`{"ok": true, "readings": [1, -2], "temp": 1.5, "name": "probe"}`), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Composite keys are encoded in sorted order
+	expected := binary.LittleEndian.AppendUint32([]byte{}, 5)
+	expected = append(expected, "probe"...)
+	expected = append(expected, 1)
+	expected = binary.LittleEndian.AppendUint16(expected, 1)
+	expected = binary.LittleEndian.AppendUint16(expected, uint16(0xfffe))
+	expected = binary.LittleEndian.AppendUint32(expected, math.Float32bits(1.5))
+
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	if !s.Validate(actual) {
+		t.Error("expected decoded JSON to validate against its schema")
+	}
+}
+
+func TestJSONDecodeErrors(t *testing.T) {
+	tests := []struct {
+		schema   string
+		document string
+	}{
+		{"int8", "300"},
+		{"uint16", "-1"},
+		{"int32", "1.5"},
+		{"string", "12"},
+		{"[2]int32", "[1, 2, 3]"},
+		{`{"x":int32}`, `{"y": 1}`},
+		{`{"x":int32}`, `{"x": 1, "y": 2}`},
+		{"int32", "1 2"},
+	}
+
+	for _, test := range tests {
+		_, err := JSON{}.Decode([]byte(test.document), mustParse(t, test.schema))
+		if err == nil {
+			t.Errorf("expected '%s' to fail to decode as %s", test.document, test.schema)
+		}
+	}
+}
+
+func TestJSONDecodeOptionalKeys(t *testing.T) {
+	s := mustParse(t, `{"x":int16=3,"note":string?}`)
+
+	actual, err := JSON{}.Decode([]byte(`{"note": null}`), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The absent note is a 0 presence byte, and x takes its default
+	expected := []byte{0}
+	expected = binary.LittleEndian.AppendUint16(expected, 3)
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	actual, err = JSON{}.Decode([]byte(`{"note": "hi", "x": 1}`), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = binary.LittleEndian.AppendUint32([]byte{1}, 2)
+	expected = append(expected, "hi"...)
+	expected = binary.LittleEndian.AppendUint16(expected, 1)
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	if !s.Validate(actual) {
+		t.Error("expected decoded JSON to validate against its schema")
+	}
+}
+
+func TestJSONDecodeEnum(t *testing.T) {
+	s := mustParse(t, `{"status":enum("ok","warn","crit"),"n":uint8}`)
+
+	actual, err := JSON{}.Decode([]byte(`{"status": "crit", "n": 4}`), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, []byte{4, 2}) {
+		t.Errorf("expected [4 2], got %v", actual)
+	}
+
+	if _, err := (JSON{}).Decode([]byte(`{"status": "down", "n": 4}`), s); err == nil {
+		t.Error("expected a value outside the enum to fail to decode")
+	}
+}
+
+func TestMsgPackDecode(t *testing.T) {
+	s := mustParse(t, `{"id":uint64,"name":string,"delta":int16,"value":float64}`)
+
+	// {"delta": -3, "id": 300, "name": "abc", "value": 0.5}
+	document := []byte{0x84,
+		0xa5, 'd', 'e', 'l', 't', 'a', 0xfd,
+		0xa2, 'i', 'd', 0xcd, 0x01, 0x2c,
+		0xa4, 'n', 'a', 'm', 'e', 0xa3, 'a', 'b', 'c',
+		0xa5, 'v', 'a', 'l', 'u', 'e', 0xcb,
+	}
+	document = binary.BigEndian.AppendUint64(document, math.Float64bits(0.5))
+
+	actual, err := MsgPack{}.Decode(document, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := binary.LittleEndian.AppendUint16([]byte{}, uint16(0xfffd))
+	expected = binary.LittleEndian.AppendUint64(expected, 300)
+	expected = binary.LittleEndian.AppendUint32(expected, 3)
+	expected = append(expected, "abc"...)
+	expected = binary.LittleEndian.AppendUint64(expected, math.Float64bits(0.5))
+
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestMsgPackDecodeTruncated(t *testing.T) {
+	_, err := MsgPack{}.Decode([]byte{0x92, 0x01}, mustParse(t, "[2]int32"))
+	if err == nil {
+		t.Error("expected truncated document to fail to decode")
+	}
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// encodeValue converts a generic decoded document into the binary encoding
+// expected by s. Documents are made up of the values produced by decoding
+// JSON or msgpack: nil, bool, string, []byte, json.Number, int64, uint64,
+// float64, []any and map[string]any.
+func encodeValue(v any, s schema.Object) ([]byte, error) {
+	switch t := s.(type) {
+	case *schema.Type:
+		return encodeType(v, *t)
+	case schema.Type:
+		return encodeType(v, t)
+	case *schema.Array:
+		return encodeArray(v, *t)
+	case schema.Array:
+		return encodeArray(v, t)
+	case *schema.Enum:
+		return encodeEnum(v, *t)
+	case schema.Enum:
+		return encodeEnum(v, t)
+	case *schema.Composite:
+		return encodeComposite(v, *t)
+	case schema.Composite:
+		return encodeComposite(v, t)
+	}
+
+	return nil, fmt.Errorf("unsupported schema %s", s.ToSchema())
+}
+
+func encodeType(v any, t schema.Type) ([]byte, error) {
+	switch t.Name {
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return nil, typeError(v, t)
+		}
+		return []byte(s), nil
+	case "binary":
+		switch b := v.(type) {
+		case []byte:
+			return b, nil
+		case string:
+			return []byte(b), nil
+		}
+		return nil, typeError(v, t)
+	case "boolean":
+		b, ok := v.(bool)
+		if !ok {
+			return nil, typeError(v, t)
+		}
+		return schema.EncodeType(b)
+	case "int8", "int16", "int32", "int64":
+		i, err := toInt64(v)
+		if err != nil {
+			return nil, typeError(v, t)
+		}
+		bits := t.Size() * 8
+		if bits < 64 && (i < -1<<(bits-1) || i > 1<<(bits-1)-1) {
+			return nil, fmt.Errorf("value %d overflows %s", i, t.Name)
+		}
+		return encodeUnsigned(uint64(i), t.Size()), nil
+	case "uint8", "uint16", "uint32", "uint64":
+		u, err := toUint64(v)
+		if err != nil {
+			return nil, typeError(v, t)
+		}
+		bits := t.Size() * 8
+		if bits < 64 && u > 1<<bits-1 {
+			return nil, fmt.Errorf("value %d overflows %s", u, t.Name)
+		}
+		return encodeUnsigned(u, t.Size()), nil
+	case "float32":
+		f, err := toFloat64(v)
+		if err != nil {
+			return nil, typeError(v, t)
+		}
+		return schema.EncodeType(float32(f))
+	case "float64":
+		f, err := toFloat64(v)
+		if err != nil {
+			return nil, typeError(v, t)
+		}
+		return schema.EncodeType(f)
+	case "timestamp", "duration":
+		// Either formatted like the output writers format them, or a number of
+		// nanoseconds
+		if s, ok := v.(string); ok {
+			b, err := schema.EncodeStringForSchema(s, &t)
+			if err != nil {
+				return nil, typeError(v, t)
+			}
+			return b, nil
+		}
+		i, err := toInt64(v)
+		if err != nil {
+			return nil, typeError(v, t)
+		}
+		return schema.EncodeType(i)
+	}
+
+	return nil, fmt.Errorf("unsupported type %s", t.Name)
+}
+
+func encodeArray(v any, a schema.Array) ([]byte, error) {
+	elements, ok := v.([]any)
+	if !ok {
+		return nil, typeError(v, a)
+	}
+
+	if len(elements) != a.Length {
+		return nil, fmt.Errorf("schema expects %d elements, document has %d", a.Length, len(elements))
+	}
+
+	var encoded []byte
+	for _, e := range elements {
+		b, err := encodeType(e, a.Type)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, b...)
+	}
+
+	return encoded, nil
+}
+
+func encodeEnum(v any, e schema.Enum) ([]byte, error) {
+	name, ok := v.(string)
+	if !ok {
+		return nil, typeError(v, e)
+	}
+
+	i, ok := e.Index(name)
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not one of %s", name, e.ToSchema())
+	}
+	return []byte{byte(i)}, nil
+}
+
+func encodeComposite(v any, c schema.Composite) ([]byte, error) {
+	document, ok := v.(map[string]any)
+	if !ok {
+		return nil, typeError(v, c)
+	}
+
+	for key := range document {
+		if i := sort.SearchStrings(c.Keys, key); i == len(c.Keys) || c.Keys[i] != key {
+			return nil, fmt.Errorf("document has unknown key '%s'", key)
+		}
+	}
+
+	var encoded []byte
+	for i, key := range c.Keys {
+		var b []byte
+		var err error
+
+		value, ok := document[key]
+		if ok && value == nil && c.Optional[key] {
+			// An explicit null is the same as leaving the key out
+			ok = false
+		}
+
+		if ok {
+			b, err = encodeValue(value, c.Values[i])
+		} else if d, hasDefault := c.Defaults[key]; hasDefault {
+			b, err = schema.EncodeStringForSchema(d, c.Values[i])
+		} else if c.Optional[key] {
+			encoded = append(encoded, 0)
+			continue
+		} else {
+			return nil, fmt.Errorf("document is missing key '%s'", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key '%s': %w", key, err)
+		}
+
+		if c.Optional[key] {
+			encoded = append(encoded, 1)
+		}
+
+		// Variable length values are prefixed by their length
+		if t, ok := c.Values[i].(*schema.Type); ok && (t.Name == "string" || t.Name == "binary") {
+			encoded = binary.LittleEndian.AppendUint32(encoded, uint32(len(b)))
+		}
+
+		encoded = append(encoded, b...)
+	}
+
+	return encoded, nil
+}
+
+func encodeUnsigned(u uint64, size int) []byte {
+	encoded := binary.LittleEndian.AppendUint64([]byte{}, u)
+	return encoded[:size]
+}
+
+func toInt64(v any) (int64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return strconv.ParseInt(string(n), 10, 64)
+	case int64:
+		return n, nil
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, fmt.Errorf("value %d overflows int64", n)
+		}
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("%v is not an integer", v)
+}
+
+func toUint64(v any) (uint64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return strconv.ParseUint(string(n), 10, 64)
+	case int64:
+		if n < 0 {
+			return 0, fmt.Errorf("value %d is negative", n)
+		}
+		return uint64(n), nil
+	case uint64:
+		return n, nil
+	}
+	return 0, fmt.Errorf("%v is not an unsigned integer", v)
+}
+
+func toFloat64(v any) (float64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return n.Float64()
+	case int64:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+func typeError(v any, s schema.Object) error {
+	return fmt.Errorf("cannot convert %v to %s", v, s.ToSchema())
+}
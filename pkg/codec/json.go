@@ -0,0 +1,38 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// JSON accepts payloads as JSON documents
+type JSON struct{}
+
+func (JSON) Name() string { return "json" }
+
+func (JSON) Decode(data []byte, s schema.Object) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Keep numbers as written, so that large integers don't lose precision
+	dec.UseNumber()
+
+	var document any
+	err := dec.Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+
+	if dec.More() {
+		return nil, errors.New("unexpected data after JSON document")
+	}
+
+	return encodeValue(document, s)
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// MsgPack accepts payloads as msgpack documents
+type MsgPack struct{}
+
+func (MsgPack) Name() string { return "msgpack" }
+
+func (MsgPack) Decode(data []byte, s schema.Object) ([]byte, error) {
+	r := msgpackReader{data: data}
+
+	document, err := r.value()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.pos != len(r.data) {
+		return nil, errors.New("unexpected data after msgpack document")
+	}
+
+	return encodeValue(document, s)
+}
+
+var errShortMsgPack = errors.New("msgpack document is truncated")
+
+// msgpackReader decodes the subset of msgpack which maps onto fossil's
+// schema types. Extension types are not supported.
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, errShortMsgPack
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *msgpackReader) uint(n int) (uint64, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+func (r *msgpackReader) value() (any, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	tag := b[0]
+
+	switch {
+	case tag <= 0x7f:
+		return int64(tag), nil
+	case tag >= 0xe0:
+		return int64(int8(tag)), nil
+	case tag&0xf0 == 0x80:
+		return r.mapOf(int(tag & 0x0f))
+	case tag&0xf0 == 0x90:
+		return r.arrayOf(int(tag & 0x0f))
+	case tag&0xe0 == 0xa0:
+		return r.str(int(tag & 0x1f))
+	}
+
+	switch tag {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.uint(1 << (tag - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, b...), nil
+	case 0xca:
+		n, err := r.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 0xcb:
+		n, err := r.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(n), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return r.uint(1 << (tag - 0xcc))
+	case 0xd0:
+		n, err := r.uint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := r.uint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := r.uint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := r.uint(8)
+		return int64(n), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uint(1 << (tag - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return r.str(int(n))
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (tag - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.arrayOf(int(n))
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (tag - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.mapOf(int(n))
+	}
+
+	return nil, fmt.Errorf("unsupported msgpack type 0x%02x", tag)
+}
+
+func (r *msgpackReader) str(n int) (any, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (r *msgpackReader) arrayOf(n int) (any, error) {
+	// Every element takes up at least a byte, so don't trust lengths
+	// longer than the remaining data
+	if n > len(r.data)-r.pos {
+		return nil, errShortMsgPack
+	}
+
+	elements := make([]any, n)
+	for i := range elements {
+		e, err := r.value()
+		if err != nil {
+			return nil, err
+		}
+		elements[i] = e
+	}
+	return elements, nil
+}
+
+func (r *msgpackReader) mapOf(n int) (any, error) {
+	if n > len(r.data)-r.pos {
+		return nil, errShortMsgPack
+	}
+
+	m := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		k, err := r.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack map keys must be strings, got %v", k)
+		}
+
+		v, err := r.value()
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
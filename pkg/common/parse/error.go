@@ -21,14 +21,57 @@ func NewSyntaxError(t Token, m string) SyntaxError {
 }
 
 func (s *SyntaxError) FormatError(input string) string {
-	repeat := s.Location.End - s.Location.Start - 1
+	return "Syntax error found in query:\n" + s.snippet(input)
+}
+
+// snippet returns the line of input where the error was found, with a caret
+// pointing at the error underneath it, followed by the error message
+func (s *SyntaxError) snippet(input string) string {
+	start, end := s.Location.Start, s.Location.End
+	if start > len(input) {
+		start = len(input)
+	}
+
+	// Only the line the error starts on is shown, for multi-line input
+	lineStart := strings.LastIndexByte(input[:start], '\n') + 1
+	if lineEnd := strings.IndexByte(input[start:], '\n'); lineEnd != -1 {
+		input = input[:start+lineEnd]
+		if end > len(input) {
+			end = len(input)
+		}
+	}
+	input = input[lineStart:]
+	start -= lineStart
+	end -= lineStart
+
+	repeat := end - start - 1
 	if repeat < 0 {
 		repeat = 0
 	}
 
-	errorString := "Syntax error found in query:\n"
-	errorString += input
-	errorString += fmt.Sprintf("\n%s^%s ", strings.Repeat(" ", s.Location.Start), strings.Repeat("~", repeat))
+	errorString := input
+	errorString += fmt.Sprintf("\n%s^%s ", strings.Repeat(" ", start), strings.Repeat("~", repeat))
 	errorString += fmt.Sprintf("%s\n", s.Message)
 	return errorString
 }
+
+// SyntaxErrors are the errors found in a single input, in the order they were
+// found
+type SyntaxErrors []SyntaxError
+
+// FormatErrors formats every error in the list, each with its own copy of
+// input pointing at where it was found
+func (e SyntaxErrors) FormatErrors(input string) string {
+	if len(e) == 1 {
+		return e[0].FormatError(input)
+	}
+
+	errorString := fmt.Sprintf("%d syntax errors found in query:\n", len(e))
+	for i := range e {
+		if i > 0 {
+			errorString += "\n"
+		}
+		errorString += e[i].snippet(input)
+	}
+	return errorString
+}
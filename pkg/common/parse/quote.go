@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package parse
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MatchQuoted returns the length of the quoted string at the start of input,
+// quotes included, or 0 if input doesn't start with one. Strings are quoted
+// with either double or single quotes, and a backslash escapes the rune
+// following it, so the closing quote is the first one which isn't escaped.
+func MatchQuoted(input string) int {
+	quote, width := utf8.DecodeRuneInString(input)
+	if quote != '"' && quote != '\'' {
+		return 0
+	}
+
+	pos := width
+	for pos < len(input) {
+		r, width := utf8.DecodeRuneInString(input[pos:])
+		pos += width
+		switch r {
+		case quote:
+			return pos
+		case '\\':
+			_, width = utf8.DecodeRuneInString(input[pos:])
+			pos += width
+		}
+	}
+	return 0
+}
+
+// Unquote interprets lexeme as a string quoted with double or single quotes,
+// returning the string it holds. The escape sequences of Go string literals
+// are supported, such as \n, \\ and \u00e9, along with escaping the quote the
+// string is quoted with.
+func Unquote(lexeme string) (string, error) {
+	n := len(lexeme)
+	if n < 2 || lexeme[0] != lexeme[n-1] || (lexeme[0] != '"' && lexeme[0] != '\'') {
+		return "", strconv.ErrSyntax
+	}
+	quote := lexeme[0]
+	s := lexeme[1 : n-1]
+
+	if !strings.ContainsRune(s, '\\') && !strings.ContainsRune(s, rune(quote)) {
+		if !utf8.ValidString(s) {
+			return "", strconv.ErrSyntax
+		}
+		return s, nil
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for len(s) > 0 {
+		r, multibyte, tail, err := strconv.UnquoteChar(s, quote)
+		if err != nil {
+			return "", err
+		}
+		if r < utf8.RuneSelf || !multibyte {
+			b.WriteByte(byte(r))
+		} else {
+			b.WriteRune(r)
+		}
+		s = tail
+	}
+	return b.String(), nil
+}
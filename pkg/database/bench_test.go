@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// benchmarkEntry is appended by the benchmarks below, and is about the size
+// of a typical metric
+var benchmarkEntry = []byte("temperature=21.5,humidity=40")
+
+func newBenchmarkDatabase(b *testing.B, config Config) *Database {
+	b.Helper()
+
+	db, err := NewDatabaseWithConfig("bench", filepath.Join(b.TempDir(), "db"), config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// Appends flush in the background, which mustn't outlive the directory
+	b.Cleanup(func() { db.Flush() })
+	return db
+}
+
+// fillSegments replaces the segments of db with count full segments of
+// entries in topic, one millisecond apart, starting at start
+func fillSegments(db *Database, topic string, count int, start time.Time) {
+	topicID := db.AddTopic(topic, "")
+
+	db.Segments = make([]Segment, count)
+	for i := range db.Segments {
+		segment := &db.Segments[i]
+		segment.HeadTime = start.Add(time.Duration(i*SegmentSize) * time.Millisecond)
+		for j := 0; j < SegmentSize; j++ {
+			segment.Append(&Datum{Delta: time.Duration(j) * time.Millisecond, TopicID: topicID, Data: benchmarkEntry})
+		}
+	}
+	db.Current = uint32(count - 1)
+	db.indexTopicSpans()
+}
+
+func BenchmarkAppend(b *testing.B) {
+	db := newBenchmarkDatabase(b, Config{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := db.Append(benchmarkEntry, "/foo")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendComposite(b *testing.B) {
+	db := newBenchmarkDatabase(b, Config{})
+	_, err := db.CreateTopic("/weather", `{"temperature":float32,"humidity":float32,"station":string}`, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	entry, err := schema.EncodeStringForSchema(`"temperature":21.5,"humidity":40,"station":north`, db.SchemaForTopic("/weather"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := db.Append(entry, "/weather")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendParallel(b *testing.B) {
+	for _, topics := range []int{1, 16} {
+		b.Run(fmt.Sprintf("topics=%d", topics), func(b *testing.B) {
+			db := newBenchmarkDatabase(b, Config{})
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					err := db.Append(benchmarkEntry, fmt.Sprintf("/foo/%d", i%topics))
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkAppendSyncWrites(b *testing.B) {
+	db := newBenchmarkDatabase(b, Config{SyncWrites: true})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := db.Append(benchmarkEntry, "/foo")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRetrieve(b *testing.B) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, segments := range []int{1, 10, 50} {
+		db := newBenchmarkDatabase(b, Config{})
+		fillSegments(db, "/foo", segments, start)
+		end := start.Add(time.Duration(segments*SegmentSize) * time.Millisecond)
+
+		b.Run(fmt.Sprintf("segments=%d/all", segments), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				db.Retrieve(Query{})
+			}
+		})
+
+		// A range covering the last tenth of the database
+		b.Run(fmt.Sprintf("segments=%d/range", segments), func(b *testing.B) {
+			q := Query{
+				Range:          &TimeRange{Start: end.Add(-end.Sub(start) / 10), End: end},
+				RangeSemantics: "between",
+			}
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				db.Retrieve(q)
+			}
+		})
+	}
+}
+
+func BenchmarkScanColumnar(b *testing.B) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := Query{Topics: []string{"/numbers"}, OnlyTopics: true}
+
+	for _, columnar := range []bool{false, true} {
+		db := newBenchmarkDatabase(b, Config{ColumnarSegments: columnar})
+		fillMixedSegments(db, start)
+		db.writeLock.Lock()
+		db.buildColumnsInternal()
+		db.writeLock.Unlock()
+
+		// Scanning leaves out the cost of collecting the entries, which is
+		// the same either way
+		b.Run(fmt.Sprintf("columnar=%t", columnar), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				db.Scan(q, func(Entry) {})
+			}
+		})
+	}
+}
+
+func BenchmarkWriteAheadLogReplay(b *testing.B) {
+	for _, entries := range []int{1000, 5000} {
+		b.Run(fmt.Sprintf("entries=%d", entries), func(b *testing.B) {
+			db := newBenchmarkDatabase(b, Config{})
+			for i := 0; i < entries; i++ {
+				err := db.Append(benchmarkEntry, fmt.Sprintf("/foo/%d", i%10))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			// Below SegmentSize appends the database is never serialized, so
+			// the write-ahead log is all there is to load
+			wal, err := os.ReadFile(filepath.Join(db.Path, "wal.log"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			base := b.TempDir()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				location := filepath.Join(base, fmt.Sprintf("db-%d", i))
+				err = os.Mkdir(location, 0700)
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = os.WriteFile(filepath.Join(location, "wal.log"), wal, 0600)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				_, err = NewDatabase("bench", location)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDeserialize(b *testing.B) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, segments := range []int{10, 50} {
+		b.Run(fmt.Sprintf("segments=%d", segments), func(b *testing.B) {
+			db := newBenchmarkDatabase(b, Config{})
+			fillSegments(db, "/foo", segments, start)
+			err := db.serializeInternal()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err = NewDatabase("bench", db.Path)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultChangeFeedSize is the number of changes a database keeps for change
+// data capture consumers when Config.ChangeFeedSize is 0
+const DefaultChangeFeedSize = 10000
+
+// ErrChangesExpired is returned when asking for changes older than the
+// oldest change the database still holds. Consumers should catch up by
+// querying the database, and follow changes from the offset returned along
+// with the error.
+var ErrChangesExpired = errors.New("changes are no longer available")
+
+// ChangeKind describes what a Change did
+type ChangeKind string
+
+const (
+	// ChangeAppend appended Data to Topic
+	ChangeAppend ChangeKind = "append"
+	// ChangeCreateTopic created Topic with Schema
+	ChangeCreateTopic ChangeKind = "create-topic"
+	// ChangeSetCodec set the codec of Topic to Codec
+	ChangeSetCodec ChangeKind = "set-codec"
+	// ChangeOverrideSchema marked Topic as overriding its parent's schema
+	ChangeOverrideSchema ChangeKind = "override-schema"
+	// ChangeAddSchema added a named schema called Name
+	ChangeAddSchema ChangeKind = "add-schema"
+	// ChangeAddTemplate added a topic template for the pattern in Name
+	ChangeAddTemplate ChangeKind = "add-template"
+)
+
+// A Change is an action committed to a database's write-ahead log, as seen
+// by change data capture consumers. Only the fields relevant to its Kind are
+// set.
+type Change struct {
+	// Offset is the sequence number of the action in the write-ahead log.
+	// Offsets increase monotonically, but skip actions which are internal
+	// to the database, such as adding a segment.
+	Offset uint64     `json:"offset"`
+	Kind   ChangeKind `json:"kind"`
+	// Time is when data was appended
+	Time  time.Time `json:"time,omitempty"`
+	Topic string    `json:"topic,omitempty"`
+	// Name is the name of a named schema, or the pattern of a template
+	Name   string        `json:"name,omitempty"`
+	Schema string        `json:"schema,omitempty"`
+	Codec  string        `json:"codec,omitempty"`
+	Data   []byte        `json:"data,omitempty"`
+	TTL    time.Duration `json:"ttl,omitempty"`
+}
+
+// MarshalJSON encodes c, leaving out Time unless it's set
+func (c Change) MarshalJSON() ([]byte, error) {
+	type change Change
+	var t *time.Time
+	if !c.Time.IsZero() {
+		t = &c.Time
+	}
+	return json.Marshal(struct {
+		change
+		Time *time.Time `json:"time,omitempty"`
+	}{change(c), t})
+}
+
+// changeRecord is an action written to the write-ahead log, which is decoded
+// into a Change when a consumer asks for it
+type changeRecord struct {
+	offset uint64
+	action int
+	// payload is the action's base64 encoded payload
+	payload string
+	// head is the head time of the segment appended to, when the action
+	// was written
+	head time.Time
+}
+
+// changeFeed holds the most recent actions written to a database's
+// write-ahead log, so that consumers can follow them without reading the
+// log, which is removed each time the database is serialized
+type changeFeed struct {
+	capacity int
+
+	mu      sync.Mutex
+	records []changeRecord
+	// start is the offset of the oldest change which is still held, or
+	// would be held once it's written
+	start uint64
+	// head is the head time of the current segment
+	head time.Time
+	// added is closed, and replaced, whenever records are added
+	added chan struct{}
+}
+
+func newChangeFeed(capacity int) *changeFeed {
+	if capacity <= 0 {
+		capacity = DefaultChangeFeedSize
+	}
+	return &changeFeed{capacity: capacity, start: 1, added: make(chan struct{})}
+}
+
+// reset sets the offset after which changes are held, and the head time of
+// the current segment, once a database has been deserialized
+func (f *changeFeed) reset(sequence uint64, head time.Time) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.records = nil
+	f.start = sequence + 1
+	f.head = head
+}
+
+// add records actions which have been written to the write-ahead log, in
+// sequence order
+func (f *changeFeed) add(actions ...[]byte) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	added := false
+	for _, lines := range actions {
+		for _, line := range strings.Split(strings.TrimSpace(string(lines)), "\n") {
+			action, payload, sequence, err := parseAction(line)
+			if err != nil || sequence == 0 {
+				continue
+			}
+
+			if action == actionAddSegment {
+				if b, err := base64.StdEncoding.DecodeString(payload); err == nil {
+					gob.NewDecoder(bytes.NewBuffer(b)).Decode(&f.head)
+				}
+			}
+
+			f.records = append(f.records, changeRecord{offset: sequence, action: action, payload: payload, head: f.head})
+			added = true
+		}
+	}
+
+	if excess := len(f.records) - f.capacity; excess > 0 {
+		f.start = f.records[excess-1].offset + 1
+		f.records = append([]changeRecord{}, f.records[excess:]...)
+	}
+
+	if added {
+		close(f.added)
+		f.added = make(chan struct{})
+	}
+}
+
+// since returns up to limit records with offsets of at least from, along
+// with a channel which is closed when more records are added
+func (f *changeFeed) since(from uint64, limit int) ([]changeRecord, uint64, <-chan struct{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if from == 0 {
+		from = f.start
+	}
+	if from < f.start {
+		return nil, f.start, nil, ErrChangesExpired
+	}
+
+	i := sort.Search(len(f.records), func(i int) bool { return f.records[i].offset >= from })
+	records := f.records[i:]
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return append([]changeRecord{}, records...), from, f.added, nil
+}
+
+// Changes returns up to limit changes committed to the database's
+// write-ahead log with offsets of at least from, in offset order, along with
+// the offset to ask for next. A from of 0 starts with the oldest change the
+// database holds. If there are no changes yet, Changes waits until there are,
+// or until ctx is done, in which case no changes are returned. Changes older
+// than the Config.ChangeFeedSize most recent ones are no longer held, and
+// asking for them returns ErrChangesExpired.
+func (d *Database) Changes(ctx context.Context, from uint64, limit int) ([]Change, uint64, error) {
+	if d.changes == nil {
+		return nil, from, ErrChangesExpired
+	}
+
+	for {
+		records, next, added, err := d.changes.since(from, limit)
+		if err != nil {
+			return nil, next, err
+		}
+
+		changes := make([]Change, 0, len(records))
+		for _, r := range records {
+			next = r.offset + 1
+			if c, ok := d.decodeChange(r); ok {
+				changes = append(changes, c)
+			}
+		}
+		if len(changes) > 0 {
+			return changes, next, nil
+		}
+
+		// Either nothing has been written since from, or only actions
+		// consumers don't see, so wait for more
+		from = next
+		select {
+		case <-added:
+		case <-ctx.Done():
+			return changes, next, nil
+		}
+	}
+}
+
+// decodeChange decodes r into a Change, returning false for actions which
+// aren't exposed to consumers
+func (d *Database) decodeChange(r changeRecord) (Change, bool) {
+	c := Change{Offset: r.offset}
+
+	b, err := base64.StdEncoding.DecodeString(r.payload)
+	if err != nil {
+		return c, false
+	}
+	dec := gob.NewDecoder(bytes.NewBuffer(b))
+
+	switch r.action {
+	case actionAddEvent:
+		var datum Datum
+		if dec.Decode(&datum) != nil {
+			return c, false
+		}
+		d.topicLock.RLock()
+		if datum.TopicID < len(d.TopicLookup) {
+			c.Topic = d.TopicLookup[datum.TopicID]
+			c.Schema = d.SchemaLookup[datum.TopicID].ToSchema()
+		}
+		d.topicLock.RUnlock()
+		c.Kind = ChangeAppend
+		c.Time = r.head.Add(datum.Delta)
+		c.Data = datum.Data
+		c.TTL = datum.TTL
+	case actionAddTopic, actionSetTopicCodec, actionAddSchema:
+		var value string
+		if dec.Decode(&value) != nil {
+			return c, false
+		}
+		switch r.action {
+		case actionAddTopic:
+			c.Kind = ChangeCreateTopic
+			c.Topic, c.Schema, _ = strings.Cut(value, ":")
+		case actionSetTopicCodec:
+			idx := strings.LastIndex(value, ":")
+			if idx == -1 {
+				return c, false
+			}
+			c.Kind = ChangeSetCodec
+			c.Topic, c.Codec = value[:idx], value[idx+1:]
+		case actionAddSchema:
+			c.Kind = ChangeAddSchema
+			c.Name, c.Schema, _ = strings.Cut(value, ":")
+		}
+	case actionOverrideSchema:
+		if dec.Decode(&c.Topic) != nil {
+			return c, false
+		}
+		c.Kind = ChangeOverrideSchema
+	case actionAddTemplate:
+		var t TopicTemplate
+		if dec.Decode(&t) != nil {
+			return c, false
+		}
+		c.Kind = ChangeAddTemplate
+		c.Name, c.Schema = t.Pattern, t.Schema
+	default:
+		return c, false
+	}
+
+	return c, true
+}
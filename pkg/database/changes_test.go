@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChanges(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	if _, err = db.CreateTopic("/temp", "int32", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Append([]byte{1, 0, 0, 0}, "/temp"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, next, err := db.Changes(context.Background(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The root topic, /temp, and the append
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %+v", changes)
+	}
+	created, appended := changes[1], changes[2]
+	if created.Kind != ChangeCreateTopic || created.Topic != "/temp" || created.Schema != "int32" {
+		t.Errorf("unexpected change %+v", created)
+	}
+	if appended.Kind != ChangeAppend || appended.Topic != "/temp" || appended.Data[0] != 1 || appended.Time.Before(before) {
+		t.Errorf("unexpected change %+v", appended)
+	}
+	if appended.Offset <= created.Offset || next != appended.Offset+1 {
+		t.Errorf("expected increasing offsets, got %d, %d and next %d", created.Offset, appended.Offset, next)
+	}
+
+	// Waiting for changes returns once one is committed
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		db.Append([]byte{2, 0, 0, 0}, "/temp")
+	}()
+	changes, _, err = db.Changes(context.Background(), next, 0)
+	if err != nil || len(changes) != 1 || changes[0].Data[0] != 2 {
+		t.Errorf("expected the next append, got %+v, %v", changes, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	changes, _, err = db.Changes(ctx, changes[0].Offset+1, 0)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("expected no changes once the context is done, got %+v, %v", changes, err)
+	}
+}
+
+func TestChangesAcrossReopen(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+	db, err := NewDatabaseWithConfig("test", location, Config{ChangeFeedSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(0); i < 3; i++ {
+		if err = db.Append([]byte{i}, "/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the two most recent changes are held
+	changes, next, err := db.Changes(context.Background(), 1, 0)
+	if !errors.Is(err, ErrChangesExpired) {
+		t.Fatalf("expected ErrChangesExpired, got %+v, %v", changes, err)
+	}
+	changes, _, err = db.Changes(context.Background(), next, 0)
+	if err != nil || len(changes) != 2 || changes[1].Data[0] != 2 {
+		t.Fatalf("expected the last two appends, got %+v, %v", changes, err)
+	}
+	last := changes[1]
+
+	// Changes still in the write-ahead log are replayed when the database
+	// is opened
+	db, err = NewDatabaseWithConfig("test", location, Config{ChangeFeedSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, _, err = db.Changes(context.Background(), last.Offset, 0)
+	if err != nil || len(changes) != 1 || !changes[0].Time.Equal(last.Time) {
+		t.Errorf("expected %+v, got %+v, %v", last, changes, err)
+	}
+
+	// Serializing the database removes the write-ahead log, so changes
+	// before it are gone once it's reopened
+	if err = db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDatabaseWithConfig("test", location, Config{ChangeFeedSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, next, err = db.Changes(context.Background(), last.Offset, 0); !errors.Is(err, ErrChangesExpired) || next != last.Offset+1 {
+		t.Errorf("expected ErrChangesExpired starting at %d, got %d, %v", last.Offset+1, next, err)
+	}
+}
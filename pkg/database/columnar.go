@@ -0,0 +1,258 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"sort"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// When Config.ColumnarSegments is set, full segments lay out the data of each
+// topic with a fixed-size schema in memory as columns: the times, sequence
+// numbers and values of its datums in parallel slices, with every value in a
+// single block. Datums keep their data, as slices of the block, so only
+// queries which select topics need to know about columns.
+
+// valueColumn holds the datums of one topic in a segment
+type valueColumn struct {
+	// width is the size of each value
+	width int
+	// rows is the index of each datum in the segment's series
+	rows      []int32
+	deltas    []time.Duration
+	sequences []uint64
+	// ttls is nil unless one of the datums has a TTL
+	ttls   []time.Duration
+	values []byte
+}
+
+// value returns the value of the kth datum in the column
+func (c *valueColumn) value(k int) []byte {
+	// Cap the slice, so that appending to it can't overwrite the next value
+	return c.values[k*c.width : (k+1)*c.width : (k+1)*c.width]
+}
+
+// expired returns true if the kth datum in the column, appended at t, has
+// expired by now
+func (c *valueColumn) expired(k int, t, now time.Time) bool {
+	return c.ttls != nil && c.ttls[k] > 0 && !now.Before(t.Add(c.ttls[k]))
+}
+
+// segmentColumns is the columnar layout of a segment
+type segmentColumns struct {
+	columns map[int]*valueColumn
+	// rest holds the IDs of topics which have data in the segment outside of
+	// a column
+	rest map[int]bool
+}
+
+// fixedWidth returns the size of every value of schema s, or 0 if their size
+// varies
+func fixedWidth(s schema.Object) int {
+	switch t := s.(type) {
+	case *schema.Type:
+		if t.Name == "string" || t.Name == "binary" {
+			return 0
+		}
+		return t.Size()
+	case *schema.Array:
+		if t.Type.Name == "string" || t.Type.Name == "binary" {
+			return 0
+		}
+		return t.Size()
+	case *schema.Enum:
+		return t.Size()
+	}
+	return 0
+}
+
+// columnWidths returns the width of the values of each topic with a
+// fixed-size schema, keyed by topic ID
+func (d *Database) columnWidths() map[int]int {
+	d.topicLock.RLock()
+	defer d.topicLock.RUnlock()
+
+	widths := make(map[int]int)
+	for id, s := range d.SchemaLookup {
+		if width := fixedWidth(s); width > 0 {
+			widths[id] = width
+		}
+	}
+	return widths
+}
+
+// buildColumns lays out the data of each topic in widths in a column. Topics
+// with any datum whose data isn't their width are left as they are.
+func (s *Segment) buildColumns(widths map[int]int) {
+	c := &segmentColumns{
+		columns: make(map[int]*valueColumn),
+		rest:    make(map[int]bool),
+	}
+
+	counts := make(map[int]int)
+	for i := 0; i < s.Size; i++ {
+		datum := &s.Series[i]
+		if width, ok := widths[datum.TopicID]; !ok || len(datum.Data) != width {
+			c.rest[datum.TopicID] = true
+			continue
+		}
+		counts[datum.TopicID]++
+	}
+
+	for id, n := range counts {
+		if c.rest[id] {
+			continue
+		}
+		c.columns[id] = &valueColumn{
+			width:     widths[id],
+			rows:      make([]int32, 0, n),
+			deltas:    make([]time.Duration, 0, n),
+			sequences: make([]uint64, 0, n),
+			values:    make([]byte, 0, n*widths[id]),
+		}
+	}
+
+	for i := 0; i < s.Size; i++ {
+		datum := &s.Series[i]
+		column, ok := c.columns[datum.TopicID]
+		if !ok {
+			continue
+		}
+		if datum.TTL > 0 && column.ttls == nil {
+			column.ttls = make([]time.Duration, len(column.rows), cap(column.rows))
+		}
+
+		column.rows = append(column.rows, int32(i))
+		column.deltas = append(column.deltas, datum.Delta)
+		column.sequences = append(column.sequences, datum.Sequence)
+		column.values = append(column.values, datum.Data...)
+		if column.ttls != nil {
+			column.ttls = append(column.ttls, datum.TTL)
+		}
+	}
+
+	// Datums share their column's block from now on, rather than each holding
+	// an allocation of their own
+	for _, column := range c.columns {
+		for k, row := range column.rows {
+			s.Series[row].Data = column.value(k)
+		}
+	}
+
+	s.columnar = c
+}
+
+// buildColumnsInternal builds the columns of each full segment which doesn't
+// have them yet, if Config.ColumnarSegments is set. Datums are moved into
+// their columns in place, so it waits for any queries which are running. It
+// must be called with writeLock held.
+func (db *Database) buildColumnsInternal() {
+	if !db.config.ColumnarSegments {
+		return
+	}
+
+	db.segmentLock.RLock()
+	pending := []int{}
+	for i := 0; i < int(db.Current); i++ {
+		if db.Segments[i].columnar == nil {
+			pending = append(pending, i)
+		}
+	}
+	db.segmentLock.RUnlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	widths := db.columnWidths()
+
+	db.queryLock.Lock()
+	defer db.queryLock.Unlock()
+
+	for _, i := range pending {
+		db.Segments[i].buildColumns(widths)
+	}
+}
+
+// scanColumns calls fn with the entries of the topics a snapshot wants among
+// the datums from index from to index to of segment, reading them from its
+// columns. Nothing is called, and it returns false, unless the data of every
+// wanted topic in the segment is in a column.
+func (s *snapshot) scanColumns(segment *Segment, from, to int, fn func(Entry)) bool {
+	c := segment.columnar
+	if c == nil || s.wanted == nil {
+		return false
+	}
+
+	type cursor struct {
+		id     int
+		column *valueColumn
+		schema string
+		// k is the next datum in the column, and end is the first one after
+		// the range
+		k, end int
+	}
+	var cursors []cursor
+	for id := range s.wanted {
+		if c.rest[id] {
+			return false
+		}
+		column, ok := c.columns[id]
+		if !ok {
+			continue
+		}
+		cursors = append(cursors, cursor{
+			id:     id,
+			column: column,
+			schema: s.schemas[id].ToSchema(),
+			k:      sort.Search(len(column.rows), func(k int) bool { return int(column.rows[k]) >= from }),
+			end:    sort.Search(len(column.rows), func(k int) bool { return int(column.rows[k]) >= to }),
+		})
+	}
+
+	emit := func(cur *cursor, k int) {
+		t := segment.HeadTime.Add(cur.column.deltas[k])
+		if cur.column.expired(k, t, s.now) {
+			return
+		}
+		fn(Entry{
+			Time:     t,
+			Topic:    s.topics[cur.id],
+			Schema:   cur.schema,
+			Data:     cur.column.value(k),
+			Sequence: cur.column.sequences[k],
+		})
+	}
+
+	if len(cursors) == 1 {
+		cur := &cursors[0]
+		for k := cur.k; k < cur.end; k++ {
+			emit(cur, k)
+		}
+		return true
+	}
+
+	// Entries of several topics are merged back into the order of the
+	// segment's series
+	for {
+		next := -1
+		for i := range cursors {
+			cur := &cursors[i]
+			if cur.k < cur.end && (next < 0 || cur.column.rows[cur.k] < cursors[next].column.rows[cursors[next].k]) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return true
+		}
+
+		cur := &cursors[next]
+		cur.k++
+		emit(cur, cur.k-1)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fillMixedSegments replaces the segments of db with two full segments and a
+// current one, cycling through appends to /numbers, /strings and /expiring,
+// whose data expires for every other datum
+func fillMixedSegments(db *Database, start time.Time) {
+	numbers := db.AddTopic("/numbers", "int64")
+	strings := db.AddTopic("/strings", "string")
+	expiring := db.AddTopic("/expiring", "int32")
+
+	db.Segments = make([]Segment, 3)
+	sequence := uint64(0)
+	for i := range db.Segments {
+		segment := &db.Segments[i]
+		segment.HeadTime = start.Add(time.Duration(i*SegmentSize) * time.Millisecond)
+		size := SegmentSize
+		if i == len(db.Segments)-1 {
+			size = 100
+		}
+		for j := 0; j < size; j++ {
+			sequence++
+			datum := Datum{Delta: time.Duration(j) * time.Millisecond, Sequence: sequence}
+			switch j % 3 {
+			case 0:
+				datum.TopicID = numbers
+				datum.Data = binary.LittleEndian.AppendUint64(nil, sequence)
+			case 1:
+				datum.TopicID = strings
+				datum.Data = []byte("some string")
+			case 2:
+				datum.TopicID = expiring
+				datum.Data = binary.LittleEndian.AppendUint32(nil, uint32(sequence))
+				if j%2 == 0 {
+					datum.TTL = time.Millisecond
+				}
+			}
+			segment.Append(&datum)
+		}
+	}
+	db.Current = uint32(len(db.Segments) - 1)
+	db.Sequence = sequence
+	db.indexTopicSpans()
+}
+
+func TestColumnarSegments(t *testing.T) {
+	db, err := NewDatabaseWithConfig("test", filepath.Join(t.TempDir(), "db"), Config{ColumnarSegments: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	fillMixedSegments(db, start)
+
+	// Retrieving every topic reads each datum in place, which columns must
+	// agree with
+	expected := func(q Query) []Entry {
+		wanted := make(map[string]bool)
+		for _, topic := range q.Topics {
+			wanted[topic] = true
+		}
+		q.OnlyTopics = false
+		entries := []Entry{}
+		for _, e := range db.Retrieve(q) {
+			if wanted[e.Topic] {
+				entries = append(entries, e)
+			}
+		}
+		return entries
+	}
+	between := &TimeRange{Start: start.Add(5000 * time.Millisecond), End: start.Add(15000 * time.Millisecond)}
+	queries := []Query{
+		{Topics: []string{"/numbers"}},
+		{Topics: []string{"/numbers", "/expiring"}},
+		{Topics: []string{"/numbers", "/strings"}},
+		{Topics: []string{"/numbers"}, Range: between, RangeSemantics: "between"},
+		{Topics: []string{"/expiring", "/numbers"}, Range: between, RangeSemantics: "between"},
+		{Topics: []string{"/numbers"}, Range: &TimeRange{Start: start, End: between.End}, RangeSemantics: "before"},
+		{Topics: []string{"/missing"}},
+	}
+	for i := range queries {
+		queries[i].OnlyTopics = true
+	}
+
+	check := func() {
+		t.Helper()
+		for _, q := range queries {
+			want := expected(q)
+			if got := db.Retrieve(q); !reflect.DeepEqual(got, want) {
+				t.Errorf("%v: expected %d entries, got %d", q.Topics, len(want), len(got))
+			}
+		}
+	}
+	check()
+
+	db.writeLock.Lock()
+	db.buildColumnsInternal()
+	db.writeLock.Unlock()
+
+	// The current segment is left as it is
+	if db.Segments[2].columnar != nil {
+		t.Error("expected the current segment not to have columns")
+	}
+	c := db.Segments[0].columnar
+	if c == nil {
+		t.Fatal("expected full segments to have columns")
+	}
+	numbers, ok := c.columns[db.topics["/numbers"]]
+	if !ok || len(numbers.rows) != (SegmentSize+2)/3 {
+		t.Fatalf("expected a column of /numbers, got %+v", c.columns)
+	}
+	if _, ok := c.columns[db.topics["/strings"]]; ok || !c.rest[db.topics["/strings"]] {
+		t.Error("expected /strings to be left out of the columns")
+	}
+	if &db.Segments[0].Series[0].Data[0] != &numbers.values[0] {
+		t.Error("expected datums to share their column's block")
+	}
+	check()
+
+	// Compaction moves datums, so columns are rebuilt
+	if err = db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if db.Segments[0].columnar == nil {
+		t.Error("expected columns to be rebuilt after compaction")
+	}
+	check()
+
+	// Columns are built when the database is opened
+	db, err = NewDatabaseWithConfig("test", db.Path, Config{ColumnarSegments: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Segments[1].columnar == nil {
+		t.Error("expected full segments to have columns when the database is opened")
+	}
+	check()
+}
+
+func TestColumnarSegmentsSkipMismatchedData(t *testing.T) {
+	segment := Segment{}
+	for i := 0; i < 10; i++ {
+		data := binary.LittleEndian.AppendUint64(nil, uint64(i))
+		if i == 5 {
+			data = data[:4]
+		}
+		segment.Append(&Datum{Delta: time.Duration(i), TopicID: 1, Data: data})
+	}
+
+	segment.buildColumns(map[int]int{1: 8})
+	if _, ok := segment.columnar.columns[1]; ok || !segment.columnar.rest[1] {
+		t.Error("expected a topic with data of the wrong size to be left out of the columns")
+	}
+}
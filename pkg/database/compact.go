@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"path"
+	"time"
+)
+
+// compactionDue returns true if a full segment holds data which has expired
+// by now. The current segment is compacted once it's full.
+func (db *Database) compactionDue(now time.Time) bool {
+	for i := 0; i < int(db.Current); i++ {
+		expires := db.Segments[i].Expires
+		if !expires.IsZero() && !expires.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// compact removes the data in a segment which has expired by now, and
+// returns the number of datums removed
+func (s *Segment) compact(now time.Time) int {
+	size := 0
+	s.Expires = time.Time{}
+	// Datums move, so the segment's columns are rebuilt afterwards
+	s.columnar = nil
+	for j := 0; j < s.Size; j++ {
+		datum := s.Series[j]
+		t := s.HeadTime.Add(datum.Delta)
+		if datum.expired(t, now) {
+			continue
+		}
+
+		if datum.TTL > 0 && (s.Expires.IsZero() || t.Add(datum.TTL).Before(s.Expires)) {
+			s.Expires = t.Add(datum.TTL)
+		}
+		s.Series[size] = datum
+		size++
+	}
+
+	removed := s.Size - size
+	for j := size; j < s.Size; j++ {
+		s.Series[j] = Datum{}
+	}
+	s.Size = size
+	return removed
+}
+
+// compactInternal removes expired data from full segments, and rewrites
+// their files. Queries read segments in place, so it waits for any which are
+// running. It must be called with writeLock held, right after the database
+// has been serialized, so that the segments it rewrites don't hold data which
+// is also still in the write-ahead log.
+func (db *Database) compactInternal(now time.Time) error {
+	if !db.compactionDue(now) {
+		return nil
+	}
+
+	db.queryLock.Lock()
+	defer db.queryLock.Unlock()
+
+	directory := path.Join(db.Path, "segments")
+	removed := 0
+	compacted := 0
+	for i := 0; i < int(db.Current); i++ {
+		segment := &db.Segments[i]
+		if segment.Expires.IsZero() || segment.Expires.After(now) {
+			continue
+		}
+
+		removed += segment.compact(now)
+		compacted++
+
+		var encoded bytes.Buffer
+		err := gob.NewEncoder(&encoded).Encode(segment)
+		if err != nil {
+			return err
+		}
+		err = db.replaceFile(path.Join(directory, fmt.Sprintf("%d", i+db.rollups.Dropped)), encoded.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	err := db.syncDirectory(directory)
+	if err != nil {
+		return err
+	}
+
+	db.log.Info().Int("segments", compacted).Int("removed", removed).Msg("compacted expired data")
+	return nil
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Config holds the tunable behavior of a Database which is not persisted to
+// disk.
+type Config struct {
+	// SyncWrites controls durability. When set, every write to the write-ahead
+	// log, as well as every file written during serialization, is flushed to
+	// stable storage before it is considered complete.
+	SyncWrites bool
+	// StrictTopics stops appends from implicitly creating topics. Appending to
+	// a topic which doesn't exist returns ErrTopicNotFound instead, unless
+	// the append is made with AppendOrCreate.
+	StrictTopics bool
+	// MaxTopics is the most topics the database may hold, including "/". 0
+	// means there is no limit.
+	MaxTopics int
+	// MaxQueryRange is the longest span of time a query may select. Queries
+	// without a time predicate select the whole history of the database. 0
+	// means there is no limit.
+	MaxQueryRange time.Duration
+	// MaxQueryResults is the most entries a query may return. 0 means there
+	// is no limit.
+	MaxQueryResults int
+	// SchemaCacheSize is the number of parsed schemas kept in memory. 0 means
+	// DefaultSchemaCacheSize.
+	SchemaCacheSize int
+	// PlanCacheSize is the number of type checked queries kept in memory, so
+	// that queries run again don't need parsing and checking. 0 means
+	// DefaultPlanCacheSize.
+	PlanCacheSize int
+	// LoadWorkers is the number of segments decoded at once when opening a
+	// database. 0 means one per CPU.
+	LoadWorkers int
+	// ColumnarSegments lays out the data of topics with a fixed-size schema,
+	// such as numeric topics, in columns once the segment holding it is full.
+	// Queries selecting those topics then scan only their data, rather than
+	// every datum in the segment.
+	ColumnarSegments bool
+	// DedupWindows deduplicates appends to topics, keyed by topic. An append
+	// whose payload was already appended to the same topic within the
+	// topic's window is acknowledged, but not stored. Sub-topics use the
+	// window of their closest parent with one. Appends are timestamped when
+	// they're received, so a resent payload matches the entry already stored
+	// if it arrives within the window.
+	DedupWindows map[string]time.Duration
+	// SlowAppendThreshold logs appends which take longer than it, along with
+	// how long they waited for the database's write lock and write-ahead log,
+	// and counts them in Stats. 0 means appends aren't timed.
+	SlowAppendThreshold time.Duration
+	// SlowFlushThreshold logs writes to the write-ahead log, and
+	// serializations of the database, which take longer than it, and counts
+	// them in Stats. 0 means they aren't timed.
+	SlowFlushThreshold time.Duration
+	// RecoverTopics opens databases whose topics or schemas files are
+	// corrupted or missing, rebuilding them from segment data, rather than
+	// failing with ErrCorruptFile. Topic names which are lost are replaced by
+	// /recovered/<id>, and schemas by string.
+	RecoverTopics bool
+	// Logger receives the database's log messages, such as its progress
+	// opening a large database
+	Logger zerolog.Logger
+	// RawRetention is how long appended data is kept as is. Older data is
+	// downsampled into buckets of RollupInterval when the database is
+	// serialized, and only the rollups are kept. 0 keeps raw data forever.
+	RawRetention time.Duration
+	// RollupInterval is the width of the buckets data older than
+	// RawRetention is downsampled into. 0 means DefaultRollupInterval.
+	RollupInterval time.Duration
+	// ChangeFeedSize is the number of changes kept in memory for consumers
+	// following the database with Changes. 0 means DefaultChangeFeedSize.
+	ChangeFeedSize int
+	// ManualMigrations stops databases older than FossilDBVersion from being
+	// migrated when they're opened. Opening one fails with ErrMigrationNeeded
+	// instead, until it's migrated with MigrateDatabase.
+	ManualMigrations bool
+}
+
+// DefaultRollupInterval is the RollupInterval used when none is configured
+const DefaultRollupInterval = time.Minute
+
+// DefaultConfig is the Config used by NewDatabase
+var DefaultConfig = Config{
+	SyncWrites: true,
+}
@@ -14,4 +14,17 @@ type Datum struct {
 	Delta   time.Duration
 	TopicID int
 	Data    []byte
+	// TTL is how long after it was appended the datum expires. 0 means it
+	// never does.
+	TTL time.Duration
+	// Sequence is the sequence number of the write-ahead log action which
+	// appended the datum. It increases with every append to the database, so
+	// orders data whose timestamps collide. It's 0 for rollups, and data
+	// appended by older versions of fossil.
+	Sequence uint64
+}
+
+// expired returns true if the datum, appended at t, has expired by now
+func (d *Datum) expired(t, now time.Time) bool {
+	return d.TTL > 0 && !now.Before(t.Add(d.TTL))
 }
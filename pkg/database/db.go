@@ -9,7 +9,7 @@ package database
 import (
 	"bufio"
 	"bytes"
-	"compress/zlib"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
@@ -19,7 +19,9 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dburkart/fossil/pkg/schema"
@@ -28,7 +30,7 @@ import (
 
 // FossilDBVersion is the version of the database as recorded on disk.
 // This is primarily used for migration.
-const FossilDBVersion = 2
+const FossilDBVersion = 3
 
 type Database struct {
 	Version      uint32
@@ -37,6 +39,7 @@ type Database struct {
 	TopicLookup  []string
 	SchemaLookup []schema.Object
 	TopicCount   int
+	Sequence     uint64    // Sequence number of the last write-ahead log action
 	STime        time.Time // Last serialize time
 	Name         string    // <-- We do not save to disk, starting here
 	Path         string
@@ -44,27 +47,142 @@ type Database struct {
 	// Private fields
 
 	// Our topic map is marked private since it is not thread safe
-	topics      map[string]int
-	schemaCache sync.Map
+	topics       map[string]int
+	codecs       map[string]string
+	encodings    map[string]string
+	overrides    map[string]bool
+	namedSchemas map[string]string
+	templates    []TopicTemplate
+	schemaCache  schemaCache
+	plans        planCache
+	// generation is incremented whenever a topic is added. See Generation.
+	generation atomic.Uint64
+	// validators holds a compiled validator for each schema in SchemaLookup
+	validators  []schema.Validator
+	wal         *walWriter
+	changes     *changeFeed
 	writeLock   sync.Mutex
 	topicLock   sync.RWMutex
-	appendCount int
+	segmentLock sync.RWMutex // Held while modifying what queries snapshot
+	queryLock   sync.RWMutex // Held by queries, so compaction can wait for them
+	rollups     rollupTier
+	spans       topicSpans
+	appendCount atomic.Int64 // Appends since the database was last serialized
+	counters    counters
+	dedup       dedupIndex
+	config      Config
 	log         zerolog.Logger
+
+	// Sequence number of the last write-ahead log action serialized to disk
+	flushedSequence uint64
+	// pendingFlush is closed once the flush an append started in the
+	// background is finished, and is nil if none is running. It's guarded by
+	// writeLock.
+	pendingFlush chan struct{}
 }
 
 func (db *Database) Stats() Stats {
-	return Stats{
-		Segments:      len(db.Segments),
-		TopicCount:    db.TopicCount,
-		SerializeTime: db.STime,
+	db.segmentLock.RLock()
+	defer db.segmentLock.RUnlock()
+
+	stats := Stats{
+		Segments:          len(db.Segments),
+		TopicCount:        db.TopicCount,
+		SerializeTime:     db.STime,
+		SerializeDuration: time.Duration(db.counters.serializeNanos.Load()),
+		PendingAppends:    int(db.appendCount.Load()),
+		Appends:           db.counters.appends.Load(),
+		AppendTime:        time.Duration(db.counters.appendNanos.Load()),
+		Queries:           db.counters.queries.Load(),
+		RetrievedEntries:  db.counters.retrieved.Load(),
+		Serializations:    db.counters.serializations.Load(),
+		ClockSkews:        db.counters.clockSkews.Load(),
+		PlanCacheHits:     db.counters.planCacheHits.Load(),
+		PlanCacheMisses:   db.counters.planCacheMisses.Load(),
+		DuplicateAppends:  db.counters.duplicateAppends.Load(),
+		SlowAppends:       db.counters.slowAppends.Load(),
+		SlowFlushes:       db.counters.slowFlushes.Load(),
+	}
+	if err := db.counters.flushErr.Load(); err != nil {
+		stats.FlushError = *err
+	}
+	if info, err := os.Stat(db.writeAheadLog().LogPath); err == nil {
+		stats.WALSize = info.Size()
+	}
+	stats.DiskSize = db.counters.storedBytes.Load() + stats.WALSize
+	return stats
+}
+
+// writeAheadLog returns a handle to the database's write-ahead log
+func (d *Database) writeAheadLog() WriteAheadLog {
+	return walForConfig(d.Path, d.config)
+}
+
+func walForConfig(location string, config Config) WriteAheadLog {
+	return WriteAheadLog{LogPath: filepath.Join(location, "wal.log"), Sync: config.SyncWrites}
+}
+
+// writeLog writes encoded actions to the write-ahead log. It must be called
+// with writeLock held, to keep actions in sequence order.
+func (d *Database) writeLog(actions ...[]byte) {
+	d.waitForLog(d.wal.queue(actions...))
+}
+
+// waitForLog waits for a batch of actions queued for the write-ahead log to
+// be written. Failing to write them is fatal, since the database could no
+// longer be recovered from the log.
+func (d *Database) waitForLog(b *walBatch) {
+	err := d.wal.wait(b)
+	if err != nil {
+		d.log.Fatal().Err(err).Msg("error writing to the write-ahead log")
 	}
 }
 
+// nextSequence returns the sequence number for the next write-ahead log
+// action. It must be called with writeLock held.
+func (d *Database) nextSequence() uint64 {
+	d.Sequence += 1
+	return d.Sequence
+}
+
 func (d *Database) appendInternal(data *Datum) {
-	if success, _ := d.Segments[d.Current].Append(data); !success {
+	d.segmentLock.Lock()
+	segment := &d.Segments[d.Current]
+	success, _ := segment.Append(data)
+	if success {
+		d.spans.observe(data.TopicID, segment.HeadTime.Add(data.Delta))
+	}
+	d.segmentLock.Unlock()
+
+	if !success {
 		d.log.Fatal().Msg("We should never not have enough segments, since our write-ahead log creates them")
 	}
-	d.appendCount += 1
+	d.appendCount.Add(1)
+}
+
+// lastAppendTimeInternal returns the time of the last entry appended to the
+// current segment, or the segment's head if it's empty. It must be called with
+// writeLock held.
+func (d *Database) lastAppendTimeInternal() (time.Time, bool) {
+	if len(d.Segments) == 0 {
+		return time.Time{}, false
+	}
+	segment := &d.Segments[d.Current]
+	if segment.Size == 0 {
+		return segment.HeadTime, true
+	}
+	return segment.HeadTime.Add(segment.Series[segment.Size-1].Delta), true
+}
+
+// addSegmentInternal adds a new current segment, starting at head
+func (d *Database) addSegmentInternal(head time.Time) {
+	d.segmentLock.Lock()
+	defer d.segmentLock.Unlock()
+
+	if len(d.Segments) > 0 {
+		d.Current += 1
+	}
+	d.Segments = append(d.Segments, Segment{HeadTime: head})
 }
 
 func normalizeTopicName(topicName string) string {
@@ -83,56 +201,239 @@ func normalizeTopicName(topicName string) string {
 	return topicName
 }
 
-// parentSchema returns the first non-string schema in any parent of topic, or nil
-func (d *Database) parentSchema(topicName string) schema.Object {
-	if topicName == "/" {
-		return nil
-	}
-
+// parentSchemaTopic returns the first non-string schema in any parent of
+// topicName, and the name of the parent it belongs to, or nil
+func (d *Database) parentSchemaTopic(topicName string) (string, schema.Object) {
 	d.topicLock.RLock()
-	idx, ok := d.topics[topicName]
-	d.topicLock.RUnlock()
+	defer d.topicLock.RUnlock()
 
-	if ok {
-		schemaObj := d.SchemaLookup[idx]
-		if t, isType := schemaObj.(schema.Type); isType && t.Name == "string" {
-			return d.parentSchema(path.Dir(topicName))
+	for topicName != "/" {
+		topicName = path.Dir(topicName)
+		if topicName == "/" {
+			break
+		}
+		if idx, ok := d.topics[topicName]; ok && !isStringSchema(d.SchemaLookup[idx]) {
+			return topicName, d.SchemaLookup[idx]
 		}
-		return schemaObj
 	}
 
-	return d.parentSchema(path.Dir(topicName))
+	return "", nil
+}
+
+func isStringSchema(s schema.Object) bool {
+	switch t := s.(type) {
+	case schema.Type:
+		return t.Name == "string"
+	case *schema.Type:
+		return t.Name == "string"
+	}
+	return false
 }
 
 func (d *Database) loadSchema(s string) schema.Object {
-	obj, ok := d.schemaCache.Load(s)
+	obj, ok := d.schemaCache.get(s)
 	if !ok {
 		o, err := schema.Parse(s)
 		if err != nil {
-			obj, ok = d.schemaCache.Load("string")
+			obj, ok = d.schemaCache.get("string")
 			if !ok {
 				obj, _ = schema.Parse("string")
 			}
 		} else {
-			d.schemaCache.Store(s, o)
+			d.schemaCache.add(s, o)
 			return o
 		}
 	}
-	return obj.(schema.Object)
+	return obj
 }
 
 func (d *Database) addTopicInternal(topicName string, s string) int {
 	topicName = normalizeTopicName(topicName)
+	obj := d.loadSchema(s)
+
+	// Appends look topics up without holding writeLock, so everything here
+	// is guarded by topicLock
+	d.topicLock.Lock()
+	defer d.topicLock.Unlock()
 	index := d.TopicCount
-	d.SchemaLookup = append(d.SchemaLookup, d.loadSchema(s))
+	d.SchemaLookup = append(d.SchemaLookup, obj)
+	d.validators = append(d.validators, schema.Compile(obj))
 	d.TopicLookup = append(d.TopicLookup, topicName)
 	d.TopicCount += 1
-	d.topicLock.Lock()
-	defer d.topicLock.Unlock()
 	d.topics[topicName] = index
+	d.generation.Add(1)
 	return index
 }
 
+// setTopicCodecInternal records the payload codec used by topicName. The
+// empty string refers to fossil's binary encoding.
+func (d *Database) setTopicCodecInternal(topicName string, codec string) {
+	topicName = normalizeTopicName(topicName)
+	d.topicLock.Lock()
+	defer d.topicLock.Unlock()
+	if d.codecs == nil {
+		d.codecs = make(map[string]string)
+	}
+	if codec == "" {
+		delete(d.codecs, topicName)
+	} else {
+		d.codecs[topicName] = codec
+	}
+}
+
+// setTopicEncodingInternal records the encoding the data of topicName is
+// stored with. The empty string stores data as it was appended.
+func (d *Database) setTopicEncodingInternal(topicName string, encoding string) {
+	topicName = normalizeTopicName(topicName)
+	d.topicLock.Lock()
+	defer d.topicLock.Unlock()
+	if d.encodings == nil {
+		d.encodings = make(map[string]string)
+	}
+	if encoding == "" {
+		delete(d.encodings, topicName)
+	} else {
+		d.encodings[topicName] = encoding
+	}
+}
+
+// setSchemaOverrideInternal records that topicName was created with a schema
+// which overrides its parent's
+func (d *Database) setSchemaOverrideInternal(topicName string) {
+	topicName = normalizeTopicName(topicName)
+	d.topicLock.Lock()
+	defer d.topicLock.Unlock()
+	if d.overrides == nil {
+		d.overrides = make(map[string]bool)
+	}
+	d.overrides[topicName] = true
+}
+
+// parentCodec returns the codec of the closest parent of topicName which has
+// one, or the empty string
+func (d *Database) parentCodec(topicName string) string {
+	d.topicLock.RLock()
+	defer d.topicLock.RUnlock()
+
+	for topicName != "/" {
+		topicName = path.Dir(topicName)
+		if codec, ok := d.codecs[topicName]; ok {
+			return codec
+		}
+	}
+
+	return ""
+}
+
+// parentEncoding returns the encoding of the closest parent of topicName
+// which has one, or the empty string
+func (d *Database) parentEncoding(topicName string) string {
+	d.topicLock.RLock()
+	defer d.topicLock.RUnlock()
+
+	for topicName != "/" {
+		topicName = path.Dir(topicName)
+		if encoding, ok := d.encodings[topicName]; ok {
+			return encoding
+		}
+	}
+
+	return ""
+}
+
+// columnLayouts returns the layout of the column each topic with an encoding
+// is stored in, keyed by topic ID
+func (d *Database) columnLayouts() map[int]columnLayout {
+	d.topicLock.RLock()
+	defer d.topicLock.RUnlock()
+
+	layouts := make(map[int]columnLayout, len(d.encodings))
+	for topic, encoding := range d.encodings {
+		index, ok := d.topics[topic]
+		if !ok {
+			continue
+		}
+		// Encodings are checked against the schema when they're set, but
+		// don't trust that here
+		if t, ok := d.SchemaLookup[index].(*schema.Type); ok && CheckEncoding(encoding, t) == nil {
+			layouts[index] = columnLayout{encoding: encoding, typ: *t}
+		}
+	}
+	return layouts
+}
+
+// loadProgressInterval is the number of segments decoded between each log
+// line reporting progress opening a database
+const loadProgressInterval = 100
+
+// decodeSegments decodes each of db.Segments from its file in directory,
+// using a pool of Config.LoadWorkers workers
+func (db *Database) decodeSegments(directory string) error {
+	workers := db.config.LoadWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(db.Segments) {
+		workers = len(db.Segments)
+	}
+
+	var wg sync.WaitGroup
+	var decoded atomic.Int64
+	var errOnce sync.Once
+	var firstErr error
+	var failed atomic.Bool
+
+	indices := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				// Keep draining indices after a failure, but don't bother
+				// decoding them
+				if failed.Load() {
+					continue
+				}
+
+				// Segment files are numbered from before raw segments were
+				// dropped by rollups
+				err := decodeSegment(filepath.Join(directory, fmt.Sprintf("%d", i+db.rollups.Dropped)), &db.Segments[i])
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					failed.Store(true)
+					continue
+				}
+
+				if n := decoded.Add(1); n%loadProgressInterval == 0 {
+					db.log.Info().Int64("decoded", n).Int("segments", len(db.Segments)).Msg("decoding segments")
+				}
+			}
+		}()
+	}
+
+	for i := range db.Segments {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	return firstErr
+}
+
+func decodeSegment(p string, segment *Segment) error {
+	contents, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+
+	dec := gob.NewDecoder(bytes.NewBuffer(contents))
+	err = dec.Decode(segment)
+	if err != nil {
+		return err
+	}
+	return segment.decodeColumns()
+}
+
 // deserializeInternal de-serializes a database from disk.
 // It expects the path field to be filled in on the database struct
 func (db *Database) deserializeInternal() error {
@@ -163,6 +464,15 @@ func (db *Database) deserializeInternal() error {
 		return err
 	}
 
+	// Starting with version 3, we track the last write-ahead log action
+	// reflected in our serialized data
+	if db.Version >= 3 {
+		err = binary.Read(r, binary.LittleEndian, &db.Sequence)
+		if err != nil {
+			return err
+		}
+	}
+
 	timeBytes, err := io.ReadAll(r)
 	if err != nil {
 		return err
@@ -172,93 +482,249 @@ func (db *Database) deserializeInternal() error {
 		return err
 	}
 
-	segmentsDirectory := path.Join(db.Path, "segments")
-	for i := uint32(0); i < segmentCount; i++ {
-		var segment Segment
+	// Databases which have never rolled up data won't have rollup metadata,
+	// otherwise, the segment count and current segment include segments
+	// which were dropped once rolled up
+	rollups, err := db.deserializeRollupMetadata()
+	if err != nil {
+		return err
+	}
+	if uint32(db.rollups.Dropped) > db.Current {
+		return fmt.Errorf("cannot read database, %d segments were rolled up but the current segment is %d", db.rollups.Dropped, db.Current)
+	}
+	db.Current -= uint32(db.rollups.Dropped)
 
-		contents, err := os.ReadFile(filepath.Join(segmentsDirectory, fmt.Sprintf("%d", i)))
-		if err != nil {
-			return err
-		}
+	db.Segments = make([]Segment, segmentCount-uint32(db.rollups.Dropped))
+	err = db.decodeSegments(path.Join(db.Path, "segments"))
+	if err != nil {
+		return err
+	}
 
-		dec := gob.NewDecoder(bytes.NewBuffer(contents))
-		err = dec.Decode(&segment)
-		if err != nil {
+	err = db.deserializeRollups(rollups)
+	if err != nil {
+		return err
+	}
+
+	var schemas []string
+	topicsErr := db.readRequiredCompressedJSON("topics", &db.TopicLookup)
+	schemasErr := db.readRequiredCompressedJSON("schemas", &schemas)
+	if topicsErr != nil || schemasErr != nil {
+		err = errors.Join(topicsErr, schemasErr)
+		if !lostMetadataFile(topicsErr) || !lostMetadataFile(schemasErr) || !db.config.RecoverTopics {
 			return err
 		}
-
-		db.Segments = append(db.Segments, segment)
+		db.log.Warn().Err(err).Msg("recovering topics from segment data")
+		db.TopicLookup, schemas = db.recoverTopics(db.TopicLookup, schemas, topicsErr != nil, schemasErr != nil)
 	}
 
-	file, err = os.Open(path.Join(db.Path, "topics"))
-	if err != nil {
-		return err
+	db.SchemaLookup = make([]schema.Object, 0, len(schemas))
+	db.validators = make([]schema.Validator, 0, len(schemas))
+	for _, s := range schemas {
+		obj := db.loadSchema(s)
+		db.SchemaLookup = append(db.SchemaLookup, obj)
+		db.validators = append(db.validators, schema.Compile(obj))
 	}
 
-	reader, err := zlib.NewReader(file)
+	// Topic codecs and named schemas were added after the topics and schemas
+	// files, so databases without any won't have these files
+	db.codecs = make(map[string]string)
+	err = db.readCompressedJSON("codecs", &db.codecs)
 	if err != nil {
 		return err
 	}
 
-	var topicBuffer bytes.Buffer
-	_, err = io.Copy(&topicBuffer, reader)
+	db.encodings = make(map[string]string)
+	err = db.readCompressedJSON("encodings", &db.encodings)
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal(topicBuffer.Bytes(), &db.TopicLookup)
+	db.namedSchemas = make(map[string]string)
+	err = db.readCompressedJSON("named_schemas", &db.namedSchemas)
 	if err != nil {
 		return err
 	}
 
-	file, err = os.Open(path.Join(db.Path, "schemas"))
+	db.overrides = make(map[string]bool)
+	err = db.readCompressedJSON("overrides", &db.overrides)
 	if err != nil {
 		return err
 	}
-	reader.Close()
 
-	reader, err = zlib.NewReader(file)
+	err = db.readCompressedJSON("topic_templates", &db.templates)
 	if err != nil {
 		return err
 	}
 
-	var schemaBuffer bytes.Buffer
-	_, err = io.Copy(&schemaBuffer, reader)
+	db.TopicCount = len(db.TopicLookup)
+	db.flushedSequence = db.Sequence
+	db.indexTopicSpans()
+	return nil
+}
 
-	var schemas []string
-	err = json.Unmarshal(schemaBuffer.Bytes(), &schemas)
+// serialization is the state of a database captured to be written to disk,
+// so that it can be encoded and written out without holding writeLock
+type serialization struct {
+	sTime    time.Time
+	sequence uint64
+	appends  int64
+	metadata []byte
+
+	// segments are the full segments to write, the first of which is
+	// segment first on disk, followed by current. Full segments don't change
+	// until they're compacted, after the flush, so they're shared with the
+	// database, but current is a copy since appends go on filling it.
+	segments []Segment
+	current  Segment
+	first    int
+	layouts  map[int]columnLayout
+
+	// files are the contents of the compressed metadata files, by name, in
+	// the order they're written
+	files []serializedFile
+
+	// rollups are the rollup segments to write, the first of which is
+	// rollup segment firstRollup. rollupMetadata is nil if there are no
+	// rollups.
+	rollups        []Segment
+	firstRollup    int
+	rollupMetadata []byte
+}
+
+type serializedFile struct {
+	name string
+	data []byte
+}
+
+func (db *Database) serializeInternal() error {
+	s, err := db.captureSerialization()
 	if err != nil {
 		return err
 	}
 
-	for _, s := range schemas {
-		db.SchemaLookup = append(db.SchemaLookup, db.loadSchema(s))
+	err = db.writeSerialization(s)
+	if err != nil {
+		return err
 	}
 
-	db.TopicCount = len(db.TopicLookup)
+	db.finishSerialization(s)
 	return nil
 }
 
-func (db *Database) serializeInternal() error {
-	// First, we write out our database metadata
+// captureSerialization rolls up any data which has aged out, and captures
+// what's to be written by writeSerialization. The write-ahead log is moved
+// aside, so that actions logged in the meantime go to a new one. It must be
+// called with writeLock held.
+func (db *Database) captureSerialization() (*serialization, error) {
+	// Roll up any data which has aged out, before deciding what to write
 	newSTime := time.Now()
+	db.rollupInternal(newSTime)
+
+	s := &serialization{
+		sTime:    newSTime,
+		sequence: db.Sequence,
+		appends:  db.appendCount.Load(),
+	}
+
+	// Next, we capture our database metadata. Segment indices on disk
+	// include the segments dropped by rollups.
+	dropped := uint32(db.rollups.Dropped)
 	databaseMetadata := bytes.NewBuffer(binary.LittleEndian.AppendUint32([]byte{}, db.Version))
-	_, err := databaseMetadata.Write(binary.LittleEndian.AppendUint32([]byte{}, uint32(len(db.Segments))))
+	_, err := databaseMetadata.Write(binary.LittleEndian.AppendUint32([]byte{}, uint32(len(db.Segments))+dropped))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = databaseMetadata.Write(binary.LittleEndian.AppendUint32([]byte{}, db.Current))
+	_, err = databaseMetadata.Write(binary.LittleEndian.AppendUint32([]byte{}, db.Current+dropped))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	_, err = databaseMetadata.Write(binary.LittleEndian.AppendUint64([]byte{}, db.Sequence))
+	if err != nil {
+		return nil, err
 	}
 	_, err = databaseMetadata.Write([]byte(newSTime.Format(time.RFC3339)))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	s.metadata = databaseMetadata.Bytes()
+
+	// Now, capture any segments after our STime
+	var first int
+	for idx := range db.Segments {
+		if db.Segments[idx].HeadTime.After(db.STime) {
+			first = idx
+			if idx > 0 {
+				first = idx - 1
+			}
+			break
+		}
 	}
 
+	s.first = first + int(dropped)
+	s.segments = db.Segments[first:db.Current]
+	s.current = db.Segments[db.Current]
+	s.layouts = db.columnLayouts()
+
+	// Our topics and schemas only change with writeLock held
+	topics, err := json.Marshal(db.TopicLookup)
+	if err != nil {
+		return nil, err
+	}
+	schemas, err := json.Marshal(db.SchemaLookup)
+	if err != nil {
+		return nil, err
+	}
+	s.files = append(s.files, serializedFile{"topics", topics}, serializedFile{"schemas", schemas})
+
+	// Capture our topic codecs, encodings and named schemas
+	db.topicLock.RLock()
+	for _, file := range []struct {
+		name string
+		v    any
+	}{
+		{"codecs", db.codecs},
+		{"encodings", db.encodings},
+		{"named_schemas", db.namedSchemas},
+		{"overrides", db.overrides},
+		{"topic_templates", db.templates},
+	} {
+		data, err := json.Marshal(file.v)
+		if err != nil {
+			db.topicLock.RUnlock()
+			return nil, err
+		}
+		s.files = append(s.files, serializedFile{file.name, data})
+	}
+	db.topicLock.RUnlock()
+
+	err = db.captureRollups(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// Finally, move the write-ahead log aside, once anything still queued
+	// for it is written. Databases being migrated have nothing queued.
+	if db.wal != nil {
+		err = db.wal.flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = db.rotateLog()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// writeSerialization encodes and writes out what captureSerialization
+// captured. It doesn't touch the database's state, so it's called without
+// holding writeLock when flushing in the background.
+func (db *Database) writeSerialization(s *serialization) error {
 	// Ensure that there is a segments directory
 	segmentsDirectory := path.Join(db.Path, "segments")
-	_, err = os.Stat(segmentsDirectory)
+	_, err := os.Stat(segmentsDirectory)
 	if os.IsNotExist(err) {
 		err = os.Mkdir(segmentsDirectory, 0755)
 		if err != nil {
@@ -266,149 +732,331 @@ func (db *Database) serializeInternal() error {
 		}
 	}
 
-	// Now, write out any segments after our STime
-	var first int
-	for idx, s := range db.Segments {
-		if s.HeadTime.After(db.STime) {
-			first = idx
-			if idx > 0 {
-				first = idx - 1
-			}
-			break
+	segments := len(s.segments) + 1
+	for i := 0; i < segments; i++ {
+		segment := &s.current
+		if i < len(s.segments) {
+			segment = &s.segments[i]
 		}
-	}
 
-	for i := uint32(first); i <= db.Current; i++ {
 		var encoded bytes.Buffer
 
 		enc := gob.NewEncoder(&encoded)
-		err := enc.Encode(db.Segments[i])
+		err := enc.Encode(encodeColumns(segment, s.layouts))
 		if err != nil {
 			db.log.Fatal().Err(err).Msg("error encoding segment")
 		}
 
-		tmpPath := filepath.Join(segmentsDirectory, fmt.Sprintf("%d.tmp", i))
-		file, err := os.OpenFile(tmpPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0600)
+		err = db.writeFile(filepath.Join(segmentsDirectory, fmt.Sprintf("%d.tmp", s.first+i)), encoded.Bytes())
 		if err != nil {
 			return err
 		}
-		defer file.Close()
+	}
 
-		_, err = file.Write(encoded.Bytes())
+	for i := 0; i < segments; i++ {
+		err = os.Rename(path.Join(segmentsDirectory, fmt.Sprintf("%d.tmp", s.first+i)), path.Join(segmentsDirectory, fmt.Sprintf("%d", s.first+i)))
 		if err != nil {
 			return err
 		}
-		file.Close()
 	}
 
-	for i := uint32(first); i <= db.Current; i++ {
-		err = os.Rename(path.Join(segmentsDirectory, fmt.Sprintf("%d.tmp", i)), path.Join(segmentsDirectory, fmt.Sprintf("%d", i)))
+	// Make sure the renames above are durable before we go on to write
+	// metadata which references the new segments
+	err = db.syncDirectory(segmentsDirectory)
+	if err != nil {
+		return err
+	}
+
+	// Write out our topics, schemas, codecs, encodings and named schemas
+	for _, file := range s.files {
+		err = db.replaceCompressedFile(file.name, file.data)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Write out our topics
-	topics, err := json.Marshal(db.TopicLookup)
+	err = db.writeRollups(s)
 	if err != nil {
 		return err
 	}
 
-	var topicBuffer bytes.Buffer
-	w := zlib.NewWriter(&topicBuffer)
-	_, err = w.Write(topics)
+	// Now, write out our metadata
+	err = db.replaceFile(path.Join(db.Path, "metadata"), s.metadata)
 	if err != nil {
 		return err
 	}
-	err = w.Close()
-	if err != nil {
+
+	// Next, remove the write-ahead log which was moved aside, since
+	// everything in it has been written out
+	err = os.Remove(db.flushingLog().LogPath)
+	if err != nil && !os.IsNotExist(err) {
+		db.log.Fatal().Err(err).Msg("error removing wal.log.flushing")
+	}
+
+	return db.syncDirectory(db.Path)
+}
+
+// finishSerialization updates the database once what was captured has been
+// written out. It must be called with writeLock held.
+func (db *Database) finishSerialization(s *serialization) {
+	// Nothing refers to segments dropped by rollups anymore
+	db.removeDroppedSegments()
+	db.rollups.dirty = s.firstRollup + len(s.rollups)
+
+	// Finally, update our database's STime and appendCount. Appends made
+	// while it was written out are left for the next serialization.
+	db.STime = s.sTime
+	db.appendCount.Add(-s.appends)
+	db.flushedSequence = s.sequence
+	db.observeSerialize(time.Since(s.sTime))
+	db.measureStorage()
+}
+
+// flushingLog returns a handle to the write-ahead log moved aside while the
+// database is serialized
+func (d *Database) flushingLog() WriteAheadLog {
+	return WriteAheadLog{LogPath: filepath.Join(d.Path, "wal.log.flushing"), Sync: d.config.SyncWrites}
+}
+
+// rotateLog moves the write-ahead log aside, to be removed once the database
+// is serialized. If one is left over from a serialization which failed, the
+// log is appended to it instead, so that both are replayed if this one fails
+// too.
+func (db *Database) rotateLog() error {
+	wal := db.writeAheadLog()
+	flushing := db.flushingLog()
+
+	if _, err := os.Stat(flushing.LogPath); os.IsNotExist(err) {
+		err = os.Rename(wal.LogPath, flushing.LogPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
 
-	tmpPath := filepath.Join(db.Path, "topics.tmp")
-	file, err := os.OpenFile(tmpPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0600)
+	contents, err := os.ReadFile(wal.LogPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	_, err = file.Write(topicBuffer.Bytes())
+	err = flushing.write(contents)
 	if err != nil {
 		return err
 	}
+	return os.Remove(wal.LogPath)
+}
+
+// applyLogs replays the write-ahead log onto the database, after any log
+// moved aside by a serialization which didn't finish. Actions are applied in
+// sequence order, so those in both are only applied once.
+func (db *Database) applyLogs() {
+	flushing := db.flushingLog()
+	if _, err := os.Stat(flushing.LogPath); err == nil {
+		flushing.ApplyToDB(db)
+	}
+
+	wal := db.writeAheadLog()
+	wal.ApplyToDB(db)
+}
+
+// hasLog reports whether there's a write-ahead log in location, including
+// one moved aside by a serialization which didn't finish
+func hasLog(location string) bool {
+	for _, name := range []string{"wal.log", "wal.log.flushing"} {
+		if _, err := os.Stat(filepath.Join(location, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readCompressedJSON decodes the zlib compressed JSON file name, in the
+// database directory, into v. If the file does not exist, v is left untouched.
+func (db *Database) readCompressedJSON(name string, v any) error {
+	err := db.readRequiredCompressedJSON(name, v)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
 
-	err = os.Rename(tmpPath, path.Join(db.Path, "topics"))
+// readRequiredCompressedJSON is like readCompressedJSON, but returns an error
+// if the file does not exist
+func (db *Database) readRequiredCompressedJSON(name string, v any) error {
+	contents, err := os.ReadFile(path.Join(db.Path, name))
 	if err != nil {
 		return err
 	}
 
-	// Write out our topic schemas
-	schemas, err := json.Marshal(db.SchemaLookup)
+	data, err := decodeMetadataFile(name, contents)
 	if err != nil {
 		return err
 	}
 
-	var schemaBuffer bytes.Buffer
-	w = zlib.NewWriter(&schemaBuffer)
-	_, err = w.Write(schemas)
+	err = json.Unmarshal(data, v)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w %s: %v", ErrCorruptFile, name, err)
 	}
-	err = w.Close()
+	return nil
+}
+
+// replaceCompressedFile compresses data with zlib, and atomically replaces
+// the file name in the database directory with it, behind a header which
+// lets it be validated when it's read
+func (db *Database) replaceCompressedFile(name string, data []byte) error {
+	contents, err := encodeMetadataFile(data)
 	if err != nil {
 		return err
 	}
 
-	tmpPath = filepath.Join(db.Path, "schemas.tmp")
-	file, err = os.OpenFile(tmpPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0600)
+	return db.replaceFile(path.Join(db.Path, name), contents)
+}
+
+// writeFile writes data to the file at p, creating or truncating it. If the
+// database is configured to sync writes, the contents are flushed to stable
+// storage before returning.
+func (db *Database) writeFile(p string, data []byte) error {
+	file, err := os.OpenFile(p, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	_, err = file.Write(schemaBuffer.Bytes())
+	_, err = file.Write(data)
 	if err != nil {
 		return err
 	}
 
-	err = os.Rename(tmpPath, path.Join(db.Path, "schemas"))
-	if err != nil {
-		return err
+	if db.config.SyncWrites {
+		err = file.Sync()
+		if err != nil {
+			return err
+		}
 	}
 
-	// Now, write out our metadata
-	tmpPath = filepath.Join(db.Path, "metadata.tmp")
-	file, err = os.OpenFile(tmpPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0600)
+	return file.Close()
+}
+
+// replaceFile atomically replaces the file at p with data, by way of a
+// temporary file and a rename. The rename is only made durable once the
+// containing directory is synced.
+func (db *Database) replaceFile(p string, data []byte) error {
+	tmpPath := p + ".tmp"
+
+	err := db.writeFile(tmpPath, data)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	_, err = file.Write(databaseMetadata.Bytes())
-	if err != nil {
-		return err
+	return os.Rename(tmpPath, p)
+}
+
+// syncDirectory flushes the directory entries of dir to stable storage, so
+// that any files created, renamed, or removed within it survive a crash.
+func (db *Database) syncDirectory(dir string) error {
+	if !db.config.SyncWrites {
+		return nil
 	}
-	file.Close()
 
-	err = os.Rename(tmpPath, path.Join(db.Path, "metadata"))
+	d, err := os.Open(dir)
 	if err != nil {
 		return err
 	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+//-- Public Interfaces
+
+// Flush serializes any data which so far only lives in the write-ahead log
+// out to disk, rolling up data older than Config.RawRetention, and then
+// compacts segments holding expired data. If nothing has changed since the
+// last flush, and nothing is due to be rolled up or compacted, this is a
+// no-op.
+func (d *Database) Flush() error {
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	// Any flush started in the background is waited for, so that nothing is
+	// being written once this returns
+	for d.pendingFlush != nil {
+		done := d.pendingFlush
+		d.writeLock.Unlock()
+		<-done
+		d.writeLock.Lock()
+	}
+
+	err := d.flushInternal()
+	d.counters.observeFlush(err)
+	return err
+}
+
+// flushInBackground flushes the database once appends have built up since it
+// was last serialized, closing done when it's finished. writeLock is only
+// held while what's to be serialized is captured, and while the database is
+// compacted afterwards, so that appends carry on while it's written out.
+func (d *Database) flushInBackground(done chan struct{}) {
+	defer close(done)
+
+	var s *serialization
+	var err error
+	d.writeLock.Lock()
+	if d.serializeDue(time.Now()) {
+		s, err = d.captureSerialization()
+	}
+	d.writeLock.Unlock()
+
+	if s != nil && err == nil {
+		err = d.writeSerialization(s)
+	}
+
+	d.writeLock.Lock()
+	if s != nil && err == nil {
+		d.finishSerialization(s)
+	}
+	// Segments filled since the database was captured may hold data which is
+	// only in the write-ahead log, so if anything was appended meanwhile,
+	// compaction waits for the next flush
+	if err == nil && d.Sequence == d.flushedSequence {
+		err = d.compactInternal(time.Now())
+	}
+	if err == nil {
+		d.buildColumnsInternal()
+	}
+	d.counters.observeFlush(err)
+	d.pendingFlush = nil
+	d.writeLock.Unlock()
 
-	// Next, zero out the WriteAheadLog
-	err = os.Remove(filepath.Join(db.Path, "wal.log"))
 	if err != nil {
-		db.log.Fatal().Err(err).Msg("error removing wal.log")
+		d.log.Error().Err(err).Msg("error flushing database in the background")
 	}
+}
 
-	// Finally, update our database's STime and appendCount
-	db.STime = newSTime
-	db.appendCount = 0
+func (d *Database) flushInternal() error {
+	now := time.Now()
+	if d.serializeDue(now) {
+		err := d.serializeInternal()
+		if err != nil {
+			return err
+		}
+	}
 
+	err := d.compactInternal(now)
+	if err != nil {
+		return err
+	}
+	d.buildColumnsInternal()
 	return nil
 }
 
-//-- Public Interfaces
+// serializeDue reports whether anything has changed since the database was
+// last serialized, or anything is due to be rolled up
+func (d *Database) serializeDue(now time.Time) bool {
+	return d.Sequence != d.flushedSequence || d.rollupDue(now)
+}
 
 func (d *Database) SchemaForTopic(topic string) schema.Object {
 	var index int
@@ -417,9 +1065,9 @@ func (d *Database) SchemaForTopic(topic string) schema.Object {
 	topic = normalizeTopicName(topic)
 
 	d.topicLock.RLock()
-	index, exists = d.topics[topic]
-	d.topicLock.RUnlock()
+	defer d.topicLock.RUnlock()
 
+	index, exists = d.topics[topic]
 	if !exists {
 		return nil
 	}
@@ -427,211 +1075,508 @@ func (d *Database) SchemaForTopic(topic string) schema.Object {
 	return d.SchemaLookup[index]
 }
 
-func (d *Database) AddTopic(topic string, schema string) int {
+// CodecForTopic returns the name of the codec payloads appended to topic are
+// encoded with. The empty string refers to fossil's binary encoding.
+func (d *Database) CodecForTopic(topic string) string {
 	topic = normalizeTopicName(topic)
 
 	d.topicLock.RLock()
-	if index, exists := d.topics[topic]; exists {
-		d.topicLock.RUnlock()
-		return index
+	defer d.topicLock.RUnlock()
+
+	return d.codecs[topic]
+}
+
+// EncodingForTopic returns the encoding the data of topic is stored with on
+// disk, or the empty string if it's stored as it was appended
+func (d *Database) EncodingForTopic(topic string) string {
+	topic = normalizeTopicName(topic)
+
+	d.topicLock.RLock()
+	defer d.topicLock.RUnlock()
+
+	return d.encodings[topic]
+}
+
+// SetTopicEncoding sets the encoding the data of topic is stored with on disk,
+// which must apply to the topic's schema. Sub-topics which are created
+// implicitly inherit it. The empty string stores data as it was appended.
+// Segments which were already written keep the encoding they were written
+// with until they're written again.
+func (d *Database) SetTopicEncoding(topic string, encoding string) error {
+	topic = normalizeTopicName(topic)
+
+	s := d.SchemaForTopic(topic)
+	if s == nil {
+		return ErrTopicNotFound
+	}
+	if err := CheckEncoding(encoding, s); err != nil {
+		return err
+	}
+	if d.EncodingForTopic(topic) == encoding {
+		return nil
 	}
-	d.topicLock.RUnlock()
 
-	// The topic doesn't exist, so get any non-string parent schema
-	parentSchema := d.parentSchema(topic)
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	d.setTopicEncodingInternal(topic, encoding)
+	d.writeLog(encodeSetTopicEncoding(topic, encoding, d.nextSequence()))
+	return nil
+}
+
+func (d *Database) AddTopic(topic string, schema string) int {
+	return d.AddTopicWithCodec(topic, schema, "")
+}
+
+// AddTopicWithCodec is like AddTopic, but also records the codec payloads
+// appended to the topic are encoded with. Topics which are added implicitly
+// inherit the codec of their parent. The schema may be the name of a schema
+// added with AddSchema.
+func (d *Database) AddTopicWithCodec(topic string, schema string, codec string) int {
+	index, _ := d.CreateTopic(topic, schema, codec)
+	return index
+}
+
+// ErrTooManyTopics is returned when creating a topic would exceed
+// Config.MaxTopics
+var ErrTooManyTopics = errors.New("too many topics")
+
+// ErrSchemaConflict is returned when creating a topic with a schema which
+// conflicts with its parent's, without overriding it. The error is always a
+// SchemaConflictError.
+var ErrSchemaConflict = errors.New("schema conflict")
+
+// SchemaConflictError describes a topic whose schema conflicts with the
+// schema of its closest parent with a non-string schema
+type SchemaConflictError struct {
+	Topic        string
+	Schema       string
+	Parent       string
+	ParentSchema string
+}
+
+func (e SchemaConflictError) Error() string {
+	return fmt.Sprintf("schema %s of %s conflicts with the schema %s of its parent %s; create it with override to replace the parent schema",
+		e.Schema, e.Topic, e.ParentSchema, e.Parent)
+}
+
+func (e SchemaConflictError) Unwrap() error {
+	return ErrSchemaConflict
+}
+
+// CreateTopic is like AddTopicWithCodec, but returns an error if the topic
+// can't be created, either because its schema conflicts with its parent's, or
+// because the database already has Config.MaxTopics topics. Creating a topic
+// which already exists is not an error.
+func (d *Database) CreateTopic(topic string, schema string, codec string) (int, error) {
+	return d.createTopic(topic, schema, codec, false)
+}
+
+// CreateTopicWithOverride is like CreateTopic, but a schema which conflicts
+// with the parent's overrides it for topic and its sub-topics
+func (d *Database) CreateTopicWithOverride(topic string, schema string, codec string) (int, error) {
+	return d.createTopic(topic, schema, codec, true)
+}
+
+// SchemaOverridden returns whether topic was created with a schema overriding
+// its parent's
+func (d *Database) SchemaOverridden(topic string) bool {
+	d.topicLock.RLock()
+	defer d.topicLock.RUnlock()
+	return d.overrides[normalizeTopicName(topic)]
+}
+
+// InheritedSchema returns the schema topic inherits from its closest parent
+// with a non-string schema, or nil if it has no such parent or overrides its
+// schema. Unlike DescribeTopic, it doesn't read the topic's data.
+func (d *Database) InheritedSchema(topic string) schema.Object {
+	topic = normalizeTopicName(topic)
+	if topic == "/" || d.SchemaOverridden(topic) {
+		return nil
+	}
+	_, s := d.parentSchemaTopic(topic)
+	return s
+}
+
+// topicPlan is how a topic which doesn't exist yet would be created
+type topicPlan struct {
+	schema     string
+	codec      string
+	encoding   string
+	overridden bool
+}
+
+// planTopic works out the schema, codec and encoding topic would be created with,
+// returning an error if its schema conflicts with its parent's
+func (d *Database) planTopic(topic string, schema string, codec string, override bool) (topicPlan, error) {
+	if IsSystemTopic(topic) {
+		return topicPlan{}, ErrSystemTopic
+	}
+
+	// Topics may be created with the name of a registered schema
+	if named, ok := d.NamedSchema(schema); ok {
+		schema = named
+	}
+	schema = canonicalSchema(schema)
+
+	// Topics created without a schema take the schema of the first template
+	// they match, in place of their parent's
+	templated := false
+	if schema == "" {
+		if t, ok := d.templateFor(topic); ok {
+			schema = t.Schema
+			templated = true
+		}
+	}
+
+	// Get any non-string parent schema
+	parent, parentSchema := d.parentSchemaTopic(topic)
+	overridden := false
+	encoding := ""
 	// If schema is an empty string, we are doing an implicit topic add,
 	// so we should inherit our parent schema
 	if parentSchema != nil && schema == "" {
 		schema = parentSchema.ToSchema()
+		if codec == "" {
+			codec = d.parentCodec(topic)
+		}
+		// A parent's encoding may not apply if a topic in between overrode
+		// its schema
+		if e := d.parentEncoding(topic); CheckEncoding(e, parentSchema) == nil {
+			encoding = e
+		}
 	} else if parentSchema != nil && parentSchema.ToSchema() != schema {
-		// Otherwise we are trying to create an invalid schema
-		// FIXME: This should be an error
-		return 0
+		// Otherwise we are trying to create an invalid schema, unless the
+		// caller explicitly asked to override the parent's, or a template did
+		if !override && !templated {
+			return topicPlan{}, SchemaConflictError{
+				Topic:        topic,
+				Schema:       schema,
+				Parent:       parent,
+				ParentSchema: parentSchema.ToSchema(),
+			}
+		}
+		overridden = true
 	}
 
+	return topicPlan{schema: schema, codec: codec, encoding: encoding, overridden: overridden}, nil
+}
+
+func (d *Database) createTopic(topic string, schema string, codec string, override bool) (int, error) {
+	topic = normalizeTopicName(topic)
+
+	d.topicLock.RLock()
+	if index, exists := d.topics[topic]; exists {
+		d.topicLock.RUnlock()
+		return index, nil
+	}
+	d.topicLock.RUnlock()
+
+	plan, err := d.planTopic(topic, schema, codec, override)
+	if err != nil {
+		return 0, err
+	}
+	schema, codec = plan.schema, plan.codec
+
 	// The topic doesn't exist, and the schema is valid, so add it
 	d.writeLock.Lock()
 	defer d.writeLock.Unlock()
 
-	index := d.addTopicInternal(topic, schema)
-	wal := WriteAheadLog{filepath.Join(d.Path, "wal.log")}
-	wal.AddTopic(topic, schema)
+	// Another writer may have added the topic while we weren't holding the lock
+	d.topicLock.RLock()
+	index, exists := d.topics[topic]
+	d.topicLock.RUnlock()
+	if exists {
+		return index, nil
+	}
 
-	return index
+	if d.config.MaxTopics > 0 && d.TopicCount >= d.config.MaxTopics {
+		return 0, fmt.Errorf("%w: the limit is %d", ErrTooManyTopics, d.config.MaxTopics)
+	}
+
+	index = d.addTopicInternal(topic, schema)
+	actions := [][]byte{encodeAddTopic(topic, schema, d.nextSequence())}
+
+	if plan.overridden {
+		d.setSchemaOverrideInternal(topic)
+		actions = append(actions, encodeOverrideSchema(topic, d.nextSequence()))
+	}
+
+	if codec != "" {
+		d.setTopicCodecInternal(topic, codec)
+		actions = append(actions, encodeSetTopicCodec(topic, codec, d.nextSequence()))
+	}
+
+	if plan.encoding != "" {
+		d.setTopicEncodingInternal(topic, plan.encoding)
+		actions = append(actions, encodeSetTopicEncoding(topic, plan.encoding, d.nextSequence()))
+	}
+	d.writeLog(actions...)
+
+	return index, nil
+}
+
+// ErrTopicNotFound is returned when appending to a topic which doesn't exist
+// in a database with StrictTopics set
+var ErrTopicNotFound = errors.New("topic not found")
+
+// TopicExists returns true if topic has been created
+func (d *Database) TopicExists(topic string) bool {
+	topic = normalizeTopicName(topic)
+
+	d.topicLock.RLock()
+	defer d.topicLock.RUnlock()
+
+	_, exists := d.topics[topic]
+	return exists
+}
+
+// StrictTopics returns true if appends may not implicitly create topics
+func (d *Database) StrictTopics() bool {
+	return d.config.StrictTopics
+}
+
+// QueryLimits returns the longest span of time a query may select, and the
+// most entries it may return, as configured by Config.MaxQueryRange and
+// Config.MaxQueryResults
+func (d *Database) QueryLimits() (time.Duration, int) {
+	return d.config.MaxQueryRange, d.config.MaxQueryResults
 }
 
-// Append to the end of the database
+// Append to the end of the database. If topic doesn't exist, it is created,
+// unless the database was configured with StrictTopics.
 func (d *Database) Append(data []byte, topic string) error {
-	topicID := d.AddTopic(topic, "")
+	if d.config.StrictTopics && !d.TopicExists(topic) {
+		return ErrTopicNotFound
+	}
+	return d.AppendOrCreate(data, topic)
+}
+
+// AppendOrCreate is like Append, but always creates topic if it doesn't
+// exist, even if the database was configured with StrictTopics.
+func (d *Database) AppendOrCreate(data []byte, topic string) error {
+	return d.AppendOrCreateWithTTL(data, topic, 0)
+}
+
+// AppendOrCreateWithTTL is like AppendOrCreate, but the data expires once ttl
+// has passed. Expired data is left out of queries, and removed from disk when
+// the database is next compacted. A ttl of 0 means the data never expires.
+func (d *Database) AppendOrCreateWithTTL(data []byte, topic string, ttl time.Duration) error {
+	_, err := d.AppendOrCreateWithReceipt(data, topic, ttl)
+	return err
+}
 
+// AppendReceipt describes where an append landed in the database
+type AppendReceipt struct {
+	// Time is the time the data was appended at, which queries see it at
+	Time time.Time
+	// Sequence is the sequence number the data was appended with
+	Sequence uint64
+	// Duplicate is set if the data was sent again within its topic's dedup
+	// window, and wasn't appended. Time and Sequence are those of the
+	// earlier append.
+	Duplicate bool
+}
+
+// AppendOrCreateWithReceipt is like AppendOrCreateWithTTL, but also returns
+// the time and sequence number the data was appended with, so that callers
+// can find it again.
+func (d *Database) AppendOrCreateWithReceipt(data []byte, topic string, ttl time.Duration) (AppendReceipt, error) {
+	start := time.Now()
+	topicID, err := d.CreateTopic(topic, "", "")
+	if err != nil {
+		return AppendReceipt{}, err
+	}
+
+	d.topicLock.RLock()
 	s := d.SchemaLookup[topicID]
-	if !s.Validate(data) {
+	v := d.validators[topicID]
+	d.topicLock.RUnlock()
+	if !v.Validate(data) {
 		// FIXME: We should either return an error, or move the data to a special topic
 		//        when this happens.
 		d.log.Error().Msg("Attempted to append non-validating data to a topic")
-		return errors.New(fmt.Sprintf("Data does not conform to %s", s.ToSchema()))
+		return AppendReceipt{}, errors.New(fmt.Sprintf("Data does not conform to %s", s.ToSchema()))
 	}
 
 	// Explicitly copy the data before taking the lock to minimize resource
 	// contention
-	e := Datum{Data: make([]byte, len(data)), TopicID: topicID}
+	e := Datum{Data: make([]byte, len(data)), TopicID: topicID, TTL: ttl}
 	copy(e.Data, data)
 
+	var hash payloadHash
+	window := d.dedupWindow(topic)
+	if window > 0 {
+		hash = sha256.Sum256(data)
+	}
+
+	locking := time.Now()
 	d.writeLock.Lock()
-	defer d.writeLock.Unlock()
+	lockWait := time.Since(locking)
 
-	if d.appendCount > SegmentSize {
-		err := d.serializeInternal()
-		if err != nil {
-			d.log.Fatal().Msg("Error serializing database to disk.")
-		}
+	// Serializing the database holds writeLock for a while, so rather than
+	// making this append wait for it, it's flushed in the background
+	if d.appendCount.Load() > int64(SegmentSize) && d.pendingFlush == nil {
+		d.pendingFlush = make(chan struct{})
+		go d.flushInBackground(d.pendingFlush)
 	}
 
 	// Pull appendTime now that we have acquired our db lock
 	appendTime := time.Now()
 
-	wal := WriteAheadLog{filepath.Join(d.Path, "wal.log")}
+	// Segments are searched assuming their entries are in time order, so if
+	// the clock has stepped backwards since the last append, the entry is
+	// clamped to the time of the last one
+	if last, ok := d.lastAppendTimeInternal(); ok && appendTime.Before(last) {
+		d.counters.clockSkews.Add(1)
+		d.log.Warn().Dur("skew", last.Sub(appendTime)).Msg("clock stepped backwards, clamping append to the previous timestamp")
+		appendTime = last
+	}
+
+	// Payloads sent again within the topic's dedup window are acknowledged,
+	// but not appended
+	if window > 0 {
+		if earlier, ok := d.dedup.seen(topicID, window, hash, appendTime); ok {
+			d.writeLock.Unlock()
+			d.counters.duplicateAppends.Add(1)
+			return AppendReceipt{Time: earlier.at, Sequence: earlier.sequence, Duplicate: true}, nil
+		}
+	}
+
+	var actions [][]byte
 
 	// Add a new segment to the log if needed
-	if d.Segments[d.Current].Size >= SegmentSize {
-		wal.AddSegment(appendTime)
-		d.Segments = append(d.Segments, Segment{HeadTime: appendTime})
-		d.Current += 1
+	if len(d.Segments) == 0 || d.Segments[d.Current].Size >= SegmentSize {
+		actions = append(actions, encodeAddSegment(appendTime, d.nextSequence()))
+		d.addSegmentInternal(appendTime)
 	}
-	if len(d.Segments) == 0 {
-		wal.AddSegment(appendTime)
-		d.Segments = append(d.Segments, Segment{HeadTime: appendTime})
+
+	if len(actions) > 0 {
+		d.wal.queue(actions...)
 	}
 
 	// Calculate the delta
-	delta := appendTime.Sub(d.Segments[d.Current].HeadTime)
+	head := d.Segments[d.Current].HeadTime
+	delta := appendTime.Sub(head)
 	e.Delta = delta
-	wal.AddEvent(&e)
+	sequence := d.nextSequence()
+	e.Sequence = sequence
 	d.appendInternal(&e)
 
-	return nil
-}
+	// The delta is measured on the monotonic clock, so the time queries see
+	// the datum at can differ slightly from appendTime's wall clock reading
+	receipt := AppendReceipt{Time: head.Add(delta), Sequence: sequence}
+	if window > 0 {
+		d.dedup.remember(topicID, hash, receipt.Time, sequence)
+	}
 
-func (d *Database) entriesFromData(s *Segment, data []Datum) []Entry {
-	entries := make([]Entry, len(data), cap(data))
+	// Reserve our place in the write-ahead log, but encode our event and
+	// wait for it to be written without holding the lock, so that concurrent
+	// appends can do so in parallel, and share a write
+	slot := d.wal.reserve()
+	d.writeLock.Unlock()
 
-	for index, val := range data {
-		entries[index] = Entry{
-			Time:   s.HeadTime.Add(val.Delta),
-			Topic:  d.TopicLookup[val.TopicID],
-			Schema: d.SchemaLookup[val.TopicID].ToSchema(),
-			Data:   val.Data,
-		}
-	}
+	logging := time.Now()
+	d.waitForLog(d.wal.fill(slot, encodeAddEvent(&e, sequence)))
+	d.observeAppend(topic, time.Since(start), lockWait, time.Since(logging))
 
-	return entries
+	return receipt, nil
 }
 
-// Retrieve a list of datum from the database matching some query
+// Retrieve a list of datum from the database matching some query. Data older
+// than Config.RawRetention is read from the rollup tier, at its resolution.
+// Queries read a snapshot of the database, so appends made while they run
+// aren't included.
 // TODO: Eventually, this should return a proper result set
 func (d *Database) Retrieve(q Query) []Entry {
-	results := make([]Entry, 0)
-	// First, we deal with the time range
-	startFound := false
-	startIndex := 0
-
-	endFound := false
-	endIndex := 0
-
-	// If the query range is nil, we can skip this
-	if q.Range != nil {
-		for index, segment := range d.Segments {
-			if !startFound && segment.HeadTime.After(q.Range.Start) {
-				if index > 0 {
-					startIndex = index - 1
-				}
-				startFound = true
-			}
-
-			if !endFound && segment.HeadTime.After(q.Range.End) {
-				if index > 0 {
-					endIndex = index - 1
-				} else {
-					return results
-				}
-				endFound = true
-			}
-		}
+	d.queryLock.RLock()
+	defer d.queryLock.RUnlock()
 
-		// If start has not been found, we still need to search the last segment
-		// of the database
-		if !startFound {
-			startIndex = int(d.Current)
-		}
-	}
+	s := d.snapshot(q)
+	entries := s.retrieve(q)
+	d.counters.observeQuery(len(entries))
+	return entries
+}
 
-	// If endIndex is 0, that means there are no segments with head times after
-	// the specified end time, so use the last segment
-	if endIndex == 0 {
-		endIndex = int(d.Current)
-	}
+// Scan calls fn with each entry Retrieve would return for q, in the same
+// order, without collecting them. Aggregates over long ranges of time can be
+// computed this way without holding every entry in memory. fn is called while
+// compaction is held off, so it shouldn't block.
+func (d *Database) Scan(q Query, fn func(Entry)) {
+	d.queryLock.RLock()
+	defer d.queryLock.RUnlock()
+
+	s := d.snapshot(q)
+	scanned := 0
+	s.scan(q, func(e Entry) {
+		scanned++
+		fn(e)
+	})
+	d.counters.observeQuery(scanned)
+}
 
-	startSubIndex := 0
-	endSubIndex := d.Segments[endIndex].Size
+// RetrieveLatest retrieves the most recent entry of each of q.Topics, or of
+// every topic if there are none, within q.Range. Rather than retrieving the
+// whole range, segments are scanned from newest to oldest until an entry has
+// been found for each topic. Entries are returned oldest first.
+func (d *Database) RetrieveLatest(q Query) []Entry {
+	d.queryLock.RLock()
+	defer d.queryLock.RUnlock()
 
-	if q.Range != nil {
-		startSubIndex, _ = d.Segments[startIndex].FindApproximateDatum(q.Range.Start)
-		endSubIndex, _ = d.Segments[endIndex].FindApproximateDatum(q.Range.End)
-		// End of the range should be inclusive
-		endSubIndex += 1
+	s := d.snapshot(q)
 
-		// Our binary search is kind of crude, in that it "fuzzy" matches the start
-		// and end of our range. So we have to do a quick bounds check on both sides
-		// to make sure that q.Range.Start <= startSubIndex <= q.Range.End
-		switch q.RangeSemantics {
-		case "since":
-			// Ensure start is correct
-			startDatum := d.Segments[startIndex].Series[startSubIndex]
-			startTime := d.Segments[startIndex].HeadTime.Add(startDatum.Delta)
-			if startTime.Before(q.Range.Start) {
-				startSubIndex += 1
-			}
-		case "before":
-			// Ensure end is correct
-			endDatum := d.Segments[endIndex].Series[endSubIndex]
-			endTime := d.Segments[startIndex].HeadTime.Add(endDatum.Delta)
-			if endTime.After(q.Range.End) {
-				endSubIndex -= 1
+	var wanted map[int]bool
+	d.topicLock.RLock()
+	remaining := len(s.topics)
+	if len(q.Topics) > 0 {
+		wanted = make(map[int]bool)
+		for _, topic := range q.Topics {
+			// Topics created since the snapshot have nothing in it
+			if id, ok := d.topics[normalizeTopicName(topic)]; ok && id < len(s.topics) {
+				wanted[id] = true
 			}
 		}
+		remaining = len(wanted)
 	}
+	d.topicLock.RUnlock()
 
-	// Handle the case where all of our datum is in a single segment
-	if startIndex == endIndex {
-		segment := d.Segments[startIndex]
-		data := segment.Series[startSubIndex:endSubIndex]
-		return d.entriesFromData(&segment, data)
-	}
+	entries := s.retrieveLatest(q, wanted, remaining)
+	d.counters.observeQuery(len(entries))
+	return entries
+}
 
-	// Since our start and end are different segments, build a result set
-	for i := startIndex; i <= endIndex; i++ {
-		segment := d.Segments[i]
-		if i == startIndex {
-			data := segment.Series[startSubIndex:]
-			results = append(results, d.entriesFromData(&segment, data)...)
-		} else if i == endIndex {
-			data := segment.Series[:endSubIndex]
-			results = append(results, d.entriesFromData(&segment, data)...)
-		} else {
-			data := segment.Series[:]
-			results = append(results, d.entriesFromData(&segment, data)...)
-		}
-	}
+// OldestTime returns the time of the oldest data in the database, whether
+// it's raw or rolled up
+func (d *Database) OldestTime() time.Time {
+	d.segmentLock.RLock()
+	defer d.segmentLock.RUnlock()
 
-	return results
+	if len(d.rollups.Segments) > 0 {
+		return d.rollups.Segments[0].HeadTime
+	}
+	return d.Segments[0].HeadTime
 }
 
 // NewDatabase creates a new database object in memory and creates the
 // directory and files on disk for storing the data
 // location is the base directory for creating the database
 func NewDatabase(name string, location string) (*Database, error) {
+	return NewDatabaseWithConfig(name, location, DefaultConfig)
+}
+
+// NewDatabaseWithConfig is like NewDatabase, but allows the caller to tune
+// the database's behavior with the supplied Config.
+func NewDatabaseWithConfig(name string, location string, config Config) (*Database, error) {
 	var db Database
 
+	if len(config.DedupWindows) > 0 {
+		windows := make(map[string]time.Duration, len(config.DedupWindows))
+		for topic, window := range config.DedupWindows {
+			windows[normalizeTopicName(topic)] = window
+		}
+		config.DedupWindows = windows
+	}
+
 	// If the path does not exist, create a new directory
 	fileinfo, err := os.Stat(location)
 	if os.IsNotExist(err) {
@@ -644,53 +1589,88 @@ func NewDatabase(name string, location string) (*Database, error) {
 	}
 
 	// Migrate the database if it's old
+	if config.ManualMigrations && migrationIsNeeded(location) {
+		return nil, fmt.Errorf("%w: %s is version %d, but the current version is %d", ErrMigrationNeeded, location, detectVersion(location), FossilDBVersion)
+	}
 	err = MigrateDatabaseIfNeeded(location)
 	if err != nil {
 		return nil, err
 	}
 
+	changes := newChangeFeed(config.ChangeFeedSize)
+
 	if _, err = os.Stat(filepath.Join(location, "metadata")); err == nil {
 		db = Database{
-			Path: location,
+			Path:        location,
+			config:      config,
+			schemaCache: schemaCache{capacity: config.SchemaCacheSize},
+			plans:       planCache{capacity: config.PlanCacheSize},
+			changes:     changes,
+			wal:         newWalWriter(walForConfig(location, config), changes.add),
+			log:         config.Logger,
 		}
 		err = db.deserializeInternal()
 		if err != nil {
 			return nil, err
 		}
+		var head time.Time
+		if len(db.Segments) > 0 {
+			head = db.Segments[db.Current].HeadTime
+		}
+		changes.reset(db.Sequence, head)
 		db.topics = make(map[string]int)
-		wal := WriteAheadLog{filepath.Join(db.Path, "wal.log")}
-		wal.ApplyToDB(&db)
-	} else if _, err = os.Stat(filepath.Join(location, "wal.log")); err == nil {
+		db.applyLogs()
+		db.buildColumnsInternal()
+	} else if hasLog(location) {
 		db = Database{
-			Version:    FossilDBVersion,
-			Path:       location,
-			Segments:   []Segment{},
-			Current:    0,
-			topics:     make(map[string]int),
-			TopicCount: 0,
-		}
-		wal := WriteAheadLog{filepath.Join(db.Path, "wal.log")}
-		wal.ApplyToDB(&db)
+			Version:      FossilDBVersion,
+			Path:         location,
+			Segments:     []Segment{},
+			Current:      0,
+			topics:       make(map[string]int),
+			codecs:       make(map[string]string),
+			encodings:    make(map[string]string),
+			overrides:    make(map[string]bool),
+			namedSchemas: make(map[string]string),
+			TopicCount:   0,
+			config:       config,
+			schemaCache:  schemaCache{capacity: config.SchemaCacheSize},
+			plans:        planCache{capacity: config.PlanCacheSize},
+			changes:      changes,
+			wal:          newWalWriter(walForConfig(location, config), changes.add),
+			log:          config.Logger,
+		}
+		db.applyLogs()
 	} else {
 		db = Database{
-			Version:    FossilDBVersion,
-			Path:       location,
-			Segments:   []Segment{},
-			Current:    0,
-			topics:     make(map[string]int),
-			TopicCount: 0,
+			Version:      FossilDBVersion,
+			Path:         location,
+			Segments:     []Segment{},
+			Current:      0,
+			topics:       make(map[string]int),
+			codecs:       make(map[string]string),
+			encodings:    make(map[string]string),
+			overrides:    make(map[string]bool),
+			namedSchemas: make(map[string]string),
+			TopicCount:   0,
+			config:       config,
+			schemaCache:  schemaCache{capacity: config.SchemaCacheSize},
+			plans:        planCache{capacity: config.PlanCacheSize},
+			changes:      changes,
+			wal:          newWalWriter(walForConfig(location, config), changes.add),
+			log:          config.Logger,
 		}
 		db.AddTopic("/", "string")
 		// TODO: Generalize this
 		sTime := time.Now()
-		wal := WriteAheadLog{filepath.Join(db.Path, "wal.log")}
-		wal.AddSegment(sTime)
-		db.Segments = append(db.Segments, Segment{HeadTime: sTime})
+		db.writeLog(encodeAddSegment(sTime, db.nextSequence()))
+		db.addSegmentInternal(sTime)
 	}
 	// We set the name here so that it's always correct, since the name can
 	// change after we first splat to disk.
 	db.Name = name
-	if db.appendCount > SegmentSize {
+	db.wal.timed = db.observeLogWrite
+	if db.appendCount.Load() > int64(SegmentSize) {
 		err := db.serializeInternal()
 		if err != nil {
 			return nil, err
@@ -700,5 +1680,7 @@ func NewDatabase(name string, location string) (*Database, error) {
 	for k, v := range db.TopicLookup {
 		db.topics[v] = k
 	}
+	db.indexDedupInternal(time.Now())
+	db.measureStorage()
 	return &db, nil
 }
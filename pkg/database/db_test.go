@@ -0,0 +1,1644 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSerializeRoundTrip(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{SyncWrites: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		err = db.Append([]byte(fmt.Sprintf("entry %d", i)), "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.serializeInternal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No temporary files should be left behind after serialization
+	err = filepath.Walk(location, func(p string, info os.FileInfo, err error) error {
+		if strings.HasSuffix(p, ".tmp") {
+			t.Errorf("found leftover temporary file %s", p)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabase("test", location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := db.Retrieve(Query{Range: nil})
+	if len(entries) != 10 {
+		t.Errorf("expected 10 entries after reload, found %d", len(entries))
+	}
+}
+
+func TestWriteAheadLogReplayIsIdempotent(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		err = db.Append([]byte(fmt.Sprintf("entry %d", i)), "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walPath := filepath.Join(location, "wal.log")
+	wal, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.serializeInternal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash between serializing and removing the write-ahead log
+	err = os.WriteFile(walPath, wal, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabase("test", location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := db.Retrieve(Query{Range: nil})
+	if len(entries) != 5 {
+		t.Errorf("expected 5 entries after recovery, found %d", len(entries))
+	}
+
+	if db.TopicCount != 2 {
+		t.Errorf("expected 2 topics after recovery, found %d", db.TopicCount)
+	}
+}
+
+func TestAppendWhileSerializationIsWritten(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		err = db.Append([]byte(fmt.Sprintf("entry %d", i)), "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Serialize the way a background flush does, appending between capturing
+	// the database and writing it out, without holding writeLock
+	db.writeLock.Lock()
+	s, err := db.captureSerialization()
+	db.writeLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Append([]byte("entry 5"), "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.writeSerialization(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.writeLock.Lock()
+	db.finishSerialization(s)
+	db.writeLock.Unlock()
+
+	// The append is left for the next serialization, in the write-ahead log
+	if db.appendCount.Load() != 1 || db.flushedSequence == db.Sequence {
+		t.Errorf("expected 1 append pending, found %d", db.appendCount.Load())
+	}
+	if _, err = os.Stat(filepath.Join(location, "wal.log")); err != nil {
+		t.Errorf("expected the write-ahead log to hold the append: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(location, "wal.log.flushing")); !os.IsNotExist(err) {
+		t.Errorf("expected the write-ahead log moved aside to be removed, got %v", err)
+	}
+
+	db, err = NewDatabase("test", location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := db.Retrieve(Query{Range: nil})
+	if len(entries) != 6 {
+		t.Errorf("expected 6 entries after reload, found %d", len(entries))
+	}
+}
+
+func TestFlushingLogIsReplayed(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		err = db.Append([]byte(fmt.Sprintf("entry %d", i)), "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate a crash while a serialization is written out, after more has
+	// been appended to a new write-ahead log
+	db.writeLock.Lock()
+	_, err = db.captureSerialization()
+	db.writeLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Append([]byte("entry 5"), "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewDatabase("test", location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := reopened.Retrieve(Query{Range: nil})
+	if len(entries) != 6 {
+		t.Errorf("expected 6 entries after recovery, found %d", len(entries))
+	}
+
+	// Serializing the original database again keeps both logs until it's
+	// written out
+	err = db.Append([]byte("entry 6"), "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.serializeInternal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(location, "wal.log.flushing")); !os.IsNotExist(err) {
+		t.Errorf("expected the write-ahead log moved aside to be removed, got %v", err)
+	}
+
+	reopened, err = NewDatabase("test", location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries = reopened.Retrieve(Query{Range: nil})
+	if len(entries) != 7 {
+		t.Errorf("expected 7 entries after serializing, found %d", len(entries))
+	}
+}
+
+func TestFlushPersistsWriteAheadLog(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Append([]byte("entry"), "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(location, "wal.log"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected write-ahead log to be removed after flush, got %v", err)
+	}
+
+	// Flushing again with nothing new should be a no-op
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabase("test", location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := db.Retrieve(Query{Range: nil})
+	if len(entries) != 1 {
+		t.Errorf("expected 1 entry after reload, found %d", len(entries))
+	}
+}
+
+func TestTopicCodecs(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.AddTopicWithCodec("/sensors", "int32", "json")
+	db.AddTopic("/sensors/garage", "")
+
+	if c := db.CodecForTopic("/sensors/garage"); c != "json" {
+		t.Errorf("expected implicitly created topic to inherit codec, got '%s'", c)
+	}
+
+	// Codecs should survive replaying the write-ahead log...
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := db.CodecForTopic("/sensors"); c != "json" {
+		t.Errorf("expected codec after replaying write-ahead log, got '%s'", c)
+	}
+
+	// ...as well as serialization
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := db.CodecForTopic("/sensors/garage"); c != "json" {
+		t.Errorf("expected codec after serialization, got '%s'", c)
+	}
+
+	if c := db.CodecForTopic("/"); c != "" {
+		t.Errorf("expected root topic to have no codec, got '%s'", c)
+	}
+}
+
+func TestTopicEncodings(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.AddTopic("/cpu", "float64")
+	db.AddTopic("/names", "string")
+	if err = db.SetTopicEncoding("/cpu", EncodingGorilla); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.SetTopicEncoding("/names", EncodingGorilla); err == nil {
+		t.Errorf("expected an error setting an encoding which doesn't apply to the schema")
+	}
+	if err = db.SetTopicEncoding("/missing", EncodingDelta); !errors.Is(err, ErrTopicNotFound) {
+		t.Errorf("expected ErrTopicNotFound, got %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		value := binary.LittleEndian.AppendUint64(nil, math.Float64bits(float64(i%10)/2))
+		if err = db.AppendOrCreate(value, "/cpu/load"); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Append([]byte("name"), "/names"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if e := db.EncodingForTopic("/cpu/load"); e != EncodingGorilla {
+		t.Errorf("expected implicitly created topic to inherit encoding, got '%s'", e)
+	}
+	expected := db.Retrieve(Query{Range: nil})
+
+	// Encodings should survive replaying the write-ahead log...
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := db.EncodingForTopic("/cpu/load"); e != EncodingGorilla {
+		t.Errorf("expected encoding after replaying write-ahead log, got '%s'", e)
+	}
+
+	// ...as well as serialization, which decodes the data transparently
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the segment without decoding its columns
+	var segment Segment
+	contents, err := os.ReadFile(filepath.Join(location, "segments", "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gob.NewDecoder(bytes.NewBuffer(contents)).Decode(&segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segment.Columns) != 1 {
+		t.Errorf("expected one encoded column on disk, got %d", len(segment.Columns))
+	}
+
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := db.EncodingForTopic("/cpu"); e != EncodingGorilla {
+		t.Errorf("expected encoding after serialization, got '%s'", e)
+	}
+
+	actual := db.Retrieve(Query{Range: nil})
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if actual[i].Topic != expected[i].Topic || !bytes.Equal(actual[i].Data, expected[i].Data) {
+			t.Errorf("entry %d: expected %+v, got %+v", i, expected[i], actual[i])
+		}
+	}
+}
+
+func TestSystemTopicsAreReserved(t *testing.T) {
+	db, err := NewDatabaseWithConfig("test", filepath.Join(t.TempDir(), "db"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range []string{"/_system", "/_system/topics", "/_system/new"} {
+		if _, err = db.CreateTopic(topic, "string", ""); !errors.Is(err, ErrSystemTopic) {
+			t.Errorf("%s: expected ErrSystemTopic, got %v", topic, err)
+		}
+		if err = db.Append([]byte("data"), topic); !errors.Is(err, ErrSystemTopic) {
+			t.Errorf("%s: expected ErrSystemTopic appending, got %v", topic, err)
+		}
+	}
+
+	// Only the prefix itself is reserved
+	if _, err = db.CreateTopic("/_systems", "string", ""); err != nil {
+		t.Errorf("expected /_systems to be created, got %v", err)
+	}
+
+	db.AddTopic("/a", "int32")
+	entries := db.SystemEntries(SystemTopicTopics, func(topic string) bool { return topic != "/" })
+	if len(entries) != 2 {
+		t.Fatalf("expected an entry for each visible topic, got %d", len(entries))
+	}
+	s, _ := SystemTopicSchema(SystemTopicTopics)
+	if !s.Validate(entries[0].Data) || entries[0].Schema != s.ToSchema() {
+		t.Errorf("expected entries to conform to %s", s.ToSchema())
+	}
+}
+
+func TestDescribeTopic(t *testing.T) {
+	db, err := NewDatabaseWithConfig("test", filepath.Join(t.TempDir(), "db"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.AddTopic("/sensors", "int32")
+	for i := 0; i < 3; i++ {
+		err = db.Append([]byte{byte(i), 0, 0, 0}, "/sensors/garage")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Append([]byte{1, 0, 0, 0}, "/sensors")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, ok := db.DescribeTopic("/sensors/garage")
+	if !ok {
+		t.Fatal("expected /sensors/garage to exist")
+	}
+
+	if info.Count != 3 {
+		t.Errorf("expected 3 entries, got %d", info.Count)
+	}
+
+	if info.First.IsZero() || info.Last.Before(info.First) {
+		t.Errorf("expected first and last entry times, got %v and %v", info.First, info.Last)
+	}
+
+	if info.Schema.ToSchema() != "int32" || info.ParentSchema == nil || info.ParentSchema.ToSchema() != "int32" {
+		t.Errorf("expected int32 schema inherited from parent, got %v and %v", info.Schema, info.ParentSchema)
+	}
+	if s := db.InheritedSchema("/sensors/garage"); s == nil || s.ToSchema() != "int32" {
+		t.Errorf("expected /sensors/garage to inherit int32, got %v", s)
+	}
+	if s := db.InheritedSchema("/sensors"); s != nil {
+		t.Errorf("expected /sensors not to inherit a schema, got %v", s)
+	}
+
+	info, ok = db.DescribeTopic("/sensors")
+	if !ok || info.Count != 1 || info.ParentSchema != nil {
+		t.Errorf("expected /sensors to hold 1 entry and have no parent schema, got %+v", info)
+	}
+
+	_, ok = db.DescribeTopic("/missing")
+	if ok {
+		t.Error("expected /missing not to exist")
+	}
+
+	// Topics are described from a snapshot, rather than holding up appends
+	// while their data is counted
+	db.writeLock.Lock()
+	done := make(chan []TopicInfo)
+	go func() {
+		info, _ := db.DescribeTopic("/sensors/garage")
+		done <- append(db.ListTopics(), info)
+	}()
+	select {
+	case infos := <-done:
+		if n := len(infos); n != 4 || infos[1].Count != 1 || infos[2].Count != 3 || infos[3].Count != 3 {
+			t.Errorf("expected /sensors and /sensors/garage to be counted, got %+v", infos)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected describing topics not to wait for the write lock")
+	}
+	db.writeLock.Unlock()
+}
+
+func TestNamedSchemas(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddSchema("point", `{"y":int32, "x":int32}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"int32", "has space", "", "1st"} {
+		if db.AddSchema(name, "int32") == nil {
+			t.Errorf("expected schema name '%s' to be rejected", name)
+		}
+	}
+
+	if db.AddSchema("point", "int64") == nil {
+		t.Error("expected redefining a schema to fail")
+	}
+
+	db.AddTopic("/points", "point")
+	if s := db.SchemaForTopic("/points").ToSchema(); s != `{"x":int32,"y":int32,}` {
+		t.Errorf("expected topic to be created with the named schema, got %s", s)
+	}
+
+	// Named schemas should survive replaying the write-ahead log...
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, ok := db.NamedSchema("point"); !ok || s != `{"x":int32,"y":int32,}` {
+		t.Errorf("expected named schema after replaying write-ahead log, got '%s'", s)
+	}
+
+	// ...as well as serialization
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if schemas := db.NamedSchemas(); len(schemas) != 1 || schemas["point"] != `{"x":int32,"y":int32,}` {
+		t.Errorf("expected named schema after serialization, got %v", schemas)
+	}
+}
+
+func TestTopicTemplates(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.AddTopic("/devices", "int64")
+	err = db.AddTopicTemplate("/devices/*/temp", "float32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pattern := range []string{"devices/*", "/devices/[", ""} {
+		if db.AddTopicTemplate(pattern, "int32") == nil {
+			t.Errorf("expected pattern '%s' to be rejected", pattern)
+		}
+	}
+	if db.AddTopicTemplate("/devices/*/temp", "int64") == nil {
+		t.Error("expected redefining a template to fail")
+	}
+	if err = db.AddTopicTemplate("/devices/*/temp", "float32"); err != nil {
+		t.Errorf("expected re-adding the same template to succeed, got %s", err)
+	}
+
+	// Topics created without a schema take the template's, rather than
+	// conflicting with their parent's
+	db.AddTopic("/devices/a/temp", "")
+	if s := db.SchemaForTopic("/devices/a/temp").ToSchema(); s != "float32" {
+		t.Errorf("expected the template's schema, got %s", s)
+	}
+	db.AddTopic("/devices/a/temp/inside", "")
+	if s := db.SchemaForTopic("/devices/a/temp/inside").ToSchema(); s != "float32" {
+		t.Errorf("expected sub-topics to inherit the template's schema, got %s", s)
+	}
+	db.AddTopic("/devices/a/humidity", "")
+	if s := db.SchemaForTopic("/devices/a/humidity").ToSchema(); s != "int64" {
+		t.Errorf("expected topics not matching the template to inherit their parent's schema, got %s", s)
+	}
+
+	// An explicit schema still has to agree with the parent's
+	if _, err = db.CreateTopic("/devices/b/temp", "int32", ""); err == nil {
+		t.Error("expected an explicit schema to conflict with the parent's")
+	}
+
+	// Templates should survive replaying the write-ahead log...
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []TopicTemplate{{Pattern: "/devices/*/temp", Schema: "float32"}}
+	if templates := db.TopicTemplates(); !reflect.DeepEqual(templates, expected) {
+		t.Errorf("expected %v after replaying write-ahead log, got %v", expected, templates)
+	}
+
+	// ...as well as serialization
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if templates := db.TopicTemplates(); !reflect.DeepEqual(templates, expected) {
+		t.Errorf("expected %v after serialization, got %v", expected, templates)
+	}
+	db.AddTopic("/devices/c/temp", "")
+	if s := db.SchemaForTopic("/devices/c/temp").ToSchema(); s != "float32" {
+		t.Errorf("expected the template's schema after reopening, got %s", s)
+	}
+}
+
+func TestEnumTopic(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.AddTopic("/status", `enum("ok","warn","crit")`)
+	if db.Append([]byte{1}, "/status") != nil {
+		t.Error("expected a valid enum value to be appended")
+	}
+	if db.Append([]byte{3}, "/status") == nil {
+		t.Error("expected an enum value out of range to be rejected")
+	}
+
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := db.SchemaForTopic("/status").ToSchema(); s != `enum("ok","warn","crit")` {
+		t.Errorf("expected enum schema after serialization, got %s", s)
+	}
+}
+
+func TestStrictTopics(t *testing.T) {
+	db, err := NewDatabaseWithConfig("test", filepath.Join(t.TempDir(), "db"), Config{StrictTopics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Append([]byte("data"), "/missing"); !errors.Is(err, ErrTopicNotFound) {
+		t.Errorf("expected ErrTopicNotFound, got %v", err)
+	}
+	if db.TopicExists("/missing") {
+		t.Error("expected append in strict mode not to create a topic")
+	}
+
+	db.AddTopic("/present", "")
+	if err = db.Append([]byte("data"), "/present"); err != nil {
+		t.Errorf("expected append to an existing topic to succeed, got %v", err)
+	}
+
+	if err = db.AppendOrCreate([]byte("data"), "/created"); err != nil || !db.TopicExists("/created") {
+		t.Errorf("expected AppendOrCreate to create the topic, got %v", err)
+	}
+}
+
+func TestMaxTopics(t *testing.T) {
+	db, err := NewDatabaseWithConfig("test", filepath.Join(t.TempDir(), "db"), Config{MaxTopics: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "/" counts towards the limit
+	for _, topic := range []string{"/a", "/b"} {
+		if _, err = db.CreateTopic(topic, "", ""); err != nil {
+			t.Fatalf("expected %s to be created, got %v", topic, err)
+		}
+	}
+
+	if _, err = db.CreateTopic("/c", "", ""); !errors.Is(err, ErrTooManyTopics) {
+		t.Errorf("expected ErrTooManyTopics, got %v", err)
+	}
+	if err = db.Append([]byte("data"), "/d"); !errors.Is(err, ErrTooManyTopics) {
+		t.Errorf("expected append to a new topic to fail with ErrTooManyTopics, got %v", err)
+	}
+
+	// Existing topics are unaffected
+	if err = db.Append([]byte("data"), "/a"); err != nil {
+		t.Errorf("expected append to an existing topic to succeed, got %v", err)
+	}
+	if db.TopicCount != 3 {
+		t.Errorf("expected 3 topics, got %d", db.TopicCount)
+	}
+}
+
+func TestCreateTopicSchemaConflict(t *testing.T) {
+	db, err := NewDatabaseWithConfig("test", filepath.Join(t.TempDir(), "db"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.AddTopic("/sensors", "int32")
+	if _, err = db.CreateTopic("/sensors/temp", "float64", ""); err == nil {
+		t.Error("expected a schema conflicting with the parent's to be rejected")
+	}
+	if db.TopicExists("/sensors/temp") {
+		t.Error("expected conflicting topic not to be created")
+	}
+}
+
+func TestValidateTopic(t *testing.T) {
+	db, err := NewDatabaseWithConfig("test", filepath.Join(t.TempDir(), "db"), Config{MaxTopics: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AddTopic("/sensors", "int32")
+
+	// Sub-topics inherit their parent's schema, without being created
+	s, _, err := db.ValidateTopic("/sensors/temp", "", "", false)
+	if err != nil || s.ToSchema() != "int32" {
+		t.Errorf("expected the parent's schema, got %v, %v", s, err)
+	}
+	if db.TopicExists("/sensors/temp") {
+		t.Error("expected validation not to create the topic")
+	}
+
+	if _, _, err = db.ValidateTopic("/sensors/temp", "float64", "", false); !errors.As(err, &SchemaConflictError{}) {
+		t.Errorf("expected a schema conflict, got %v", err)
+	}
+	if _, _, err = db.ValidateTopic("/sensors/temp", "float64", "", true); err != nil {
+		t.Errorf("expected an override to be allowed, got %v", err)
+	}
+	if _, _, err = db.ValidateTopic("/bad", "{int32", "", false); err == nil {
+		t.Error("expected a schema which doesn't parse to be rejected")
+	}
+
+	db.AddTopic("/other", "")
+	if _, _, err = db.ValidateTopic("/new", "", "", false); !errors.Is(err, ErrTooManyTopics) {
+		t.Errorf("expected ErrTooManyTopics, got %v", err)
+	}
+	// Existing topics keep their own schema
+	if s, _, err = db.ValidateTopic("/sensors", "float64", "", false); err != nil || s.ToSchema() != "int32" {
+		t.Errorf("expected the existing schema, got %v, %v", s, err)
+	}
+}
+
+func TestCreateTopicMultiLineSchema(t *testing.T) {
+	db, err := NewDatabaseWithConfig("test", filepath.Join(t.TempDir(), "db"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateTopic("/points", "{\n\t\"y\": int32, # up\n\t\"x\": int32,\n}", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same schema written on one line doesn't conflict with it
+	if _, err = db.CreateTopic("/points/a", `{"x":int32,"y":int32,}`, ""); err != nil {
+		t.Errorf("expected equivalent schemas not to conflict, got %s", err)
+	}
+}
+
+func TestCreateTopicSchemaOverride(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.AddTopic("/sensors", "int32")
+	_, err = db.CreateTopic("/sensors/temp", "float64", "")
+	var conflict SchemaConflictError
+	if !errors.As(err, &conflict) || !errors.Is(err, ErrSchemaConflict) {
+		t.Fatalf("expected a SchemaConflictError, got %v", err)
+	}
+	if conflict.Parent != "/sensors" || conflict.ParentSchema != "int32" || conflict.Schema != "float64" {
+		t.Errorf("unexpected conflict %+v", conflict)
+	}
+
+	if _, err = db.CreateTopicWithOverride("/sensors/temp", "float64", ""); err != nil {
+		t.Fatal(err)
+	}
+	if !db.SchemaOverridden("/sensors/temp") {
+		t.Error("expected /sensors/temp to be recorded as an override")
+	}
+
+	// Sub-topics inherit the overriding schema
+	db.AddTopic("/sensors/temp/garage", "")
+	if info, _ := db.DescribeTopic("/sensors/temp/garage"); info.Schema.ToSchema() != "float64" {
+		t.Errorf("expected sub-topic to inherit float64, got %s", info.Schema.ToSchema())
+	}
+
+	// Overrides should survive replaying the write-ahead log...
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.SchemaOverridden("/sensors/temp") {
+		t.Error("expected override after replaying write-ahead log")
+	}
+
+	// ...as well as serialization
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := db.DescribeTopic("/sensors/temp"); !info.Override {
+		t.Error("expected override after serialization")
+	}
+}
+
+func TestConcurrentAppendsAreRecovered(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 8
+	const appends = 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < appends; i++ {
+				err := db.Append([]byte(fmt.Sprintf("entry %d", i)), fmt.Sprintf("/writer/%d", w))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// Every action must have made it to the write-ahead log, in sequence
+	// order, for all of them to be replayed
+	db, err = NewDatabase("test", location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := db.Retrieve(Query{Range: nil})
+	if len(entries) != writers*appends {
+		t.Errorf("expected %d entries after reload, found %d", writers*appends, len(entries))
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Time.Before(entries[i-1].Time) {
+			t.Fatalf("expected entries in time order after reload, but entry %d is before %d", i, i-1)
+		}
+	}
+}
+
+func TestDeserializeManySegments(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	fillSegments(db, "/foo", 5, start)
+	err = db.serializeInternal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabaseWithConfig("test", location, Config{LoadWorkers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(db.Segments) != 5 {
+		t.Fatalf("expected 5 segments after reload, found %d", len(db.Segments))
+	}
+	for i, segment := range db.Segments {
+		expected := start.Add(time.Duration(i*SegmentSize) * time.Millisecond)
+		if !segment.HeadTime.Equal(expected) {
+			t.Errorf("expected segment %d to start at %s, got %s", i, expected, segment.HeadTime)
+		}
+	}
+
+	entries := db.Retrieve(Query{Range: nil})
+	if len(entries) != 5*SegmentSize {
+		t.Errorf("expected %d entries after reload, found %d", 5*SegmentSize, len(entries))
+	}
+
+	// A missing segment should fail to load, rather than leave a hole
+	err = os.Remove(filepath.Join(location, "segments", "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewDatabaseWithConfig("test", location, Config{LoadWorkers: 2})
+	if err == nil {
+		t.Error("expected an error opening a database with a missing segment")
+	}
+}
+
+func TestRollups(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+	config := Config{RawRetention: time.Hour}
+
+	db, err := NewDatabaseWithConfig("test", location, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topicID := db.AddTopic("/foo", "int32")
+
+	// Two segments old enough to roll up, each with one minute of data, and
+	// one with data which is kept raw
+	now := time.Now()
+	heads := []time.Time{
+		now.Add(-3 * time.Hour).Truncate(time.Minute),
+		now.Add(-2 * time.Hour).Truncate(time.Minute),
+		now.Add(-10 * time.Minute),
+	}
+	values := [][]int32{{1, 2, 3}, {4, 6}, {7}}
+	db.Segments = make([]Segment, len(heads))
+	for i := range db.Segments {
+		db.Segments[i].HeadTime = heads[i]
+		for j, v := range values[i] {
+			db.Segments[i].Append(&Datum{
+				Delta:   time.Duration(j) * 10 * time.Second,
+				TopicID: topicID,
+				Data:    binary.LittleEndian.AppendUint32(nil, uint32(v)),
+			})
+		}
+	}
+	db.Current = uint32(len(heads) - 1)
+	db.indexTopicSpans()
+
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first segment was entirely rolled up, but the second still
+	// precedes data which is kept raw
+	if len(db.Segments) != 2 || db.Current != 1 {
+		t.Errorf("expected the first raw segment to be dropped, found %d segments", len(db.Segments))
+	}
+	_, err = os.Stat(filepath.Join(location, "segments", "0"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the dropped segment's file to be removed, got %v", err)
+	}
+
+	check := func(db *Database) {
+		t.Helper()
+
+		entries := db.Retrieve(Query{Range: nil})
+		expected := []int32{2, 5, 7}
+		if len(entries) != len(expected) {
+			t.Fatalf("expected %d entries, found %d", len(expected), len(entries))
+		}
+		for i, entry := range entries {
+			if v := int32(binary.LittleEndian.Uint32(entry.Data)); v != expected[i] {
+				t.Errorf("expected entry %d to be %d, got %d", i, expected[i], v)
+			}
+		}
+		if !entries[0].Time.Equal(heads[0]) {
+			t.Errorf("expected the first rollup at %s, got %s", heads[0], entries[0].Time)
+		}
+
+		// Ranges entirely within either tier only read that tier
+		entries = db.Retrieve(Query{Range: &TimeRange{Start: heads[0], End: heads[1].Add(time.Minute)}})
+		if len(entries) != 2 {
+			t.Errorf("expected 2 rolled up entries, found %d", len(entries))
+		}
+		entries = db.Retrieve(Query{Range: &TimeRange{Start: heads[2], End: now}})
+		if len(entries) != 1 {
+			t.Errorf("expected 1 raw entry, found %d", len(entries))
+		}
+
+		info, ok := db.DescribeTopic("/foo")
+		if !ok {
+			t.Fatal("expected /foo to exist")
+		}
+		if info.Count != 3 || !info.First.Equal(heads[0]) {
+			t.Errorf("expected 3 entries starting at %s, got %+v", heads[0], info)
+		}
+	}
+	check(db)
+
+	db, err = NewDatabaseWithConfig("test", location, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+}
+
+func TestRetrieveLatest(t *testing.T) {
+	db, err := NewDatabaseWithConfig("test", filepath.Join(t.TempDir(), "db"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, topic := range []string{"/sensors/a", "/sensors/b", "/other"} {
+			err = db.Append([]byte(fmt.Sprintf("%s %d", topic, i)), topic)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	entries := db.RetrieveLatest(Query{Topics: []string{"/sensors/a", "/sensors/b"}})
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, found %d", len(entries))
+	}
+	for i, expected := range []string{"/sensors/a 2", "/sensors/b 2"} {
+		if string(entries[i].Data) != expected {
+			t.Errorf("expected entry %d to be %q, got %q", i, expected, entries[i].Data)
+		}
+	}
+
+	// Every topic with data, oldest first
+	entries = db.RetrieveLatest(Query{})
+	if len(entries) != 3 || string(entries[2].Data) != "/other 2" {
+		t.Errorf("expected the latest entry of 3 topics, got %v", entries)
+	}
+
+	// The latest entry within a range which ends before the newest data
+	all := db.Retrieve(Query{})
+	entries = db.RetrieveLatest(Query{
+		Topics: []string{"/sensors/a"},
+		Range:  &TimeRange{Start: all[0].Time, End: all[3].Time},
+	})
+	if len(entries) != 1 || string(entries[0].Data) != "/sensors/a 1" {
+		t.Errorf("expected the latest entry in range to be from the second append, got %v", entries)
+	}
+}
+
+func TestRetrieveDuringAppends(t *testing.T) {
+	db, err := NewDatabaseWithConfig("test", filepath.Join(t.TempDir(), "db"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough appends to fill a segment, so that queries race with new
+	// segments being added as well as with appends to the current one
+	const appends = SegmentSize + SegmentSize/2
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < appends; i++ {
+			err := db.Append([]byte(fmt.Sprintf("%d", i)), fmt.Sprintf("/foo/%d", i%10))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// Every snapshot should hold a prefix of the appends, in order
+	for done := false; !done; {
+		entries := db.Retrieve(Query{Range: nil})
+		done = len(entries) == appends
+		for i, entry := range entries {
+			if string(entry.Data) != fmt.Sprintf("%d", i) {
+				t.Fatalf("expected entry %d to be %d, got %q", i, i, entry.Data)
+			}
+		}
+		db.RetrieveLatest(Query{Topics: []string{"/foo/1"}})
+	}
+	wg.Wait()
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCorruptTopicsFile(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"/foo", "/bar"} {
+		err = db.Append([]byte(topic), topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.serializeInternal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit in the compressed contents, as a partial write might
+	p := filepath.Join(location, "topics")
+	contents, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents[len(contents)-1] ^= 1
+	err = os.WriteFile(p, contents, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDatabaseWithConfig("test", location, Config{})
+	if !errors.Is(err, ErrCorruptFile) {
+		t.Fatalf("expected ErrCorruptFile, got %v", err)
+	}
+
+	db, err = NewDatabaseWithConfig("test", location, Config{RecoverTopics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Schemas were intact, so only the names of the topics are lost
+	expected := []string{"/", "/recovered/1", "/recovered/2"}
+	if fmt.Sprint(db.TopicLookup) != fmt.Sprint(expected) {
+		t.Errorf("expected recovered topics %v, got %v", expected, db.TopicLookup)
+	}
+	entries := db.Retrieve(Query{Range: nil})
+	if len(entries) != 2 || entries[0].Topic != "/recovered/1" || string(entries[0].Data) != "/foo" {
+		t.Errorf("expected entries in recovered topics, got %v", entries)
+	}
+}
+
+func TestLegacyMetadataFiles(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AddTopic("/foo", "int32")
+	err = db.serializeInternal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files written before they had a header are plain zlib streams
+	for _, name := range []string{"topics", "schemas"} {
+		p := filepath.Join(location, name)
+		contents, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(p, contents[metadataFileHeaderSize:], 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := db.SchemaForTopic("/foo"); s == nil || s.ToSchema() != "int32" {
+		t.Errorf("expected /foo to be read with its schema, got %v", s)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AddTopic("/count", "int32")
+	for _, topic := range []string{"/foo", "/count"} {
+		if err = db.AppendOrCreate([]byte("data"), topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if plan, err := RebuildIndex(location, RebuildOptions{}); err != nil || plan.Needed() {
+		t.Fatalf("expected an intact database not to need rebuilding, got %+v, %v", plan, err)
+	}
+
+	// Without its topics file, the database only opens when recovering
+	if err = os.Remove(filepath.Join(location, "topics")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewDatabaseWithConfig("test", location, Config{}); err == nil {
+		t.Fatal("expected a database without a topics file not to open")
+	}
+
+	// A dry run reports the rebuild without writing anything
+	plan, err := RebuildIndex(location, RebuildOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Needed() || !plan.LostTopics || plan.LostSchemas || plan.Topics != 3 || plan.Recovered != 2 {
+		t.Errorf("unexpected rebuild plan: %+v", plan)
+	}
+	if _, err = os.Stat(filepath.Join(location, "topics")); !os.IsNotExist(err) {
+		t.Errorf("expected a dry run not to write a topics file, got %v", err)
+	}
+
+	plan, err = RebuildIndex(location, RebuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(plan.Backup, "schemas")); err != nil {
+		t.Errorf("expected the database to be backed up, got %v", err)
+	}
+
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/", "/recovered/1", "/recovered/2"}
+	if fmt.Sprint(db.TopicLookup) != fmt.Sprint(expected) {
+		t.Errorf("expected rebuilt topics %v, got %v", expected, db.TopicLookup)
+	}
+	if s := db.SchemaForTopic("/recovered/1").ToSchema(); s != "int32" {
+		t.Errorf("expected the intact schema of /count to be kept, got %s", s)
+	}
+	if len(db.Retrieve(Query{Range: nil})) != 2 {
+		t.Error("expected the rebuilt database to hold 2 entries")
+	}
+}
+
+func TestEntryTTL(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AppendOrCreateWithTTL([]byte("gone"), "/presence", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AppendOrCreate([]byte("kept"), "/presence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	entries := db.Retrieve(Query{Range: nil})
+	if len(entries) != 1 || string(entries[0].Data) != "kept" {
+		t.Errorf("expected only the entry without a TTL, got %v", entries)
+	}
+	entries = db.RetrieveLatest(Query{Topics: []string{"/presence"}})
+	if len(entries) != 1 || string(entries[0].Data) != "kept" {
+		t.Errorf("expected the latest entry which hasn't expired, got %v", entries)
+	}
+	info, _ := db.DescribeTopic("/presence")
+	if info.Count != 1 {
+		t.Errorf("expected expired entries not to be counted, got %d", info.Count)
+	}
+}
+
+func TestCompactExpiredEntries(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	topicID := db.AddTopic("/presence", "")
+
+	// A full segment with expired data, followed by the current segment
+	head := time.Now().Add(-time.Hour)
+	db.Segments = []Segment{{HeadTime: head}, {HeadTime: time.Now()}}
+	db.Segments[0].Append(&Datum{Delta: 0, TopicID: topicID, Data: []byte("gone"), TTL: time.Minute})
+	db.Segments[0].Append(&Datum{Delta: time.Second, TopicID: topicID, Data: []byte("kept")})
+	db.Segments[0].Append(&Datum{Delta: 2 * time.Second, TopicID: topicID, Data: []byte("later"), TTL: 2 * time.Hour})
+	db.Current = 1
+
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if db.Segments[0].Size != 2 || string(db.Segments[0].Series[0].Data) != "kept" {
+		t.Errorf("expected the expired datum to be compacted away, got %d datums", db.Segments[0].Size)
+	}
+	if expected := head.Add(2*time.Second + 2*time.Hour); !db.Segments[0].Expires.Equal(expected) {
+		t.Errorf("expected the segment to expire next at %s, got %s", expected, db.Segments[0].Expires)
+	}
+
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Segments[0].Size != 2 {
+		t.Errorf("expected the compacted segment to be persisted, got %d datums", db.Segments[0].Size)
+	}
+	entries := db.Retrieve(Query{Range: &TimeRange{Start: head, End: head.Add(time.Minute)}})
+	if len(entries) != 2 {
+		t.Errorf("expected 2 entries, got %d", len(entries))
+	}
+}
+
+func TestScan(t *testing.T) {
+	db, err := NewDatabaseWithConfig("test", filepath.Join(t.TempDir(), "db"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		err = db.Append([]byte(fmt.Sprintf("%d", i)), "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	all := db.Retrieve(Query{Quantifier: "all"})
+
+	for _, q := range []Query{
+		{Quantifier: "all"},
+		{Quantifier: "all", Range: &TimeRange{Start: all[1].Time, End: all[3].Time}, RangeSemantics: "between"},
+	} {
+		var scanned []Entry
+		db.Scan(q, func(e Entry) {
+			scanned = append(scanned, e)
+		})
+		if !reflect.DeepEqual(scanned, db.Retrieve(q)) {
+			t.Errorf("expected scanning %+v to visit the entries retrieved, got %v", q, scanned)
+		}
+	}
+}
+
+func TestTopicSpanPruning(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	fillSegments(db, "/foo", 3, start)
+
+	// Only the last segment holds data appended to /bar
+	bar := db.AddTopic("/bar", "")
+	db.AddTopic("/empty", "")
+	last := &db.Segments[2]
+	for j := 100; j < 110; j++ {
+		last.Series[j].TopicID = bar
+	}
+	db.indexTopicSpans()
+
+	check := func(db *Database) {
+		t.Helper()
+		entries := db.Retrieve(Query{Topics: []string{"/bar"}})
+		if len(entries) != SegmentSize {
+			t.Errorf("expected only the last segment to be scanned for /bar, got %d entries", len(entries))
+		}
+		for _, e := range entries {
+			if e.Time.Before(last.HeadTime) {
+				t.Fatalf("expected no entries before %s, got one at %s", last.HeadTime, e.Time)
+			}
+		}
+
+		if entries := db.Retrieve(Query{Topics: []string{"/empty"}}); len(entries) != 0 {
+			t.Errorf("expected nothing to be scanned for a topic without data, got %d entries", len(entries))
+		}
+		if entries := db.Retrieve(Query{Topics: []string{"/foo", "/bar"}}); len(entries) != 3*SegmentSize {
+			t.Errorf("expected every segment to be scanned for /foo and /bar, got %d entries", len(entries))
+		}
+	}
+	check(db)
+
+	// Spans are rebuilt when the database is opened
+	err = db.serializeInternal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+}
+
+func TestStats(t *testing.T) {
+	db, err := NewDatabaseWithConfig("test", filepath.Join(t.TempDir(), "db"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = db.Append([]byte("data"), "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Retrieve(Query{Quantifier: "all"})
+
+	stats := db.Stats()
+	if stats.Appends != 3 || stats.AppendTime <= 0 || stats.PendingAppends != 3 {
+		t.Errorf("unexpected append stats %+v", stats)
+	}
+	if stats.Queries != 1 || stats.RetrievedEntries != 3 {
+		t.Errorf("unexpected query stats %+v", stats)
+	}
+	if stats.WALSize == 0 {
+		t.Error("expected the write-ahead log to have a size")
+	}
+
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats = db.Stats()
+	if stats.PendingAppends != 0 || stats.SerializeDuration <= 0 || stats.Serializations != 1 {
+		t.Errorf("unexpected stats after flushing %+v", stats)
+	}
+	if stats.WALSize != 0 || stats.DiskSize == 0 {
+		t.Errorf("expected the serialized database to take up disk space instead of the write-ahead log, got %+v", stats)
+	}
+}
+
+func TestSlowAppendsAndFlushes(t *testing.T) {
+	db, err := NewDatabaseWithConfig("test", filepath.Join(t.TempDir(), "db"), Config{
+		SlowAppendThreshold: time.Nanosecond,
+		SlowFlushThreshold:  time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend a segment's worth of appends has built up, so that the next
+	// one flushes the database in the background
+	db.appendCount.Store(int64(SegmentSize) + 1)
+	if err = db.Append([]byte("data"), "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := db.Stats()
+	if stats.Serializations != 1 || stats.PendingAppends != 0 {
+		t.Errorf("expected the append to be flushed in the background, got %+v", stats)
+	}
+	// Creating the topic and appending to it write to the write-ahead log,
+	// and are slow, as is the serialization
+	if stats.SlowAppends != 1 || stats.SlowFlushes < 2 {
+		t.Errorf("expected every append and flush to be slow, got %+v", stats)
+	}
+}
+
+func TestClockSkewIsClamped(t *testing.T) {
+	db, err := NewDatabaseWithConfig("test", filepath.Join(t.TempDir(), "db"), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Append([]byte("before"), "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	// Pretend the clock stepped back an hour, by moving the segment forward
+	db.Segments[db.Current].HeadTime = db.Segments[db.Current].HeadTime.Add(time.Hour)
+	if err = db.Append([]byte("after"), "/foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	segment := db.Segments[db.Current]
+	if segment.Series[1].Delta < segment.Series[0].Delta {
+		t.Errorf("expected the append to be clamped to the previous one, got deltas %v and %v", segment.Series[0].Delta, segment.Series[1].Delta)
+	}
+	if stats := db.Stats(); stats.ClockSkews != 1 {
+		t.Errorf("expected 1 clock skew, got %d", stats.ClockSkews)
+	}
+
+	if err = db.Append([]byte("later"), "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	entries := db.Retrieve(Query{Quantifier: "all"})
+	if len(entries) != 3 || string(entries[2].Data) != "later" {
+		t.Errorf("expected entries in the order they were appended, got %v", entries)
+	}
+}
+
+func TestMigrateV2Database(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Append([]byte("entry"), "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Version 2 metadata has no sequence number after the current segment
+	p := filepath.Join(location, "metadata")
+	metadata, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2 := append(binary.LittleEndian.AppendUint32([]byte{}, 2), metadata[4:12]...)
+	v2 = append(v2, metadata[20:]...)
+	if err = os.WriteFile(p, v2, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDatabaseWithConfig("test", location, Config{ManualMigrations: true})
+	if !errors.Is(err, ErrMigrationNeeded) {
+		t.Fatalf("expected opening to fail with ErrMigrationNeeded, got %v", err)
+	}
+
+	// A dry run reports the migration without writing anything
+	plan, err := MigrateDatabase(location, MigrateOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Needed() || plan.From != 2 || plan.To != FossilDBVersion || len(plan.Steps) != 1 || plan.Topics != 2 {
+		t.Errorf("unexpected migration plan: %+v", plan)
+	}
+	if after, _ := os.ReadFile(p); !bytes.Equal(after, v2) {
+		t.Error("expected a dry run not to change metadata")
+	}
+	if _, err = os.Stat(plan.Backup); !os.IsNotExist(err) {
+		t.Errorf("expected a dry run not to back up the database, got %v", err)
+	}
+
+	plan, err = MigrateDatabase(location, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup, _ := os.ReadFile(filepath.Join(plan.Backup, "metadata")); !bytes.Equal(backup, v2) {
+		t.Error("expected the version 2 metadata to be backed up")
+	}
+	if _, err = os.Stat(filepath.Join(plan.Backup, "segments", "0")); err != nil {
+		t.Errorf("expected segments to be backed up, got %v", err)
+	}
+
+	db, err = NewDatabaseWithConfig("test", location, Config{ManualMigrations: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Version != FossilDBVersion || len(db.Retrieve(Query{Range: nil})) != 1 {
+		t.Errorf("expected a migrated database holding 1 entry, got version %d", db.Version)
+	}
+	if plan, _ = MigrateDatabase(location, MigrateOptions{}); plan.Needed() {
+		t.Errorf("expected no further migration to be needed, got %+v", plan)
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+	db, err := NewDatabaseWithConfig("test", location, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 6; i++ {
+		err = db.Append([]byte(fmt.Sprintf("entry %d", i)), fmt.Sprintf("/topic%d", i%2))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkOrdered := func(entries Entries) {
+		t.Helper()
+		if len(entries) != 6 {
+			t.Fatalf("expected 6 entries, got %d", len(entries))
+		}
+		var prev uint64
+		for _, e := range entries {
+			if e.Sequence <= prev {
+				t.Errorf("expected increasing sequence numbers, got %d after %d", e.Sequence, prev)
+			}
+			prev = e.Sequence
+		}
+	}
+
+	entries := db.Retrieve(Query{Quantifier: "all"})
+	checkOrdered(entries)
+
+	// Sequence numbers survive replaying the write-ahead log, and serializing
+	// the database
+	replayed, err := NewDatabase("test", location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := replayed.Retrieve(Query{Quantifier: "all"}); !reflect.DeepEqual(sequences(got), sequences(entries)) {
+		t.Errorf("expected sequence numbers %v after replaying the log, got %v", sequences(entries), sequences(got))
+	}
+
+	err = replayed.serializeInternal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewDatabase("test", location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Retrieve(Query{Quantifier: "all"}); !reflect.DeepEqual(sequences(got), sequences(entries)) {
+		t.Errorf("expected sequence numbers %v after serializing, got %v", sequences(entries), sequences(got))
+	}
+}
+
+func sequences(entries Entries) []uint64 {
+	var s []uint64
+	for _, e := range entries {
+		s = append(s, e.Sequence)
+	}
+	return s
+}
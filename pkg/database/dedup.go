@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// ParseDedupWindows parses Config.DedupWindows from specs of the form
+// <topic>=<window>, such as /sensors=5m
+func ParseDedupWindows(specs []string) (map[string]time.Duration, error) {
+	windows := make(map[string]time.Duration, len(specs))
+	for _, spec := range specs {
+		topic, window, ok := strings.Cut(spec, "=")
+		if !ok || topic == "" {
+			return nil, fmt.Errorf("invalid dedup window '%s', expected <topic>=<window>", spec)
+		}
+		d, err := time.ParseDuration(window)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid dedup window '%s' for %s", window, topic)
+		}
+		windows[normalizeTopicName(topic)] = d
+	}
+	return windows, nil
+}
+
+// dedupWindow returns the window appends to topic are deduplicated within,
+// which is the window of its closest parent with one in Config.DedupWindows,
+// or 0 if appends to it aren't deduplicated
+func (d *Database) dedupWindow(topic string) time.Duration {
+	if len(d.config.DedupWindows) == 0 {
+		return 0
+	}
+
+	topic = normalizeTopicName(topic)
+	for {
+		if window, ok := d.config.DedupWindows[topic]; ok {
+			return window
+		}
+		if topic == "/" {
+			return 0
+		}
+		topic = path.Dir(topic)
+	}
+}
+
+type payloadHash [sha256.Size]byte
+
+// dedupIndex remembers the payloads appended to each topic with a dedup
+// window, for as long as the window. It's guarded by writeLock.
+type dedupIndex struct {
+	topics map[int]*dedupTopic
+}
+
+type dedupTopic struct {
+	// appended maps the hash of each payload remembered to its append
+	appended map[payloadHash]dedupAppend
+	// order holds the remembered payloads oldest first, so they can be
+	// forgotten once they're older than the window
+	order []dedupAppend
+}
+
+type dedupAppend struct {
+	hash     payloadHash
+	at       time.Time
+	sequence uint64
+}
+
+// seen returns the earlier append of a payload hashing to hash to topic, and
+// true, if there was one within window of now. Appends older than the window
+// are forgotten.
+func (x *dedupIndex) seen(topic int, window time.Duration, hash payloadHash, now time.Time) (dedupAppend, bool) {
+	t, ok := x.topics[topic]
+	if !ok {
+		return dedupAppend{}, false
+	}
+
+	cutoff := now.Add(-window)
+	forget := 0
+	for forget < len(t.order) && t.order[forget].at.Before(cutoff) {
+		delete(t.appended, t.order[forget].hash)
+		forget++
+	}
+	t.order = t.order[forget:]
+
+	earlier, ok := t.appended[hash]
+	return earlier, ok
+}
+
+// remember records the payload hashing to hash as appended to topic at at,
+// with sequence
+func (x *dedupIndex) remember(topic int, hash payloadHash, at time.Time, sequence uint64) {
+	if x.topics == nil {
+		x.topics = make(map[int]*dedupTopic)
+	}
+	t, ok := x.topics[topic]
+	if !ok {
+		t = &dedupTopic{appended: make(map[payloadHash]dedupAppend)}
+		x.topics[topic] = t
+	}
+
+	a := dedupAppend{hash, at, sequence}
+	t.appended[hash] = a
+	t.order = append(t.order, a)
+}
+
+// indexDedupInternal remembers the payloads appended within the dedup
+// window of their topic before now, so that appends resent after the
+// database is reopened are still deduplicated. It must be called with
+// writeLock held.
+func (d *Database) indexDedupInternal(now time.Time) {
+	var longest time.Duration
+	for _, window := range d.config.DedupWindows {
+		if window > longest {
+			longest = window
+		}
+	}
+	if longest == 0 {
+		return
+	}
+	cutoff := now.Add(-longest)
+
+	// Every datum in a segment is no newer than the head of the next one, so
+	// only segments after the last one starting before cutoff are read
+	first := 0
+	for i := range d.Segments {
+		if d.Segments[i].HeadTime.Before(cutoff) {
+			first = i
+		}
+	}
+
+	windows := make(map[int]time.Duration)
+	for i := first; i < len(d.Segments); i++ {
+		segment := &d.Segments[i]
+		for j := 0; j < segment.Size; j++ {
+			datum := &segment.Series[j]
+			window, ok := windows[datum.TopicID]
+			if !ok && datum.TopicID < len(d.TopicLookup) {
+				window = d.dedupWindow(d.TopicLookup[datum.TopicID])
+				windows[datum.TopicID] = window
+			}
+
+			t := segment.HeadTime.Add(datum.Delta)
+			if window == 0 || t.Before(now.Add(-window)) {
+				continue
+			}
+			hash := sha256.Sum256(datum.Data)
+			if _, ok := d.dedup.seen(datum.TopicID, window, hash, t); !ok {
+				d.dedup.remember(datum.TopicID, hash, t, datum.Sequence)
+			}
+		}
+	}
+}
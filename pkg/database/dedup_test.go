@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDedupAppends(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "db")
+	config := Config{DedupWindows: map[string]time.Duration{"sensors": time.Hour, "/sensors/fast": time.Millisecond}}
+	db, err := NewDatabaseWithConfig("test", location, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, a := range []struct{ topic, data string }{
+		{"/sensors/a", "21.5"},
+		{"/sensors/a", "21.5"},
+		{"/sensors/a", "22.0"},
+		{"/sensors/b", "21.5"},
+		{"/other", "21.5"},
+		{"/other", "21.5"},
+	} {
+		if err = db.Append([]byte(a.data), a.topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := func(db *Database, topic string) int {
+		n := 0
+		for _, e := range db.Retrieve(Query{}) {
+			if e.Topic == topic {
+				n++
+			}
+		}
+		return n
+	}
+	for topic, expected := range map[string]int{"/sensors/a": 2, "/sensors/b": 1, "/other": 2} {
+		if n := count(db, topic); n != expected {
+			t.Errorf("expected %d entries in %s, got %d", expected, topic, n)
+		}
+	}
+	if duplicates := db.Stats().DuplicateAppends; duplicates != 1 {
+		t.Errorf("expected 1 duplicate append, got %d", duplicates)
+	}
+
+	// Payloads are forgotten once they're older than the window
+	for i := 0; i < 2; i++ {
+		if err = db.Append([]byte("1"), "/sensors/fast"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if n := count(db, "/sensors/fast"); n != 2 {
+		t.Errorf("expected appends outside of the window to be stored, got %d entries", n)
+	}
+
+	// Appends are remembered when the database is reopened
+	db, err = NewDatabaseWithConfig("test", location, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Append([]byte("22.0"), "/sensors/a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(db, "/sensors/a"); n != 2 {
+		t.Errorf("expected an append resent after reopening to be deduplicated, got %d entries", n)
+	}
+}
+
+func TestParseDedupWindows(t *testing.T) {
+	windows, err := ParseDedupWindows([]string{"/sensors=5m", "gateways/north/=1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]time.Duration{"/sensors": 5 * time.Minute, "/gateways/north": time.Hour}
+	if !reflect.DeepEqual(windows, expected) {
+		t.Errorf("expected %v, got %v", expected, windows)
+	}
+
+	for _, spec := range []string{"/sensors", "=5m", "/sensors=soon", "/sensors=-1m"} {
+		if _, err := ParseDedupWindows([]string{spec}); err == nil {
+			t.Errorf("expected %s not to parse", spec)
+		}
+	}
+}
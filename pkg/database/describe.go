@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"sort"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// TopicInfo describes a topic, and the data appended to it
+type TopicInfo struct {
+	Topic  string
+	Schema schema.Object
+	// ParentSchema is the schema inherited from the topic's closest parent
+	// with a non-string schema, or nil
+	ParentSchema schema.Object
+	// Override is set when the topic's schema overrides ParentSchema
+	Override bool
+	Codec    string
+	// Encoding is the encoding the topic's data is stored with on disk
+	Encoding string
+	// Count is the number of entries appended directly to the topic. Entries
+	// in sub-topics are not included, and rolled up entries count once per
+	// bucket.
+	Count int
+	First time.Time
+	Last  time.Time
+}
+
+// DescribeTopic returns information about topic, and false if it does not
+// exist. Its data is counted from a snapshot, so appends aren't held up, and
+// only the segments its data spans are read.
+func (d *Database) DescribeTopic(topic string) (TopicInfo, bool) {
+	topic = normalizeTopicName(topic)
+
+	d.topicLock.RLock()
+	index, exists := d.topics[topic]
+	var s schema.Object
+	if exists {
+		s = d.SchemaLookup[index]
+	}
+	d.topicLock.RUnlock()
+
+	if !exists {
+		return TopicInfo{}, false
+	}
+
+	info := TopicInfo{
+		Topic:    topic,
+		Schema:   s,
+		Codec:    d.CodecForTopic(topic),
+		Encoding: d.EncodingForTopic(topic),
+		Override: d.SchemaOverridden(topic),
+	}
+	if topic != "/" {
+		_, info.ParentSchema = d.parentSchemaTopic(topic)
+	}
+
+	d.queryLock.RLock()
+	defer d.queryLock.RUnlock()
+
+	snap := d.snapshot(Query{Topics: []string{topic}, OnlyTopics: true})
+	snap.eachDatum(func(t time.Time, datum *Datum) {
+		if datum.TopicID != index {
+			return
+		}
+
+		if info.Count == 0 {
+			info.First = t
+		}
+		info.Last = t
+		info.Count += 1
+	})
+
+	return info, true
+}
+
+// ListTopics returns information about every topic in the database, sorted
+// by name. ParentSchema is not filled in. Like DescribeTopic, data is counted
+// from a snapshot.
+func (d *Database) ListTopics() []TopicInfo {
+	d.topicLock.RLock()
+	infos := make([]TopicInfo, len(d.TopicLookup))
+	for index, topic := range d.TopicLookup {
+		infos[index] = TopicInfo{
+			Topic:  topic,
+			Schema: d.SchemaLookup[index],
+			Codec:  d.codecs[topic],
+		}
+	}
+	d.topicLock.RUnlock()
+
+	d.queryLock.RLock()
+	snap := d.snapshot(Query{})
+	snap.eachDatum(func(t time.Time, datum *Datum) {
+		if datum.TopicID >= len(infos) {
+			return
+		}
+		info := &infos[datum.TopicID]
+
+		if info.Count == 0 {
+			info.First = t
+		}
+		info.Last = t
+		info.Count += 1
+	})
+	d.queryLock.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Topic < infos[j].Topic
+	})
+	return infos
+}
@@ -0,0 +1,482 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// Topic encodings compress the data of a topic inside the segments it's
+// stored in on disk. Data is decoded when segments are read back in, so
+// queries never see encoded data.
+const (
+	// EncodingGorilla XORs each float32 or float64 value with the one before
+	// it, storing only the bits which changed, as described in Facebook's
+	// Gorilla paper
+	EncodingGorilla = "gorilla"
+	// EncodingDelta stores the delta of the delta between each integer value
+	// and the one before it
+	EncodingDelta = "delta"
+)
+
+// encodingTypes lists the schema types each encoding applies to
+var encodingTypes = map[string][]string{
+	EncodingGorilla: {"float32", "float64"},
+	EncodingDelta:   {"int8", "uint8", "int16", "uint16", "int32", "uint32", "int64", "uint64"},
+}
+
+// ErrUnknownEncoding is returned when setting an encoding which doesn't exist
+var ErrUnknownEncoding = errors.New("unknown encoding")
+
+// CheckEncoding returns an error unless encoding exists and applies to topics
+// with schema s. The empty string, meaning no encoding, applies to every
+// schema.
+func CheckEncoding(encoding string, s schema.Object) error {
+	if encoding == "" {
+		return nil
+	}
+
+	types, ok := encodingTypes[encoding]
+	if !ok {
+		return fmt.Errorf("%w '%s'", ErrUnknownEncoding, encoding)
+	}
+
+	if t, ok := s.(*schema.Type); ok {
+		for _, name := range types {
+			if t.Name == name {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("encoding %s only applies to topics with a schema of %s", encoding, strings.Join(types, ", "))
+}
+
+// Column is the encoded data of one topic in a segment on disk. The data of
+// the topic's datums is removed from the segment, and decoded from Block in
+// the order the datums appear in.
+type Column struct {
+	Encoding string
+	// Type is the schema type of each value
+	Type  string
+	Count int
+	Block []byte
+}
+
+// columnLayout is how the data of a topic is laid out in columns
+type columnLayout struct {
+	encoding string
+	typ      schema.Type
+}
+
+// encodeColumns returns a copy of s with the data of each topic in layouts
+// moved into an encoded column. Topics with any datum whose data isn't the
+// size of their type are left as they are.
+func encodeColumns(s *Segment, layouts map[int]columnLayout) Segment {
+	encoded := *s
+	if len(layouts) == 0 {
+		return encoded
+	}
+
+	values := make(map[int][][]byte)
+	for i := 0; i < s.Size; i++ {
+		datum := &s.Series[i]
+		layout, ok := layouts[datum.TopicID]
+		if !ok {
+			continue
+		}
+		if len(datum.Data) != layout.typ.Size() {
+			// Mark the topic as unencodable, so that it's left in place
+			values[datum.TopicID] = nil
+			layouts = withoutLayout(layouts, datum.TopicID)
+			continue
+		}
+		values[datum.TopicID] = append(values[datum.TopicID], datum.Data)
+	}
+
+	for id, v := range values {
+		if v == nil {
+			continue
+		}
+		layout := layouts[id]
+		if encoded.Columns == nil {
+			encoded.Columns = make(map[int]Column)
+		}
+		encoded.Columns[id] = Column{
+			Encoding: layout.encoding,
+			Type:     layout.typ.Name,
+			Count:    len(v),
+			Block:    encodeBlock(layout, v),
+		}
+	}
+
+	for i := 0; i < encoded.Size; i++ {
+		if _, ok := encoded.Columns[encoded.Series[i].TopicID]; ok {
+			encoded.Series[i].Data = nil
+		}
+	}
+	return encoded
+}
+
+// withoutLayout returns a copy of layouts without the layout of topic, so that
+// the caller's map isn't modified
+func withoutLayout(layouts map[int]columnLayout, topic int) map[int]columnLayout {
+	copied := make(map[int]columnLayout, len(layouts))
+	for id, layout := range layouts {
+		if id != topic {
+			copied[id] = layout
+		}
+	}
+	return copied
+}
+
+// decodeColumns restores the data of each datum stored in one of the
+// segment's columns, and drops the columns
+func (s *Segment) decodeColumns() error {
+	if len(s.Columns) == 0 {
+		s.Columns = nil
+		return nil
+	}
+
+	values := make(map[int][][]byte, len(s.Columns))
+	for id, column := range s.Columns {
+		v, err := decodeBlock(column)
+		if err != nil {
+			return fmt.Errorf("cannot decode column of topic %d: %w", id, err)
+		}
+		values[id] = v
+	}
+
+	for i := 0; i < s.Size; i++ {
+		datum := &s.Series[i]
+		v, ok := values[datum.TopicID]
+		if !ok {
+			continue
+		}
+		if len(v) == 0 {
+			return fmt.Errorf("column of topic %d has fewer values than the segment has datums", datum.TopicID)
+		}
+		datum.Data, values[datum.TopicID] = v[0], v[1:]
+	}
+
+	s.Columns = nil
+	return nil
+}
+
+func encodeBlock(layout columnLayout, values [][]byte) []byte {
+	w := bitWriter{}
+	width := layout.typ.Size() * 8
+	switch layout.encoding {
+	case EncodingGorilla:
+		encodeGorilla(&w, width, values)
+	case EncodingDelta:
+		encodeDelta(&w, width, signed(layout.typ.Name), values)
+	}
+	return w.bytes
+}
+
+func decodeBlock(c Column) ([][]byte, error) {
+	t := schema.Type{Name: c.Type}
+	if err := CheckEncoding(c.Encoding, &t); err != nil {
+		return nil, err
+	}
+
+	r := bitReader{bytes: c.Block}
+	width := t.Size() * 8
+	switch c.Encoding {
+	case EncodingGorilla:
+		return decodeGorilla(&r, width, c.Count)
+	default:
+		return decodeDelta(&r, width, signed(c.Type), c.Count)
+	}
+}
+
+func signed(typ string) bool {
+	return strings.HasPrefix(typ, "int")
+}
+
+// readValue reads a little-endian value of width bits from b
+func readValue(b []byte) uint64 {
+	var padded [8]byte
+	copy(padded[:], b)
+	return binary.LittleEndian.Uint64(padded[:])
+}
+
+// writeValue returns v as a little-endian value of width bits
+func writeValue(v uint64, width int) []byte {
+	return binary.LittleEndian.AppendUint64(nil, v)[:width/8]
+}
+
+//--
+//-- Gorilla float encoding
+//--
+
+func encodeGorilla(w *bitWriter, width int, values [][]byte) {
+	prev := readValue(values[0])
+	w.writeBits(prev, width)
+
+	// The leading and trailing zeros of the previous meaningful bits, which
+	// following values reuse if their meaningful bits fit inside them
+	prevLeading, prevTrailing := -1, 0
+	for _, value := range values[1:] {
+		v := readValue(value)
+		xor := v ^ prev
+		prev = v
+
+		if xor == 0 {
+			w.writeBit(false)
+			continue
+		}
+		w.writeBit(true)
+
+		leading := bits.LeadingZeros64(xor) - (64 - width)
+		trailing := bits.TrailingZeros64(xor)
+		// Leading zeros are written in 5 bits
+		if leading > 31 {
+			leading = 31
+		}
+
+		if prevLeading != -1 && leading >= prevLeading && trailing >= prevTrailing {
+			w.writeBit(false)
+			w.writeBits(xor>>prevTrailing, width-prevLeading-prevTrailing)
+			continue
+		}
+
+		meaningful := width - leading - trailing
+		w.writeBit(true)
+		w.writeBits(uint64(leading), 5)
+		w.writeBits(uint64(meaningful-1), 6)
+		w.writeBits(xor>>trailing, meaningful)
+		prevLeading, prevTrailing = leading, trailing
+	}
+}
+
+func decodeGorilla(r *bitReader, width int, count int) ([][]byte, error) {
+	values := make([][]byte, 0, count)
+	if count == 0 {
+		return values, nil
+	}
+
+	prev, err := r.readBits(width)
+	if err != nil {
+		return nil, err
+	}
+	values = append(values, writeValue(prev, width))
+
+	var leading, trailing int
+	for len(values) < count {
+		changed, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+
+		if changed {
+			window, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+
+			// A set bit starts a new window of meaningful bits, rather than
+			// reusing the previous one
+			if window {
+				l, err := r.readBits(5)
+				if err != nil {
+					return nil, err
+				}
+				m, err := r.readBits(6)
+				if err != nil {
+					return nil, err
+				}
+				leading = int(l)
+				trailing = width - leading - int(m) - 1
+				if trailing < 0 {
+					return nil, errors.New("malformed gorilla block")
+				}
+			}
+
+			xor, err := r.readBits(width - leading - trailing)
+			if err != nil {
+				return nil, err
+			}
+			prev ^= xor << trailing
+		}
+
+		values = append(values, writeValue(prev, width))
+	}
+
+	return values, nil
+}
+
+//--
+//-- Delta-of-delta integer encoding
+//--
+
+// deltaBuckets are the sizes of zigzag encoded deltas of deltas which have a
+// prefix of their own. Larger ones are written in full.
+var deltaBuckets = []int{7, 9, 12}
+
+func encodeDelta(w *bitWriter, width int, signed bool, values [][]byte) {
+	prev := extend(readValue(values[0]), width, signed)
+	w.writeBits(prev, width)
+
+	var prevDelta uint64
+	for _, value := range values[1:] {
+		v := extend(readValue(value), width, signed)
+		delta := v - prev
+		dod := zigzag(int64(delta - prevDelta))
+		prev, prevDelta = v, delta
+
+		if dod == 0 {
+			w.writeBit(false)
+			continue
+		}
+		w.writeBit(true)
+
+		size := 64
+		for _, s := range deltaBuckets {
+			if dod < 1<<s {
+				size = s
+				w.writeBit(false)
+				break
+			}
+			w.writeBit(true)
+		}
+		w.writeBits(dod, size)
+	}
+}
+
+func decodeDelta(r *bitReader, width int, signed bool, count int) ([][]byte, error) {
+	values := make([][]byte, 0, count)
+	if count == 0 {
+		return values, nil
+	}
+
+	prev, err := r.readBits(width)
+	if err != nil {
+		return nil, err
+	}
+	prev = extend(prev, width, signed)
+	values = append(values, writeValue(prev, width))
+
+	var prevDelta uint64
+	for len(values) < count {
+		var dod uint64
+		changed, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+
+		if changed {
+			// The number of set bits before the first clear one picks the
+			// size of the delta of deltas
+			size := 64
+			for _, s := range deltaBuckets {
+				larger, err := r.readBit()
+				if err != nil {
+					return nil, err
+				}
+				if !larger {
+					size = s
+					break
+				}
+			}
+
+			dod, err = r.readBits(size)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		prevDelta += uint64(unzigzag(dod))
+		prev += prevDelta
+		values = append(values, writeValue(prev, width))
+	}
+
+	return values, nil
+}
+
+// extend sign extends v from width bits if signed is set
+func extend(v uint64, width int, signed bool) uint64 {
+	if !signed || width == 64 {
+		return v
+	}
+	shift := 64 - width
+	return uint64(int64(v<<shift) >> shift)
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+//--
+//-- Bit streams
+//--
+
+type bitWriter struct {
+	bytes []byte
+	// used is the number of bits used in the last byte
+	used int
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.used == 0 || w.used == 8 {
+		w.bytes = append(w.bytes, 0)
+		w.used = 0
+	}
+	if bit {
+		w.bytes[len(w.bytes)-1] |= 0x80 >> w.used
+	}
+	w.used++
+}
+
+// writeBits writes the low n bits of v, most significant first
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(v&(1<<i) != 0)
+	}
+}
+
+type bitReader struct {
+	bytes []byte
+	// offset is the number of bits read
+	offset int
+}
+
+var errShortBlock = errors.New("block ended before all of its values were read")
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.offset >= len(r.bytes)*8 {
+		return false, errShortBlock
+	}
+	bit := r.bytes[r.offset/8]&(0x80>>(r.offset%8)) != 0
+	r.offset++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	var v uint64
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v <<= 1
+		if bit {
+			v |= 1
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// encodingSegment returns a segment holding values for topic 1, interleaved
+// with strings in topic 0
+func encodingSegment(values [][]byte) Segment {
+	s := Segment{}
+	for i, v := range values {
+		s.Append(&Datum{Delta: 0, TopicID: 1, Data: v})
+		if i%3 == 0 {
+			s.Append(&Datum{Delta: 0, TopicID: 0, Data: []byte("string")})
+		}
+	}
+	return s
+}
+
+func checkRoundTrip(t *testing.T, layout columnLayout, values [][]byte) Segment {
+	t.Helper()
+
+	s := encodingSegment(values)
+	encoded := encodeColumns(&s, map[int]columnLayout{1: layout})
+	if _, ok := encoded.Columns[1]; !ok {
+		t.Fatalf("expected topic to be encoded as %s", layout.encoding)
+	}
+
+	decoded := encoded
+	err := decoded.decodeColumns()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < s.Size; i++ {
+		if !bytes.Equal(s.Series[i].Data, decoded.Series[i].Data) {
+			t.Fatalf("datum %d: expected %v, got %v", i, s.Series[i].Data, decoded.Series[i].Data)
+		}
+	}
+	if decoded.Columns != nil {
+		t.Errorf("expected columns to be dropped once decoded")
+	}
+	return encoded
+}
+
+func TestGorillaEncoding(t *testing.T) {
+	layout := columnLayout{encoding: EncodingGorilla, typ: schema.Type{Name: "float64"}}
+
+	var smooth, random [][]byte
+	for i := 0; i < 1000; i++ {
+		smooth = append(smooth, binary.LittleEndian.AppendUint64(nil, math.Float64bits(20+math.Round(math.Sin(float64(i)/100)*10)/10)))
+		random = append(random, binary.LittleEndian.AppendUint64(nil, rand.Uint64()))
+	}
+	special := [][]byte{}
+	for _, f := range []float64{0, math.Inf(1), math.NaN(), -0.0, math.MaxFloat64, math.SmallestNonzeroFloat64, 1} {
+		special = append(special, binary.LittleEndian.AppendUint64(nil, math.Float64bits(f)))
+	}
+
+	encoded := checkRoundTrip(t, layout, smooth)
+	if size := len(encoded.Columns[1].Block); size*10 > len(smooth)*8 {
+		t.Errorf("expected a smooth signal to compress by an order of magnitude, got %d bytes", size)
+	}
+	checkRoundTrip(t, layout, random)
+	checkRoundTrip(t, layout, special)
+
+	var float32s [][]byte
+	for i := 0; i < 100; i++ {
+		float32s = append(float32s, binary.LittleEndian.AppendUint32(nil, math.Float32bits(float32(i%7)*1.5)))
+	}
+	checkRoundTrip(t, columnLayout{encoding: EncodingGorilla, typ: schema.Type{Name: "float32"}}, float32s)
+}
+
+func TestDeltaEncoding(t *testing.T) {
+	var counter, random [][]byte
+	for i := 0; i < 1000; i++ {
+		counter = append(counter, binary.LittleEndian.AppendUint64(nil, uint64(1_000_000+i*15)))
+		random = append(random, binary.LittleEndian.AppendUint64(nil, rand.Uint64()))
+	}
+
+	layout := columnLayout{encoding: EncodingDelta, typ: schema.Type{Name: "int64"}}
+	encoded := checkRoundTrip(t, layout, counter)
+	if size := len(encoded.Columns[1].Block); size*10 > len(counter)*8 {
+		t.Errorf("expected a counter to compress by an order of magnitude, got %d bytes", size)
+	}
+	checkRoundTrip(t, layout, random)
+	checkRoundTrip(t, columnLayout{encoding: EncodingDelta, typ: schema.Type{Name: "uint64"}}, random)
+
+	// Narrow types wrap around, and signed ones are sign extended
+	for _, name := range []string{"int8", "uint8", "int16", "uint16", "int32", "uint32"} {
+		typ := schema.Type{Name: name}
+		var values [][]byte
+		for _, v := range []int64{0, -1, 1, -128, 127, 255, -32768, 65535, math.MinInt32, math.MaxUint32, 3, 3, 3} {
+			values = append(values, binary.LittleEndian.AppendUint64(nil, uint64(v))[:typ.Size()])
+		}
+		checkRoundTrip(t, columnLayout{encoding: EncodingDelta, typ: typ}, values)
+	}
+}
+
+func TestEncodingSkipsMismatchedData(t *testing.T) {
+	s := encodingSegment([][]byte{{1, 0, 0, 0}, {1, 0}})
+	encoded := encodeColumns(&s, map[int]columnLayout{1: {encoding: EncodingDelta, typ: schema.Type{Name: "int32"}}})
+	if len(encoded.Columns) != 0 {
+		t.Errorf("expected topic with data of the wrong size not to be encoded")
+	}
+	if !bytes.Equal(encoded.Series[0].Data, []byte{1, 0, 0, 0}) {
+		t.Errorf("expected data to be left in place, got %v", encoded.Series[0].Data)
+	}
+}
+
+func TestCheckEncoding(t *testing.T) {
+	cases := []struct {
+		encoding string
+		schema   schema.Object
+		ok       bool
+	}{
+		{"", &schema.Type{Name: "string"}, true},
+		{EncodingGorilla, &schema.Type{Name: "float64"}, true},
+		{EncodingGorilla, &schema.Type{Name: "int64"}, false},
+		{EncodingDelta, &schema.Type{Name: "uint16"}, true},
+		{EncodingDelta, &schema.Type{Name: "boolean"}, false},
+		{EncodingDelta, &schema.Array{Length: 2, Type: schema.Type{Name: "int32"}}, false},
+		{"zstd", &schema.Type{Name: "int32"}, false},
+	}
+
+	for _, c := range cases {
+		if err := CheckEncoding(c.encoding, c.schema); (err == nil) != c.ok {
+			t.Errorf("CheckEncoding(%q, %s): unexpected error %v", c.encoding, c.schema.ToSchema(), err)
+		}
+	}
+}
@@ -23,10 +23,19 @@ const (
 	actionAddEvent = 1 << iota
 	actionAddSegment
 	actionAddTopic
+	actionSetTopicCodec
+	actionAddSchema
+	actionOverrideSchema
+	actionAddTemplate
+	actionSetTopicEncoding
+	// Spooled appends are only written to a Spool, never to a database's log
+	actionSpoolAppend
+	actionSpoolRemove
 )
 
 type WriteAheadLog struct {
 	LogPath string
+	Sync    bool // Flush each action to stable storage before returning
 }
 
 func (w *WriteAheadLog) ApplyToDB(d *Database) {
@@ -42,15 +51,24 @@ func (w *WriteAheadLog) ApplyToDB(d *Database) {
 		// In order to make the most of the good data that we have, we simply discard anything
 		// that looks erroneous.
 		// FIXME: Add logging to indicate we have corrupted sections of the write-ahead log.
-		action := strings.Split(scanner.Text(), ";")
-		actionType, err := strconv.Atoi(action[0])
+		line := scanner.Text()
+		actionType, payload, sequence, err := parseAction(line)
 		if err != nil {
 			continue
 		}
-		valueBytes, err := base64.StdEncoding.DecodeString(action[1])
+		valueBytes, err := base64.StdEncoding.DecodeString(payload)
 		if err != nil {
 			continue
 		}
+
+		// Actions written by older versions of fossil do not carry a sequence
+		// number, and are always applied. Otherwise, we skip any action the
+		// database has already seen, which happens when we crash after
+		// serializing, but before the write-ahead log is removed.
+		if sequence > 0 && sequence <= d.Sequence {
+			continue
+		}
+
 		dec := gob.NewDecoder(bytes.NewBuffer(valueBytes))
 
 		switch actionType {
@@ -60,6 +78,11 @@ func (w *WriteAheadLog) ApplyToDB(d *Database) {
 			if err != nil {
 				continue
 			}
+			// Data logged before it carried a sequence number takes the one
+			// it was logged with
+			if datum.Sequence == 0 {
+				datum.Sequence = sequence
+			}
 			d.appendInternal(&datum)
 		case actionAddSegment:
 			var segment Segment
@@ -67,10 +90,7 @@ func (w *WriteAheadLog) ApplyToDB(d *Database) {
 			if err != nil {
 				continue
 			}
-			if len(d.Segments) > 0 {
-				d.Current += 1
-			}
-			d.Segments = append(d.Segments, segment)
+			d.addSegmentInternal(segment.HeadTime)
 		case actionAddTopic:
 			var topic string
 			err := dec.Decode(&topic)
@@ -92,68 +112,178 @@ func (w *WriteAheadLog) ApplyToDB(d *Database) {
 			} else {
 				d.addTopicInternal(pieces[0], pieces[1])
 			}
+		case actionSetTopicCodec:
+			var topicCodec string
+			err := dec.Decode(&topicCodec)
+			if err != nil {
+				continue
+			}
+			idx := strings.LastIndex(topicCodec, ":")
+			if idx == -1 {
+				continue
+			}
+			d.setTopicCodecInternal(topicCodec[:idx], topicCodec[idx+1:])
+		case actionAddSchema:
+			var namedSchema string
+			err := dec.Decode(&namedSchema)
+			if err != nil {
+				continue
+			}
+			// Names can't contain a ':', but schemas can
+			idx := strings.Index(namedSchema, ":")
+			if idx == -1 {
+				continue
+			}
+			d.addSchemaInternal(namedSchema[:idx], namedSchema[idx+1:])
+		case actionAddTemplate:
+			var template TopicTemplate
+			err := dec.Decode(&template)
+			if err != nil {
+				continue
+			}
+			d.addTemplateInternal(template)
+		case actionOverrideSchema:
+			var topic string
+			err := dec.Decode(&topic)
+			if err != nil {
+				continue
+			}
+			d.setSchemaOverrideInternal(topic)
+		case actionSetTopicEncoding:
+			var topicEncoding string
+			err := dec.Decode(&topicEncoding)
+			if err != nil {
+				continue
+			}
+			idx := strings.LastIndex(topicEncoding, ":")
+			if idx == -1 {
+				continue
+			}
+			d.setTopicEncodingInternal(topicEncoding[:idx], topicEncoding[idx+1:])
+		default:
+			continue
+		}
+
+		if sequence > 0 {
+			d.Sequence = sequence
+			d.changes.add([]byte(line))
 		}
 	}
 }
 
-func (w *WriteAheadLog) AddEvent(d *Datum) {
-	var encoded bytes.Buffer
-
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(d)
-	if err != nil {
-		log.Fatal("encode:", err)
+// parseAction splits a line of the write-ahead log into its action type, its
+// base64 encoded payload, and its sequence number, which is 0 for actions
+// written by older versions of fossil
+func parseAction(line string) (int, string, uint64, error) {
+	action := strings.Split(line, ";")
+	if len(action) < 2 {
+		return 0, "", 0, fmt.Errorf("malformed action '%s'", line)
 	}
-
-	file, err := os.OpenFile(w.LogPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	actionType, err := strconv.Atoi(action[0])
 	if err != nil {
-		log.Fatal(err)
+		return 0, "", 0, err
 	}
-	defer file.Close()
 
-	_, err = file.WriteString(fmt.Sprintf("%d;%s\n", actionAddEvent, base64.StdEncoding.EncodeToString(encoded.Bytes())))
-	if err != nil {
-		log.Fatal(err)
+	var sequence uint64
+	if len(action) > 2 {
+		sequence, err = strconv.ParseUint(strings.TrimSpace(action[2]), 10, 64)
+		if err != nil {
+			return 0, "", 0, err
+		}
 	}
+	return actionType, action[1], sequence, nil
 }
 
-func (w *WriteAheadLog) AddSegment(t time.Time) {
+// encodeAction encodes v as a line of the write-ahead log
+func encodeAction(action int, v any, sequence uint64) []byte {
 	var encoded bytes.Buffer
 
 	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(t)
+	err := enc.Encode(v)
 	if err != nil {
 		log.Fatal("encode:", err)
 	}
 
-	file, err := os.OpenFile(w.LogPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
+	return []byte(fmt.Sprintf("%d;%s;%d\n", action, base64.StdEncoding.EncodeToString(encoded.Bytes()), sequence))
+}
 
-	_, err = file.WriteString(fmt.Sprintf("%d;%s\n", actionAddSegment, base64.StdEncoding.EncodeToString(encoded.Bytes())))
-	if err != nil {
-		log.Fatal(err)
-	}
+func encodeAddEvent(d *Datum, sequence uint64) []byte {
+	return encodeAction(actionAddEvent, d, sequence)
 }
 
-func (w *WriteAheadLog) AddTopic(t string, s string) {
-	var encoded bytes.Buffer
+func encodeAddSegment(t time.Time, sequence uint64) []byte {
+	return encodeAction(actionAddSegment, t, sequence)
+}
 
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(fmt.Sprintf("%s:%s", t, s))
-	if err != nil {
-		log.Fatal("encode:", err)
-	}
+func encodeAddTopic(t string, s string, sequence uint64) []byte {
+	return encodeAction(actionAddTopic, fmt.Sprintf("%s:%s", t, s), sequence)
+}
+
+func encodeSetTopicCodec(t string, codec string, sequence uint64) []byte {
+	return encodeAction(actionSetTopicCodec, fmt.Sprintf("%s:%s", t, codec), sequence)
+}
+
+func encodeSetTopicEncoding(t string, encoding string, sequence uint64) []byte {
+	return encodeAction(actionSetTopicEncoding, fmt.Sprintf("%s:%s", t, encoding), sequence)
+}
+
+func encodeAddSchema(name string, s string, sequence uint64) []byte {
+	return encodeAction(actionAddSchema, fmt.Sprintf("%s:%s", name, s), sequence)
+}
 
+func encodeAddTemplate(t TopicTemplate, sequence uint64) []byte {
+	return encodeAction(actionAddTemplate, t, sequence)
+}
+
+func encodeOverrideSchema(t string, sequence uint64) []byte {
+	return encodeAction(actionOverrideSchema, t, sequence)
+}
+
+func (w *WriteAheadLog) AddEvent(d *Datum, sequence uint64) {
+	w.mustWrite(encodeAddEvent(d, sequence))
+}
+
+func (w *WriteAheadLog) AddSegment(t time.Time, sequence uint64) {
+	w.mustWrite(encodeAddSegment(t, sequence))
+}
+
+func (w *WriteAheadLog) AddTopic(t string, s string, sequence uint64) {
+	w.mustWrite(encodeAddTopic(t, s, sequence))
+}
+
+func (w *WriteAheadLog) SetTopicCodec(t string, codec string, sequence uint64) {
+	w.mustWrite(encodeSetTopicCodec(t, codec, sequence))
+}
+
+func (w *WriteAheadLog) AddSchema(name string, s string, sequence uint64) {
+	w.mustWrite(encodeAddSchema(name, s, sequence))
+}
+
+func (w *WriteAheadLog) AddTemplate(t TopicTemplate, sequence uint64) {
+	w.mustWrite(encodeAddTemplate(t, sequence))
+}
+
+// write appends encoded actions to the log, syncing it if configured to
+func (w *WriteAheadLog) write(actions []byte) error {
 	file, err := os.OpenFile(w.LogPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer file.Close()
 
-	_, err = file.WriteString(fmt.Sprintf("%d;%s\n", actionAddTopic, base64.StdEncoding.EncodeToString(encoded.Bytes())))
+	_, err = file.Write(actions)
+	if err != nil {
+		return err
+	}
+
+	if w.Sync {
+		return file.Sync()
+	}
+	return nil
+}
+
+func (w *WriteAheadLog) mustWrite(actions []byte) {
+	err := w.write(actions)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+)
+
+// ErrCorruptFile is returned when a database file fails validation on load,
+// for example because it was only partly written
+var ErrCorruptFile = errors.New("corrupted database file")
+
+// Compressed metadata files, such as topics and schemas, start with a header
+// so that corruption is caught when they're loaded:
+//
+//	magic    4 bytes, "FSLM"
+//	version  uint32
+//	checksum uint32, the IEEE CRC-32 of the compressed contents which follow
+//
+// Files written before the header was added are plain zlib streams.
+var metadataFileMagic = []byte("FSLM")
+
+const metadataFileVersion = 1
+
+const metadataFileHeaderSize = 12
+
+// encodeMetadataFile compresses data, and prepends a metadata file header
+func encodeMetadataFile(data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 0, metadataFileHeaderSize+compressed.Len())
+	b = append(b, metadataFileMagic...)
+	b = binary.LittleEndian.AppendUint32(b, metadataFileVersion)
+	b = binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(compressed.Bytes()))
+	return append(b, compressed.Bytes()...), nil
+}
+
+// decodeMetadataFile validates the contents of the metadata file name, and
+// returns them decompressed
+func decodeMetadataFile(name string, contents []byte) ([]byte, error) {
+	if bytes.HasPrefix(contents, metadataFileMagic) {
+		if len(contents) < metadataFileHeaderSize {
+			return nil, fmt.Errorf("%w %s: truncated header", ErrCorruptFile, name)
+		}
+
+		version := binary.LittleEndian.Uint32(contents[4:])
+		if version > metadataFileVersion {
+			return nil, fmt.Errorf("cannot read %s, its version (%d) is greater than our version (%d)", name, version, metadataFileVersion)
+		}
+
+		checksum := binary.LittleEndian.Uint32(contents[8:])
+		contents = contents[metadataFileHeaderSize:]
+		if crc32.ChecksumIEEE(contents) != checksum {
+			return nil, fmt.Errorf("%w %s: checksum mismatch", ErrCorruptFile, name)
+		}
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrCorruptFile, name, err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrCorruptFile, name, err)
+	}
+	return data, nil
+}
+
+// lostMetadataFile returns whether err, from reading a metadata file, means
+// the file is missing or corrupt, so that its contents can only be recovered.
+// A nil error means the file is intact.
+func lostMetadataFile(err error) bool {
+	return err == nil || errors.Is(err, ErrCorruptFile) || errors.Is(err, fs.ErrNotExist)
+}
+
+// recoverTopics rebuilds the topic names or schemas which couldn't be read,
+// for every topic ID found in the database's segments. Names are replaced by
+// /recovered/<id>, and schemas by string, which any data is displayed as.
+//
+// Topics which were never appended to can't be found in segment data, so
+// unless one of the files is intact, topics created after the last of these
+// may be recovered with IDs already in use. Recovered databases should be
+// checked before they're appended to.
+func (db *Database) recoverTopics(topics []string, schemas []string, lostTopics, lostSchemas bool) ([]string, []string) {
+	count := 1
+	if !lostTopics {
+		count = len(topics)
+	}
+	if !lostSchemas && len(schemas) > count {
+		count = len(schemas)
+	}
+	for _, segments := range [][]Segment{db.rollups.Segments, db.Segments} {
+		for i := range segments {
+			for _, datum := range segments[i].Series[:segments[i].Size] {
+				if datum.TopicID >= count {
+					count = datum.TopicID + 1
+				}
+			}
+		}
+	}
+
+	if lostTopics {
+		topics = nil
+	}
+	if lostSchemas {
+		schemas = nil
+	}
+	for id := len(topics); id < count; id++ {
+		topic := "/"
+		if id > 0 {
+			topic = fmt.Sprintf("/recovered/%d", id)
+		}
+		topics = append(topics, topic)
+	}
+	for id := len(schemas); id < count; id++ {
+		schemas = append(schemas, "string")
+	}
+
+	return topics, schemas
+}
@@ -11,11 +11,19 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
 	"time"
 )
 
+// ErrMigrationNeeded is returned when opening a database whose on-disk version
+// is older than FossilDBVersion, if Config.ManualMigrations is set
+var ErrMigrationNeeded = errors.New("database needs to be migrated")
+
 // deserializeFunc reads in a database of a specific version, and returns a
 // versioned database object
 type deserializeFunc func(string) (any, error)
@@ -30,16 +38,27 @@ type cleanupFunc func(string) error
 var deserializationFunctions = []deserializeFunc{
 	nil,
 	deserializeV1,
+	deserializeV2,
 }
 
 var migrationFunctions = []migrationFunc{
 	nil,
 	migrateV1ToV2,
+	migrateV2ToV3,
 }
 
 var cleanupFunctions = []cleanupFunc{
 	nil,
 	cleanupV1,
+	nil,
+}
+
+// migrationDescriptions describe what each migration function changes, for
+// dry runs
+var migrationDescriptions = []string{
+	"",
+	"split the database file into metadata, topics, schemas and segment files, giving every topic a string schema",
+	"apply the write-ahead log, and record its sequence number in metadata",
 }
 
 //--
@@ -110,6 +129,45 @@ func cleanupV1(p string) error {
 	return nil
 }
 
+//--
+//-- Database Version 2 migration handlers
+//--
+
+// deserializeV2 reads in a version 2 database, along with its write-ahead log.
+// Version 2 write-ahead logs do not have sequence numbers, so they must be
+// fully applied before we serialize out a version 3 database.
+func deserializeV2(p string) (any, error) {
+	db := Database{
+		Path:   p,
+		topics: make(map[string]int),
+	}
+
+	err := db.deserializeInternal()
+	if err != nil {
+		return nil, err
+	}
+
+	wal := db.writeAheadLog()
+	wal.ApplyToDB(&db)
+
+	return &db, nil
+}
+
+func migrateV2ToV3(db any) (any, error) {
+	// Assert that from is a v2 database
+	from, ok := db.(*Database)
+	if !ok || from.Version != 2 {
+		return nil, errors.New("attempted migration from a non v2 database")
+	}
+
+	// The only change in version 3 is the addition of a sequence number to
+	// our metadata, which starts out at 0.
+	from.Version = 3
+	from.Sequence = 0
+
+	return from, nil
+}
+
 // The detectVersion function is responsible for detecting the version for a given
 // on-disk database. Starting with version 2, the version will always be stored as
 // the first 4 bytes of the database's metadata file. We special case version 1
@@ -163,7 +221,95 @@ func migrationIsNeeded(p string) bool {
 	return false
 }
 
-// MigrateDatabaseIfNeeded has all the logic necessary to migrate from
+// MigrationPlan describes the migration of a database to FossilDBVersion
+type MigrationPlan struct {
+	Path string
+	// From is the on-disk version of the database, and To the version it's
+	// migrated to. They're equal if no migration is needed.
+	From uint32
+	To   uint32
+	// Steps describe each migration the database goes through
+	Steps []string
+	// Backup is the directory the database's files are copied to before
+	// they're migrated, or empty if they aren't backed up
+	Backup string
+	// Topics and Segments count what the migrated database holds
+	Topics   int
+	Segments int
+}
+
+// Needed returns whether the database needs to be migrated
+func (m MigrationPlan) Needed() bool {
+	return m.From != m.To
+}
+
+// MigrateOptions configures MigrateDatabase
+type MigrateOptions struct {
+	// DryRun migrates the database in memory, to check that it can be, but
+	// doesn't write anything
+	DryRun bool
+	// NoBackup skips copying the database's files before migrating them
+	NoBackup bool
+}
+
+// backupPath returns the directory the files of the version v database at p
+// are backed up to before being migrated
+func backupPath(p string, v uint32, now time.Time) string {
+	return fmt.Sprintf("%s.v%d-backup-%s", filepath.Clean(p), v, now.UTC().Format("20060102T150405Z"))
+}
+
+// backupDatabase copies every file beneath p into backup, which must not
+// already exist
+func backupDatabase(p, backup string) error {
+	if err := os.Mkdir(backup, 0700); err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(p, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(p, name)
+		if err != nil || rel == "." {
+			return err
+		}
+		if entry.IsDir() {
+			return os.Mkdir(filepath.Join(backup, rel), 0700)
+		}
+		return copyFile(name, filepath.Join(backup, rel))
+	})
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err = dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// MigrateDatabaseIfNeeded migrates the database at p to FossilDBVersion, if
+// it's older, backing up its files first. See MigrateDatabase.
+func MigrateDatabaseIfNeeded(p string) error {
+	_, err := MigrateDatabase(p, MigrateOptions{})
+	return err
+}
+
+// MigrateDatabase has all the logic necessary to migrate from
 // an old database through an arbitrary number of versions to the current
 // database version. It does this through use of 3 types of handler functions:
 //
@@ -177,41 +323,66 @@ func migrationIsNeeded(p string) bool {
 //
 //   - A cleanup function, specific to a source DB version. This function
 //     is responsible for cleaning up any un-needed files after migration.
-func MigrateDatabaseIfNeeded(p string) error {
+//
+// Unless opts.NoBackup is set, the database's files are copied to a sibling
+// directory of p before anything is written, so that a migration which goes
+// wrong can be undone by hand. The returned plan describes the migration,
+// which a dry run only carries out in memory.
+func MigrateDatabase(p string, opts MigrateOptions) (MigrationPlan, error) {
+	plan := MigrationPlan{Path: p, From: FossilDBVersion, To: FossilDBVersion}
 	if !migrationIsNeeded(p) {
-		return nil
+		return plan, nil
 	}
 
 	dbVersion := detectVersion(p)
+	plan.From = dbVersion
+	if !opts.NoBackup {
+		plan.Backup = backupPath(p, dbVersion, time.Now())
+	}
 
 	// First deserialize the old database
 	db, err := deserializationFunctions[dbVersion](p)
 	if err != nil {
-		return err
+		return plan, err
 	}
 
 	// Now, migrate the database struct
-	for _, m := range migrationFunctions[dbVersion:] {
+	for i, m := range migrationFunctions[dbVersion:] {
 		if m == nil {
 			continue
 		}
 
 		db, err = m(db)
 		if err != nil {
-			return err
+			return plan, err
 		}
+		from := dbVersion + uint32(i)
+		plan.Steps = append(plan.Steps, fmt.Sprintf("v%d to v%d: %s", from, from+1, migrationDescriptions[from]))
 	}
 
 	// We must have a Database struct at the end of the migration
 	modernDB, ok := db.(*Database)
 	if !ok {
-		return errors.New("expected a Database at the end of migration")
+		return plan, errors.New("expected a Database at the end of migration")
+	}
+	plan.Topics = len(modernDB.TopicLookup)
+	plan.Segments = len(modernDB.Segments)
+
+	if opts.DryRun {
+		return plan, nil
+	}
+
+	if plan.Backup != "" {
+		err = backupDatabase(p, plan.Backup)
+		if err != nil {
+			return plan, fmt.Errorf("unable to back up database before migrating it: %w", err)
+		}
 	}
 
 	// Serialize the migrated DB to disk
 	err = modernDB.serializeInternal()
 	if err != nil {
-		return err
+		return plan, err
 	}
 
 	// Now, perform cleanup
@@ -219,9 +390,9 @@ func MigrateDatabaseIfNeeded(p string) error {
 	if cleanup != nil {
 		err = cleanup(p)
 		if err != nil {
-			return err
+			return plan, err
 		}
 	}
 
-	return nil
+	return plan, nil
 }
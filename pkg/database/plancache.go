@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultPlanCacheSize is the number of query plans a database keeps around
+// when Config.PlanCacheSize is 0
+const DefaultPlanCacheSize = 256
+
+type planCacheEntry struct {
+	key        string
+	generation uint64
+	plan       any
+}
+
+// planCache is a least recently used cache of query plans, keyed by the query
+// string and the generation of the database's topics the plan was made
+// against. The zero value is an empty cache holding up to
+// DefaultPlanCacheSize plans.
+type planCache struct {
+	capacity int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   list.List
+}
+
+// get returns the plan cached for key, unless it was made against an older
+// generation than generation, in which case it's dropped
+func (c *planCache) get(key string, generation uint64) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*planCacheEntry)
+	if entry.generation != generation {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return entry.plan, true
+}
+
+func (c *planCache) add(key string, generation uint64, plan any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*planCacheEntry)
+		entry.generation, entry.plan = generation, plan
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&planCacheEntry{key, generation, plan})
+
+	capacity := c.capacity
+	if capacity <= 0 {
+		capacity = DefaultPlanCacheSize
+	}
+	for c.order.Len() > capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*planCacheEntry).key)
+	}
+}
+
+func (c *planCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// Generation counts changes to the database's topics and their schemas, so
+// that anything derived from them, such as a type checked query, can tell
+// when it's out of date
+func (d *Database) Generation() uint64 {
+	return d.generation.Load()
+}
+
+// CachedPlan returns the plan cached for query by CachePlan, unless topics
+// have changed since it was made. Plans are opaque to the database.
+func (d *Database) CachedPlan(query string) (any, bool) {
+	plan, ok := d.plans.get(query, d.Generation())
+	if ok {
+		d.counters.planCacheHits.Add(1)
+	} else {
+		d.counters.planCacheMisses.Add(1)
+	}
+	return plan, ok
+}
+
+// CachePlan caches plan for query, which was made when the database was at
+// generation. Plans must not be modified once they're cached, since they're
+// shared by every query which uses them.
+func (d *Database) CachePlan(query string, generation uint64, plan any) {
+	d.plans.add(query, generation, plan)
+}
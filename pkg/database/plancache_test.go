@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPlanCacheEviction(t *testing.T) {
+	c := planCache{capacity: 2}
+
+	c.add("all in /a", 0, "a")
+	c.add("all in /b", 0, "b")
+
+	// Using /a makes /b the least recently used
+	if _, ok := c.get("all in /a", 0); !ok {
+		t.Fatal("expected all in /a to be cached")
+	}
+	c.add("all in /c", 0, "c")
+
+	if c.len() != 2 {
+		t.Errorf("expected the cache to hold 2 plans, got %d", c.len())
+	}
+	if _, ok := c.get("all in /b", 0); ok {
+		t.Error("expected all in /b to be evicted")
+	}
+	for _, key := range []string{"all in /a", "all in /c"} {
+		if _, ok := c.get(key, 0); !ok {
+			t.Errorf("expected %s to be cached", key)
+		}
+	}
+}
+
+func TestPlanCacheDefaultCapacity(t *testing.T) {
+	var c planCache
+
+	for i := 0; i < DefaultPlanCacheSize+10; i++ {
+		c.add(fmt.Sprintf("all in /%d", i), 0, i)
+	}
+
+	if c.len() != DefaultPlanCacheSize {
+		t.Errorf("expected the cache to hold %d plans, got %d", DefaultPlanCacheSize, c.len())
+	}
+}
+
+func TestPlanCacheGeneration(t *testing.T) {
+	db, err := NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.CachePlan("all", db.Generation(), "plan")
+	if plan, ok := db.CachedPlan("all"); !ok || plan != "plan" {
+		t.Fatalf("expected the plan to be cached, got %v", plan)
+	}
+
+	// Adding a topic may change how queries type check
+	if _, err = db.CreateTopic("/numbers", "int64", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.CachedPlan("all"); ok {
+		t.Error("expected the plan to be invalidated by a new topic")
+	}
+
+	stats := db.Stats()
+	if stats.PlanCacheHits != 1 || stats.PlanCacheMisses != 1 {
+		t.Errorf("expected 1 hit and 1 miss, got %d and %d", stats.PlanCacheHits, stats.PlanCacheMisses)
+	}
+}
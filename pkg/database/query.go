@@ -21,7 +21,10 @@ type TimeRange struct {
 //   - Data Predicate (TODO!)
 type Query struct {
 	Quantifier     string
-	Topics         []string
+	Topics         []string   // Without a range, only data spanned by these is scanned
 	Range          *TimeRange // nil means entire history (no time range)
 	RangeSemantics string     // none, before, since, between
+	// OnlyTopics leaves out the entries of every topic but Topics, which are
+	// otherwise returned along with them
+	OnlyTopics bool
 }
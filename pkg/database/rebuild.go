@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RebuildPlan describes the rebuilding of a database's topics and schemas
+// files from its segments
+type RebuildPlan struct {
+	Path string
+	// LostTopics and LostSchemas are set if the topics or schemas file is
+	// missing or corrupt. Nothing is rebuilt unless one of them is.
+	LostTopics  bool
+	LostSchemas bool
+	// Topics counts the topics of the rebuilt database, of which Recovered
+	// are named /recovered/<id> since their names were lost
+	Topics    int
+	Recovered int
+	// Backup is the directory the database's files are copied to before
+	// they're rewritten, or empty if they aren't backed up
+	Backup string
+}
+
+// Needed returns whether the database's topics or schemas need rebuilding
+func (r RebuildPlan) Needed() bool {
+	return r.LostTopics || r.LostSchemas
+}
+
+// RebuildOptions configures RebuildIndex
+type RebuildOptions struct {
+	// DryRun rebuilds the topics and schemas in memory, to check that they
+	// can be, but doesn't write anything
+	DryRun bool
+	// NoBackup skips copying the database's files before rewriting them
+	NoBackup bool
+}
+
+// RebuildIndex rebuilds the topics and schemas files of the database at p,
+// if either is missing or corrupt, from the topic IDs found in its segments
+// and write-ahead log, the same way Config.RecoverTopics does when a database
+// is opened. The rebuilt files are then written out, so that the database
+// opens normally afterwards.
+//
+// Like MigrateDatabase, the database's files are copied to a sibling
+// directory of p before anything is written, unless opts.NoBackup is set. It
+// must not be run while the database is open.
+func RebuildIndex(p string, opts RebuildOptions) (RebuildPlan, error) {
+	plan := RebuildPlan{Path: p}
+
+	if _, err := os.Stat(filepath.Join(p, "metadata")); err != nil {
+		return plan, fmt.Errorf("no database metadata found in %s: %w", p, err)
+	}
+	if version := detectVersion(p); version != FossilDBVersion {
+		return plan, fmt.Errorf("%w: %s is version %d, but the current version is %d", ErrMigrationNeeded, p, version, FossilDBVersion)
+	}
+
+	db := Database{
+		Path:   p,
+		topics: make(map[string]int),
+		config: Config{RecoverTopics: true},
+	}
+
+	var err error
+	for _, file := range []struct {
+		name string
+		lost *bool
+	}{{"topics", &plan.LostTopics}, {"schemas", &plan.LostSchemas}} {
+		var contents []any
+		err = db.readRequiredCompressedJSON(file.name, &contents)
+		if !lostMetadataFile(err) {
+			return plan, err
+		}
+		*file.lost = err != nil
+	}
+	if !plan.Needed() {
+		return plan, nil
+	}
+
+	err = db.deserializeInternal()
+	if err != nil {
+		return plan, err
+	}
+	db.applyLogs()
+
+	plan.Topics = len(db.TopicLookup)
+	for _, topic := range db.TopicLookup {
+		if strings.HasPrefix(topic, "/recovered/") {
+			plan.Recovered++
+		}
+	}
+
+	if opts.DryRun {
+		return plan, nil
+	}
+
+	if !opts.NoBackup {
+		plan.Backup = backupPath(p, FossilDBVersion, time.Now())
+		err = backupDatabase(p, plan.Backup)
+		if err != nil {
+			return plan, fmt.Errorf("unable to back up database before rebuilding it: %w", err)
+		}
+	}
+
+	return plan, db.serializeInternal()
+}
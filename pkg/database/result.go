@@ -26,17 +26,58 @@ type Entry struct {
 	Topic  string    `json:"topic"`
 	Schema string    `json:"schema"`
 	Data   []byte    `json:"data"`
+	// Sequence is the sequence number of the datum the entry was read from,
+	// which totally orders the entries of a database, even those whose times
+	// are equal. Entries transformed by a query keep the sequence number of
+	// the datum they came from.
+	Sequence uint64 `json:"sequence,omitempty"`
 }
 
+// EntryFormat is a textual encoding of an Entry, as tab separated fields
+type EntryFormat int
+
+const (
+	// EntryFormatEscaped escapes backslashes, tabs and line breaks within each
+	// field, so that any topic or schema survives a round trip
+	EntryFormatEscaped EntryFormat = iota
+	// EntryFormatLegacy is the unescaped encoding used by older versions of
+	// fossil. Entries whose topic or schema contain a tab don't survive a
+	// round trip, so it should only be used to exchange entries with them.
+	EntryFormatLegacy
+)
+
+var (
+	entryEscaper   = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+	entryUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\r`, "\r")
+)
+
+// ToString encodes e with EntryFormatEscaped
 func (e *Entry) ToString() string {
-	return fmt.Sprintf("%s\t%s\t%s\t%s", e.Time.Format(time.RFC3339Nano), e.Topic, base64.StdEncoding.EncodeToString(e.Data), e.Schema)
+	return e.Format(EntryFormatEscaped)
+}
+
+// Format encodes e as its time, topic, base64 encoded data and schema,
+// separated by tabs
+func (e *Entry) Format(f EntryFormat) string {
+	topic, schema := e.Topic, e.Schema
+	if f == EntryFormatEscaped {
+		topic, schema = entryEscaper.Replace(topic), entryEscaper.Replace(schema)
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s", e.Time.Format(time.RFC3339Nano), topic, base64.StdEncoding.EncodeToString(e.Data), schema)
 }
 
+// ParseEntry decodes an entry encoded by ToString
 func ParseEntry(s string) (Entry, error) {
+	return ParseEntryFormat(s, EntryFormatEscaped)
+}
+
+// ParseEntryFormat decodes an entry encoded with f. The schema may be left
+// out.
+func ParseEntryFormat(s string, f EntryFormat) (Entry, error) {
 	ent := Entry{}
 	parts := strings.Split(s, "\t")
-	if len(parts) < 3 {
-		return ent, fmt.Errorf("malformed entry, expected 3 parts gpt %d", len(parts))
+	if len(parts) < 3 || len(parts) > 4 {
+		return ent, fmt.Errorf("malformed entry, expected 4 parts got %d", len(parts))
 	}
 	t, err := time.Parse(time.RFC3339Nano, parts[0])
 	if err != nil {
@@ -45,7 +86,15 @@ func ParseEntry(s string) (Entry, error) {
 	ent.Time = t
 	ent.Topic = parts[1]
 	ent.Data, err = base64.StdEncoding.DecodeString(parts[2])
-	ent.Schema = parts[3]
+	if err != nil {
+		return ent, err
+	}
+	if len(parts) == 4 {
+		ent.Schema = parts[3]
+	}
+	if f == EntryFormatEscaped {
+		ent.Topic, ent.Schema = entryUnescaper.Replace(ent.Topic), entryUnescaper.Replace(ent.Schema)
+	}
 	return ent, nil
 }
 
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEntryRoundTrip(t *testing.T) {
+	when := time.Date(2023, 1, 2, 3, 4, 5, 6, time.UTC)
+	entries := []Entry{
+		{Time: when, Topic: "/logs", Schema: "string", Data: []byte("a\tb\nc")},
+		{Time: when, Topic: "/odd\ttopic\\name", Schema: `enum("a\tb")`, Data: []byte{}},
+		{Time: when, Topic: "/lines", Schema: "{\n\"x\": int32}", Data: []byte{1, 2, 3, 4}},
+	}
+
+	for _, e := range entries {
+		parsed, err := ParseEntry(e.ToString())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.Time.Equal(e.Time) || parsed.Topic != e.Topic || parsed.Schema != e.Schema || !bytes.Equal(parsed.Data, e.Data) {
+			t.Errorf("expected %+v, got %+v", e, parsed)
+		}
+	}
+}
+
+func TestParseEntryLegacy(t *testing.T) {
+	e := Entry{Time: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC), Topic: `/a\b`, Schema: "int32", Data: []byte{1, 0, 0, 0}}
+
+	legacy := e.Format(EntryFormatLegacy)
+	if legacy != "2023-01-02T03:04:05Z\t/a\\b\tAQAAAA==\tint32" {
+		t.Errorf("unexpected legacy encoding %q", legacy)
+	}
+	parsed, err := ParseEntryFormat(legacy, EntryFormatLegacy)
+	if err != nil || parsed.Topic != e.Topic || parsed.Schema != e.Schema {
+		t.Errorf("expected %+v, got %+v, %v", e, parsed, err)
+	}
+
+	// Older versions could leave the schema out
+	parsed, err = ParseEntryFormat("2023-01-02T03:04:05Z\t/a\tAQAAAA==", EntryFormatLegacy)
+	if err != nil || parsed.Schema != "" {
+		t.Errorf("expected an entry without a schema, got %+v, %v", parsed, err)
+	}
+
+	for _, malformed := range []string{"2023-01-02T03:04:05Z\t/a", "2023-01-02T03:04:05Z\t/a\tnot base64!\tint32"} {
+		if _, err = ParseEntry(malformed); err == nil {
+			t.Errorf("expected %q to fail to parse", malformed)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// rollupTier holds data which has aged out of Config.RawRetention,
+// downsampled into buckets of Config.RollupInterval. Rollups are stored in
+// segments of their own, in the rollups directory of the database.
+type rollupTier struct {
+	Segments []Segment
+	// Until is the end of the data which has been rolled up. Raw data before
+	// it is only read from the rollups.
+	Until time.Time
+	// Dropped is the number of raw segments dropped once they were rolled up.
+	// Raw segment files keep the index they had before segments were dropped.
+	Dropped int
+
+	// dirty is the index of the first rollup segment changed since the tier
+	// was last serialized
+	dirty int
+	// unlinked is the number of dropped raw segment files removed from disk
+	unlinked int
+}
+
+// rollupMetadata is what's persisted of a rollupTier, besides its segments
+type rollupMetadata struct {
+	Until    time.Time `json:"until"`
+	Dropped  int       `json:"dropped"`
+	Segments int       `json:"segments"`
+}
+
+// rollupBucket accumulates the data appended to a topic during one bucket
+type rollupBucket struct {
+	sum   float64
+	count int
+	last  []byte
+}
+
+// decodeNumeric decodes data of the numeric type t
+func decodeNumeric(t schema.Type, data []byte) (float64, bool) {
+	if !t.IsNumeric() || !t.Validate(data) {
+		return 0, false
+	}
+
+	switch t.Name {
+	case "int8":
+		return float64(int8(data[0])), true
+	case "uint8":
+		return float64(data[0]), true
+	case "int16":
+		return float64(int16(binary.LittleEndian.Uint16(data))), true
+	case "uint16":
+		return float64(binary.LittleEndian.Uint16(data)), true
+	case "int32":
+		return float64(int32(binary.LittleEndian.Uint32(data))), true
+	case "uint32":
+		return float64(binary.LittleEndian.Uint32(data)), true
+	case "int64":
+		return float64(int64(binary.LittleEndian.Uint64(data))), true
+	case "uint64":
+		return float64(binary.LittleEndian.Uint64(data)), true
+	case "float32":
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(data))), true
+	case "float64":
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), true
+	}
+	return 0, false
+}
+
+// encodeNumeric encodes v as the numeric type t, rounding it to the nearest
+// integer for integer types
+func encodeNumeric(t schema.Type, v float64) []byte {
+	if t.Name != "float32" && t.Name != "float64" {
+		v = math.Round(v)
+	}
+
+	switch t.Name {
+	case "int8":
+		return []byte{byte(int8(v))}
+	case "uint8":
+		return []byte{uint8(v)}
+	case "int16":
+		return binary.LittleEndian.AppendUint16(nil, uint16(int16(v)))
+	case "uint16":
+		return binary.LittleEndian.AppendUint16(nil, uint16(v))
+	case "int32":
+		return binary.LittleEndian.AppendUint32(nil, uint32(int32(v)))
+	case "uint32":
+		return binary.LittleEndian.AppendUint32(nil, uint32(v))
+	case "int64":
+		return binary.LittleEndian.AppendUint64(nil, uint64(int64(v)))
+	case "uint64":
+		return binary.LittleEndian.AppendUint64(nil, uint64(v))
+	case "float32":
+		return binary.LittleEndian.AppendUint32(nil, math.Float32bits(float32(v)))
+	case "float64":
+		return binary.LittleEndian.AppendUint64(nil, math.Float64bits(v))
+	}
+	return nil
+}
+
+// numericType returns the type of a schema, if it's a numeric type
+func numericType(s schema.Object) (schema.Type, bool) {
+	switch t := s.(type) {
+	case schema.Type:
+		return t, t.IsNumeric()
+	case *schema.Type:
+		return *t, t.IsNumeric()
+	}
+	return schema.Type{}, false
+}
+
+func (b *rollupBucket) add(s schema.Object, data []byte) {
+	b.last = data
+	if t, ok := numericType(s); ok {
+		if v, ok := decodeNumeric(t, data); ok {
+			b.sum += v
+			b.count++
+		}
+	}
+}
+
+// value is the mean of a bucket of numbers, or the last value appended to a
+// bucket of anything else
+func (b *rollupBucket) value(s schema.Object) []byte {
+	if t, ok := numericType(s); ok && b.count > 0 {
+		return encodeNumeric(t, b.sum/float64(b.count))
+	}
+	return b.last
+}
+
+func (db *Database) rollupInterval() time.Duration {
+	if db.config.RollupInterval > 0 {
+		return db.config.RollupInterval
+	}
+	return DefaultRollupInterval
+}
+
+// rollupBoundary is the time before which data should have been rolled up
+func (db *Database) rollupBoundary(now time.Time) time.Time {
+	return now.Add(-db.config.RawRetention).Truncate(db.rollupInterval())
+}
+
+// rollupDue returns true if there's raw data older than Config.RawRetention
+// to roll up
+func (db *Database) rollupDue(now time.Time) bool {
+	return db.config.RawRetention > 0 && db.rollupBoundary(now).After(db.rollups.Until)
+}
+
+// appendRollup appends a rolled up datum at t to the rollup tier
+func (db *Database) appendRollup(t time.Time, d Datum) {
+	r := &db.rollups
+
+	n := len(r.Segments)
+	if n == 0 || r.Segments[n-1].Size >= SegmentSize {
+		r.Segments = append(r.Segments, Segment{HeadTime: t})
+		n++
+	}
+	if n-1 < r.dirty {
+		r.dirty = n - 1
+	}
+
+	d.Delta = t.Sub(r.Segments[n-1].HeadTime)
+	r.Segments[n-1].Append(&d)
+	db.spans.observe(d.TopicID, t)
+}
+
+// rollupInternal downsamples raw data older than Config.RawRetention into the
+// rollup tier, and drops raw segments which no longer hold anything newer. It
+// must be called with writeLock held.
+func (db *Database) rollupInternal(now time.Time) {
+	if !db.rollupDue(now) {
+		return
+	}
+
+	until := db.rollupBoundary(now)
+	interval := db.rollupInterval()
+
+	type bucketKey struct {
+		start   int64
+		topicID int
+	}
+	buckets := make(map[bucketKey]*rollupBucket)
+	var keys []bucketKey
+
+	for i := 0; i <= int(db.Current) && i < len(db.Segments); i++ {
+		segment := &db.Segments[i]
+		if !segment.HeadTime.Before(until) {
+			break
+		}
+
+		for j := 0; j < segment.Size; j++ {
+			datum := &segment.Series[j]
+			t := segment.HeadTime.Add(datum.Delta)
+			if t.Before(db.rollups.Until) {
+				continue
+			}
+			if !t.Before(until) {
+				break
+			}
+			if datum.expired(t, now) {
+				continue
+			}
+
+			key := bucketKey{start: t.Truncate(interval).UnixNano(), topicID: datum.TopicID}
+			b, ok := buckets[key]
+			if !ok {
+				b = &rollupBucket{}
+				buckets[key] = b
+				keys = append(keys, key)
+			}
+			b.add(db.SchemaLookup[datum.TopicID], datum.Data)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].start != keys[j].start {
+			return keys[i].start < keys[j].start
+		}
+		return keys[i].topicID < keys[j].topicID
+	})
+
+	db.segmentLock.Lock()
+	defer db.segmentLock.Unlock()
+
+	for _, key := range keys {
+		db.appendRollup(time.Unix(0, key.start), Datum{
+			TopicID: key.topicID,
+			Data:    buckets[key].value(db.SchemaLookup[key.topicID]),
+		})
+	}
+	db.rollups.Until = until
+
+	// Every datum in a segment is older than the head of the next one, so
+	// segments followed by one starting before until are entirely rolled up
+	drop := 0
+	for drop < int(db.Current) && !db.Segments[drop+1].HeadTime.After(until) {
+		drop++
+	}
+	if drop > 0 {
+		// Copy the remaining segments, so that the dropped ones can be freed
+		db.Segments = append(make([]Segment, 0, len(db.Segments)-drop), db.Segments[drop:]...)
+		db.Current -= uint32(drop)
+		db.rollups.Dropped += drop
+	}
+
+	db.log.Info().Time("until", until).Int("buckets", len(keys)).Int("dropped", drop).Msg("rolled up raw data")
+}
+
+// captureRollups captures the rollup segments changed since they were last
+// serialized, and the rollup metadata, to be written by writeRollups
+func (db *Database) captureRollups(s *serialization) error {
+	r := &db.rollups
+	s.firstRollup = r.dirty
+	if r.Until.IsZero() {
+		return nil
+	}
+
+	// Rollups only change while the database is captured, so they're shared
+	s.rollups = r.Segments[r.dirty:]
+
+	metadata, err := json.Marshal(rollupMetadata{Until: r.Until, Dropped: r.Dropped, Segments: len(r.Segments)})
+	if err != nil {
+		return err
+	}
+	s.rollupMetadata = metadata
+	return nil
+}
+
+// writeRollups writes the rollup segments and metadata captured by
+// captureRollups
+func (db *Database) writeRollups(s *serialization) error {
+	if s.rollupMetadata == nil {
+		return nil
+	}
+
+	directory := path.Join(db.Path, "rollups")
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+
+	for i := range s.rollups {
+		var encoded bytes.Buffer
+		err = gob.NewEncoder(&encoded).Encode(s.rollups[i])
+		if err != nil {
+			return err
+		}
+
+		err = db.replaceFile(filepath.Join(directory, fmt.Sprintf("%d", s.firstRollup+i)), encoded.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	err = db.syncDirectory(directory)
+	if err != nil {
+		return err
+	}
+
+	return db.replaceCompressedFile("rollup", s.rollupMetadata)
+}
+
+// removeDroppedSegments removes the files of raw segments dropped since they
+// were last removed. It's called once metadata no longer referring to them
+// has been written.
+func (db *Database) removeDroppedSegments() {
+	r := &db.rollups
+	for ; r.unlinked < r.Dropped; r.unlinked++ {
+		err := os.Remove(filepath.Join(db.Path, "segments", fmt.Sprintf("%d", r.unlinked)))
+		if err != nil && !os.IsNotExist(err) {
+			db.log.Error().Err(err).Int("segment", r.unlinked).Msg("unable to remove rolled up segment")
+		}
+	}
+}
+
+// deserializeRollupMetadata reads the rollup metadata, if the database has
+// any rollups. Segments are read by deserializeRollups.
+func (db *Database) deserializeRollupMetadata() (rollupMetadata, error) {
+	var metadata rollupMetadata
+	err := db.readCompressedJSON("rollup", &metadata)
+	if err != nil {
+		return metadata, err
+	}
+
+	db.rollups = rollupTier{
+		Until:    metadata.Until,
+		Dropped:  metadata.Dropped,
+		unlinked: metadata.Dropped,
+	}
+	return metadata, nil
+}
+
+// deserializeRollups reads the rollup segments listed in metadata
+func (db *Database) deserializeRollups(metadata rollupMetadata) error {
+	r := &db.rollups
+	r.Segments = make([]Segment, metadata.Segments)
+	for i := range r.Segments {
+		err := decodeSegment(path.Join(db.Path, "rollups", fmt.Sprintf("%d", i)), &r.Segments[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	// If serialization was interrupted, the last segment may hold rollups
+	// from after Until, which will be rolled up again
+	if n := len(r.Segments); n > 0 {
+		last := &r.Segments[n-1]
+		for last.Size > 0 && !last.HeadTime.Add(last.Series[last.Size-1].Delta).Before(r.Until) {
+			last.Size--
+		}
+	}
+	r.dirty = len(r.Segments)
+
+	return nil
+}
+
+// eachDatum calls fn with each datum in the database which hasn't expired
+// and its time, oldest first, reading rolled up data from the rollup tier.
+// It must be called with writeLock held.
+func (d *Database) eachDatum(fn func(t time.Time, datum *Datum)) {
+	now := time.Now()
+	for tier, segments := range [][]Segment{d.rollups.Segments, d.Segments} {
+		for i := range segments {
+			segment := &segments[i]
+			for j := range segment.Series[:segment.Size] {
+				t := segment.HeadTime.Add(segment.Series[j].Delta)
+				// Skip raw data which has already been rolled up
+				if tier > 0 && t.Before(d.rollups.Until) {
+					continue
+				}
+				if segment.Series[j].expired(t, now) {
+					continue
+				}
+				fn(t, &segment.Series[j])
+			}
+		}
+	}
+}
+
+// scanRollups calls fn with each rolled up entry matching a query
+func (s *snapshot) scanRollups(q Query, fn func(Entry)) {
+	t := s.rollups
+
+	first, last := 0, len(t.segments)-1
+	if q.Range == nil && s.span != nil {
+		var ok bool
+		if first, last, ok = t.segmentWindow(*s.span); !ok {
+			return
+		}
+	}
+
+	for i := first; i <= last; i++ {
+		segment := &t.segments[i]
+		// Skip segments which end before the range does
+		if q.Range != nil && i+1 < len(t.segments) && t.segments[i+1].HeadTime.Before(q.Range.Start) {
+			continue
+		}
+		if q.Range != nil && segment.HeadTime.After(q.Range.End) {
+			break
+		}
+
+		s.eachEntry(segment, t.series(i), func(entry Entry) {
+			if q.Range != nil && (entry.Time.Before(q.Range.Start) || entry.Time.After(q.Range.End)) {
+				return
+			}
+			fn(entry)
+		})
+	}
+}
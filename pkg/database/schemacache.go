@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// DefaultSchemaCacheSize is the number of parsed schemas a database keeps
+// around when Config.SchemaCacheSize is 0
+const DefaultSchemaCacheSize = 256
+
+type schemaCacheEntry struct {
+	key string
+	obj schema.Object
+}
+
+// schemaCache is a least recently used cache of parsed schemas, keyed by the
+// schema string. The zero value is an empty cache holding up to
+// DefaultSchemaCacheSize schemas.
+type schemaCache struct {
+	capacity int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   list.List
+}
+
+func (c *schemaCache) get(key string) (schema.Object, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*schemaCacheEntry).obj, true
+}
+
+func (c *schemaCache) add(key string, obj schema.Object) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*schemaCacheEntry).obj = obj
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&schemaCacheEntry{key, obj})
+
+	capacity := c.capacity
+	if capacity <= 0 {
+		capacity = DefaultSchemaCacheSize
+	}
+	for c.order.Len() > capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*schemaCacheEntry).key)
+	}
+}
+
+func (c *schemaCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
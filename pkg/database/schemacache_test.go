@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"testing"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+func TestSchemaCacheEviction(t *testing.T) {
+	c := schemaCache{capacity: 2}
+
+	c.add("int32", &schema.Type{Name: "int32"})
+	c.add("int64", &schema.Type{Name: "int64"})
+
+	// Using int32 makes int64 the least recently used
+	if _, ok := c.get("int32"); !ok {
+		t.Fatal("expected int32 to be cached")
+	}
+	c.add("string", &schema.Type{Name: "string"})
+
+	if c.len() != 2 {
+		t.Errorf("expected the cache to hold 2 schemas, got %d", c.len())
+	}
+	if _, ok := c.get("int64"); ok {
+		t.Error("expected int64 to be evicted")
+	}
+	for _, key := range []string{"int32", "string"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("expected %s to be cached", key)
+		}
+	}
+}
+
+func TestSchemaCacheDefaultCapacity(t *testing.T) {
+	var c schemaCache
+
+	for i := 0; i < DefaultSchemaCacheSize+10; i++ {
+		c.add(schema.Array{Length: i + 1, Type: schema.Type{Name: "int8"}}.ToSchema(), &schema.Type{Name: "int8"})
+	}
+
+	if c.len() != DefaultSchemaCacheSize {
+		t.Errorf("expected the cache to hold %d schemas, got %d", DefaultSchemaCacheSize, c.len())
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+var schemaNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// addSchemaInternal records s under name in the named schema registry
+func (d *Database) addSchemaInternal(name string, s string) {
+	d.topicLock.Lock()
+	defer d.topicLock.Unlock()
+	if d.namedSchemas == nil {
+		d.namedSchemas = make(map[string]string)
+	}
+	d.namedSchemas[name] = s
+}
+
+// canonicalSchema returns s in its canonical form, without the comments and
+// line breaks it may have been written with. Schemas which don't parse are
+// returned as is.
+func canonicalSchema(s string) string {
+	if s == "" {
+		return s
+	}
+	obj, err := schema.Parse(s)
+	if err != nil {
+		return s
+	}
+	return obj.ToSchema()
+}
+
+// AddSchema adds a schema to the database's registry of named schemas, so that
+// topics can be created with name in place of the schema itself.
+func (d *Database) AddSchema(name string, s string) error {
+	if !schemaNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid schema name '%s'", name)
+	}
+	if _, err := schema.Parse(name); err == nil {
+		return fmt.Errorf("schema name '%s' conflicts with a built-in type", name)
+	}
+
+	obj, err := schema.Parse(s)
+	if err != nil {
+		return err
+	}
+	s = obj.ToSchema()
+
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	if existing, ok := d.NamedSchema(name); ok {
+		if existing == s {
+			return nil
+		}
+		return fmt.Errorf("schema '%s' already exists", name)
+	}
+
+	d.addSchemaInternal(name, s)
+	d.writeLog(encodeAddSchema(name, s, d.nextSequence()))
+
+	return nil
+}
+
+// NamedSchema returns the schema registered under name
+func (d *Database) NamedSchema(name string) (string, bool) {
+	d.topicLock.RLock()
+	defer d.topicLock.RUnlock()
+
+	s, ok := d.namedSchemas[name]
+	return s, ok
+}
+
+// NamedSchemas returns a copy of the database's named schema registry
+func (d *Database) NamedSchemas() map[string]string {
+	d.topicLock.RLock()
+	defer d.topicLock.RUnlock()
+
+	schemas := make(map[string]string, len(d.namedSchemas))
+	for name, s := range d.namedSchemas {
+		schemas[name] = s
+	}
+	return schemas
+}
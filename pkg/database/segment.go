@@ -25,6 +25,15 @@ type Segment struct {
 	HeadTime time.Time
 	Series   [SegmentSize]Datum
 	Size     int
+	// Expires is when the first datum in the segment with a TTL expires, or
+	// zero if none have one
+	Expires time.Time
+	// Columns holds the data of topics with an encoding while the segment is
+	// on disk, keyed by topic ID. It's always empty in memory.
+	Columns map[int]Column
+	// columnar is the layout of the segment's data in columns, once it's
+	// full, if Config.ColumnarSegments is set
+	columnar *segmentColumns
 }
 
 func (s *Segment) Append(d *Datum) (bool, error) {
@@ -39,6 +48,13 @@ func (s *Segment) Append(d *Datum) (bool, error) {
 	s.Series[s.Size] = *d
 	s.Size += 1
 
+	if d.TTL > 0 {
+		expires := s.HeadTime.Add(d.Delta + d.TTL)
+		if s.Expires.IsZero() || expires.Before(s.Expires) {
+			s.Expires = expires
+		}
+	}
+
 	return true, nil
 }
 
@@ -76,10 +92,16 @@ func (s *Segment) binarySearchApproximate(desired time.Duration, begin int, end
 }
 
 func (s *Segment) FindApproximateDatum(desired time.Time) (int, Datum) {
-	if desired.Before(s.HeadTime) {
-		return 0, s.Series[0]
-	}
-	desiredDuration := desired.Sub(s.HeadTime)
-	index, _ := s.binarySearchApproximate(desiredDuration, 0, s.Size-1)
+	index := s.findApproximateIndex(desired, s.Size)
 	return index, s.Series[index]
 }
+
+// findApproximateIndex returns the index of the datum closest to desired
+// among the first size datums of the segment
+func (s *Segment) findApproximateIndex(desired time.Time, size int) int {
+	if size == 0 || desired.Before(s.HeadTime) {
+		return 0
+	}
+	index, _ := s.binarySearchApproximate(desired.Sub(s.HeadTime), 0, size-1)
+	return index
+}
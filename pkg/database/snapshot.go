@@ -0,0 +1,394 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"time"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// tier is a snapshot of a list of segments. Every segment but the last is
+// full, and is never modified again. The last may still be appended to, so
+// only the datums it held when the snapshot was taken are read from it.
+type tier struct {
+	segments []Segment
+	// last is the size of the last segment when the snapshot was taken
+	last int
+}
+
+func newTier(segments []Segment) tier {
+	t := tier{segments: segments}
+	if n := len(segments); n > 0 {
+		t.last = segments[n-1].Size
+	}
+	return t
+}
+
+// size returns the number of datums in segment i
+func (t tier) size(i int) int {
+	if i == len(t.segments)-1 {
+		return t.last
+	}
+	return t.segments[i].Size
+}
+
+// series returns the datums in segment i
+func (t tier) series(i int) []Datum {
+	return t.segments[i].Series[:t.size(i)]
+}
+
+// snapshot is a consistent view of a database, which queries read without
+// holding any locks. Taking one only copies slice headers, so appends aren't
+// blocked for any longer than that.
+type snapshot struct {
+	raw     tier
+	rollups tier
+	// until is the end of the rolled up data, see rollupTier
+	until   time.Time
+	topics  []string
+	schemas []schema.Object
+	// now is when the snapshot was taken, which data expires relative to
+	now time.Time
+	// span, if set, bounds the data held by the topics a query without a
+	// time range selects. Segments outside of it aren't scanned.
+	span *TimeRange
+	// wanted, if set, holds the IDs of the only topics whose entries are
+	// scanned, see Query.OnlyTopics
+	wanted map[int]bool
+}
+
+// snapshot takes a snapshot of the database for a query. If q selects topics
+// without a time range, the snapshot records the span of time their data
+// covers.
+func (d *Database) snapshot(q Query) snapshot {
+	var ids []int
+	if (q.Range == nil || q.OnlyTopics) && len(q.Topics) > 0 {
+		ids = d.topicIDs(q.Topics)
+	}
+
+	d.segmentLock.RLock()
+	s := snapshot{
+		raw:     newTier(d.Segments[:d.Current+1]),
+		rollups: newTier(d.rollups.Segments),
+		until:   d.rollups.Until,
+		now:     time.Now(),
+	}
+	if ids != nil && q.Range == nil {
+		// Selected topics which hold no data get an empty span, so that
+		// nothing is scanned
+		span, _ := d.spans.union(ids)
+		s.span = &span
+	}
+	d.segmentLock.RUnlock()
+
+	if q.OnlyTopics {
+		s.wanted = make(map[int]bool, len(ids))
+		for _, id := range ids {
+			s.wanted[id] = true
+		}
+	}
+
+	// Topics are created before anything is appended to them, so taking
+	// these after the segments covers every topic in the snapshot. They're
+	// only ever appended to, so they can be read after unlocking.
+	d.topicLock.RLock()
+	s.topics = d.TopicLookup
+	s.schemas = d.SchemaLookup
+	d.topicLock.RUnlock()
+
+	return s
+}
+
+// eachEntry calls fn with the entry for each datum in data which hasn't
+// expired, and belongs to a wanted topic
+func (s *snapshot) eachEntry(segment *Segment, data []Datum, fn func(Entry)) {
+	for i := range data {
+		val := &data[i]
+		if s.wanted != nil && !s.wanted[val.TopicID] {
+			continue
+		}
+		t := segment.HeadTime.Add(val.Delta)
+		if val.expired(t, s.now) {
+			continue
+		}
+
+		fn(Entry{
+			Time:     t,
+			Topic:    s.topics[val.TopicID],
+			Schema:   s.schemas[val.TopicID].ToSchema(),
+			Data:     val.Data,
+			Sequence: val.Sequence,
+		})
+	}
+}
+
+// eachDatum calls fn with each datum in the snapshot which hasn't expired,
+// and the time it was appended, like Database.eachDatum. Only segments which
+// may hold data within the snapshot's span are read.
+func (s *snapshot) eachDatum(fn func(t time.Time, datum *Datum)) {
+	if s.span != nil && s.span.Start.IsZero() {
+		return
+	}
+
+	for tier, t := range []tier{s.rollups, s.raw} {
+		first, last := 0, len(t.segments)-1
+		if s.span != nil {
+			var ok bool
+			if first, last, ok = t.segmentWindow(*s.span); !ok {
+				continue
+			}
+		}
+
+		for i := first; i <= last; i++ {
+			segment := &t.segments[i]
+			series := t.series(i)
+			for j := range series {
+				at := segment.HeadTime.Add(series[j].Delta)
+				// Skip raw data which has already been rolled up
+				if tier > 0 && at.Before(s.until) {
+					continue
+				}
+				if series[j].expired(at, s.now) {
+					continue
+				}
+				fn(at, &series[j])
+			}
+		}
+	}
+}
+
+// entriesFromData returns the entries for data which hasn't expired
+func (s *snapshot) entriesFromData(segment *Segment, data []Datum) []Entry {
+	entries := make([]Entry, 0, len(data))
+	s.eachEntry(segment, data, func(e Entry) {
+		entries = append(entries, e)
+	})
+	return entries
+}
+
+// retrieve retrieves the entries matching a query
+func (s *snapshot) retrieve(q Query) []Entry {
+	results := make([]Entry, 0)
+	s.scan(q, func(e Entry) {
+		results = append(results, e)
+	})
+	return results
+}
+
+// scan calls fn with each entry matching a query, oldest first, reading data
+// older than until from the rollups
+func (s *snapshot) scan(q Query, fn func(Entry)) {
+	if s.span != nil && s.span.Start.IsZero() {
+		return
+	}
+
+	if s.until.IsZero() {
+		s.scanRaw(q, fn)
+		return
+	}
+
+	if (q.Range == nil || q.Range.Start.Before(s.until)) && (s.span == nil || s.span.Start.Before(s.until)) {
+		s.scanRollups(q, fn)
+	}
+	if q.Range != nil && q.Range.End.Before(s.until) {
+		return
+	}
+	if s.span != nil && s.span.End.Before(s.until) {
+		return
+	}
+
+	// Raw segments may still hold data from before until, which was rolled
+	// up along with the segments before them
+	s.scanRaw(q, func(e Entry) {
+		if !e.Time.Before(s.until) {
+			fn(e)
+		}
+	})
+}
+
+// scanRaw calls fn with each entry of raw data matching a query
+func (s *snapshot) scanRaw(q Query, fn func(Entry)) {
+	t := s.raw
+	current := len(t.segments) - 1
+
+	// First, we deal with the time range
+	startFound := false
+	startIndex := 0
+
+	endFound := false
+	endIndex := 0
+
+	// If the query range is nil, we can skip this
+	if q.Range != nil {
+		for index := range t.segments {
+			head := t.segments[index].HeadTime
+			if !startFound && head.After(q.Range.Start) {
+				if index > 0 {
+					startIndex = index - 1
+				}
+				startFound = true
+			}
+
+			if !endFound && head.After(q.Range.End) {
+				if index > 0 {
+					endIndex = index - 1
+				} else {
+					return
+				}
+				endFound = true
+			}
+		}
+
+		// If start has not been found, we still need to search the last segment
+		// of the database
+		if !startFound {
+			startIndex = current
+		}
+	}
+
+	// Without a time range, only the segments which may hold data from the
+	// selected topics are scanned
+	if q.Range == nil && s.span != nil {
+		var ok bool
+		startIndex, endIndex, ok = t.segmentWindow(*s.span)
+		if !ok {
+			return
+		}
+		current = endIndex
+	}
+
+	// If endIndex is 0, that means there are no segments with head times after
+	// the specified end time, so use the last segment
+	if endIndex == 0 {
+		endIndex = current
+	}
+
+	startSubIndex := 0
+	endSubIndex := t.size(endIndex)
+
+	if q.Range != nil {
+		startSubIndex = t.segments[startIndex].findApproximateIndex(q.Range.Start, t.size(startIndex))
+		endSubIndex = t.segments[endIndex].findApproximateIndex(q.Range.End, t.size(endIndex))
+		// End of the range should be inclusive, but segments emptied by
+		// compaction have nothing to include
+		endSubIndex += 1
+		if endSubIndex > t.size(endIndex) {
+			endSubIndex = t.size(endIndex)
+		}
+
+		// Our binary search is kind of crude, in that it "fuzzy" matches the start
+		// and end of our range. So we have to do a quick bounds check on both sides
+		// to make sure that q.Range.Start <= startSubIndex <= q.Range.End
+		switch q.RangeSemantics {
+		case "since":
+			// Ensure start is correct
+			if startSubIndex < t.size(startIndex) {
+				startDatum := t.segments[startIndex].Series[startSubIndex]
+				startTime := t.segments[startIndex].HeadTime.Add(startDatum.Delta)
+				if startTime.Before(q.Range.Start) {
+					startSubIndex += 1
+				}
+			}
+		case "before":
+			// Ensure end is correct
+			if endSubIndex < t.size(endIndex) {
+				endDatum := t.segments[endIndex].Series[endSubIndex]
+				endTime := t.segments[endIndex].HeadTime.Add(endDatum.Delta)
+				if endTime.After(q.Range.End) {
+					endSubIndex -= 1
+				}
+			}
+		}
+	}
+
+	if startIndex == endIndex && startSubIndex > endSubIndex {
+		return
+	}
+
+	// Handle the case where all of our datum is in a single segment
+	if startIndex == endIndex {
+		s.scanSegment(t, startIndex, startSubIndex, endSubIndex, fn)
+		return
+	}
+
+	// Since our start and end are different segments, scan each of them
+	for i := startIndex; i <= endIndex; i++ {
+		if i == startIndex {
+			s.scanSegment(t, i, startSubIndex, t.size(i), fn)
+		} else if i == endIndex {
+			s.scanSegment(t, i, 0, endSubIndex, fn)
+		} else {
+			s.scanSegment(t, i, 0, t.size(i), fn)
+		}
+	}
+}
+
+// scanSegment calls fn with the entry for each datum from index from to index
+// to of segment i, reading them from the segment's columns if it can
+func (s *snapshot) scanSegment(t tier, i int, from, to int, fn func(Entry)) {
+	segment := &t.segments[i]
+	if s.scanColumns(segment, from, to, fn) {
+		return
+	}
+	s.eachEntry(segment, t.series(i)[from:to], fn)
+}
+
+// retrieveLatest retrieves the most recent entry of each topic in wanted, or
+// of every topic if wanted is nil, within q.Range. remaining is the number of
+// topics to find an entry for. See Database.RetrieveLatest.
+func (s *snapshot) retrieveLatest(q Query, wanted map[int]bool, remaining int) []Entry {
+	results := make([]Entry, 0)
+	found := make(map[int]bool)
+
+	// scan scans a tier backwards for the topics not found yet, down to data
+	// before stop. It returns true if there's nothing left to find.
+	scan := func(t tier, stop time.Time) bool {
+		for i := len(t.segments) - 1; i >= 0; i-- {
+			segment := &t.segments[i]
+			if q.Range != nil && segment.HeadTime.After(q.Range.End) {
+				continue
+			}
+
+			series := t.series(i)
+			for j := len(series) - 1; j >= 0; j-- {
+				datum := &series[j]
+				at := segment.HeadTime.Add(datum.Delta)
+				if q.Range != nil && at.After(q.Range.End) {
+					continue
+				}
+				if q.Range != nil && at.Before(q.Range.Start) {
+					return true
+				}
+				if at.Before(stop) {
+					return false
+				}
+				if found[datum.TopicID] || (wanted != nil && !wanted[datum.TopicID]) || datum.expired(at, s.now) {
+					continue
+				}
+
+				found[datum.TopicID] = true
+				results = append(results, s.entriesFromData(segment, series[j:j+1])...)
+				if len(found) == remaining {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	// Raw data from before until has been rolled up, so the latest entry of
+	// any topic not found in raw data is read from the rollups
+	if remaining > 0 && !scan(s.raw, s.until) {
+		scan(s.rollups, time.Time{})
+	}
+
+	for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+		results[i], results[j] = results[j], results[i]
+	}
+	return results
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import "time"
+
+// topicSpans records the times of the first and last datum appended to each
+// topic, indexed by topic ID, so that queries which only select topics can
+// skip segments holding none of their data. First may be older than a
+// topic's oldest datum once expired data is compacted away, which only makes
+// the span wider than it needs to be. It's guarded by segmentLock.
+type topicSpans []TimeRange
+
+// observe widens the span of topicID to include t
+func (s *topicSpans) observe(topicID int, t time.Time) {
+	for len(*s) <= topicID {
+		*s = append(*s, TimeRange{})
+	}
+
+	span := &(*s)[topicID]
+	if span.Start.IsZero() || t.Before(span.Start) {
+		span.Start = t
+	}
+	if t.After(span.End) {
+		span.End = t
+	}
+}
+
+// union returns the span covering every topic in ids, and false if none of
+// them hold any data
+func (s topicSpans) union(ids []int) (TimeRange, bool) {
+	var union TimeRange
+	found := false
+	for _, id := range ids {
+		if id >= len(s) || s[id].Start.IsZero() {
+			continue
+		}
+		if !found || s[id].Start.Before(union.Start) {
+			union.Start = s[id].Start
+		}
+		if !found || s[id].End.After(union.End) {
+			union.End = s[id].End
+		}
+		found = true
+	}
+	return union, found
+}
+
+// indexTopicSpans rebuilds the span of every topic from the data in the
+// database, which is only done when it's opened
+func (d *Database) indexTopicSpans() {
+	d.spans = nil
+	d.eachDatum(func(t time.Time, datum *Datum) {
+		d.spans.observe(datum.TopicID, t)
+	})
+}
+
+// topicIDs returns the IDs of topics, ignoring any which don't exist
+func (d *Database) topicIDs(topics []string) []int {
+	d.topicLock.RLock()
+	defer d.topicLock.RUnlock()
+
+	ids := make([]int, 0, len(topics))
+	for _, topic := range topics {
+		if id, ok := d.topics[normalizeTopicName(topic)]; ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// segmentWindow returns the first and last index of the segments in t which
+// may hold data within span. Every datum in a segment is no newer than the
+// head of the next one, so a segment followed by one starting before span
+// holds nothing within it. ok is false if no segment does.
+func (t tier) segmentWindow(span TimeRange) (first int, last int, ok bool) {
+	last = len(t.segments) - 1
+	for first <= last && first+1 < len(t.segments) && t.segments[first+1].HeadTime.Before(span.Start) {
+		first++
+	}
+	for last >= first && t.segments[last].HeadTime.After(span.End) {
+		last--
+	}
+	return first, last, first <= last
+}
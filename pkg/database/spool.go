@@ -0,0 +1,277 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// SpoolDropPolicy decides what a full Spool drops to make room
+type SpoolDropPolicy int
+
+const (
+	// SpoolDropOldest drops the oldest appends in the spool until a new one
+	// fits
+	SpoolDropOldest SpoolDropPolicy = iota
+	// SpoolDropNewest keeps the appends in the spool, refusing new ones with
+	// ErrSpoolFull
+	SpoolDropNewest
+)
+
+// ErrSpoolFull is returned when pushing an append onto a full spool which
+// drops the newest appends, or an append too large to ever fit
+var ErrSpoolFull = errors.New("spool is full")
+
+// A SpooledAppend is an append waiting in a Spool to be sent
+type SpooledAppend struct {
+	Topic string
+	Data  []byte
+	TTL   time.Duration
+	// IdempotencyKey is the key the append was first sent with, if any, so
+	// that the server can tell when a replayed append already landed
+	IdempotencyKey string
+	// Time is when the append was spooled
+	Time time.Time
+}
+
+type spooled struct {
+	SpooledAppend
+	sequence uint64
+	// line is the append as written to the spool's file
+	line []byte
+}
+
+// A Spool is a queue of appends kept on disk in the format of the write-ahead
+// log, which clients hold appends in while the server can't be reached. Each
+// append is written to the end of the file as it's pushed, and the appends
+// which are popped are recorded after it, so that a spool reopened after a
+// crash only holds the appends which were never popped.
+type Spool struct {
+	path    string
+	maxSize int64
+	policy  SpoolDropPolicy
+
+	mu      sync.Mutex
+	entries []spooled
+	// size is the size of the entries on disk, and fileSize the size of the
+	// whole file, including entries which have been popped
+	size     int64
+	fileSize int64
+	sequence uint64
+	dropped  uint64
+}
+
+// OpenSpool opens the spool at path, creating it if it doesn't exist. The
+// spool holds at most maxSize bytes of appends, dropping them according to
+// policy once it's full.
+func OpenSpool(path string, maxSize int64, policy SpoolDropPolicy) (*Spool, error) {
+	s := &Spool{path: path, maxSize: maxSize, policy: policy}
+
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Like the write-ahead log, anything which looks corrupted is discarded
+	// to make the most of the rest
+	var removed uint64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		actionType, payload, sequence, err := parseAction(string(line))
+		if err != nil {
+			continue
+		}
+		valueBytes, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			continue
+		}
+		dec := gob.NewDecoder(bytes.NewBuffer(valueBytes))
+
+		switch actionType {
+		case actionSpoolAppend:
+			var a SpooledAppend
+			if dec.Decode(&a) != nil {
+				continue
+			}
+			s.entries = append(s.entries, spooled{SpooledAppend: a, sequence: sequence, line: line})
+		case actionSpoolRemove:
+			if dec.Decode(&removed) != nil {
+				continue
+			}
+		}
+		if sequence > s.sequence {
+			s.sequence = sequence
+		}
+	}
+
+	kept := s.entries[:0]
+	for _, e := range s.entries {
+		if e.sequence > removed {
+			kept = append(kept, e)
+			s.size += int64(len(e.line))
+		}
+	}
+	s.entries = kept
+
+	return s, s.compact()
+}
+
+// Push adds a to the end of the spool
+func (s *Spool) Push(a SpooledAppend) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line := encodeAction(actionSpoolAppend, a, s.sequence+1)
+	size := int64(len(line))
+	if size > s.maxSize {
+		return ErrSpoolFull
+	}
+
+	if s.size+size > s.maxSize {
+		if s.policy == SpoolDropNewest {
+			s.dropped++
+			return ErrSpoolFull
+		}
+
+		dropped := 0
+		for s.size+size > s.maxSize {
+			s.size -= int64(len(s.entries[dropped].line))
+			dropped++
+		}
+		err := s.remove(dropped)
+		if err != nil {
+			return err
+		}
+		s.dropped += uint64(dropped)
+	}
+
+	err := s.write(line)
+	if err != nil {
+		return err
+	}
+	s.sequence++
+	s.entries = append(s.entries, spooled{SpooledAppend: a, sequence: s.sequence, line: line})
+	s.size += size
+	return nil
+}
+
+// Peek returns the oldest append in the spool, and false if it's empty
+func (s *Spool) Peek() (SpooledAppend, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) == 0 {
+		return SpooledAppend{}, false
+	}
+	return s.entries[0].SpooledAppend, true
+}
+
+// Pop removes the oldest append from the spool
+func (s *Spool) Pop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) == 0 {
+		return nil
+	}
+	s.size -= int64(len(s.entries[0].line))
+	return s.remove(1)
+}
+
+// Len returns the number of appends in the spool
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Size returns the size of the appends in the spool, in bytes
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Dropped returns the number of appends dropped because the spool was full,
+// since it was opened
+func (s *Spool) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// remove removes the first n entries, whose size the caller has already taken
+// off s.size, and records it on disk
+func (s *Spool) remove(n int) error {
+	last := s.entries[n-1].sequence
+	s.entries = s.entries[n:]
+
+	// Popped entries are rewritten away once they take up most of the file
+	if len(s.entries) == 0 || s.fileSize > 2*s.size {
+		return s.compact()
+	}
+	return s.write(encodeAction(actionSpoolRemove, last, last))
+}
+
+// compact rewrites the spool's file with only the entries it holds
+func (s *Spool) compact() error {
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	for _, e := range s.entries {
+		w.Write(e.line)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return err
+	}
+	s.fileSize = s.size
+	return nil
+}
+
+func (s *Spool) write(line []byte) error {
+	w := WriteAheadLog{LogPath: s.path}
+	err := w.write(line)
+	if err != nil {
+		return err
+	}
+	s.fileSize += int64(len(line))
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func pushSpooled(t *testing.T, s *Spool, topics ...string) {
+	t.Helper()
+	for _, topic := range topics {
+		err := s.Push(SpooledAppend{Topic: topic, Data: []byte("data"), Time: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkSpooled(t *testing.T, s *Spool, topics ...string) {
+	t.Helper()
+	if s.Len() != len(topics) {
+		t.Fatalf("expected %d spooled appends, got %d", len(topics), s.Len())
+	}
+	for i, topic := range topics {
+		if i < len(s.entries) && s.entries[i].Topic != topic {
+			t.Errorf("expected spooled append %d to be to %s, got %s", i, topic, s.entries[i].Topic)
+		}
+	}
+}
+
+func TestSpoolSurvivesReopening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+	s, err := OpenSpool(path, 1<<20, SpoolDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pushSpooled(t, s, "/a", "/b", "/c")
+	s.Pop()
+	if a, ok := s.Peek(); !ok || a.Topic != "/b" {
+		t.Fatalf("expected /b to be next, got %+v", a)
+	}
+
+	s, err = OpenSpool(path, 1<<20, SpoolDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSpooled(t, s, "/b", "/c")
+
+	// New appends are numbered after the ones read back
+	pushSpooled(t, s, "/d")
+	s.Pop()
+	s, err = OpenSpool(path, 1<<20, SpoolDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSpooled(t, s, "/c", "/d")
+
+	s.Pop()
+	s.Pop()
+	s, err = OpenSpool(path, 1<<20, SpoolDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSpooled(t, s)
+	if s.fileSize != 0 {
+		t.Errorf("expected an empty spool's file to be truncated, got %d bytes", s.fileSize)
+	}
+}
+
+func TestSpoolDropPolicies(t *testing.T) {
+	line := encodeAction(actionSpoolAppend, SpooledAppend{Topic: "/0", Data: []byte("data")}, 1)
+	// Room for three appends
+	maxSize := int64(len(line)*3 + len(line)/2)
+
+	s, err := OpenSpool(filepath.Join(t.TempDir(), "spool"), maxSize, SpoolDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		err := s.Push(SpooledAppend{Topic: fmt.Sprintf("/%d", i), Data: []byte("data")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkSpooled(t, s, "/2", "/3", "/4")
+	if s.Dropped() != 2 {
+		t.Errorf("expected 2 dropped appends, got %d", s.Dropped())
+	}
+
+	s, err = OpenSpool(filepath.Join(t.TempDir(), "spool"), maxSize, SpoolDropNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		err := s.Push(SpooledAppend{Topic: fmt.Sprintf("/%d", i), Data: []byte("data")})
+		if i >= 3 && !errors.Is(err, ErrSpoolFull) {
+			t.Errorf("expected ErrSpoolFull, got %v", err)
+		}
+	}
+	checkSpooled(t, s, "/0", "/1", "/2")
+
+	err = s.Push(SpooledAppend{Topic: "/big", Data: make([]byte, maxSize)})
+	if !errors.Is(err, ErrSpoolFull) {
+		t.Errorf("expected an append larger than the spool not to fit, got %v", err)
+	}
+}
@@ -7,10 +7,142 @@
 
 package database
 
-import "time"
+import (
+	"io/fs"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
 
 type Stats struct {
 	Segments      int
 	TopicCount    int
 	SerializeTime time.Time
+	// SerializeDuration is how long the last serialization took
+	SerializeDuration time.Duration
+	// WALSize is the size of the write-ahead log in bytes
+	WALSize int64
+	// PendingAppends is the number of appends since the database was last
+	// serialized
+	PendingAppends int
+	// FlushError is the error the last Flush failed with, or nil if it
+	// succeeded
+	FlushError error
+	// DiskSize is the size of the database on disk in bytes, including its
+	// segments, metadata and write-ahead log
+	DiskSize int64
+
+	// The rest are totals since the database was opened
+
+	Appends    uint64
+	AppendTime time.Duration
+	Queries    uint64
+	// RetrievedEntries is the number of entries retrieved by queries, before
+	// any of their pipelines ran
+	RetrievedEntries uint64
+	// Serializations is the number of times the database was serialized
+	Serializations uint64
+	// ClockSkews is the number of appends made while the clock was behind
+	// the last append, which were clamped to its timestamp
+	ClockSkews uint64
+	// PlanCacheHits and PlanCacheMisses count the queries which did and
+	// didn't find a plan cached from an earlier run of the same query
+	PlanCacheHits   uint64
+	PlanCacheMisses uint64
+	// DuplicateAppends is the number of appends which weren't stored, since
+	// their payload was appended to the same topic within its dedup window
+	DuplicateAppends uint64
+	// SlowAppends counts the appends which took longer than
+	// Config.SlowAppendThreshold, and SlowFlushes the write-ahead log writes
+	// and serializations which took longer than Config.SlowFlushThreshold
+	SlowAppends uint64
+	SlowFlushes uint64
+}
+
+// counters accumulate the totals reported by Stats
+type counters struct {
+	appends          atomic.Uint64
+	appendNanos      atomic.Int64
+	queries          atomic.Uint64
+	retrieved        atomic.Uint64
+	serializeNanos   atomic.Int64
+	serializations   atomic.Uint64
+	clockSkews       atomic.Uint64
+	planCacheHits    atomic.Uint64
+	planCacheMisses  atomic.Uint64
+	duplicateAppends atomic.Uint64
+	slowAppends      atomic.Uint64
+	slowFlushes      atomic.Uint64
+	flushErr         atomic.Pointer[error]
+	// storedBytes is the size of the serialized database, which only changes
+	// when it's serialized, so it isn't measured on every call to Stats
+	storedBytes atomic.Int64
+}
+
+func (c *counters) observeAppend(d time.Duration) {
+	c.appends.Add(1)
+	c.appendNanos.Add(int64(d))
+}
+
+// observeAppend counts an append to topic which took d, logging it if it
+// was slow, along with how long it waited for writeLock and the write-ahead
+// log
+func (d *Database) observeAppend(topic string, took, lockWait, logWait time.Duration) {
+	d.counters.observeAppend(took)
+	if d.config.SlowAppendThreshold <= 0 || took <= d.config.SlowAppendThreshold {
+		return
+	}
+	d.counters.slowAppends.Add(1)
+	d.log.Warn().Str("topic", topic).Dur("duration", took).Dur("lock_wait", lockWait).Dur("wal_wait", logWait).Msg("slow append")
+}
+
+// observeLogWrite logs writes of actions to the write-ahead log which took
+// longer than Config.SlowFlushThreshold
+func (d *Database) observeLogWrite(took time.Duration, actions int) {
+	if d.config.SlowFlushThreshold <= 0 || took <= d.config.SlowFlushThreshold {
+		return
+	}
+	d.counters.slowFlushes.Add(1)
+	d.log.Warn().Dur("duration", took).Int("actions", actions).Msg("slow write-ahead log write")
+}
+
+// observeSerialize logs serializations which took longer than
+// Config.SlowFlushThreshold
+func (d *Database) observeSerialize(took time.Duration) {
+	d.counters.serializeNanos.Store(int64(took))
+	d.counters.serializations.Add(1)
+	if d.config.SlowFlushThreshold <= 0 || took <= d.config.SlowFlushThreshold {
+		return
+	}
+	d.counters.slowFlushes.Add(1)
+	d.log.Warn().Dur("duration", took).Int("segments", len(d.Segments)).Msg("slow flush")
+}
+
+func (c *counters) observeFlush(err error) {
+	if err == nil {
+		c.flushErr.Store(nil)
+		return
+	}
+	c.flushErr.Store(&err)
+}
+
+func (c *counters) observeQuery(retrieved int) {
+	c.queries.Add(1)
+	c.retrieved.Add(uint64(retrieved))
+}
+
+// measureStorage records the size of every file in the database directory
+// other than the write-ahead log, whose size changes with every append
+func (db *Database) measureStorage() {
+	var size int64
+	filepath.WalkDir(db.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || p == db.writeAheadLog().LogPath {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	db.counters.storedBytes.Store(size)
 }
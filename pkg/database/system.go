@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// System topics are virtual topics under SystemTopicPrefix, which describe the
+// database itself. They hold no data, but can be queried like any other topic,
+// returning a snapshot of the database as of the query.
+const (
+	SystemTopicPrefix = "/_system"
+	// SystemTopicTopics holds an entry describing each topic in the database
+	SystemTopicTopics = "/_system/topics"
+	// SystemTopicStats holds a single entry with the database's Stats
+	SystemTopicStats = "/_system/stats"
+)
+
+// ErrSystemTopic is returned when creating or appending to a topic under
+// SystemTopicPrefix
+var ErrSystemTopic = errors.New("topics under " + SystemTopicPrefix + " are reserved for the system")
+
+// systemSchemas are the schemas of the entries in each system topic. Times are
+// in nanoseconds since the unix epoch, or 0 if there isn't one.
+var systemSchemas = map[string]string{
+	SystemTopicTopics: `{"name": string, "schema": string, "codec": string, "entries": uint64, "first_append": int64, "last_append": int64}`,
+	SystemTopicStats: `{"segments": uint64, "topics": uint64, "disk_size": uint64, "wal_size": uint64, "pending_appends": uint64, ` +
+		`"appends": uint64, "queries": uint64, "retrieved_entries": uint64, "serializations": uint64, "clock_skews": uint64, ` +
+		`"plan_cache_hits": uint64, "plan_cache_misses": uint64, "duplicate_appends": uint64, "slow_appends": uint64, "slow_flushes": uint64, "last_flush": int64}`,
+}
+
+// SystemTopics returns the names of the system topics, sorted
+func SystemTopics() []string {
+	return []string{SystemTopicStats, SystemTopicTopics}
+}
+
+// IsSystemTopic returns whether topic is, or is beneath, SystemTopicPrefix
+func IsSystemTopic(topic string) bool {
+	topic = normalizeTopicName(topic)
+	return topic == SystemTopicPrefix || strings.HasPrefix(topic, SystemTopicPrefix+"/")
+}
+
+// SystemTopicSchema returns the schema of the entries in the system topic
+// topic, and false if there's no such system topic
+func SystemTopicSchema(topic string) (schema.Object, bool) {
+	s, ok := systemSchemas[normalizeTopicName(topic)]
+	if !ok {
+		return nil, false
+	}
+	obj, err := schema.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return obj, true
+}
+
+// SystemEntries returns the entries of the system topic topic, as of now.
+// Entries describing topics are left out unless visible returns true for
+// them, or visible is nil.
+func (d *Database) SystemEntries(topic string, visible func(topic string) bool) Entries {
+	topic = normalizeTopicName(topic)
+	obj, ok := SystemTopicSchema(topic)
+	if !ok {
+		return Entries{}
+	}
+	s := obj.(*schema.Composite)
+	now := time.Now()
+
+	entry := func(fields map[string]any) Entry {
+		return Entry{Time: now, Topic: topic, Schema: s.ToSchema(), Data: encodeSystemFields(s, fields)}
+	}
+
+	switch topic {
+	case SystemTopicTopics:
+		entries := Entries{}
+		for _, info := range d.ListTopics() {
+			if visible != nil && !visible(info.Topic) {
+				continue
+			}
+
+			var first, last int64
+			if info.Count > 0 {
+				first, last = info.First.UnixNano(), info.Last.UnixNano()
+			}
+			entries = append(entries, entry(map[string]any{
+				"name":         info.Topic,
+				"schema":       info.Schema.ToSchema(),
+				"codec":        info.Codec,
+				"entries":      uint64(info.Count),
+				"first_append": first,
+				"last_append":  last,
+			}))
+		}
+		return entries
+	case SystemTopicStats:
+		stats := d.Stats()
+		var lastFlush int64
+		if !stats.SerializeTime.IsZero() {
+			lastFlush = stats.SerializeTime.UnixNano()
+		}
+
+		return Entries{entry(map[string]any{
+			"segments":          uint64(stats.Segments),
+			"topics":            uint64(stats.TopicCount),
+			"disk_size":         uint64(stats.DiskSize),
+			"wal_size":          uint64(stats.WALSize),
+			"pending_appends":   uint64(stats.PendingAppends),
+			"appends":           stats.Appends,
+			"queries":           stats.Queries,
+			"retrieved_entries": stats.RetrievedEntries,
+			"serializations":    stats.Serializations,
+			"clock_skews":       stats.ClockSkews,
+			"plan_cache_hits":   stats.PlanCacheHits,
+			"plan_cache_misses": stats.PlanCacheMisses,
+			"duplicate_appends": stats.DuplicateAppends,
+			"slow_appends":      stats.SlowAppends,
+			"slow_flushes":      stats.SlowFlushes,
+			"last_flush":        lastFlush,
+		})}
+	}
+
+	return Entries{}
+}
+
+// encodeSystemFields encodes fields as a value of the composite s, whose keys
+// are all strings, uint64s or int64s
+func encodeSystemFields(s *schema.Composite, fields map[string]any) []byte {
+	var b []byte
+	for _, key := range s.Keys {
+		switch v := fields[key].(type) {
+		case string:
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(v)))
+			b = append(b, v...)
+		case uint64:
+			b = binary.LittleEndian.AppendUint64(b, v)
+		case int64:
+			b = binary.LittleEndian.AppendUint64(b, uint64(v))
+		default:
+			panic("missing system topic field " + key)
+		}
+	}
+	return b
+}
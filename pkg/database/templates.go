@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// TopicTemplate gives the topics matching Pattern a schema, when they are
+// created without one. Patterns are matched with path.Match, so a '*' matches
+// a single level of a topic, as in /devices/*/temp.
+type TopicTemplate struct {
+	Pattern string `json:"pattern"`
+	Schema  string `json:"schema"`
+}
+
+// addTemplateInternal appends t to the database's topic templates
+func (d *Database) addTemplateInternal(t TopicTemplate) {
+	d.topicLock.Lock()
+	defer d.topicLock.Unlock()
+	d.templates = append(d.templates, t)
+}
+
+// AddTopicTemplate registers a template, so that topics matching pattern
+// which are created without a schema, such as by an append, are given s in
+// place of their parent's schema. The schema may be the name of a schema
+// added with AddSchema. Templates are matched in the order they were added.
+func (d *Database) AddTopicTemplate(pattern string, s string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("invalid template pattern '%s': patterns start with '/'", pattern)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid template pattern '%s': %w", pattern, err)
+	}
+
+	if named, ok := d.NamedSchema(s); ok {
+		s = named
+	}
+	obj, err := schema.Parse(s)
+	if err != nil {
+		return err
+	}
+	s = obj.ToSchema()
+
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	for _, t := range d.TopicTemplates() {
+		if t.Pattern != pattern {
+			continue
+		}
+		if t.Schema == s {
+			return nil
+		}
+		return fmt.Errorf("template '%s' already exists", pattern)
+	}
+
+	t := TopicTemplate{Pattern: pattern, Schema: s}
+	d.addTemplateInternal(t)
+	d.writeLog(encodeAddTemplate(t, d.nextSequence()))
+
+	return nil
+}
+
+// TopicTemplates returns a copy of the database's topic templates, in the
+// order they are matched
+func (d *Database) TopicTemplates() []TopicTemplate {
+	d.topicLock.RLock()
+	defer d.topicLock.RUnlock()
+
+	return append([]TopicTemplate{}, d.templates...)
+}
+
+// templateFor returns the first template matching topic
+func (d *Database) templateFor(topic string) (TopicTemplate, bool) {
+	d.topicLock.RLock()
+	defer d.topicLock.RUnlock()
+
+	for _, t := range d.templates {
+		if matched, _ := path.Match(t.Pattern, topic); matched {
+			return t, true
+		}
+	}
+	return TopicTemplate{}, false
+}
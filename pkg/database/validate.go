@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"fmt"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// ValidateTopic checks whether topic could be created like CreateTopic (or
+// CreateTopicWithOverride) would, without creating it. It returns the schema
+// and codec payloads appended to the topic would be checked against, which
+// are its own if it already exists. Unlike CreateTopic, a schema which doesn't
+// parse is an error, rather than being treated as a string.
+func (d *Database) ValidateTopic(topic string, s string, codec string, override bool) (schema.Object, string, error) {
+	topic = normalizeTopicName(topic)
+
+	if d.TopicExists(topic) {
+		return d.SchemaForTopic(topic), d.CodecForTopic(topic), nil
+	}
+
+	if named, ok := d.NamedSchema(s); ok {
+		s = named
+	}
+	if s != "" {
+		if _, err := schema.Parse(s); err != nil {
+			return nil, "", err
+		}
+	}
+
+	plan, err := d.planTopic(topic, s, codec, override)
+	if err != nil {
+		return nil, "", err
+	}
+
+	d.topicLock.RLock()
+	count := d.TopicCount
+	d.topicLock.RUnlock()
+	if d.config.MaxTopics > 0 && count >= d.config.MaxTopics {
+		return nil, "", fmt.Errorf("%w: the limit is %d", ErrTooManyTopics, d.config.MaxTopics)
+	}
+
+	return d.loadSchema(plan.schema), plan.codec, nil
+}
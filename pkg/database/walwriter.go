@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package database
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// walBatch is a group of actions written to the write-ahead log together
+type walBatch struct {
+	actions [][]byte
+	// unfilled counts slots reserved in actions which haven't been filled
+	unfilled sync.WaitGroup
+	done     chan struct{}
+	err      error
+}
+
+// walSlot is a place reserved in a batch for an action which is yet to be
+// encoded
+type walSlot struct {
+	batch *walBatch
+	index int
+}
+
+func newWalBatch() *walBatch {
+	return &walBatch{done: make(chan struct{})}
+}
+
+// walWriter batches up actions for the write-ahead log, so that concurrent
+// writers share a single write (and sync) of the log, rather than each of
+// them opening, writing and syncing it in turn while holding the database's
+// writeLock.
+//
+// Actions must be queued in sequence order, which callers ensure by queueing
+// them, or reserving a slot for them, while holding writeLock. Callers then
+// fill their slot and wait for their batch to be written after releasing
+// writeLock, so that encoding and writing happen concurrently with other
+// appends. The first waiter writes every queued action, and any writers which
+// queued actions in the meantime find their batch already written once it's
+// done.
+type walWriter struct {
+	wal WriteAheadLog
+	// written is called with each batch of actions once it's been written
+	written func(actions ...[]byte)
+	// timed, if set, is called with how long each batch took to write, and
+	// how many actions it held
+	timed func(d time.Duration, actions int)
+
+	// writing is held while a batch is written to the log
+	writing sync.Mutex
+
+	mu      sync.Mutex
+	pending *walBatch
+}
+
+func newWalWriter(wal WriteAheadLog, written func(actions ...[]byte)) *walWriter {
+	return &walWriter{wal: wal, written: written, pending: newWalBatch()}
+}
+
+// queue adds encoded actions to the next batch written to the log, and
+// returns that batch so the caller can wait for it
+func (w *walWriter) queue(actions ...[]byte) *walBatch {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending.actions = append(w.pending.actions, actions...)
+	return w.pending
+}
+
+// reserve reserves a slot for an action in the next batch written to the
+// log. The batch won't be written until the slot is filled.
+func (w *walWriter) reserve() walSlot {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending.actions = append(w.pending.actions, nil)
+	w.pending.unfilled.Add(1)
+	return walSlot{batch: w.pending, index: len(w.pending.actions) - 1}
+}
+
+// fill fills a reserved slot with an encoded action, and returns the batch it
+// belongs to
+func (w *walWriter) fill(slot walSlot, action []byte) *walBatch {
+	w.mu.Lock()
+	slot.batch.actions[slot.index] = action
+	w.mu.Unlock()
+
+	slot.batch.unfilled.Done()
+	return slot.batch
+}
+
+// wait blocks until b has been written to the log, writing it if no one
+// else is, and returns any error writing it
+func (w *walWriter) wait(b *walBatch) error {
+	w.writing.Lock()
+	defer w.writing.Unlock()
+
+	select {
+	case <-b.done:
+	default:
+		w.flushLocked()
+	}
+	return b.err
+}
+
+// write queues encoded actions and waits for them to be written to the log
+func (w *walWriter) write(actions ...[]byte) error {
+	return w.wait(w.queue(actions...))
+}
+
+// flush writes any queued actions to the log. The database calls this before
+// removing the log, so that queued actions aren't written to a new one.
+func (w *walWriter) flush() error {
+	w.writing.Lock()
+	defer w.writing.Unlock()
+
+	return w.flushLocked()
+}
+
+func (w *walWriter) flushLocked() error {
+	w.mu.Lock()
+	b := w.pending
+	w.pending = newWalBatch()
+	w.mu.Unlock()
+
+	b.unfilled.Wait()
+	if len(b.actions) > 0 {
+		start := time.Now()
+		b.err = w.wal.write(bytes.Join(b.actions, nil))
+		if w.timed != nil {
+			w.timed(time.Since(start), len(b.actions))
+		}
+		// Writers only return once the batch is done, so that what they
+		// wrote is visible to whoever is notified of it
+		if b.err == nil && w.written != nil {
+			w.written(b.actions...)
+		}
+	}
+	close(b.done)
+
+	return b.err
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossiltest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	fossil "github.com/dburkart/fossil/api"
+	"github.com/dburkart/fossil/pkg/codec"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// A Fixture declares the topics a test database starts out with, and the data
+// in them. Fixtures are written in Go, or loaded from JSON with LoadFixture:
+//
+//	{"topics": [{"name": "/temps", "schema": "float32", "data": ["21.5", "22"]}]}
+type Fixture struct {
+	Topics []Topic `json:"topics"`
+}
+
+// A Topic is created with its Schema and Codec, and then has its Data appended
+// in order
+type Topic struct {
+	Name string `json:"name"`
+	// Schema defaults to string
+	Schema string `json:"schema,omitempty"`
+	// Codec is the codec Data is appended with, which defaults to binary
+	Codec string `json:"codec,omitempty"`
+	// Data holds the values appended to the topic. Values of binary topics are
+	// written the way they're appended from the CLI, such as "21.5", and are
+	// encoded with the topic's schema. Values of topics with another codec are
+	// appended as they are, such as a JSON document for the json codec.
+	Data []string `json:"data,omitempty"`
+}
+
+// LoadFixture reads the JSON fixture at path
+func LoadFixture(path string) (Fixture, error) {
+	var f Fixture
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return f, fmt.Errorf("invalid fixture %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Seed creates the topics of fixture, and appends their data, with client
+func Seed(client fossil.Client, fixture Fixture) error {
+	for _, topic := range fixture.Topics {
+		resp, err := client.Send(proto.NewMessageWithType(proto.CommandCreate, proto.CreateTopicRequest{
+			Topic:  topic.Name,
+			Schema: topic.Schema,
+			Codec:  topic.Codec,
+		}))
+		if err == nil {
+			err = responseError(resp)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to create topic %s: %w", topic.Name, err)
+		}
+
+		s := topic.Schema
+		if s == "" {
+			s = "string"
+		}
+		obj, err := schema.Parse(s)
+		if err != nil {
+			return fmt.Errorf("invalid schema for topic %s: %w", topic.Name, err)
+		}
+		binary := topic.Codec == "" || topic.Codec == (codec.Binary{}).Name()
+
+		for i, value := range topic.Data {
+			data := []byte(value)
+			if binary {
+				data, err = schema.EncodeStringForSchema(value, obj)
+				if err != nil {
+					return fmt.Errorf("invalid value %d of topic %s: %w", i, topic.Name, err)
+				}
+			}
+
+			err = client.Append(topic.Name, data)
+			if err != nil {
+				return fmt.Errorf("unable to append value %d to topic %s: %w", i, topic.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func responseError(resp proto.Message) error {
+	if resp.Command() != proto.CommandError {
+		return nil
+	}
+	e := proto.ErrResponse{}
+	if err := proto.Unmarshal(resp.Data(), &e); err != nil {
+		return err
+	}
+	return fmt.Errorf("server returned error %d: %w", e.Code, e.Err)
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+// Package fossiltest runs fossil servers and databases seeded from fixtures
+// for end-to-end tests, and asserts on the results of queries against them.
+//
+//	srv := fossiltest.NewServer(t, fossiltest.Fixture{Topics: []fossiltest.Topic{
+//		{Name: "/temps", Schema: "int32", Data: []string{"20", "25"}},
+//	}})
+//	fossiltest.AssertValues(t, srv.Client(), "all in /temps | filter x -> x > 21", "25")
+package fossiltest
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	fossil "github.com/dburkart/fossil/api"
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/schema"
+	"github.com/dburkart/fossil/pkg/server"
+	"github.com/rs/zerolog"
+)
+
+// DatabaseName is the name of the database test servers serve
+const DatabaseName = "default"
+
+// Server is a fossil server listening on an ephemeral port of the loopback
+// interface, with a database in a temporary directory. It's closed when the
+// test which started it finishes.
+type Server struct {
+	// Addr is the address the server listens on
+	Addr string
+
+	t      testing.TB
+	server server.Server
+	sock   net.Listener
+}
+
+// NewServer starts a server whose database is seeded from fixture
+func NewServer(t testing.TB, fixture Fixture) *Server {
+	t.Helper()
+
+	dbs := map[string]server.DatabaseConfig{
+		DatabaseName: {Name: DatabaseName, Directory: t.TempDir()},
+	}
+	s := &Server{t: t, server: server.New(zerolog.Nop(), dbs, 0, 0, proto.DefaultLimits, nil, nil)}
+
+	var err error
+	s.sock, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Addr = s.sock.Addr().String()
+	go s.server.Serve(s.sock)
+	t.Cleanup(s.Close)
+
+	if err = Seed(s.Client(), fixture); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// ConnectionString returns the connection string of the server's database
+func (s *Server) ConnectionString() string {
+	return "fossil://" + s.Addr + "/" + DatabaseName
+}
+
+// Database returns the server's database, for looking at it directly
+func (s *Server) Database() *database.Database {
+	return s.server.Databases()[DatabaseName]
+}
+
+// Client returns a new client of the server, which is closed when the test
+// finishes
+func (s *Server) Client() fossil.Client {
+	s.t.Helper()
+	return connect(s.t, s.ConnectionString())
+}
+
+// Close stops the server listening. Connections which are already open are
+// left for their clients to close.
+func (s *Server) Close() {
+	s.sock.Close()
+}
+
+// NewLocal returns a client of a database seeded from fixture, which is
+// opened in the test's process rather than served over the network
+func NewLocal(t testing.TB, fixture Fixture) fossil.Client {
+	t.Helper()
+
+	client := connect(t, "file://"+filepath.Join(t.TempDir(), DatabaseName))
+	if err := Seed(client, fixture); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func connect(t testing.TB, connstr string) fossil.Client {
+	t.Helper()
+
+	client, err := fossil.NewClient(connstr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// Query runs query with client, failing the test if it fails
+func Query(t testing.TB, client fossil.Client, query string) database.Entries {
+	t.Helper()
+
+	entries, err := client.Query(query)
+	if err != nil {
+		t.Fatalf("query '%s' failed: %s", query, err)
+	}
+	return entries
+}
+
+// Values returns the data of each entry, formatted the way the CLI prints it
+func Values(entries database.Entries) []string {
+	values := make([]string, len(entries))
+	for i, e := range entries {
+		s, err := schema.Parse(e.Schema)
+		if err == nil {
+			values[i], err = schema.DecodeStringForSchema(e.Data, s)
+		}
+		if err != nil {
+			values[i] = string(e.Data)
+		}
+	}
+	return values
+}
+
+// AssertValues fails the test unless query returns entries whose values, as
+// formatted by Values, are want in order
+func AssertValues(t testing.TB, client fossil.Client, query string, want ...string) {
+	t.Helper()
+
+	got := Values(Query(t, client, query))
+	if len(got) != len(want) {
+		t.Errorf("query '%s': expected %q, got %q", query, want, got)
+		return
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("query '%s': expected %q, got %q", query, want, got)
+			return
+		}
+	}
+}
+
+// AssertCount fails the test unless query returns want entries
+func AssertCount(t testing.TB, client fossil.Client, query string, want int) {
+	t.Helper()
+
+	if got := Query(t, client, query); len(got) != want {
+		t.Errorf("query '%s': expected %d entries, got %d", query, want, len(got))
+	}
+}
+
+// AssertQueryFails fails the test unless query fails
+func AssertQueryFails(t testing.TB, client fossil.Client, query string) {
+	t.Helper()
+
+	if _, err := client.Query(query); err == nil {
+		t.Errorf("expected query '%s' to fail", query)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package fossiltest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	fossil "github.com/dburkart/fossil/api"
+)
+
+var fixture = Fixture{Topics: []Topic{
+	{Name: "/temps", Schema: "int32", Data: []string{"20", "25", "30"}},
+	{Name: "/sensors", Schema: `{"location": string, "temp": float32}`, Codec: "json", Data: []string{
+		`{"location": "garage", "temp": 21.5}`,
+	}},
+	{Name: "/logs", Data: []string{"started"}},
+}}
+
+func TestServerAndLocal(t *testing.T) {
+	srv := NewServer(t, fixture)
+
+	for name, client := range map[string]fossil.Client{"server": srv.Client(), "local": NewLocal(t, fixture)} {
+		t.Run(name, func(t *testing.T) {
+			AssertValues(t, client, "all in /temps | filter x -> x > 21", "25", "30")
+			AssertValues(t, client, "all in /sensors | map s -> s.location", "garage")
+			AssertValues(t, client, "all in /logs", "started")
+			AssertCount(t, client, "all", 5)
+			AssertQueryFails(t, client, "all in /temps | map x -> x.nope")
+		})
+	}
+
+	if !srv.Database().TopicExists("/temps") {
+		t.Error("expected the server's database to hold the fixture's topics")
+	}
+}
+
+func TestLoadFixture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixture.json")
+	err := os.WriteFile(path, []byte(`{"topics": [{"name": "/n", "schema": "int64", "data": ["1", "2"]}]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := LoadFixture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertValues(t, NewLocal(t, f), "all in /n | map x -> x * 2", "2", "4")
+}
+
+func TestSeedRejectsInvalidData(t *testing.T) {
+	srv := NewServer(t, Fixture{})
+	err := Seed(srv.Client(), Fixture{Topics: []Topic{{Name: "/n", Schema: "int64", Data: []string{"one"}}}})
+	if err == nil {
+		t.Error("expected a value which doesn't match the schema to be rejected")
+	}
+}
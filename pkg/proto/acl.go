@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package proto
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// TopicACL restricts which topics a group of clients may append to and
+// query. Fossil doesn't authenticate clients, so they're identified by the
+// address they connect from.
+type TopicACL struct {
+	Name string
+	// Clients are the networks whose clients the ACL applies to
+	Clients []*net.IPNet
+	// Allow limits clients to these topics and the topics beneath them. If
+	// it's empty, every topic is allowed.
+	Allow []string
+	// Deny keeps clients away from these topics and the topics beneath them,
+	// even if they're allowed
+	Deny []string
+	// CreateTopics trusts clients to create the topics they append to, even
+	// in strict mode
+	CreateTopics bool
+}
+
+// coversTopic returns true if topic is pattern, or is beneath it
+func coversTopic(pattern, topic string) bool {
+	pattern = strings.TrimSuffix(pattern, "/")
+	if pattern == "" {
+		return true
+	}
+	return topic == pattern || strings.HasPrefix(topic, pattern+"/")
+}
+
+// Permits returns true if clients the ACL applies to may use topic. A nil
+// ACL permits every topic.
+func (a *TopicACL) Permits(topic string) bool {
+	if a == nil {
+		return true
+	}
+
+	for _, pattern := range a.Deny {
+		if coversTopic(pattern, topic) {
+			return false
+		}
+	}
+
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range a.Allow {
+		if coversTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// MayCreateTopics returns true if clients the ACL applies to are trusted to
+// create the topics they append to in strict mode. Only clients with an ACL
+// which says so are trusted, so a nil ACL may not.
+func (a *TopicACL) MayCreateTopics() bool {
+	return a != nil && a.CreateTopics
+}
+
+// Applies returns true if the ACL applies to a client connecting from ip
+func (a *TopicACL) Applies(ip net.IP) bool {
+	for _, network := range a.Clients {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TopicACLs are checked in order, and the first which applies to a client
+// restricts it
+type TopicACLs []TopicACL
+
+// For returns the ACL restricting a client connecting from addr, or nil if
+// the client is unrestricted
+func (acls TopicACLs) For(addr net.Addr) *TopicACL {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	case *net.UnixAddr:
+		// Clients on a unix socket are on this machine
+		ip = net.IPv4(127, 0, 0, 1)
+	default:
+		return nil
+	}
+
+	for i := range acls {
+		if acls[i].Applies(ip) {
+			return &acls[i]
+		}
+	}
+	return nil
+}
+
+// ParseClients parses a list of networks in CIDR notation, or single
+// addresses, for TopicACL.Clients
+func ParseClients(clients []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(clients))
+
+	for _, c := range clients {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid client address %q", c)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client network %q: %w", c, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package proto
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTopicACLPermits(t *testing.T) {
+	acl := &TopicACL{
+		Allow: []string{"/metrics", "/logs/"},
+		Deny:  []string{"/metrics/billing"},
+	}
+
+	tt := []struct {
+		topic   string
+		permits bool
+	}{
+		{"/metrics", true},
+		{"/metrics/cpu", true},
+		{"/metricsauce", false},
+		{"/metrics/billing", false},
+		{"/metrics/billing/invoices", false},
+		{"/logs", true},
+		{"/logs/app", true},
+		{"/", false},
+		{"/secrets", false},
+	}
+
+	for _, tc := range tt {
+		if acl.Permits(tc.topic) != tc.permits {
+			t.Errorf("expected Permits(%q) to be %v", tc.topic, tc.permits)
+		}
+	}
+
+	// Without an allow list, only denied topics are off limits
+	acl = &TopicACL{Deny: []string{"/secrets"}}
+	if !acl.Permits("/metrics") || acl.Permits("/secrets/key") {
+		t.Error("expected an empty allow list to allow every topic which isn't denied")
+	}
+
+	acl = nil
+	if !acl.Permits("/secrets") {
+		t.Error("expected a nil ACL to permit every topic")
+	}
+}
+
+func TestTopicACLMayCreateTopics(t *testing.T) {
+	var acl *TopicACL
+	if acl.MayCreateTopics() {
+		t.Error("expected clients without an ACL not to be trusted to create topics")
+	}
+	if (&TopicACL{}).MayCreateTopics() {
+		t.Error("expected an ACL not to trust clients to create topics by default")
+	}
+	if !(&TopicACL{CreateTopics: true}).MayCreateTopics() {
+		t.Error("expected an ACL with CreateTopics to trust clients to create topics")
+	}
+}
+
+func TestTopicACLsFor(t *testing.T) {
+	internal, err := ParseClients([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, err := ParseClients([]string{"192.168.1.5", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acls := TopicACLs{
+		{Name: "internal", Clients: internal},
+		{Name: "single", Clients: single},
+	}
+
+	tt := []struct {
+		ip  string
+		acl string
+	}{
+		{"10.1.2.3", "internal"},
+		{"192.168.1.5", "single"},
+		{"192.168.1.6", ""},
+		{"::1", "single"},
+	}
+
+	for _, tc := range tt {
+		acl := acls.For(&net.TCPAddr{IP: net.ParseIP(tc.ip), Port: 8001})
+		name := ""
+		if acl != nil {
+			name = acl.Name
+		}
+		if name != tc.acl {
+			t.Errorf("expected client %s to get acl %q, got %q", tc.ip, tc.acl, name)
+		}
+	}
+
+	// Unix socket clients are matched as loopback clients
+	loopback, _ := ParseClients([]string{"127.0.0.0/8"})
+	local := TopicACLs{{Name: "local", Clients: loopback}}
+	if acl := local.For(&net.UnixAddr{Name: "/var/run/fossil.sock", Net: "unix"}); acl == nil || acl.Name != "local" {
+		t.Errorf("expected a unix socket client to get acl \"local\", got %+v", acl)
+	}
+
+	_, err = ParseClients([]string{"10.0.0.0/33"})
+	if err == nil {
+		t.Error("expected an invalid network to fail to parse")
+	}
+	_, err = ParseClients([]string{"localhost"})
+	if err == nil {
+		t.Error("expected a host name to fail to parse")
+	}
+}
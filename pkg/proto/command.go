@@ -25,4 +25,32 @@ var (
 	CommandAppend = "APPEND"
 	// CommandCreate is used to create topics (but could be used for other purposes in the future)
 	CommandCreate = "CREATE"
+	// CommandFlush serializes the current database's write-ahead log to disk
+	CommandFlush = "FLUSH"
+	// CommandSchema adds a named schema to the current database
+	CommandSchema = "SCHEMA"
+	// CommandTemplate adds a topic template to the current database
+	CommandTemplate = "TEMPLATE"
+	// CommandDescribe retrieves information about a topic in the current database
+	CommandDescribe = "DESCRIBE"
+	// CommandTopics lists the topics in the current database, with their schemas
+	CommandTopics = "TOPICS"
+	// CommandDatabaseStatus lists the databases served, with their status,
+	// size and topic count
+	CommandDatabaseStatus = "DBSTATUS"
+	// CommandValidate checks whether an append or topic creation would succeed,
+	// without writing anything
+	CommandValidate = "VALIDATE"
+	// CommandChanges retrieves the changes committed to the current database
+	// after an offset, waiting for some if there are none
+	CommandChanges = "CHANGES"
+	// CommandPing checks that the server is responding, and measures the round
+	// trip to it
+	CommandPing = "PING"
+	// CommandAuth authenticates the connection with the server's admin token,
+	// which the admin port requires before serving other commands
+	CommandAuth = "AUTH"
+	// CommandNotice is sent by the server, ahead of a response or on its own,
+	// to tell the client something which isn't an error. Clients never send it.
+	CommandNotice = "NOTICE"
 )
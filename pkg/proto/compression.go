@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/dustin/go-humanize"
+)
+
+// CompressionGzip compresses the data portion of messages with gzip
+const CompressionGzip = "gzip"
+
+// compressedFlag is set in the length prefix of a message whose data portion
+// is compressed. The compressed data is preceded by the ID of the algorithm
+// which compressed it.
+const compressedFlag = 1 << 31
+
+var compressionIDs = map[string]byte{
+	CompressionGzip: 1,
+}
+
+// SupportedCompression lists the compression algorithms messages can be
+// compressed with, in order of preference
+var SupportedCompression = []string{CompressionGzip}
+
+// CompressionThreshold is the size of the data portion of a message above
+// which it's compressed, if the client negotiated compression
+var CompressionThreshold = 64 * humanize.KiByte
+
+// NegotiateCompression picks the first of the compression algorithms offered
+// by a client which is supported, or returns an empty string if none are
+func NegotiateCompression(offered []string) string {
+	for _, algorithm := range offered {
+		if _, ok := compressionIDs[algorithm]; ok {
+			return algorithm
+		}
+	}
+	return ""
+}
+
+// Compress returns m with its data portion compressed with algorithm, if it's
+// larger than threshold. Otherwise, or if algorithm isn't supported, or if
+// compressing m wouldn't make it any smaller, m is returned as is.
+func Compress(m Message, algorithm string, threshold int) Message {
+	id, ok := compressionIDs[algorithm]
+	if !ok || len(m.Data()) <= threshold {
+		return m
+	}
+
+	buf := bytes.NewBuffer([]byte{id})
+	zw := gzip.NewWriter(buf)
+	zw.Write(m.Data())
+	zw.Close()
+	if buf.Len() >= len(m.Data()) {
+		return m
+	}
+
+	return &lineMessage{
+		command:    m.Command(),
+		data:       m.Data(),
+		requestID:  m.RequestID(),
+		compressed: buf.Bytes(),
+	}
+}
+
+// decompress decompresses the data portion of a compressed message, which
+// may be at most maxSize bytes once decompressed, or any size if maxSize is 0
+func decompress(b []byte, maxSize int) ([]byte, error) {
+	if len(b) == 0 || b[0] != compressionIDs[CompressionGzip] {
+		return nil, fmt.Errorf("message compressed with an unknown algorithm")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(b[1:]))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress message: %w", err)
+	}
+
+	var r io.Reader = zr
+	if maxSize > 0 {
+		// Read one byte past the limit, to tell whether it was exceeded
+		r = io.LimitReader(zr, int64(maxSize-commandWidth)+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress message: %w", err)
+	}
+	if exceeds(commandWidth+len(data), maxSize) {
+		return nil, LimitError{What: "decompressed message", Size: commandWidth + len(data), Limit: maxSize}
+	}
+
+	return data, nil
+}
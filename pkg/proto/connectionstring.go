@@ -12,26 +12,37 @@ import (
 	"fmt"
 	"net/url"
 	"path"
+	"strings"
 )
 
 var Protocol = "fossil"
 
 type ConnectionString struct {
-	Local    bool
+	Local bool
+	// Network is the network Address is dialed on, "tcp" or "unix"
+	Network  string
 	Address  string
 	Database string
+	// Token authenticates connections to the server's admin port, and is
+	// given as the password of the connection string
+	Token string
 }
 
 // ParseConnectionString takes a connection string and parses it into the parts
 // the application needs to make a connection. This function will always parse,
 // even horribly malformed connection strings. It will only return an error if
-// the protocol is not "fossil" or "file"
+// the protocol is not "fossil", "fossil+unix" or "file"
 //
 // Formats:
 //
 //	./path/to/local/db
 //	file://./path/to/local/db
-//	fossil://<host:port>[/<db_name>]
+//	fossil://[admin:<token>@]<host:port>[/<db_name>]
+//	fossil+unix://<path/to/socket.sock>[/<db_name>]
+//
+// IPv6 hosts are written in brackets, as in fossil://[::1]:8001. The path of
+// a unix socket must end in ".sock" to be followed by a database name;
+// otherwise the whole path is taken to be the socket.
 func ParseConnectionString(connStr string) (ConnectionString, error) {
 	ret := ConnectionString{
 		Local:    true,
@@ -54,9 +65,29 @@ func ParseConnectionString(connStr string) (ConnectionString, error) {
 		return ret, nil
 	}
 
+	if u.Scheme == "fossil+unix" {
+		ret.Local = false
+		ret.Network = "unix"
+		ret.Address = u.Host + u.Path
+		if i := strings.Index(ret.Address, ".sock/"); i != -1 {
+			ret.Address, ret.Database = ret.Address[:i+len(".sock")], ret.Address[i+len(".sock/"):]
+			if ret.Database == "" {
+				ret.Database = "default"
+			} else if strings.Contains(ret.Database, "/") {
+				return ConnectionString{}, errors.New(fmt.Sprintf("invalid database %s", ret.Database))
+			}
+		}
+		if ret.Address == "" {
+			return ConnectionString{}, errors.New("missing unix socket path")
+		}
+		return ret, nil
+	}
+
 	if u.Scheme == "fossil" {
 		ret.Local = false
+		ret.Network = "tcp"
 		ret.Address = u.Host
+		ret.Token, _ = u.User.Password()
 		d, p := path.Split(u.Path)
 		if d == "" && p == "" {
 			ret.Database = "default"
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package proto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/database"
+)
+
+// fuzzMessages are the messages of each command, which seed the fuzzers
+var fuzzMessages = []Marshaler{
+	VersionRequest{Version: Version, Compression: []string{CompressionGzip}},
+	UseRequest{DbName: "default"},
+	AppendRequest{Topic: "/foo", Data: []byte("bar"), TTL: time.Minute, IdempotencyKey: "key", Ack: true},
+	AppendResponse{Code: 200, Time: time.Unix(0, 1), Sequence: 1},
+	QueryRequest{Query: "all in /foo", Profile: true, Metadata: true, Sequences: true},
+	QueryResponse{Results: database.Entries{{Time: time.Unix(0, 1), Topic: "/foo", Schema: "string", Data: []byte("bar"), Sequence: 1}}, Sequences: true},
+	ListRequest{Object: "topics"},
+	CreateTopicRequest{Topic: "/foo", Schema: "int32", Codec: "json"},
+	ErrResponse{Code: 404, Err: database.ErrTopicNotFound},
+	Notice{Level: NoticeWarning, Message: "results truncated"},
+}
+
+// FuzzLineMessage reads arbitrary bytes as a message off the wire
+func FuzzLineMessage(f *testing.F) {
+	for _, m := range fuzzMessages {
+		b, err := WithRequestID(NewMessageWithType(CommandQuery, m), "abc").Marshal()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	compressed, _ := Compress(NewMessage(CommandQuery, bytes.Repeat([]byte("a"), 1024)), CompressionGzip, 0).Marshal()
+	f.Add(compressed)
+
+	// Request IDs of every length the header allows, including the longest,
+	// with and without compression, and one cut short of its length
+	longest := string(bytes.Repeat([]byte("a"), MaxRequestIDLength))
+	for _, id := range []string{"a", longest} {
+		b, _ := WithRequestID(NewMessageWithType(CommandQuery, QueryRequest{Query: "all"}), id).Marshal()
+		f.Add(b)
+		b, _ = Compress(WithRequestID(NewMessage(CommandQuery, bytes.Repeat([]byte("a"), 1024)), id), CompressionGzip, 0).Marshal()
+		f.Add(b)
+	}
+	truncated, _ := WithRequestID(NewMessage(CommandQuery, []byte("data")), "a").Marshal()
+	truncated[lenWidth+commandWidth] = MaxRequestIDLength
+	f.Add(truncated)
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := ReadMessageLimited(bytes.NewReader(b), 1<<20)
+		if err != nil {
+			return
+		}
+		if len(m.Data()) > 1<<20 {
+			t.Errorf("read %d bytes of data, more than the limit", len(m.Data()))
+		}
+	})
+}
+
+// FuzzAppendRequest unmarshals arbitrary bytes as an append, which must
+// marshal back to an append which unmarshals the same way
+func FuzzAppendRequest(f *testing.F) {
+	fuzzRoundTrip(f, func() Unmarshaler { return &AppendRequest{} })
+}
+
+// FuzzQueryResponse unmarshals arbitrary bytes as query results, which must
+// marshal back to results which unmarshal the same way
+func FuzzQueryResponse(f *testing.F) {
+	fuzzRoundTrip(f, func() Unmarshaler { return &QueryResponse{} })
+}
+
+// FuzzUnmarshal unmarshals arbitrary bytes as each kind of message, which
+// mustn't panic
+func FuzzUnmarshal(f *testing.F) {
+	for _, m := range fuzzMessages {
+		b, _ := m.Marshal()
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, u := range []Unmarshaler{
+			&VersionRequest{}, &VersionResponse{}, &UseRequest{}, &AuthRequest{}, &ErrResponse{}, &OkResponse{}, &Notice{},
+			&AppendRequest{}, &AppendResponse{}, &QueryRequest{}, &QueryResponse{}, &StatsRequest{}, &StatsResponse{}, &ListRequest{},
+			&ListResponse{}, &CreateTopicRequest{}, &FlushRequest{}, &CreateSchemaRequest{}, &CreateTemplateRequest{},
+			&ValidateRequest{}, &ChangesRequest{}, &ChangesResponse{}, &PingRequest{}, &PingResponse{},
+			&DescribeRequest{}, &DescribeResponse{}, &ListTopicsRequest{}, &ListTopicsResponse{},
+			&DatabaseStatusRequest{}, &DatabaseStatusResponse{},
+		} {
+			Unmarshal(b, u)
+		}
+	})
+}
+
+func fuzzRoundTrip(f *testing.F, make func() Unmarshaler) {
+	for _, m := range fuzzMessages {
+		b, _ := m.Marshal()
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		first := make()
+		if Unmarshal(b, first) != nil {
+			return
+		}
+		marshaled, err := first.(Marshaler).Marshal()
+		if err != nil {
+			return
+		}
+		second := make()
+		if err = Unmarshal(marshaled, second); err != nil {
+			t.Fatalf("unable to unmarshal %#v after marshaling it: %s", first, err)
+		}
+		if !reflect.DeepEqual(first, second) {
+			t.Errorf("expected %#v, got %#v", first, second)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package proto
+
+import (
+	"fmt"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Limits bounds the size of messages, and of what they carry. A limit of 0
+// means there is no limit.
+type Limits struct {
+	// MaxMessageSize is the largest wire message accepted, not including its
+	// length prefix
+	MaxMessageSize int
+	// MaxAppendSize is the largest payload accepted by an append
+	MaxAppendSize int
+	// MaxTopicLength is the longest topic name accepted
+	MaxTopicLength int
+}
+
+var DefaultLimits = Limits{
+	MaxMessageSize: 100 * humanize.MiByte,
+}
+
+// LimitError is returned when something exceeds one of the Limits
+type LimitError struct {
+	// What exceeded the limit: "message", "decompressed message", "append
+	// payload", or "topic name"
+	What  string
+	Size  int
+	Limit int
+}
+
+func (e LimitError) Error() string {
+	return fmt.Sprintf("%s of %d bytes exceeds the limit of %d bytes", e.What, e.Size, e.Limit)
+}
+
+func exceeds(size, limit int) bool {
+	return limit > 0 && size > limit
+}
+
+// CheckMessage returns a LimitError if a message with a data portion of size
+// bytes exceeds l
+func (l Limits) CheckMessage(size int) error {
+	if exceeds(commandWidth+size, l.MaxMessageSize) {
+		return LimitError{What: "message", Size: commandWidth + size, Limit: l.MaxMessageSize}
+	}
+	return nil
+}
+
+// CheckTopic returns a LimitError if topic exceeds l
+func (l Limits) CheckTopic(topic string) error {
+	if exceeds(len(topic), l.MaxTopicLength) {
+		return LimitError{What: "topic name", Size: len(topic), Limit: l.MaxTopicLength}
+	}
+	return nil
+}
+
+// CheckAppend returns a LimitError if a exceeds l
+func (l Limits) CheckAppend(a AppendRequest) error {
+	if err := l.CheckTopic(a.Topic); err != nil {
+		return err
+	}
+	if exceeds(len(a.Data), l.MaxAppendSize) {
+		return LimitError{What: "append payload", Size: len(a.Data), Limit: l.MaxAppendSize}
+	}
+	return nil
+}
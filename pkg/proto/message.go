@@ -8,7 +8,9 @@ package proto
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -22,7 +24,7 @@ import (
 )
 
 var (
-	Version                      = "v1.0.0"
+	Version                      = "v1.2.0"
 	MessageOk                    = NewMessageWithType(CommandOk, OkResponse{Code: 200, Message: "Ok"})
 	MessageOkDatabaseChanged     = NewMessageWithType(CommandOk, OkResponse{Code: 201, Message: "database changed"})
 	MessageError                 = NewMessageWithType(CommandError, ErrResponse{Code: 500})
@@ -37,8 +39,32 @@ var (
 	commandWidth = 8
 )
 
+// requestIDFlag is set in the length prefix of a message which carries a
+// request ID. The ID follows the command, preceded by its length in a byte.
+const requestIDFlag = 1 << 30
+
+// MaxRequestIDLength is the longest request ID a message can carry
+const MaxRequestIDLength = 255
+
+// NewRequestID returns a random ID for a request
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ReadMessageFull reads a message from r, which may be at most
+// DefaultLimits.MaxMessageSize bytes
 func ReadMessageFull(r io.Reader) (Message, error) {
-	msg := &lineMessage{}
+	return ReadMessageLimited(r, DefaultLimits.MaxMessageSize)
+}
+
+// ReadMessageLimited reads a message from r, which may be at most maxSize
+// bytes, or any size if maxSize is 0. If the message is too large, a
+// LimitError is returned, and the message is discarded so that the next
+// message can still be read.
+func ReadMessageLimited(r io.Reader, maxSize int) (Message, error) {
+	msg := &lineMessage{maxSize: maxSize}
 	err := msg.Unmarshal(r)
 	if err != nil {
 		return nil, err
@@ -51,18 +77,25 @@ type Message interface {
 	Unmarshal(r io.Reader) error
 	Command() string
 	Data() []byte
+	// RequestID is the ID of the request the message is, or is in response
+	// to, which is empty if it doesn't carry one
+	RequestID() string
 	MarshalZerologObject(e *zerolog.Event)
 }
 
 type lineMessage struct {
-	command string
-	data    []byte
+	command   string
+	data      []byte
+	requestID string
+	maxSize   int
+	// compressed is the data portion as sent on the wire, if it's compressed
+	compressed []byte
 }
 
 func NewMessage(cmd string, data []byte) Message {
 	return &lineMessage{
-		cmd,
-		data,
+		command: cmd,
+		data:    data,
 	}
 }
 
@@ -72,16 +105,50 @@ func NewMessageWithType(cmd string, t Marshaler) Message {
 		panic(err)
 	}
 	return &lineMessage{
-		cmd,
-		d,
+		command: cmd,
+		data:    d,
+	}
+}
+
+// WithRequestID returns a copy of m which carries the request ID id, or m
+// itself if id is empty
+func WithRequestID(m Message, id string) Message {
+	if id == "" {
+		return m
+	}
+	lm, ok := m.(*lineMessage)
+	if !ok {
+		lm = &lineMessage{command: m.Command(), data: m.Data()}
+	} else {
+		copied := *lm
+		lm = &copied
 	}
+	lm.requestID = id
+	return lm
 }
 
 func (m lineMessage) Marshal() ([]byte, error) {
-	b := make([]byte, lenWidth+commandWidth+len(m.data))
-	binary.BigEndian.PutUint32(b, uint32(commandWidth+len(m.data)))
+	data := m.data
+	var flags uint32
+	if m.compressed != nil {
+		data = m.compressed
+		flags = compressedFlag
+	}
+
+	var header []byte
+	if m.requestID != "" {
+		if len(m.requestID) > MaxRequestIDLength {
+			return nil, fmt.Errorf("request ID is longer than %d bytes", MaxRequestIDLength)
+		}
+		header = append([]byte{byte(len(m.requestID))}, m.requestID...)
+		flags |= requestIDFlag
+	}
+
+	b := make([]byte, lenWidth+commandWidth+len(header)+len(data))
+	binary.BigEndian.PutUint32(b, uint32(commandWidth+len(header)+len(data))|flags)
 	copy(b[lenWidth:], []byte(m.command))
-	copy(b[commandWidth+lenWidth:], m.data)
+	copy(b[lenWidth+commandWidth:], header)
+	copy(b[lenWidth+commandWidth+len(header):], data)
 
 	return b, nil
 }
@@ -93,13 +160,27 @@ func (m *lineMessage) Unmarshal(r io.Reader) error {
 		return err
 	}
 	length := binary.BigEndian.Uint32(lengthPrefix)
-	if length > 100*humanize.MiByte {
-		return errors.New("message too large")
+	compressed := length&compressedFlag != 0
+	hasRequestID := length&requestIDFlag != 0
+	length &^= compressedFlag | requestIDFlag
+	if exceeds(int(length), m.maxSize) {
+		// Skip over the message, so that the reader is positioned at the
+		// start of the next one
+		_, err = io.CopyN(io.Discard, r, int64(length))
+		if err != nil {
+			return err
+		}
+		return LimitError{What: "message", Size: int(length), Limit: m.maxSize}
 	}
-	buf := make([]byte, length)
-	n, err := io.ReadFull(r, buf)
+	// Read the message as it arrives, rather than allocating its whole
+	// length up front, since the length may not be honest
+	buf, err := io.ReadAll(io.LimitReader(r, int64(length)))
 	if err != nil {
-		return fmt.Errorf("unable to read response\n\t'%s'", string(buf))
+		return err
+	}
+	n := len(buf)
+	if n < int(length) {
+		return fmt.Errorf("unable to read message after %d of %d bytes: %w", n, length, io.ErrUnexpectedEOF)
 	}
 	if n < 8 {
 		return errors.New("message format incorrect")
@@ -108,6 +189,26 @@ func (m *lineMessage) Unmarshal(r io.Reader) error {
 	// Parse message
 	m.command = strings.ToUpper(strings.Trim(string(buf[:commandWidth]), "\u0000"))
 	m.data = buf[commandWidth:]
+	m.requestID = ""
+	if hasRequestID {
+		if len(m.data) < 1 {
+			return errors.New("message format incorrect: truncated request ID")
+		}
+		// Widen the length before adding to it, so that a request ID of
+		// MaxRequestIDLength doesn't wrap around
+		end := 1 + int(m.data[0])
+		if len(m.data) < end {
+			return errors.New("message format incorrect: truncated request ID")
+		}
+		m.requestID = string(m.data[1:end])
+		m.data = m.data[end:]
+	}
+	if compressed {
+		m.data, err = decompress(m.data, m.maxSize)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -119,8 +220,15 @@ func (m lineMessage) Data() []byte {
 	return m.data
 }
 
+func (m lineMessage) RequestID() string {
+	return m.requestID
+}
+
 func (m lineMessage) MarshalZerologObject(e *zerolog.Event) {
 	e.Str("command", m.command).Bytes("data", m.data)
+	if m.requestID != "" {
+		e.Str("request_id", m.requestID)
+	}
 }
 
 func Marshal(t Marshaler) ([]byte, error) {
@@ -147,10 +255,22 @@ type Printable interface {
 type (
 	VersionRequest struct {
 		Version string
+		// Compression lists the compression algorithms the client can
+		// decompress, in order of preference
+		Compression []string
 	}
 	VersionResponse struct {
 		Code    uint32 `json:"code"`
 		Version string `json:"version"`
+		// Compression is the algorithm the server compresses large responses
+		// with, or empty if it won't compress them
+		Compression string `json:"compression,omitempty"`
+		// Capabilities lists the optional parts of the protocol the server
+		// supports, and is nil for servers which predate advertising them
+		Capabilities []string `json:"capabilities,omitempty"`
+		// MinClientVersion is the oldest version of the protocol the server
+		// serves clients speaking
+		MinClientVersion string `json:"min_client_version,omitempty"`
 	}
 
 	ErrResponse struct {
@@ -163,10 +283,24 @@ type (
 		Message string `json:"message"`
 	}
 
+	// Notice tells the client something about its request, or the server,
+	// which isn't an error, such as that its results were truncated or that
+	// something it relies on is deprecated
+	Notice struct {
+		// Level is one of the Notice constants, such as NoticeWarning
+		Level   string `json:"level"`
+		Message string `json:"message"`
+	}
+
 	UseRequest struct {
 		DbName string
 	}
 
+	// AuthRequest authenticates a connection to the admin port
+	AuthRequest struct {
+		Token string
+	}
+
 	ListRequest struct {
 		Object string
 	}
@@ -190,19 +324,217 @@ type (
 	AppendRequest struct {
 		Topic string
 		Data  []byte
+		// CreateTopic creates the topic if it doesn't exist, even if the
+		// database is in strict mode. Servers ignore it from clients they
+		// don't trust to create topics.
+		CreateTopic bool
+		// TTL is how long the data is kept before it expires. 0 means it
+		// doesn't.
+		TTL time.Duration
+		// IdempotencyKey, if set, identifies the append, so that the server
+		// can acknowledge a retried append without appending it twice
+		IdempotencyKey string
+		// Ack requests an AppendResponse describing where the data landed,
+		// rather than a generic Ok. Only servers with CapabilityAppendAcks
+		// understand it.
+		Ack bool
+	}
+
+	// AppendResponse acknowledges an append which requested one, with the
+	// time and sequence number the server appended the data with
+	AppendResponse struct {
+		// Code is 200 if the data was appended, or 208 if it was a duplicate
+		// of an earlier append, whose Time and Sequence are given instead
+		Code     uint32    `json:"code"`
+		Time     time.Time `json:"time"`
+		Sequence uint64    `json:"sequence"`
 	}
 
 	QueryRequest struct {
 		Query string
+		// Profile requests a QueryProfile in the response
+		Profile bool
+		// Metadata requests QueryMetadata in the response. Results past the
+		// database's limit are then truncated, rather than failing the query.
+		Metadata bool
+		// Sequences requests the sequence number of each result in the
+		// response. Servers which don't know about them ignore it.
+		Sequences bool
 	}
 
 	QueryResponse struct {
 		Results database.Entries `json:"results"`
+		// Profile is only set if it was requested
+		Profile QueryProfile `json:"profile,omitempty"`
+		// Metadata is only set if it was requested
+		Metadata *QueryMetadata `json:"metadata,omitempty"`
+		// Sequences is set if the results carry their sequence numbers
+		Sequences bool `json:"-"`
+	}
+
+	// QueryMetadata describes the results of a query, so that clients can
+	// page through them
+	QueryMetadata struct {
+		// Matched is how many entries the query matched
+		Matched uint64 `json:"matched"`
+		// Returned is how many of them are in the response
+		Returned uint64 `json:"returned"`
+		// Truncated is set if entries were left out of the response
+		// because of the database's limits
+		Truncated bool `json:"truncated"`
+		// Start and End are the time range the query was run over
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
 	}
 
+	// QueryStage is the work done by one stage of a query
+	QueryStage struct {
+		Name     string        `json:"name"`
+		RowsIn   uint64        `json:"rows_in"`
+		RowsOut  uint64        `json:"rows_out"`
+		Duration time.Duration `json:"duration"`
+	}
+
+	// QueryProfile is the work done by each stage of a query, in order
+	QueryProfile []QueryStage
+
 	CreateTopicRequest struct {
 		Topic  string
 		Schema string
+		Codec  string
+		// Encoding is the encoding the topic's data is stored with on disk,
+		// or empty to store it as it's appended
+		Encoding string
+		// Override the schema of the topic's parent, if they conflict
+		Override bool
+	}
+
+	FlushRequest struct{}
+
+	CreateSchemaRequest struct {
+		Name   string
+		Schema string
+	}
+
+	// CreateTemplateRequest gives topics matching Pattern, which are created
+	// without a schema, Schema instead of their parent's
+	CreateTemplateRequest struct {
+		Pattern string
+		Schema  string
+	}
+
+	// ValidateRequest asks whether a payload would be accepted by Topic, or
+	// whether Topic could be created, without writing anything. Schema, Codec
+	// and Override are used as they would be by a CreateTopicRequest, if the
+	// topic doesn't exist.
+	ValidateRequest struct {
+		Topic  string
+		Schema string
+		Codec  string
+		// Data is checked against the topic's schema, unless it's nil
+		Data []byte
+		// CreateTopic validates as though the topic is created if it doesn't
+		// exist, even if the database is in strict mode. Servers ignore it
+		// from clients they don't trust to create topics.
+		CreateTopic bool
+		// Override the schema of the topic's parent, if they conflict
+		Override bool
+	}
+
+	// ChangesRequest asks for the changes committed to the current database
+	// with offsets of at least From. 0 starts with the oldest change the
+	// database holds.
+	ChangesRequest struct {
+		From uint64
+		// Limit is the most changes returned. 0 means there is no limit.
+		Limit uint32
+		// Wait is how long to wait for a change, if there are none
+		Wait time.Duration
+	}
+
+	// ChangesResponse holds changes in offset order
+	ChangesResponse struct {
+		Changes []database.Change `json:"changes"`
+		// Next is the offset to ask for the following changes from
+		Next uint64 `json:"next"`
+	}
+
+	// PingRequest checks that the server is responding. It doesn't need a
+	// database to be in use.
+	PingRequest struct {
+		// Sent is when the client sent the request, which the server echoes
+		Sent time.Time
+	}
+
+	PingResponse struct {
+		Sent time.Time `json:"sent"`
+		// Received is when the server received the request, by its clock
+		Received time.Time `json:"received"`
+		// RoundTrip is computed by the client from Sent once the response
+		// arrives, and isn't sent over the wire
+		RoundTrip time.Duration `json:"round_trip"`
+	}
+
+	DescribeRequest struct {
+		Topic string
+	}
+
+	DescribeResponse struct {
+		Topic        string    `json:"topic"`
+		Schema       string    `json:"schema"`
+		ParentSchema string    `json:"parent_schema"`
+		Codec        string    `json:"codec"`
+		Encoding     string    `json:"encoding"`
+		Count        uint64    `json:"count"`
+		First        time.Time `json:"first"`
+		Last         time.Time `json:"last"`
+	}
+
+	// ListTopicsRequest asks for a page of the topics in the current
+	// database, sorted by name
+	ListTopicsRequest struct {
+		// Prefix limits the topics listed to those starting with it
+		Prefix string
+		// After is the Next of the previous page, or empty for the first page
+		After string
+		// Limit is the most topics in the page, or 0 for all of them
+		Limit uint32
+	}
+
+	ListTopicsResponse struct {
+		Topics []TopicSummary `json:"topics"`
+		// Next is passed as the After of the request for the next page, and
+		// is empty if this is the last page
+		Next string `json:"next,omitempty"`
+	}
+
+	TopicSummary struct {
+		Topic  string `json:"topic"`
+		Schema string `json:"schema"`
+		Codec  string `json:"codec"`
+		Count  uint64 `json:"count"`
+	}
+
+	// DatabaseStatusRequest asks for the status of every database served
+	DatabaseStatusRequest struct{}
+
+	DatabaseStatusResponse struct {
+		Databases []DatabaseStatus `json:"databases"`
+	}
+
+	// DatabaseStatus describes a database being served
+	DatabaseStatus struct {
+		Name string `json:"name"`
+		// Status is DatabaseOpen, or DatabaseDegraded if the database isn't
+		// healthy, such as when its last flush failed
+		Status string `json:"status"`
+		// Size is the size of the database on disk in bytes
+		Size   uint64 `json:"size"`
+		Topics uint64 `json:"topics"`
+		// LastFlush is when the database was last serialized to disk, or
+		// zero if it never has been
+		LastFlush time.Time     `json:"last_flush"`
+		Uptime    time.Duration `json:"uptime"`
 	}
 )
 
@@ -212,11 +544,24 @@ type (
 // Marshal a VersionRequest. We don't actually use the specified version, and
 // instead rely on the Version variable above
 func (v VersionRequest) Marshal() ([]byte, error) {
-	return []byte(Version), nil
+	b := []byte(Version)
+	// Compression algorithms follow the version, separated by a NUL byte
+	if len(v.Compression) > 0 {
+		b = append(b, 0)
+		b = append(b, strings.Join(v.Compression, ",")...)
+	}
+	return b, nil
 }
 
 // Unmarshal ...
 func (v *VersionRequest) Unmarshal(b []byte) error {
+	v.Compression = nil
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		if i+1 < len(b) {
+			v.Compression = strings.Split(string(b[i+1:]), ",")
+		}
+		b = b[:i]
+	}
 	v.Version = string(b)
 
 	return nil
@@ -233,6 +578,19 @@ func (v VersionResponse) Marshal() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The negotiated compression, capabilities, and minimum client version
+	// follow the version, each separated by a NUL byte. Trailing fields
+	// which are empty are left out.
+	fields := []string{v.Compression, strings.Join(v.Capabilities, ","), v.MinClientVersion}
+	for len(fields) > 0 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	for _, field := range fields {
+		_, err = buf.Write(append([]byte{0}, field...))
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return buf.Bytes(), nil
 }
@@ -250,16 +608,46 @@ func (v *VersionResponse) Unmarshal(b []byte) error {
 		return err
 	}
 
-	v.Version = string(version)
+	fields := strings.Split(string(version), "\x00")
+	v.Version = fields[0]
+	v.Compression = ""
+	v.Capabilities = nil
+	v.MinClientVersion = ""
+	if len(fields) > 1 {
+		v.Compression = fields[1]
+	}
+	if len(fields) > 2 {
+		v.Capabilities = []string{}
+		if fields[2] != "" {
+			v.Capabilities = strings.Split(fields[2], ",")
+		}
+	}
+	if len(fields) > 3 {
+		v.MinClientVersion = fields[3]
+	}
 	return nil
 }
 
+// Supports returns whether the server which sent v supports capability.
+// Servers which predate advertising capabilities are assumed to support it.
+func (v VersionResponse) Supports(capability string) bool {
+	if v.Capabilities == nil {
+		return true
+	}
+	for _, c := range v.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
 func (v VersionResponse) Headers() []string {
-	return []string{"code", "version"}
+	return []string{"code", "version", "capabilities", "min_client_version"}
 }
 
 func (v VersionResponse) Values() [][]string {
-	return [][]string{[]string{fmt.Sprintf("%d", v.Code), v.Version}}
+	return [][]string{[]string{fmt.Sprintf("%d", v.Code), v.Version, strings.Join(v.Capabilities, ","), v.MinClientVersion}}
 }
 
 // UseRequest
@@ -277,6 +665,21 @@ func (rq *UseRequest) Unmarshal(b []byte) error {
 	return nil
 }
 
+// AuthRequest
+// --------------------------
+
+// Marshal ...
+func (rq AuthRequest) Marshal() ([]byte, error) {
+	return []byte(rq.Token), nil
+}
+
+// Unmarshal ...
+func (rq *AuthRequest) Unmarshal(b []byte) error {
+	rq.Token = string(b)
+
+	return nil
+}
+
 // ErrResponse
 // --------------------------
 
@@ -362,16 +765,110 @@ func (v OkResponse) Values() [][]string {
 	return [][]string{[]string{fmt.Sprintf("%d", v.Code), v.Message}}
 }
 
+// Notice
+// --------------------------
+
+// Levels of a Notice
+const (
+	NoticeInfo        = "info"
+	NoticeWarning     = "warning"
+	NoticeDeprecation = "deprecation"
+)
+
+// Marshal ...
+func (n Notice) Marshal() ([]byte, error) {
+	// The level is separated from the message by a NUL byte
+	b := append([]byte(n.Level), 0)
+	return append(b, n.Message...), nil
+}
+
+// Unmarshal ...
+func (n *Notice) Unmarshal(b []byte) error {
+	level, message, ok := bytes.Cut(b, []byte{0})
+	if !ok {
+		return errors.New("notice is missing its level")
+	}
+	n.Level = string(level)
+	n.Message = string(message)
+	return nil
+}
+
+func (n Notice) String() string {
+	return fmt.Sprintf("%s: %s", n.Level, n.Message)
+}
+
+func (n Notice) Headers() []string {
+	return []string{"level", "message"}
+}
+
+func (n Notice) Values() [][]string {
+	return [][]string{{n.Level, n.Message}}
+}
+
 // AppendRequest
 // --------------------------
 
+// appendCreateTopicFlag is set in the topic length of an AppendRequest with
+// CreateTopic set
+const appendCreateTopicFlag = 1 << 31
+
+// appendTTLFlag is set in the topic length of an AppendRequest with a TTL,
+// which follows the topic
+const appendTTLFlag = 1 << 30
+
+// appendKeyFlag is set in the topic length of an AppendRequest with an
+// idempotency key, which follows the TTL, preceded by its length in a byte
+const appendKeyFlag = 1 << 29
+
+// appendAckFlag is set in the topic length of an AppendRequest with Ack set
+const appendAckFlag = 1 << 28
+
+// MaxIdempotencyKeyLength is the longest idempotency key an append can carry
+const MaxIdempotencyKeyLength = 255
+
+// NewIdempotencyKey returns a random idempotency key for an append
+func NewIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 // Marshal ...
 func (rq AppendRequest) Marshal() ([]byte, error) {
-	buf := bytes.NewBuffer(binary.BigEndian.AppendUint32([]byte{}, uint32(len(rq.Topic))))
+	if len(rq.IdempotencyKey) > MaxIdempotencyKeyLength {
+		return nil, fmt.Errorf("idempotency key is longer than %d bytes", MaxIdempotencyKeyLength)
+	}
+
+	length := uint32(len(rq.Topic))
+	if rq.CreateTopic {
+		length |= appendCreateTopicFlag
+	}
+	if rq.TTL > 0 {
+		length |= appendTTLFlag
+	}
+	if rq.IdempotencyKey != "" {
+		length |= appendKeyFlag
+	}
+	if rq.Ack {
+		length |= appendAckFlag
+	}
+	buf := bytes.NewBuffer(binary.BigEndian.AppendUint32([]byte{}, length))
 	_, err := buf.Write([]byte(rq.Topic))
 	if err != nil {
 		return nil, err
 	}
+	if rq.TTL > 0 {
+		_, err = buf.Write(binary.BigEndian.AppendUint64([]byte{}, uint64(rq.TTL)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rq.IdempotencyKey != "" {
+		_, err = buf.Write(append([]byte{byte(len(rq.IdempotencyKey))}, rq.IdempotencyKey...))
+		if err != nil {
+			return nil, err
+		}
+	}
 	_, err = buf.Write(rq.Data)
 	if err != nil {
 		return nil, err
@@ -388,6 +885,14 @@ func (rq *AppendRequest) Unmarshal(b []byte) error {
 		return err
 	}
 	length := binary.BigEndian.Uint32(lengthPrefix)
+	rq.CreateTopic = length&appendCreateTopicFlag != 0
+	hasTTL := length&appendTTLFlag != 0
+	hasKey := length&appendKeyFlag != 0
+	rq.Ack = length&appendAckFlag != 0
+	length &^= appendCreateTopicFlag | appendTTLFlag | appendKeyFlag | appendAckFlag
+	if int(length) > buf.Len() {
+		return io.ErrUnexpectedEOF
+	}
 	topic := make([]byte, length)
 	m, err := io.ReadFull(buf, topic)
 	if err != nil {
@@ -399,37 +904,206 @@ func (rq *AppendRequest) Unmarshal(b []byte) error {
 		rq.Topic = string(topic[:length])
 	}
 
+	rq.TTL = 0
+	if hasTTL {
+		ttl := make([]byte, 8)
+		_, err = io.ReadFull(buf, ttl)
+		if err != nil {
+			return err
+		}
+		rq.TTL = time.Duration(binary.BigEndian.Uint64(ttl))
+		if rq.TTL < 0 {
+			return fmt.Errorf("invalid TTL %s", rq.TTL)
+		}
+		m += len(ttl)
+	}
+
+	rq.IdempotencyKey = ""
+	if hasKey {
+		keyLength, err := buf.ReadByte()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, keyLength)
+		_, err = io.ReadFull(buf, key)
+		if err != nil {
+			return err
+		}
+		rq.IdempotencyKey = string(key)
+		m += 1 + len(key)
+	}
+
 	rq.Data = b[n+m:]
 
 	return nil
 }
 
+// AppendResponse
+// --------------------------
+
+// Marshal ...
+func (rq AppendResponse) Marshal() ([]byte, error) {
+	b := binary.BigEndian.AppendUint32([]byte{}, rq.Code)
+	b = binary.BigEndian.AppendUint64(b, uint64(unixNanos(rq.Time)))
+	b = binary.BigEndian.AppendUint64(b, rq.Sequence)
+	return b, nil
+}
+
+// Unmarshal ...
+func (rq *AppendResponse) Unmarshal(b []byte) error {
+	if len(b) < 20 {
+		return io.ErrUnexpectedEOF
+	}
+	rq.Code = binary.BigEndian.Uint32(b)
+	rq.Time = fromUnixNanos(int64(binary.BigEndian.Uint64(b[4:])))
+	rq.Sequence = binary.BigEndian.Uint64(b[12:])
+	return nil
+}
+
+func (rq AppendResponse) Headers() []string {
+	return []string{"code", "time", "sequence"}
+}
+
+func (rq AppendResponse) Values() [][]string {
+	return [][]string{{fmt.Sprintf("%d", rq.Code), rq.Time.Format(time.RFC3339Nano), fmt.Sprintf("%d", rq.Sequence)}}
+}
+
 // QueryRequest
 // --------------------------
 
+// Flags following the query of a QueryRequest
+const (
+	// queryProfileFlag is set if Profile is
+	queryProfileFlag = 1 << iota
+	// queryMetadataFlag is set if Metadata is
+	queryMetadataFlag
+	// querySequencesFlag is set if Sequences is
+	querySequencesFlag
+)
+
 // Marshal ...
 func (rq QueryRequest) Marshal() ([]byte, error) {
-	return []byte(rq.Query), nil
+	b := []byte(rq.Query)
+	var flags byte
+	if rq.Profile {
+		flags |= queryProfileFlag
+	}
+	if rq.Metadata {
+		flags |= queryMetadataFlag
+	}
+	if rq.Sequences {
+		flags |= querySequencesFlag
+	}
+	if flags != 0 {
+		b = append(b, 0, flags)
+	}
+	return b, nil
 }
 
 // Unmarshal ...
 func (rq *QueryRequest) Unmarshal(b []byte) error {
+	// Flags may follow the query, separated by a NUL byte
+	var flags byte
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		if i+1 < len(b) {
+			flags = b[i+1]
+		}
+		b = b[:i]
+	}
+
 	rq.Query = string(b)
+	rq.Profile = flags&queryProfileFlag != 0
+	rq.Metadata = flags&queryMetadataFlag != 0
+	rq.Sequences = flags&querySequencesFlag != 0
 	return nil
 }
 
 // QueryResponse
 // --------------------------
 
-// Marshal ...
+// appendDictionary appends a count prefixed list of length prefixed strings
+func appendDictionary(b []byte, dict []string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(dict)))
+	for _, str := range dict {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(str)))
+		b = append(b, str...)
+	}
+	return b
+}
+
+// Marshal encodes each result as its time, the indices of its topic and
+// schema, and its data. Topics and schemas are usually shared by many
+// results, so each is only sent once, in a dictionary preceding the results.
 func (rq QueryResponse) Marshal() ([]byte, error) {
-	b := []byte{}
-	buf := bytes.NewBuffer(binary.BigEndian.AppendUint32(b, uint32(len(rq.Results))))
+	var topics, schemas []string
+	topicIndex := map[string]uint32{}
+	schemaIndex := map[string]uint32{}
+	index := func(dict *[]string, indices map[string]uint32, str string) uint32 {
+		i, ok := indices[str]
+		if !ok {
+			i = uint32(len(*dict))
+			indices[str] = i
+			*dict = append(*dict, str)
+		}
+		return i
+	}
+
+	entries := binary.BigEndian.AppendUint32([]byte{}, uint32(len(rq.Results)))
 	for i := range rq.Results {
-		ent := rq.Results[i].ToString()
-		l := binary.BigEndian.AppendUint32([]byte{}, uint32(len(ent)))
-		buf.Write(l)
-		buf.WriteString(ent)
+		ent := &rq.Results[i]
+		entries = binary.BigEndian.AppendUint64(entries, uint64(ent.Time.Unix()))
+		entries = binary.BigEndian.AppendUint32(entries, uint32(ent.Time.Nanosecond()))
+		entries = binary.BigEndian.AppendUint32(entries, index(&topics, topicIndex, ent.Topic))
+		entries = binary.BigEndian.AppendUint32(entries, index(&schemas, schemaIndex, ent.Schema))
+		entries = binary.BigEndian.AppendUint32(entries, uint32(len(ent.Data)))
+		entries = append(entries, ent.Data...)
+	}
+
+	b := appendDictionary([]byte{}, topics)
+	b = appendDictionary(b, schemas)
+	buf := bytes.NewBuffer(append(b, entries...))
+
+	// Sequence numbers follow the metadata, so metadata describing the
+	// results is sent with them if none was asked for
+	md := rq.Metadata
+	if rq.Sequences && md == nil {
+		md = &QueryMetadata{Matched: uint64(len(rq.Results)), Returned: uint64(len(rq.Results))}
+	}
+
+	// Metadata follows the profile, so an empty profile is sent if metadata
+	// is without one
+	if rq.Profile != nil || md != nil {
+		buf.Write(binary.BigEndian.AppendUint32([]byte{}, uint32(len(rq.Profile))))
+		for _, stage := range rq.Profile {
+			buf.Write(binary.BigEndian.AppendUint32([]byte{}, uint32(len(stage.Name))))
+			buf.WriteString(stage.Name)
+			buf.Write(binary.BigEndian.AppendUint64([]byte{}, stage.RowsIn))
+			buf.Write(binary.BigEndian.AppendUint64([]byte{}, stage.RowsOut))
+			buf.Write(binary.BigEndian.AppendUint64([]byte{}, uint64(stage.Duration)))
+		}
+	}
+
+	if md != nil {
+		b := binary.BigEndian.AppendUint64([]byte{}, md.Matched)
+		b = binary.BigEndian.AppendUint64(b, md.Returned)
+		if md.Truncated {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+		for _, t := range []time.Time{md.Start, md.End} {
+			b = binary.BigEndian.AppendUint64(b, uint64(t.Unix()))
+			b = binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+		}
+		buf.Write(b)
+	}
+
+	if rq.Sequences {
+		b := binary.BigEndian.AppendUint32([]byte{}, uint32(len(rq.Results)))
+		for i := range rq.Results {
+			b = binary.BigEndian.AppendUint64(b, rq.Results[i].Sequence)
+		}
+		buf.Write(b)
 	}
 
 	return buf.Bytes(), nil
@@ -437,34 +1111,170 @@ func (rq QueryResponse) Marshal() ([]byte, error) {
 
 // Unmarshal ...
 func (rq *QueryResponse) Unmarshal(b []byte) error {
-	var count uint32 = 0
 	buf := bytes.NewBuffer(b)
-	err := binary.Read(buf, binary.BigEndian, &count)
+
+	readBytes := func() ([]byte, error) {
+		var l uint32
+		err := binary.Read(buf, binary.BigEndian, &l)
+		if err != nil {
+			return nil, err
+		}
+		if int(l) > buf.Len() {
+			return nil, io.ErrUnexpectedEOF
+		}
+		field := make([]byte, l)
+		_, err = io.ReadFull(buf, field)
+		return field, err
+	}
+
+	readDictionary := func() ([]string, error) {
+		var count uint32
+		err := binary.Read(buf, binary.BigEndian, &count)
+		if err != nil {
+			return nil, err
+		}
+		dict := []string{}
+		for i := uint32(0); i < count; i++ {
+			str, err := readBytes()
+			if err != nil {
+				return nil, err
+			}
+			dict = append(dict, string(str))
+		}
+		return dict, nil
+	}
+
+	topics, err := readDictionary()
 	if err != nil {
 		return err
 	}
+	schemas, err := readDictionary()
+	if err != nil {
+		return err
+	}
+
+	var count uint32 = 0
+	err = binary.Read(buf, binary.BigEndian, &count)
+	if err != nil {
+		return err
+	}
+	first := len(rq.Results)
 	var i uint32
 	for i = 0; i < count; i++ {
-		var l uint32
-		err := binary.Read(buf, binary.BigEndian, &l)
+		var seconds int64
+		var nanoseconds, topic, schema uint32
+		for _, field := range []any{&seconds, &nanoseconds, &topic, &schema} {
+			err = binary.Read(buf, binary.BigEndian, field)
+			if err != nil {
+				return err
+			}
+		}
+		if topic >= uint32(len(topics)) || schema >= uint32(len(schemas)) {
+			return fmt.Errorf("entry refers to topic %d and schema %d, but only %d topics and %d schemas were sent", topic, schema, len(topics), len(schemas))
+		}
+
+		data, err := readBytes()
 		if err != nil {
 			return err
 		}
-		line := make([]byte, l)
-		n, err := buf.Read(line)
+
+		rq.Results = append(rq.Results, database.Entry{
+			Time:   time.Unix(seconds, int64(nanoseconds)).UTC(),
+			Topic:  topics[topic],
+			Schema: schemas[schema],
+			Data:   data,
+		})
+	}
+
+	// A profile follows the results, if one was requested
+	if buf.Len() == 0 {
+		return nil
+	}
+	err = binary.Read(buf, binary.BigEndian, &count)
+	if err != nil {
+		return err
+	}
+	// Each stage takes at least the length of its name and three counters
+	if int(count) > buf.Len()/(4+3*8) {
+		return io.ErrUnexpectedEOF
+	}
+	if count > 0 {
+		rq.Profile = make(QueryProfile, count)
+	}
+	for i = 0; i < count; i++ {
+		stage := &rq.Profile[i]
+
+		var l uint32
+		err = binary.Read(buf, binary.BigEndian, &l)
 		if err != nil {
 			return err
 		}
-		if uint32(n) != l {
-			return fmt.Errorf("error entry len not the right len %d != %d", n, l)
+		if int(l) > buf.Len() {
+			return io.ErrUnexpectedEOF
 		}
-		ent, err := database.ParseEntry(string(line))
+		name := make([]byte, l)
+		_, err = io.ReadFull(buf, name)
 		if err != nil {
 			return err
 		}
-		rq.Results = append(rq.Results, ent)
+		stage.Name = string(name)
+
+		var duration uint64
+		for _, field := range []*uint64{&stage.RowsIn, &stage.RowsOut, &duration} {
+			err = binary.Read(buf, binary.BigEndian, field)
+			if err != nil {
+				return err
+			}
+		}
+		stage.Duration = time.Duration(duration)
 	}
-	return nil
+
+	// Metadata follows the profile, if it was requested
+	if buf.Len() == 0 {
+		return nil
+	}
+	md := &QueryMetadata{}
+	var truncated byte
+	for _, field := range []any{&md.Matched, &md.Returned, &truncated} {
+		err = binary.Read(buf, binary.BigEndian, field)
+		if err != nil {
+			return err
+		}
+	}
+	md.Truncated = truncated != 0
+	for _, t := range []*time.Time{&md.Start, &md.End} {
+		var seconds int64
+		var nanoseconds uint32
+		for _, field := range []any{&seconds, &nanoseconds} {
+			err = binary.Read(buf, binary.BigEndian, field)
+			if err != nil {
+				return err
+			}
+		}
+		*t = time.Unix(seconds, int64(nanoseconds)).UTC()
+	}
+	rq.Metadata = md
+
+	// Sequence numbers follow the metadata, if they were requested
+	if buf.Len() == 0 {
+		return nil
+	}
+	err = binary.Read(buf, binary.BigEndian, &count)
+	if err != nil {
+		return err
+	}
+	results := rq.Results[first:]
+	if int(count) != len(results) {
+		return fmt.Errorf("response has %d sequence numbers for %d results", count, len(results))
+	}
+	for i := range results {
+		err = binary.Read(buf, binary.BigEndian, &results[i].Sequence)
+		if err != nil {
+			return err
+		}
+	}
+	rq.Sequences = true
+	return nil
 }
 
 func (v QueryResponse) Headers() []string {
@@ -493,6 +1303,23 @@ func (v QueryResponse) Values() [][]string {
 	return res
 }
 
+func (v QueryProfile) Headers() []string {
+	return []string{"stage", "rows_in", "rows_out", "duration"}
+}
+
+func (v QueryProfile) Values() [][]string {
+	res := [][]string{}
+	for _, stage := range v {
+		res = append(res, []string{
+			stage.Name,
+			fmt.Sprintf("%d", stage.RowsIn),
+			fmt.Sprintf("%d", stage.RowsOut),
+			stage.Duration.String(),
+		})
+	}
+	return res
+}
+
 // StatsRequest
 // --------------------------
 
@@ -629,6 +1456,9 @@ func (rq *ListResponse) Unmarshal(b []byte) error {
 		if err != nil {
 			return err
 		}
+		if int(l) > buf.Len() {
+			return io.ErrUnexpectedEOF
+		}
 		line := make([]byte, l)
 		n, err := buf.Read(line)
 		if err != nil {
@@ -658,9 +1488,17 @@ func (v ListResponse) Values() [][]string {
 // CreateTopicRequest
 //-------------------------
 
+// createOverrideFlag is set in the topic length of a CreateTopicRequest with
+// Override set
+const createOverrideFlag = 1 << 31
+
 // Marshal ...
 func (rq CreateTopicRequest) Marshal() ([]byte, error) {
-	buf := bytes.NewBuffer(binary.BigEndian.AppendUint32([]byte{}, uint32(len(rq.Topic))))
+	length := uint32(len(rq.Topic))
+	if rq.Override {
+		length |= createOverrideFlag
+	}
+	buf := bytes.NewBuffer(binary.BigEndian.AppendUint32([]byte{}, length))
 	_, err := buf.Write([]byte(rq.Topic))
 	if err != nil {
 		return nil, err
@@ -669,6 +1507,20 @@ func (rq CreateTopicRequest) Marshal() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The codec and encoding are optional, and each separated from the field
+	// before it by a NUL byte
+	if rq.Codec != "" || rq.Encoding != "" {
+		_, err = buf.Write(append([]byte{0}, rq.Codec...))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rq.Encoding != "" {
+		_, err = buf.Write(append([]byte{0}, rq.Encoding...))
+		if err != nil {
+			return nil, err
+		}
+	}
 	return buf.Bytes(), nil
 }
 
@@ -681,6 +1533,11 @@ func (rq *CreateTopicRequest) Unmarshal(b []byte) error {
 		return err
 	}
 	length := binary.BigEndian.Uint32(lengthPrefix)
+	rq.Override = length&createOverrideFlag != 0
+	length &^= createOverrideFlag
+	if int(length) > buf.Len() {
+		return io.ErrUnexpectedEOF
+	}
 	topic := make([]byte, length)
 	m, err := io.ReadFull(buf, topic)
 	if err != nil {
@@ -688,8 +1545,666 @@ func (rq *CreateTopicRequest) Unmarshal(b []byte) error {
 	}
 	rq.Topic = string(topic)
 	rq.Schema = string(b[n+m:])
+	rq.Codec, rq.Encoding = "", ""
+	if idx := strings.IndexByte(rq.Schema, 0); idx != -1 {
+		rq.Codec = rq.Schema[idx+1:]
+		rq.Schema = rq.Schema[:idx]
+	}
+	if idx := strings.IndexByte(rq.Codec, 0); idx != -1 {
+		rq.Encoding = rq.Codec[idx+1:]
+		rq.Codec = rq.Codec[:idx]
+	}
 	if rq.Schema == "" {
 		rq.Schema = "string"
 	}
 	return nil
 }
+
+// FlushRequest
+//-------------------------
+
+// Marshal ...
+func (rq FlushRequest) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Unmarshal ...
+func (rq *FlushRequest) Unmarshal(b []byte) error {
+	return nil
+}
+
+// CreateSchemaRequest
+//-------------------------
+
+// Marshal ...
+func (rq CreateSchemaRequest) Marshal() ([]byte, error) {
+	b := binary.BigEndian.AppendUint32([]byte{}, uint32(len(rq.Name)))
+	b = append(b, rq.Name...)
+	b = append(b, rq.Schema...)
+	return b, nil
+}
+
+// Unmarshal ...
+func (rq *CreateSchemaRequest) Unmarshal(b []byte) error {
+	buf := bytes.NewBuffer(b)
+	var length uint32
+	err := binary.Read(buf, binary.BigEndian, &length)
+	if err != nil {
+		return err
+	}
+	if int(length) > buf.Len() {
+		return io.ErrUnexpectedEOF
+	}
+	name := make([]byte, length)
+	_, err = io.ReadFull(buf, name)
+	if err != nil {
+		return err
+	}
+	rq.Name = string(name)
+	rq.Schema = buf.String()
+	return nil
+}
+
+// CreateTemplateRequest
+//-------------------------
+
+// Marshal ...
+func (rq CreateTemplateRequest) Marshal() ([]byte, error) {
+	b := binary.BigEndian.AppendUint32([]byte{}, uint32(len(rq.Pattern)))
+	b = append(b, rq.Pattern...)
+	b = append(b, rq.Schema...)
+	return b, nil
+}
+
+// Unmarshal ...
+func (rq *CreateTemplateRequest) Unmarshal(b []byte) error {
+	buf := bytes.NewBuffer(b)
+	var length uint32
+	err := binary.Read(buf, binary.BigEndian, &length)
+	if err != nil {
+		return err
+	}
+	if int(length) > buf.Len() {
+		return io.ErrUnexpectedEOF
+	}
+	pattern := make([]byte, length)
+	_, err = io.ReadFull(buf, pattern)
+	if err != nil {
+		return err
+	}
+	rq.Pattern = string(pattern)
+	rq.Schema = buf.String()
+	return nil
+}
+
+// ValidateRequest
+//-------------------------
+
+// Flags leading a ValidateRequest
+const (
+	// validateCreateTopicFlag is set if CreateTopic is
+	validateCreateTopicFlag = 1 << iota
+	// validateOverrideFlag is set if Override is
+	validateOverrideFlag
+	// validateDataFlag is set if Data isn't nil
+	validateDataFlag
+)
+
+// Marshal ...
+func (rq ValidateRequest) Marshal() ([]byte, error) {
+	var flags byte
+	if rq.CreateTopic {
+		flags |= validateCreateTopicFlag
+	}
+	if rq.Override {
+		flags |= validateOverrideFlag
+	}
+	if rq.Data != nil {
+		flags |= validateDataFlag
+	}
+
+	b := []byte{flags}
+	for _, s := range []string{rq.Topic, rq.Schema, rq.Codec} {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+		b = append(b, s...)
+	}
+	b = append(b, rq.Data...)
+	return b, nil
+}
+
+// Unmarshal ...
+func (rq *ValidateRequest) Unmarshal(b []byte) error {
+	buf := bytes.NewBuffer(b)
+	flags, err := buf.ReadByte()
+	if err != nil {
+		return err
+	}
+	rq.CreateTopic = flags&validateCreateTopicFlag != 0
+	rq.Override = flags&validateOverrideFlag != 0
+
+	var fields [3]string
+	for i := range fields {
+		var length uint32
+		err = binary.Read(buf, binary.BigEndian, &length)
+		if err != nil {
+			return err
+		}
+		if int(length) > buf.Len() {
+			return io.ErrUnexpectedEOF
+		}
+		fields[i] = string(buf.Next(int(length)))
+	}
+	rq.Topic, rq.Schema, rq.Codec = fields[0], fields[1], fields[2]
+	if rq.Topic == "" {
+		rq.Topic = "/"
+	}
+
+	rq.Data = nil
+	if flags&validateDataFlag != 0 {
+		rq.Data = append([]byte{}, buf.Bytes()...)
+	}
+	return nil
+}
+
+// ChangesRequest
+//-------------------------
+
+// Marshal ...
+func (rq ChangesRequest) Marshal() ([]byte, error) {
+	b := binary.BigEndian.AppendUint64([]byte{}, rq.From)
+	b = binary.BigEndian.AppendUint32(b, rq.Limit)
+	b = binary.BigEndian.AppendUint64(b, uint64(rq.Wait))
+	return b, nil
+}
+
+// Unmarshal ...
+func (rq *ChangesRequest) Unmarshal(b []byte) error {
+	if len(b) < 20 {
+		return io.ErrUnexpectedEOF
+	}
+	rq.From = binary.BigEndian.Uint64(b)
+	rq.Limit = binary.BigEndian.Uint32(b[8:])
+	rq.Wait = time.Duration(binary.BigEndian.Uint64(b[12:]))
+	return nil
+}
+
+// ChangesResponse
+//-------------------------
+
+// Marshal ...
+func (rq ChangesResponse) Marshal() ([]byte, error) {
+	b := binary.BigEndian.AppendUint64([]byte{}, rq.Next)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(rq.Changes)))
+	for _, c := range rq.Changes {
+		var t int64
+		if !c.Time.IsZero() {
+			t = c.Time.UnixNano()
+		}
+		b = binary.BigEndian.AppendUint64(b, c.Offset)
+		b = binary.BigEndian.AppendUint64(b, uint64(t))
+		b = binary.BigEndian.AppendUint64(b, uint64(c.TTL))
+		for _, field := range [][]byte{[]byte(c.Kind), []byte(c.Topic), []byte(c.Name), []byte(c.Schema), []byte(c.Codec), c.Data} {
+			b = binary.BigEndian.AppendUint32(b, uint32(len(field)))
+			b = append(b, field...)
+		}
+	}
+	return b, nil
+}
+
+// Unmarshal ...
+func (rq *ChangesResponse) Unmarshal(b []byte) error {
+	buf := bytes.NewBuffer(b)
+	err := binary.Read(buf, binary.BigEndian, &rq.Next)
+	if err != nil {
+		return err
+	}
+	var count uint32
+	err = binary.Read(buf, binary.BigEndian, &count)
+	if err != nil {
+		return err
+	}
+
+	rq.Changes = []database.Change{}
+	for i := uint32(0); i < count; i++ {
+		c := database.Change{}
+		var t, ttl int64
+		for _, v := range []any{&c.Offset, &t, &ttl} {
+			err = binary.Read(buf, binary.BigEndian, v)
+			if err != nil {
+				return err
+			}
+		}
+		if t != 0 {
+			c.Time = time.Unix(0, t).UTC()
+		}
+		c.TTL = time.Duration(ttl)
+
+		var fields [6][]byte
+		for j := range fields {
+			var l uint32
+			err = binary.Read(buf, binary.BigEndian, &l)
+			if err != nil {
+				return err
+			}
+			if int(l) > buf.Len() {
+				return io.ErrUnexpectedEOF
+			}
+			fields[j] = buf.Next(int(l))
+		}
+		c.Kind = database.ChangeKind(fields[0])
+		c.Topic, c.Name, c.Schema, c.Codec = string(fields[1]), string(fields[2]), string(fields[3]), string(fields[4])
+		if len(fields[5]) > 0 {
+			c.Data = append([]byte{}, fields[5]...)
+		}
+		rq.Changes = append(rq.Changes, c)
+	}
+	return nil
+}
+
+// unixNanos returns t in nanoseconds since the unix epoch, or 0 if t is zero
+func unixNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNanos is the inverse of unixNanos
+func fromUnixNanos(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
+
+// PingRequest
+//-------------------------
+
+// Marshal ...
+func (rq PingRequest) Marshal() ([]byte, error) {
+	return binary.BigEndian.AppendUint64([]byte{}, uint64(unixNanos(rq.Sent))), nil
+}
+
+// Unmarshal ...
+func (rq *PingRequest) Unmarshal(b []byte) error {
+	// The timestamp is optional, so that a bare PING can be sent by hand
+	rq.Sent = time.Time{}
+	if len(b) == 0 {
+		return nil
+	}
+	if len(b) < 8 {
+		return io.ErrUnexpectedEOF
+	}
+	rq.Sent = fromUnixNanos(int64(binary.BigEndian.Uint64(b)))
+	return nil
+}
+
+// PingResponse
+//-------------------------
+
+// Marshal ...
+func (rq PingResponse) Marshal() ([]byte, error) {
+	b := binary.BigEndian.AppendUint64([]byte{}, uint64(unixNanos(rq.Sent)))
+	b = binary.BigEndian.AppendUint64(b, uint64(unixNanos(rq.Received)))
+	return b, nil
+}
+
+// Unmarshal ...
+func (rq *PingResponse) Unmarshal(b []byte) error {
+	if len(b) < 16 {
+		return io.ErrUnexpectedEOF
+	}
+	rq.Sent = fromUnixNanos(int64(binary.BigEndian.Uint64(b)))
+	rq.Received = fromUnixNanos(int64(binary.BigEndian.Uint64(b[8:])))
+	return nil
+}
+
+func (rq PingResponse) Headers() []string {
+	return []string{"round_trip", "server_time"}
+}
+
+func (rq PingResponse) Values() [][]string {
+	return [][]string{{rq.RoundTrip.String(), rq.Received.Format(time.RFC3339Nano)}}
+}
+
+// DescribeRequest
+//-------------------------
+
+// Marshal ...
+func (rq DescribeRequest) Marshal() ([]byte, error) {
+	return []byte(rq.Topic), nil
+}
+
+// Unmarshal ...
+func (rq *DescribeRequest) Unmarshal(b []byte) error {
+	rq.Topic = strings.TrimSpace(string(b))
+	if rq.Topic == "" {
+		rq.Topic = "/"
+	}
+	return nil
+}
+
+// DescribeResponse
+//-------------------------
+
+// Marshal ...
+func (rq DescribeResponse) Marshal() ([]byte, error) {
+	var first, last int64
+	if rq.Count > 0 {
+		first = rq.First.UnixNano()
+		last = rq.Last.UnixNano()
+	}
+
+	b := binary.BigEndian.AppendUint64([]byte{}, rq.Count)
+	b = binary.BigEndian.AppendUint64(b, uint64(first))
+	b = binary.BigEndian.AppendUint64(b, uint64(last))
+	for _, str := range []string{rq.Topic, rq.Schema, rq.ParentSchema, rq.Codec, rq.Encoding} {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(str)))
+		b = append(b, str...)
+	}
+	return b, nil
+}
+
+// Unmarshal ...
+func (rq *DescribeResponse) Unmarshal(b []byte) error {
+	buf := bytes.NewBuffer(b)
+	err := binary.Read(buf, binary.BigEndian, &rq.Count)
+	if err != nil {
+		return err
+	}
+	var first, last int64
+	err = binary.Read(buf, binary.BigEndian, &first)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(buf, binary.BigEndian, &last)
+	if err != nil {
+		return err
+	}
+	rq.First, rq.Last = time.Time{}, time.Time{}
+	if rq.Count > 0 {
+		rq.First = time.Unix(0, first).UTC()
+		rq.Last = time.Unix(0, last).UTC()
+	}
+
+	// The encoding was added later, so older servers don't send it
+	rq.Encoding = ""
+	for _, str := range []*string{&rq.Topic, &rq.Schema, &rq.ParentSchema, &rq.Codec, &rq.Encoding} {
+		if str == &rq.Encoding && buf.Len() == 0 {
+			break
+		}
+		var l uint32
+		err = binary.Read(buf, binary.BigEndian, &l)
+		if err != nil {
+			return err
+		}
+		if int(l) > buf.Len() {
+			return io.ErrUnexpectedEOF
+		}
+		field := make([]byte, l)
+		_, err = io.ReadFull(buf, field)
+		if err != nil {
+			return err
+		}
+		*str = string(field)
+	}
+	return nil
+}
+
+func (v DescribeResponse) Headers() []string {
+	return []string{"topic", "schema", "parent_schema", "codec", "encoding", "count", "first", "last"}
+}
+
+func (v DescribeResponse) Values() [][]string {
+	codec := v.Codec
+	if codec == "" {
+		codec = "binary"
+	}
+	encoding := v.Encoding
+	if encoding == "" {
+		encoding = "none"
+	}
+
+	first, last := "", ""
+	if v.Count > 0 {
+		first = v.First.Format(time.RFC3339Nano)
+		last = v.Last.Format(time.RFC3339Nano)
+	}
+
+	return [][]string{
+		{
+			v.Topic,
+			v.Schema,
+			v.ParentSchema,
+			codec,
+			encoding,
+			fmt.Sprintf("%d", v.Count),
+			first,
+			last,
+		},
+	}
+}
+
+// ListTopicsRequest
+//-------------------------
+
+// Marshal ...
+func (rq ListTopicsRequest) Marshal() ([]byte, error) {
+	b := binary.BigEndian.AppendUint32([]byte{}, rq.Limit)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(rq.After)))
+	b = append(b, rq.After...)
+	b = append(b, rq.Prefix...)
+	return b, nil
+}
+
+// Unmarshal ...
+func (rq *ListTopicsRequest) Unmarshal(b []byte) error {
+	buf := bytes.NewBuffer(b)
+	err := binary.Read(buf, binary.BigEndian, &rq.Limit)
+	if err != nil {
+		return err
+	}
+	var length uint32
+	err = binary.Read(buf, binary.BigEndian, &length)
+	if err != nil {
+		return err
+	}
+	if int(length) > buf.Len() {
+		return io.ErrUnexpectedEOF
+	}
+	after := make([]byte, length)
+	_, err = io.ReadFull(buf, after)
+	if err != nil {
+		return err
+	}
+	rq.After = string(after)
+	rq.Prefix = buf.String()
+	return nil
+}
+
+// ListTopicsResponse
+//-------------------------
+
+// Marshal ...
+func (rq ListTopicsResponse) Marshal() ([]byte, error) {
+	b := binary.BigEndian.AppendUint32([]byte{}, uint32(len(rq.Topics)))
+	for _, topic := range rq.Topics {
+		for _, str := range []string{topic.Topic, topic.Schema, topic.Codec} {
+			b = binary.BigEndian.AppendUint32(b, uint32(len(str)))
+			b = append(b, str...)
+		}
+		b = binary.BigEndian.AppendUint64(b, topic.Count)
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(len(rq.Next)))
+	b = append(b, rq.Next...)
+	return b, nil
+}
+
+// Unmarshal ...
+func (rq *ListTopicsResponse) Unmarshal(b []byte) error {
+	buf := bytes.NewBuffer(b)
+
+	readString := func() (string, error) {
+		var l uint32
+		err := binary.Read(buf, binary.BigEndian, &l)
+		if err != nil {
+			return "", err
+		}
+		if int(l) > buf.Len() {
+			return "", io.ErrUnexpectedEOF
+		}
+		str := make([]byte, l)
+		_, err = io.ReadFull(buf, str)
+		return string(str), err
+	}
+
+	var count uint32
+	err := binary.Read(buf, binary.BigEndian, &count)
+	if err != nil {
+		return err
+	}
+	rq.Topics = []TopicSummary{}
+	for i := uint32(0); i < count; i++ {
+		var topic TopicSummary
+		for _, str := range []*string{&topic.Topic, &topic.Schema, &topic.Codec} {
+			*str, err = readString()
+			if err != nil {
+				return err
+			}
+		}
+		err = binary.Read(buf, binary.BigEndian, &topic.Count)
+		if err != nil {
+			return err
+		}
+		rq.Topics = append(rq.Topics, topic)
+	}
+
+	rq.Next, err = readString()
+	return err
+}
+
+func (v ListTopicsResponse) Headers() []string {
+	return []string{"topic", "schema", "codec", "count"}
+}
+
+func (v ListTopicsResponse) Values() [][]string {
+	res := [][]string{}
+	for _, topic := range v.Topics {
+		codec := topic.Codec
+		if codec == "" {
+			codec = "binary"
+		}
+		res = append(res, []string{topic.Topic, topic.Schema, codec, fmt.Sprintf("%d", topic.Count)})
+	}
+	return res
+}
+
+// Statuses of a database in a DatabaseStatusResponse
+const (
+	DatabaseOpen     = "open"
+	DatabaseDegraded = "degraded"
+)
+
+// DatabaseStatusRequest
+//-------------------------
+
+// Marshal ...
+func (rq DatabaseStatusRequest) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Unmarshal ...
+func (rq *DatabaseStatusRequest) Unmarshal(b []byte) error {
+	return nil
+}
+
+// DatabaseStatusResponse
+//-------------------------
+
+// Marshal ...
+func (rq DatabaseStatusResponse) Marshal() ([]byte, error) {
+	b := binary.BigEndian.AppendUint32([]byte{}, uint32(len(rq.Databases)))
+	for _, db := range rq.Databases {
+		for _, str := range []string{db.Name, db.Status} {
+			b = binary.BigEndian.AppendUint32(b, uint32(len(str)))
+			b = append(b, str...)
+		}
+		var lastFlush int64
+		if !db.LastFlush.IsZero() {
+			lastFlush = db.LastFlush.UnixNano()
+		}
+		b = binary.BigEndian.AppendUint64(b, db.Size)
+		b = binary.BigEndian.AppendUint64(b, db.Topics)
+		b = binary.BigEndian.AppendUint64(b, uint64(lastFlush))
+		b = binary.BigEndian.AppendUint64(b, uint64(db.Uptime))
+	}
+	return b, nil
+}
+
+// Unmarshal ...
+func (rq *DatabaseStatusResponse) Unmarshal(b []byte) error {
+	buf := bytes.NewBuffer(b)
+
+	var count uint32
+	err := binary.Read(buf, binary.BigEndian, &count)
+	if err != nil {
+		return err
+	}
+	rq.Databases = []DatabaseStatus{}
+	for i := uint32(0); i < count; i++ {
+		var db DatabaseStatus
+		for _, str := range []*string{&db.Name, &db.Status} {
+			var l uint32
+			err = binary.Read(buf, binary.BigEndian, &l)
+			if err != nil {
+				return err
+			}
+			if int(l) > buf.Len() {
+				return io.ErrUnexpectedEOF
+			}
+			field := make([]byte, l)
+			_, err = io.ReadFull(buf, field)
+			if err != nil {
+				return err
+			}
+			*str = string(field)
+		}
+
+		var lastFlush, uptime int64
+		for _, n := range []any{&db.Size, &db.Topics, &lastFlush, &uptime} {
+			err = binary.Read(buf, binary.BigEndian, n)
+			if err != nil {
+				return err
+			}
+		}
+		if lastFlush != 0 {
+			db.LastFlush = time.Unix(0, lastFlush).UTC()
+		}
+		db.Uptime = time.Duration(uptime)
+		rq.Databases = append(rq.Databases, db)
+	}
+	return nil
+}
+
+func (v DatabaseStatusResponse) Headers() []string {
+	return []string{"database", "status", "size", "topics", "last_flush", "uptime"}
+}
+
+func (v DatabaseStatusResponse) Values() [][]string {
+	res := [][]string{}
+	for _, db := range v.Databases {
+		lastFlush := "never"
+		if !db.LastFlush.IsZero() {
+			lastFlush = db.LastFlush.Format(time.RFC3339Nano)
+		}
+		res = append(res, []string{
+			db.Name,
+			db.Status,
+			humanize.Bytes(db.Size),
+			fmt.Sprintf("%d", db.Topics),
+			lastFlush,
+			db.Uptime.Round(time.Second).String(),
+		})
+	}
+	return res
+}
@@ -9,6 +9,8 @@ package proto
 import (
 	"bytes"
 	"errors"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -41,6 +43,82 @@ func TestMessageMarshaling(t *testing.T) {
 	}
 }
 
+func TestMessageRequestID(t *testing.T) {
+	m := WithRequestID(NewMessageWithType(CommandQuery, QueryRequest{Query: "all"}), "abc123")
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadMessageFull(bytes.NewBuffer(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.RequestID() != "abc123" || read.Command() != CommandQuery || !bytes.Equal(read.Data(), m.Data()) {
+		t.Errorf("unexpected message %s %q %v", read.Command(), read.RequestID(), read.Data())
+	}
+
+	// The ID survives compression, which only applies to the data
+	big := WithRequestID(NewMessage(CommandQuery, bytes.Repeat([]byte("a"), 1024)), "abc123")
+	b, _ = Compress(big, CompressionGzip, 0).Marshal()
+	read, err = ReadMessageFull(bytes.NewBuffer(b))
+	if err != nil || read.RequestID() != "abc123" || !bytes.Equal(read.Data(), big.Data()) {
+		t.Errorf("expected compressed message to keep its request ID, got %q, %v", read.RequestID(), err)
+	}
+
+	// The longest ID allowed round trips, rather than wrapping its length
+	longest := strings.Repeat("a", MaxRequestIDLength)
+	b, err = WithRequestID(m, longest).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err = ReadMessageFull(bytes.NewBuffer(b))
+	if err != nil || read.RequestID() != longest || !bytes.Equal(read.Data(), m.Data()) {
+		t.Errorf("expected a request ID of %d bytes to round trip, got %d bytes, %v", MaxRequestIDLength, len(read.RequestID()), err)
+	}
+
+	if _, err := WithRequestID(m, string(make([]byte, MaxRequestIDLength+1))).Marshal(); err == nil {
+		t.Error("expected an overlong request ID to fail to marshal")
+	}
+}
+
+func TestReadMessageLimited(t *testing.T) {
+	buf := new(bytes.Buffer)
+	big, _ := NewMessageWithType(CommandAppend, AppendRequest{Topic: "/", Data: make([]byte, 64)}).Marshal()
+	small, _ := NewMessage(CommandFlush, nil).Marshal()
+	buf.Write(big)
+	buf.Write(small)
+
+	_, err := ReadMessageLimited(buf, 32)
+	var limitErr LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != 32 {
+		t.Fatalf("expected a LimitError, got %v", err)
+	}
+
+	// The oversized message is skipped, so the next one can still be read
+	m, err := ReadMessageLimited(buf, 32)
+	if err != nil || m.Command() != CommandFlush {
+		t.Errorf("expected to read the next message, got %v, %v", m, err)
+	}
+}
+
+func TestLimitsCheckAppend(t *testing.T) {
+	l := Limits{MaxAppendSize: 4, MaxTopicLength: 4}
+
+	if err := l.CheckAppend(AppendRequest{Topic: "/foo", Data: []byte("data")}); err != nil {
+		t.Errorf("expected append within limits to pass, got %v", err)
+	}
+	if err := l.CheckAppend(AppendRequest{Topic: "/foo", Data: []byte("datum")}); err == nil {
+		t.Error("expected oversized payload to be rejected")
+	}
+	if err := l.CheckAppend(AppendRequest{Topic: "/fooo", Data: []byte("data")}); err == nil {
+		t.Error("expected long topic name to be rejected")
+	}
+	if err := (Limits{}).CheckAppend(AppendRequest{Topic: "/fooo", Data: make([]byte, 1024)}); err != nil {
+		t.Errorf("expected zero limits to accept anything, got %v", err)
+	}
+}
+
 func BenchmarkReadMessageFull(b *testing.B) {
 	buf := new(bytes.Buffer)
 	rw := NewResponseWriter(buf)
@@ -61,7 +139,7 @@ func TestVersionRequest(t *testing.T) {
 		t.Fail()
 	}
 
-	req = VersionRequest{"v1.2.3"}
+	req = VersionRequest{Version: "v1.2.3"}
 	b, _ = req.Marshal()
 	if !bytes.Equal(b, []byte(Version)) {
 		t.Fail()
@@ -90,6 +168,70 @@ func TestVersionResponse(t *testing.T) {
 	}
 }
 
+func TestVersionCompression(t *testing.T) {
+	req := VersionRequest{Compression: []string{"lz4", CompressionGzip}}
+	b, _ := req.Marshal()
+	req = VersionRequest{}
+	err := req.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Version != Version || !reflect.DeepEqual(req.Compression, []string{"lz4", CompressionGzip}) {
+		t.Errorf("expected version %s offering lz4 and gzip, got %+v", Version, req)
+	}
+
+	if c := NegotiateCompression(req.Compression); c != CompressionGzip {
+		t.Errorf("expected gzip to be negotiated, got %q", c)
+	}
+	if c := NegotiateCompression(nil); c != "" {
+		t.Errorf("expected no compression without an offer, got %q", c)
+	}
+
+	resp := VersionResponse{Code: 200, Compression: CompressionGzip}
+	b, _ = resp.Marshal()
+	resp = VersionResponse{}
+	err = resp.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Version != Version || resp.Compression != CompressionGzip {
+		t.Errorf("expected version %s compressed with gzip, got %+v", Version, resp)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	data := bytes.Repeat([]byte("2023-01-02T03:04:05Z\t/foo\tKgAAAA==\tint32\n"), 100)
+	m := NewMessage(CommandQuery, data)
+
+	if c := Compress(m, "", 0); c != m {
+		t.Error("expected a message not to be compressed without an algorithm")
+	}
+	if c := Compress(m, CompressionGzip, len(data)); c != m {
+		t.Error("expected a message not above the threshold not to be compressed")
+	}
+
+	plain, _ := m.Marshal()
+	wire, _ := Compress(m, CompressionGzip, 0).Marshal()
+	if len(wire) >= len(plain) {
+		t.Errorf("expected compressed message to be smaller than %d bytes, got %d", len(plain), len(wire))
+	}
+
+	read, err := ReadMessageFull(bytes.NewBuffer(wire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Command() != CommandQuery || !bytes.Equal(read.Data(), data) {
+		t.Errorf("expected compressed message to be read back as is, got %s", read.Data())
+	}
+
+	// The limit applies to the decompressed message, not just what's sent
+	_, err = ReadMessageLimited(bytes.NewBuffer(wire), len(wire))
+	var limitErr LimitError
+	if !errors.As(err, &limitErr) || limitErr.What != "decompressed message" {
+		t.Errorf("expected a LimitError for the decompressed message, got %v", err)
+	}
+}
+
 func TestUseRequest(t *testing.T) {
 	req := UseRequest{}
 
@@ -115,6 +257,19 @@ func TestUseRequest(t *testing.T) {
 	}
 }
 
+func TestNotice(t *testing.T) {
+	n := Notice{Level: NoticeDeprecation, Message: "STATS is deprecated"}
+
+	b, _ := n.Marshal()
+	var got Notice
+	if err := got.Unmarshal(b); err != nil || got != n {
+		t.Errorf("expected %+v, got %+v (%v)", n, got, err)
+	}
+	if err := got.Unmarshal([]byte("no level")); err == nil {
+		t.Error("expected a notice without a level to fail")
+	}
+}
+
 func TestOkResponse(t *testing.T) {
 	req := OkResponse{Code: 200, Message: "test"}
 
@@ -187,6 +342,78 @@ func TestAppendRequest(t *testing.T) {
 			t.Fail()
 		}
 	})
+
+	t.Run("create topic", func(t *testing.T) {
+		req := AppendRequest{Topic: "/new", Data: []byte("woohoo"), CreateTopic: true}
+
+		b, _ := req.Marshal()
+		req = AppendRequest{}
+		err := req.Unmarshal(b)
+		if err != nil {
+			t.Fail()
+		}
+
+		// Check fields
+		if req.Topic != "/new" || !req.CreateTopic {
+			t.Errorf("expected /new with CreateTopic set, got %+v", req)
+		}
+		if !bytes.Equal(req.Data, []byte("woohoo")) {
+			t.Fail()
+		}
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		req := AppendRequest{Topic: "/presence", Data: []byte("here"), CreateTopic: true, TTL: 30 * time.Second}
+
+		b, _ := req.Marshal()
+		req = AppendRequest{}
+		err := req.Unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if req.Topic != "/presence" || !req.CreateTopic || req.TTL != 30*time.Second {
+			t.Errorf("expected /presence with CreateTopic and a TTL of 30s, got %+v", req)
+		}
+		if !bytes.Equal(req.Data, []byte("here")) {
+			t.Errorf("expected data to follow the TTL, got %q", req.Data)
+		}
+	})
+	t.Run("ack", func(t *testing.T) {
+		req := AppendRequest{Topic: "/acked", Data: []byte("here"), Ack: true}
+
+		b, _ := req.Marshal()
+		req = AppendRequest{}
+		err := req.Unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if req.Topic != "/acked" || !req.Ack || req.CreateTopic {
+			t.Errorf("expected /acked with Ack, got %+v", req)
+		}
+		if !bytes.Equal(req.Data, []byte("here")) {
+			t.Errorf("expected data to follow the topic, got %q", req.Data)
+		}
+	})
+}
+
+func TestAppendResponse(t *testing.T) {
+	resp := AppendResponse{Code: 208, Time: time.Date(2023, 1, 2, 3, 4, 5, 6, time.UTC), Sequence: 42}
+
+	b, _ := resp.Marshal()
+	var got AppendResponse
+	err := got.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != resp {
+		t.Errorf("expected %+v, got %+v", resp, got)
+	}
+
+	if err = got.Unmarshal(b[:19]); err == nil {
+		t.Error("expected a truncated response not to unmarshal")
+	}
 }
 
 func TestQueryRequest(t *testing.T) {
@@ -204,6 +431,133 @@ func TestQueryRequest(t *testing.T) {
 	}
 }
 
+func TestQueryRequestProfile(t *testing.T) {
+	req := QueryRequest{Query: "all", Profile: true}
+
+	b, _ := req.Marshal()
+	req = QueryRequest{}
+	err := req.Unmarshal(b)
+	if err != nil {
+		t.Fail()
+	}
+
+	if req.Query != "all" || !req.Profile {
+		t.Errorf("expected a profiled query for 'all', got %+v", req)
+	}
+}
+
+func TestQueryResponseProfile(t *testing.T) {
+	profile := QueryProfile{
+		{Name: "retrieve", RowsOut: 10, Duration: time.Millisecond},
+		{Name: "filter", RowsIn: 10, RowsOut: 4, Duration: time.Microsecond},
+	}
+	req := QueryResponse{Results: database.Entries{}, Profile: profile}
+
+	b, _ := req.Marshal()
+	req = QueryResponse{}
+	err := req.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(req.Profile, profile) {
+		t.Errorf("expected profile %v, got %v", profile, req.Profile)
+	}
+
+	// Responses without a profile shouldn't grow one
+	req = QueryResponse{Results: database.Entries{}}
+	b, _ = req.Marshal()
+	err = req.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Profile != nil {
+		t.Errorf("expected no profile, got %v", req.Profile)
+	}
+}
+
+func TestQueryResponseMetadata(t *testing.T) {
+	req := QueryRequest{Query: "all", Metadata: true}
+	b, _ := req.Marshal()
+	req = QueryRequest{}
+	err := req.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Query != "all" || req.Profile || !req.Metadata {
+		t.Errorf("expected a query for 'all' with metadata, got %+v", req)
+	}
+
+	metadata := &QueryMetadata{
+		Matched:   10,
+		Returned:  4,
+		Truncated: true,
+		Start:     time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		End:       time.Date(2023, 1, 2, 12, 30, 0, 500, time.UTC),
+	}
+	profile := QueryProfile{{Name: "retrieve", RowsOut: 10, Duration: time.Millisecond}}
+
+	// Metadata follows the profile, and needs to survive with or without one
+	for _, p := range []QueryProfile{nil, profile} {
+		resp := QueryResponse{Results: database.Entries{}, Profile: p, Metadata: metadata}
+		b, _ = resp.Marshal()
+		resp = QueryResponse{}
+		err = resp.Unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp.Profile, p) {
+			t.Errorf("expected profile %v, got %v", p, resp.Profile)
+		}
+		if !reflect.DeepEqual(resp.Metadata, metadata) {
+			t.Errorf("expected metadata %+v, got %+v", metadata, resp.Metadata)
+		}
+	}
+}
+
+func TestQueryResponseSequences(t *testing.T) {
+	req := QueryRequest{Query: "all", Sequences: true}
+	b, _ := req.Marshal()
+	req = QueryRequest{}
+	err := req.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !req.Sequences || req.Metadata {
+		t.Errorf("expected a query for sequence numbers without metadata, got %+v", req)
+	}
+
+	results := database.Entries{
+		{Time: time.Unix(1, 0).UTC(), Topic: "/a", Schema: "string", Data: []byte("x"), Sequence: 3},
+		{Time: time.Unix(1, 0).UTC(), Topic: "/b", Schema: "string", Data: []byte("y"), Sequence: 5},
+	}
+
+	// Sequence numbers follow the metadata, which is sent even if it wasn't
+	// asked for
+	resp := QueryResponse{Results: results, Sequences: true}
+	b, _ = resp.Marshal()
+	resp = QueryResponse{}
+	err = resp.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Sequences || !reflect.DeepEqual(resp.Results, results) {
+		t.Errorf("expected results %+v with sequence numbers, got %+v", results, resp.Results)
+	}
+	if resp.Metadata == nil || resp.Metadata.Returned != 2 {
+		t.Errorf("expected metadata describing the results, got %+v", resp.Metadata)
+	}
+
+	// Responses without them leave results unnumbered
+	resp = QueryResponse{Results: results}
+	b, _ = resp.Marshal()
+	resp = QueryResponse{}
+	resp.Unmarshal(b)
+	if resp.Sequences || resp.Results[0].Sequence != 0 {
+		t.Errorf("expected no sequence numbers, got %+v", resp.Results)
+	}
+}
+
 func TestQueryResponse(t *testing.T) {
 	req := QueryResponse{Results: database.Entries{}}
 
@@ -249,6 +603,43 @@ func TestQueryResponse(t *testing.T) {
 	}
 }
 
+func TestQueryResponseBinary(t *testing.T) {
+	// Data containing the delimiters of the old string encoding, and results
+	// sharing topics and schemas
+	results := database.Entries{
+		{Time: time.Date(2023, 1, 2, 3, 4, 5, 6, time.UTC), Topic: "/foo", Schema: "string", Data: []byte("a\tb\nc\x00")},
+		{Time: time.Date(2023, 1, 2, 3, 4, 6, 0, time.UTC), Topic: "/bar", Schema: "string", Data: []byte{}},
+		{Time: time.Date(2023, 1, 2, 3, 4, 7, 0, time.UTC), Topic: "/foo", Schema: "int32", Data: []byte{42, 0, 0, 0}},
+		// Results computed by reduce stages have no time
+		{Topic: "/foo", Schema: "int32", Data: []byte{1, 0, 0, 0}},
+	}
+
+	b, err := QueryResponse{Results: results}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("/foo")); n != 1 {
+		t.Errorf("expected /foo to be encoded once, got %d times", n)
+	}
+
+	resp := QueryResponse{}
+	err = resp.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resp.Results, results) {
+		t.Errorf("expected %v, got %v", results, resp.Results)
+	}
+
+	// Indices past the end of the dictionaries are rejected
+	b, _ = QueryResponse{Results: results[:1]}.Marshal()
+	b[len(b)-len(results[0].Data)-9] = 1
+	resp = QueryResponse{}
+	if err = resp.Unmarshal(b); err == nil {
+		t.Error("expected an out of range topic index to be rejected")
+	}
+}
+
 func TestStatsRequest(t *testing.T) {
 	req := StatsRequest{Database: "default"}
 
@@ -299,6 +690,42 @@ func TestListRequest(t *testing.T) {
 	}
 }
 
+func TestListTopicsRequest(t *testing.T) {
+	req := ListTopicsRequest{Prefix: "/foo", After: "/foo/bar", Limit: 10}
+
+	b, _ := req.Marshal()
+	var res ListTopicsRequest
+	err := res.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res != req {
+		t.Errorf("expected %+v, got %+v", req, res)
+	}
+}
+
+func TestListTopicsResponse(t *testing.T) {
+	req := ListTopicsResponse{
+		Topics: []TopicSummary{
+			{Topic: "/a topic", Schema: "{\"a b\": int32,}", Count: 3},
+			{Topic: "/b", Schema: "string", Codec: "json"},
+		},
+		Next: "/b",
+	}
+
+	b, _ := req.Marshal()
+	var res ListTopicsResponse
+	err := res.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(res, req) {
+		t.Errorf("expected %+v, got %+v", req, res)
+	}
+}
+
 func TestListResponse(t *testing.T) {
 	req := ListResponse{ObjectList: []string{"y", "2", "k"}}
 
@@ -358,4 +785,209 @@ func TestCreateTopicRequest(t *testing.T) {
 	if req.Schema != "string" {
 		t.Fail()
 	}
+
+	req = CreateTopicRequest{Topic: "/foo/bar", Schema: "{x:int32}", Codec: "json"}
+
+	b, _ = req.Marshal()
+	req = CreateTopicRequest{}
+	err = req.Unmarshal(b)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+
+	if req.Schema != "{x:int32}" {
+		t.Fail()
+	}
+
+	if req.Codec != "json" {
+		t.Fail()
+	}
+
+	req = CreateTopicRequest{Topic: "/foo/bar", Schema: "float64", Encoding: "gorilla"}
+
+	b, _ = req.Marshal()
+	req = CreateTopicRequest{}
+	err = req.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.Schema != "float64" || req.Codec != "" || req.Encoding != "gorilla" {
+		t.Errorf("unexpected request %+v", req)
+	}
+
+	req = CreateTopicRequest{Topic: "/foo/bar", Schema: "float64", Override: true}
+
+	b, _ = req.Marshal()
+	req = CreateTopicRequest{}
+	err = req.Unmarshal(b)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+
+	if req.Topic != "/foo/bar" || req.Schema != "float64" || !req.Override {
+		t.Errorf("unexpected request %+v", req)
+	}
+}
+
+func TestDescribeResponse(t *testing.T) {
+	first := time.Date(2023, time.March, 1, 12, 0, 0, 500, time.UTC)
+	req := DescribeResponse{
+		Topic:        "/sensors/garage",
+		Schema:       "int32",
+		ParentSchema: "int32",
+		Codec:        "json",
+		Encoding:     "delta",
+		Count:        42,
+		First:        first,
+		Last:         first.Add(time.Hour),
+	}
+
+	b, _ := req.Marshal()
+	actual := DescribeResponse{}
+	err := actual.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual != req {
+		t.Errorf("expected %+v, got %+v", req, actual)
+	}
+
+	// Empty topics have no first or last entry
+	req = DescribeResponse{Topic: "/", Schema: "string", First: first}
+	b, _ = req.Marshal()
+	err = actual.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !actual.First.IsZero() || !actual.Last.IsZero() {
+		t.Errorf("expected zero times for an empty topic, got %v and %v", actual.First, actual.Last)
+	}
+
+	// Older servers don't send the encoding
+	req = DescribeResponse{Topic: "/", Schema: "string"}
+	b, _ = req.Marshal()
+	err = actual.Unmarshal(b[:len(b)-4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != req {
+		t.Errorf("expected %+v, got %+v", req, actual)
+	}
+}
+
+func TestCreateTemplateRequest(t *testing.T) {
+	req := CreateTemplateRequest{Pattern: "/devices/*/temp", Schema: "float32"}
+	b, _ := req.Marshal()
+
+	actual := CreateTemplateRequest{}
+	err := actual.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != req {
+		t.Errorf("expected %+v, got %+v", req, actual)
+	}
+
+	if err = actual.Unmarshal([]byte{0, 0, 0, 9, '/'}); err == nil {
+		t.Error("expected a truncated pattern to fail")
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	tests := []ValidateRequest{
+		{Topic: "/foo", Data: []byte{42, 0, 0, 0}},
+		{Topic: "/foo", Data: []byte{}},
+		{Topic: "/foo", Schema: "int32", Codec: "json", CreateTopic: true, Override: true},
+	}
+
+	for _, req := range tests {
+		b, _ := req.Marshal()
+		actual := ValidateRequest{}
+		err := actual.Unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, req) {
+			t.Errorf("expected %+v, got %+v", req, actual)
+		}
+	}
+
+	actual := ValidateRequest{}
+	if err := actual.Unmarshal([]byte{0, 0, 0, 0, 9, '/'}); err == nil {
+		t.Error("expected a truncated topic to fail")
+	}
+}
+
+func TestChangesMessages(t *testing.T) {
+	req := ChangesRequest{From: 12, Limit: 100, Wait: time.Second}
+	b, _ := req.Marshal()
+	actualReq := ChangesRequest{}
+	if err := actualReq.Unmarshal(b); err != nil || actualReq != req {
+		t.Errorf("expected %+v, got %+v, %v", req, actualReq, err)
+	}
+
+	resp := ChangesResponse{
+		Changes: []database.Change{
+			{Offset: 3, Kind: database.ChangeCreateTopic, Topic: "/temp", Schema: "int32"},
+			{Offset: 5, Kind: database.ChangeAppend, Topic: "/temp", Schema: "int32", Time: time.Unix(1, 2).UTC(), Data: []byte{1, 0, 0, 0}, TTL: time.Hour},
+			{Offset: 6, Kind: database.ChangeAddTemplate, Name: "/devices/*", Schema: "float32"},
+		},
+		Next: 7,
+	}
+	b, _ = resp.Marshal()
+	actualResp := ChangesResponse{}
+	if err := actualResp.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actualResp, resp) {
+		t.Errorf("expected %+v, got %+v", resp, actualResp)
+	}
+
+	if err := actualResp.Unmarshal(b[:len(b)-2]); err == nil {
+		t.Error("expected a truncated response to fail")
+	}
+}
+
+func TestPingMessages(t *testing.T) {
+	req := PingRequest{Sent: time.Unix(10, 20).UTC()}
+	b, _ := req.Marshal()
+	actualReq := PingRequest{}
+	if err := actualReq.Unmarshal(b); err != nil || actualReq != req {
+		t.Errorf("expected %+v, got %+v, %v", req, actualReq, err)
+	}
+
+	// The sent time is optional
+	if err := actualReq.Unmarshal(nil); err != nil || !actualReq.Sent.IsZero() {
+		t.Errorf("expected an empty ping to have no sent time, got %+v, %v", actualReq, err)
+	}
+
+	resp := PingResponse{Received: time.Unix(11, 0).UTC()}
+	b, _ = resp.Marshal()
+	actualResp := PingResponse{}
+	if err := actualResp.Unmarshal(b); err != nil || actualResp != resp {
+		t.Errorf("expected %+v, got %+v, %v", resp, actualResp, err)
+	}
+	if err := actualResp.Unmarshal(b[:12]); err == nil {
+		t.Error("expected a truncated response to fail")
+	}
+}
+
+func TestCreateSchemaRequest(t *testing.T) {
+	req := CreateSchemaRequest{Name: "point", Schema: `{"x":int32,"y":int32}`}
+
+	b, _ := req.Marshal()
+	actual := CreateSchemaRequest{}
+	err := actual.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual != req {
+		t.Errorf("expected %+v, got %+v", req, actual)
+	}
 }
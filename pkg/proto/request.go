@@ -7,12 +7,24 @@
 package proto
 
 import (
+	"context"
+
 	"github.com/dburkart/fossil/pkg/database"
+	"github.com/rs/zerolog"
 )
 
 type Request struct {
 	msg Message
 	db  *database.Database
+	acl *TopicACL
+	// compression is the algorithm negotiated by the client, if any
+	compression string
+	remoteAddr  string
+	// listener is the name of the listener the request was received on
+	listener string
+	// requestID is the ID sent by the client, or one generated for it
+	requestID string
+	ctx       context.Context
 }
 
 // NewRequest creates a new request from the line message and the current
@@ -24,6 +36,59 @@ func NewRequest(msg Message, db *database.Database) *Request {
 	}
 }
 
+// NewRequestWithACL creates a new request like NewRequest, for a client
+// restricted by acl
+func NewRequestWithACL(msg Message, db *database.Database, acl *TopicACL) *Request {
+	return &Request{
+		msg: msg,
+		db:  db,
+		acl: acl,
+	}
+}
+
+// WithCompression records the compression algorithm negotiated by the client
+// which made the request, and returns the request
+func (r *Request) WithCompression(algorithm string) *Request {
+	r.compression = algorithm
+	return r
+}
+
+// WithRemoteAddr records the address of the client which made the request,
+// and returns the request
+func (r *Request) WithRemoteAddr(addr string) *Request {
+	r.remoteAddr = addr
+	return r
+}
+
+// WithListener records the name of the listener the request was received on,
+// and returns the request
+func (r *Request) WithListener(name string) *Request {
+	r.listener = name
+	return r
+}
+
+// WithRequestID records the ID of the request, for clients which didn't send
+// one, and returns the request
+func (r *Request) WithRequestID(id string) *Request {
+	r.requestID = id
+	return r
+}
+
+// WithContext sets the context the request is handled in, which carries the
+// span tracing it, and returns the request
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r.ctx = ctx
+	return r
+}
+
+// Context retrieves the context the request is handled in
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
 // Database retrieves the current database handle
 func (r *Request) Database() *database.Database {
 	return r.db
@@ -38,3 +103,51 @@ func (r *Request) Command() string {
 func (r *Request) Data() []byte {
 	return r.msg.Data()
 }
+
+// ACL retrieves the ACL restricting the client which made the request, which
+// is nil if the client is unrestricted
+func (r *Request) ACL() *TopicACL {
+	return r.acl
+}
+
+// RemoteAddr retrieves the address of the client which made the request, which
+// is empty if it isn't known
+func (r *Request) RemoteAddr() string {
+	return r.remoteAddr
+}
+
+// Listener retrieves the name of the listener the request was received on,
+// which is empty if it isn't known
+func (r *Request) Listener() string {
+	return r.listener
+}
+
+// RequestID retrieves the ID of the request, which is the one the client sent
+// if it sent one
+func (r *Request) RequestID() string {
+	if id := r.msg.RequestID(); id != "" {
+		return id
+	}
+	return r.requestID
+}
+
+// SentRequestID retrieves the ID sent by the client, which is empty if it
+// didn't send one
+func (r *Request) SentRequestID() string {
+	return r.msg.RequestID()
+}
+
+// Log returns log with the request's ID added to it, so that everything
+// logged about the request can be tied together
+func (r *Request) Log(log zerolog.Logger) *zerolog.Logger {
+	if id := r.RequestID(); id != "" {
+		log = log.With().Str("request_id", id).Logger()
+	}
+	return &log
+}
+
+// Compression retrieves the compression algorithm negotiated by the client
+// which made the request, which is empty if it didn't negotiate any
+func (r *Request) Compression() string {
+	return r.compression
+}
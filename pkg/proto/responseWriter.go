@@ -15,6 +15,10 @@ var ()
 type ResponseWriter struct {
 	io.Writer
 	w io.Writer
+	// requestID is added to each message written, if set
+	requestID string
+	// notices is set if the client can be sent notices
+	notices bool
 }
 
 // NewResponseWriter ...
@@ -24,11 +28,48 @@ func NewResponseWriter(w io.Writer) ResponseWriter {
 	}
 }
 
+// WithRequestID returns a copy of rw which adds the request ID id to the
+// messages written through it. Only clients which sent a request ID should be
+// sent one back, since older clients can't read it.
+func (rw ResponseWriter) WithRequestID(id string) ResponseWriter {
+	rw.requestID = id
+	return rw
+}
+
+// RequestID returns the request ID added to messages written through rw
+func (rw ResponseWriter) RequestID() string {
+	return rw.requestID
+}
+
+// WithNotices returns a copy of rw which writes notices if accept is set.
+// Only clients speaking NoticesVersion or newer should be sent them.
+func (rw ResponseWriter) WithNotices(accept bool) ResponseWriter {
+	rw.notices = accept
+	return rw
+}
+
+// Notices returns whether notices are written through rw
+func (rw ResponseWriter) Notices() bool {
+	return rw.notices
+}
+
+// WriteNotice writes n ahead of the response, if the client accepts notices
+func (rw ResponseWriter) WriteNotice(n Notice) {
+	if !rw.notices {
+		return
+	}
+	rw.WriteMessage(NewMessageWithType(CommandNotice, n))
+}
+
 func (rw ResponseWriter) Write(b []byte) (int, error) {
 	return rw.w.Write(b)
 }
 
 func (rw ResponseWriter) WriteMessage(t Marshaler) (int, error) {
+	if m, ok := t.(Message); ok && rw.requestID != "" {
+		t = WithRequestID(m, rw.requestID)
+	}
+
 	b, err := t.Marshal()
 	if err != nil {
 		return 0, err
@@ -0,0 +1,437 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+// Package spec is a machine-readable description of fossil's line protocol,
+// for use by third-party client implementations. The description is emitted
+// as protocol.json, alongside a set of golden test vectors in vectors.json.
+// Both files are checked against pkg/proto by this package's tests; run them
+// with SHOULD_REBASE set to regenerate the files after changing the protocol.
+package spec
+
+import (
+	"encoding/json"
+
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+// Field types
+const (
+	TypeUint8  = "uint8"
+	TypeUint32 = "uint32"
+	TypeUint64 = "uint64"
+	TypeString = "string"
+	TypeBytes  = "bytes"
+	TypeList   = "list"
+)
+
+// LengthRest is used as the Length of a field which extends to the end of
+// the message
+const LengthRest = "rest"
+
+type (
+	// Spec describes the whole protocol
+	Spec struct {
+		Version    string    `json:"version"`
+		Endianness string    `json:"endianness"`
+		Framing    []Field   `json:"framing"`
+		Commands   []Command `json:"commands"`
+		Messages   []Message `json:"messages"`
+	}
+
+	// Command pairs a command name with the messages sent and received with
+	// it. Commands only the server sends have no Request.
+	Command struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Request     string   `json:"request,omitempty"`
+		Responses   []string `json:"responses"`
+	}
+
+	// Message describes the layout of the data section of a framed message
+	Message struct {
+		Name        string  `json:"name"`
+		Description string  `json:"description,omitempty"`
+		Fields      []Field `json:"fields"`
+	}
+
+	// Field describes a single field of a Message, in wire order
+	Field struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+		// Size is the width in bytes of fixed-width fields
+		Size int `json:"size,omitempty"`
+		// Length is the name of the field holding the width in bytes of a
+		// variable-width field, or LengthRest
+		Length string `json:"length,omitempty"`
+		// Terminator, if set, ends a variable-width field early
+		Terminator string `json:"terminator,omitempty"`
+		// Count is the name of the field holding the number of items in a list
+		Count       string  `json:"count,omitempty"`
+		Items       []Field `json:"items,omitempty"`
+		Optional    bool    `json:"optional,omitempty"`
+		Description string  `json:"description,omitempty"`
+	}
+)
+
+// Protocol is the description of the protocol implemented by pkg/proto
+var Protocol = Spec{
+	Version:    proto.Version,
+	Endianness: "big",
+	Framing: []Field{
+		{Name: "length", Type: TypeUint32, Size: 4, Description: "Length of the rest of the message, including the command. Bit 31 is set if data is compressed with the algorithm negotiated by VERSION, in which case data is a uint8 algorithm ID (1 for gzip) followed by the compressed data. Bit 30 is set if the message carries a request ID"},
+		{Name: "command", Type: TypeString, Size: 8, Description: "Command name, padded with NUL bytes"},
+		{Name: "request_id_length", Type: TypeUint8, Size: 1, Optional: true, Description: "Present if bit 30 of length is set"},
+		{Name: "request_id", Type: TypeString, Length: "request_id_length", Optional: true, Description: "Present if bit 30 of length is set. Identifies the request in server logs, and is returned with the response"},
+		{Name: "data", Type: TypeBytes, Length: LengthRest, Description: "Message specific data, see messages"},
+	},
+	Commands: []Command{
+		{Name: proto.CommandVersion, Description: "Announce the version of the protocol spoken, and negotiate compression and capabilities", Request: "VersionRequest", Responses: []string{"VersionResponse"}},
+		{Name: proto.CommandUse, Description: "Set the database used by subsequent commands", Request: "UseRequest", Responses: []string{"OkResponse", "ErrResponse"}},
+		{Name: proto.CommandAuth, Description: "Authenticate the connection with the server's admin token. Only served on the admin port", Request: "AuthRequest", Responses: []string{"OkResponse", "ErrResponse"}},
+		{Name: proto.CommandList, Description: "List databases, topics, or schemas", Request: "ListRequest", Responses: []string{"ListResponse"}},
+		{Name: proto.CommandStats, Description: "Retrieve server and database statistics", Request: "StatsRequest", Responses: []string{"StatsResponse", "ErrResponse"}},
+		{Name: proto.CommandQuery, Description: "Run a query against the current database", Request: "QueryRequest", Responses: []string{"QueryResponse", "ErrResponse"}},
+		{Name: proto.CommandAppend, Description: "Append data to a topic in the current database", Request: "AppendRequest", Responses: []string{"OkResponse", "AppendResponse", "ErrResponse"}},
+		{Name: proto.CommandCreate, Description: "Create a topic in the current database", Request: "CreateTopicRequest", Responses: []string{"OkResponse", "ErrResponse"}},
+		{Name: proto.CommandFlush, Description: "Flush the current database to disk", Request: "FlushRequest", Responses: []string{"OkResponse", "ErrResponse"}},
+		{Name: proto.CommandSchema, Description: "Add a named schema to the current database", Request: "CreateSchemaRequest", Responses: []string{"OkResponse", "ErrResponse"}},
+		{Name: proto.CommandTemplate, Description: "Add a topic template to the current database", Request: "CreateTemplateRequest", Responses: []string{"OkResponse", "ErrResponse"}},
+		{Name: proto.CommandDescribe, Description: "Describe a topic in the current database", Request: "DescribeRequest", Responses: []string{"DescribeResponse", "ErrResponse"}},
+		{Name: proto.CommandTopics, Description: "List a page of the topics in the current database, with their schemas", Request: "ListTopicsRequest", Responses: []string{"ListTopicsResponse", "ErrResponse"}},
+		{Name: proto.CommandDatabaseStatus, Description: "List the databases served, with their status, size and topic count. No database needs to be in use", Request: "DatabaseStatusRequest", Responses: []string{"DatabaseStatusResponse"}},
+		{Name: proto.CommandValidate, Description: "Check whether an append or topic creation would succeed, without writing anything", Request: "ValidateRequest", Responses: []string{"OkResponse", "ErrResponse"}},
+		{Name: proto.CommandPing, Description: "Check that the server is responding, and measure the round trip to it. No database needs to be in use", Request: "PingRequest", Responses: []string{"PingResponse"}},
+		{Name: proto.CommandChanges, Description: "Follow the changes committed to the current database's write-ahead log", Request: "ChangesRequest", Responses: []string{"ChangesResponse", "ErrResponse"}},
+		{Name: proto.CommandNotice, Description: "Sent by servers with the notices capability, to clients speaking v1.2.0 or newer, ahead of a response or on its own. Clients never send it, and must read past it to the response they're waiting for", Responses: []string{"Notice"}},
+	},
+	Messages: []Message{
+		{
+			Name: "VersionRequest",
+			Fields: []Field{
+				{Name: "version", Type: TypeString, Length: LengthRest, Terminator: "\x00"},
+				{Name: "compression", Type: TypeString, Length: LengthRest, Optional: true, Description: "Follows the NUL byte terminating version, if present. Comma separated compression algorithms the client can decompress, in order of preference"},
+			},
+		},
+		{
+			Name: "VersionResponse",
+			Fields: []Field{
+				{Name: "code", Type: TypeUint32, Size: 4},
+				{Name: "version", Type: TypeString, Length: LengthRest, Terminator: "\x00"},
+				{Name: "compression", Type: TypeString, Length: LengthRest, Terminator: "\x00", Optional: true, Description: "Follows the NUL byte terminating version, if present. The algorithm large responses on this connection are compressed with, or empty if they won't be"},
+				{Name: "capabilities", Type: TypeString, Length: LengthRest, Terminator: "\x00", Optional: true, Description: "Follows the NUL byte terminating compression, if present. Comma separated optional parts of the protocol the server supports. Servers which don't send it are assumed to support everything"},
+				{Name: "min_client_version", Type: TypeString, Length: LengthRest, Optional: true, Description: "Follows the NUL byte terminating capabilities, if present. The oldest protocol version the server serves clients speaking; older clients get code 426"},
+			},
+		},
+		{
+			Name:        "OkResponse",
+			Description: "Sent with the OK command",
+			Fields: []Field{
+				{Name: "code", Type: TypeUint32, Size: 4},
+				{Name: "message", Type: TypeString, Length: LengthRest},
+			},
+		},
+		{
+			Name:        "Notice",
+			Description: "Sent with the NOTICE command. A notice about a request carries its request ID, if the request had one",
+			Fields: []Field{
+				{Name: "level", Type: TypeString, Length: LengthRest, Terminator: "\x00", Description: "info, warning or deprecation. Clients should treat levels they don't know as info"},
+				{Name: "message", Type: TypeString, Length: LengthRest},
+			},
+		},
+		{
+			Name:        "ErrResponse",
+			Description: "Sent with the ERR command",
+			Fields: []Field{
+				{Name: "code", Type: TypeUint32, Size: 4},
+				{Name: "error", Type: TypeString, Length: LengthRest},
+			},
+		},
+		{
+			Name: "UseRequest",
+			Fields: []Field{
+				{Name: "database", Type: TypeString, Length: LengthRest},
+			},
+		},
+		{
+			Name: "AuthRequest",
+			Fields: []Field{
+				{Name: "token", Type: TypeString, Length: LengthRest},
+			},
+		},
+		{
+			Name: "ListRequest",
+			Fields: []Field{
+				{Name: "object", Type: TypeString, Length: LengthRest, Description: `One of "databases", "topics", "schemas", "named-schemas", or "templates". Empty means "databases"`},
+			},
+		},
+		{
+			Name: "ListResponse",
+			Fields: []Field{
+				{Name: "count", Type: TypeUint32, Size: 4},
+				{Name: "objects", Type: TypeList, Count: "count", Items: []Field{
+					{Name: "length", Type: TypeUint32, Size: 4},
+					{Name: "object", Type: TypeString, Length: "length"},
+				}},
+			},
+		},
+		{
+			Name: "StatsRequest",
+			Fields: []Field{
+				{Name: "database", Type: TypeString, Length: LengthRest},
+			},
+		},
+		{
+			Name: "StatsResponse",
+			Fields: []Field{
+				{Name: "alloc_heap", Type: TypeUint64, Size: 8},
+				{Name: "total_mem", Type: TypeUint64, Size: 8},
+				{Name: "segments", Type: TypeUint64, Size: 8},
+				{Name: "topics", Type: TypeUint64, Size: 8},
+				{Name: "uptime", Type: TypeString, Length: LengthRest, Description: "A Go duration string, such as 1h2m3.5s"},
+			},
+		},
+		{
+			Name: "QueryRequest",
+			Fields: []Field{
+				{Name: "query", Type: TypeString, Length: LengthRest, Terminator: "\x00"},
+				{Name: "flags", Type: TypeUint8, Size: 1, Optional: true, Description: "Follows the NUL byte terminating query, if present. Bit 0 requests a profile of the query, bit 1 metadata describing its results, and bit 2 the sequence number of each result"},
+			},
+		},
+		{
+			Name: "QueryResponse",
+			Fields: []Field{
+				{Name: "topic_count", Type: TypeUint32, Size: 4},
+				{Name: "topics", Type: TypeList, Count: "topic_count", Description: "Each topic in the response, once", Items: []Field{
+					{Name: "length", Type: TypeUint32, Size: 4},
+					{Name: "topic", Type: TypeString, Length: "length"},
+				}},
+				{Name: "schema_count", Type: TypeUint32, Size: 4},
+				{Name: "schemas", Type: TypeList, Count: "schema_count", Description: "Each schema in the response, once", Items: []Field{
+					{Name: "length", Type: TypeUint32, Size: 4},
+					{Name: "schema", Type: TypeString, Length: "length"},
+				}},
+				{Name: "count", Type: TypeUint32, Size: 4},
+				{Name: "entries", Type: TypeList, Count: "count", Items: []Field{
+					{Name: "seconds", Type: TypeUint64, Size: 8, Description: "Signed seconds since the Unix epoch"},
+					{Name: "nanoseconds", Type: TypeUint32, Size: 4},
+					{Name: "topic", Type: TypeUint32, Size: 4, Description: "Index into topics"},
+					{Name: "schema", Type: TypeUint32, Size: 4, Description: "Index into schemas"},
+					{Name: "length", Type: TypeUint32, Size: 4},
+					{Name: "data", Type: TypeBytes, Length: "length"},
+				}},
+				{Name: "stage_count", Type: TypeUint32, Size: 4, Optional: true, Description: "Only present if a profile was requested"},
+				{Name: "stages", Type: TypeList, Count: "stage_count", Optional: true, Items: []Field{
+					{Name: "name_length", Type: TypeUint32, Size: 4},
+					{Name: "name", Type: TypeString, Length: "name_length"},
+					{Name: "rows_in", Type: TypeUint64, Size: 8},
+					{Name: "rows_out", Type: TypeUint64, Size: 8},
+					{Name: "duration", Type: TypeUint64, Size: 8, Description: "Nanoseconds spent in the stage"},
+				}},
+				{Name: "matched", Type: TypeUint64, Size: 8, Optional: true, Description: "Only present if metadata was requested, in which case the profile is always sent. The number of entries the query matched"},
+				{Name: "returned", Type: TypeUint64, Size: 8, Optional: true, Description: "The number of entries in the response"},
+				{Name: "truncated", Type: TypeUint8, Size: 1, Optional: true, Description: "1 if entries were left out because of the database's limits"},
+				{Name: "start_seconds", Type: TypeUint64, Size: 8, Optional: true, Description: "Start of the time range the query was run over"},
+				{Name: "start_nanoseconds", Type: TypeUint32, Size: 4, Optional: true},
+				{Name: "end_seconds", Type: TypeUint64, Size: 8, Optional: true, Description: "End of the time range the query was run over"},
+				{Name: "end_nanoseconds", Type: TypeUint32, Size: 4, Optional: true},
+				{Name: "sequence_count", Type: TypeUint32, Size: 4, Optional: true, Description: "Only present if sequence numbers were requested, in which case metadata is always sent. Equal to count"},
+				{Name: "sequences", Type: TypeList, Count: "sequence_count", Optional: true, Description: "The sequence number of each entry, in order. Sequence numbers increase with each append to a database, so order entries whose times are equal", Items: []Field{
+					{Name: "sequence", Type: TypeUint64, Size: 8},
+				}},
+			},
+		},
+		{
+			Name: "AppendRequest",
+			Fields: []Field{
+				{Name: "topic_length", Type: TypeUint32, Size: 4, Description: "The high bit is set to create the topic if it doesn't exist, even in strict mode, the next bit is set if a ttl follows the topic, bit 29 is set if an idempotency key follows the ttl, and bit 28 is set to be answered with an AppendResponse rather than an OkResponse. None are part of the length"},
+				{Name: "topic", Type: TypeString, Length: "topic_length", Description: `Empty means "/"`},
+				{Name: "ttl", Type: TypeUint64, Size: 8, Optional: true, Description: "Nanoseconds until the data expires, present if the ttl bit of topic_length is set"},
+				{Name: "idempotency_key_length", Type: TypeUint8, Size: 1, Optional: true, Description: "Present if bit 29 of topic_length is set"},
+				{Name: "idempotency_key", Type: TypeString, Length: "idempotency_key_length", Optional: true, Description: "Present if bit 29 of topic_length is set. Appends sent with the key of one the server already applied, within its idempotency window, are acknowledged without being applied again"},
+				{Name: "data", Type: TypeBytes, Length: LengthRest, Description: "Encoded according to the topic's schema and codec"},
+			},
+		},
+		{
+			Name:        "AppendResponse",
+			Description: "Sent with the APPEND command, in answer to appends with bit 28 of topic_length set, by servers with the append-acks capability",
+			Fields: []Field{
+				{Name: "code", Type: TypeUint32, Size: 4, Description: "200 if the data was appended, or 208 if it duplicated an earlier append, which time and sequence describe instead"},
+				{Name: "time", Type: TypeUint64, Size: 8, Description: "The time the data was appended at, in nanoseconds since the unix epoch"},
+				{Name: "sequence", Type: TypeUint64, Size: 8, Description: "The sequence number the data was appended with"},
+			},
+		},
+		{
+			Name: "CreateTopicRequest",
+			Fields: []Field{
+				{Name: "topic_length", Type: TypeUint32, Size: 4, Description: "The high bit is set to override a conflicting parent schema, and isn't part of the length"},
+				{Name: "topic", Type: TypeString, Length: "topic_length"},
+				{Name: "schema", Type: TypeString, Length: LengthRest, Terminator: "\x00", Description: `Empty means "string"`},
+				{Name: "codec", Type: TypeString, Length: LengthRest, Terminator: "\x00", Optional: true, Description: "Follows the NUL byte terminating schema, if present. Empty means binary"},
+				{Name: "encoding", Type: TypeString, Length: LengthRest, Optional: true, Description: "Follows the NUL byte terminating codec, if present. The encoding the topic's data is stored with on disk: gorilla for float types, delta for integer types, or empty for none"},
+			},
+		},
+		{
+			Name:   "FlushRequest",
+			Fields: []Field{},
+		},
+		{
+			Name: "CreateSchemaRequest",
+			Fields: []Field{
+				{Name: "name_length", Type: TypeUint32, Size: 4},
+				{Name: "name", Type: TypeString, Length: "name_length"},
+				{Name: "schema", Type: TypeString, Length: LengthRest},
+			},
+		},
+		{
+			Name: "CreateTemplateRequest",
+			Fields: []Field{
+				{Name: "pattern_length", Type: TypeUint32, Size: 4},
+				{Name: "pattern", Type: TypeString, Length: "pattern_length"},
+				{Name: "schema", Type: TypeString, Length: LengthRest},
+			},
+		},
+		{
+			Name: "ValidateRequest",
+			Fields: []Field{
+				{Name: "flags", Type: TypeUint8, Size: 1, Description: "Bit 0 validates as though the topic is created if it doesn't exist, even in strict mode. Bit 1 overrides a conflicting parent schema. Bit 2 is set if data is present"},
+				{Name: "topic_length", Type: TypeUint32, Size: 4},
+				{Name: "topic", Type: TypeString, Length: "topic_length", Description: `Empty means "/"`},
+				{Name: "schema_length", Type: TypeUint32, Size: 4},
+				{Name: "schema", Type: TypeString, Length: "schema_length", Description: "Used if the topic doesn't exist, as by CreateTopicRequest"},
+				{Name: "codec_length", Type: TypeUint32, Size: 4},
+				{Name: "codec", Type: TypeString, Length: "codec_length"},
+				{Name: "data", Type: TypeBytes, Length: LengthRest, Description: "Checked against the topic's schema and codec, if bit 2 of flags is set"},
+			},
+		},
+		{
+			Name: "PingRequest",
+			Fields: []Field{
+				{Name: "sent", Type: TypeUint64, Size: 8, Optional: true, Description: "When the client sent the request, in nanoseconds since the unix epoch"},
+			},
+		},
+		{
+			Name: "PingResponse",
+			Fields: []Field{
+				{Name: "sent", Type: TypeUint64, Size: 8, Description: "Echoes the sent time of the request, or 0 if it had none"},
+				{Name: "received", Type: TypeUint64, Size: 8, Description: "When the server received the request by its clock, in nanoseconds since the unix epoch"},
+			},
+		},
+		{
+			Name: "ChangesRequest",
+			Fields: []Field{
+				{Name: "from", Type: TypeUint64, Size: 8, Description: "Offset of the first change to return, or 0 for the oldest change held"},
+				{Name: "limit", Type: TypeUint32, Size: 4, Description: "Most changes returned, or 0 for no limit"},
+				{Name: "wait", Type: TypeUint64, Size: 8, Description: "Nanoseconds to wait for a change if there are none, capped by the server"},
+			},
+		},
+		{
+			Name:        "ChangesResponse",
+			Description: "Changes are sorted by offset. An ErrResponse with code 404 is returned if from is older than the oldest change held",
+			Fields: []Field{
+				{Name: "next", Type: TypeUint64, Size: 8, Description: "Passed as from to get the following changes"},
+				{Name: "count", Type: TypeUint32, Size: 4},
+				{Name: "changes", Type: TypeList, Count: "count", Items: []Field{
+					{Name: "offset", Type: TypeUint64, Size: 8},
+					{Name: "time", Type: TypeUint64, Size: 8, Description: "Time of appended data in nanoseconds since the unix epoch, or 0"},
+					{Name: "ttl", Type: TypeUint64, Size: 8, Description: "Nanoseconds until appended data expires, or 0"},
+					{Name: "kind_length", Type: TypeUint32, Size: 4},
+					{Name: "kind", Type: TypeString, Length: "kind_length", Description: "One of append, create-topic, set-codec, override-schema, add-schema, or add-template"},
+					{Name: "topic_length", Type: TypeUint32, Size: 4},
+					{Name: "topic", Type: TypeString, Length: "topic_length"},
+					{Name: "name_length", Type: TypeUint32, Size: 4},
+					{Name: "name", Type: TypeString, Length: "name_length", Description: "Name of an added schema, or pattern of an added template"},
+					{Name: "schema_length", Type: TypeUint32, Size: 4},
+					{Name: "schema", Type: TypeString, Length: "schema_length"},
+					{Name: "codec_length", Type: TypeUint32, Size: 4},
+					{Name: "codec", Type: TypeString, Length: "codec_length"},
+					{Name: "data_length", Type: TypeUint32, Size: 4},
+					{Name: "data", Type: TypeBytes, Length: "data_length"},
+				}},
+			},
+		},
+		{
+			Name: "DescribeRequest",
+			Fields: []Field{
+				{Name: "topic", Type: TypeString, Length: LengthRest, Description: `Empty means "/"`},
+			},
+		},
+		{
+			Name: "DescribeResponse",
+			Fields: []Field{
+				{Name: "count", Type: TypeUint64, Size: 8, Description: "Number of entries appended directly to the topic"},
+				{Name: "first", Type: TypeUint64, Size: 8, Description: "Time of the first entry in nanoseconds since the unix epoch, or 0 if count is 0"},
+				{Name: "last", Type: TypeUint64, Size: 8, Description: "Time of the last entry in nanoseconds since the unix epoch, or 0 if count is 0"},
+				{Name: "topic_length", Type: TypeUint32, Size: 4},
+				{Name: "topic", Type: TypeString, Length: "topic_length"},
+				{Name: "schema_length", Type: TypeUint32, Size: 4},
+				{Name: "schema", Type: TypeString, Length: "schema_length"},
+				{Name: "parent_schema_length", Type: TypeUint32, Size: 4},
+				{Name: "parent_schema", Type: TypeString, Length: "parent_schema_length", Description: "Schema inherited from the closest parent with a non-string schema, or empty"},
+				{Name: "codec_length", Type: TypeUint32, Size: 4},
+				{Name: "codec", Type: TypeString, Length: "codec_length", Description: "Empty means binary"},
+				{Name: "encoding_length", Type: TypeUint32, Size: 4, Optional: true, Description: "Absent from servers which predate encodings"},
+				{Name: "encoding", Type: TypeString, Length: "encoding_length", Optional: true, Description: "Encoding the topic's data is stored with on disk, or empty for none"},
+			},
+		},
+		{
+			Name: "ListTopicsRequest",
+			Fields: []Field{
+				{Name: "limit", Type: TypeUint32, Size: 4, Description: "Most topics in the page, or 0 for all of them"},
+				{Name: "after_length", Type: TypeUint32, Size: 4},
+				{Name: "after", Type: TypeString, Length: "after_length", Description: "The next of the previous page, or empty for the first page"},
+				{Name: "prefix", Type: TypeString, Length: LengthRest, Description: "Only topics starting with prefix are listed"},
+			},
+		},
+		{
+			Name:        "ListTopicsResponse",
+			Description: "Topics are sorted by name",
+			Fields: []Field{
+				{Name: "count", Type: TypeUint32, Size: 4},
+				{Name: "topics", Type: TypeList, Count: "count", Items: []Field{
+					{Name: "topic_length", Type: TypeUint32, Size: 4},
+					{Name: "topic", Type: TypeString, Length: "topic_length"},
+					{Name: "schema_length", Type: TypeUint32, Size: 4},
+					{Name: "schema", Type: TypeString, Length: "schema_length"},
+					{Name: "codec_length", Type: TypeUint32, Size: 4},
+					{Name: "codec", Type: TypeString, Length: "codec_length", Description: "Empty means binary"},
+					{Name: "entries", Type: TypeUint64, Size: 8, Description: "Number of entries appended directly to the topic"},
+				}},
+				{Name: "next_length", Type: TypeUint32, Size: 4},
+				{Name: "next", Type: TypeString, Length: "next_length", Description: "Passed as after to get the next page, or empty if this is the last page"},
+			},
+		},
+		{
+			Name:   "DatabaseStatusRequest",
+			Fields: []Field{},
+		},
+		{
+			Name:        "DatabaseStatusResponse",
+			Description: "Databases are sorted by name",
+			Fields: []Field{
+				{Name: "count", Type: TypeUint32, Size: 4},
+				{Name: "databases", Type: TypeList, Count: "count", Items: []Field{
+					{Name: "name_length", Type: TypeUint32, Size: 4},
+					{Name: "name", Type: TypeString, Length: "name_length"},
+					{Name: "status_length", Type: TypeUint32, Size: 4},
+					{Name: "status", Type: TypeString, Length: "status_length", Description: "open, or degraded if the database isn't healthy, such as when its last flush failed"},
+					{Name: "size", Type: TypeUint64, Size: 8, Description: "Size of the database on disk in bytes"},
+					{Name: "topics", Type: TypeUint64, Size: 8},
+					{Name: "last_flush", Type: TypeUint64, Size: 8, Description: "When the database was last flushed to disk in nanoseconds since the unix epoch, or 0 if it never has been"},
+					{Name: "uptime", Type: TypeUint64, Size: 8, Description: "Nanoseconds since the database was opened"},
+				}},
+			},
+		},
+	},
+}
+
+// JSON returns the protocol description as indented JSON
+func JSON() ([]byte, error) {
+	b, err := json.MarshalIndent(Protocol, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package spec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+func checkGolden(t *testing.T, path string, actual []byte) {
+	if os.Getenv("SHOULD_REBASE") != "" {
+		err := os.WriteFile(path, actual, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("%s is out of date, re-run tests with SHOULD_REBASE set to regenerate it", path)
+	}
+}
+
+func TestProtocolJSON(t *testing.T) {
+	b, err := JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "protocol.json", b)
+}
+
+func TestVectorsJSON(t *testing.T) {
+	b, err := VectorsJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "vectors.json", b)
+}
+
+func TestSpecIsComplete(t *testing.T) {
+	messages := map[string]bool{}
+	for _, m := range Protocol.Messages {
+		messages[m.Name] = true
+	}
+
+	for _, c := range Protocol.Commands {
+		for _, name := range append([]string{c.Request}, c.Responses...) {
+			if name == "" && c.Name == proto.CommandNotice {
+				continue
+			}
+			if !messages[name] {
+				t.Errorf("command %s refers to undescribed message %s", c.Name, name)
+			}
+		}
+	}
+
+	for _, s := range samples {
+		if !messages[s.message] {
+			t.Errorf("vector '%s' refers to undescribed message %s", s.name, s.message)
+		}
+	}
+}
+
+func TestVectorsRoundTrip(t *testing.T) {
+	vectors, err := Vectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, v := range vectors {
+		wire, err := hex.DecodeString(v.Wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := proto.ReadMessageFull(bytes.NewReader(wire))
+		if err != nil {
+			t.Errorf("%s: %s", v.Name, err)
+			continue
+		}
+
+		if msg.Command() != v.Command {
+			t.Errorf("%s: expected command %s, got %s", v.Name, v.Command, msg.Command())
+		}
+
+		// Unmarshaling the data into a fresh message and marshaling it again
+		// should reproduce the wire encoding
+		expected := reflect.TypeOf(samples[i].data)
+		fresh := reflect.New(expected).Interface().(proto.Unmarshaler)
+		err = fresh.Unmarshal(msg.Data())
+		if err != nil {
+			t.Errorf("%s: %s", v.Name, err)
+			continue
+		}
+
+		data, err := reflect.ValueOf(fresh).Elem().Interface().(proto.Marshaler).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, msg.Data()) {
+			t.Errorf("%s: expected data to survive a round trip, got %x, want %x", v.Name, data, msg.Data())
+		}
+	}
+}
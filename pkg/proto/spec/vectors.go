@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package spec
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+// Vector is a golden test vector: a message along with its complete wire
+// encoding, framing included
+type Vector struct {
+	Name    string         `json:"name"`
+	Command string         `json:"command"`
+	Message string         `json:"message"`
+	Values  map[string]any `json:"values"`
+	Wire    string         `json:"wire"`
+}
+
+type sample struct {
+	name    string
+	command string
+	message string
+	values  map[string]any
+	data    proto.Marshaler
+}
+
+var vectorTime = time.Date(2023, time.January, 2, 3, 4, 5, 600000000, time.UTC)
+
+var samples = []sample{
+	{"version request", proto.CommandVersion, "VersionRequest",
+		map[string]any{"version": proto.Version},
+		proto.VersionRequest{}},
+	{"version response", proto.CommandVersion, "VersionResponse",
+		map[string]any{"code": 200, "version": proto.Version},
+		proto.VersionResponse{Code: 200}},
+	{"version request offering compression", proto.CommandVersion, "VersionRequest",
+		map[string]any{"version": proto.Version, "compression": "gzip"},
+		proto.VersionRequest{Compression: []string{proto.CompressionGzip}}},
+	{"version response negotiating compression", proto.CommandVersion, "VersionResponse",
+		map[string]any{"code": 200, "version": proto.Version, "compression": "gzip"},
+		proto.VersionResponse{Code: 200, Compression: proto.CompressionGzip}},
+	{"version response advertising capabilities", proto.CommandVersion, "VersionResponse",
+		map[string]any{"code": 200, "version": proto.Version, "compression": "gzip", "capabilities": "compression,ping", "min_client_version": "v1.0.0"},
+		proto.VersionResponse{Code: 200, Compression: proto.CompressionGzip, Capabilities: []string{proto.CapabilityCompression, proto.CapabilityPing}, MinClientVersion: "v1.0.0"}},
+	{"version response rejecting an old client", proto.CommandVersion, "VersionResponse",
+		map[string]any{"code": 426, "version": proto.Version, "compression": "", "capabilities": "ping", "min_client_version": "v1.1.0"},
+		proto.VersionResponse{Code: 426, Capabilities: []string{proto.CapabilityPing}, MinClientVersion: "v1.1.0"}},
+	{"ok", proto.CommandOk, "OkResponse",
+		map[string]any{"code": 200, "message": "Ok"},
+		proto.OkResponse{Code: 200, Message: "Ok"}},
+	{"error", proto.CommandError, "ErrResponse",
+		map[string]any{"code": 504, "error": "bad query"},
+		proto.ErrResponse{Code: 504, Err: errors.New("bad query")}},
+	{"notice", proto.CommandNotice, "Notice",
+		map[string]any{"level": "warning", "message": "results truncated"},
+		proto.Notice{Level: proto.NoticeWarning, Message: "results truncated"}},
+	{"use", proto.CommandUse, "UseRequest",
+		map[string]any{"database": "default"},
+		proto.UseRequest{DbName: "default"}},
+	{"auth", proto.CommandAuth, "AuthRequest",
+		map[string]any{"token": "s3cret"},
+		proto.AuthRequest{Token: "s3cret"}},
+	{"list request", proto.CommandList, "ListRequest",
+		map[string]any{"object": "topics"},
+		proto.ListRequest{Object: "topics"}},
+	{"list response", proto.CommandList, "ListResponse",
+		map[string]any{"objects": []string{"/", "/foo"}},
+		proto.ListResponse{ObjectList: []string{"/", "/foo"}}},
+	{"stats request", proto.CommandStats, "StatsRequest",
+		map[string]any{"database": "default"},
+		proto.StatsRequest{Database: "default"}},
+	{"stats response", proto.CommandStats, "StatsResponse",
+		map[string]any{"alloc_heap": 1024, "total_mem": 4096, "segments": 1, "topics": 2, "uptime": "1h0m0s"},
+		proto.StatsResponse{AllocHeap: 1024, TotalMem: 4096, Segments: 1, Topics: 2, Uptime: time.Hour}},
+	{"query request", proto.CommandQuery, "QueryRequest",
+		map[string]any{"query": "all in /foo"},
+		proto.QueryRequest{Query: "all in /foo"}},
+	{"query response", proto.CommandQuery, "QueryResponse",
+		map[string]any{"topics": []string{"/foo", "/bar"}, "schemas": []string{"int32"}, "entries": []map[string]any{
+			{"seconds": vectorTime.Unix(), "nanoseconds": vectorTime.Nanosecond(), "topic": 0, "schema": 0, "data": "2a000000"},
+			{"seconds": vectorTime.Unix(), "nanoseconds": vectorTime.Nanosecond(), "topic": 1, "schema": 0, "data": "09000000"},
+		}},
+		proto.QueryResponse{Results: database.Entries{
+			{Time: vectorTime, Topic: "/foo", Schema: "int32", Data: []byte{42, 0, 0, 0}},
+			{Time: vectorTime, Topic: "/bar", Schema: "int32", Data: []byte{9, 0, 0, 0}},
+		}}},
+	{"profiled query request", proto.CommandQuery, "QueryRequest",
+		map[string]any{"query": "all in /foo", "flags": 1},
+		proto.QueryRequest{Query: "all in /foo", Profile: true}},
+	{"profiled query response", proto.CommandQuery, "QueryResponse",
+		map[string]any{"topics": []string{}, "schemas": []string{}, "entries": []map[string]any{}, "stages": []map[string]any{{"name": "retrieve", "rows_in": 0, "rows_out": 0, "duration": 1000}}},
+		proto.QueryResponse{Results: database.Entries{}, Profile: proto.QueryProfile{
+			{Name: "retrieve", Duration: time.Microsecond},
+		}}},
+	{"query request with metadata", proto.CommandQuery, "QueryRequest",
+		map[string]any{"query": "all in /foo", "flags": 2},
+		proto.QueryRequest{Query: "all in /foo", Metadata: true}},
+	{"query response with metadata", proto.CommandQuery, "QueryResponse",
+		map[string]any{"topics": []string{}, "schemas": []string{}, "entries": []map[string]any{}, "stages": []map[string]any{},
+			"matched": 3, "returned": 0, "truncated": false,
+			"start_seconds": vectorTime.Unix(), "start_nanoseconds": vectorTime.Nanosecond(),
+			"end_seconds": vectorTime.Unix() + 60, "end_nanoseconds": vectorTime.Nanosecond()},
+		proto.QueryResponse{Results: database.Entries{}, Metadata: &proto.QueryMetadata{
+			Matched: 3, Start: vectorTime, End: vectorTime.Add(time.Minute),
+		}}},
+	{"query request with sequences", proto.CommandQuery, "QueryRequest",
+		map[string]any{"query": "all in /foo", "flags": 4},
+		proto.QueryRequest{Query: "all in /foo", Sequences: true}},
+	{"query response with sequences", proto.CommandQuery, "QueryResponse",
+		map[string]any{"topics": []string{"/foo"}, "schemas": []string{"string"},
+			"entries": []map[string]any{
+				{"seconds": vectorTime.Unix(), "nanoseconds": vectorTime.Nanosecond(), "topic": 0, "schema": 0, "data": "6869"},
+				{"seconds": vectorTime.Unix(), "nanoseconds": vectorTime.Nanosecond(), "topic": 0, "schema": 0, "data": "6869"},
+			},
+			"stages": []map[string]any{}, "matched": 2, "returned": 2, "truncated": false,
+			"start_seconds": vectorTime.Unix(), "start_nanoseconds": vectorTime.Nanosecond(),
+			"end_seconds": vectorTime.Unix() + 60, "end_nanoseconds": vectorTime.Nanosecond(),
+			"sequences": []map[string]any{{"sequence": 7}, {"sequence": 9}}},
+		proto.QueryResponse{Results: database.Entries{
+			{Time: vectorTime, Topic: "/foo", Schema: "string", Data: []byte("hi"), Sequence: 7},
+			{Time: vectorTime, Topic: "/foo", Schema: "string", Data: []byte("hi"), Sequence: 9},
+		}, Metadata: &proto.QueryMetadata{
+			Matched: 2, Returned: 2, Start: vectorTime, End: vectorTime.Add(time.Minute),
+		}, Sequences: true}},
+	{"append", proto.CommandAppend, "AppendRequest",
+		map[string]any{"topic": "/foo", "data": "2a000000"},
+		proto.AppendRequest{Topic: "/foo", Data: []byte{42, 0, 0, 0}}},
+	{"append creating topic", proto.CommandAppend, "AppendRequest",
+		map[string]any{"topic": "/foo", "data": "2a000000", "create_topic": true},
+		proto.AppendRequest{Topic: "/foo", Data: []byte{42, 0, 0, 0}, CreateTopic: true}},
+	{"append with ttl", proto.CommandAppend, "AppendRequest",
+		map[string]any{"topic": "/foo", "data": "2a000000", "ttl": 60000000000},
+		proto.AppendRequest{Topic: "/foo", Data: []byte{42, 0, 0, 0}, TTL: time.Minute}},
+	{"append with idempotency key", proto.CommandAppend, "AppendRequest",
+		map[string]any{"topic": "/foo", "data": "2a000000", "idempotency_key": "k1"},
+		proto.AppendRequest{Topic: "/foo", Data: []byte{42, 0, 0, 0}, IdempotencyKey: "k1"}},
+	{"append with ack", proto.CommandAppend, "AppendRequest",
+		map[string]any{"topic": "/foo", "data": "2a000000", "ack": true},
+		proto.AppendRequest{Topic: "/foo", Data: []byte{42, 0, 0, 0}, Ack: true}},
+	{"append response", proto.CommandAppend, "AppendResponse",
+		map[string]any{"code": 200, "time": vectorTime.UnixNano(), "sequence": 7},
+		proto.AppendResponse{Code: 200, Time: vectorTime, Sequence: 7}},
+	{"create topic", proto.CommandCreate, "CreateTopicRequest",
+		map[string]any{"topic": "/foo", "schema": "int32"},
+		proto.CreateTopicRequest{Topic: "/foo", Schema: "int32"}},
+	{"create topic with codec", proto.CommandCreate, "CreateTopicRequest",
+		map[string]any{"topic": "/foo", "schema": "int32", "codec": "json"},
+		proto.CreateTopicRequest{Topic: "/foo", Schema: "int32", Codec: "json"}},
+	{"create topic with encoding", proto.CommandCreate, "CreateTopicRequest",
+		map[string]any{"topic": "/foo", "schema": "float64", "encoding": "gorilla"},
+		proto.CreateTopicRequest{Topic: "/foo", Schema: "float64", Encoding: "gorilla"}},
+	{"create topic overriding parent schema", proto.CommandCreate, "CreateTopicRequest",
+		map[string]any{"topic": "/foo", "schema": "int32", "override": true},
+		proto.CreateTopicRequest{Topic: "/foo", Schema: "int32", Override: true}},
+	{"flush", proto.CommandFlush, "FlushRequest",
+		map[string]any{},
+		proto.FlushRequest{}},
+	{"create schema", proto.CommandSchema, "CreateSchemaRequest",
+		map[string]any{"name": "point", "schema": `{"x":int32,"y":int32,}`},
+		proto.CreateSchemaRequest{Name: "point", Schema: `{"x":int32,"y":int32,}`}},
+	{"create template", proto.CommandTemplate, "CreateTemplateRequest",
+		map[string]any{"pattern": "/devices/*/temp", "schema": "float32"},
+		proto.CreateTemplateRequest{Pattern: "/devices/*/temp", Schema: "float32"}},
+	{"validate append", proto.CommandValidate, "ValidateRequest",
+		map[string]any{"topic": "/foo", "data": "2a000000"},
+		proto.ValidateRequest{Topic: "/foo", Data: []byte{42, 0, 0, 0}}},
+	{"validate topic creation", proto.CommandValidate, "ValidateRequest",
+		map[string]any{"topic": "/foo", "schema": "int32", "codec": "json", "create_topic": true},
+		proto.ValidateRequest{Topic: "/foo", Schema: "int32", Codec: "json", CreateTopic: true}},
+	{"ping request", proto.CommandPing, "PingRequest",
+		map[string]any{"sent": vectorTime.UnixNano()},
+		proto.PingRequest{Sent: vectorTime}},
+	{"ping response", proto.CommandPing, "PingResponse",
+		map[string]any{"sent": vectorTime.UnixNano(), "received": vectorTime.Add(time.Millisecond).UnixNano()},
+		proto.PingResponse{Sent: vectorTime, Received: vectorTime.Add(time.Millisecond)}},
+	{"changes request", proto.CommandChanges, "ChangesRequest",
+		map[string]any{"from": 3, "limit": 100, "wait": 1000000000},
+		proto.ChangesRequest{From: 3, Limit: 100, Wait: time.Second}},
+	{"changes response", proto.CommandChanges, "ChangesResponse",
+		map[string]any{"next": 5, "changes": []map[string]any{
+			{"offset": 3, "time": 0, "ttl": 0, "kind": "create-topic", "topic": "/foo", "name": "", "schema": "int32", "codec": "", "data": ""},
+			{"offset": 4, "time": vectorTime.UnixNano(), "ttl": 0, "kind": "append", "topic": "/foo", "name": "", "schema": "int32", "codec": "", "data": "2a000000"},
+		}},
+		proto.ChangesResponse{Next: 5, Changes: []database.Change{
+			{Offset: 3, Kind: database.ChangeCreateTopic, Topic: "/foo", Schema: "int32"},
+			{Offset: 4, Kind: database.ChangeAppend, Time: vectorTime, Topic: "/foo", Schema: "int32", Data: []byte{42, 0, 0, 0}},
+		}}},
+	{"describe request", proto.CommandDescribe, "DescribeRequest",
+		map[string]any{"topic": "/foo"},
+		proto.DescribeRequest{Topic: "/foo"}},
+	{"describe response", proto.CommandDescribe, "DescribeResponse",
+		map[string]any{"topic": "/foo/bar", "schema": "int32", "parent_schema": "int32", "codec": "", "encoding": "delta", "count": 2,
+			"first": vectorTime.UnixNano(), "last": vectorTime.Add(time.Minute).UnixNano()},
+		proto.DescribeResponse{Topic: "/foo/bar", Schema: "int32", ParentSchema: "int32", Encoding: "delta", Count: 2,
+			First: vectorTime, Last: vectorTime.Add(time.Minute)}},
+	{"list topics request", proto.CommandTopics, "ListTopicsRequest",
+		map[string]any{"prefix": "/foo", "after": "/foo/bar", "limit": 2},
+		proto.ListTopicsRequest{Prefix: "/foo", After: "/foo/bar", Limit: 2}},
+	{"list topics response", proto.CommandTopics, "ListTopicsResponse",
+		map[string]any{"topics": []map[string]any{
+			{"topic": "/foo/baz", "schema": "int32", "codec": "", "entries": 2},
+			{"topic": "/foo/qux", "schema": "string", "codec": "json", "entries": 0},
+		}, "next": "/foo/qux"},
+		proto.ListTopicsResponse{Topics: []proto.TopicSummary{
+			{Topic: "/foo/baz", Schema: "int32", Count: 2},
+			{Topic: "/foo/qux", Schema: "string", Codec: "json"},
+		}, Next: "/foo/qux"}},
+	{"database status request", proto.CommandDatabaseStatus, "DatabaseStatusRequest",
+		map[string]any{},
+		proto.DatabaseStatusRequest{}},
+	{"database status response", proto.CommandDatabaseStatus, "DatabaseStatusResponse",
+		map[string]any{"databases": []map[string]any{
+			{"name": "default", "status": "open", "size": 4096, "topics": 3, "last_flush": vectorTime.UnixNano(), "uptime": int64(time.Hour)},
+			{"name": "metrics", "status": "degraded", "size": 0, "topics": 0, "last_flush": 0, "uptime": int64(time.Hour)},
+		}},
+		proto.DatabaseStatusResponse{Databases: []proto.DatabaseStatus{
+			{Name: "default", Status: proto.DatabaseOpen, Size: 4096, Topics: 3, LastFlush: vectorTime, Uptime: time.Hour},
+			{Name: "metrics", Status: proto.DatabaseDegraded, Uptime: time.Hour},
+		}}},
+}
+
+// Vectors returns the golden test vectors for the protocol implemented by
+// pkg/proto. Byte values are hex encoded.
+func Vectors() ([]Vector, error) {
+	var vectors []Vector
+
+	for _, s := range samples {
+		wire, err := proto.NewMessageWithType(s.command, s.data).Marshal()
+		if err != nil {
+			return nil, err
+		}
+
+		vectors = append(vectors, Vector{
+			Name:    s.name,
+			Command: s.command,
+			Message: s.message,
+			Values:  s.values,
+			Wire:    hex.EncodeToString(wire),
+		})
+	}
+
+	return vectors, nil
+}
+
+// VectorsJSON returns the golden test vectors as indented JSON
+func VectorsJSON() ([]byte, error) {
+	vectors, err := Vectors()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.MarshalIndent(vectors, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
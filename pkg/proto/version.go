@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package proto
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Capabilities are optional parts of the protocol a server advertises in its
+// VersionResponse, so clients can adapt to servers which lack them
+const (
+	// CapabilityCompression means the server can compress large responses
+	CapabilityCompression = "compression"
+	// CapabilityRequestIDs means the server understands request IDs
+	CapabilityRequestIDs = "request-ids"
+	// CapabilityValidate means the server supports the VALIDATE command
+	CapabilityValidate = "validate"
+	// CapabilityChanges means the server can stream its changes with CHANGES
+	CapabilityChanges = "changes"
+	// CapabilityPing means the server supports the PING command
+	CapabilityPing = "ping"
+	// CapabilityIdempotentAppends means the server deduplicates appends sent
+	// with the same idempotency key
+	CapabilityIdempotentAppends = "idempotent-appends"
+	// CapabilityAppendAcks means the server answers appends which ask for it
+	// with an AppendResponse
+	CapabilityAppendAcks = "append-acks"
+	// CapabilityNotices means the server sends NOTICE messages to clients
+	// speaking NoticesVersion or newer
+	CapabilityNotices = "notices"
+)
+
+// NoticesVersion is the oldest version of the protocol whose clients can read
+// NOTICE messages. Older clients would take one for the response to their
+// request, so they're never sent any.
+const NoticesVersion = "v1.2.0"
+
+// SupportedCapabilities lists the capabilities of this version of the protocol
+var SupportedCapabilities = []string{
+	CapabilityCompression,
+	CapabilityRequestIDs,
+	CapabilityValidate,
+	CapabilityChanges,
+	CapabilityPing,
+	CapabilityIdempotentAppends,
+	CapabilityAppendAcks,
+	CapabilityNotices,
+}
+
+// MinClientVersion is the oldest version of the protocol a client may speak to
+// be served
+var MinClientVersion = "v1.0.0"
+
+// ParseVersion parses a version of the form vMAJOR.MINOR.PATCH
+func ParseVersion(version string) ([3]int, error) {
+	var v [3]int
+
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if !strings.HasPrefix(version, "v") || len(parts) != 3 {
+		return v, fmt.Errorf("invalid version '%s': expected vMAJOR.MINOR.PATCH", version)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version '%s': expected vMAJOR.MINOR.PATCH", version)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+// CompareVersions returns -1 if version a is older than b, 1 if it's newer,
+// and 0 if they're the same
+func CompareVersions(a, b string) (int, error) {
+	va, err := ParseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := ParseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range va {
+		switch {
+		case va[i] < vb[i]:
+			return -1, nil
+		case va[i] > vb[i]:
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// CheckClientVersion returns an error explaining why a client speaking version
+// can't be served, or nil if it can
+func CheckClientVersion(version string) error {
+	c, err := CompareVersions(version, MinClientVersion)
+	if err != nil {
+		return err
+	}
+	if c < 0 {
+		return fmt.Errorf("client version %s is older than %s, the oldest this server supports; upgrade the client", version, MinClientVersion)
+	}
+	return nil
+}
+
+// AcceptsNotices returns whether a client speaking version can be sent NOTICE
+// messages
+func AcceptsNotices(version string) bool {
+	c, err := CompareVersions(version, NoticesVersion)
+	return err == nil && c >= 0
+}
+
+// CheckServerVersion returns an error explaining why a client speaking this
+// version of the protocol can't talk to the server which sent v, or nil if it
+// can. Servers speaking a different major version are incompatible.
+func CheckServerVersion(v VersionResponse) error {
+	server, err := ParseVersion(v.Version)
+	if err != nil {
+		return err
+	}
+	client, _ := ParseVersion(Version)
+	if server[0] != client[0] {
+		return fmt.Errorf("server speaks protocol %s, which is incompatible with this client's %s; use a client and server with the same major version", v.Version, Version)
+	}
+
+	if v.MinClientVersion != "" {
+		if c, err := CompareVersions(Version, v.MinClientVersion); err == nil && c < 0 {
+			return fmt.Errorf("server requires clients speaking protocol %s or newer, but this client speaks %s; upgrade the client", v.MinClientVersion, Version)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package proto
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tt := []struct {
+		a, b string
+		want int
+		err  bool
+	}{
+		{"v1.0.0", "v1.0.0", 0, false},
+		{"v1.0.0", "v1.1.0", -1, false},
+		{"v1.10.0", "v1.9.3", 1, false},
+		{"v2.0.0", "v1.9.9", 1, false},
+		{"1.0.0", "v1.0.0", 0, true},
+		{"v1.0", "v1.0.0", 0, true},
+		{"", "v1.0.0", 0, true},
+	}
+
+	for _, tc := range tt {
+		got, err := CompareVersions(tc.a, tc.b)
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, %v; expected %d, error %v", tc.a, tc.b, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestCheckVersions(t *testing.T) {
+	if err := CheckClientVersion(Version); err != nil {
+		t.Errorf("expected our own version to be served, got %s", err)
+	}
+	if err := CheckClientVersion("v0.9.0"); err == nil {
+		t.Error("expected a client older than MinClientVersion to be rejected")
+	}
+
+	if err := CheckServerVersion(VersionResponse{Version: "v1.0.0"}); err != nil {
+		t.Errorf("expected a server with the same major version to be compatible, got %s", err)
+	}
+	if err := CheckServerVersion(VersionResponse{Version: "v2.0.0"}); err == nil {
+		t.Error("expected a server with a different major version to be incompatible")
+	}
+	if err := CheckServerVersion(VersionResponse{Version: "v1.9.0", MinClientVersion: "v1.9.0"}); err == nil {
+		t.Error("expected a server requiring a newer client to be incompatible")
+	}
+}
+
+func TestAcceptsNotices(t *testing.T) {
+	if !AcceptsNotices(Version) || !AcceptsNotices("v1.3.0") {
+		t.Error("expected clients speaking NoticesVersion or newer to accept notices")
+	}
+	if AcceptsNotices("v1.1.0") || AcceptsNotices("") {
+		t.Error("expected older clients not to accept notices")
+	}
+}
+
+func TestVersionCapabilities(t *testing.T) {
+	resp := VersionResponse{Code: 200, Capabilities: []string{CapabilityPing, CapabilityChanges}, MinClientVersion: "v1.0.0"}
+	b, _ := resp.Marshal()
+	resp = VersionResponse{}
+	if err := resp.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Compression != "" || !reflect.DeepEqual(resp.Capabilities, []string{CapabilityPing, CapabilityChanges}) || resp.MinClientVersion != "v1.0.0" {
+		t.Errorf("expected ping and changes capabilities without compression, got %+v", resp)
+	}
+	if !resp.Supports(CapabilityPing) || resp.Supports(CapabilityValidate) {
+		t.Errorf("expected ping to be supported and validate not to be, got %+v", resp.Capabilities)
+	}
+
+	// Servers which predate capabilities only send the version and compression
+	if err := resp.Unmarshal(append([]byte{0, 0, 0, 200}, "v1.0.0\x00gzip"...)); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Compression != CompressionGzip || resp.Capabilities != nil || !resp.Supports(CapabilityValidate) {
+		t.Errorf("expected a legacy server to be assumed to support everything, got %+v", resp)
+	}
+}
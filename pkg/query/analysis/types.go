@@ -73,6 +73,9 @@ func (t *TypeChecker) Visit(node ast.ASTNode) ast.Visitor {
 		case *ast.StringNode:
 			t.typeLookup[n] = &schema.Type{Name: "string"}
 			t.locations[n] = n.Token.Location
+		case *ast.BooleanNode:
+			t.typeLookup[n] = &schema.Type{Name: "boolean"}
+			t.locations[n] = n.Token.Location
 		case *ast.IdentifierNode:
 			s, ok := t.symbols[n.Value()]
 			if !ok {
@@ -98,11 +101,27 @@ func (t *TypeChecker) Visit(node ast.ASTNode) ast.Visitor {
 			}
 
 			if array != nil {
-				if types.IntVal(n.Subscript.(*ast.NumberNode).Val) > int64(array.Length-1) {
-					t.Errors = append(t.Errors, parse.NewSyntaxError(n.Subscript.(*ast.NumberNode).Token, fmt.Sprintf("Tuple index out of bounds, '%s' has a schema of '%s'", n.Identifier.Value(), array.ToSchema())))
-				}
+				switch s := n.Subscript.(type) {
+				case *ast.NumberNode:
+					if _, ok := s.Index(array.Length); !ok {
+						t.Errors = append(t.Errors, parse.NewSyntaxError(s.Token, fmt.Sprintf("Tuple index out of bounds, '%s' has a schema of '%s'", n.Identifier.Value(), array.ToSchema())))
+					}
 
-				t.typeLookup[n] = &array.Type
+					t.typeLookup[n] = &array.Type
+				case *ast.SliceNode:
+					// Slices are arrays of their own, whose length is known
+					// from the bounds
+					start, end := s.Bounds(array.Length)
+					if end <= start {
+						t.Errors = append(t.Errors, parse.NewSyntaxError(s.Token, fmt.Sprintf("Tuple slice '%s' is empty, '%s' has a schema of '%s'", s.Value(), n.Identifier.Value(), array.ToSchema())))
+						return nil
+					}
+
+					t.typeLookup[n] = &schema.Array{Type: array.Type, Length: end - start}
+				default:
+					t.Errors = append(t.Errors, parse.NewSyntaxError(n.Token, fmt.Sprintf("Expected an integer index for tuple subscript, '%s' has a schema of '%s'", n.Identifier.Value(), array.ToSchema())))
+					return nil
+				}
 			} else {
 				// Ensure that the subscript is a string
 				if _, ok := n.Subscript.(*ast.StringNode); !ok {
@@ -112,16 +131,48 @@ func (t *TypeChecker) Visit(node ast.ASTNode) ast.Visitor {
 
 				keyName := n.Subscript.(*ast.StringNode).Val
 				obj := composite.SchemaForKey(types.StringVal(keyName))
+				if _, unknown := obj.(schema.Unknown); unknown {
+					t.Errors = append(t.Errors, parse.NewSyntaxError(n.Subscript.(*ast.StringNode).Token, fmt.Sprintf("Unknown composite key '%s', '%s' has a schema of '%s'", types.StringVal(keyName), n.Identifier.Value(), composite.ToSchema())))
+					return nil
+				}
 
 				t.typeLookup[n] = obj
 			}
 			t.locations[n] = n.Identifier.Token.Location
 
-		case *ast.TimeWhenceNode, *ast.TimespanNode:
-			t.typeLookup[n] = &schema.Type{Name: "int64"}
+		case *ast.TimeWhenceNode:
+			t.typeLookup[n] = &schema.Type{Name: "timestamp"}
+			t.locations[n] = n.Token.Location
+		case *ast.TimespanNode:
+			t.typeLookup[n] = &schema.Type{Name: "duration"}
+			t.locations[n] = n.Token.Location
 		case *ast.BinaryOpNode:
-			if !t.typeForNode(n.Left).IsNumeric() || !t.typeForNode(n.Right).IsNumeric() {
-				t.Errors = append(t.Errors, parse.NewSyntaxError(n.Op, "Both operands must be numeric"))
+			if isTemporal(t.typeForNode(n.Left)) || isTemporal(t.typeForNode(n.Right)) {
+				s, err := types.TemporalType(t.typeForNode(n.Left), n.Op, t.typeForNode(n.Right))
+				if err != nil {
+					t.Errors = append(t.Errors, parse.NewSyntaxError(n.Op, err.Error()))
+					return nil
+				}
+				t.typeLookup[n] = s
+				t.locations[n] = parse.Location{Start: t.locations[n.Left].Start, End: t.locations[n.Right].End}
+				break
+			}
+
+			// Strings and booleans can only be compared for equality, with
+			// others of their kind
+			left, right := t.typeForNode(n.Left), t.typeForNode(n.Right)
+			if (isString(left) && isString(right)) || (isBoolean(left) && isBoolean(right)) {
+				if n.Op.Type != scanner.TOK_EQ_EQ && n.Op.Type != scanner.TOK_NOT_EQ {
+					t.Errors = append(t.Errors, parse.NewSyntaxError(n.Op, fmt.Sprintf("Operator '%s' can't be applied to %s values, only '==' and '!=' can", n.Op.Lexeme, left.ToSchema())))
+					return nil
+				}
+				t.typeLookup[n] = &schema.Type{Name: "boolean"}
+				t.locations[n] = parse.Location{Start: t.locations[n.Left].Start, End: t.locations[n.Right].End}
+				break
+			}
+
+			if !left.IsNumeric() || !right.IsNumeric() {
+				t.Errors = append(t.Errors, parse.NewSyntaxError(n.Op, "Both operands must be numeric, or both strings or booleans to compare them"))
 				return nil
 			}
 
@@ -168,7 +219,13 @@ func (t *TypeChecker) Visit(node ast.ASTNode) ast.Visitor {
 
 				// FIXME: Up-sample to largest numeric
 			}
-			t.typeLookup[n] = &schema.Array{Type: *innerType.(*schema.Type), Length: len(n.Elements)}
+			elementType, ok := innerType.(*schema.Type)
+			if !ok {
+				err := fmt.Sprintf("Tuples can't hold values of type %s", innerType.ToSchema())
+				t.Errors = append(t.Errors, parse.NewSyntaxError(parse.Token{Location: t.locations[n.Elements[0]]}, err))
+				return nil
+			}
+			t.typeLookup[n] = &schema.Array{Type: *elementType, Length: len(n.Elements)}
 			t.locations[n] = parse.Location{Start: t.locations[n.Elements[0]].Start, End: t.locations[n.Elements[len(n.Elements)-1]].End}
 		case *ast.DataFunctionNode:
 			t.typeLookup[n] = t.typeForNode(n.Expression)
@@ -177,6 +234,16 @@ func (t *TypeChecker) Visit(node ast.ASTNode) ast.Visitor {
 				t.Errors = append(t.Errors, parse.NewSyntaxError(n.Name, fmt.Sprintf("The reduce function expects 2 arguments, %d provided", len(n.Arguments))))
 			}
 
+			// The result of a reduce is passed back in as its first argument,
+			// so it must be of the same type
+			if n.Name.Lexeme == "reduce" && len(n.Arguments) == 2 {
+				argType, resultType := t.symbols[n.Arguments[0].Value()], t.typeForNode(n.Expression)
+				if _, unknown := resultType.(schema.Unknown); !unknown && !sameKind(argType, resultType) {
+					txt := fmt.Sprintf("The reduce function must return the type of its arguments, %s, but returns %s", argType.ToSchema(), resultType.ToSchema())
+					t.Errors = append(t.Errors, parse.NewSyntaxError(parse.Token{Location: t.locations[n.Expression]}, txt))
+				}
+			}
+
 			// Populate symbols for the next stage in our pipeline
 			if n.Next != nil {
 				// Ensure we have the same number of return values as the next stage's
@@ -187,18 +254,22 @@ func (t *TypeChecker) Visit(node ast.ASTNode) ast.Visitor {
 				// Filter operations don't mutate the input, and simply pass it along
 				if n.Name.Lexeme == "filter" {
 					argType = t.symbols[n.Arguments[0].Value()]
+					if len(n.Arguments) > 1 && nextNumArgs != len(n.Arguments) {
+						txt := fmt.Sprintf("Argument mismatch: %s stage expected %d arguments, but got %d", n.Next.Value(), nextNumArgs, len(n.Arguments))
+						t.Errors = append(t.Errors, parse.NewSyntaxError(n.Next.Name, txt))
+					}
 				} else {
-					if array, ok := t.typeForNode(n.Expression).(schema.Array); ok {
-						if nextNumArgs == 1 {
-							argType = array
-						} else if nextNumArgs == array.Length {
-							argType = array.Type
-						} else {
-							txt := fmt.Sprintf("Argument mismatch: %s stage expected %d arguments, but got %d", n.Next.Value(), nextNumArgs, array.Length)
-							t.Errors = append(t.Errors, parse.NewSyntaxError(parse.Token{Location: t.locations[n.Expression]}, txt))
-						}
-					} else {
-						argType = t.typeForNode(n.Expression)
+					argType = t.typeForNode(n.Expression)
+				}
+
+				// Arrays are destructured into the arguments of a next stage
+				// which takes more than one, other than reduce, whose
+				// arguments are the accumulated value and the next one
+				if n.Name.Lexeme != "filter" || len(n.Arguments) == 1 {
+					var err string
+					argType, err = destructure(argType, n.Next)
+					if err != "" {
+						t.Errors = append(t.Errors, parse.NewSyntaxError(parse.Token{Location: t.locations[n.Expression]}, err))
 					}
 				}
 
@@ -206,6 +277,26 @@ func (t *TypeChecker) Visit(node ast.ASTNode) ast.Visitor {
 					t.symbols[arg.Value()] = argType
 				}
 			}
+		case *ast.CompositeNode:
+			composite := &schema.Composite{}
+
+			for i, key := range n.Keys {
+				valueType := t.typeForNode(n.Values[i])
+
+				// Composites can only hold the types a composite schema can
+				switch valueType.(type) {
+				case *schema.Type, *schema.Array, *schema.Enum:
+				default:
+					err := fmt.Sprintf("Composite key '%s' can't hold a value of type %s", types.StringVal(key.Val), valueType.ToSchema())
+					t.Errors = append(t.Errors, parse.NewSyntaxError(parse.Token{Location: t.locations[n.Values[i]]}, err))
+				}
+
+				composite.Keys = append(composite.Keys, types.StringVal(key.Val))
+				composite.Values = append(composite.Values, valueType)
+			}
+
+			t.typeLookup[n] = composite
+			t.locations[n] = parse.Location{Start: n.Keys[0].Token.Location.Start, End: t.locations[n.Values[len(n.Values)-1]].End}
 		case *ast.BuiltinFunctionNode:
 			builtin, ok := types.LookupBuiltinFunction(n.Name.Lexeme)
 			if !ok {
@@ -236,6 +327,9 @@ func (t *TypeChecker) Visit(node ast.ASTNode) ast.Visitor {
 			} else {
 				topic := n.Topic.(*ast.TopicSelectorNode).Topic
 				s = t.db.SchemaForTopic(topic.Lexeme)
+				if system, ok := database.SystemTopicSchema(topic.Lexeme); ok {
+					s = system
+				}
 				if s == nil {
 					t.Errors = append(t.Errors, parse.NewSyntaxError(topic, "Unknown topic specified."))
 					return nil
@@ -250,17 +344,78 @@ func (t *TypeChecker) Visit(node ast.ASTNode) ast.Visitor {
 	case *ast.DataPipelineNode:
 		first := n.Stages[0].(*ast.DataFunctionNode)
 
+		// Entries are destructured into the arguments of the first stage
+		// like they are between stages
+		argType, err := destructure(t.initialType, first)
+		if err != "" {
+			t.Errors = append(t.Errors, parse.NewSyntaxError(first.Name, err))
+		}
 		for _, arg := range first.Arguments {
-			t.symbols[arg.Value()] = t.initialType
+			t.symbols[arg.Value()] = argType
 		}
 
 		return t
 
-	case *ast.NumberNode, *ast.StringNode, *ast.IdentifierNode, *ast.BinaryOpNode, *ast.UnaryOpNode, *ast.TupleNode,
-		*ast.DataFunctionNode, *ast.ElementNode, *ast.BuiltinFunctionNode, *ast.TimespanNode, *ast.TimeWhenceNode:
+	case *ast.NumberNode, *ast.StringNode, *ast.BooleanNode, *ast.IdentifierNode, *ast.BinaryOpNode, *ast.UnaryOpNode, *ast.TupleNode,
+		*ast.DataFunctionNode, *ast.ElementNode, *ast.BuiltinFunctionNode, *ast.CompositeNode, *ast.TimespanNode, *ast.TimeWhenceNode:
 		t.push(n)
 		return t
 	}
 
 	return nil
 }
+
+// isTemporal returns whether s is a timestamp or a duration
+func isTemporal(s schema.Object) bool {
+	t, ok := s.(*schema.Type)
+	return ok && (t.Name == "timestamp" || t.Name == "duration")
+}
+
+// isString returns true if values of type s are strings, which enums are once
+// decoded
+func isString(s schema.Object) bool {
+	switch s := s.(type) {
+	case *schema.Type:
+		return s.Name == "string"
+	case *schema.Enum, schema.Enum:
+		return true
+	}
+	return false
+}
+
+func isBoolean(s schema.Object) bool {
+	t, ok := s.(*schema.Type)
+	return ok && t.Name == "boolean"
+}
+
+// destructure returns the type each argument of stage is bound to when it's
+// passed a value of type s, or an error if s can't be split between them.
+// Arrays are destructured into the arguments of stages which take more than
+// one, other than reduce, whose arguments are the accumulated value and the
+// next one.
+func destructure(s schema.Object, stage *ast.DataFunctionNode) (schema.Object, string) {
+	numArgs := len(stage.Arguments)
+	if numArgs < 2 || stage.Name.Lexeme == "reduce" {
+		return s, ""
+	}
+
+	array, ok := s.(*schema.Array)
+	if !ok {
+		return s, fmt.Sprintf("Argument mismatch: %s stage expected %d arguments, but got a single %s", stage.Value(), numArgs, s.ToSchema())
+	}
+	if array.Length != numArgs {
+		return s, fmt.Sprintf("Argument mismatch: %s stage expected %d arguments, but got %d", stage.Value(), numArgs, array.Length)
+	}
+	return &array.Type, ""
+}
+
+// sameKind returns whether values of types a and b can be used in place of one
+// another, which numbers of any width and arrays of them the same length can
+func sameKind(a, b schema.Object) bool {
+	arrayA, okA := a.(*schema.Array)
+	arrayB, okB := b.(*schema.Array)
+	if okA && okB {
+		return arrayA.Length == arrayB.Length && sameKind(&arrayA.Type, &arrayB.Type)
+	}
+	return (a.IsNumeric() && b.IsNumeric()) || a.ToSchema() == b.ToSchema()
+}
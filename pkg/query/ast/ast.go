@@ -51,6 +51,12 @@ type (
 		BaseNode
 		Type         parse.Token
 		TimeQuantity ASTNode
+		Align        ASTNode
+		// Count is set instead of TimeQuantity when sampling every Nth entry
+		Count ASTNode
+		// PerTopic samples the entries of each topic separately, rather than
+		// the entries of every topic together
+		PerTopic bool
 	}
 
 	TopicSelectorNode struct {
@@ -110,6 +116,11 @@ type (
 		Val types.Value
 	}
 
+	BooleanNode struct {
+		BaseNode
+		Val types.Value
+	}
+
 	TupleNode struct {
 		BaseNode
 		Elements []ASTNode
@@ -121,6 +132,14 @@ type (
 		Subscript  ASTNode
 	}
 
+	// SliceNode subscripts the elements of an array from Start up to End,
+	// either of which may be left off
+	SliceNode struct {
+		BaseNode
+		Start *NumberNode
+		End   *NumberNode
+	}
+
 	DataPipelineNode struct {
 		BaseNode
 		Stages []ASTNode
@@ -211,6 +230,10 @@ func (b BinaryOpNode) DerivedValue() int64 {
 //-- TimespanNode
 
 func (t TimespanNode) DerivedValue() int64 {
+	if t.Token.Type == scanner.TOK_DURATION {
+		return int64(types.DurationVal(types.MakeFromToken(t.Token)))
+	}
+
 	switch t.Value() {
 	case "@year":
 		return int64(time.Hour * 24 * 365)
@@ -241,6 +264,13 @@ func MakeStringNodeFromID(tok parse.Token) *StringNode {
 	return &StringNode{BaseNode: BaseNode{Token: tok}, Val: types.MakeString(tok.Lexeme)}
 }
 
+//-- BooleanNode
+
+// MakeBooleanNode returns the boolean literal tok, which is true or false
+func MakeBooleanNode(tok parse.Token) *BooleanNode {
+	return &BooleanNode{BaseNode: BaseNode{Token: tok}, Val: types.MakeBoolean(tok.Lexeme == "true")}
+}
+
 //-- NumberNode
 
 func MakeNumberNode(tok parse.Token) *NumberNode {
@@ -250,3 +280,51 @@ func MakeNumberNode(tok parse.Token) *NumberNode {
 func (n NumberNode) DerivedValue() int64 {
 	return types.IntVal(n.Val)
 }
+
+// Index returns the element of an array of length elements the number
+// indexes, counting back from the end of the array if it's negative, and false
+// if it's out of bounds
+func (n NumberNode) Index(length int) (int, bool) {
+	i := n.DerivedValue()
+	if i < 0 {
+		i += int64(length)
+	}
+	return int(i), i >= 0 && i < int64(length)
+}
+
+//-- SliceNode
+
+func (s SliceNode) Value() string {
+	var start, end string
+	if s.Start != nil {
+		start = s.Start.Value()
+	}
+	if s.End != nil {
+		end = s.End.Value()
+	}
+	return start + ":" + end
+}
+
+// Bounds returns the start and end of the slice of an array of length
+// elements. Like indices, negative bounds count back from the end of the
+// array, and bounds past either end of it are clamped to that end, so the
+// slice is empty when end isn't after start.
+func (s SliceNode) Bounds(length int) (int, int) {
+	bound := func(n *NumberNode, missing int) int {
+		if n == nil {
+			return missing
+		}
+		i := n.DerivedValue()
+		if i < 0 {
+			i += int64(length)
+		}
+		if i < 0 {
+			return 0
+		}
+		if i > int64(length) {
+			return length
+		}
+		return int(i)
+	}
+	return bound(s.Start, 0), bound(s.End, length)
+}
@@ -28,6 +28,13 @@ func (d *Dumper) Visit(node ASTNode) Visitor {
 	switch t := node.(type) {
 	case *TopicSelectorNode:
 		value = "in " + t.Topic.Lexeme
+	case *QuantifierNode:
+		if t.Count != nil {
+			value += " by count"
+		}
+		if t.PerTopic {
+			value += " per topic"
+		}
 	case *DataFunctionNode:
 		var args string
 		for _, a := range t.Arguments {
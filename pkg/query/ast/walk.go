@@ -36,6 +36,14 @@ func Walk(v Visitor, node ASTNode) {
 			Walk(v, n.TimeQuantity)
 		}
 
+		if n.Align != nil {
+			Walk(v, n.Align)
+		}
+
+		if n.Count != nil {
+			Walk(v, n.Count)
+		}
+
 	case *TopicSelectorNode:
 		// Skip, leaf node
 
@@ -63,7 +71,7 @@ func Walk(v Visitor, node ASTNode) {
 	case *UnaryOpNode:
 		Walk(v, n.Operand)
 
-	case *TimespanNode, *IdentifierNode, *NumberNode, *StringNode, *ElementNode:
+	case *TimespanNode, *IdentifierNode, *NumberNode, *StringNode, *BooleanNode, *ElementNode:
 		// Skip, leaf nodes
 
 	case *TupleNode:
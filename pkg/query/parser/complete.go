@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package parser
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/dburkart/fossil/pkg/common/parse"
+	"github.com/dburkart/fossil/pkg/query/scanner"
+	"github.com/dburkart/fossil/pkg/query/types"
+)
+
+// Completion describes what can come next at the end of a partial query
+type Completion struct {
+	// Word is the partially typed word at the end of the query, which
+	// completions replace
+	Word string
+	// Candidates are the keywords, operators, builtins and identifiers which
+	// can come next, and start with Word
+	Candidates []string
+	// Topic is true if a topic can come next
+	Topic bool
+}
+
+// completionState is where in the grammar a partial query leaves off
+type completionState int
+
+const (
+	expectQuantifier completionState = iota
+	expectSampleParen
+	inSample
+	expectClause
+	expectTopic
+	expectTimeWhence
+	inTimeExpression
+	expectTimespan
+	expectStage
+	inStageArguments
+	inExpression
+)
+
+var (
+	quantifiers  = []string{"all", "latest", "sample("}
+	timespans    = []string{"@second", "@minute", "@hour", "@day", "@week", "@month", "@year"}
+	stages       = []string{"filter", "map", "reduce"}
+	clauseStarts = [][]string{{"in"}, {"since", "before", "between"}, {"where"}, {"|"}}
+)
+
+// isPartialWord returns true if t could be the beginning of a longer token
+func isPartialWord(t parse.Token) bool {
+	switch t.Type {
+	case scanner.TOK_IDENTIFIER, scanner.TOK_KEYWORD, scanner.TOK_TOPIC, scanner.TOK_SLASH,
+		scanner.TOK_WHENCE, scanner.TOK_TIMESPAN, scanner.TOK_INVALID:
+		return true
+	}
+	return false
+}
+
+// Complete works out what can come next at the end of input, which is a
+// partial query. Unlike Parse, it's lenient: it never fails, and makes the
+// best of input it doesn't understand.
+func Complete(input string) Completion {
+	s := scanner.Scanner{Input: input}
+
+	var tokens []parse.Token
+	for s.Pos < len(input) {
+		t := s.Emit()
+		if t.Lexeme == "" {
+			break
+		}
+		tokens = append(tokens, t)
+	}
+
+	c := Completion{}
+
+	// Unless the input ends with a space, the last token is still being typed
+	if len(tokens) > 0 && !strings.HasSuffix(input, " ") {
+		last := tokens[len(tokens)-1]
+		if isPartialWord(last) && last.Location.End == len(input) {
+			c.Word = last.Lexeme
+			tokens = tokens[:len(tokens)-1]
+		}
+	}
+
+	state := expectQuantifier
+	nextClause := 0
+	between := false
+	var arguments []string
+
+	for _, t := range tokens {
+		switch state {
+		case expectQuantifier:
+			state = expectClause
+			if t.Lexeme == "sample" {
+				state = expectSampleParen
+			}
+		case expectSampleParen:
+			state = inSample
+		case inSample:
+			if t.Type == scanner.TOK_PAREN_R {
+				state = expectClause
+			}
+		case expectTopic:
+			state = expectClause
+		case expectTimeWhence:
+			state = inTimeExpression
+		case expectTimespan:
+			state = inTimeExpression
+		case inTimeExpression:
+			switch {
+			case t.Type == scanner.TOK_MINUS || t.Type == scanner.TOK_PLUS || t.Type == scanner.TOK_STAR:
+				state = expectTimespan
+			case t.Type == scanner.TOK_COMMA && between:
+				between = false
+				state = expectTimeWhence
+			case t.Type == scanner.TOK_KEYWORD && t.Lexeme == "where":
+				arguments = []string{"value"}
+				state = inExpression
+			case t.Type == scanner.TOK_PIPE:
+				state = expectStage
+			}
+		case expectStage:
+			arguments = nil
+			state = inStageArguments
+		case inStageArguments:
+			if t.Type == scanner.TOK_IDENTIFIER {
+				arguments = append(arguments, t.Lexeme)
+			} else if t.Type == scanner.TOK_ARROW {
+				state = inExpression
+			}
+		case inExpression:
+			if t.Type == scanner.TOK_PIPE {
+				state = expectStage
+			}
+		case expectClause:
+			switch {
+			case t.Type == scanner.TOK_KEYWORD && t.Lexeme == "in":
+				nextClause = 1
+				state = expectTopic
+			case t.Type == scanner.TOK_KEYWORD && (t.Lexeme == "since" || t.Lexeme == "before" || t.Lexeme == "between"):
+				nextClause = 2
+				between = t.Lexeme == "between"
+				state = expectTimeWhence
+			case t.Type == scanner.TOK_KEYWORD && t.Lexeme == "where":
+				nextClause = 3
+				arguments = []string{"value"}
+				state = inExpression
+			case t.Type == scanner.TOK_PIPE:
+				nextClause = 4
+				state = expectStage
+			}
+		}
+	}
+
+	var candidates []string
+	switch state {
+	case expectQuantifier:
+		candidates = quantifiers
+	case expectSampleParen:
+		candidates = []string{"("}
+	case inSample:
+		last := tokens[len(tokens)-1]
+		switch last.Type {
+		case scanner.TOK_PAREN_L, scanner.TOK_PLUS, scanner.TOK_MINUS, scanner.TOK_STAR:
+			candidates = timespans
+		case scanner.TOK_COMMA:
+			candidates = []string{"align"}
+		case scanner.TOK_IDENTIFIER:
+			if last.Lexeme == "align" {
+				candidates = []string{"~now"}
+			}
+		}
+	case expectClause:
+		for _, starts := range clauseStarts[nextClause:] {
+			candidates = append(candidates, starts...)
+		}
+	case expectTopic:
+		c.Topic = true
+	case expectTimeWhence:
+		candidates = []string{"~now"}
+	case inTimeExpression:
+		candidates = []string{"-", "+"}
+		if between {
+			candidates = append(candidates, ",")
+		} else {
+			candidates = append(candidates, "where", "|")
+		}
+	case expectTimespan:
+		candidates = timespans
+	case expectStage:
+		candidates = stages
+	case inExpression:
+		// Only complete words, not operators
+		if c.Word == "" || unicode.IsLetter(rune(c.Word[0])) {
+			candidates = append(candidates, arguments...)
+			for _, name := range types.BuiltinNames() {
+				candidates = append(candidates, name+"(")
+			}
+		}
+	}
+
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, c.Word) {
+			c.Candidates = append(c.Candidates, candidate)
+		}
+	}
+
+	return c
+}
@@ -0,0 +1,34 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/dburkart/fossil/pkg/query/scanner"
+)
+
+// FuzzParse parses arbitrary queries, which must either parse or return a
+// syntax error
+func FuzzParse(f *testing.F) {
+	for _, q := range []string{
+		"all",
+		"all in /foo",
+		"1 in /foo since ~now - @minute",
+		"all in /temps between ~(2023-01-01)..~now | filter x -> x > 21 | map x -> x * 2",
+		"all in /sensors | map s -> (s.location, s.temp) | reduce a, b -> a + b",
+		`all | filter x -> x == "a" || !(x < 1.5e3) | sample @second*5`,
+		"all | map x -> time(x) - ~now + interval(x) / 2",
+	} {
+		f.Add(q)
+	}
+
+	f.Fuzz(func(t *testing.T, q string) {
+		p := Parser{Scanner: scanner.Scanner{Input: q}}
+		p.Parse()
+	})
+}
@@ -12,12 +12,16 @@ import (
 	"github.com/dburkart/fossil/pkg/common/parse"
 	"github.com/dburkart/fossil/pkg/query/ast"
 	"github.com/dburkart/fossil/pkg/query/scanner"
+	"github.com/dburkart/fossil/pkg/query/types"
 	"strings"
 	"time"
 )
 
 type Parser struct {
 	Scanner scanner.Scanner
+
+	// errors holds the syntax errors the parser has recovered from so far
+	errors parse.SyntaxErrors
 }
 
 func (p *Parser) Parse() (query ast.ASTNode, err error) {
@@ -27,7 +31,12 @@ func (p *Parser) Parse() (query ast.ASTNode, err error) {
 			if !ok {
 				panic(e)
 			}
-			err = errors.New(syntaxError.FormatError(p.Scanner.Input))
+			p.errors = append(p.errors, syntaxError)
+		}
+
+		if len(p.errors) > 0 {
+			query = nil
+			err = errors.New(p.errors.FormatErrors(p.Scanner.Input))
 		}
 	}()
 
@@ -35,19 +44,125 @@ func (p *Parser) Parse() (query ast.ASTNode, err error) {
 	// trim queries of whitespace
 	p.Scanner.Input = strings.Trim(p.Scanner.Input, " \t\n")
 
-	err = nil
+	p.errors = nil
 	query = p.query()
 
-	// If we didn't parse all the input, return an error
-	if p.Scanner.Pos != len(p.Scanner.Input) {
-		syntaxError := parse.NewSyntaxError(parse.Token{
-			Type:     scanner.TOK_INVALID,
-			Location: parse.Location{Start: p.Scanner.Pos, End: len(p.Scanner.Input) - 1},
-		}, "Error: query is not valid, starting here")
-		err = errors.New(syntaxError.FormatError(p.Scanner.Input))
+	return
+}
+
+// ParseTimeQuantity parses input, which must consist of a single
+// time-quantity such as "@minute * 5", returning the length of time it
+// describes
+func ParseTimeQuantity(input string) (d time.Duration, err error) {
+	p := Parser{Scanner: scanner.Scanner{Input: strings.Trim(input, " \t\n")}}
+
+	defer func() {
+		if e := recover(); e != nil {
+			syntaxError, ok := e.(parse.SyntaxError)
+			if !ok {
+				panic(e)
+			}
+			d = 0
+			err = errors.New(parse.SyntaxErrors{syntaxError}.FormatErrors(p.Scanner.Input))
+		}
+	}()
+
+	node := p.timeQuantity()
+	if !p.atEnd() {
+		tok := p.Scanner.Emit()
+		panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: unexpected '%s' after time quantity", tok.Lexeme)))
 	}
 
-	return
+	return time.Duration(node.(ast.Numeric).DerivedValue()), nil
+}
+
+// recoverFrom calls parseFn, and if it runs into a syntax error, records the
+// error and skips ahead to the next token accepted by sync, or the end of the
+// input, so that parsing can carry on and find any other errors. It returns
+// false if parseFn ran into an error.
+func (p *Parser) recoverFrom(sync func(parse.Token) bool, parseFn func()) (ok bool) {
+	start := p.Scanner.Pos
+
+	defer func() {
+		e := recover()
+		if e == nil {
+			return
+		}
+
+		syntaxError, isSyntaxError := e.(parse.SyntaxError)
+		if !isSyntaxError {
+			panic(e)
+		}
+		p.errors = append(p.errors, syntaxError)
+		ok = false
+
+		// Resume from the token which caused the error, in case it starts
+		// something we can parse
+		if syntaxError.Location.Start >= start && syntaxError.Location.Start < p.Scanner.Pos {
+			p.Scanner.Start, p.Scanner.Pos = syntaxError.Location.Start, syntaxError.Location.Start
+		}
+
+		// Always make progress, so we don't run into the same error again
+		if p.Scanner.Pos <= start && !p.atEnd() {
+			p.Scanner.Emit()
+		}
+		p.skipUntil(sync)
+	}()
+
+	parseFn()
+	return true
+}
+
+// skipUntil skips tokens until it finds one accepted by sync, which is left to
+// be emitted next, or the end of the input
+func (p *Parser) skipUntil(sync func(parse.Token) bool) {
+	for !p.atEnd() {
+		start, pos := p.Scanner.Start, p.Scanner.Pos
+		t := p.Scanner.Emit()
+		if sync(t) {
+			p.Scanner.Start, p.Scanner.Pos = start, pos
+			return
+		}
+	}
+}
+
+// atEnd returns true once every token has been emitted
+func (p *Parser) atEnd() bool {
+	return p.Scanner.Pos >= len(p.Scanner.Input)
+}
+
+// peek returns the next token without consuming it
+func (p *Parser) peek() parse.Token {
+	start, pos := p.Scanner.Start, p.Scanner.Pos
+	t := p.Scanner.Emit()
+	p.Scanner.Start, p.Scanner.Pos = start, pos
+	return t
+}
+
+// clause is an optional part of a query, following the quantifier
+type clause struct {
+	starts func(parse.Token) bool
+	parse  func()
+}
+
+func isTopicSelectorStart(t parse.Token) bool {
+	return t.Type == scanner.TOK_KEYWORD && t.Lexeme == "in"
+}
+
+func isTimePredicateStart(t parse.Token) bool {
+	return t.Type == scanner.TOK_KEYWORD && (t.Lexeme == "since" || t.Lexeme == "before" || t.Lexeme == "between")
+}
+
+func isDataPredicateStart(t parse.Token) bool {
+	return t.Type == scanner.TOK_KEYWORD && t.Lexeme == "where"
+}
+
+func isDataPipelineStart(t parse.Token) bool {
+	return t.Type == scanner.TOK_PIPE
+}
+
+func isClauseStart(t parse.Token) bool {
+	return isTopicSelectorStart(t) || isTimePredicateStart(t) || isDataPredicateStart(t) || isDataPipelineStart(t)
 }
 
 // query returns a QueryNode
@@ -55,26 +170,53 @@ func (p *Parser) Parse() (query ast.ASTNode, err error) {
 // Grammar:
 //
 //	query           = quantifier [ topic-selector ] [ time-predicate ] [ data-predicate ] [ data-pipeline ]
+//
+// Errors in one part of the query don't stop the others from being parsed, so
+// that every error in the query can be reported at once.
 func (p *Parser) query() ast.ASTNode {
 	q := ast.QueryNode{BaseNode: ast.BaseNode{}, Input: p.Scanner.Input}
 
 	// Queries must start with a Quantifier
-	q.Quantifier = p.quantifier()
-
-	// Check for topic-selector
-	topicSelector := p.topicSelector()
-	if topicSelector != nil {
-		q.Topic = topicSelector
+	p.recoverFrom(isClauseStart, func() {
+		q.Quantifier = p.quantifier()
+	})
+
+	var predicate *ast.DataFunctionNode
+	clauses := []clause{
+		{isTopicSelectorStart, func() { q.Topic = p.topicSelector() }},
+		{isTimePredicateStart, func() { q.TimePredicate = p.timePredicate() }},
+		{isDataPredicateStart, func() { predicate = p.dataPredicate() }},
+		{isDataPipelineStart, func() { q.DataPipeline = p.dataPipeline() }},
 	}
 
-	timePredicate := p.timePredicate()
-	if timePredicate != nil {
-		q.TimePredicate = timePredicate
+	// Clauses are optional, but must come in order
+	next := 0
+	for !p.atEnd() {
+		t := p.peek()
+		found := false
+		for i := next; i < len(clauses) && !found; i++ {
+			if clauses[i].starts(t) {
+				p.recoverFrom(isClauseStart, clauses[i].parse)
+				next, found = i+1, true
+			}
+		}
+
+		if !found {
+			t = p.Scanner.Emit()
+			p.errors = append(p.errors, parse.NewSyntaxError(t, fmt.Sprintf("Error: unexpected token '%s', expected a topic selector, time predicate, where clause, or data pipeline", t.Lexeme)))
+			p.skipUntil(isClauseStart)
+		}
 	}
 
-	dataPipeline := p.dataPipeline()
-	if dataPipeline != nil {
-		q.DataPipeline = dataPipeline
+	// A data-predicate is run as the first stage of the pipeline
+	if predicate != nil {
+		if q.DataPipeline == nil {
+			q.DataPipeline = &ast.DataPipelineNode{Stages: []ast.ASTNode{predicate}}
+		} else {
+			pipeline := q.DataPipeline.(*ast.DataPipelineNode)
+			predicate.Next = pipeline.Stages[0].(*ast.DataFunctionNode)
+			pipeline.Stages = append([]ast.ASTNode{predicate}, pipeline.Stages...)
+		}
 	}
 
 	return &q
@@ -84,12 +226,15 @@ func (p *Parser) query() ast.ASTNode {
 //
 // Grammar:
 //
-//	quantifier      = "all" / sample
+//	quantifier      = "all" / "latest" / sample
+//	sample          = "sample(" ( time-sample / count-sample ) ")" [ "per" "topic" ]
+//	time-sample     = time-quantity [ "," "align" time-expression ]
+//	count-sample    = 1*DIGIT "entries"
 func (p *Parser) quantifier() ast.ASTNode {
 	// Pull off the next token
 	tok := p.Scanner.Emit()
 
-	if tok.Type != scanner.TOK_KEYWORD || (tok.Lexeme != "all" && tok.Lexeme != "sample") {
+	if tok.Type != scanner.TOK_KEYWORD || (tok.Lexeme != "all" && tok.Lexeme != "latest" && tok.Lexeme != "sample") {
 		panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: unexpected token '%s', expected quantifier (all, sample, etc.)", tok.Lexeme)))
 	}
 
@@ -104,17 +249,61 @@ func (p *Parser) quantifier() ast.ASTNode {
 			panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: unexpected token '%s', expected '('", tok.Lexeme)))
 		}
 
-		q.TimeQuantity = p.timeQuantity()
+		q.Count = p.sampleCount()
+		if q.Count == nil {
+			q.TimeQuantity = p.timeQuantity()
+		}
 
 		tok = p.Scanner.Emit()
+		if tok.Type == scanner.TOK_COMMA && q.Count == nil {
+			tok = p.Scanner.Emit()
+			if tok.Type != scanner.TOK_IDENTIFIER || tok.Lexeme != "align" {
+				panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: unexpected token '%s', expected 'align'", tok.Lexeme)))
+			}
+
+			q.Align = p.timeExpression()
+
+			tok = p.Scanner.Emit()
+		}
+
 		if tok.Type != scanner.TOK_PAREN_R {
 			panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: unexpected token '%s', expected ')'", tok.Lexeme)))
 		}
+
+		if next := p.peek(); next.Type == scanner.TOK_IDENTIFIER && next.Lexeme == "per" {
+			p.Scanner.Emit()
+			tok = p.Scanner.Emit()
+			if tok.Type != scanner.TOK_IDENTIFIER || tok.Lexeme != "topic" {
+				panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: unexpected token '%s', expected 'topic'", tok.Lexeme)))
+			}
+			q.PerTopic = true
+		}
 	}
 
 	return &q
 }
 
+// sampleCount returns a NumberNode if the next tokens are a count-sample, or
+// nil without consuming anything otherwise
+func (p *Parser) sampleCount() ast.ASTNode {
+	start, pos := p.Scanner.Start, p.Scanner.Pos
+
+	tok := p.Scanner.Emit()
+	if tok.Type == scanner.TOK_INTEGER {
+		unit := p.Scanner.Emit()
+		if unit.Type == scanner.TOK_IDENTIFIER && unit.Lexeme == "entries" {
+			count := ast.MakeNumberNode(tok)
+			if count.DerivedValue() <= 0 {
+				panic(parse.NewSyntaxError(tok, "Error: sample count must be greater than 0"))
+			}
+			return count
+		}
+	}
+
+	p.Scanner.Start, p.Scanner.Pos = start, pos
+	return nil
+}
+
 // topicSelector returns a TopicSelectorNode
 //
 // Grammar:
@@ -224,6 +413,9 @@ func (p *Parser) timeWhence() ast.ASTNode {
 	case tok.Lexeme == "~now":
 		when = time.Now()
 	case strings.HasPrefix(tok.Lexeme, "~("):
+		if !strings.HasSuffix(tok.Lexeme, ")") || len(tok.Lexeme) < 3 {
+			panic(parse.NewSyntaxError(tok, "Error: time-whence is missing a closing ')'"))
+		}
 		value := tok.Lexeme[2 : len(tok.Lexeme)-1]
 		when, err = ParseVagueDateTime(value)
 		if err != nil {
@@ -296,13 +488,15 @@ func (p *Parser) timeTerm() ast.ASTNode {
 //
 // Grammar:
 //
-//	time-atom       = number / timespan
+//	time-atom       = number / duration / timespan
 func (p *Parser) timeAtom() ast.ASTNode {
 	tok := p.Scanner.Emit()
 
 	switch tok.Type {
 	case scanner.TOK_INTEGER:
 		return ast.MakeNumberNode(tok)
+	case scanner.TOK_DURATION:
+		return unitLiteral(tok)
 	case scanner.TOK_TIMESPAN:
 		return &ast.TimespanNode{BaseNode: ast.BaseNode{
 			Token: tok,
@@ -312,27 +506,61 @@ func (p *Parser) timeAtom() ast.ASTNode {
 	panic(parse.NewSyntaxError(tok, fmt.Sprintf("Expected number of timespan, got '%s'", tok.Lexeme)))
 }
 
+// dataPredicate returns a filter DataFunctionNode, which refers to each entry
+// as "value"
+//
+// Grammar:
+//
+//	data-predicate  = "where" expression
+func (p *Parser) dataPredicate() *ast.DataFunctionNode {
+	t := p.Scanner.Emit()
+	if !isDataPredicateStart(t) {
+		panic(parse.NewSyntaxError(t, fmt.Sprintf("Error: unexpected token '%s', expected 'where'", t.Lexeme)))
+	}
+
+	name := parse.Token{Type: scanner.TOK_IDENTIFIER, Lexeme: "filter", Location: t.Location}
+	value := parse.Token{Type: scanner.TOK_IDENTIFIER, Lexeme: "value", Location: t.Location}
+
+	return &ast.DataFunctionNode{
+		BaseNode:   ast.BaseNode{Token: name},
+		Name:       name,
+		Arguments:  []ast.IdentifierNode{{BaseNode: ast.BaseNode{Token: value}}},
+		Expression: p.expression(),
+	}
+}
+
 // dataPipeline returns a DataPipelineNode, or nil
 //
 // Grammar:
 //
 //	data-pipeline   = 1*data-stage
+//
+// A stage with an error is left out, and parsing carries on with the next one.
 func (p *Parser) dataPipeline() ast.ASTNode {
-	stage := p.dataStage()
-	if stage == nil {
-		return nil
-	}
-
 	stages := []ast.ASTNode{}
 
-	for stage != nil {
+	for {
+		var stage ast.ASTNode
+		ok := p.recoverFrom(isDataPipelineStart, func() {
+			stage = p.dataStage()
+		})
+		if !ok {
+			continue
+		}
+		if stage == nil {
+			break
+		}
+
 		// Chain our stages together
 		if len(stages) > 0 {
 			lastStage := stages[len(stages)-1].(*ast.DataFunctionNode)
 			lastStage.Next = stage.(*ast.DataFunctionNode)
 		}
 		stages = append(stages, stage)
-		stage = p.dataStage()
+	}
+
+	if len(stages) == 0 {
+		return nil
 	}
 
 	return &ast.DataPipelineNode{Stages: stages}
@@ -357,13 +585,16 @@ func (p *Parser) dataStage() ast.ASTNode {
 //
 // Grammar:
 //
-//	data-function   = ( "filter" / "map" / "reduce" ) data-args "->" ( expression / composite / tuple )
+//	data-function   = ( ( "filter" / "map" / "reduce" ) data-args "->" ( expression / composite / tuple ) ) / projection
 //	data-args       = identifier [ "," data-args ]
 func (p *Parser) dataFunction() ast.ASTNode {
 	t := p.Scanner.Emit()
+	if t.Lexeme == "project" {
+		return p.projection(t)
+	}
 	if t.Type != scanner.TOK_KEYWORD && t.Lexeme != "map" && t.Lexeme != "reduce" &&
 		t.Lexeme != "filter" {
-		panic(parse.NewSyntaxError(t, fmt.Sprintf("Error: Unexpected token '%s', expected 'filter', 'map', or 'reduce'", t.Lexeme)))
+		panic(parse.NewSyntaxError(t, fmt.Sprintf("Error: Unexpected token '%s', expected 'filter', 'map', 'reduce', or 'project'", t.Lexeme)))
 	}
 
 	fn := ast.DataFunctionNode{BaseNode: ast.BaseNode{Token: t}, Name: t}
@@ -402,6 +633,62 @@ func (p *Parser) dataFunction() ast.ASTNode {
 	return &fn
 }
 
+// projection returns a map DataFunctionNode, which builds a composite of the
+// given keys of each entry, referred to as "value"
+//
+// Grammar:
+//
+//	projection      = "project" key *( "," key )
+func (p *Parser) projection(project parse.Token) *ast.DataFunctionNode {
+	name := parse.Token{Type: scanner.TOK_IDENTIFIER, Lexeme: "map", Location: project.Location}
+	value := ast.IdentifierNode{BaseNode: ast.BaseNode{Token: parse.Token{Type: scanner.TOK_IDENTIFIER, Lexeme: "value", Location: project.Location}}}
+
+	composite := ast.CompositeNode{}
+	seen := make(map[string]bool)
+
+	for {
+		t := p.Scanner.Emit()
+
+		var key *ast.StringNode
+
+		switch t.Type {
+		case scanner.TOK_STRING:
+			key = ast.MakeStringNode(t)
+		case scanner.TOK_IDENTIFIER:
+			key = ast.MakeStringNodeFromID(t)
+		default:
+			panic(parse.NewSyntaxError(t, fmt.Sprintf("Error: Unexpected token '%s'. Expected a composite key to project", t.Lexeme)))
+		}
+
+		if seen[types.StringVal(key.Val)] {
+			panic(parse.NewSyntaxError(key.Token, fmt.Sprintf("Error: Duplicate composite key '%s'", types.StringVal(key.Val))))
+		}
+		seen[types.StringVal(key.Val)] = true
+
+		composite.Keys = append(composite.Keys, *key)
+		composite.Values = append(composite.Values, &ast.ElementNode{
+			BaseNode:   ast.BaseNode{Token: key.Token},
+			Identifier: value,
+			Subscript:  key,
+		})
+
+		// If next token is not a comma, we're done
+		t = p.Scanner.Emit()
+
+		if t.Type != scanner.TOK_COMMA {
+			p.Scanner.Rewind()
+			break
+		}
+	}
+
+	return &ast.DataFunctionNode{
+		BaseNode:   ast.BaseNode{Token: name},
+		Name:       name,
+		Arguments:  []ast.IdentifierNode{value},
+		Expression: &composite,
+	}
+}
+
 // expression returns a BinaryOpNode, or the result of comparison
 //
 // Grammar:
@@ -491,7 +778,7 @@ func (p *Parser) termMD() ast.ASTNode {
 //
 // Grammar:
 //
-//	unary           = ( ( "-" / "+" ) ( sub-value / integer / float / identifier ) ) / composite / primary
+//	unary           = ( ( "-" / "+" ) ( sub-value / integer / float / duration / size / identifier ) ) / composite / primary
 func (p *Parser) unary() ast.ASTNode {
 	t := p.Scanner.Emit()
 	if t.Type == scanner.TOK_MINUS || t.Type == scanner.TOK_PLUS {
@@ -507,6 +794,8 @@ func (p *Parser) unary() ast.ASTNode {
 
 		if t.Type == scanner.TOK_INTEGER || t.Type == scanner.TOK_FLOAT {
 			op.Operand = ast.MakeNumberNode(t)
+		} else if t.Type == scanner.TOK_DURATION || t.Type == scanner.TOK_SIZE {
+			op.Operand = unitLiteral(t)
 		} else if t.Type == scanner.TOK_IDENTIFIER {
 			op.Operand = &ast.IdentifierNode{ast.BaseNode{Token: t}}
 		} else {
@@ -524,13 +813,18 @@ func (p *Parser) unary() ast.ASTNode {
 //
 // Grammar:
 //
-//	primary         = builtin / sub-value / identifier / integer / float / string / "(" expression ")"
+//	primary         = builtin / boolean / sub-value / identifier / integer / float / duration / size / string / time-whence / timespan / "(" tuple ")"
 func (p *Parser) primary() ast.ASTNode {
 	builtin := p.builtin()
 	if builtin != nil {
 		return builtin
 	}
 
+	boolean := p.boolean()
+	if boolean != nil {
+		return boolean
+	}
+
 	tupleVal := p.subValue()
 	if tupleVal != nil {
 		return tupleVal
@@ -541,11 +835,18 @@ func (p *Parser) primary() ast.ASTNode {
 	switch t.Type {
 	case scanner.TOK_INTEGER, scanner.TOK_FLOAT:
 		return ast.MakeNumberNode(t)
+	case scanner.TOK_DURATION, scanner.TOK_SIZE:
+		return unitLiteral(t)
 	case scanner.TOK_STRING:
 		return ast.MakeStringNode(t)
+	case scanner.TOK_WHENCE:
+		p.Scanner.Rewind()
+		return p.timeWhence()
+	case scanner.TOK_TIMESPAN:
+		return &ast.TimespanNode{BaseNode: ast.BaseNode{Token: t}}
 	case scanner.TOK_PAREN_L:
-		// We're an expression group, so call expression
-		expr := p.expression()
+		// We're an expression group, or a tuple literal, so call tuple
+		expr := p.tuple()
 
 		// Expect a closing paren
 		t = p.Scanner.Emit()
@@ -559,11 +860,41 @@ func (p *Parser) primary() ast.ASTNode {
 	}
 }
 
+// boolean returns a BooleanNode, or nil if the next token isn't true or false
+//
+// Grammar:
+//
+//	boolean         = "true" / "false"
+func (p *Parser) boolean() ast.ASTNode {
+	t := p.Scanner.Emit()
+
+	if t.Type != scanner.TOK_IDENTIFIER || (t.Lexeme != "true" && t.Lexeme != "false") {
+		p.Scanner.Rewind()
+		return nil
+	}
+
+	return ast.MakeBooleanNode(t)
+}
+
+// unitLiteral returns a TimespanNode for a duration, or a NumberNode holding
+// the number of bytes in a size
+func unitLiteral(tok parse.Token) ast.ASTNode {
+	if types.MakeFromToken(tok).Kind() == types.Unknown {
+		panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: '%s' is out of range", tok.Lexeme)))
+	}
+
+	if tok.Type == scanner.TOK_DURATION {
+		return &ast.TimespanNode{BaseNode: ast.BaseNode{Token: tok}}
+	}
+	return ast.MakeNumberNode(tok)
+}
+
 // subValue returns a ElementNode, or Identifier if there is no subscript.
+// Dotted access, x.key, is sugar for x["key"].
 //
 // Grammar:
 //
-//	sub-value     = identifier "[" ( integer / string ) "]"
+//	sub-value     = identifier ( "[" ( array-subscript / string ) "]" / "." identifier )
 func (p *Parser) subValue() ast.ASTNode {
 	t := p.Scanner.Emit()
 
@@ -576,6 +907,14 @@ func (p *Parser) subValue() ast.ASTNode {
 
 	t = p.Scanner.Emit()
 
+	if t.Type == scanner.TOK_DOT {
+		t = p.Scanner.Emit()
+		if t.Type != scanner.TOK_IDENTIFIER {
+			panic(parse.NewSyntaxError(t, fmt.Sprintf("Error: Unexpected token '%s'. Expected a key after '.'", t.Lexeme)))
+		}
+		return &ast.ElementNode{Identifier: identifier, Subscript: ast.MakeStringNodeFromID(t)}
+	}
+
 	// If we're not a tuple value, return the identifier
 	if t.Type != scanner.TOK_BRACKET_L {
 		p.Scanner.Rewind()
@@ -587,8 +926,9 @@ func (p *Parser) subValue() ast.ASTNode {
 	var subscript ast.ASTNode
 
 	switch t.Type {
-	case scanner.TOK_INTEGER:
-		subscript = ast.MakeNumberNode(t)
+	case scanner.TOK_INTEGER, scanner.TOK_MINUS, scanner.TOK_COLON:
+		p.Scanner.Rewind()
+		subscript = p.arraySubscript()
 	case scanner.TOK_STRING:
 		subscript = ast.MakeStringNode(t)
 	case scanner.TOK_IDENTIFIER:
@@ -606,6 +946,57 @@ func (p *Parser) subValue() ast.ASTNode {
 	return &ast.ElementNode{Identifier: identifier, Subscript: subscript}
 }
 
+// arraySubscript returns the NumberNode indexing an array, or the SliceNode
+// slicing it. Negative indices count back from the end of the array.
+//
+// Grammar:
+//
+//	array-subscript = index / [ index ] ":" [ index ]
+func (p *Parser) arraySubscript() ast.ASTNode {
+	start := p.index()
+
+	t := p.Scanner.Emit()
+	if t.Type != scanner.TOK_COLON {
+		p.Scanner.Rewind()
+		return start
+	}
+
+	return &ast.SliceNode{BaseNode: ast.BaseNode{Token: t}, Start: start, End: p.index()}
+}
+
+// index returns the NumberNode of an array index, or nil if there is none
+//
+// Grammar:
+//
+//	index = [ "-" ] integer
+func (p *Parser) index() *ast.NumberNode {
+	t := p.Scanner.Emit()
+
+	if t.Type == scanner.TOK_MINUS {
+		minus := t
+		t = p.Scanner.Emit()
+		if t.Type != scanner.TOK_INTEGER {
+			panic(parse.NewSyntaxError(t, fmt.Sprintf("Error: Unexpected token '%s'. Expected an integer after '-'", t.Lexeme)))
+		}
+
+		// The sign is folded into the index, so that it's a single literal
+		t = parse.Token{
+			Type:     t.Type,
+			Lexeme:   "-" + t.Lexeme,
+			Location: parse.Location{Start: minus.Location.Start, End: t.Location.End},
+		}
+	} else if t.Type != scanner.TOK_INTEGER {
+		p.Scanner.Rewind()
+		return nil
+	}
+
+	index := ast.MakeNumberNode(t)
+	if index.Val.Kind() != types.Int {
+		panic(parse.NewSyntaxError(t, fmt.Sprintf("Error: Invalid tuple index '%s'", t.Lexeme)))
+	}
+	return index
+}
+
 // builtin returns a BuiltinFunctionNode or an IdentifierNode or nil
 //
 // Grammar:
@@ -671,10 +1062,11 @@ func (p *Parser) tuple() ast.ASTNode {
 //
 // Grammar:
 //
-//	composite      = string ":" primary *( "," string ":" primary )
+//	composite      = key ":" expression *( "," key ":" expression )
+//	key            = string / identifier
 func (p *Parser) composite() ast.ASTNode {
 	composite := ast.CompositeNode{}
-	found := false
+	seen := make(map[string]bool)
 
 	for {
 		start, pos := p.Scanner.Start, p.Scanner.Pos
@@ -687,23 +1079,32 @@ func (p *Parser) composite() ast.ASTNode {
 			key = ast.MakeStringNode(t)
 		case scanner.TOK_IDENTIFIER:
 			key = ast.MakeStringNodeFromID(t)
-		default:
-			p.Scanner.Rewind()
-			break
 		}
 
-		t = p.Scanner.Emit()
+		if key != nil {
+			t = p.Scanner.Emit()
+		}
 
-		if t.Type != scanner.TOK_COLON {
+		if key == nil || t.Type != scanner.TOK_COLON {
+			// Once we've seen a key, every element must have one
+			if len(composite.Keys) > 0 {
+				p.Scanner.Start, p.Scanner.Pos = start, pos
+				t = p.Scanner.Emit()
+				panic(parse.NewSyntaxError(t, fmt.Sprintf("Error: Unexpected token '%s'. Expected a composite key", t.Lexeme)))
+			}
 			p.Scanner.Start, p.Scanner.Pos = start, pos
 			break
 		}
 
+		if seen[types.StringVal(key.Val)] {
+			panic(parse.NewSyntaxError(key.Token, fmt.Sprintf("Error: Duplicate composite key '%s'", types.StringVal(key.Val))))
+		}
+		seen[types.StringVal(key.Val)] = true
+
 		value := p.expression()
 
 		composite.Keys = append(composite.Keys, *key)
 		composite.Values = append(composite.Values, value)
-		found = true
 
 		// If next token is not a comma, we're done
 		t = p.Scanner.Emit()
@@ -714,7 +1115,7 @@ func (p *Parser) composite() ast.ASTNode {
 		}
 	}
 
-	if found == false {
+	if len(composite.Keys) == 0 {
 		return nil
 	}
 
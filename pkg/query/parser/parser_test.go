@@ -78,7 +78,7 @@ func TestParse(t *testing.T) {
 			for s.Scan() {
 				var d ast.Dumper
 				p := Parser{
-					scanner.Scanner{
+					Scanner: scanner.Scanner{
 						Input: s.Text(),
 					},
 				}
@@ -115,3 +115,61 @@ func TestParse(t *testing.T) {
 
 	fmt.Print(tests)
 }
+
+func TestParseRecoversFromErrors(t *testing.T) {
+	tt := []struct {
+		query    string
+		messages []string
+	}{
+		{
+			"al in /foo | map x -> x",
+			[]string{"unexpected token 'al'"},
+		},
+		{
+			"all in /foo sinse ~now | mop x -> x | map x x * 2 | filter y -> y[",
+			[]string{
+				"unexpected token 'sinse'",
+				"Unexpected token 'mop'",
+				"Unexpected token '*', expected an identifier",
+				"Invalid tuple subscript",
+			},
+		},
+		{
+			"all in | map x -> | map y -> y[-]",
+			[]string{
+				"expected a topic after 'in' keyword",
+				"Unexpected token '|'",
+				"Expected an integer after '-'",
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		p := Parser{
+			Scanner: scanner.Scanner{
+				Input: tc.query,
+			},
+		}
+
+		_, err := p.Parse()
+		if err == nil {
+			t.Errorf("expected query to fail: %s", tc.query)
+			continue
+		}
+
+		if len(tc.messages) > 1 && !strings.HasPrefix(err.Error(), fmt.Sprintf("%d syntax errors", len(tc.messages))) {
+			t.Errorf("expected %d errors for %s, got:\n%s", len(tc.messages), tc.query, err)
+		}
+
+		// Errors are reported in the order they appear in the query
+		rest := err.Error()
+		for _, m := range tc.messages {
+			i := strings.Index(rest, m)
+			if i < 0 {
+				t.Errorf("expected error '%s' for %s, got:\n%s", m, tc.query, err)
+				break
+			}
+			rest = rest[i+len(m):]
+		}
+	}
+}
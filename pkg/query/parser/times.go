@@ -20,6 +20,7 @@ var numberFormats = [...]string{
 	time.RFC822,
 	time.RFC822Z,
 	time.Layout,
+	"2006-01-02",
 	"2006/01/02",
 	"02/01/2006",
 }
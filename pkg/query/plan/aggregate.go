@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package plan
+
+import (
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/query/ast"
+	"github.com/dburkart/fossil/pkg/query/types"
+)
+
+// Aggregate runs a data pipeline which reduces its input, one entry at a time
+// as entries are scanned from the database. Unlike a Pipeline, the entries
+// are never collected, and don't pass between stages running in their own
+// goroutines, so aggregates over long ranges of time are much cheaper.
+//
+// Only pipelines whose reduce is preceded by filter and map stages taking a
+// single argument can be run this way. Stages after the reduce run as a
+// Pipeline over its result.
+type Aggregate struct {
+	stages []*ast.DataFunctionNode
+	reduce *ast.DataFunctionNode
+	rest   []ast.ASTNode
+}
+
+// MakeAggregateFromNode returns an Aggregate running the pipeline node, and
+// whether it can be run as one
+func MakeAggregateFromNode(node *ast.DataPipelineNode) (Aggregate, bool) {
+	var a Aggregate
+
+	for i, stage := range node.Stages {
+		stage, ok := stage.(*ast.DataFunctionNode)
+		if !ok {
+			return a, false
+		}
+
+		switch stage.Name.Lexeme {
+		case "filter", "map":
+			if len(stage.Arguments) != 1 {
+				return a, false
+			}
+			a.stages = append(a.stages, stage)
+		case "reduce":
+			a.reduce = stage
+			a.rest = node.Stages[i+1:]
+			return a, true
+		default:
+			return a, false
+		}
+	}
+	return a, false
+}
+
+// Execute runs the pipeline over the entries scan calls its argument with
+func (a Aggregate) Execute(scan func(func(database.Entry))) database.Entries {
+	states := make([]BuiltinState, len(a.stages))
+	for i := range states {
+		states[i] = make(BuiltinState)
+	}
+	r := reducer{node: a.reduce}
+
+	scan(func(entry database.Entry) {
+		w := Wrap(entry)
+		for i, stage := range a.stages {
+			fn := MakeStatefulFunction(SymbolMap{stage.Arguments[0].Value(): w.Value()}, states[i], w.entry)
+			ast.Walk(&fn, stage)
+			result := fn.Result[0]
+
+			// As in FilterStage and MapStage, entries are dropped when their
+			// predicate or value can't be computed
+			if types.IsUnknown(result) {
+				return
+			}
+			if stage.Name.Lexeme == "filter" {
+				if !types.BooleanVal(result) {
+					return
+				}
+				continue
+			}
+			w = w.Copy(result)
+		}
+		r.add(w)
+	})
+
+	result := r.result()
+	if len(a.rest) == 0 {
+		var results database.Entries
+		for _, w := range result {
+			results = append(results, w.Entry())
+		}
+		return results
+	}
+
+	rest := MakePipelineFromNode(&ast.DataPipelineNode{Stages: a.rest})
+	return rest.run(func(first Stage) {
+		if result != nil {
+			first.Add(destructure(a.reduce, result))
+		}
+	})
+}
+
+// reducer reduces entries one at a time, exactly as ReduceStage does: the
+// first two entries are passed to the reduce function in order, and after
+// that, each new entry is passed along with the result so far. An entry whose
+// reduction can't be computed is skipped.
+type reducer struct {
+	node  *ast.DataFunctionNode
+	count int
+	first WrappedEntry
+	acc   WrappedEntry
+}
+
+func (r *reducer) add(w WrappedEntry) {
+	r.count++
+	switch r.count {
+	case 1:
+		r.first = w
+	case 2:
+		r.acc = w
+		r.reduceInto(r.first, w)
+	default:
+		r.reduceInto(w, r.acc)
+	}
+}
+
+// reduceInto reduces a and b, keeping the result as the accumulated value
+// along with the metadata of a
+func (r *reducer) reduceInto(a, b WrappedEntry) {
+	symbols := make(SymbolMap)
+	symbols[r.node.Arguments[0].Value()] = a.Value()
+	symbols[r.node.Arguments[1].Value()] = b.Value()
+
+	fn := MakeFunction(symbols)
+	ast.Walk(&fn, r.node)
+	if types.IsUnknown(fn.Result[0]) {
+		return
+	}
+
+	r.acc = a.Copy(fn.Result[0])
+	r.acc.SetTopic("N/A")
+}
+
+// result returns the reduced entry, or nil if nothing was reduced
+func (r *reducer) result() []WrappedEntry {
+	switch r.count {
+	case 0:
+		return nil
+	case 1:
+		return []WrappedEntry{r.first}
+	}
+	return []WrappedEntry{r.acc}
+}
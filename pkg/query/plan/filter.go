@@ -17,6 +17,8 @@ type FilterStage struct {
 	root  *ast.DataFunctionNode
 	input chan []WrappedEntry
 	once  sync.Once
+	state BuiltinState
+	profiler
 }
 
 func MakeFilterStage(node *ast.DataFunctionNode) *FilterStage {
@@ -24,6 +26,7 @@ func MakeFilterStage(node *ast.DataFunctionNode) *FilterStage {
 
 	f.input = make(chan []WrappedEntry)
 	f.root = node
+	f.state = make(BuiltinState)
 	return &f
 }
 
@@ -47,19 +50,26 @@ func (f *FilterStage) Finish() {
 
 func (f *FilterStage) Execute() {
 	for entries := range f.input {
+		f.received(1)
+		start := f.start()
+
 		symbols := make(SymbolMap)
 
 		for idx, arg := range f.root.Arguments {
 			symbols[arg.Value()] = entries[idx].Value()
 		}
 
-		fn := MakeFunction(symbols)
+		fn := MakeStatefulFunction(symbols, f.state, entries[0].entry)
 		ast.Walk(&fn, f.root)
 
-		allowed := types.BooleanVal(fn.Result[0])
+		// Entries whose predicate couldn't be evaluated, for instance due to a
+		// failed cast, are rejected
+		allowed := !types.IsUnknown(fn.Result[0]) && types.BooleanVal(fn.Result[0])
+		f.stop(start)
 
 		if allowed {
-			f.Next().Add(entries)
+			f.emitted(1)
+			f.Next().Add(destructure(f.root, entries))
 		}
 	}
 	f.Next().Finish()
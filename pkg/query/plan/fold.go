@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package plan
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/common/parse"
+	"github.com/dburkart/fossil/pkg/query/ast"
+	"github.com/dburkart/fossil/pkg/query/scanner"
+	"github.com/dburkart/fossil/pkg/query/types"
+)
+
+// Fold evaluates the constant parts of the query rooted at node, so that
+// they're computed once when the query is prepared, rather than each time a
+// filter runs or for every entry passing through a stage. Time expressions
+// are replaced by the time they evaluate to, with ~now evaluated afresh, time
+// quantities by the duration they evaluate to, and arithmetic on number and
+// string literals by the literal it evaluates to. Folding must happen after
+// type checking.
+//
+// Nodes which change are copied rather than modified, so a checked query can
+// be folded again each time it's prepared.
+func Fold(node ast.ASTNode) ast.ASTNode {
+	switch n := node.(type) {
+	case *ast.QueryNode:
+		q := *n
+		q.Quantifier = Fold(n.Quantifier)
+		if n.TimePredicate != nil {
+			q.TimePredicate = Fold(n.TimePredicate)
+		}
+		if n.DataPipeline != nil {
+			q.DataPipeline = Fold(n.DataPipeline)
+		}
+		return &q
+
+	case *ast.QuantifierNode:
+		q := *n
+		if n.TimeQuantity != nil {
+			q.TimeQuantity = foldQuantity(n.TimeQuantity)
+		}
+		if n.Align != nil {
+			q.Align = Fold(n.Align)
+		}
+		return &q
+
+	case *ast.TimePredicateNode:
+		p := *n
+		p.Begin = Fold(n.Begin)
+		if n.End != nil {
+			p.End = Fold(n.End)
+		}
+		return &p
+
+	case *ast.TimeExpressionNode:
+		e := *n
+		e.Whence = Fold(n.Whence)
+		if n.Quantity == nil {
+			return &e
+		}
+		whence := e.Whence.(*ast.TimeWhenceNode)
+		return &ast.TimeExpressionNode{
+			BaseNode: n.BaseNode,
+			Whence:   &ast.TimeWhenceNode{BaseNode: whence.BaseNode, When: e.Time()},
+		}
+
+	case *ast.TimeWhenceNode:
+		if n.Value() == "~now" {
+			return &ast.TimeWhenceNode{BaseNode: n.BaseNode, When: time.Now()}
+		}
+
+	case *ast.DataPipelineNode:
+		p := *n
+		p.Stages = make([]ast.ASTNode, len(n.Stages))
+		for i, stage := range n.Stages {
+			p.Stages[i] = Fold(stage)
+		}
+		// Link each stage to the copy of the next one
+		for i := 0; i+1 < len(p.Stages); i++ {
+			stage, ok := p.Stages[i].(*ast.DataFunctionNode)
+			next, nextOk := p.Stages[i+1].(*ast.DataFunctionNode)
+			if ok && nextOk && stage.Next != nil {
+				stage.Next = next
+			}
+		}
+		return &p
+
+	case *ast.DataFunctionNode:
+		f := *n
+		f.Expression = Fold(n.Expression)
+		return &f
+
+	case *ast.BuiltinFunctionNode:
+		f := *n
+		f.Expression = Fold(n.Expression)
+		return &f
+
+	case *ast.TupleNode:
+		t := *n
+		t.Elements = make([]ast.ASTNode, len(n.Elements))
+		for i, e := range n.Elements {
+			t.Elements[i] = Fold(e)
+		}
+		return &t
+
+	case *ast.CompositeNode:
+		c := *n
+		c.Values = make([]ast.ASTNode, len(n.Values))
+		for i, v := range n.Values {
+			c.Values[i] = Fold(v)
+		}
+		return &c
+
+	case *ast.UnaryOpNode:
+		u := *n
+		u.Operand = Fold(n.Operand)
+		if operand, ok := constant(u.Operand); ok {
+			v := evaluate(func() types.Value { return types.UnaryOp(u.Operator, operand) })
+			if folded := literal(u.Token, v); folded != nil {
+				return folded
+			}
+		}
+		return &u
+
+	case *ast.BinaryOpNode:
+		b := *n
+		b.Left = Fold(n.Left)
+		b.Right = Fold(n.Right)
+		left, lok := constant(b.Left)
+		right, rok := constant(b.Right)
+		if lok && rok {
+			v := evaluate(func() types.Value { return types.BinaryOp(left, b.Op, right) })
+			if folded := literal(b.Token, v); folded != nil {
+				return folded
+			}
+		}
+		return &b
+	}
+
+	return node
+}
+
+// foldQuantity replaces a time quantity with the number of nanoseconds it
+// evaluates to
+func foldQuantity(node ast.ASTNode) ast.ASTNode {
+	quantity, ok := node.(ast.Numeric)
+	if !ok {
+		return node
+	}
+	if _, ok := node.(*ast.NumberNode); ok {
+		return node
+	}
+
+	return literal(parse.Token{}, types.MakeInt(quantity.DerivedValue()))
+}
+
+// constant returns the value of a number or string literal
+func constant(node ast.ASTNode) (types.Value, bool) {
+	switch n := node.(type) {
+	case *ast.NumberNode:
+		return n.Val, true
+	case *ast.StringNode:
+		return n.Val, true
+	}
+	return nil, false
+}
+
+// evaluate returns the result of fn, or Unknown if it panics on operands it
+// doesn't support, which is left to happen when the query runs
+func evaluate(fn func() types.Value) (v types.Value) {
+	defer func() {
+		if recover() != nil {
+			v = types.MakeUnknown()
+		}
+	}()
+	return fn()
+}
+
+// literal returns a number or string literal holding v, in place of the
+// expression at tok, or nil if v isn't a number or string
+func literal(tok parse.Token, v types.Value) ast.ASTNode {
+	tok = parse.Token{Location: tok.Location}
+
+	switch v.Kind() {
+	case types.Int:
+		tok.Type, tok.Lexeme = scanner.TOK_INTEGER, strconv.FormatInt(types.IntVal(v), 10)
+		return &ast.NumberNode{BaseNode: ast.BaseNode{Token: tok}, Val: v}
+	case types.Float:
+		tok.Type, tok.Lexeme = scanner.TOK_FLOAT, strconv.FormatFloat(types.FloatVal(v), 'g', -1, 64)
+		return &ast.NumberNode{BaseNode: ast.BaseNode{Token: tok}, Val: v}
+	case types.String:
+		tok.Type, tok.Lexeme = scanner.TOK_STRING, strconv.Quote(types.StringVal(v))
+		return &ast.StringNode{BaseNode: ast.BaseNode{Token: tok}, Val: v}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package plan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/query/ast"
+	"github.com/dburkart/fossil/pkg/query/parser"
+	"github.com/dburkart/fossil/pkg/query/scanner"
+	"github.com/dburkart/fossil/pkg/query/types"
+)
+
+func parseAndFold(t *testing.T, query string) *ast.QueryNode {
+	t.Helper()
+
+	p := parser.Parser{Scanner: scanner.Scanner{Input: query}}
+	root, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Fold(root).(*ast.QueryNode)
+}
+
+func TestFoldTimes(t *testing.T) {
+	before := time.Now()
+	q := parseAndFold(t, "sample(@minute * 5, align ~now - @day) since ~now - @day * 7")
+	after := time.Now()
+	ago := func(tm time.Time, d time.Duration) bool {
+		return !tm.Before(before.Add(-d)) && !tm.After(after.Add(-d))
+	}
+
+	quantity, ok := q.Quantifier.(*ast.QuantifierNode).TimeQuantity.(*ast.NumberNode)
+	if !ok || time.Duration(quantity.DerivedValue()) != 5*time.Minute {
+		t.Errorf("expected the sample quantity to be folded to 5m, got %#v", q.Quantifier.(*ast.QuantifierNode).TimeQuantity)
+	}
+
+	align := q.Quantifier.(*ast.QuantifierNode).Align.(*ast.TimeExpressionNode)
+	if align.Quantity != nil || !ago(align.Time(), 24*time.Hour) {
+		t.Errorf("expected the alignment to be folded to a day ago, got %v", align.Time())
+	}
+
+	since := q.TimePredicate.(*ast.TimePredicateNode).Begin.(*ast.TimeExpressionNode)
+	if since.Quantity != nil || !ago(since.Time(), 7*24*time.Hour) {
+		t.Errorf("expected since to be folded to a week ago, got %v", since.Time())
+	}
+}
+
+func TestFoldArithmetic(t *testing.T) {
+	tests := []struct {
+		query string
+		// folded is the kind of literal the expression of the stage folds to,
+		// or Unknown if it isn't constant
+		folded types.Kind
+	}{
+		{"all | map x -> x * (2 + 3)", types.Unknown},
+		{"all | map x -> -2 * 3 + 1", types.Int},
+		{"all | map x -> 1 / 4", types.Float},
+		{"all | map x -> 1 < 2", types.Unknown},
+	}
+
+	for _, tc := range tests {
+		q := parseAndFold(t, tc.query)
+		stage := q.DataPipeline.(*ast.DataPipelineNode).Stages[0].(*ast.DataFunctionNode)
+
+		v, ok := constant(stage.Expression)
+		if tc.folded == types.Unknown {
+			if ok {
+				t.Errorf("%s: expected the expression not to be folded, got %v", tc.query, v)
+			}
+			continue
+		}
+		if !ok || v.Kind() != tc.folded {
+			t.Errorf("%s: expected the expression to be folded, got %#v", tc.query, stage.Expression)
+		}
+	}
+
+	// Constant parts of expressions are folded even when the whole isn't
+	q := parseAndFold(t, "all | map x -> x * (2 + 3)")
+	product := q.DataPipeline.(*ast.DataPipelineNode).Stages[0].(*ast.DataFunctionNode).Expression.(*ast.BinaryOpNode)
+	if v, ok := constant(product.Right); !ok || types.IntVal(v) != 5 {
+		t.Errorf("expected 2 + 3 to be folded to 5, got %#v", product.Right)
+	}
+}
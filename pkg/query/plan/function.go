@@ -8,24 +8,49 @@ package plan
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/dburkart/fossil/pkg/database"
 	"github.com/dburkart/fossil/pkg/query/ast"
 	"github.com/dburkart/fossil/pkg/query/types"
 )
 
 type SymbolMap map[string]types.Value
 
+// BuiltinState holds what each call of a stateful builtin in a stage keeps
+// between entries, separately for each topic
+type BuiltinState map[builtinCall]*any
+
+type builtinCall struct {
+	node  *ast.BuiltinFunctionNode
+	topic string
+}
+
 type Function struct {
 	Result  []types.Value
 	symbols SymbolMap
 	results map[ast.ASTNode]types.Value
 	stack   []ast.ASTNode
+
+	// state and entry are only set for functions which run stateful builtins
+	state BuiltinState
+	entry *database.Entry
 }
 
 func MakeFunction(symbols SymbolMap) Function {
 	return Function{symbols: symbols, results: make(map[ast.ASTNode]types.Value)}
 }
 
+// MakeStatefulFunction makes a function which runs stateful builtins on
+// entry, keeping what they need for the next entry in state. Without state,
+// stateful builtins return Unknown.
+func MakeStatefulFunction(symbols SymbolMap, state BuiltinState, entry *database.Entry) Function {
+	f := MakeFunction(symbols)
+	f.state = state
+	f.entry = entry
+	return f
+}
+
 // FIXME: Factor out stack into it's own thing
 func (f *Function) push(node ast.ASTNode) {
 	f.stack = append(f.stack, node)
@@ -54,6 +79,12 @@ func (f *Function) Visit(node ast.ASTNode) ast.Visitor {
 			f.results[n] = n.Val
 		case *ast.StringNode:
 			f.results[n] = n.Val
+		case *ast.BooleanNode:
+			f.results[n] = n.Val
+		case *ast.TimeWhenceNode:
+			f.results[n] = types.MakeTimestamp(n.When)
+		case *ast.TimespanNode:
+			f.results[n] = types.MakeDuration(time.Duration(n.DerivedValue()))
 		case *ast.UnaryOpNode:
 			f.results[n] = types.UnaryOp(n.Operator, f.results[n.Operand])
 		case *ast.BinaryOpNode:
@@ -66,25 +97,66 @@ func (f *Function) Visit(node ast.ASTNode) ast.Visitor {
 
 			switch s := n.Subscript.(type) {
 			case *ast.StringNode:
-				f.results[n] = types.CompositeVal(result)[types.StringVal(s.Val)]
+				value, ok := types.CompositeVal(result)[types.StringVal(s.Val)]
+				if !ok {
+					// Optional keys may be missing from a composite
+					value = types.MakeUnknown()
+				}
+				f.results[n] = value
 			case *ast.NumberNode:
-				f.results[n] = types.TupleVal(result)[types.IntVal(s.Val)]
+				values := types.TupleVal(result)
+				i, _ := s.Index(len(values))
+				f.results[n] = values[i]
+			case *ast.SliceNode:
+				values := types.TupleVal(result)
+				start, end := s.Bounds(len(values))
+				f.results[n] = types.MakeTuple(append([]types.Value{}, values[start:end]...))
 			default:
 				panic(fmt.Sprintf("Subscript %s is not valid!", n.Subscript.Value()))
 			}
 		case *ast.TupleNode:
 			var values []types.Value
+			floats := false
 			for _, v := range n.Elements {
 				values = append(values, f.results[v])
+				floats = floats || f.results[v].Kind() == types.Float
+			}
+
+			// Tuples holding any floats are inferred to be float arrays, so
+			// convert any ints to match
+			if floats {
+				for i, v := range values {
+					if v.Kind() == types.Int {
+						values[i] = types.MakeFloat(float64(types.IntVal(v)))
+					}
+				}
 			}
 			f.results[n] = types.MakeTuple(values)
+		case *ast.CompositeNode:
+			values := make(map[string]types.Value, len(n.Keys))
+			for i, key := range n.Keys {
+				values[types.StringVal(key.Val)] = f.results[n.Values[i]]
+			}
+			f.results[n] = types.MakeComposite(values)
 		case *ast.BuiltinFunctionNode:
 			fn, ok := types.LookupBuiltinFunction(n.Name.Lexeme)
 			if !ok {
 				panic("We should never have an invalid builtin name here")
 			}
 
-			f.results[n] = fn.Execute(f.results[n.Expression])
+			stateful, ok := fn.(types.StatefulBuiltin)
+			if !ok || f.state == nil {
+				f.results[n] = fn.Execute(f.results[n.Expression])
+				break
+			}
+
+			call := builtinCall{node: n, topic: f.entry.Topic}
+			state, ok := f.state[call]
+			if !ok {
+				state = new(any)
+				f.state[call] = state
+			}
+			f.results[n] = stateful.ExecuteAt(f.results[n.Expression], f.entry.Time, state)
 		case *ast.DataFunctionNode:
 			f.Result = append(f.Result, f.results[n.Expression])
 		}
@@ -93,8 +165,8 @@ func (f *Function) Visit(node ast.ASTNode) ast.Visitor {
 	}
 
 	switch n := node.(type) {
-	case *ast.DataFunctionNode, *ast.IdentifierNode, *ast.NumberNode, *ast.UnaryOpNode, *ast.BinaryOpNode,
-		*ast.TupleNode, *ast.ElementNode, *ast.BuiltinFunctionNode, *ast.CompositeNode:
+	case *ast.DataFunctionNode, *ast.IdentifierNode, *ast.NumberNode, *ast.StringNode, *ast.BooleanNode, *ast.UnaryOpNode, *ast.BinaryOpNode,
+		*ast.TupleNode, *ast.ElementNode, *ast.BuiltinFunctionNode, *ast.CompositeNode, *ast.TimeWhenceNode, *ast.TimespanNode:
 		f.push(n)
 		return f
 	}
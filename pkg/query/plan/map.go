@@ -8,6 +8,7 @@ package plan
 
 import (
 	"github.com/dburkart/fossil/pkg/query/ast"
+	"github.com/dburkart/fossil/pkg/query/types"
 	"sync"
 )
 
@@ -16,6 +17,8 @@ type MapStage struct {
 	root  *ast.DataFunctionNode
 	input chan []WrappedEntry
 	once  sync.Once
+	state BuiltinState
+	profiler
 }
 
 func MakeMapStage(node *ast.DataFunctionNode) *MapStage {
@@ -23,6 +26,7 @@ func MakeMapStage(node *ast.DataFunctionNode) *MapStage {
 
 	m.input = make(chan []WrappedEntry)
 	m.root = node
+	m.state = make(BuiltinState)
 	return &m
 }
 
@@ -46,22 +50,35 @@ func (m *MapStage) Finish() {
 
 func (m *MapStage) Execute() {
 	for entries := range m.input {
+		m.received(1)
+		start := m.start()
+
 		symbols := make(SymbolMap)
 
 		for idx, arg := range m.root.Arguments {
 			symbols[arg.Value()] = entries[idx].Value()
 		}
 
-		fn := MakeFunction(symbols)
+		prototype := entries[0]
+		fn := MakeStatefulFunction(symbols, m.state, prototype.entry)
 		ast.Walk(&fn, m.root)
 
 		var newEntries []WrappedEntry
-		prototype := entries[0]
 		for _, r := range fn.Result {
+			// Results which couldn't be computed, for instance due to a
+			// failed cast, are skipped
+			if types.IsUnknown(r) {
+				continue
+			}
 			newEntries = append(newEntries, prototype.Copy(r))
 		}
+		m.stop(start)
 
-		m.Next().Add(newEntries)
+		if len(newEntries) == 0 {
+			continue
+		}
+		m.emitted(1)
+		m.Next().Add(destructure(m.root, newEntries))
 	}
 	m.Next().Finish()
 }
@@ -7,15 +7,43 @@
 package plan
 
 import (
+	"errors"
+	"fmt"
 	"github.com/dburkart/fossil/pkg/database"
 	"github.com/dburkart/fossil/pkg/query/ast"
 	"strings"
 	"time"
 )
 
+// ErrTopicDenied is returned when a query selects a topic which isn't
+// allowed, and none of the topics beneath it are either
+var ErrTopicDenied = errors.New("access denied")
+
 type MetaDataFilterBuilder struct {
 	Filters database.Filters
 	DB      *database.Database
+	// Allowed, if set, restricts the query to topics for which it returns
+	// true
+	Allowed func(topic string) bool
+	// Err records a topic selector which selects no allowed topics
+	Err error
+	// Range is the span of time selected by the query's time predicate, or
+	// nil if it has none
+	Range *database.TimeRange
+
+	// latest is the query made by the latest quantifier, which retrieves
+	// entries itself rather than filtering them, so that it can read only
+	// the newest data
+	latest *database.Query
+
+	// topics and rangeSemantics record the topic selector and time predicate
+	// for Scan. topics is nil if the query has no topic selector.
+	topics         map[string]bool
+	rangeSemantics string
+
+	// system holds the system topics selected by the query, whose entries
+	// are generated rather than retrieved, or nil if it selects none
+	system []string
 }
 
 func (m *MetaDataFilterBuilder) Visit(node ast.ASTNode) ast.Visitor {
@@ -24,39 +52,130 @@ func (m *MetaDataFilterBuilder) Visit(node ast.ASTNode) ast.Visitor {
 	case *ast.QueryNode:
 		return m
 	case *ast.QuantifierNode:
+		if n.Value() == "latest" {
+			m.latest = &database.Query{Quantifier: n.Value()}
+		}
 		m.Filters = append(m.Filters, m.makeQuantifierFilter(n))
 	case *ast.TopicSelectorNode:
-		m.Filters = append(m.Filters, m.makeTopicSelectionFilter(n))
+		topics := m.selectTopics(n)
+		if m.latest != nil {
+			m.latest.Topics = topics
+			break
+		}
+		m.topics = make(map[string]bool)
+		for _, t := range topics {
+			m.topics[t] = true
+		}
+		m.Filters = append(m.Filters, m.makeTopicSelectionFilter(topics))
 	case *ast.TimePredicateNode:
-		m.Filters = append(m.Filters, m.makeTimePredicateFilter(n))
+		timeRange := m.timeRange(n)
+		m.Range = &timeRange
+		m.rangeSemantics = n.Value()
+		if m.latest != nil {
+			m.latest.Range = &timeRange
+			m.latest.RangeSemantics = n.Value()
+			break
+		}
+		m.Filters = append(m.Filters, m.makeTimePredicateFilter(n, timeRange))
 	}
 
 	return nil
 }
 
+// retrieve retrieves entries from the database, leaving out any from topics
+// which aren't allowed
+func (m *MetaDataFilterBuilder) retrieve(q database.Query) database.Entries {
+	if m.system != nil {
+		return m.systemEntries()
+	}
+
+	data := m.DB.Retrieve(q)
+	if m.Allowed == nil {
+		return data
+	}
+
+	filtered := database.Entries{}
+	for _, val := range data {
+		if m.Allowed(val.Topic) {
+			filtered = append(filtered, val)
+		}
+	}
+	return filtered
+}
+
+// Scan calls fn with each entry selected by the query's topic selector and
+// time predicate, as they're scanned from the database, leaving out any from
+// topics which aren't allowed. The entries are the same as those the "all"
+// quantifier's filters return, without retrieving them all at once.
+func (m *MetaDataFilterBuilder) Scan(fn func(database.Entry)) {
+	if m.system != nil {
+		for _, e := range m.systemEntries() {
+			fn(e)
+		}
+		return
+	}
+
+	q := database.Query{Range: m.Range, RangeSemantics: m.rangeSemantics, OnlyTopics: m.topics != nil}
+	for t := range m.topics {
+		q.Topics = append(q.Topics, t)
+	}
+	m.DB.Scan(q, func(e database.Entry) {
+		if m.topics != nil && !m.topics[e.Topic] {
+			return
+		}
+		if m.Allowed != nil && !m.Allowed(e.Topic) {
+			return
+		}
+		fn(e)
+	})
+}
+
 func (m *MetaDataFilterBuilder) makeQuantifierFilter(q *ast.QuantifierNode) database.Filter {
 	return func(data database.Entries) database.Entries {
+		// Latest retrieves its own entries, in place of the topic selector
+		// and time predicate
+		if q.Value() == "latest" {
+			return m.retrieveLatest()
+		}
+
 		if data == nil {
-			data = m.DB.Retrieve(database.Query{Quantifier: q.Value(), Range: nil})
+			data = m.retrieve(database.Query{Quantifier: q.Value(), Range: nil})
 		}
 
 		switch q.Value() {
 		case "all":
 			return data
 		case "sample":
+			if q.Count != nil {
+				return sampleEvery(data, q.Count.(*ast.NumberNode).DerivedValue(), q.PerTopic)
+			}
+
 			quantity, ok := q.TimeQuantity.(ast.Numeric)
 			if !ok {
 				panic("Expected child to be of type *TimespanNode")
 			}
 
-			sampleDuration := quantity.DerivedValue()
-			nextTime := data[0].Time
+			sampleDuration := time.Duration(quantity.DerivedValue())
+			if sampleDuration <= 0 {
+				return data
+			}
+
+			// Buckets are aligned to the unix epoch unless the query asks
+			// for a different origin, so that they are stable across queries
+			origin := time.Unix(0, 0)
+			if q.Align != nil {
+				origin = q.Align.(*ast.TimeExpressionNode).Time()
+			}
+
 			filtered := database.Entries{}
+			lastBuckets := map[string]int64{}
 
 			for _, val := range data {
-				if val.Time.After(nextTime) || val.Time.Equal(nextTime) {
+				key := sampleKey(val, q.PerTopic)
+				bucket := sampleBucket(val.Time, origin, sampleDuration)
+				if last, ok := lastBuckets[key]; !ok || bucket != last {
 					filtered = append(filtered, val)
-					nextTime = val.Time.Add(time.Duration(sampleDuration))
+					lastBuckets[key] = bucket
 				}
 			}
 
@@ -68,22 +187,132 @@ func (m *MetaDataFilterBuilder) makeQuantifierFilter(q *ast.QuantifierNode) data
 	}
 }
 
-func (m *MetaDataFilterBuilder) makeTopicSelectionFilter(q *ast.TopicSelectorNode) database.Filter {
+// sampleEvery returns every nth entry of data, starting with the first, or
+// every nth entry of each topic if perTopic is set
+func sampleEvery(data database.Entries, n int64, perTopic bool) database.Entries {
+	filtered := database.Entries{}
+	seen := map[string]int64{}
+	for _, e := range data {
+		key := sampleKey(e, perTopic)
+		if seen[key]%n == 0 {
+			filtered = append(filtered, e)
+		}
+		seen[key]++
+	}
+	return filtered
+}
+
+// sampleKey returns the key of the group e is sampled with, which is its topic
+// if topics are sampled separately
+func sampleKey(e database.Entry, perTopic bool) string {
+	if perTopic {
+		return e.Topic
+	}
+	return ""
+}
+
+// sampleBucket returns the index of the interval of length d, counting from
+// origin, which t falls in.
+func sampleBucket(t, origin time.Time, d time.Duration) int64 {
+	offset := t.Sub(origin)
+	bucket := int64(offset / d)
+
+	// Round towards negative infinity for times before the origin
+	if offset < 0 && offset%d != 0 {
+		bucket--
+	}
+
+	return bucket
+}
+
+// retrieveLatest retrieves the newest entry of each topic selected by the
+// query, leaving out any from topics which aren't allowed
+func (m *MetaDataFilterBuilder) retrieveLatest() database.Entries {
+	// System topics are a snapshot as of now, so all of their entries are
+	// the latest
+	if m.system != nil {
+		return m.systemEntries()
+	}
+
+	q := *m.latest
+	if q.Topics != nil && len(q.Topics) == 0 {
+		// The topic selector matched nothing
+		return database.Entries{}
+	}
+
+	data := m.DB.RetrieveLatest(q)
+	if m.Allowed == nil {
+		return data
+	}
+
+	filtered := database.Entries{}
+	for _, val := range data {
+		if m.Allowed(val.Topic) {
+			filtered = append(filtered, val)
+		}
+	}
+	return filtered
+}
+
+// selectTopics returns the allowed topics selected by a topic selector
+func (m *MetaDataFilterBuilder) selectTopics(q *ast.TopicSelectorNode) []string {
 	topic := q.Topic.Lexeme
 
-	// Capture the desired topics in our closure
-	var topicFilter = make(map[string]bool)
+	// System topics are only selected by name, so that they don't show up
+	// in queries of every topic
+	candidates := m.DB.TopicLookup
+	if strings.HasPrefix(topic, database.SystemTopicPrefix) {
+		candidates = database.SystemTopics()
+		m.system = []string{}
+	}
 
 	// Since topics are hierarchical, we want any topic which has the desired prefix
-	for _, t := range m.DB.TopicLookup {
+	topics := []string{}
+	denied := false
+	for _, t := range candidates {
 		if strings.HasPrefix(t, topic) {
-			topicFilter[t] = true
+			if m.Allowed != nil && !m.Allowed(t) {
+				denied = true
+				continue
+			}
+			topics = append(topics, t)
 		}
 	}
+	if m.system != nil {
+		m.system = topics
+	}
+
+	// Selecting a topic which is partly allowed narrows the query to the
+	// allowed topics, but selecting one which isn't allowed at all is an error
+	if m.Allowed != nil && len(topics) == 0 && (denied || !m.Allowed(topic)) {
+		m.Err = fmt.Errorf("%w to topic %s", ErrTopicDenied, topic)
+	}
+
+	return topics
+}
+
+// systemEntries returns the entries of the system topics selected by the
+// query. Only the allowed topics are described.
+func (m *MetaDataFilterBuilder) systemEntries() database.Entries {
+	entries := database.Entries{}
+	for _, t := range m.system {
+		entries = append(entries, m.DB.SystemEntries(t, m.Allowed)...)
+	}
+	return entries
+}
+
+func (m *MetaDataFilterBuilder) makeTopicSelectionFilter(topics []string) database.Filter {
+	// Capture the desired topics in our closure
+	var topicFilter = make(map[string]bool)
+	for _, t := range topics {
+		topicFilter[t] = true
+	}
 
 	return func(data database.Entries) database.Entries {
+		// Without a time predicate, the database only scans the segments
+		// which may hold data from the selected topics
 		if data == nil {
-			data = m.DB.Retrieve(database.Query{Range: nil})
+			data = m.retrieve(database.Query{Topics: topics, Range: nil, OnlyTopics: true})
 		}
 
 		filtered := database.Entries{}
@@ -98,13 +327,14 @@ func (m *MetaDataFilterBuilder) makeTopicSelectionFilter(q *ast.TopicSelectorNod
 	}
 }
 
-func (m *MetaDataFilterBuilder) makeTimePredicateFilter(t *ast.TimePredicateNode) database.Filter {
+// timeRange returns the range of time selected by a time predicate
+func (m *MetaDataFilterBuilder) timeRange(t *ast.TimePredicateNode) database.TimeRange {
 	var startTime, endTime time.Time
 
 	switch t.Value() {
 	case "before":
 		endTime = t.Begin.(*ast.TimeExpressionNode).Time()
-		startTime = m.DB.Segments[0].HeadTime
+		startTime = m.DB.OldestTime()
 	case "since":
 		startTime = t.Begin.(*ast.TimeExpressionNode).Time()
 		endTime = time.Now()
@@ -113,11 +343,19 @@ func (m *MetaDataFilterBuilder) makeTimePredicateFilter(t *ast.TimePredicateNode
 		endTime = t.End.(*ast.TimeExpressionNode).Time()
 	}
 
-	timeRange := database.TimeRange{Start: startTime, End: endTime}
+	return database.TimeRange{Start: startTime, End: endTime}
+}
 
+func (m *MetaDataFilterBuilder) makeTimePredicateFilter(t *ast.TimePredicateNode, timeRange database.TimeRange) database.Filter {
 	return func(data database.Entries) database.Entries {
 		if data == nil {
-			return m.DB.Retrieve(database.Query{Range: &timeRange, RangeSemantics: t.Value()})
+			// Only the selected topics are retrieved, which lets the
+			// database skip the data of other topics
+			q := database.Query{Range: &timeRange, RangeSemantics: t.Value(), OnlyTopics: m.topics != nil}
+			for topic := range m.topics {
+				q.Topics = append(q.Topics, topic)
+			}
+			return m.retrieve(q)
 		}
 
 		// TODO: Handle non-nil case! Let's factor out some of the Retrieve functionality for
@@ -20,6 +20,10 @@ type DataPipeline interface {
 
 type Pipeline struct {
 	stages []Stage
+	stats  []*StageStats
+	// first is the node of the first stage, which entries are destructured
+	// into the arguments of
+	first *ast.DataFunctionNode
 }
 
 func MakePipelineFromNode(node *ast.DataPipelineNode) Pipeline {
@@ -30,6 +34,9 @@ func MakePipelineFromNode(node *ast.DataPipelineNode) Pipeline {
 		if !ok {
 			panic("Unexpected node found in data pipeline")
 		}
+		if p.first == nil {
+			p.first = stage
+		}
 
 		switch stage.Name.Lexeme {
 		case "filter":
@@ -62,7 +69,54 @@ func (p *Pipeline) Finalize() {
 	p.stages = append(p.stages, collect)
 }
 
+// EnableProfiling records StageStats for each stage of the pipeline as it
+// executes, which are returned by Stats
+func (p *Pipeline) EnableProfiling() {
+	p.stats = nil
+	for _, stage := range p.stages {
+		profiled, ok := stage.(Profiled)
+		if !ok {
+			continue
+		}
+
+		stats := &StageStats{Name: stageName(stage)}
+		profiled.Profile(stats)
+		p.stats = append(p.stats, stats)
+	}
+}
+
+// Stats returns the StageStats recorded during the last execution of the
+// pipeline, if profiling is enabled
+func (p *Pipeline) Stats() []StageStats {
+	stats := make([]StageStats, len(p.stats))
+	for i, s := range p.stats {
+		stats[i] = *s
+	}
+	return stats
+}
+
+func stageName(s Stage) string {
+	switch s.(type) {
+	case *FilterStage:
+		return "filter"
+	case *MapStage:
+		return "map"
+	case *ReduceStage:
+		return "reduce"
+	}
+	return "unknown"
+}
+
 func (p *Pipeline) Execute(entries database.Entries) database.Entries {
+	return p.run(func(first Stage) {
+		for _, entry := range entries {
+			first.Add(split(p.first, []WrappedEntry{Wrap(entry)}))
+		}
+	})
+}
+
+// run runs the pipeline, with feed passing in everything to the first stage
+func (p *Pipeline) run(feed func(first Stage)) database.Entries {
 	var results database.Entries
 	var wg sync.WaitGroup
 
@@ -83,10 +137,7 @@ func (p *Pipeline) Execute(entries database.Entries) database.Entries {
 		wg.Done()
 	}()
 
-	// Pass in everything to the first stage
-	for _, entry := range entries {
-		first.Add([]WrappedEntry{Wrap(entry)})
-	}
+	feed(first)
 	first.Finish()
 
 	wg.Wait()
@@ -130,9 +181,38 @@ func (w *WrappedEntry) Entry() database.Entry {
 	}
 	e.Time = w.entry.Time
 	e.Topic = w.entry.Topic
+	e.Sequence = w.entry.Sequence
 	return e
 }
 
+// destructure returns the entries a stage running node passes to the next
+// stage. A single tuple is split into one entry per element when the next
+// stage takes more than one argument, so `map x -> x, x * 2 | map a, b -> a + b`
+// binds a and b to each element. Reduce stages take the accumulated value and
+// the next one, so values are never split for them.
+func destructure(node *ast.DataFunctionNode, entries []WrappedEntry) []WrappedEntry {
+	return split(node.Next, entries)
+}
+
+// split splits a single tuple in entries into one entry per element, if next
+// takes that many arguments
+func split(next *ast.DataFunctionNode, entries []WrappedEntry) []WrappedEntry {
+	if len(entries) != 1 || next == nil || len(next.Arguments) < 2 || next.Name.Lexeme == "reduce" {
+		return entries
+	}
+
+	v := entries[0].Value()
+	if v.Kind() != types.Tuple || len(types.TupleVal(v)) != len(next.Arguments) {
+		return entries
+	}
+
+	var destructured []WrappedEntry
+	for _, element := range types.TupleVal(v) {
+		destructured = append(destructured, entries[0].Copy(element))
+	}
+	return destructured
+}
+
 type Stage interface {
 	Chain(Stage)
 	Next() Stage
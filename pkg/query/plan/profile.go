@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package plan
+
+import "time"
+
+// StageStats records the work done by one stage of a query
+type StageStats struct {
+	Name    string
+	RowsIn  int
+	RowsOut int
+	// Duration is the time the stage spent working, not including the time
+	// it spent waiting on other stages
+	Duration time.Duration
+}
+
+// profiler is embedded in stages to record their StageStats when profiling
+// is enabled. Stages run in their own goroutine, so each profiler is only
+// ever written to by one goroutine.
+type profiler struct {
+	stats *StageStats
+}
+
+func (p *profiler) Profile(stats *StageStats) {
+	p.stats = stats
+}
+
+// start returns the time work on a row started, to be passed to stop
+func (p *profiler) start() time.Time {
+	if p.stats == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (p *profiler) stop(start time.Time) {
+	if p.stats != nil {
+		p.stats.Duration += time.Since(start)
+	}
+}
+
+func (p *profiler) received(rows int) {
+	if p.stats != nil {
+		p.stats.RowsIn += rows
+	}
+}
+
+func (p *profiler) emitted(rows int) {
+	if p.stats != nil {
+		p.stats.RowsOut += rows
+	}
+}
+
+// Profiled is implemented by stages which can record StageStats
+type Profiled interface {
+	Profile(*StageStats)
+}
@@ -8,6 +8,7 @@ package plan
 
 import (
 	"github.com/dburkart/fossil/pkg/query/ast"
+	"github.com/dburkart/fossil/pkg/query/types"
 	"sync"
 )
 
@@ -16,6 +17,7 @@ type ReduceStage struct {
 	root  *ast.DataFunctionNode
 	input chan []WrappedEntry
 	once  sync.Once
+	profiler
 }
 
 func MakeReduceStage(node *ast.DataFunctionNode) *ReduceStage {
@@ -48,21 +50,30 @@ func (r *ReduceStage) Execute() {
 	var b []WrappedEntry
 	for {
 		a := <-r.input
+		if a != nil {
+			r.received(1)
+		}
 
 		if b == nil {
 			b = <-r.input
+			if b != nil {
+				r.received(1)
+			}
 		}
 
 		if a == nil {
-			r.Next().Add(b)
+			r.emitted(1)
+			r.Next().Add(destructure(r.root, b))
 			break
 		}
 
 		if b == nil {
-			r.Next().Add(a)
+			r.emitted(1)
+			r.Next().Add(destructure(r.root, a))
 			break
 		}
 
+		start := r.start()
 		symbols := make(SymbolMap)
 		symbols[r.root.Arguments[0].Value()] = a[0].Value()
 		symbols[r.root.Arguments[1].Value()] = b[0].Value()
@@ -70,6 +81,13 @@ func (r *ReduceStage) Execute() {
 		fn := MakeFunction(symbols)
 		ast.Walk(&fn, r.root)
 
+		r.stop(start)
+
+		// If the result couldn't be computed, for instance due to a failed
+		// cast, a is skipped and b carried forward
+		if types.IsUnknown(fn.Result[0]) {
+			continue
+		}
 		entry := a[0].Copy(fn.Result[0])
 		entry.SetTopic("N/A")
 		b = []WrappedEntry{a[0].Copy(fn.Result[0])}
@@ -8,6 +8,10 @@ package query
 
 import (
 	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/common/parse"
 	"github.com/dburkart/fossil/pkg/database"
 	"github.com/dburkart/fossil/pkg/query/analysis"
 	"github.com/dburkart/fossil/pkg/query/ast"
@@ -16,12 +20,52 @@ import (
 	"github.com/dburkart/fossil/pkg/query/scanner"
 )
 
+// ErrLimitExceeded is returned when a query selects a longer span of time, or
+// returns more entries, than its database allows
+var ErrLimitExceeded = errors.New("query exceeds limits")
+
 type Query struct {
 	Filters  database.Filters
 	Pipeline plan.DataPipeline
+	// Range is the span of time the query selects, which runs from the
+	// oldest entry in the database until it was prepared if the query
+	// doesn't narrow it
+	Range database.TimeRange
+
+	// maxResults is the most entries the query may return, or 0 for no limit
+	maxResults int
+
+	// aggregate, if set, runs the query's pipeline while scan scans the
+	// database for the entries it selects, in place of Filters and Pipeline.
+	// See plan.Aggregate.
+	aggregate *plan.Aggregate
+	scan      func(func(database.Entry))
+}
+
+// CheckResults returns an error wrapping ErrLimitExceeded if result holds
+// more entries than the query's database allows
+func (q *Query) CheckResults(result database.Result) error {
+	if q.maxResults > 0 && len(result.Data) > q.maxResults {
+		return fmt.Errorf("%w: %d results is more than the maximum of %d, narrow the query's time range or topic", ErrLimitExceeded, len(result.Data), q.maxResults)
+	}
+	return nil
+}
+
+// Truncate drops the entries of result past the most the query's database
+// allows, returning how many entries it matched before they were dropped
+func (q *Query) Truncate(result *database.Result) int {
+	matched := len(result.Data)
+	if q.maxResults > 0 && matched > q.maxResults {
+		result.Data = result.Data[:q.maxResults]
+	}
+	return matched
 }
 
 func (q *Query) Execute() database.Result {
+	if q.aggregate != nil {
+		return database.Result{Data: q.aggregate.Execute(q.scan)}
+	}
+
 	result := q.Filters.Execute()
 
 	if q.Pipeline != nil {
@@ -31,16 +75,129 @@ func (q *Query) Execute() database.Result {
 	return result
 }
 
+// ExecuteWithProfile is like Execute, but also returns how long each stage of
+// the query took, and how many rows passed through it. The first stage is
+// "retrieve", which is the time spent retrieving entries from the database,
+// unless the query is an aggregate, which only has an "aggregate" stage.
+func (q *Query) ExecuteWithProfile() (database.Result, []plan.StageStats) {
+	start := time.Now()
+
+	// Aggregates retrieve entries and run the pipeline in one go, so they
+	// have a single stage
+	if q.aggregate != nil {
+		scanned := 0
+		data := q.aggregate.Execute(func(fn func(database.Entry)) {
+			q.scan(func(e database.Entry) {
+				scanned++
+				fn(e)
+			})
+		})
+		return database.Result{Data: data}, []plan.StageStats{{
+			Name:     "aggregate",
+			RowsIn:   scanned,
+			RowsOut:  len(data),
+			Duration: time.Since(start),
+		}}
+	}
+
+	result := q.Filters.Execute()
+	stats := []plan.StageStats{{
+		Name:     "retrieve",
+		RowsOut:  len(result.Data),
+		Duration: time.Since(start),
+	}}
+
+	if q.Pipeline != nil {
+		pipeline, profiled := q.Pipeline.(*plan.Pipeline)
+		if profiled {
+			pipeline.EnableProfiling()
+		}
+
+		result.Data = q.Pipeline.Execute(result.Data)
+
+		if profiled {
+			stats = append(stats, pipeline.Stats()...)
+		}
+	}
+
+	return result, stats
+}
+
 func Prepare(d *database.Database, statement string) (Query, error) {
+	return PrepareRestricted(d, statement, nil)
+}
+
+// PrepareRestricted prepares a query like Prepare, but restricted to the
+// topics for which allowed returns true. Selecting a topic which isn't
+// allowed, when no topic beneath it is either, returns an error wrapping
+// plan.ErrTopicDenied. A nil allowed doesn't restrict the query.
+func PrepareRestricted(d *database.Database, statement string, allowed func(topic string) bool) (Query, error) {
+	root, err := check(d, statement)
+	if err != nil {
+		return Query{}, err
+	}
+
+	// Evaluate constant expressions once, rather than for every entry. The
+	// checked query may be shared, so folding copies what it changes.
+	root = plan.Fold(root)
+
+	// Build metadata filters
+	builder := plan.MetaDataFilterBuilder{DB: d, Allowed: allowed}
+	ast.Walk(&builder, root)
+	if builder.Err != nil {
+		return Query{}, builder.Err
+	}
+
+	maxRange, maxResults := d.QueryLimits()
+	if maxRange > 0 {
+		err = checkRange(d, root.(*ast.QueryNode), builder.Range, maxRange)
+		if err != nil {
+			return Query{}, err
+		}
+	}
+
+	q := Query{Filters: builder.Filters, maxResults: maxResults}
+	if builder.Range != nil {
+		q.Range = *builder.Range
+	} else {
+		q.Range = database.TimeRange{Start: d.OldestTime(), End: time.Now()}
+	}
+
+	// Data Pipeline
+	pipelineNode := root.(*ast.QueryNode).DataPipeline
+	if pipelineNode != nil {
+		pipeline := plan.MakePipelineFromNode(pipelineNode.(*ast.DataPipelineNode))
+		q.Pipeline = &pipeline
+
+		// Reductions over every entry selected are computed while scanning,
+		// rather than retrieving every entry first
+		aggregate, ok := plan.MakeAggregateFromNode(pipelineNode.(*ast.DataPipelineNode))
+		if ok && root.(*ast.QueryNode).Quantifier.Value() == "all" {
+			q.aggregate = &aggregate
+			q.scan = builder.Scan
+		}
+	}
+
+	return q, err
+}
+
+// check parses and type checks statement, or returns the query the database
+// cached when statement was last checked, if its topics haven't changed since
+func check(d *database.Database, statement string) (ast.ASTNode, error) {
+	if root, ok := d.CachedPlan(statement); ok {
+		return root.(ast.ASTNode), nil
+	}
+	generation := d.Generation()
+
 	p := parser.Parser{
-		scanner.Scanner{
+		Scanner: scanner.Scanner{
 			Input: statement,
 		},
 	}
 
 	root, err := p.Parse()
 	if err != nil {
-		return Query{}, err
+		return nil, err
 	}
 
 	// Type checking
@@ -48,22 +205,30 @@ func Prepare(d *database.Database, statement string) (Query, error) {
 	ast.Walk(checker, root)
 
 	if len(checker.Errors) > 0 {
-		// FIXME: Handle multiple errors
-		return Query{}, errors.New(checker.Errors[0].FormatError(statement))
+		return nil, errors.New(parse.SyntaxErrors(checker.Errors).FormatErrors(statement))
 	}
 
-	// Build metadata filters
-	builder := plan.MetaDataFilterBuilder{DB: d}
-	ast.Walk(&builder, root)
+	d.CachePlan(statement, generation, root)
+	return root, nil
+}
 
-	q := Query{Filters: builder.Filters}
+// checkRange returns an error wrapping ErrLimitExceeded if the span of time
+// selected by a query is longer than maxRange. The latest quantifier only
+// reads the newest entries, so isn't limited.
+func checkRange(d *database.Database, root *ast.QueryNode, selected *database.TimeRange, maxRange time.Duration) error {
+	if root.Quantifier.Value() == "latest" {
+		return nil
+	}
 
-	// Data Pipeline
-	pipelineNode := root.(*ast.QueryNode).DataPipeline
-	if pipelineNode != nil {
-		pipeline := plan.MakePipelineFromNode(pipelineNode.(*ast.DataPipelineNode))
-		q.Pipeline = &pipeline
+	var span time.Duration
+	if selected != nil {
+		span = selected.End.Sub(selected.Start)
+	} else if oldest := d.OldestTime(); !oldest.IsZero() {
+		span = time.Since(oldest)
 	}
 
-	return q, err
+	if span > maxRange {
+		return fmt.Errorf("%w: a time range of %s is more than the maximum of %s, narrow the query with since, before or between", ErrLimitExceeded, span.Round(time.Second), maxRange)
+	}
+	return nil
 }
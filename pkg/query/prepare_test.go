@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package query
+
+import (
+	"testing"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+type testTopic struct {
+	name   string
+	schema string
+	values []string
+}
+
+// testDatabase returns a database holding each of topics, with its values
+// appended in order
+func testDatabase(t *testing.T, topics ...testTopic) *database.Database {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range topics {
+		if _, err = db.CreateTopic(topic.name, topic.schema, ""); err != nil {
+			t.Fatal(err)
+		}
+		s, err := schema.Parse(topic.schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, value := range topic.values {
+			data, err := schema.EncodeStringForSchema(value, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = db.Append(data, topic.name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return db
+}
+
+// execute prepares and executes statement against db, returning the data of
+// each entry it results in
+func execute(t *testing.T, db *database.Database, statement string) []string {
+	t.Helper()
+
+	q, err := Prepare(db, statement)
+	if err != nil {
+		t.Fatalf("%s: %s", statement, err)
+	}
+
+	var data []string
+	for _, e := range q.Execute().Data {
+		data = append(data, string(e.Data))
+	}
+	return data
+}
+
+func TestExecuteEquality(t *testing.T) {
+	db := testDatabase(t,
+		testTopic{"/logs", "string", []string{"ok", "error", "ok", "error"}},
+		testTopic{"/flags", "boolean", []string{"true", "false", "true"}},
+		testTopic{"/levels", `enum("ok", "warn", "crit")`, []string{"ok", "crit", "warn", "crit"}},
+	)
+
+	tt := []struct {
+		statement string
+		count     int
+	}{
+		{`all in /logs | filter x -> x == "error"`, 2},
+		{`all in /logs | filter x -> x != "error"`, 2},
+		{`all in /logs | filter x -> x == "missing"`, 0},
+		{`all in /flags | filter x -> x == true`, 2},
+		{`all in /flags | filter x -> x != true`, 1},
+		{`all in /flags | filter x -> false == x`, 1},
+		{`all in /levels | filter x -> x == "crit"`, 2},
+	}
+
+	for _, tc := range tt {
+		if got := execute(t, db, tc.statement); len(got) != tc.count {
+			t.Errorf("%s: expected %d results, got %q", tc.statement, tc.count, got)
+		}
+	}
+
+	for _, statement := range []string{
+		`all in /logs | filter x -> x < "error"`,
+		`all in /logs | filter x -> x == 1`,
+		`all in /flags | filter x -> x == "true"`,
+		`all in /logs | map x -> x + "!"`,
+	} {
+		if _, err := Prepare(db, statement); err == nil {
+			t.Errorf("%s: expected preparing to fail", statement)
+		}
+	}
+}
+
+func TestExecuteEscapedStrings(t *testing.T) {
+	db := testDatabase(t, testTopic{"/logs", "string", []string{`it's "quoted"`, "it's quoted", "tab\tand é", "plain"}})
+
+	tt := []struct {
+		statement string
+		want      string
+	}{
+		{`all in /logs | filter x -> x == "it's \"quoted\""`, `it's "quoted"`},
+		{`all in /logs | filter x -> x == 'it\'s quoted'`, "it's quoted"},
+		{`all in /logs | filter x -> x == "tab\tand \u00e9"`, "tab\tand é"},
+	}
+
+	for _, tc := range tt {
+		got := execute(t, db, tc.statement)
+		if len(got) != 1 || got[0] != tc.want {
+			t.Errorf("%s: expected [%q], got %q", tc.statement, tc.want, got)
+		}
+	}
+}
+
+func TestExecuteWhere(t *testing.T) {
+	db := testDatabase(t,
+		testTopic{"/logs", "string", []string{"ok", "error", "ok", "error"}},
+		testTopic{"/temps", "int64", []string{"60", "75", "80"}},
+	)
+
+	tt := []struct {
+		statement string
+		count     int
+	}{
+		{`all in /logs where value == "error"`, 2},
+		{`all in /logs where value != "error"`, 2},
+		{`all in /logs where value == "error" | map x -> 1 | reduce a, b -> a + b`, 1},
+		{`all in /temps where value > 70`, 2},
+		// The clause filters the latest entry, rather than finding the
+		// latest entry it matches
+		{`latest in /temps where value > 70`, 1},
+		{`latest in /temps where value < 70`, 0},
+	}
+
+	for _, tc := range tt {
+		if got := execute(t, db, tc.statement); len(got) != tc.count {
+			t.Errorf("%s: expected %d results, got %q", tc.statement, tc.count, got)
+		}
+	}
+}
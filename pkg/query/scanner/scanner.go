@@ -41,6 +41,17 @@ func (s *Scanner) MatchIdentifier() int {
 	return size
 }
 
+// MatchKeyword returns whether the next token is keyword, rather than an
+// identifier which happens to begin with it
+func (s *Scanner) MatchKeyword(keyword string) bool {
+	if !strings.HasPrefix(s.Input[s.Pos:], keyword) {
+		return false
+	}
+
+	r, _ := utf8.DecodeRuneInString(s.Input[s.Pos+len(keyword):])
+	return !(unicode.IsDigit(r) || unicode.IsLetter(r) || r == '-' || r == '_')
+}
+
 // MatchTopic returns the length of the next token, assuming it is a topic
 // string.
 //
@@ -67,15 +78,34 @@ func (s *Scanner) MatchTopic() int {
 //
 // Grammar:
 //
-//	integer          = 1*DIGIT
+//	integer          = digits
 func (s *Scanner) MatchInteger() int {
-	r, width := utf8.DecodeRuneInString(s.Input[s.Pos:])
+	return s.matchDigits(s.Pos)
+}
+
+// matchDigits returns the length of the run of digits at pos, which may be
+// separated by single underscores for readability, as in 1_000_000
+//
+// Grammar:
+//
+//	digits          = 1*DIGIT *( "_" 1*DIGIT )
+func (s *Scanner) matchDigits(pos int) int {
+	r, width := utf8.DecodeRuneInString(s.Input[pos:])
 	size := 0
 
-	for i := s.Pos; unicode.IsDigit(r); {
+	for i := pos; unicode.IsDigit(r); {
 		size += width
 		i += width
 		r, width = utf8.DecodeRuneInString(s.Input[i:])
+
+		if r == '_' {
+			next, _ := utf8.DecodeRuneInString(s.Input[i+width:])
+			if unicode.IsDigit(next) {
+				size += width
+				i += width
+				r, width = next, utf8.RuneLen(next)
+			}
+		}
 	}
 
 	return size
@@ -86,35 +116,53 @@ func (s *Scanner) MatchInteger() int {
 //
 // Grammar:
 //
-//  float           = *DIGIT "." 1*DIGIT
+//  float           = [ digits ] "." digits
 func (s *Scanner) MatchFloat() int {
-	r, width := utf8.DecodeRuneInString(s.Input[s.Pos:])
-	lsize := 0
-	rsize := 0
+	lsize := s.matchDigits(s.Pos)
 
-	for i := s.Pos; unicode.IsDigit(r); {
-		lsize += width
-		i += width
-		r, width = utf8.DecodeRuneInString(s.Input[i:])
+	r, _ := utf8.DecodeRuneInString(s.Input[s.Pos+lsize:])
+	if r != '.' {
+		return 0
 	}
 
-	if r != '.' {
+	rsize := s.matchDigits(s.Pos + lsize + 1)
+	if rsize == 0 {
 		return 0
 	}
 
-	r, width = utf8.DecodeRuneInString(s.Input[s.Pos+lsize+1:])
+	return lsize + rsize + 1
+}
+
+// MatchUnit returns the length of the unit suffixing the number which ends at
+// pos, and the type of token the number makes with it, or 0 if the number
+// has no unit. Units are matched regardless of case.
+//
+// Grammar:
+//
+//	duration-unit   = "ns" / "us" / "ms" / "s" / "m" / "h" / "d"
+//	size-unit       = "b" / "kb" / "kib" / "mb" / "mib" / "gb" / "gib" / "tb" / "tib"
+func (s *Scanner) MatchUnit(pos int) (int, TokenType) {
+	i := pos
+	r, width := utf8.DecodeRuneInString(s.Input[i:])
 
-	for i := s.Pos + lsize + 1; unicode.IsDigit(r); {
-		rsize += width
+	for unicode.IsLetter(r) {
 		i += width
 		r, width = utf8.DecodeRuneInString(s.Input[i:])
 	}
 
-	if rsize == 0 {
-		return 0
+	// A unit can't run into anything else which could be part of a word
+	if unicode.IsDigit(r) || r == '_' {
+		return 0, TOK_INVALID
 	}
 
-	return lsize + rsize + 1
+	unit := strings.ToLower(s.Input[pos:i])
+	if _, ok := DurationUnits[unit]; ok {
+		return i - pos, TOK_DURATION
+	}
+	if _, ok := SizeUnits[unit]; ok {
+		return i - pos, TOK_SIZE
+	}
+	return 0, TOK_INVALID
 }
 
 // MatchString returns the length of the next token, assuming it is a
@@ -122,23 +170,12 @@ func (s *Scanner) MatchFloat() int {
 //
 // Grammar:
 //
-//	string          = DQUOTE *ALPHANUM DQUOTE / SQUOTE *ALPHANUM SQUOTE
+//	string          = DQUOTE *( char / escape ) DQUOTE / SQUOTE *( char / escape ) SQUOTE
+//	escape          = "\" ( DQUOTE / SQUOTE / "\" / "n" / "t" / "r" / "u" 4HEXDIG )
+//
+// Escapes are those of Go string literals, and are checked by parse.Unquote.
 func (s *Scanner) MatchString() int {
-	r, width := utf8.DecodeRuneInString(s.Input[s.Pos:])
-	size := 0
-
-	quote := r
-	r, width = utf8.DecodeRuneInString(s.Input[s.Pos+1:])
-	for r != quote {
-		if r == utf8.RuneError {
-			return 0
-		}
-		size += width
-		r, width = utf8.DecodeRuneInString(s.Input[s.Pos+size+1:])
-	}
-
-	// Include quote runes
-	return size + 2
+	return parse.MatchQuoted(s.Input[s.Pos:])
 }
 
 // MatchTimeWhence returns the length of the next token, assuming it is
@@ -163,16 +200,15 @@ func (s *Scanner) MatchTimeWhence() int {
 		pos = pos + 1
 		r, _ = utf8.DecodeRuneInString(s.Input[pos:])
 
-		// Find the next boundary
-		var end int
-		for end = pos; rune(s.Input[end]) != ')'; end++ {
-			if end == len(s.Input)-1 {
-				break
-			}
+		// Find the next boundary, or take the rest of the input if the
+		// timestamp is unterminated
+		end := strings.IndexByte(s.Input[pos:], ')')
+		if end == -1 {
+			return len(s.Input) - s.Pos
 		}
 
-		// Add back one for '~', and another to include "end"
-		return end - pos + 3
+		// Add back one for '~', one for '(', and another to include ')'
+		return end + 3
 	}
 
 	if strings.HasPrefix(s.Input[pos:], "now") {
@@ -325,7 +361,8 @@ func (s *Scanner) Emit() parse.Token {
 			skip = width
 		case r == '/':
 			next, _ := utf8.DecodeRuneInString(s.Input[s.Pos+1:])
-			if isDelimiter(next) || !unicode.IsLetter(next) {
+			// Topics start with a letter, or an underscore for system topics
+			if isDelimiter(next) || (!unicode.IsLetter(next) && next != '_') {
 				t.Type = TOK_SLASH
 				skip = width
 				break
@@ -352,6 +389,11 @@ func (s *Scanner) Emit() parse.Token {
 			skip = s.MatchString()
 			if skip > 0 {
 				t.Type = TOK_STRING
+				// Strings with invalid escape sequences are invalid as a
+				// whole
+				if _, err := parse.Unquote(s.Input[s.Pos : s.Pos+skip]); err != nil {
+					t.Type = TOK_INVALID
+				}
 			} else {
 				t.Type = TOK_INVALID
 				skip = s.SkipToBoundary(isDelimiter)
@@ -360,9 +402,13 @@ func (s *Scanner) Emit() parse.Token {
 			skip = s.MatchFloat()
 			if skip > 0 {
 				t.Type = TOK_FLOAT
+				if unit, unitType := s.MatchUnit(s.Pos + skip); unit > 0 {
+					t.Type = unitType
+					skip += unit
+				}
 			} else {
-				t.Type = TOK_INVALID
-				skip = s.SkipToBoundary(isDelimiter)
+				t.Type = TOK_DOT
+				skip = width
 			}
 		case unicode.IsDigit(r):
 			skip = s.MatchFloat()
@@ -372,21 +418,25 @@ func (s *Scanner) Emit() parse.Token {
 				skip = s.MatchInteger()
 				t.Type = TOK_INTEGER
 			}
+			if unit, unitType := s.MatchUnit(s.Pos + skip); unit > 0 {
+				t.Type = unitType
+				skip += unit
+			}
 		case r == 'a':
-			if strings.HasPrefix(s.Input[s.Pos:], "all") {
+			if s.MatchKeyword("all") {
 				t.Type = TOK_KEYWORD
 				skip = len("all")
 				break
 			}
 			identifierFallthrough()
 		case r == 'b':
-			if strings.HasPrefix(s.Input[s.Pos:], "before") {
+			if s.MatchKeyword("before") {
 				t.Type = TOK_KEYWORD
 				skip = len("before")
 				break
 			}
 
-			if strings.HasPrefix(s.Input[s.Pos:], "between") {
+			if s.MatchKeyword("between") {
 				t.Type = TOK_KEYWORD
 				skip = len("between")
 				break
@@ -394,19 +444,33 @@ func (s *Scanner) Emit() parse.Token {
 
 			identifierFallthrough()
 		case r == 'i':
-			if strings.HasPrefix(s.Input[s.Pos:], "in") {
+			if s.MatchKeyword("in") {
 				t.Type = TOK_KEYWORD
 				skip = len("in")
 				break
 			}
 			identifierFallthrough()
+		case r == 'l':
+			if s.MatchKeyword("latest") {
+				t.Type = TOK_KEYWORD
+				skip = len("latest")
+				break
+			}
+			identifierFallthrough()
+		case r == 'w':
+			if s.MatchKeyword("where") {
+				t.Type = TOK_KEYWORD
+				skip = len("where")
+				break
+			}
+			identifierFallthrough()
 		case r == 's':
-			if strings.HasPrefix(s.Input[s.Pos:], "since") {
+			if s.MatchKeyword("since") {
 				t.Type = TOK_KEYWORD
 				skip = len("since")
 				break
 			}
-			if strings.HasPrefix(s.Input[s.Pos:], "sample") {
+			if s.MatchKeyword("sample") {
 				t.Type = TOK_KEYWORD
 				skip = len("sample")
 				break
@@ -414,6 +478,11 @@ func (s *Scanner) Emit() parse.Token {
 			identifierFallthrough()
 		case unicode.IsLetter(r):
 			identifierFallthrough()
+		case width > 0:
+			// Runes which can't start a token are invalid on their own, so
+			// that scanning moves past them
+			t.Type = TOK_INVALID
+			skip = width
 		}
 
 		s.Pos = s.Start + skip
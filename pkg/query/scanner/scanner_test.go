@@ -74,6 +74,71 @@ func TestEmitFloat(t *testing.T) {
 	}
 }
 
+func TestEmitUnits(t *testing.T) {
+	s := Scanner{Input: "1_000_000 1_000.5 5s 10ms 1.5h 2KiB 4mb 3x 7s2 1_"}
+
+	wantTypes := []TokenType{TOK_INTEGER, TOK_FLOAT, TOK_DURATION, TOK_DURATION, TOK_DURATION, TOK_SIZE, TOK_SIZE,
+		TOK_INTEGER, TOK_IDENTIFIER, TOK_INTEGER, TOK_IDENTIFIER, TOK_INTEGER}
+	wantLexemes := []string{"1_000_000", "1_000.5", "5s", "10ms", "1.5h", "2KiB", "4mb", "3", "x", "7", "s2", "1"}
+
+	for i := 0; i < len(wantTypes); i++ {
+		tok := s.Emit()
+
+		if tok.Type != wantTypes[i] {
+			t.Error("wanted", wantTypes[i].ToString(), ", got", tok.Type.ToString())
+		}
+
+		if tok.Lexeme != wantLexemes[i] {
+			t.Error("wanted", wantLexemes[i], ", got", tok.Lexeme)
+		}
+	}
+}
+
+func TestSplitUnit(t *testing.T) {
+	number, scale := SplitUnit("1.5MiB")
+	if number != "1.5" || scale != 1<<20 {
+		t.Error("wanted 1.5 and", 1<<20, ", got", number, "and", scale)
+	}
+
+	number, scale = SplitUnit("10ms")
+	if number != "10" || scale != 1000000 {
+		t.Error("wanted 10 and 1000000, got", number, "and", scale)
+	}
+}
+
+func TestEmitString(t *testing.T) {
+	s := Scanner{Input: `"it's \"quoted\"" 'caf\u00e9' "bad \q" "open`}
+
+	wantTypes := []TokenType{TOK_STRING, TOK_STRING, TOK_INVALID, TOK_INVALID}
+	wantLexemes := []string{`"it's \"quoted\""`, `'caf\u00e9'`, `"bad \q"`, `"open`}
+
+	for i := 0; i < len(wantTypes); i++ {
+		tok := s.Emit()
+
+		if tok.Type != wantTypes[i] {
+			t.Error("wanted", wantTypes[i].ToString(), ", got", tok.Type.ToString())
+		}
+
+		if tok.Lexeme != wantLexemes[i] {
+			t.Error("wanted", wantLexemes[i], ", got", tok.Lexeme)
+		}
+	}
+}
+
+func TestEmitUnknownRune(t *testing.T) {
+	s := Scanner{Input: `\ x`}
+
+	tok := s.Emit()
+	if tok.Type != TOK_INVALID || tok.Lexeme != `\` {
+		t.Errorf("wanted an invalid '\\' token, got %v '%s'", tok.Type, tok.Lexeme)
+	}
+
+	tok = s.Emit()
+	if tok.Type != TOK_IDENTIFIER {
+		t.Error("wanted TOK_IDENTIFIER, got", tok.Type.ToString())
+	}
+}
+
 func TestEmitKeyword(t *testing.T) {
 	s := Scanner{Input: "   all in sample"}
 
@@ -116,6 +181,25 @@ func TestEmitIdentifier(t *testing.T) {
 	}
 }
 
+func TestEmitDottedKey(t *testing.T) {
+	s := Scanner{Input: "x.inside sample_rate .5"}
+
+	wantTypes := []TokenType{TOK_IDENTIFIER, TOK_DOT, TOK_IDENTIFIER, TOK_IDENTIFIER, TOK_FLOAT}
+	wantLexemes := []string{"x", ".", "inside", "sample_rate", ".5"}
+
+	for i := 0; i < len(wantTypes); i++ {
+		tok := s.Emit()
+
+		if tok.Type != wantTypes[i] {
+			t.Error("wanted", wantTypes[i].ToString(), ", got", tok.Type.ToString())
+		}
+
+		if tok.Lexeme != wantLexemes[i] {
+			t.Error("wanted", wantLexemes[i], ", got", tok.Lexeme)
+		}
+	}
+}
+
 func TestEmitTopic(t *testing.T) {
 	s := Scanner{Input: "/foo/bar/baz / /c02f3a2a-2791-443b-a2e9-c5e29740b803/"}
 	expectedTopicLexemes := []string{"/foo/bar/baz", "/", "/c02f3a2a-2791-443b-a2e9-c5e29740b803/"}
@@ -17,11 +17,13 @@ const (
 	TOK_KEYWORD
 	TOK_INTEGER
 	TOK_FLOAT
+	TOK_SIZE
 	TOK_STRING
 	TOK_TOPIC
 	TOK_COMMA
 	TOK_COLON
 	TOK_PIPE
+	TOK_DOT
 
 	// Expressions
 	TOK_EQ_EQ
@@ -38,6 +40,7 @@ const (
 	// Time
 	TOK_WHENCE
 	TOK_TIMESPAN
+	TOK_DURATION
 
 	TOK_PAREN_L
 	TOK_PAREN_R
@@ -63,6 +66,8 @@ func (t TokenType) ToString() string {
 		return "TOK_INTEGER"
 	case TOK_FLOAT:
 		return "TOK_FLOAT"
+	case TOK_SIZE:
+		return "TOK_SIZE"
 	case TOK_STRING:
 		return "TOK_STRING"
 	case TOK_TOPIC:
@@ -71,6 +76,8 @@ func (t TokenType) ToString() string {
 		return "TOK_WHENCE"
 	case TOK_TIMESPAN:
 		return "TOK_TIMESPAN"
+	case TOK_DURATION:
+		return "TOK_DURATION"
 	case TOK_COMMA:
 		return "TOK_COMMA"
 	case TOK_COLON:
@@ -103,6 +110,8 @@ func (t TokenType) ToString() string {
 		return "TOK_ARROW"
 	case TOK_PIPE:
 		return "TOK_PIPE"
+	case TOK_DOT:
+		return "TOK_DOT"
 	}
 	return "TOK_UNKNOWN"
 }
@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package scanner
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DurationUnits maps each unit a duration literal can have to the number of
+// nanoseconds in it
+var DurationUnits = map[string]int64{
+	"ns": int64(time.Nanosecond),
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+	"m":  int64(time.Minute),
+	"h":  int64(time.Hour),
+	"d":  int64(time.Hour * 24),
+}
+
+// SizeUnits maps each unit a size literal can have to the number of bytes in
+// it
+var SizeUnits = map[string]int64{
+	"b":   1,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"tib": 1 << 40,
+}
+
+// SplitUnit splits the lexeme of a TOK_DURATION or TOK_SIZE into its number,
+// and the scale of its unit: the number of nanoseconds or bytes in it
+func SplitUnit(lexeme string) (string, int64) {
+	i := strings.LastIndexFunc(lexeme, func(r rune) bool { return !unicode.IsLetter(r) }) + 1
+	unit := strings.ToLower(lexeme[i:])
+	if scale, ok := DurationUnits[unit]; ok {
+		return lexeme[:i], scale
+	}
+	return lexeme[:i], SizeUnits[unit]
+}
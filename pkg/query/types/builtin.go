@@ -8,18 +8,38 @@ package types
 
 import (
 	"errors"
+	"sort"
+
 	"github.com/dburkart/fossil/pkg/schema"
 )
 
+var builtinMap = map[string]Builtin{
+	"max":          BuiltinMax{},
+	"min":          BuiltinMin{},
+	"int":          BuiltinCast{name: "int", kind: Int},
+	"float":        BuiltinCast{name: "float", kind: Float},
+	"string":       BuiltinCast{name: "string", kind: String},
+	"bool":         BuiltinCast{name: "bool", kind: Boolean},
+	"counter_rate": BuiltinCounterRate{},
+	"time":         BuiltinTime{},
+	"interval":     BuiltinInterval{},
+}
+
 func LookupBuiltinFunction(name string) (b Builtin, ok bool) {
-	builtinMap := map[string]Builtin{
-		"max": BuiltinMax{},
-		"min": BuiltinMin{},
-	}
 	b, ok = builtinMap[name]
 	return
 }
 
+// BuiltinNames returns the name of every builtin function, sorted
+func BuiltinNames() []string {
+	names := make([]string, 0, len(builtinMap))
+	for name := range builtinMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type Builtin interface {
 	Name() string
 	Validate(input schema.Object) (schema.Object, error)
@@ -34,7 +54,7 @@ func (b BuiltinMax) Validate(input schema.Object) (schema.Object, error) {
 	switch t := input.(type) {
 	case *schema.Array:
 		if t.Type.IsNumeric() {
-			return t.Type, nil
+			return &t.Type, nil
 		}
 		return nil, errors.New("max expects arguments to be numeric")
 	default:
@@ -73,7 +93,7 @@ func (b BuiltinMin) Validate(input schema.Object) (schema.Object, error) {
 	switch t := input.(type) {
 	case *schema.Array:
 		if t.Type.IsNumeric() {
-			return t.Type, nil
+			return &t.Type, nil
 		}
 		return nil, errors.New("min expects arguments to be numeric")
 	default:
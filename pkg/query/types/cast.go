@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// BuiltinCast converts a single value to another kind. Values which can't be
+// converted, such as a string which isn't a number passed to int, become
+// Unknown, which a filter rejects and a map skips.
+type BuiltinCast struct {
+	name string
+	kind Kind
+}
+
+func (b BuiltinCast) Name() string { return b.name }
+
+func (b BuiltinCast) Validate(input schema.Object) (schema.Object, error) {
+	switch input.(type) {
+	case *schema.Type, *schema.Enum:
+	default:
+		return nil, fmt.Errorf("%s expects a single value, not %s", b.name, input.ToSchema())
+	}
+
+	switch b.kind {
+	case Int:
+		return &schema.Type{Name: "int64"}, nil
+	case Float:
+		return &schema.Type{Name: "float64"}, nil
+	case Boolean:
+		return &schema.Type{Name: "boolean"}, nil
+	default:
+		return &schema.Type{Name: "string"}, nil
+	}
+}
+
+func (b BuiltinCast) Execute(input Value) Value {
+	return Cast(input, b.kind)
+}
+
+// Cast converts v to a value of kind k, or returns Unknown if it can't be
+// converted. Floats are truncated when cast to an int, and strings are parsed
+// the same way as literals in a query. Timestamps and durations are cast to
+// nanoseconds as ints, and to seconds as floats.
+func Cast(v Value, k Kind) Value {
+	if v.Kind() == k {
+		return v
+	}
+
+	switch x := v.(type) {
+	case intVal:
+		switch k {
+		case Float:
+			return MakeFloat(float64(x))
+		case String:
+			return MakeString(strconv.FormatInt(int64(x), 10))
+		case Boolean:
+			return MakeBoolean(x != 0)
+		}
+	case floatVal:
+		switch k {
+		case Int:
+			return MakeInt(int64(x))
+		case String:
+			return MakeString(strconv.FormatFloat(float64(x), 'g', -1, 64))
+		case Boolean:
+			return MakeBoolean(x != 0)
+		}
+	case booleanVal:
+		switch k {
+		case Int:
+			if x {
+				return MakeInt(1)
+			}
+			return MakeInt(0)
+		case Float:
+			return MakeFloat(FloatVal(x))
+		case String:
+			return MakeString(StringVal(x))
+		}
+	case timestampVal, durationVal:
+		// Timestamps are nanoseconds since the unix epoch as ints, and
+		// seconds as floats, and durations are the same length of time
+		var ns int64
+		if t, ok := x.(timestampVal); ok {
+			ns = int64(t)
+		} else {
+			ns = int64(x.(durationVal))
+		}
+		switch k {
+		case Int:
+			return MakeInt(ns)
+		case Float:
+			return MakeFloat(float64(ns) / float64(time.Second))
+		case String:
+			return MakeString(StringVal(x))
+		}
+	case stringVal:
+		s := strings.TrimSpace(string(x))
+		switch k {
+		case Int:
+			if i, err := strconv.ParseInt(s, 0, 64); err == nil {
+				return MakeInt(i)
+			}
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return MakeInt(int64(f))
+			}
+		case Float:
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return MakeFloat(f)
+			}
+		case Boolean:
+			if b, err := strconv.ParseBool(s); err == nil {
+				return MakeBoolean(b)
+			}
+		}
+	}
+
+	return MakeUnknown()
+}
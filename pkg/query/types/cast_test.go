@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package types
+
+import (
+	"testing"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+func TestCast(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    Value
+		kind     Kind
+		expected Value
+	}{
+		{"int to float", MakeInt(2), Float, MakeFloat(2)},
+		{"int to string", MakeInt(-42), String, MakeString("-42")},
+		{"int to bool", MakeInt(0), Boolean, MakeBoolean(false)},
+		{"float to int", MakeFloat(2.9), Int, MakeInt(2)},
+		{"float to string", MakeFloat(1.5), String, MakeString("1.5")},
+		{"bool to int", MakeBoolean(true), Int, MakeInt(1)},
+		{"bool to string", MakeBoolean(false), String, MakeString("false")},
+		{"string to int", MakeString(" 42 "), Int, MakeInt(42)},
+		{"hex string to int", MakeString("0x10"), Int, MakeInt(16)},
+		{"float string to int", MakeString("3.7"), Int, MakeInt(3)},
+		{"string to float", MakeString("1e3"), Float, MakeFloat(1000)},
+		{"string to bool", MakeString("true"), Boolean, MakeBoolean(true)},
+		{"string to itself", MakeString("foo"), String, MakeString("foo")},
+		{"non-numeric string to int", MakeString("foo"), Int, MakeUnknown()},
+		{"non-numeric string to float", MakeString("foo"), Float, MakeUnknown()},
+		{"string to bool fails", MakeString("maybe"), Boolean, MakeUnknown()},
+		{"unknown to int", MakeUnknown(), Int, MakeUnknown()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := Cast(test.input, test.kind)
+			if actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestCastValidate(t *testing.T) {
+	b, ok := LookupBuiltinFunction("float")
+	if !ok {
+		t.Fatal("expected float to be a builtin")
+	}
+
+	s, err := b.Validate(&schema.Type{Name: "string"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ToSchema() != "float64" {
+		t.Errorf("expected float64, got %s", s.ToSchema())
+	}
+
+	_, err = b.Validate(&schema.Array{Type: schema.Type{Name: "int32"}, Length: 2})
+	if err == nil {
+		t.Error("expected casting an array to fail")
+	}
+}
+
+func TestIsUnknown(t *testing.T) {
+	if !IsUnknown(MakeTuple([]Value{MakeInt(1), MakeUnknown()})) {
+		t.Error("expected a tuple holding an unknown value to be unknown")
+	}
+	if IsUnknown(MakeComposite(map[string]Value{"a": MakeUnknown()})) {
+		t.Error("expected a composite with a missing key not to be unknown")
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package types
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// StatefulBuiltin is a Builtin whose result depends on the entries it was
+// executed on before, in the order they pass through a pipeline stage
+type StatefulBuiltin interface {
+	Builtin
+	// ExecuteAt executes the builtin on the input of an entry appended at t.
+	// State holds whatever the builtin kept from the previous entry of the
+	// same topic, and is nil for the first.
+	ExecuteAt(input Value, t time.Time, state *any) Value
+}
+
+// BuiltinCounterRate computes the per-second rate at which a counter grows
+// between consecutive entries. A counter which drops is taken to have been
+// reset to zero, so the increase is the counter's new value rather than a
+// negative one.
+type BuiltinCounterRate struct{}
+
+// counterSample is the state BuiltinCounterRate keeps between entries
+type counterSample struct {
+	value float64
+	time  time.Time
+}
+
+func (b BuiltinCounterRate) Name() string { return "counter_rate" }
+
+func (b BuiltinCounterRate) Validate(input schema.Object) (schema.Object, error) {
+	switch t := input.(type) {
+	case nil, schema.Unknown:
+		// Topics without a schema can't be checked until execution
+	case *schema.Type:
+		if !t.IsNumeric() {
+			return nil, fmt.Errorf("counter_rate expects a single numeric value, not %s", t.ToSchema())
+		}
+	default:
+		return nil, fmt.Errorf("counter_rate expects a single numeric value, not %s", t.ToSchema())
+	}
+	return &schema.Type{Name: "float64"}, nil
+}
+
+// Execute returns Unknown, since a rate can't be computed from one value
+func (b BuiltinCounterRate) Execute(input Value) Value {
+	return MakeUnknown()
+}
+
+// ExecuteAt returns the rate since the previous entry, or Unknown for the
+// first entry, and for entries at or before the time of the previous one
+func (b BuiltinCounterRate) ExecuteAt(input Value, t time.Time, state *any) Value {
+	if input.Kind() != Int && input.Kind() != Float {
+		return MakeUnknown()
+	}
+
+	current := counterSample{value: FloatVal(input), time: t}
+	previous, ok := (*state).(counterSample)
+	if !ok {
+		*state = current
+		return MakeUnknown()
+	}
+
+	elapsed := current.time.Sub(previous.time).Seconds()
+	if elapsed <= 0 {
+		return MakeUnknown()
+	}
+	*state = current
+
+	increase := current.value - previous.value
+	if increase < 0 {
+		increase = current.value
+	}
+	return MakeFloat(increase / elapsed)
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+func TestCounterRate(t *testing.T) {
+	b, ok := LookupBuiltinFunction("counter_rate")
+	if !ok {
+		t.Fatal("expected counter_rate to be a builtin")
+	}
+	rate := b.(StatefulBuiltin)
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		input    Value
+		offset   time.Duration
+		expected Value
+	}{
+		{"first entry", MakeInt(100), 0, MakeUnknown()},
+		{"increase", MakeInt(110), 2 * time.Second, MakeFloat(5)},
+		{"float increase", MakeFloat(140), 12 * time.Second, MakeFloat(3)},
+		{"reset", MakeInt(20), 22 * time.Second, MakeFloat(2)},
+		{"same time", MakeInt(30), 22 * time.Second, MakeUnknown()},
+		{"after same time", MakeInt(30), 27 * time.Second, MakeFloat(2)},
+		{"unknown", MakeUnknown(), 30 * time.Second, MakeUnknown()},
+	}
+
+	var state any
+	for _, test := range tests {
+		actual := rate.ExecuteAt(test.input, start.Add(test.offset), &state)
+		if actual != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, actual)
+		}
+	}
+
+	if !IsUnknown(b.Execute(MakeInt(1))) {
+		t.Error("expected counter_rate without state to be unknown")
+	}
+}
+
+func TestCounterRateValidate(t *testing.T) {
+	b, _ := LookupBuiltinFunction("counter_rate")
+
+	s, err := b.Validate(&schema.Type{Name: "uint64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ToSchema() != "float64" {
+		t.Errorf("expected float64, got %s", s.ToSchema())
+	}
+
+	for _, input := range []schema.Object{&schema.Type{Name: "string"}, &schema.Array{Type: schema.Type{Name: "int32"}, Length: 2}} {
+		if _, err = b.Validate(input); err == nil {
+			t.Errorf("expected %s to be rejected", input.ToSchema())
+		}
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package types
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/common/parse"
+	"github.com/dburkart/fossil/pkg/query/scanner"
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+func isTemporal(v Value) bool {
+	return v.Kind() == Timestamp || v.Kind() == Duration
+}
+
+func isNumber(v Value) bool {
+	return v.Kind() == Int || v.Kind() == Float
+}
+
+// temporalOp applies operator to operands at least one of which is a timestamp
+// or a duration. Subtracting timestamps gives the duration between them,
+// durations can be added to or subtracted from timestamps, and durations can
+// be scaled by numbers. Any other combination is Unknown.
+func temporalOp(left Value, operator parse.Token, right Value) Value {
+	switch operator.Type {
+	case scanner.TOK_LESS, scanner.TOK_LESS_EQ, scanner.TOK_EQ_EQ, scanner.TOK_NOT_EQ, scanner.TOK_GREATER, scanner.TOK_GREATER_EQ:
+		if left.Kind() != right.Kind() {
+			return MakeUnknown()
+		}
+		// Both kinds are stored as nanoseconds, so they compare as ints
+		var l, r intVal
+		switch left.Kind() {
+		case Timestamp:
+			l, r = intVal(left.(timestampVal)), intVal(right.(timestampVal))
+		default:
+			l, r = intVal(left.(durationVal)), intVal(right.(durationVal))
+		}
+		return BinaryOp(l, operator, r)
+	}
+
+	switch l := left.(type) {
+	case timestampVal:
+		switch r := right.(type) {
+		case timestampVal:
+			if operator.Type == scanner.TOK_MINUS {
+				return MakeDuration(TimestampVal(l).Sub(TimestampVal(r)))
+			}
+		case durationVal:
+			switch operator.Type {
+			case scanner.TOK_PLUS:
+				return MakeTimestamp(TimestampVal(l).Add(time.Duration(r)))
+			case scanner.TOK_MINUS:
+				return MakeTimestamp(TimestampVal(l).Add(-time.Duration(r)))
+			}
+		}
+	case durationVal:
+		switch {
+		case right.Kind() == Timestamp && operator.Type == scanner.TOK_PLUS:
+			return MakeTimestamp(TimestampVal(right).Add(time.Duration(l)))
+		case right.Kind() == Duration:
+			r := right.(durationVal)
+			switch operator.Type {
+			case scanner.TOK_PLUS:
+				return l + r
+			case scanner.TOK_MINUS:
+				return l - r
+			case scanner.TOK_SLASH:
+				if r == 0 {
+					return MakeUnknown()
+				}
+				return MakeFloat(float64(l) / float64(r))
+			}
+		case isNumber(right):
+			switch operator.Type {
+			case scanner.TOK_STAR:
+				return MakeDuration(time.Duration(float64(l) * FloatVal(right)))
+			case scanner.TOK_SLASH:
+				if FloatVal(right) == 0 {
+					return MakeUnknown()
+				}
+				return MakeDuration(time.Duration(float64(l) / FloatVal(right)))
+			}
+		}
+	case intVal, floatVal:
+		if r, ok := right.(durationVal); ok && operator.Type == scanner.TOK_STAR {
+			return MakeDuration(time.Duration(FloatVal(l) * float64(r)))
+		}
+	}
+
+	return MakeUnknown()
+}
+
+// TemporalType returns the type of the result of applying operator to values
+// of the types left and right, at least one of which is a timestamp or a
+// duration, following the same rules as BinaryOp
+func TemporalType(left schema.Object, operator parse.Token, right schema.Object) (schema.Object, error) {
+	name := func(s schema.Object) string {
+		if t, ok := s.(*schema.Type); ok {
+			if t.IsNumeric() {
+				return "number"
+			}
+			return t.Name
+		}
+		return s.ToSchema()
+	}
+	l, r := name(left), name(right)
+
+	switch operator.Type {
+	case scanner.TOK_LESS, scanner.TOK_LESS_EQ, scanner.TOK_EQ_EQ, scanner.TOK_NOT_EQ, scanner.TOK_GREATER, scanner.TOK_GREATER_EQ:
+		if l == r {
+			return &schema.Type{Name: "boolean"}, nil
+		}
+	case scanner.TOK_MINUS:
+		switch {
+		case l == "timestamp" && r == "timestamp":
+			return &schema.Type{Name: "duration"}, nil
+		case l == "timestamp" && r == "duration":
+			return &schema.Type{Name: "timestamp"}, nil
+		case l == "duration" && r == "duration":
+			return &schema.Type{Name: "duration"}, nil
+		}
+	case scanner.TOK_PLUS:
+		switch {
+		case l == "timestamp" && r == "duration", l == "duration" && r == "timestamp":
+			return &schema.Type{Name: "timestamp"}, nil
+		case l == "duration" && r == "duration":
+			return &schema.Type{Name: "duration"}, nil
+		}
+	case scanner.TOK_STAR:
+		if (l == "duration" && r == "number") || (l == "number" && r == "duration") {
+			return &schema.Type{Name: "duration"}, nil
+		}
+	case scanner.TOK_SLASH:
+		switch {
+		case l == "duration" && r == "number":
+			return &schema.Type{Name: "duration"}, nil
+		case l == "duration" && r == "duration":
+			return &schema.Type{Name: "float64"}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Operator '%s' can't be applied to %s and %s", operator.Lexeme, left.ToSchema(), right.ToSchema())
+}
+
+// BuiltinTime returns the time the entry it's executed on was appended at, as
+// a timestamp. Its argument only names the entry, so any value will do.
+type BuiltinTime struct{}
+
+func (b BuiltinTime) Name() string { return "time" }
+
+func (b BuiltinTime) Validate(input schema.Object) (schema.Object, error) {
+	return &schema.Type{Name: "timestamp"}, nil
+}
+
+// Execute returns Unknown, since a value doesn't know when it was appended
+func (b BuiltinTime) Execute(input Value) Value {
+	return MakeUnknown()
+}
+
+func (b BuiltinTime) ExecuteAt(input Value, t time.Time, state *any) Value {
+	return MakeTimestamp(t)
+}
+
+// BuiltinInterval returns the duration between the entry it's executed on and
+// the previous entry of the same topic. Like time, its argument only names
+// the entry.
+type BuiltinInterval struct{}
+
+func (b BuiltinInterval) Name() string { return "interval" }
+
+func (b BuiltinInterval) Validate(input schema.Object) (schema.Object, error) {
+	return &schema.Type{Name: "duration"}, nil
+}
+
+// Execute returns Unknown, since an interval can't be computed from one value
+func (b BuiltinInterval) Execute(input Value) Value {
+	return MakeUnknown()
+}
+
+// ExecuteAt returns the interval since the previous entry, or Unknown for the
+// first entry
+func (b BuiltinInterval) ExecuteAt(input Value, t time.Time, state *any) Value {
+	previous, ok := (*state).(time.Time)
+	*state = t
+	if !ok {
+		return MakeUnknown()
+	}
+	return MakeDuration(t.Sub(previous))
+}
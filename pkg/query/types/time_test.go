@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/common/parse"
+	"github.com/dburkart/fossil/pkg/query/scanner"
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+var (
+	minus = parse.Token{Type: scanner.TOK_MINUS, Lexeme: "-"}
+	star  = parse.Token{Type: scanner.TOK_STAR, Lexeme: "*"}
+)
+
+func TestTemporalBinaryOp(t *testing.T) {
+	epoch := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	later := epoch.Add(90 * time.Minute)
+
+	tests := []struct {
+		name     string
+		left     Value
+		op       parse.Token
+		right    Value
+		expected Value
+	}{
+		{"timestamp - timestamp", MakeTimestamp(later), minus, MakeTimestamp(epoch), MakeDuration(90 * time.Minute)},
+		{"timestamp - duration", MakeTimestamp(later), minus, MakeDuration(time.Hour), MakeTimestamp(epoch.Add(30 * time.Minute))},
+		{"duration + timestamp", MakeDuration(time.Hour), plus, MakeTimestamp(epoch), MakeTimestamp(epoch.Add(time.Hour))},
+		{"duration + duration", MakeDuration(time.Hour), plus, MakeDuration(time.Minute), MakeDuration(61 * time.Minute)},
+		{"duration * int", MakeDuration(time.Hour), star, MakeInt(2), MakeDuration(2 * time.Hour)},
+		{"float * duration", MakeFloat(0.5), star, MakeDuration(time.Hour), MakeDuration(30 * time.Minute)},
+		{"duration / int", MakeDuration(time.Hour), slash, MakeInt(4), MakeDuration(15 * time.Minute)},
+		{"duration / duration", MakeDuration(time.Hour), slash, MakeDuration(time.Minute), MakeFloat(60)},
+		{"duration / zero", MakeDuration(time.Hour), slash, MakeInt(0), MakeUnknown()},
+		{"timestamp < timestamp", MakeTimestamp(epoch), less, MakeTimestamp(later), MakeBoolean(true)},
+		{"duration == duration", MakeDuration(time.Hour), eqEq, MakeDuration(60 * time.Minute), MakeBoolean(true)},
+		{"timestamp + timestamp", MakeTimestamp(epoch), plus, MakeTimestamp(later), MakeUnknown()},
+		{"timestamp - int", MakeTimestamp(epoch), minus, MakeInt(1), MakeUnknown()},
+		{"duration == int", MakeDuration(time.Hour), eqEq, MakeInt(1), MakeUnknown()},
+		{"unknown - timestamp", MakeUnknown(), minus, MakeTimestamp(epoch), MakeUnknown()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := BinaryOp(test.left, test.op, test.right)
+			if actual != test.expected {
+				t.Errorf("expected %v (%T), got %v (%T)", test.expected, test.expected, actual, actual)
+			}
+		})
+	}
+}
+
+func TestTemporalType(t *testing.T) {
+	ts, dur, num := &schema.Type{Name: "timestamp"}, &schema.Type{Name: "duration"}, &schema.Type{Name: "int64"}
+
+	tests := []struct {
+		left, right schema.Object
+		op          parse.Token
+		expected    string
+	}{
+		{ts, ts, minus, "duration"},
+		{ts, dur, minus, "timestamp"},
+		{dur, ts, plus, "timestamp"},
+		{num, dur, star, "duration"},
+		{dur, dur, slash, "float64"},
+		{ts, ts, less, "boolean"},
+	}
+	for _, test := range tests {
+		s, err := TemporalType(test.left, test.op, test.right)
+		if err != nil {
+			t.Errorf("%s %s %s: %s", test.left.ToSchema(), test.op.Lexeme, test.right.ToSchema(), err)
+			continue
+		}
+		if s.ToSchema() != test.expected {
+			t.Errorf("%s %s %s: expected %s, got %s", test.left.ToSchema(), test.op.Lexeme, test.right.ToSchema(), test.expected, s.ToSchema())
+		}
+	}
+
+	for _, invalid := range [][2]schema.Object{{ts, ts}, {ts, num}, {dur, &schema.Type{Name: "string"}}} {
+		if _, err := TemporalType(invalid[0], plus, invalid[1]); err == nil {
+			t.Errorf("expected %s + %s to be invalid", invalid[0].ToSchema(), invalid[1].ToSchema())
+		}
+	}
+}
+
+func TestTimeAndInterval(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var state any
+	b, _ := LookupBuiltinFunction("interval")
+	interval := b.(StatefulBuiltin)
+	if !IsUnknown(interval.ExecuteAt(MakeInt(1), start, &state)) {
+		t.Error("expected the interval of the first entry to be unknown")
+	}
+	if v := interval.ExecuteAt(MakeInt(1), start.Add(time.Second), &state); v != MakeDuration(time.Second) {
+		t.Errorf("expected an interval of 1s, got %v", v)
+	}
+
+	b, _ = LookupBuiltinFunction("time")
+	if v := b.(StatefulBuiltin).ExecuteAt(MakeInt(1), start, new(any)); !TimestampVal(v).Equal(start) {
+		t.Errorf("expected %s, got %s", start, TimestampVal(v))
+	}
+}
+
+func TestTemporalEntries(t *testing.T) {
+	ts := MakeTimestamp(time.Date(2023, 1, 1, 12, 30, 0, 500, time.UTC))
+
+	for _, test := range []struct {
+		value    Value
+		expected string
+	}{
+		{ts, "2023-01-01T12:30:00.0000005Z"},
+		{MakeDuration(90 * time.Minute), "1h30m0s"},
+	} {
+		entry, err := EntryFromValue(test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, _ := schema.Parse(entry.Schema)
+		formatted, err := schema.DecodeStringForSchema(entry.Data, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if formatted != test.expected || StringVal(test.value) != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, formatted)
+		}
+		if v := MakeFromEntry(entry); v != test.value {
+			t.Errorf("expected %v to round trip, got %v", test.value, v)
+		}
+	}
+
+	if v := Cast(MakeDuration(1500*time.Millisecond), Float); v != MakeFloat(1.5) {
+		t.Errorf("expected a duration cast to float to be in seconds, got %v", v)
+	}
+}
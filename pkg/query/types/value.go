@@ -14,6 +14,7 @@ import (
 	"math"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/dburkart/fossil/pkg/common/parse"
 	"github.com/dburkart/fossil/pkg/database"
@@ -32,6 +33,8 @@ const (
 	Float
 	Tuple
 	Composite
+	Timestamp
+	Duration
 )
 
 type Value interface {
@@ -46,6 +49,9 @@ type (
 	floatVal     float64
 	tupleVal     []Value
 	compositeVal map[string]Value
+	// timestampVal is a number of nanoseconds since the unix epoch
+	timestampVal int64
+	durationVal  time.Duration
 )
 
 func (unknownVal) Kind() Kind   { return Unknown }
@@ -55,6 +61,8 @@ func (intVal) Kind() Kind       { return Int }
 func (floatVal) Kind() Kind     { return Float }
 func (tupleVal) Kind() Kind     { return Tuple }
 func (compositeVal) Kind() Kind { return Composite }
+func (timestampVal) Kind() Kind { return Timestamp }
+func (durationVal) Kind() Kind  { return Duration }
 
 func MakeUnknown() Value                     { return unknownVal{} }
 func MakeBoolean(b bool) Value               { return booleanVal(b) }
@@ -63,6 +71,8 @@ func MakeInt(i int64) Value                  { return intVal(i) }
 func MakeFloat(f float64) Value              { return floatVal(f) }
 func MakeTuple(t []Value) Value              { return tupleVal(t) }
 func MakeComposite(m map[string]Value) Value { return compositeVal(m) }
+func MakeTimestamp(t time.Time) Value        { return timestampVal(t.UnixNano()) }
+func MakeDuration(d time.Duration) Value     { return durationVal(d) }
 
 func MakeFromSchemaType(b []byte, t schema.Type) Value {
 	switch t.Name {
@@ -80,6 +90,10 @@ func MakeFromSchemaType(b []byte, t schema.Type) Value {
 		return MakeBoolean(b[0] != 0)
 	case "string":
 		return MakeString(string(b))
+	case "timestamp":
+		return timestampVal(binary.LittleEndian.Uint64(b))
+	case "duration":
+		return durationVal(binary.LittleEndian.Uint64(b))
 	default:
 		panic("Unknown type!")
 	}
@@ -95,54 +109,50 @@ func MakeFromSchemaArray(b []byte, a schema.Array) Value {
 	return MakeTuple(values)
 }
 
+// MakeFromSchemaEnum returns the name stored in b as a string
+func MakeFromSchemaEnum(b []byte, e schema.Enum) Value {
+	name, err := e.Name(b)
+	if err != nil {
+		return MakeUnknown()
+	}
+	return MakeString(name)
+}
+
 func MakeFromEntry(entry database.Entry) Value {
 	object, err := schema.Parse(entry.Schema)
 	if err != nil {
 		panic(err)
 	}
 
-	// FIXME: Handle composite types
 	switch t := object.(type) {
 	case *schema.Type:
 		return MakeFromSchemaType(entry.Data, *t)
 	case *schema.Array:
 		return MakeFromSchemaArray(entry.Data, *t)
+	case *schema.Enum:
+		return MakeFromSchemaEnum(entry.Data, *t)
 	case *schema.Composite:
 		value := map[string]Value{}
 
-		index := 0
+		fields, err := t.Fields(entry.Data)
+		if err != nil {
+			panic(err)
+		}
 
-		// Iterate through our keys, pulling out values to store in our map
 		for i, key := range t.Keys {
-			// Depending on the object type, it will take up variable amounts of space
-			var size int
-			obj := t.Values[i]
+			// Optional keys which were left out have no value
+			if fields[i] == nil {
+				continue
+			}
 
-			switch tt := obj.(type) {
+			switch tt := t.Values[i].(type) {
 			case *schema.Type:
-				size = tt.Size()
-
-				// We are variable length, so read in the length of the field
-				if tt.Name == "string" || tt.Name == "binary" {
-					// Read in 4 bytes specifying size, skip it by adding to index
-					size = int(binary.LittleEndian.Uint32(entry.Data[index : index+4]))
-					index += 4
-				}
-
-				value[key] = MakeFromSchemaType(entry.Data[index:index+size], *tt)
+				value[key] = MakeFromSchemaType(fields[i], *tt)
 			case *schema.Array:
-				size = tt.Size()
-
-				if tt.Type.Name == "string" || tt.Type.Name == "binary" {
-					// Read in 4 bytes specifying size, skip it by adding to index
-					size = int(binary.LittleEndian.Uint32(entry.Data[index : index+4]))
-					index += 4
-				}
-
-				value[key] = MakeFromSchemaArray(entry.Data[index:index+size], *tt)
+				value[key] = MakeFromSchemaArray(fields[i], *tt)
+			case *schema.Enum:
+				value[key] = MakeFromSchemaEnum(fields[i], *tt)
 			}
-
-			index += size
 		}
 		return MakeComposite(value)
 	}
@@ -171,6 +181,12 @@ func EntryFromValue(v Value) (database.Entry, error) {
 			entry.Data = []byte{0}
 		}
 		entry.Schema = "boolean"
+	case timestampVal:
+		entry.Data = binary.LittleEndian.AppendUint64(entry.Data, uint64(v))
+		entry.Schema = "timestamp"
+	case durationVal:
+		entry.Data = binary.LittleEndian.AppendUint64(entry.Data, uint64(v))
+		entry.Schema = "duration"
 	case tupleVal:
 		// First, we assert that all values have the same sub-value type.
 		// We also ensure that it's a valid "array" type
@@ -208,6 +224,14 @@ func EntryFromValue(v Value) (database.Entry, error) {
 					return entry, err
 				}
 				buffer.Write(b)
+			case timestampVal:
+				_, ok = lastType.(timestampVal)
+				t = schema.Type{Name: "timestamp"}
+				buffer.Write(binary.LittleEndian.AppendUint64(nil, uint64(ix.(timestampVal))))
+			case durationVal:
+				_, ok = lastType.(durationVal)
+				t = schema.Type{Name: "duration"}
+				buffer.Write(binary.LittleEndian.AppendUint64(nil, uint64(ix.(durationVal))))
 			default:
 				ok = false
 			}
@@ -238,42 +262,30 @@ func EntryFromValue(v Value) (database.Entry, error) {
 		sort.Strings(sortedKeys)
 
 		for _, key := range sortedKeys {
-			var t schema.Object
 			value := v[key]
 
-			switch value.(type) {
-			case intVal:
-				t = schema.Type{Name: "int64"}
-				b, err := schema.EncodeType(IntVal(value))
-				if err != nil {
-					return entry, err
-				}
-				buffer.Write(b)
-			case floatVal:
-				t = schema.Type{Name: "float64"}
-				b, err := schema.EncodeType(FloatVal(value))
-				if err != nil {
-					return entry, err
-				}
-				buffer.Write(b)
-			case booleanVal:
-				t = schema.Type{Name: "boolean"}
-				b, err := schema.EncodeType(BooleanVal(value))
-				if err != nil {
-					return entry, err
-				}
-				buffer.Write(b)
-			case stringVal:
-				s := StringVal(value)
-				t = schema.Type{Name: "string"}
-				b, err := schema.EncodeType(s)
-				if err != nil {
-					return entry, err
-				}
-				// First, write out the string length
-				buffer.Write(binary.LittleEndian.AppendUint32([]byte{}, uint32(len(s))))
-				buffer.Write(b)
+			// Optional keys which were missing from the input are left out
+			if value.Kind() == Unknown {
+				continue
+			}
+			if value.Kind() == Composite {
+				return entry, fmt.Errorf("composite key '%s' can't hold a composite", key)
+			}
+
+			sub, err := EntryFromValue(value)
+			if err != nil {
+				return entry, err
+			}
+			t, err := schema.Parse(sub.Schema)
+			if err != nil {
+				return entry, err
+			}
+
+			// Strings are prefixed with their length within a composite
+			if value.Kind() == String {
+				buffer.Write(binary.LittleEndian.AppendUint32([]byte{}, uint32(len(sub.Data))))
 			}
+			buffer.Write(sub.Data)
 
 			composite.Keys = append(composite.Keys, key)
 			composite.Values = append(composite.Values, t)
@@ -296,14 +308,50 @@ func MakeFromToken(tok parse.Token) Value {
 			return MakeFloat(x)
 		}
 	case scanner.TOK_STRING:
-		if s, err := strconv.Unquote(tok.Lexeme); err == nil {
+		if s, err := parse.Unquote(tok.Lexeme); err == nil {
 			return MakeString(s)
 		}
+	case scanner.TOK_DURATION:
+		switch x := scaleUnit(tok.Lexeme); x.Kind() {
+		case Int:
+			return MakeDuration(time.Duration(IntVal(x)))
+		case Float:
+			return MakeDuration(time.Duration(math.Round(FloatVal(x))))
+		}
+	case scanner.TOK_SIZE:
+		return scaleUnit(tok.Lexeme)
 	}
 
 	return MakeUnknown()
 }
 
+// scaleUnit returns the number of base units, nanoseconds or bytes, in a
+// number with a unit. It's an Int unless the number of base units is
+// fractional, and Unknown if it can't be parsed or doesn't fit in an int64.
+func scaleUnit(lexeme string) Value {
+	number, scale := scanner.SplitUnit(lexeme)
+
+	if x, err := strconv.ParseInt(number, 0, 64); err == nil {
+		if x > math.MaxInt64/scale {
+			return MakeUnknown()
+		}
+		return MakeInt(x * scale)
+	}
+
+	x, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return MakeUnknown()
+	}
+	x *= float64(scale)
+	if x >= math.MaxInt64 {
+		return MakeUnknown()
+	}
+	if x == math.Trunc(x) {
+		return MakeInt(int64(x))
+	}
+	return MakeFloat(x)
+}
+
 func StringVal(v Value) string {
 	switch x := v.(type) {
 	case stringVal:
@@ -318,6 +366,10 @@ func StringVal(v Value) string {
 		return boolStr
 	case floatVal:
 		return strconv.FormatFloat(FloatVal(x), 'e', 3, 64)
+	case timestampVal:
+		return TimestampVal(x).UTC().Format(time.RFC3339Nano)
+	case durationVal:
+		return DurationVal(x).String()
 	default:
 		panic("Could not convert string")
 	}
@@ -362,6 +414,24 @@ func FloatVal(v Value) float64 {
 	}
 }
 
+func TimestampVal(v Value) time.Time {
+	switch x := v.(type) {
+	case timestampVal:
+		return time.Unix(0, int64(x))
+	default:
+		panic("Not a timestamp")
+	}
+}
+
+func DurationVal(v Value) time.Duration {
+	switch x := v.(type) {
+	case durationVal:
+		return time.Duration(x)
+	default:
+		panic("Not a duration")
+	}
+}
+
 func CompositeVal(v Value) map[string]Value {
 	switch x := v.(type) {
 	case compositeVal:
@@ -380,6 +450,22 @@ func TupleVal(v Value) []Value {
 	}
 }
 
+// IsUnknown returns whether v, or any value in a tuple v, couldn't be made
+// sense of
+func IsUnknown(v Value) bool {
+	switch x := v.(type) {
+	case unknownVal:
+		return true
+	case tupleVal:
+		for _, e := range x {
+			if IsUnknown(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func UnaryOp(operator parse.Token, operand Value) Value {
 	switch operator.Type {
 	case scanner.TOK_MINUS:
@@ -388,12 +474,14 @@ func UnaryOp(operator parse.Token, operand Value) Value {
 			return MakeInt(-int64(operand))
 		case floatVal:
 			return MakeFloat(-float64(operand))
+		case durationVal:
+			return -operand
 		default:
 			return MakeUnknown()
 		}
 	case scanner.TOK_PLUS:
 		switch operand := operand.(type) {
-		case intVal, floatVal:
+		case intVal, floatVal, durationVal:
 			return operand
 		default:
 			return MakeUnknown()
@@ -404,12 +492,34 @@ func UnaryOp(operator parse.Token, operand Value) Value {
 }
 
 func BinaryOp(left Value, operator parse.Token, right Value) Value {
+	if isTemporal(left) || isTemporal(right) {
+		return temporalOp(left, operator, right)
+	}
+
 	left, right = upcast(left, right)
 
-	switch left := left.(type) {
-	case unknownVal:
-		return left
+	// If either side couldn't be made sense of, neither can the result
+	if left.Kind() == Unknown || right.Kind() == Unknown {
+		return MakeUnknown()
+	}
 
+	switch left := left.(type) {
+	case booleanVal:
+		right := right.(booleanVal)
+		switch operator.Type {
+		case scanner.TOK_EQ_EQ:
+			return MakeBoolean(left == right)
+		case scanner.TOK_NOT_EQ:
+			return MakeBoolean(left != right)
+		}
+	case stringVal:
+		right := right.(stringVal)
+		switch operator.Type {
+		case scanner.TOK_EQ_EQ:
+			return MakeBoolean(left == right)
+		case scanner.TOK_NOT_EQ:
+			return MakeBoolean(left != right)
+		}
 	case intVal:
 		right := right.(intVal)
 		switch operator.Type {
@@ -420,6 +530,8 @@ func BinaryOp(left Value, operator parse.Token, right Value) Value {
 			return MakeBoolean(left <= right)
 		case scanner.TOK_EQ_EQ:
 			return MakeBoolean(left == right)
+		case scanner.TOK_NOT_EQ:
+			return MakeBoolean(left != right)
 		case scanner.TOK_GREATER:
 			return MakeBoolean(left > right)
 		case scanner.TOK_GREATER_EQ:
@@ -445,6 +557,8 @@ func BinaryOp(left Value, operator parse.Token, right Value) Value {
 			return MakeBoolean(left <= right)
 		case scanner.TOK_EQ_EQ:
 			return MakeBoolean(left == right)
+		case scanner.TOK_NOT_EQ:
+			return MakeBoolean(left != right)
 		case scanner.TOK_GREATER:
 			return MakeBoolean(left > right)
 		case scanner.TOK_GREATER_EQ:
@@ -471,7 +585,7 @@ func complexity(v Value) int {
 		return 0
 	case booleanVal:
 		return 1
-	case *stringVal:
+	case stringVal:
 		return 2
 	case intVal:
 		return 3
@@ -491,14 +605,43 @@ func upcast(a, b Value) (Value, Value) {
 	return a, b
 }
 
+// upcastInternal converts a to the type of b, where b is the more complex of
+// the two. Strings which don't hold a number are converted to unknown values.
 func upcastInternal(a, b Value) (Value, Value) {
 	switch b.(type) {
+	case unknownVal:
+		return a, b
+	case booleanVal:
+		return a, b
+	case stringVal:
+		switch aa := a.(type) {
+		case booleanVal:
+			return MakeString(StringVal(aa)), b
+		}
+		return a, b
 	case intVal:
+		switch aa := a.(type) {
+		case booleanVal:
+			if aa {
+				return MakeInt(1), b
+			}
+			return MakeInt(0), b
+		case stringVal:
+			if x, err := strconv.ParseInt(string(aa), 0, 64); err == nil {
+				return MakeInt(x), b
+			}
+			return MakeUnknown(), b
+		}
 		return a, b
 	case floatVal:
 		switch aa := a.(type) {
-		case intVal:
-			return MakeFloat(float64(aa)), b
+		case booleanVal, intVal:
+			return MakeFloat(FloatVal(aa)), b
+		case stringVal:
+			if x, err := strconv.ParseFloat(string(aa), 64); err == nil {
+				return MakeFloat(x), b
+			}
+			return MakeUnknown(), b
 		}
 		return a, b
 	}
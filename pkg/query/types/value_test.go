@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/common/parse"
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/query/scanner"
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+var (
+	eqEq  = parse.Token{Type: scanner.TOK_EQ_EQ, Lexeme: "=="}
+	notEq = parse.Token{Type: scanner.TOK_NOT_EQ, Lexeme: "!="}
+	less  = parse.Token{Type: scanner.TOK_LESS, Lexeme: "<"}
+	plus  = parse.Token{Type: scanner.TOK_PLUS, Lexeme: "+"}
+	slash = parse.Token{Type: scanner.TOK_SLASH, Lexeme: "/"}
+)
+
+func TestBinaryOp(t *testing.T) {
+	tests := []struct {
+		name     string
+		left     Value
+		op       parse.Token
+		right    Value
+		expected Value
+	}{
+		{"int == int", MakeInt(1), eqEq, MakeInt(1), MakeBoolean(true)},
+		{"int != int", MakeInt(1), notEq, MakeInt(2), MakeBoolean(true)},
+		{"int != equal int", MakeInt(2), notEq, MakeInt(2), MakeBoolean(false)},
+		{"float != float", MakeFloat(1.5), notEq, MakeFloat(1.5), MakeBoolean(false)},
+		{"int != float", MakeInt(1), notEq, MakeFloat(1.5), MakeBoolean(true)},
+		{"float == int", MakeFloat(2.0), eqEq, MakeInt(2), MakeBoolean(true)},
+		{"int < float", MakeInt(1), less, MakeFloat(1.5), MakeBoolean(true)},
+		{"int + int", MakeInt(1), plus, MakeInt(2), MakeInt(3)},
+		{"int / int", MakeInt(3), slash, MakeInt(2), MakeFloat(1.5)},
+		{"bool == bool", MakeBoolean(true), eqEq, MakeBoolean(true), MakeBoolean(true)},
+		{"bool != bool", MakeBoolean(true), notEq, MakeBoolean(false), MakeBoolean(true)},
+		{"bool == int", MakeBoolean(true), eqEq, MakeInt(1), MakeBoolean(true)},
+		{"int != bool", MakeInt(0), notEq, MakeBoolean(false), MakeBoolean(false)},
+		{"bool == float", MakeBoolean(false), eqEq, MakeFloat(0), MakeBoolean(true)},
+		{"string == string", MakeString("foo"), eqEq, MakeString("foo"), MakeBoolean(true)},
+		{"string != string", MakeString("foo"), notEq, MakeString("bar"), MakeBoolean(true)},
+		{"string == bool", MakeString("true"), eqEq, MakeBoolean(true), MakeBoolean(true)},
+		{"string == int", MakeString("42"), eqEq, MakeInt(42), MakeBoolean(true)},
+		{"float != string", MakeFloat(1.5), notEq, MakeString("1.5"), MakeBoolean(false)},
+		{"non-numeric string == int", MakeString("foo"), eqEq, MakeInt(42), MakeUnknown()},
+		{"unknown == int", MakeUnknown(), eqEq, MakeInt(42), MakeUnknown()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := BinaryOp(test.left, test.op, test.right)
+			if actual != test.expected {
+				t.Errorf("expected %v (%T), got %v (%T)", test.expected, test.expected, actual, actual)
+			}
+		})
+	}
+}
+
+func TestBinaryOpUnsupported(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected ordering comparison of strings to panic")
+		}
+	}()
+
+	BinaryOp(MakeString("a"), less, MakeString("b"))
+}
+
+func TestUpcast(t *testing.T) {
+	a, b := upcast(MakeInt(1), MakeFloat(2))
+	if a.Kind() != Float || b.Kind() != Float {
+		t.Errorf("expected int to upcast to float, got %T and %T", a, b)
+	}
+
+	a, b = upcast(MakeString("x"), MakeBoolean(true))
+	if a.Kind() != String || b.Kind() != String {
+		t.Errorf("expected bool to upcast to string, got %T and %T", a, b)
+	}
+}
+
+func TestMakeFromTokenString(t *testing.T) {
+	tests := []struct {
+		lexeme   string
+		expected string
+	}{
+		{`"plain"`, "plain"},
+		{`'single'`, "single"},
+		{`"it's \"quoted\""`, `it's "quoted"`},
+		{`'it\'s'`, "it's"},
+		{`"back\\slash"`, `back\slash`},
+		{`"line\nbreak"`, "line\nbreak"},
+		{`"caf\u00e9"`, "café"},
+		{`"日本"`, "日本"},
+	}
+
+	for _, tc := range tests {
+		v := MakeFromToken(parse.Token{Type: scanner.TOK_STRING, Lexeme: tc.lexeme})
+		if v.Kind() != String || StringVal(v) != tc.expected {
+			t.Errorf("%s: expected %q, got %v", tc.lexeme, tc.expected, v)
+		}
+	}
+}
+
+func TestMakeFromTokenUnits(t *testing.T) {
+	tests := []struct {
+		tok      scanner.TokenType
+		lexeme   string
+		expected Value
+	}{
+		{scanner.TOK_INTEGER, "1_000_000", MakeInt(1000000)},
+		{scanner.TOK_DURATION, "5s", MakeDuration(5 * time.Second)},
+		{scanner.TOK_DURATION, "1.5h", MakeDuration(90 * time.Minute)},
+		{scanner.TOK_DURATION, "2_500US", MakeDuration(2500 * time.Microsecond)},
+		{scanner.TOK_SIZE, "2kib", MakeInt(2048)},
+		{scanner.TOK_SIZE, "1.5kb", MakeInt(1500)},
+		{scanner.TOK_SIZE, "0.5b", MakeFloat(0.5)},
+		{scanner.TOK_DURATION, "99999999999d", MakeUnknown()},
+		{scanner.TOK_SIZE, "10000000tib", MakeUnknown()},
+	}
+
+	for _, tc := range tests {
+		v := MakeFromToken(parse.Token{Type: tc.tok, Lexeme: tc.lexeme})
+		if v != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.lexeme, tc.expected, v)
+		}
+	}
+}
+
+func TestMakeFromEntryOptionalKeys(t *testing.T) {
+	s := `{"x":int32=4,"note":string?,}`
+	obj, err := schema.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := schema.EncodeStringForSchema("", obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := CompositeVal(MakeFromEntry(database.Entry{Schema: s, Data: data}))
+	if _, ok := m["note"]; ok {
+		t.Errorf("expected absent key to be left out, got %v", m)
+	}
+	if IntVal(m["x"]) != 4 {
+		t.Errorf("expected default of 4, got %v", m["x"])
+	}
+}
+
+func TestMakeFromEntryEnum(t *testing.T) {
+	v := MakeFromEntry(database.Entry{Schema: `enum("ok","warn")`, Data: []byte{1}})
+	if v.Kind() != String || StringVal(v) != "warn" {
+		t.Errorf("expected enum to be read as the string warn, got %v", v)
+	}
+
+	m := CompositeVal(MakeFromEntry(database.Entry{Schema: `{"s":enum("ok","warn"),}`, Data: []byte{0}}))
+	if StringVal(m["s"]) != "ok" {
+		t.Errorf("expected enum key to be read as the string ok, got %v", m["s"])
+	}
+}
+
+func TestEntryFromValueComposite(t *testing.T) {
+	v := MakeComposite(map[string]Value{
+		"pair":    MakeTuple([]Value{MakeFloat(1.5), MakeFloat(2)}),
+		"name":    MakeString("cpu"),
+		"count":   MakeInt(3),
+		"missing": MakeUnknown(),
+	})
+
+	entry, err := EntryFromValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Schema != `{"count":int64,"name":string,"pair":[2]float64,}` {
+		t.Errorf("unexpected schema %s", entry.Schema)
+	}
+
+	// The entry should read back as the value it was made from
+	m := CompositeVal(MakeFromEntry(entry))
+	if IntVal(m["count"]) != 3 || StringVal(m["name"]) != "cpu" {
+		t.Errorf("unexpected value %v", m)
+	}
+	if pair := TupleVal(m["pair"]); len(pair) != 2 || FloatVal(pair[0]) != 1.5 || FloatVal(pair[1]) != 2 {
+		t.Errorf("unexpected pair %v", m["pair"])
+	}
+	if _, ok := m["missing"]; ok {
+		t.Errorf("expected unknown value to be left out, got %v", m)
+	}
+
+	_, err = EntryFromValue(MakeComposite(map[string]Value{"inner": v}))
+	if err == nil {
+		t.Error("expected nested composite to be rejected")
+	}
+}
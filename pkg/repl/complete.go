@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package repl
+
+import (
+	"strings"
+
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/query/parser"
+)
+
+// CompleteQuery completes the partial query at the end of a query, profile or
+// histogram command. It returns every completion of the partially typed word at the end
+// of the line, in full, along with that word. If line isn't a query command,
+// ok is false.
+func CompleteQuery(line string, topics []string) (completions []string, word string, ok bool) {
+	var query string
+	if strings.HasPrefix(strings.ToUpper(line), "HISTOGRAM(") {
+		// The query follows the bucket width
+		_, rest, found := strings.Cut(line, ")")
+		if !found {
+			return nil, "", false
+		}
+		query = rest
+	} else {
+		command, rest, found := strings.Cut(line, " ")
+		if !found {
+			return nil, "", false
+		}
+
+		switch strings.ToUpper(command) {
+		case proto.CommandQuery, "PROFILE":
+		default:
+			return nil, "", false
+		}
+		query = rest
+	}
+
+	c := parser.Complete(strings.TrimLeft(query, " "))
+	for _, candidate := range c.Candidates {
+		// Keep typing straight after an opening paren
+		if !strings.HasSuffix(candidate, "(") {
+			candidate += " "
+		}
+		completions = append(completions, candidate)
+	}
+
+	if c.Topic {
+		for _, topic := range topics {
+			if strings.HasPrefix(topic, c.Word) {
+				completions = append(completions, topic+" ")
+			}
+		}
+	}
+
+	return completions, c.Word, true
+}
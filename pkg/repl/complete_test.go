@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package repl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompleteQuery(t *testing.T) {
+	topics := []string{"/", "/cpu", "/cpu/core0", "/memory"}
+
+	tt := []struct {
+		line        string
+		completions []string
+		word        string
+	}{
+		{"query ", []string{"all ", "latest ", "sample("}, ""},
+		{"QUERY s", []string{"sample("}, "s"},
+		{"query all ", []string{"in ", "since ", "before ", "between ", "where ", "| "}, ""},
+		{"query all i", []string{"in "}, "i"},
+		{"query all in /c", []string{"/cpu ", "/cpu/core0 "}, "/c"},
+		{"query all in /cpu ", []string{"since ", "before ", "between ", "where ", "| "}, ""},
+		{"query all in /cpu since ", []string{"~now "}, ""},
+		{"query all in /cpu since ~now - @m", []string{"@minute ", "@month "}, "@m"},
+		{"query all in /cpu since ~now - @day ", []string{"- ", "+ ", "where ", "| "}, ""},
+		{"query all in /cpu where v", []string{"value "}, "v"},
+		{"query all between ~now - @day ", []string{"- ", "+ ", ", "}, ""},
+		{"query sample(", []string{"@second ", "@minute ", "@hour ", "@day ", "@week ", "@month ", "@year "}, ""},
+		{"query sample(@hour, ", []string{"align "}, ""},
+		{"query sample(@hour) ", []string{"in ", "since ", "before ", "between ", "where ", "| "}, ""},
+		{"profile all | ", []string{"filter ", "map ", "reduce "}, ""},
+		{"histogram(@minute * 5) ", []string{"all ", "latest ", "sample("}, ""},
+		{"histogram(@hour) all i", []string{"in "}, "i"},
+		{"query all | m", []string{"map "}, "m"},
+		{"query all | map x -> m", []string{"max(", "min("}, "m"},
+		{"query all | map x, y -> ", []string{"x ", "y ", "bool(", "counter_rate(", "float(", "int(", "interval(", "max(", "min(", "string(", "time("}, ""},
+		{"query all | map x -> x * 2 | r", []string{"reduce "}, "r"},
+	}
+
+	for _, tc := range tt {
+		completions, word, ok := CompleteQuery(tc.line, topics)
+		if !ok {
+			t.Errorf("expected %q to be completed as a query", tc.line)
+			continue
+		}
+		if !reflect.DeepEqual(completions, tc.completions) || word != tc.word {
+			t.Errorf("completing %q: expected %q replacing %q, got %q replacing %q", tc.line, tc.completions, tc.word, completions, word)
+		}
+	}
+
+	for _, line := range []string{"query", "append /cpu ", "describe /c", "histogram(@ho"} {
+		if _, _, ok := CompleteQuery(line, topics); ok {
+			t.Errorf("expected %q not to be completed as a query", line)
+		}
+	}
+}
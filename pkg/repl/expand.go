@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package repl
+
+import (
+	"time"
+
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+// ExpandedResults prints query results with a column for each key of the
+// composite results, rather than a single data column, so that they can be
+// loaded into a spreadsheet. The columns are the union of the keys of every
+// result, in the order they're first seen; results which aren't composites
+// are printed in a data column.
+type ExpandedResults proto.QueryResponse
+
+// columns returns the keys of every composite result, and whether any result
+// isn't a composite
+func (v ExpandedResults) columns() ([]string, bool) {
+	var keys []string
+	seen := map[string]bool{}
+	data := false
+
+	for _, val := range v.Results {
+		obj, err := schema.Parse(val.Schema)
+		if err != nil {
+			continue
+		}
+		composite, ok := obj.(*schema.Composite)
+		if !ok {
+			data = true
+			continue
+		}
+		for _, key := range composite.Keys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys, data
+}
+
+func (v ExpandedResults) Headers() []string {
+	keys, data := v.columns()
+	headers := append([]string{"time", "topic"}, keys...)
+	if data {
+		headers = append(headers, "data")
+	}
+	return headers
+}
+
+func (v ExpandedResults) Values() [][]string {
+	keys, data := v.columns()
+	column := map[string]int{}
+	for i, key := range keys {
+		column[key] = i + 2
+	}
+	width := len(keys) + 2
+	if data {
+		width++
+	}
+
+	res := [][]string{}
+	for _, val := range v.Results {
+		obj, err := schema.Parse(val.Schema)
+		if err != nil {
+			continue
+		}
+
+		row := make([]string, width)
+		row[0] = val.Time.Format(time.RFC3339Nano)
+		row[1] = val.Topic
+
+		composite, ok := obj.(*schema.Composite)
+		if !ok {
+			row[width-1], err = schema.DecodeStringForSchema(val.Data, obj)
+			if err != nil {
+				continue
+			}
+			res = append(res, row)
+			continue
+		}
+
+		fields, err := composite.Fields(val.Data)
+		if err != nil {
+			continue
+		}
+		for i, key := range composite.Keys {
+			// Optional keys which are absent are left empty
+			if fields[i] == nil {
+				continue
+			}
+			row[column[key]], err = schema.DecodeStringForSchema(fields[i], composite.Values[i])
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		res = append(res, row)
+	}
+
+	return res
+}
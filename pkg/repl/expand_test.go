@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package repl
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/schema"
+)
+
+func TestExpandedResults(t *testing.T) {
+	entry := func(topic, s, data string) database.Entry {
+		obj, err := schema.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := schema.EncodeStringForSchema(data, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return database.Entry{Time: time.Unix(0, 0).UTC(), Topic: topic, Schema: s, Data: b}
+	}
+
+	results := ExpandedResults(proto.QueryResponse{Results: database.Entries{
+		entry("/weather", `{"temp": float32, "humidity": int32?}`, `"temp": 12.5, "humidity": 80`),
+		entry("/weather", `{"temp": float32, "humidity": int32?}`, `"temp": 14.25`),
+		entry("/wind", `{"speed": int32, "temp": float32}`, `"speed": 3, "temp": 9`),
+		entry("/notes", "string", "hello, world"),
+	}})
+
+	expectedHeaders := []string{"time", "topic", "humidity", "temp", "speed", "data"}
+	if headers := results.Headers(); !reflect.DeepEqual(headers, expectedHeaders) {
+		t.Errorf("expected headers %v, got %v", expectedHeaders, headers)
+	}
+
+	ts := "1970-01-01T00:00:00Z"
+	expectedValues := [][]string{
+		{ts, "/weather", "80", "12.500000", "", ""},
+		{ts, "/weather", "", "14.250000", "", ""},
+		{ts, "/wind", "", "9.000000", "3", ""},
+		{ts, "/notes", "", "", "", "hello, world"},
+	}
+	if values := results.Values(); !reflect.DeepEqual(values, expectedValues) {
+		t.Errorf("expected values %v, got %v", expectedValues, values)
+	}
+}
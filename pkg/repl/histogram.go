@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/query/parser"
+)
+
+const (
+	// histogramWidth is the length of the bar of the fullest bucket
+	histogramWidth = 50
+	// maxHistogramBuckets is the most buckets a histogram may have
+	maxHistogramBuckets = 10000
+)
+
+// ParseHistogramCommand parses a histogram command, returning the width of
+// each bucket and the query whose results are counted. If line isn't a
+// histogram command, ok is false.
+//
+// Syntax:
+//
+//	histogram(<time-quantity>) <query>
+func ParseHistogramCommand(line string) (bucket time.Duration, query string, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(strings.ToUpper(line), "HISTOGRAM(") {
+		return 0, "", false, nil
+	}
+
+	quantity, query, found := strings.Cut(line[len("histogram("):], ")")
+	if !found {
+		return 0, "", true, errors.New("malformed histogram: expected histogram(<time-quantity>) <query>")
+	}
+	bucket, err = parser.ParseTimeQuantity(quantity)
+	if err != nil {
+		return 0, "", true, err
+	}
+	if bucket <= 0 {
+		return 0, "", true, fmt.Errorf("malformed histogram: bucket width %s must be positive", bucket)
+	}
+
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return 0, "", true, errors.New("malformed histogram: expected a query after the bucket width")
+	}
+	return bucket, query, true, nil
+}
+
+// HistogramBucket counts the entries from Start up to the start of the next
+// bucket
+type HistogramBucket struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// Histogram counts query results per bucket of time, so that gaps and bursts
+// stand out. Buckets are aligned to multiples of Width, and run from the
+// earliest result to the latest, including the empty ones in between.
+type Histogram struct {
+	Width   time.Duration     `json:"width"`
+	Buckets []HistogramBucket `json:"buckets"`
+}
+
+// NewHistogram counts entries in buckets width long. It is an error for the
+// entries to span more than maxHistogramBuckets buckets.
+func NewHistogram(entries database.Entries, width time.Duration) (Histogram, error) {
+	h := Histogram{Width: width}
+	if len(entries) == 0 {
+		return h, nil
+	}
+
+	first, last := entries[0].Time, entries[0].Time
+	for _, e := range entries {
+		if e.Time.Before(first) {
+			first = e.Time
+		}
+		if e.Time.After(last) {
+			last = e.Time
+		}
+	}
+
+	start := first.Truncate(width)
+	n := last.Sub(start)/width + 1
+	if n > maxHistogramBuckets {
+		return h, fmt.Errorf("results span %d buckets of %s, more than the %d allowed; use wider buckets", n, width, maxHistogramBuckets)
+	}
+	h.Buckets = make([]HistogramBucket, n)
+	for i := range h.Buckets {
+		h.Buckets[i].Start = start.Add(time.Duration(i) * width)
+	}
+	for _, e := range entries {
+		h.Buckets[e.Time.Sub(start)/width].Count++
+	}
+
+	return h, nil
+}
+
+func (h Histogram) Headers() []string {
+	return []string{"start", "count", "histogram"}
+}
+
+func (h Histogram) Values() [][]string {
+	most := 0
+	for _, b := range h.Buckets {
+		if b.Count > most {
+			most = b.Count
+		}
+	}
+
+	values := make([][]string, 0, len(h.Buckets))
+	for _, b := range h.Buckets {
+		bar := 0
+		if most > 0 {
+			bar = b.Count * histogramWidth / most
+			// Any entries at all get a mark, so that a bucket with a few
+			// entries can be told apart from a gap
+			if bar == 0 && b.Count > 0 {
+				bar = 1
+			}
+		}
+		values = append(values, []string{
+			b.Start.Format(time.RFC3339),
+			strconv.Itoa(b.Count),
+			strings.Repeat("#", bar),
+		})
+	}
+	return values
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package repl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/database"
+)
+
+func TestParseHistogramCommand(t *testing.T) {
+	bucket, query, ok, err := ParseHistogramCommand("HISTOGRAM(@minute * 5) all in /sensors")
+	if !ok || err != nil || bucket != 5*time.Minute || query != "all in /sensors" {
+		t.Errorf("unexpected parse %s, %q, %v, %v", bucket, query, ok, err)
+	}
+
+	if _, _, ok, _ := ParseHistogramCommand("query all"); ok {
+		t.Error("expected a query not to be a histogram command")
+	}
+
+	for _, line := range []string{"histogram(@hour all", "histogram(@fortnight) all", "histogram(@hour)", "histogram(@hour all) all", "histogram(0) all"} {
+		if _, _, ok, err := ParseHistogramCommand(line); !ok || err == nil {
+			t.Errorf("ParseHistogramCommand(%q): expected an error", line)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	start := time.Date(2023, 3, 1, 9, 0, 0, 0, time.UTC)
+	var entries database.Entries
+	for _, offset := range []time.Duration{10 * time.Minute, 20 * time.Minute, 30 * time.Minute, 50 * time.Minute, 3*time.Hour + 5*time.Minute} {
+		entries = append(entries, database.Entry{Time: start.Add(offset)})
+	}
+
+	h, err := NewHistogram(entries, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"2023-03-01T09:00:00Z", "4", strings.Repeat("#", histogramWidth)},
+		{"2023-03-01T10:00:00Z", "0", ""},
+		{"2023-03-01T11:00:00Z", "0", ""},
+		{"2023-03-01T12:00:00Z", "1", strings.Repeat("#", histogramWidth/4)},
+	}
+	if values := h.Values(); !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+
+	if _, err := NewHistogram(entries, time.Millisecond); err == nil {
+		t.Error("expected too many buckets to be an error")
+	}
+
+	if h, err := NewHistogram(nil, time.Hour); err != nil || len(h.Values()) != 0 {
+		t.Errorf("expected no buckets for no entries, got %v, %v", h.Values(), err)
+	}
+}
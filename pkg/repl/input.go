@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package repl
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// NeedsContinuation returns true if input is an incomplete command which
+// should be continued on the next line. This is the case when the input ends
+// with a pipe, or has unclosed parentheses, brackets, or braces.
+func NeedsContinuation(input string) bool {
+	trimmed := strings.TrimSpace(input)
+	if strings.HasSuffix(trimmed, "|") {
+		return true
+	}
+
+	depth := 0
+	inString := false
+	inComment := false
+	escaped := false
+	for _, r := range trimmed {
+		// Comments in schemas run until the end of the line
+		if inComment {
+			inComment = r != '\n'
+			continue
+		}
+
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch r {
+		case '"':
+			inString = true
+		case '#':
+			inComment = true
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		}
+	}
+
+	return depth > 0
+}
+
+// Escape sequences a terminal wraps pasted text in, once bracketed paste mode
+// is enabled with BracketedPasteOn
+var (
+	pasteStart = []byte("\x1b[200~")
+	pasteEnd   = []byte("\x1b[201~")
+)
+
+const (
+	BracketedPasteOn  = "\x1b[?2004h"
+	BracketedPasteOff = "\x1b[?2004l"
+)
+
+type pasteReader struct {
+	r       io.Reader
+	inPaste bool
+	partial []byte
+	pending []byte
+	buf     []byte
+}
+
+// NewPasteReader wraps a terminal's input, removing bracketed paste markers
+// and replacing line breaks in pasted text with spaces. A multi-line query
+// pasted into the REPL is then edited as a single line, rather than being
+// executed a line at a time.
+func NewPasteReader(r io.Reader) io.Reader {
+	return &pasteReader{r: r, buf: make([]byte, 1024)}
+}
+
+func (p *pasteReader) Read(b []byte) (int, error) {
+	for len(p.pending) == 0 {
+		n, err := p.r.Read(p.buf)
+		for _, c := range p.buf[:n] {
+			p.filter(c)
+		}
+		if err != nil {
+			// Anything held back as a possible marker is just input
+			p.emit(p.partial...)
+			p.partial = nil
+			if len(p.pending) == 0 {
+				return 0, err
+			}
+			break
+		}
+	}
+
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *pasteReader) filter(c byte) {
+	p.partial = append(p.partial, c)
+
+	switch {
+	case bytes.Equal(p.partial, pasteStart):
+		p.inPaste = true
+		p.partial = p.partial[:0]
+	case bytes.Equal(p.partial, pasteEnd):
+		p.inPaste = false
+		p.partial = p.partial[:0]
+	case bytes.HasPrefix(pasteStart, p.partial), bytes.HasPrefix(pasteEnd, p.partial):
+		// Could still be a marker, hold on to it
+	default:
+		// Markers only ever start with an escape, so only a trailing escape
+		// needs to be held back
+		last := len(p.partial) - 1
+		if p.partial[last] == pasteStart[0] {
+			p.emit(p.partial[:last]...)
+			p.partial = append(p.partial[:0], c)
+		} else {
+			p.emit(p.partial...)
+			p.partial = p.partial[:0]
+		}
+	}
+}
+
+func (p *pasteReader) emit(b ...byte) {
+	for _, c := range b {
+		if p.inPaste && (c == '\r' || c == '\n') {
+			c = ' '
+		}
+		p.pending = append(p.pending, c)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package repl
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestNeedsContinuation(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected bool
+	}{
+		{"all in /foo", false},
+		{"all in /foo |", true},
+		{"all in /foo |  ", true},
+		{"all in /foo | map x -> (", true},
+		{"all in /foo | map x -> (x * 2)", false},
+		{"create topic /foo {", true},
+		{"create topic /foo {x:int32}", false},
+		{`all in /foo | filter x -> x == "(|"`, false},
+		{`all in /foo | filter x -> x == "\"(" && (`, true},
+		{"create topic /foo { # {", true},
+		{"create topic /foo { # }", true},
+		{"create topic /foo { # }\n\"x\": int32 }", false},
+		{`create topic /foo {"#": int32 }`, false},
+		{"", false},
+	}
+
+	for _, tc := range testCases {
+		if actual := NeedsContinuation(tc.input); actual != tc.expected {
+			t.Errorf("NeedsContinuation(%q): expected %v, got %v", tc.input, tc.expected, actual)
+		}
+	}
+}
+
+func TestPasteReader(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"plain", "all in /foo\n", "all in /foo\n"},
+		{"paste", "\x1b[200~query all\nin /foo\r\n| sample(@minute)\x1b[201~\n", "query all in /foo  | sample(@minute)\n"},
+		{"arrow keys", "\x1b[Aabc\x1b[D", "\x1b[Aabc\x1b[D"},
+		{"trailing escape", "abc\x1b", "abc\x1b"},
+		{"escape before marker", "\x1b\x1b[200~a\nb\x1b[201~", "\x1ba b"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Reading a byte at a time splits the markers across reads
+			r := NewPasteReader(iotest.OneByteReader(strings.NewReader(tc.input)))
+			actual, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(actual) != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package repl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MorePrompt is shown after each page of output
+const MorePrompt = "--More-- "
+
+// Pager collects the output of a REPL command, and writes it a page at a time
+// when it's flushed, asking whether to continue after each page. Output which
+// fits on one page is written as-is.
+type Pager struct {
+	w io.Writer
+	// height returns the number of lines the terminal has room for
+	height func() int
+	// more is called after each page, and returns whether to show the next
+	more func() bool
+
+	enabled bool
+	// rows is the number of rows per page set with the pager command, or 0
+	// to fit pages to the terminal
+	rows int
+	buf  bytes.Buffer
+}
+
+// NewPager returns an enabled Pager writing to w
+func NewPager(w io.Writer, height func() int, more func() bool) *Pager {
+	return &Pager{w: w, height: height, more: more, enabled: true}
+}
+
+// Disable turns paging off, so that output is written as-is
+func (p *Pager) Disable() {
+	p.enabled = false
+}
+
+// Write buffers b until the pager is flushed
+func (p *Pager) Write(b []byte) (int, error) {
+	return p.buf.Write(b)
+}
+
+// Flush writes the buffered output, a page at a time if it doesn't fit on
+// one. Output left over when more declines to continue is discarded.
+func (p *Pager) Flush() error {
+	defer p.buf.Reset()
+
+	size := p.pageSize()
+	if !p.enabled || size <= 0 {
+		_, err := p.w.Write(p.buf.Bytes())
+		return err
+	}
+
+	out := p.buf.Bytes()
+	for {
+		page, rest := splitLines(out, size)
+		if _, err := p.w.Write(page); err != nil {
+			return err
+		}
+		if len(rest) == 0 || !p.more() {
+			return nil
+		}
+		out = rest
+	}
+}
+
+// pageSize returns the number of lines in a page, leaving room on the
+// terminal for the prompt
+func (p *Pager) pageSize() int {
+	if p.rows > 0 {
+		return p.rows
+	}
+	if p.height == nil {
+		return 0
+	}
+	return p.height() - 1
+}
+
+// splitLines splits b after its first n lines
+func splitLines(b []byte, n int) ([]byte, []byte) {
+	end := 0
+	for i := 0; i < n; i++ {
+		next := bytes.IndexByte(b[end:], '\n')
+		if next < 0 {
+			return b, nil
+		}
+		end += next + 1
+	}
+	return b[:end], b[end:]
+}
+
+// Handle runs line if it's a pager command, returning whether it was one. A
+// bare pager command shows whether paging is on.
+//
+// Syntax:
+//
+//	pager [on | off | rows]
+func (p *Pager) Handle(line string) (bool, error) {
+	cmd, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if strings.ToUpper(cmd) != "PAGER" {
+		return false, nil
+	}
+
+	switch rest = strings.TrimSpace(rest); strings.ToUpper(rest) {
+	case "":
+		fmt.Println(p)
+	case "ON":
+		p.enabled, p.rows = true, 0
+	case "OFF":
+		p.enabled = false
+	default:
+		rows, err := strconv.Atoi(rest)
+		if err != nil || rows <= 0 {
+			return true, errors.New("malformed pager: expected on, off or a number of rows")
+		}
+		p.enabled, p.rows = true, rows
+	}
+	return true, nil
+}
+
+func (p *Pager) String() string {
+	switch {
+	case !p.enabled:
+		return "pager is off"
+	case p.rows > 0:
+		return fmt.Sprintf("pager is on, with %d rows per page", p.rows)
+	}
+	return "pager is on"
+}
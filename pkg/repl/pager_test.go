@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package repl
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPager(t *testing.T) {
+	var out strings.Builder
+	prompts := 0
+	pager := NewPager(&out, func() int { return 4 }, func() bool {
+		prompts++
+		fmt.Fprint(&out, "--More--\n")
+		return prompts < 2
+	})
+
+	// Output which fits on a page isn't paged
+	fmt.Fprint(pager, "1\n2\n3\n")
+	if err := pager.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "1\n2\n3\n" || prompts != 0 {
+		t.Errorf("expected output which fits to be written as-is, got %q after %d prompts", out.String(), prompts)
+	}
+
+	// Declining to continue discards the rest
+	out.Reset()
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintln(pager, i)
+	}
+	if err := pager.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "1\n2\n3\n--More--\n4\n5\n6\n--More--\n"; out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+
+	for _, line := range []string{"pager off", "PAGER 2", "pager on", "pager off"} {
+		if handled, err := pager.Handle(line); !handled || err != nil {
+			t.Fatalf("Handle(%q): expected handled without error, got %v, %v", line, handled, err)
+		}
+	}
+	for _, line := range []string{"pager sometimes", "pager 0"} {
+		if _, err := pager.Handle(line); err == nil {
+			t.Errorf("Handle(%q): expected an error", line)
+		}
+	}
+	if handled, _ := pager.Handle("query all"); handled {
+		t.Error("expected a query not to be handled")
+	}
+
+	// Errors leave the pager as it was, so it's still off
+	out.Reset()
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintln(pager, i)
+	}
+	pager.Flush()
+	if strings.Contains(out.String(), "--More--") {
+		t.Errorf("expected output not to be paged once the pager is off, got %q", out.String())
+	}
+}
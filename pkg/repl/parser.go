@@ -8,8 +8,13 @@ package repl
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dburkart/fossil/pkg/proto"
 	"github.com/dburkart/fossil/pkg/schema"
@@ -17,7 +22,7 @@ import (
 
 // ParseREPLCommand parses input from the command line
 //
-// This function assumes there is no '\n'
+// Input may only span lines when it was continued within a schema
 func ParseREPLCommand(b []byte, schemas map[string]schema.Object) (proto.Message, error) {
 	// Get the command
 	var msg proto.Message
@@ -34,36 +39,38 @@ func ParseREPLCommand(b []byte, schemas map[string]schema.Object) (proto.Message
 		data = b[ind+1:]
 	}
 
+	// Appends and topic creation can be validated without writing anything
+	dryRun := false
+	if bytes.HasPrefix(data, []byte(dryRunFlag+" ")) {
+		dryRun = true
+		data = bytes.TrimLeft(data[len(dryRunFlag):], " ")
+	}
+
 	// Marshal message based on the command
 	command := strings.ToUpper(string(cmd))
+	if dryRun && command != proto.CommandAppend && command != proto.CommandCreate {
+		return nil, fmt.Errorf("%s is only supported by append and create topic", dryRunFlag)
+	}
 	switch command {
 	case proto.CommandVersion:
 		msg = proto.NewMessageWithType(proto.CommandVersion, proto.VersionRequest{})
-	case proto.CommandAppend:
-		req := proto.AppendRequest{}
-
-		if len(data) == 0 {
-			return nil, errors.New("malformed append request: expected data after append keyword")
-		}
-
-		// check for space after topic, no space means the data starts with /
-		spaceInd := bytes.IndexByte(data, ' ')
-		if data[0] == '/' && spaceInd != -1 {
-			req.Topic = string(data[:spaceInd])
-			s, ok := schemas[req.Topic]
-			if ok {
-				d, err := schema.EncodeStringForSchema(string(data[spaceInd+1:]), s)
-				if err != nil {
-					return nil, err
-				}
-				req.Data = d
-			} else {
-				req.Data = data[spaceInd+1:]
+	case proto.CommandPing:
+		msg = proto.NewMessageWithType(proto.CommandPing, proto.PingRequest{Sent: time.Now()})
+	case proto.CommandAppend, proto.CommandValidate:
+		req, err := parseAppendCommand(data, schemas)
+		if err != nil {
+			return nil, err
+		}
+
+		if dryRun || command == proto.CommandValidate {
+			// Data is only validated if it isn't nil
+			if req.Data == nil {
+				req.Data = []byte{}
 			}
+			msg = proto.NewMessageWithType(proto.CommandValidate, proto.ValidateRequest{Topic: req.Topic, Data: req.Data})
 		} else {
-			req.Data = data[:]
+			msg = proto.NewMessageWithType(proto.CommandAppend, req)
 		}
-		msg = proto.NewMessageWithType(proto.CommandAppend, req)
 	case proto.CommandUse:
 		req := proto.UseRequest{}
 
@@ -83,6 +90,23 @@ func ParseREPLCommand(b []byte, schemas map[string]schema.Object) (proto.Message
 		req.Query = string(data)
 
 		msg = proto.NewMessageWithType(proto.CommandQuery, req)
+	case "PROFILE":
+		// Run a query, asking for a per-stage profile along with the results
+		req := proto.QueryRequest{}
+
+		req.Query = string(data)
+		req.Profile = true
+
+		msg = proto.NewMessageWithType(proto.CommandQuery, req)
+	case proto.CommandTopics:
+		req, err := parseTopicsCommand(string(data))
+		if err != nil {
+			return nil, err
+		}
+
+		msg = proto.NewMessageWithType(proto.CommandTopics, req)
+	case "DATABASES":
+		msg = proto.NewMessageWithType(proto.CommandDatabaseStatus, proto.DatabaseStatusRequest{})
 	case proto.CommandList:
 		req := proto.ListRequest{}
 
@@ -90,29 +114,234 @@ func ParseREPLCommand(b []byte, schemas map[string]schema.Object) (proto.Message
 
 		msg = proto.NewMessageWithType(proto.CommandList, req)
 	case proto.CommandCreate:
+		if strings.HasPrefix(string(data), "schema ") ||
+			strings.HasPrefix(string(data), "SCHEMA ") {
+			if dryRun {
+				return nil, fmt.Errorf("%s is only supported by append and create topic", dryRunFlag)
+			}
+			req := proto.CreateSchemaRequest{}
+
+			definition := strings.TrimSpace(string(data[len("schema "):]))
+			spaceInd := strings.IndexByte(definition, ' ')
+			if spaceInd == -1 {
+				return nil, errors.New("malformed create request: expected a name and schema after schema keyword")
+			}
+			req.Name = definition[:spaceInd]
+			req.Schema = strings.TrimSpace(definition[spaceInd+1:])
+
+			msg = proto.NewMessageWithType(proto.CommandSchema, req)
+			break
+		}
+
+		if strings.HasPrefix(string(data), "template ") ||
+			strings.HasPrefix(string(data), "TEMPLATE ") {
+			if dryRun {
+				return nil, fmt.Errorf("%s is only supported by append and create topic", dryRunFlag)
+			}
+			req := proto.CreateTemplateRequest{}
+
+			definition := strings.TrimSpace(string(data[len("template "):]))
+			spaceInd := strings.IndexByte(definition, ' ')
+			if spaceInd == -1 {
+				return nil, errors.New("malformed create request: expected a pattern and schema after template keyword")
+			}
+			req.Pattern = definition[:spaceInd]
+			req.Schema = strings.TrimSpace(definition[spaceInd+1:])
+
+			msg = proto.NewMessageWithType(proto.CommandTemplate, req)
+			break
+		}
+
 		req := proto.CreateTopicRequest{}
 
 		if !strings.HasPrefix(string(data), "topic") &&
 			!strings.HasPrefix(string(data), "TOPIC") {
-			return nil, errors.New("malformed create request: expected topic keyword after create")
+			return nil, errors.New("malformed create request: expected topic, schema or template keyword after create")
 		}
 
 		begin := bytes.IndexByte(data, ' ') + 1
-		spaceInd := bytes.IndexByte(data[begin:], ' ') + begin
+
+		// A trailing override keyword replaces a conflicting parent schema
+		for _, keyword := range []string{" override", " OVERRIDE"} {
+			if ind := len(data) - len(keyword); ind > begin && bytes.HasSuffix(data, []byte(keyword)) {
+				req.Override = true
+				data = data[:ind]
+				break
+			}
+		}
+
+		// An optional encoding may follow the schema and codec
+		if encodingInd := bytes.LastIndex(data, []byte(" encoding ")); encodingInd != -1 && encodingInd >= begin {
+			req.Encoding = strings.TrimSpace(string(data[encodingInd+len(" encoding "):]))
+			data = data[:encodingInd]
+		}
+
+		// An optional codec may follow the schema
+		if codecInd := bytes.LastIndex(data, []byte(" codec ")); codecInd != -1 && codecInd >= begin {
+			req.Codec = strings.TrimSpace(string(data[codecInd+len(" codec "):]))
+			data = data[:codecInd]
+		}
+
+		spaceInd := bytes.IndexByte(data[begin:], ' ')
 
 		// No schema
 		if spaceInd == -1 {
 			req.Topic = string(data[begin:])
 			req.Schema = ""
 		} else {
+			spaceInd += begin
 			req.Topic = string(data[begin:spaceInd])
 			req.Schema = string(data[spaceInd+1:])
 		}
 
+		if dryRun {
+			msg = proto.NewMessageWithType(proto.CommandValidate, proto.ValidateRequest{
+				Topic:       req.Topic,
+				Schema:      req.Schema,
+				Codec:       req.Codec,
+				Override:    req.Override,
+				CreateTopic: true,
+			})
+			break
+		}
 		msg = proto.NewMessageWithType(proto.CommandCreate, req)
+	case proto.CommandFlush:
+		msg = proto.NewMessageWithType(proto.CommandFlush, proto.FlushRequest{})
+	case proto.CommandDescribe:
+		req := proto.DescribeRequest{}
+
+		req.Topic = strings.TrimSpace(string(data))
+		// Allow "describe topic /foo" as well as "describe /foo"
+		if fields := strings.Fields(req.Topic); len(fields) == 2 && strings.ToUpper(fields[0]) == "TOPIC" {
+			req.Topic = fields[1]
+		}
+
+		msg = proto.NewMessageWithType(proto.CommandDescribe, req)
 	default:
 		msg = proto.NewMessage(command, b)
 	}
 
 	return msg, nil
 }
+
+// dryRunFlag follows append or create to validate the command, rather than
+// run it
+const dryRunFlag = "--dry-run"
+
+// Binary payloads can't be typed into the REPL, so they're appended from a
+// file, or given in base64, by prefixing the data with one of these
+const (
+	filePayloadPrefix   = "@file:"
+	base64PayloadPrefix = "base64:"
+)
+
+// binaryPayload returns the payload referred to by data, and true, if data is
+// a file reference or base64. The payload is appended as is, without being
+// encoded for the topic's schema.
+func binaryPayload(data []byte) ([]byte, bool, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte(filePayloadPrefix)):
+		p := strings.TrimSpace(string(data[len(filePayloadPrefix):]))
+		payload, err := os.ReadFile(p)
+		if err != nil {
+			return nil, true, fmt.Errorf("malformed append request: unable to read payload: %w", err)
+		}
+		return payload, true, nil
+	case bytes.HasPrefix(data, []byte(base64PayloadPrefix)):
+		payload, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data[len(base64PayloadPrefix):])))
+		if err != nil {
+			return nil, true, fmt.Errorf("malformed append request: invalid base64 payload: %w", err)
+		}
+		return payload, true, nil
+	}
+	return nil, false, nil
+}
+
+// parseAppendCommand parses the arguments to "append", which are an optional
+// topic followed by the data to append. Data for topics with a known schema is
+// encoded according to it, unless it's a file reference or base64.
+func parseAppendCommand(data []byte, schemas map[string]schema.Object) (proto.AppendRequest, error) {
+	req := proto.AppendRequest{}
+
+	if len(data) == 0 {
+		return req, errors.New("malformed append request: expected data after append keyword")
+	}
+
+	// check for space after topic, no space means the data starts with /
+	spaceInd := bytes.IndexByte(data, ' ')
+	if data[0] == '/' && spaceInd != -1 {
+		req.Topic = string(data[:spaceInd])
+		payload, ok, err := binaryPayload(data[spaceInd+1:])
+		if ok {
+			req.Data = payload
+			return req, err
+		}
+		s, ok := schemas[req.Topic]
+		if ok {
+			d, err := schema.EncodeStringForSchema(string(data[spaceInd+1:]), s)
+			if err != nil {
+				return req, err
+			}
+			req.Data = d
+		} else {
+			req.Data = data[spaceInd+1:]
+		}
+	} else {
+		payload, ok, err := binaryPayload(data)
+		if ok {
+			req.Data = payload
+			return req, err
+		}
+		req.Data = data[:]
+	}
+	return req, nil
+}
+
+// parseTopicsCommand parses the arguments to "topics", which are an optional
+// prefix, followed by optional "limit <n>" and "after <topic>" clauses
+func parseTopicsCommand(args string) (proto.ListTopicsRequest, error) {
+	req := proto.ListTopicsRequest{}
+
+	fields := strings.Fields(args)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "/") {
+		req.Prefix = fields[0]
+		fields = fields[1:]
+	}
+
+	for len(fields) > 0 {
+		if len(fields) < 2 {
+			return req, fmt.Errorf("malformed topics request: expected a value after %s", fields[0])
+		}
+
+		switch strings.ToLower(fields[0]) {
+		case "limit":
+			limit, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return req, fmt.Errorf("malformed topics request: invalid limit %s", fields[1])
+			}
+			req.Limit = uint32(limit)
+		case "after":
+			req.After = fields[1]
+		default:
+			return req, fmt.Errorf("malformed topics request: unexpected %s", fields[0])
+		}
+		fields = fields[2:]
+	}
+
+	return req, nil
+}
+
+// FormatTopicsCommand returns the "topics" command which sends req
+func FormatTopicsCommand(req proto.ListTopicsRequest) string {
+	cmd := []string{"topics"}
+	if req.Prefix != "" {
+		cmd = append(cmd, req.Prefix)
+	}
+	if req.Limit > 0 {
+		cmd = append(cmd, "limit", strconv.FormatUint(uint64(req.Limit), 10))
+	}
+	if req.After != "" {
+		cmd = append(cmd, "after", req.After)
+	}
+	return strings.Join(cmd, " ")
+}
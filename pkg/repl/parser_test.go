@@ -9,6 +9,8 @@ package repl
 import (
 	"bytes"
 	"github.com/dburkart/fossil/pkg/schema"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/dburkart/fossil/pkg/proto"
@@ -27,6 +29,22 @@ func TestParseREPLCommand(t *testing.T) {
 			t.Fail()
 		}
 	})
+	t.Run("ping", func(t *testing.T) {
+		msg, err := ParseREPLCommand([]byte("ping"), map[string]schema.Object{})
+		if err != nil || msg.Command() != proto.CommandPing {
+			t.Fatalf("expected a ping, got %v, %v", msg, err)
+		}
+		req := proto.PingRequest{}
+		if err = req.Unmarshal(msg.Data()); err != nil || req.Sent.IsZero() {
+			t.Errorf("expected the ping to carry its sent time, got %+v, %v", req, err)
+		}
+	})
+	t.Run("databases", func(t *testing.T) {
+		msg, err := ParseREPLCommand([]byte("databases"), map[string]schema.Object{})
+		if err != nil || msg.Command() != proto.CommandDatabaseStatus {
+			t.Fatalf("expected a database status request, got %v, %v", msg, err)
+		}
+	})
 	t.Run("append no topic", func(t *testing.T) {
 		cmp := proto.NewMessageWithType(proto.CommandAppend, proto.AppendRequest{Topic: "", Data: []byte("a")})
 		msg, err := ParseREPLCommand([]byte("append a"), map[string]schema.Object{})
@@ -66,6 +84,35 @@ func TestParseREPLCommand(t *testing.T) {
 			t.Fail()
 		}
 	})
+	t.Run("append binary", func(t *testing.T) {
+		blob := []byte{0, 1, 2, 0xff, ' ', '\n'}
+		p := filepath.Join(t.TempDir(), "blob")
+		if err := os.WriteFile(p, blob, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// Binary payloads aren't encoded, even for topics with a schema
+		schemas := map[string]schema.Object{"/blobs": &schema.Type{Name: "int32"}}
+		for _, input := range []string{"append /blobs @file:" + p, "append /blobs base64:AAEC/yAK", "append base64:AAEC/yAK"} {
+			msg, err := ParseREPLCommand([]byte(input), schemas)
+			if err != nil {
+				t.Fatalf("%s: %s", input, err)
+			}
+			req := proto.AppendRequest{}
+			if err = req.Unmarshal(msg.Data()); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(req.Data, blob) {
+				t.Errorf("%s: expected %v, got %v", input, blob, req.Data)
+			}
+		}
+
+		for _, input := range []string{"append /blobs @file:" + p + ".missing", "append /blobs base64:!!"} {
+			if _, err := ParseREPLCommand([]byte(input), schemas); err == nil {
+				t.Errorf("%s: expected an error", input)
+			}
+		}
+	})
 	t.Run("append no args", func(t *testing.T) {
 		_, err := ParseREPLCommand([]byte("append"), map[string]schema.Object{})
 		if err == nil {
@@ -98,4 +145,166 @@ func TestParseREPLCommand(t *testing.T) {
 			t.Fail()
 		}
 	})
+	t.Run("profile", func(t *testing.T) {
+		cmp := proto.NewMessageWithType(proto.CommandQuery, proto.QueryRequest{Query: "all", Profile: true})
+		msg, err := ParseREPLCommand([]byte("profile all"), map[string]schema.Object{})
+		if err != nil {
+			t.Fail()
+		}
+		if msg.Command() != proto.CommandQuery {
+			t.Fail()
+		}
+		if !bytes.Equal(msg.Data(), cmp.Data()) {
+			t.Fail()
+		}
+	})
+	t.Run("topics", func(t *testing.T) {
+		cmp := proto.NewMessageWithType(proto.CommandTopics, proto.ListTopicsRequest{Prefix: "/foo", Limit: 5, After: "/foo/bar"})
+		msg, err := ParseREPLCommand([]byte("topics /foo limit 5 after /foo/bar"), map[string]schema.Object{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Command() != proto.CommandTopics {
+			t.Fail()
+		}
+		if !bytes.Equal(msg.Data(), cmp.Data()) {
+			t.Fail()
+		}
+
+		_, err = ParseREPLCommand([]byte("topics limit"), map[string]schema.Object{})
+		if err == nil {
+			t.Error("expected an error for a limit without a value")
+		}
+	})
+	t.Run("create", func(t *testing.T) {
+		cmp := proto.NewMessageWithType(proto.CommandCreate, proto.CreateTopicRequest{Topic: "/foo", Schema: "int32"})
+		msg, err := ParseREPLCommand([]byte("create topic /foo int32"), map[string]schema.Object{})
+		if err != nil {
+			t.Fail()
+		}
+		if msg.Command() != proto.CommandCreate {
+			t.Fail()
+		}
+		if !bytes.Equal(msg.Data(), cmp.Data()) {
+			t.Fail()
+		}
+	})
+	t.Run("create with codec", func(t *testing.T) {
+		cmp := proto.NewMessageWithType(proto.CommandCreate, proto.CreateTopicRequest{Topic: "/foo", Schema: "{x:int32}", Codec: "json"})
+		msg, err := ParseREPLCommand([]byte("create topic /foo {x:int32} codec json"), map[string]schema.Object{})
+		if err != nil {
+			t.Fail()
+		}
+		if !bytes.Equal(msg.Data(), cmp.Data()) {
+			t.Fail()
+		}
+	})
+	t.Run("create with override", func(t *testing.T) {
+		cmp := proto.NewMessageWithType(proto.CommandCreate, proto.CreateTopicRequest{Topic: "/a/b", Schema: "int32", Codec: "json", Override: true})
+		msg, err := ParseREPLCommand([]byte("create topic /a/b int32 codec json override"), map[string]schema.Object{})
+		if err != nil {
+			t.Fail()
+		}
+		if !bytes.Equal(msg.Data(), cmp.Data()) {
+			t.Fail()
+		}
+	})
+	t.Run("create with encoding", func(t *testing.T) {
+		cmp := proto.NewMessageWithType(proto.CommandCreate, proto.CreateTopicRequest{Topic: "/cpu", Schema: "float64", Codec: "json", Encoding: "gorilla", Override: true})
+		msg, err := ParseREPLCommand([]byte("create topic /cpu float64 codec json encoding gorilla override"), map[string]schema.Object{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg.Data(), cmp.Data()) {
+			t.Errorf("expected %q, got %q", cmp.Data(), msg.Data())
+		}
+	})
+	t.Run("create multi-line", func(t *testing.T) {
+		s := "{\n\t\"x\": int32, # metres\n\t\"y\": int32,\n}"
+		cmp := proto.NewMessageWithType(proto.CommandCreate, proto.CreateTopicRequest{Topic: "/foo", Schema: s, Codec: "json"})
+		msg, err := ParseREPLCommand([]byte("create topic /foo "+s+" codec json"), map[string]schema.Object{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg.Data(), cmp.Data()) {
+			t.Errorf("expected %q, got %q", cmp.Data(), msg.Data())
+		}
+	})
+	t.Run("describe", func(t *testing.T) {
+		cmp := proto.NewMessageWithType(proto.CommandDescribe, proto.DescribeRequest{Topic: "/foo"})
+		for _, line := range []string{"describe /foo", "describe topic /foo"} {
+			msg, err := ParseREPLCommand([]byte(line), map[string]schema.Object{})
+			if err != nil {
+				t.Fail()
+			}
+			if msg.Command() != proto.CommandDescribe {
+				t.Fail()
+			}
+			if !bytes.Equal(msg.Data(), cmp.Data()) {
+				t.Errorf("%s: expected %q, got %q", line, cmp.Data(), msg.Data())
+			}
+		}
+	})
+	t.Run("create schema", func(t *testing.T) {
+		cmp := proto.NewMessageWithType(proto.CommandSchema, proto.CreateSchemaRequest{Name: "point", Schema: `{"x":int32, "y":int32}`})
+		msg, err := ParseREPLCommand([]byte(`create schema point {"x":int32, "y":int32}`), map[string]schema.Object{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Command() != proto.CommandSchema {
+			t.Fail()
+		}
+		if !bytes.Equal(msg.Data(), cmp.Data()) {
+			t.Errorf("expected %q, got %q", cmp.Data(), msg.Data())
+		}
+
+		_, err = ParseREPLCommand([]byte("create schema point"), map[string]schema.Object{})
+		if err == nil {
+			t.Error("expected a schema without a definition to fail")
+		}
+	})
+	t.Run("create template", func(t *testing.T) {
+		cmp := proto.NewMessageWithType(proto.CommandTemplate, proto.CreateTemplateRequest{Pattern: "/devices/*/temp", Schema: "float32"})
+		msg, err := ParseREPLCommand([]byte("create template /devices/*/temp float32"), map[string]schema.Object{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg.Data(), cmp.Data()) || msg.Command() != proto.CommandTemplate {
+			t.Errorf("expected %q, got %s %q", cmp.Data(), msg.Command(), msg.Data())
+		}
+
+		_, err = ParseREPLCommand([]byte("create template /devices/*/temp"), map[string]schema.Object{})
+		if err == nil {
+			t.Error("expected a template without a schema to fail")
+		}
+	})
+	t.Run("dry-run", func(t *testing.T) {
+		i32, _ := schema.Parse("int32")
+		schemas := map[string]schema.Object{"/foo": i32}
+		tests := []struct {
+			input string
+			req   proto.ValidateRequest
+		}{
+			{"append --dry-run /foo 42", proto.ValidateRequest{Topic: "/foo", Data: []byte{42, 0, 0, 0}}},
+			{"validate /foo 42", proto.ValidateRequest{Topic: "/foo", Data: []byte{42, 0, 0, 0}}},
+			{"create --dry-run topic /bar float32 codec json override",
+				proto.ValidateRequest{Topic: "/bar", Schema: "float32", Codec: "json", Override: true, CreateTopic: true}},
+		}
+
+		for _, tc := range tests {
+			cmp := proto.NewMessageWithType(proto.CommandValidate, tc.req)
+			msg, err := ParseREPLCommand([]byte(tc.input), schemas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(msg.Data(), cmp.Data()) || msg.Command() != proto.CommandValidate {
+				t.Errorf("%s: expected %q, got %s %q", tc.input, cmp.Data(), msg.Command(), msg.Data())
+			}
+		}
+
+		_, err := ParseREPLCommand([]byte("query --dry-run all"), schemas)
+		if err == nil {
+			t.Error("expected --dry-run to be rejected by query")
+		}
+	})
 }
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Variables holds the values set with the set command during a REPL session.
+// Names are stored without their leading '$'.
+type Variables map[string]string
+
+// Handle runs line if it's a set or unset command, returning whether it was
+// one. A bare set lists the variables which are set.
+//
+// Syntax:
+//
+//	set [$name = value]
+//	unset $name
+func (v Variables) Handle(line string) (bool, error) {
+	cmd, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	rest = strings.TrimSpace(rest)
+
+	switch strings.ToUpper(cmd) {
+	case "SET":
+		if rest == "" {
+			for _, name := range v.names() {
+				fmt.Printf("$%s = %s\n", name, v[name])
+			}
+			return true, nil
+		}
+
+		name, value, found := strings.Cut(rest, "=")
+		if !found {
+			return true, errors.New("malformed set: expected $name = value")
+		}
+		name, err := variableName(strings.TrimSpace(name))
+		if err != nil {
+			return true, err
+		}
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return true, fmt.Errorf("malformed set: expected a value for $%s", name)
+		}
+		v[name] = value
+		return true, nil
+	case "UNSET":
+		name, err := variableName(rest)
+		if err != nil {
+			return true, err
+		}
+		delete(v, name)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Expand replaces each $name in the query, profile or histogram command in
+// line with the variable's value. Other commands, and anything inside a quoted
+// string, are left alone. It is an error to reference a variable which isn't set.
+func (v Variables) Expand(line string) (string, error) {
+	cmd, _, _ := strings.Cut(line, " ")
+	if cmd = strings.ToUpper(cmd); cmd != "QUERY" && cmd != "PROFILE" && !strings.HasPrefix(cmd, "HISTOGRAM(") {
+		return line, nil
+	}
+
+	var expanded strings.Builder
+	var quote rune
+	escaped := false
+	for i := 0; i < len(line); {
+		r, width := utf8.DecodeRuneInString(line[i:])
+		if quote != 0 {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == quote:
+				quote = 0
+			}
+		} else if r == '"' || r == '\'' {
+			quote = r
+		} else if r == '$' {
+			end := i + width
+			for end < len(line) {
+				r, width := utf8.DecodeRuneInString(line[end:])
+				if !isVariableRune(r) {
+					break
+				}
+				end += width
+			}
+
+			name := line[i+1 : end]
+			if name == "" {
+				return "", fmt.Errorf("expected a variable name after '$' at offset %d", i)
+			}
+			value, ok := v[name]
+			if !ok {
+				return "", fmt.Errorf("variable $%s is not set", name)
+			}
+			expanded.WriteString(value)
+			i = end
+			continue
+		}
+
+		expanded.WriteRune(r)
+		i += width
+	}
+
+	return expanded.String(), nil
+}
+
+func (v Variables) names() []string {
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isVariableRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// variableName returns the name of the variable referenced as $name
+func variableName(s string) (string, error) {
+	if !strings.HasPrefix(s, "$") || len(s) == 1 {
+		return "", fmt.Errorf("malformed variable '%s': expected $name", s)
+	}
+	for _, r := range s[1:] {
+		if !isVariableRune(r) {
+			return "", fmt.Errorf("malformed variable '%s': names may only contain letters, digits and '_'", s)
+		}
+	}
+	return s[1:], nil
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package repl
+
+import "testing"
+
+func TestVariables(t *testing.T) {
+	vars := Variables{}
+
+	for _, line := range []string{"set $start = ~(2023-01-01)", "SET $topic=/sensors", "set $gone = 1", "unset $gone"} {
+		handled, err := vars.Handle(line)
+		if !handled || err != nil {
+			t.Fatalf("Handle(%q): expected handled without error, got %v, %v", line, handled, err)
+		}
+	}
+
+	if handled, _ := vars.Handle("query all"); handled {
+		t.Error("expected a query not to be handled")
+	}
+
+	for _, line := range []string{"set $start", "set start = 1", "set $x =", "unset", "set $a-b = 1"} {
+		if _, err := vars.Handle(line); err == nil {
+			t.Errorf("Handle(%q): expected an error", line)
+		}
+	}
+
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"query all in $topic since $start", "query all in /sensors since ~(2023-01-01)"},
+		{"PROFILE all in $topic", "PROFILE all in /sensors"},
+		{"histogram(@hour) all in $topic", "histogram(@hour) all in /sensors"},
+		{`query all | filter x -> x == "$topic"`, `query all | filter x -> x == "$topic"`},
+		{`query all | filter x -> x == 'it\'s $topic' in $topic`, `query all | filter x -> x == 'it\'s $topic' in /sensors`},
+		{"append /foo $topic", "append /foo $topic"},
+	}
+
+	for _, tc := range testCases {
+		actual, err := vars.Expand(tc.input)
+		if err != nil {
+			t.Errorf("Expand(%q): %s", tc.input, err)
+		} else if actual != tc.expected {
+			t.Errorf("Expand(%q): expected %q, got %q", tc.input, tc.expected, actual)
+		}
+	}
+
+	for _, line := range []string{"query all in $gone", "query all in $"} {
+		if _, err := vars.Expand(line); err == nil {
+			t.Errorf("Expand(%q): expected an error", line)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+//go:build grpc
+
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Enabled reports whether fossil was built with gRPC support
+const Enabled = true
+
+// Serve listens for gRPC connections on port, serving svc until an error
+// occurs
+func Serve(port int, svc *Service) error {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+
+	return newServer(svc).Serve(lis)
+}
+
+// newServer returns a gRPC server with svc registered on it
+func newServer(svc *Service) *grpc.Server {
+	s := grpc.NewServer(grpc.ForceServerCodec(codec{}))
+	s.RegisterService(&serviceDesc, svc)
+	return s
+}
+
+// codec marshals our hand-written messages using the standard protobuf
+// content-subtype, so that clients generated from fossil.proto interoperate.
+type codec struct{}
+
+func (codec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(Message)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	return m.Marshal()
+}
+
+func (codec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(Message)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal into %T", v)
+	}
+	return m.Unmarshal(data)
+}
+
+func (codec) Name() string { return "proto" }
+
+// peerAddr returns the address of the client making the call in ctx
+func peerAddr(ctx context.Context) net.Addr {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return p.Addr
+}
+
+// statusError converts errors returned by Service into gRPC status errors
+func statusError(err error) error {
+	var e Error
+	if !errors.As(err, &e) {
+		return err
+	}
+
+	code := codes.Internal
+	switch e.Code {
+	case 403:
+		code = codes.PermissionDenied
+	case 404:
+		code = codes.NotFound
+	case 503, 504, 508:
+		code = codes.InvalidArgument
+	}
+
+	return status.Error(code, e.Message)
+}
+
+type fossilServer interface {
+	Append(context.Context, *AppendRequest) (*AppendResponse, error)
+	Query(context.Context, *QueryRequest, func(*Entry) error) error
+	CreateTopic(context.Context, *CreateTopicRequest) (*CreateTopicResponse, error)
+	List(context.Context, *ListRequest) (*ListResponse, error)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "fossil.v1.Fossil",
+	HandlerType: (*fossilServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Append",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+				req := new(AppendRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req any) (any, error) {
+					resp, err := srv.(fossilServer).Append(ctx, req.(*AppendRequest))
+					return resp, statusError(err)
+				}
+				if interceptor == nil {
+					return handler(ctx, req)
+				}
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/fossil.v1.Fossil/Append"}, handler)
+			},
+		},
+		{
+			MethodName: "CreateTopic",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+				req := new(CreateTopicRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req any) (any, error) {
+					resp, err := srv.(fossilServer).CreateTopic(ctx, req.(*CreateTopicRequest))
+					return resp, statusError(err)
+				}
+				if interceptor == nil {
+					return handler(ctx, req)
+				}
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/fossil.v1.Fossil/CreateTopic"}, handler)
+			},
+		},
+		{
+			MethodName: "List",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+				req := new(ListRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req any) (any, error) {
+					resp, err := srv.(fossilServer).List(ctx, req.(*ListRequest))
+					return resp, statusError(err)
+				}
+				if interceptor == nil {
+					return handler(ctx, req)
+				}
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/fossil.v1.Fossil/List"}, handler)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Query",
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				req := new(QueryRequest)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				err := srv.(fossilServer).Query(stream.Context(), req, func(e *Entry) error {
+					return stream.SendMsg(e)
+				})
+				return statusError(err)
+			},
+		},
+	},
+	Metadata: "fossil.proto",
+}
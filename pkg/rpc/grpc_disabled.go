@@ -0,0 +1,29 @@
+//go:build !grpc
+
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Enabled reports whether fossil was built with gRPC support
+const Enabled = false
+
+// peerAddr returns nil, since without gRPC support there are no calls to
+// have come from a client
+func peerAddr(_ context.Context) net.Addr {
+	return nil
+}
+
+// Serve always fails, since fossil was built without gRPC support
+func Serve(_ int, _ *Service) error {
+	return errors.New("fossil was built without gRPC support, rebuild with -tags grpc")
+}
@@ -0,0 +1,176 @@
+//go:build grpc
+
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// dial serves svc on a local port for the duration of the test, returning a
+// connection to it
+func dial(t *testing.T, svc *Service) *grpc.ClientConn {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(svc)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// query runs q over conn, returning the entries streamed back
+func query(ctx context.Context, conn *grpc.ClientConn, q string) ([]*Entry, error) {
+	stream, err := conn.NewStream(ctx, &serviceDesc.Streams[0], "/fossil.v1.Fossil/Query")
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&QueryRequest{Query: q}); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for {
+		e := new(Entry)
+		err := stream.RecvMsg(e)
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	db, err := database.NewDatabaseWithConfig("default", filepath.Join(t.TempDir(), "default"), database.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dial(t, NewService(map[string]*database.Database{"default": db}, nil))
+	ctx := context.Background()
+
+	err = conn.Invoke(ctx, "/fossil.v1.Fossil/CreateTopic", &CreateTopicRequest{Topic: "/temp", Schema: "int32", Codec: "json"}, new(CreateTopicResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appended := new(AppendResponse)
+	err = conn.Invoke(ctx, "/fossil.v1.Fossil/Append", &AppendRequest{Topic: "/temp", Data: []byte("42")}, appended)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := query(ctx, conn, "all in /temp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || !reflect.DeepEqual(entries[0].Data, []byte{42, 0, 0, 0}) {
+		t.Errorf("expected a single entry holding 42, got %+v", entries)
+	}
+	if len(entries) == 1 && entries[0].Sequence != appended.Sequence {
+		t.Errorf("expected the streamed entry to have sequence %d, got %d", appended.Sequence, entries[0].Sequence)
+	}
+
+	err = conn.Invoke(ctx, "/fossil.v1.Fossil/List", &ListRequest{Database: "missing", Object: "topics"}, new(ListResponse))
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected listing a missing database to fail with NotFound, got %v", err)
+	}
+}
+
+func TestGRPCTopicACL(t *testing.T) {
+	db, err := database.NewDatabaseWithConfig("default", filepath.Join(t.TempDir(), "default"), database.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients, err := proto.ParseClients([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(map[string]*database.Database{"default": db}, proto.TopicACLs{{Name: "local", Clients: clients, Deny: []string{"/secret"}}})
+
+	// Calls made without a client aren't restricted, so set the topics up
+	// directly
+	ctx := context.Background()
+	for _, topic := range []string{"/secret", "/public"} {
+		_, err = svc.CreateTopic(ctx, &CreateTopicRequest{Topic: topic, Schema: "int32", Codec: "json"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = svc.Append(ctx, &AppendRequest{Topic: topic, Data: []byte("1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn := dial(t, svc)
+
+	err = conn.Invoke(ctx, "/fossil.v1.Fossil/Append", &AppendRequest{Topic: "/secret", Data: []byte("2")}, new(AppendResponse))
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected appending to a denied topic to fail with PermissionDenied, got %v", err)
+	}
+
+	err = conn.Invoke(ctx, "/fossil.v1.Fossil/CreateTopic", &CreateTopicRequest{Topic: "/secret/child", Schema: "int32"}, new(CreateTopicResponse))
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected creating a denied topic to fail with PermissionDenied, got %v", err)
+	}
+
+	_, err = query(ctx, conn, "all in /secret")
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected querying a denied topic to fail with PermissionDenied, got %v", err)
+	}
+
+	entries, err := query(ctx, conn, "all in /public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected a permitted topic to be queryable, got %+v", entries)
+	}
+
+	list := new(ListResponse)
+	err = conn.Invoke(ctx, "/fossil.v1.Fossil/List", &ListRequest{Object: "topics"}, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range list.Objects {
+		if topic == "/secret" {
+			t.Errorf("expected denied topics to be left out of the list, got %v", list.Objects)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package rpc
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages below are hand-written equivalents of those in fossil.proto,
+// encoded with protowire so that we don't need generated code.
+
+type (
+	AppendRequest struct {
+		Database string
+		Topic    string
+		Data     []byte
+	}
+
+	AppendResponse struct {
+		TimeUnixNano int64
+		Sequence     uint64
+		Duplicate    bool
+	}
+
+	QueryRequest struct {
+		Database string
+		Query    string
+	}
+
+	Entry struct {
+		TimeUnixNano int64
+		Topic        string
+		Schema       string
+		Data         []byte
+		Sequence     uint64
+	}
+
+	CreateTopicRequest struct {
+		Database string
+		Topic    string
+		Schema   string
+		Codec    string
+		Override bool
+		Encoding string
+	}
+
+	CreateTopicResponse struct{}
+
+	ListRequest struct {
+		Database string
+		Object   string
+	}
+
+	ListResponse struct {
+		Objects []string
+	}
+)
+
+// Message is implemented by every message in fossil.proto
+type Message interface {
+	Marshal() ([]byte, error)
+	Unmarshal([]byte) error
+}
+
+// fieldFunc consumes the value of field num from b, returning the number of
+// bytes consumed, or a negative number on error (see protowire.ParseError).
+type fieldFunc func(num protowire.Number, typ protowire.Type, b []byte) int
+
+// unmarshalFields walks the fields in b, handing each to fn. Fields fn
+// doesn't consume are skipped.
+func unmarshalFields(b []byte, fn fieldFunc) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n = fn(num, typ, b)
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeString(typ protowire.Type, b []byte, s *string) int {
+	if typ != protowire.BytesType {
+		return 0
+	}
+	v, n := protowire.ConsumeString(b)
+	if n >= 0 {
+		*s = v
+	}
+	return n
+}
+
+func consumeBytes(typ protowire.Type, b []byte, out *[]byte) int {
+	if typ != protowire.BytesType {
+		return 0
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n >= 0 {
+		*out = append([]byte{}, v...)
+	}
+	return n
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func consumeBool(typ protowire.Type, b []byte, out *bool) int {
+	if typ != protowire.VarintType {
+		return 0
+	}
+	v, n := protowire.ConsumeVarint(b)
+	if n >= 0 {
+		*out = protowire.DecodeBool(v)
+	}
+	return n
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeBool(v))
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// AppendRequest
+//-------------------------
+
+func (m AppendRequest) Marshal() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, m.Database)
+	b = appendString(b, 2, m.Topic)
+	b = appendBytes(b, 3, m.Data)
+	return b, nil
+}
+
+func (m *AppendRequest) Unmarshal(b []byte) error {
+	*m = AppendRequest{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Database)
+		case 2:
+			return consumeString(typ, b, &m.Topic)
+		case 3:
+			return consumeBytes(typ, b, &m.Data)
+		}
+		return 0
+	})
+}
+
+// AppendResponse
+//-------------------------
+
+func (m AppendResponse) Marshal() ([]byte, error) {
+	var b []byte
+	if m.TimeUnixNano != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.TimeUnixNano))
+	}
+	if m.Sequence != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Sequence)
+	}
+	b = appendBool(b, 3, m.Duplicate)
+	return b, nil
+}
+
+func (m *AppendResponse) Unmarshal(b []byte) error {
+	*m = AppendResponse{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			if typ != protowire.VarintType {
+				return 0
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n >= 0 {
+				m.TimeUnixNano = int64(v)
+			}
+			return n
+		case 2:
+			if typ != protowire.VarintType {
+				return 0
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n >= 0 {
+				m.Sequence = v
+			}
+			return n
+		case 3:
+			return consumeBool(typ, b, &m.Duplicate)
+		}
+		return 0
+	})
+}
+
+// QueryRequest
+//-------------------------
+
+func (m QueryRequest) Marshal() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, m.Database)
+	b = appendString(b, 2, m.Query)
+	return b, nil
+}
+
+func (m *QueryRequest) Unmarshal(b []byte) error {
+	*m = QueryRequest{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Database)
+		case 2:
+			return consumeString(typ, b, &m.Query)
+		}
+		return 0
+	})
+}
+
+// Entry
+//-------------------------
+
+func (m Entry) Marshal() ([]byte, error) {
+	var b []byte
+	if m.TimeUnixNano != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.TimeUnixNano))
+	}
+	b = appendString(b, 2, m.Topic)
+	b = appendString(b, 3, m.Schema)
+	b = appendBytes(b, 4, m.Data)
+	if m.Sequence != 0 {
+		b = protowire.AppendTag(b, 5, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Sequence)
+	}
+	return b, nil
+}
+
+func (m *Entry) Unmarshal(b []byte) error {
+	*m = Entry{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			if typ != protowire.VarintType {
+				return 0
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n >= 0 {
+				m.TimeUnixNano = int64(v)
+			}
+			return n
+		case 2:
+			return consumeString(typ, b, &m.Topic)
+		case 3:
+			return consumeString(typ, b, &m.Schema)
+		case 4:
+			return consumeBytes(typ, b, &m.Data)
+		case 5:
+			if typ != protowire.VarintType {
+				return 0
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n >= 0 {
+				m.Sequence = v
+			}
+			return n
+		}
+		return 0
+	})
+}
+
+// CreateTopicRequest
+//-------------------------
+
+func (m CreateTopicRequest) Marshal() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, m.Database)
+	b = appendString(b, 2, m.Topic)
+	b = appendString(b, 3, m.Schema)
+	b = appendString(b, 4, m.Codec)
+	b = appendBool(b, 5, m.Override)
+	b = appendString(b, 6, m.Encoding)
+	return b, nil
+}
+
+func (m *CreateTopicRequest) Unmarshal(b []byte) error {
+	*m = CreateTopicRequest{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Database)
+		case 2:
+			return consumeString(typ, b, &m.Topic)
+		case 3:
+			return consumeString(typ, b, &m.Schema)
+		case 4:
+			return consumeString(typ, b, &m.Codec)
+		case 5:
+			return consumeBool(typ, b, &m.Override)
+		case 6:
+			return consumeString(typ, b, &m.Encoding)
+		}
+		return 0
+	})
+}
+
+// CreateTopicResponse
+//-------------------------
+
+func (m CreateTopicResponse) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (m *CreateTopicResponse) Unmarshal(b []byte) error {
+	return unmarshalFields(b, func(protowire.Number, protowire.Type, []byte) int { return 0 })
+}
+
+// ListRequest
+//-------------------------
+
+func (m ListRequest) Marshal() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, m.Database)
+	b = appendString(b, 2, m.Object)
+	return b, nil
+}
+
+func (m *ListRequest) Unmarshal(b []byte) error {
+	*m = ListRequest{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Database)
+		case 2:
+			return consumeString(typ, b, &m.Object)
+		}
+		return 0
+	})
+}
+
+// ListResponse
+//-------------------------
+
+func (m ListResponse) Marshal() ([]byte, error) {
+	var b []byte
+	for _, o := range m.Objects {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, o)
+	}
+	return b, nil
+}
+
+func (m *ListResponse) Unmarshal(b []byte) error {
+	*m = ListResponse{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num != 1 {
+			return 0
+		}
+		var o string
+		n := consumeString(typ, b, &o)
+		if n > 0 {
+			m.Objects = append(m.Objects, o)
+		}
+		return n
+	})
+}
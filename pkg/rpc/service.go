@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+// Package rpc implements the Fossil service described in fossil.proto on top
+// of the same handlers used by the line protocol server.
+package rpc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/query/plan"
+	"github.com/dburkart/fossil/pkg/server"
+)
+
+// Error is returned when a handler responds with an ERR message. Code is the
+// line protocol's error code.
+type Error struct {
+	Code    uint32
+	Message string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
+
+type Service struct {
+	dbMap map[string]*database.Database
+	acls  proto.TopicACLs
+}
+
+// NewService returns a Service for the databases in dbMap, restricting each
+// client by the first of acls which applies to it, as the line protocol does
+func NewService(dbMap map[string]*database.Database, acls proto.TopicACLs) *Service {
+	return &Service{dbMap: dbMap, acls: acls}
+}
+
+// acl returns the ACL restricting the client making the call in ctx
+func (s *Service) acl(ctx context.Context) *proto.TopicACL {
+	return s.acls.For(peerAddr(ctx))
+}
+
+func errTopicDenied(topic string) error {
+	return Error{Code: 403, Message: fmt.Sprintf("%s to topic %s", plan.ErrTopicDenied, topic)}
+}
+
+func (s *Service) database(name string) (*database.Database, error) {
+	if name == "" {
+		name = "default"
+	}
+
+	db, ok := s.dbMap[name]
+	if !ok {
+		return nil, Error{Code: 404, Message: fmt.Sprintf("database '%s' not found", name)}
+	}
+	return db, nil
+}
+
+// unmarshalResponse unmarshals msg into t, or returns an Error if msg is an
+// ERR message
+func unmarshalResponse(msg proto.Message, t proto.Unmarshaler) error {
+	if msg.Command() == proto.CommandError {
+		e := proto.ErrResponse{}
+		err := e.Unmarshal(msg.Data())
+		if err != nil {
+			return err
+		}
+		message := ""
+		if e.Err != nil {
+			message = e.Err.Error()
+		}
+		return Error{Code: e.Code, Message: message}
+	}
+
+	if t == nil {
+		return nil
+	}
+	return t.Unmarshal(msg.Data())
+}
+
+func (s *Service) Append(ctx context.Context, req *AppendRequest) (*AppendResponse, error) {
+	db, err := s.database(req.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.acl(ctx).Permits(req.Topic) {
+		return nil, errTopicDenied(req.Topic)
+	}
+
+	// gRPC appends never ask to create their topic, so in strict mode only
+	// topics which exist may be appended to, whatever MayCreateTopics says
+	ack := proto.AppendResponse{}
+	msg := server.AppendResponse(proto.AppendRequest{Topic: req.Topic, Data: req.Data, Ack: true}, db)
+	err = unmarshalResponse(msg, &ack)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AppendResponse{TimeUnixNano: ack.Time.UnixNano(), Sequence: ack.Sequence, Duplicate: ack.Code == 208}, nil
+}
+
+// Query runs req, handing each resulting entry to send. Sending stops at the
+// first error.
+func (s *Service) Query(ctx context.Context, req *QueryRequest, send func(*Entry) error) error {
+	db, err := s.database(req.Database)
+	if err != nil {
+		return err
+	}
+
+	resp := proto.QueryResponse{}
+	err = unmarshalResponse(server.RestrictedQueryResponse(proto.QueryRequest{Query: req.Query, Sequences: true}, db, s.acl(ctx)), &resp)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range resp.Results {
+		err = send(&Entry{
+			TimeUnixNano: e.Time.UnixNano(),
+			Topic:        e.Topic,
+			Schema:       e.Schema,
+			Data:         e.Data,
+			Sequence:     e.Sequence,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) CreateTopic(ctx context.Context, req *CreateTopicRequest) (*CreateTopicResponse, error) {
+	db, err := s.database(req.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.acl(ctx).Permits(req.Topic) {
+		return nil, errTopicDenied(req.Topic)
+	}
+
+	schema := req.Schema
+	if schema == "" {
+		schema = "string"
+	}
+
+	msg := server.CreateResponse(proto.CreateTopicRequest{Topic: req.Topic, Schema: schema, Codec: req.Codec, Encoding: req.Encoding, Override: req.Override}, db)
+	err = unmarshalResponse(msg, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CreateTopicResponse{}, nil
+}
+
+func (s *Service) List(ctx context.Context, req *ListRequest) (*ListResponse, error) {
+	db, err := s.database(req.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := proto.ListResponse{}
+	err = unmarshalResponse(server.ListResponse(proto.ListRequest{Object: req.Object}, db, s.dbMap, s.acl(ctx)), &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ListResponse{Objects: resp.ObjectList}, nil
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dburkart/fossil/pkg/database"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	messages := []Message{
+		&AppendRequest{Database: "default", Topic: "/foo", Data: []byte{1, 2, 3}},
+		&AppendResponse{TimeUnixNano: 1672531200000000000, Sequence: 7, Duplicate: true},
+		&QueryRequest{Query: "all in /foo"},
+		&Entry{TimeUnixNano: 1672531200000000000, Topic: "/foo", Schema: "int32", Data: []byte{0, 1, 0, 0}},
+		&CreateTopicRequest{Topic: "/foo", Schema: "{x:int32}", Codec: "json"},
+		&CreateTopicRequest{Topic: "/foo/bar", Schema: "float64", Override: true},
+		&ListRequest{Database: "other", Object: "topics"},
+		&ListResponse{Objects: []string{"/", "/foo"}},
+	}
+
+	for _, m := range messages {
+		b, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual := reflect.New(reflect.TypeOf(m).Elem()).Interface().(Message)
+		err = actual.Unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(m, actual) {
+			t.Errorf("expected %+v, got %+v", m, actual)
+		}
+	}
+}
+
+func TestService(t *testing.T) {
+	db, err := database.NewDatabaseWithConfig("default", filepath.Join(t.TempDir(), "default"), database.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := NewService(map[string]*database.Database{"default": db}, nil)
+	ctx := context.Background()
+
+	_, err = svc.CreateTopic(ctx, &CreateTopicRequest{Topic: "/temp", Schema: "int32", Codec: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appended, err := svc.Append(ctx, &AppendRequest{Topic: "/temp", Data: []byte("42")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = svc.Append(ctx, &AppendRequest{Topic: "/temp", Data: []byte(`"hot"`)})
+	if err == nil {
+		t.Error("expected appending non-conforming data to fail")
+	}
+
+	var entries []*Entry
+	err = svc.Query(ctx, &QueryRequest{Query: "all in /temp"}, func(e *Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || !reflect.DeepEqual(entries[0].Data, []byte{42, 0, 0, 0}) {
+		t.Errorf("expected a single entry holding 42, got %+v", entries)
+	}
+	if len(entries) == 1 && (entries[0].TimeUnixNano != appended.TimeUnixNano || entries[0].Sequence != appended.Sequence) {
+		t.Errorf("expected the append to be acknowledged with its entry's time and sequence, got %+v", appended)
+	}
+
+	list, err := svc.List(ctx, &ListRequest{Object: "topics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Objects) != 2 {
+		t.Errorf("expected 2 topics, got %v", list.Objects)
+	}
+
+	_, err = svc.List(ctx, &ListRequest{Database: "missing", Object: "topics"})
+	var rpcErr Error
+	if !errors.As(err, &rpcErr) || rpcErr.Code != 404 {
+		t.Errorf("expected a 404 for a missing database, got %v", err)
+	}
+}
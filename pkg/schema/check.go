@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package schema
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Check is like Validate, but returns an error explaining why val doesn't
+// conform to s. Each field of a composite is checked, and every field which
+// doesn't conform is reported along with its key.
+func Check(s Object, val []byte) error {
+	switch t := s.(type) {
+	case *Type:
+		return checkType(*t, val)
+	case Type:
+		return checkType(t, val)
+	case *Array:
+		if t.Type.Name == "string" || t.Type.Name == "binary" {
+			return fmt.Errorf("invalid type found in array: %s", t.Type.Name)
+		}
+		if len(val) != t.Size() {
+			return fmt.Errorf("expected %d bytes for %s, got %d", t.Size(), t.ToSchema(), len(val))
+		}
+		return nil
+	case *Enum:
+		if len(val) != 1 {
+			return fmt.Errorf("expected 1 byte for %s, got %d", t.ToSchema(), len(val))
+		}
+		if int(val[0]) >= len(t.Values) {
+			return fmt.Errorf("%d is not the index of one of %s", val[0], t.ToSchema())
+		}
+		return nil
+	case *Composite:
+		fields, err := t.Fields(val)
+		if err != nil {
+			return err
+		}
+		var errs []error
+		for i, field := range fields {
+			// Absent optional keys have nothing to check
+			if field == nil && t.Optional[t.Keys[i]] {
+				continue
+			}
+			if err := Check(t.Values[i], field); err != nil {
+				errs = append(errs, fmt.Errorf("key '%s': %w", t.Keys[i], err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	if !s.Validate(val) {
+		return fmt.Errorf("value does not conform to %s", s.ToSchema())
+	}
+	return nil
+}
+
+func checkType(t Type, val []byte) error {
+	if t.Name == "string" || t.Name == "binary" {
+		return nil
+	}
+	if !t.Validate(val) {
+		return fmt.Errorf("expected %d bytes for %s, got %d", t.Size(), t.Name, len(val))
+	}
+	return nil
+}
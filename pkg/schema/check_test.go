@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package schema
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	obj, err := Parse(`{"level": enum("ok", "crit"), "value": int32, "note": string?}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := EncodeStringForSchema(`"level": crit, "value": 12`, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(obj, b); err != nil {
+		t.Errorf("expected %v to conform, got %s", b, err)
+	}
+
+	// Each field which doesn't conform is named
+	b[0] = 7
+	err = Check(obj, b)
+	if err == nil || !strings.Contains(err.Error(), "key 'level'") {
+		t.Errorf("expected an error naming the level key, got %v", err)
+	}
+
+	err = Check(obj, b[:3])
+	if err == nil || !strings.Contains(err.Error(), "before key 'value'") {
+		t.Errorf("expected an error naming the value key, got %v", err)
+	}
+
+	i64, _ := Parse("int64")
+	err = Check(i64, []byte{1, 2, 3, 4})
+	if err == nil || err.Error() != "expected 8 bytes for int64, got 4" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	s, _ := Parse("string")
+	if err := Check(s, []byte("anything")); err != nil {
+		t.Errorf("expected any string to conform, got %s", err)
+	}
+}
@@ -11,9 +11,11 @@ import (
 	"errors"
 	"fmt"
 	"math"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/common/parse"
 )
 
 type SchemaType interface {
@@ -61,6 +63,13 @@ func EncodeType[T SchemaType](v T) ([]byte, error) {
 }
 
 func DecodeStringForSchema(input []byte, s Object) (string, error) {
+	switch t := s.(type) {
+	case *Type, *Array:
+		if !t.Validate(input) {
+			return "", fmt.Errorf("invalid value for %s", t.ToSchema())
+		}
+	}
+
 	switch t := s.(type) {
 	case *Type:
 		switch t.Name {
@@ -91,7 +100,13 @@ func DecodeStringForSchema(input []byte, s Object) (string, error) {
 			return fmt.Sprintf("%f", math.Float32frombits(binary.LittleEndian.Uint32(input))), nil
 		case "float64":
 			return fmt.Sprintf("%f", math.Float64frombits(binary.LittleEndian.Uint64(input))), nil
+		case "timestamp":
+			return time.Unix(0, int64(binary.LittleEndian.Uint64(input))).UTC().Format(time.RFC3339Nano), nil
+		case "duration":
+			return time.Duration(binary.LittleEndian.Uint64(input)).String(), nil
 		}
+	case *Enum:
+		return t.Name(input)
 	case *Array:
 		var output string
 
@@ -109,45 +124,22 @@ func DecodeStringForSchema(input []byte, s Object) (string, error) {
 
 		return output, nil
 	case *Composite:
-		index := 0
-		var pairs []string
+		fields, err := t.Fields(input)
+		if err != nil {
+			return "", err
+		}
 
+		var pairs []string
 		for i, key := range t.Keys {
-			var err error
-			var size int
-			obj := t.Values[i]
-			var repr string
-
-			switch tt := obj.(type) {
-			case *Type:
-				switch tt.Name {
-				case "string":
-					size = int(binary.LittleEndian.Uint32(input[index : index+4]))
-					index += 4
-					repr = string(input[index : index+size])
-				case "binary":
-					size = int(binary.LittleEndian.Uint32(input[index : index+4]))
-					index += 4
-					repr, err = DecodeStringForSchema(input[index:index+size], obj)
-					if err != nil {
-						return "", err
-					}
-				default:
-					size = tt.Size()
-					repr, err = DecodeStringForSchema(input[index:index+size], obj)
-					if err != nil {
-						return "", err
-					}
-				}
-			case *Array:
-				size = tt.Size()
-				repr, err = DecodeStringForSchema(input[index:index+size], obj)
-				if err != nil {
-					return "", err
-				}
+			// Leave out optional keys which are absent
+			if fields[i] == nil {
+				continue
 			}
 
-			index += size
+			repr, err := DecodeStringForSchema(fields[i], t.Values[i])
+			if err != nil {
+				return "", err
+			}
 			pairs = append(pairs, fmt.Sprintf("%s: %s", key, repr))
 		}
 
@@ -225,7 +217,29 @@ func EncodeStringForSchema(input string, s Object) ([]byte, error) {
 				return nil, err
 			}
 			return EncodeType(f)
+		case "timestamp":
+			t, err := time.Parse(time.RFC3339Nano, input)
+			if err != nil {
+				return nil, err
+			}
+			return EncodeType(t.UnixNano())
+		case "duration":
+			d, err := time.ParseDuration(input)
+			if err != nil {
+				return nil, err
+			}
+			return EncodeType(int64(d))
+		}
+	case *Enum:
+		name, err := parse.Unquote(input)
+		if err != nil {
+			name = input
+		}
+		i, ok := t.Index(name)
+		if !ok {
+			return nil, fmt.Errorf("'%s' is not one of %s", name, t.ToSchema())
 		}
+		return []byte{byte(i)}, nil
 	case *Array:
 		var array []string
 		array = strings.Split(input, ",")
@@ -244,9 +258,11 @@ func EncodeStringForSchema(input string, s Object) ([]byte, error) {
 
 		return formatted, nil
 	case *Composite:
-		var keys []string
 		c := map[string]string{}
-		pairs := strings.Split(input, ",")
+		var pairs []string
+		if strings.TrimSpace(input) != "" {
+			pairs = strings.Split(input, ",")
+		}
 
 		for _, p := range pairs {
 			pair := strings.Split(p, ":")
@@ -256,52 +272,44 @@ func EncodeStringForSchema(input string, s Object) ([]byte, error) {
 			}
 
 			s := strings.Trim(pair[0], " \t\n")
-			key, err := strconv.Unquote(s)
+			key, err := parse.Unquote(s)
 			if err != nil {
 				key = s
 			}
+			if _, ok := t.SchemaForKey(key).(Unknown); ok {
+				return nil, fmt.Errorf("unknown key '%s'", key)
+			}
 			value := strings.Trim(pair[1], " \t\n")
 			c[key] = value
-			keys = append(keys, key)
 		}
 
-		sort.Strings(keys)
-
-		for i, key := range keys {
+		for i, key := range t.Keys {
 			obj := t.Values[i]
 
-			switch tt := obj.(type) {
-			case *Type:
-				switch tt.Name {
-				case "string":
-					formatted = append(formatted, binary.LittleEndian.AppendUint32([]byte{}, uint32(len(c[key])))...)
-					b, err := EncodeStringForSchema(c[key], tt)
-					if err != nil {
-						return nil, err
-					}
-					formatted = append(formatted, b...)
-				case "binary":
-					formatted = append(formatted, binary.LittleEndian.AppendUint32([]byte{}, uint32(len(c[key])))...)
-					b, err := EncodeStringForSchema(c[key], tt)
-					if err != nil {
-						return nil, err
-					}
-					formatted = append(formatted, b...)
-				default:
-					b, err := EncodeStringForSchema(c[key], tt)
-					if err != nil {
-						return nil, err
-					}
-					formatted = append(formatted, b...)
+			value, ok := c[key]
+			if !ok {
+				if d, hasDefault := t.Defaults[key]; hasDefault {
+					value = d
+				} else if t.Optional[key] {
+					formatted = append(formatted, 0)
+					continue
+				} else {
+					return nil, fmt.Errorf("missing value for key '%s'", key)
 				}
+			} else if t.Optional[key] {
+				formatted = append(formatted, 1)
+			}
 
-			case *Array:
-				b, err := EncodeStringForSchema(c[key], tt)
-				if err != nil {
-					return nil, err
-				}
-				formatted = append(formatted, b...)
+			b, err := EncodeStringForSchema(value, obj)
+			if err != nil {
+				return nil, err
+			}
+
+			// Variable length values are prefixed by their length
+			if tt, ok := obj.(*Type); ok && (tt.Name == "string" || tt.Name == "binary") {
+				formatted = binary.LittleEndian.AppendUint32(formatted, uint32(len(b)))
 			}
+			formatted = append(formatted, b...)
 		}
 	}
 
@@ -0,0 +1,40 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package schema
+
+import (
+	"testing"
+)
+
+// FuzzParse parses arbitrary schemas, and decodes arbitrary data with those
+// which parse. A schema which parses must parse again from its ToSchema.
+func FuzzParse(f *testing.F) {
+	for _, s := range []string{
+		"string",
+		"int32",
+		"[4]float64",
+		"[99999999999999999999]int8",
+		"timestamp",
+		"{ on, off }",
+		`{"x": int32, "y": [2]uint8, "name"?: string}`,
+		"{\"a\": { x, y }, # comment\n \"b\": binary}",
+	} {
+		f.Add(s, []byte("\x00\x00\x00\x01abcdefgh"))
+	}
+
+	f.Fuzz(func(t *testing.T, s string, data []byte) {
+		obj, err := Parse(s)
+		if err != nil {
+			return
+		}
+		if _, err = Parse(obj.ToSchema()); err != nil {
+			t.Errorf("unable to parse '%s', which '%s' parsed to: %s", obj.ToSchema(), s, err)
+		}
+		obj.Validate(data)
+		DecodeStringForSchema(data, obj)
+	})
+}
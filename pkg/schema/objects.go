@@ -7,7 +7,11 @@
 package schema
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 type Object interface {
@@ -28,9 +32,21 @@ type (
 		Type   Type
 	}
 
+	// Enum is one of a fixed set of names, stored as the uint8 index of the
+	// name in Values
+	Enum struct {
+		Values []string
+	}
+
 	Composite struct {
 		Keys   []string
 		Values []Object
+		// Optional keys may be absent from a value, and are encoded with a
+		// leading byte which is 0 when the key is absent
+		Optional map[string]bool
+		// Defaults holds the value used when encoding a value which is
+		// missing a key
+		Defaults map[string]string
 	}
 )
 
@@ -54,6 +70,8 @@ func (t Type) Size() int {
 		return 4
 	case t.Name == "float64":
 		return 8
+	case t.Name == "timestamp" || t.Name == "duration":
+		return 8
 	case t.Name == "string":
 		return 4
 	case t.Name == "binary":
@@ -92,6 +110,10 @@ func (t Type) Validate(val []byte) bool {
 		if len(val) != 8 {
 			return false
 		}
+	case t.Name == "timestamp" || t.Name == "duration":
+		if len(val) != 8 {
+			return false
+		}
 	}
 
 	return true
@@ -145,28 +167,115 @@ func (a Array) IsNumeric() bool {
 	return false
 }
 
+// MaxEnumValues is the number of values an Enum can hold, since they are
+// stored in a single byte
+const MaxEnumValues = 256
+
+func (e Enum) MarshalJSON() ([]byte, error) {
+	// Enum schemas contain quoted values, so they need escaping
+	return json.Marshal(e.ToSchema())
+}
+
+func (e Enum) Size() int {
+	return 1
+}
+
+// Index returns the index name is stored as, and false if name is not one of
+// the enum's values
+func (e Enum) Index(name string) (int, bool) {
+	for i, v := range e.Values {
+		if v == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Name returns the name stored in val
+func (e Enum) Name(val []byte) (string, error) {
+	if len(val) != 1 || int(val[0]) >= len(e.Values) {
+		return "", fmt.Errorf("invalid value for %s", e.ToSchema())
+	}
+	return e.Values[val[0]], nil
+}
+
+func (e Enum) Validate(val []byte) bool {
+	_, err := e.Name(val)
+	return err == nil
+}
+
+func (e Enum) ToSchema() string {
+	quoted := make([]string, len(e.Values))
+	for i, v := range e.Values {
+		quoted[i] = fmt.Sprintf(`"%s"`, v)
+	}
+	return fmt.Sprintf("enum(%s)", strings.Join(quoted, ","))
+}
+
+func (e Enum) IsNumeric() bool {
+	return false
+}
+
 func (c Composite) Validate(val []byte) bool {
-	var size int
-	hasString := false
-	for _, val := range c.Values {
-		switch t := val.(type) {
+	_, err := c.Fields(val)
+	return err == nil
+}
+
+// Fields splits val into the encoded value of each key, in the same order as
+// Keys. Variable length values have their length prefix removed, and absent
+// optional keys are nil.
+func (c Composite) Fields(val []byte) ([][]byte, error) {
+	fields := make([][]byte, len(c.Keys))
+	index := 0
+
+	for i, key := range c.Keys {
+		if c.Optional[key] {
+			if index >= len(val) {
+				return nil, fmt.Errorf("value ends before key '%s'", key)
+			}
+			present := val[index]
+			index += 1
+			if present == 0 {
+				continue
+			}
+		}
+
+		var size int
+		switch t := c.Values[i].(type) {
 		case *Type:
-			if t.Name == "string" {
-				hasString = true
+			size = t.Size()
+			if t.Name == "string" || t.Name == "binary" {
+				if index+4 > len(val) {
+					return nil, fmt.Errorf("value ends before key '%s'", key)
+				}
+				size = int(binary.LittleEndian.Uint32(val[index : index+4]))
+				index += 4
 			}
-			size += t.Size()
 		case *Array:
-			if t.Type.Name == "string" {
-				hasString = true
-			}
-			size += t.Size()
+			size = t.Size()
+		case *Enum:
+			size = t.Size()
+		default:
+			return nil, fmt.Errorf("unsupported schema %s for key '%s'", c.Values[i].ToSchema(), key)
 		}
+
+		if size < 0 || index+size > len(val) {
+			return nil, fmt.Errorf("value ends before key '%s'", key)
+		}
+		fields[i] = val[index : index+size]
+		index += size
 	}
 
-	if hasString {
-		return len(val) >= size
+	if index != len(val) {
+		return nil, fmt.Errorf("value has %d unexpected trailing bytes", len(val)-index)
 	}
-	return len(val) == size
+
+	return fields, nil
+}
+
+func (c Composite) MarshalJSON() ([]byte, error) {
+	// Composite schemas contain quoted keys, so they need escaping
+	return json.Marshal(c.ToSchema())
 }
 
 func (c Composite) ToSchema() string {
@@ -178,6 +287,20 @@ func (c Composite) ToSchema() string {
 		key := c.Keys[idx]
 		val := c.Values[idx].ToSchema()
 
+		if c.Optional[key] {
+			val += "?"
+		} else if d, ok := c.Defaults[key]; ok {
+			switch t := c.Values[idx].(type) {
+			case *Type:
+				if t.Name == "string" || t.Name == "binary" {
+					d = strconv.Quote(d)
+				}
+			case *Enum:
+				d = strconv.Quote(d)
+			}
+			val += "=" + d
+		}
+
 		schema += fmt.Sprintf(`"%s":%s,`, key, val)
 	}
 
@@ -7,6 +7,7 @@
 package schema
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"testing"
@@ -45,3 +46,70 @@ func TestJSONMarshal(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestComposite_OptionalKeys(t *testing.T) {
+	obj, err := Parse(`{"x": int32 = 5, "note": string?}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Missing keys are filled in with defaults, or left out if optional
+	b, err := EncodeStringForSchema(`"note": hi`, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !obj.Validate(b) {
+		t.Errorf("expected %v to validate", b)
+	}
+
+	decoded, err := DecodeStringForSchema(b, obj)
+	if err != nil || decoded != "note: hi, x: 5" {
+		t.Errorf("unexpected decoding %s, %v", decoded, err)
+	}
+
+	b, err = EncodeStringForSchema("", obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := obj.(*Composite).Fields(b)
+	if err != nil || fields[0] != nil || len(fields[1]) != 4 {
+		t.Errorf("unexpected fields %v, %v", fields, err)
+	}
+
+	if obj.Validate(append(b, 0)) {
+		t.Error("expected trailing bytes to fail validation")
+	}
+
+	required, _ := Parse(`{"x": int32}`)
+	if _, err := EncodeStringForSchema("", required); err == nil {
+		t.Error("expected a missing key without a default to fail to encode")
+	}
+}
+
+func TestEnum(t *testing.T) {
+	e := &Enum{Values: []string{"ok", "warn", "crit"}}
+
+	b, err := EncodeStringForSchema("warn", e)
+	if err != nil || !bytes.Equal(b, []byte{1}) {
+		t.Errorf("expected warn to encode as 1, got %v, %v", b, err)
+	}
+	if !e.Validate(b) {
+		t.Error("expected encoded enum to validate")
+	}
+
+	if s, err := DecodeStringForSchema([]byte{2}, e); err != nil || s != "crit" {
+		t.Errorf("expected 2 to decode as crit, got %s, %v", s, err)
+	}
+
+	if _, err := EncodeStringForSchema("down", e); err == nil {
+		t.Error("expected an unknown name to fail to encode")
+	}
+	if e.Validate([]byte{3}) || e.Validate([]byte{0, 0}) {
+		t.Error("expected out of range values to fail validation")
+	}
+
+	j, _ := json.Marshal(e)
+	if string(j) != `"enum(\"ok\",\"warn\",\"crit\")"` {
+		t.Errorf("unexpected JSON %s", j)
+	}
+}
@@ -35,9 +35,12 @@ func (p *Parser) Parse() (schema Object, err error) {
 		}
 	}()
 
-	p.Scanner.Input = strings.Trim(p.Scanner.Input, " \t\n")
+	p.Scanner.Input = strings.TrimSpace(p.Scanner.Input)
 
 	schema = p.schema()
+
+	// Comments may follow the schema
+	p.Scanner.SkipIgnored()
 	if schema == nil {
 		syntaxError := parse.NewSyntaxError(parse.Token{
 			Type:     TOK_INVALID,
@@ -62,6 +65,10 @@ func (p *Parser) schema() Object {
 		return schema
 	}
 
+	if schema = p.enum(); schema != nil {
+		return schema
+	}
+
 	if schema = p.array(); schema != nil {
 		return schema
 	}
@@ -104,7 +111,7 @@ func (p *Parser) array() Object {
 
 	array.Length, err = strconv.Atoi(tok.Lexeme)
 	if err != nil {
-		panic(err)
+		panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: invalid array size '%s'", tok.Lexeme)))
 	}
 
 	tok = p.Scanner.Emit()
@@ -131,6 +138,54 @@ func (p *Parser) array() Object {
 	return &array
 }
 
+func (p *Parser) enum() Object {
+	var enum Enum
+
+	tok := p.Scanner.Emit()
+	if tok.Type != TOK_ENUM {
+		p.Scanner.Rewind()
+		return nil
+	}
+
+	tok = p.Scanner.Emit()
+	if tok.Type != TOK_PAREN_O {
+		panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: unexpected token '%s', expected a '('", tok.Lexeme)))
+	}
+
+	tok = p.Scanner.Emit()
+	for tok.Type != TOK_PAREN_X {
+		if tok.Type != TOK_KEY {
+			panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: unexpected token '%s', expected an enum value (\"...\")", tok.Lexeme)))
+		}
+
+		name, err := parse.Unquote(tok.Lexeme)
+		if err != nil {
+			name = tok.Lexeme[1 : len(tok.Lexeme)-1]
+		}
+		if _, exists := enum.Index(name); exists {
+			panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: duplicate enum value '%s'", name)))
+		}
+		if len(enum.Values) == MaxEnumValues {
+			panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: enums are limited to %d values", MaxEnumValues)))
+		}
+		enum.Values = append(enum.Values, name)
+
+		// Values are separated by commas, with an optional trailing comma
+		tok = p.Scanner.Emit()
+		if tok.Type == TOK_COMMA {
+			tok = p.Scanner.Emit()
+		} else if tok.Type != TOK_PAREN_X {
+			panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: unexpected token '%s', expected ',' or ')'", tok.Lexeme)))
+		}
+	}
+
+	if len(enum.Values) == 0 {
+		panic(parse.NewSyntaxError(tok, "Error: enums must have at least one value"))
+	}
+
+	return &enum
+}
+
 // Insert a string into a list of strings (preserving order), returning the resulting index
 func insertInto(list []string, key string) ([]string, int) {
 	for idx, s := range list {
@@ -159,7 +214,7 @@ func (p *Parser) composite() Object {
 		}
 
 		var idx int
-		unquotedKey, err := strconv.Unquote(tok.Lexeme)
+		unquotedKey, err := parse.Unquote(tok.Lexeme)
 		if err != nil {
 			unquotedKey = tok.Lexeme
 		}
@@ -172,6 +227,9 @@ func (p *Parser) composite() Object {
 
 		// Now we must find a valid type
 		val := p.dType()
+		if val == nil {
+			val = p.enum()
+		}
 		if val == nil {
 			// It could be an array
 			val = p.array()
@@ -183,8 +241,24 @@ func (p *Parser) composite() Object {
 
 		composite.Values = append(composite.Values[:idx], append([]Object{val}, composite.Values[idx:]...)...)
 
-		// Finally, every line must have a comma
+		// Values may be marked optional, or given a default
 		tok = p.Scanner.Emit()
+		switch tok.Type {
+		case TOK_QUESTION:
+			if composite.Optional == nil {
+				composite.Optional = make(map[string]bool)
+			}
+			composite.Optional[unquotedKey] = true
+			tok = p.Scanner.Emit()
+		case TOK_EQUALS:
+			if composite.Defaults == nil {
+				composite.Defaults = make(map[string]string)
+			}
+			composite.Defaults[unquotedKey] = p.defaultValue(unquotedKey, val)
+			tok = p.Scanner.Emit()
+		}
+
+		// Finally, every line must have a comma
 
 		// Our composite could be over now
 		if tok.Type == TOK_CURLY_X {
@@ -201,3 +275,41 @@ func (p *Parser) composite() Object {
 
 	return &composite
 }
+
+// defaultValue parses the default value of key, which has the schema val
+func (p *Parser) defaultValue(key string, val Object) string {
+	tok := p.Scanner.EmitLiteral()
+	if tok.Type != TOK_LITERAL {
+		panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: expected a default value for key '%s'", key)))
+	}
+
+	if e, ok := val.(*Enum); ok {
+		value, err := parse.Unquote(tok.Lexeme)
+		if _, valid := e.Index(value); err != nil || !valid {
+			panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: default value for key '%s' must be one of %s", key, e.ToSchema())))
+		}
+		return value
+	}
+
+	t, ok := val.(*Type)
+	if !ok {
+		panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: default values are not supported for %s", val.ToSchema())))
+	}
+
+	value := tok.Lexeme
+	if t.Name == "string" || t.Name == "binary" {
+		unquoted, err := parse.Unquote(tok.Lexeme)
+		if err != nil {
+			panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: expected a quoted default value for key '%s'", key)))
+		}
+		value = unquoted
+	} else if t.Name == "boolean" && value != "true" && value != "false" {
+		panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: expected true or false as default value for key '%s'", key)))
+	}
+
+	if _, err := EncodeStringForSchema(value, t); err != nil {
+		panic(parse.NewSyntaxError(tok, fmt.Sprintf("Error: invalid default value '%s' for %s", tok.Lexeme, t.Name)))
+	}
+
+	return value
+}
@@ -188,3 +188,140 @@ func TestParseShallowMap(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestParseOptionalAndDefaults(t *testing.T) {
+	obj, err := Parse(`{"x": int32 = 7, "note": string?, "name": string = "a b"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := obj.(*Composite)
+	if !c.Optional["note"] || c.Optional["x"] {
+		t.Errorf("expected only 'note' to be optional, got %v", c.Optional)
+	}
+	if c.Defaults["x"] != "7" || c.Defaults["name"] != "a b" {
+		t.Errorf("unexpected defaults %v", c.Defaults)
+	}
+
+	expected := `{"name":string="a b","note":string?,"x":int32=7,}`
+	if c.ToSchema() != expected {
+		t.Errorf("expected %s, got %s", expected, c.ToSchema())
+	}
+
+	// The canonical form should parse to the same schema
+	again, err := Parse(c.ToSchema())
+	if err != nil || again.ToSchema() != expected {
+		t.Errorf("expected %s to round-trip, got %v, %v", expected, again, err)
+	}
+
+	// Quoted defaults may contain escape sequences, and use either quote
+	obj, err = Parse(`{"a": string = "say \"hi\"\n", "b": string = 'caf\u00e9'}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = obj.(*Composite)
+	if c.Defaults["a"] != "say \"hi\"\n" || c.Defaults["b"] != "café" {
+		t.Errorf("unexpected defaults %q", c.Defaults)
+	}
+	again, err = Parse(c.ToSchema())
+	if err != nil || again.ToSchema() != c.ToSchema() {
+		t.Errorf("expected %s to round-trip, got %v, %v", c.ToSchema(), again, err)
+	}
+
+	invalid := []string{
+		`{"x": int16 = 70000}`,
+		`{"x": string = "bad \q"}`,
+		`{"x": boolean = yes}`,
+		`{"x": [2]int32 = 1}`,
+		`{"x": int32 = }`,
+	}
+	for _, s := range invalid {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("expected '%s' to fail to parse", s)
+		}
+	}
+}
+
+func TestParseMultiLine(t *testing.T) {
+	obj, err := Parse(`# A reading from a sensor
+{
+	"x": int32 = 7,   # millimetres
+	"note": string?,  # set by hand, sometimes
+	"level": enum(
+		"ok",
+		"crit",       # pages someone
+	),
+}  # trailing comment`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"level":enum("ok","crit"),"note":string?,"x":int32=7,}`
+	if obj.ToSchema() != expected {
+		t.Errorf("expected %s, got %s", expected, obj.ToSchema())
+	}
+
+	obj, err = Parse("int32 # a comment")
+	if err != nil || obj.ToSchema() != "int32" {
+		t.Errorf("expected int32, got %v, %v", obj, err)
+	}
+
+	// Errors point at the line they were found on
+	_, err = Parse("{\n\t\"x\": int32,\n\t\"y\": bogus,\n}")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "\t\"y\": bogus,\n") || strings.Contains(err.Error(), "\"x\"") {
+		t.Errorf("expected the error to show only the second key's line, got %s", err)
+	}
+
+	invalid := []string{
+		`# nothing but a comment`,
+		`{"x": int32 # unterminated }`,
+	}
+	for _, s := range invalid {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("expected '%s' to fail to parse", s)
+		}
+	}
+}
+
+func TestParseEnum(t *testing.T) {
+	obj, err := Parse(`enum("ok", "warn", "crit")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok := obj.(*Enum)
+	if !ok {
+		t.Fatalf("expected an enum, got %T", obj)
+	}
+	if !slicesEqualStr(e.Values, []string{"ok", "warn", "crit"}) {
+		t.Errorf("unexpected values %v", e.Values)
+	}
+	if e.ToSchema() != `enum("ok","warn","crit")` {
+		t.Errorf("unexpected schema %s", e.ToSchema())
+	}
+
+	obj, err = Parse(`{"level": enum("ok", "crit") = "ok", "n": int32}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"level":enum("ok","crit")="ok","n":int32,}`
+	if obj.ToSchema() != expected {
+		t.Errorf("expected %s, got %s", expected, obj.ToSchema())
+	}
+
+	invalid := []string{
+		`enum()`,
+		`enum("a", "a")`,
+		`enum("a" "b")`,
+		`enum(a)`,
+		`{"level": enum("ok") = "bad"}`,
+	}
+	for _, s := range invalid {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("expected '%s' to fail to parse", s)
+		}
+	}
+}
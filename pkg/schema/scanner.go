@@ -58,6 +58,39 @@ func (s *Scanner) MatchKey() int {
 	return pos - s.Pos
 }
 
+// MatchComment returns the length of the comment at the scanner's position,
+// which runs until the end of the line
+//
+// Grammar:
+//
+//	comment = "#" *( %x00-09 / %x0B-10FFFF )
+func (s *Scanner) MatchComment() int {
+	if !strings.HasPrefix(s.Input[s.Pos:], "#") {
+		return 0
+	}
+
+	size := strings.IndexByte(s.Input[s.Pos:], '\n')
+	if size == -1 {
+		size = len(s.Input) - s.Pos
+	}
+
+	return size
+}
+
+// SkipIgnored moves past any whitespace and comments at the scanner's
+// position
+func (s *Scanner) SkipIgnored() {
+	for s.Pos < len(s.Input) {
+		r, width := utf8.DecodeRuneInString(s.Input[s.Pos:])
+		if r == '#' {
+			width = s.MatchComment()
+		} else if !unicode.IsSpace(r) {
+			break
+		}
+		s.Pos += width
+	}
+}
+
 func (s *Scanner) MatchNumber() int {
 	r, width := utf8.DecodeRuneInString(s.Input[s.Pos:])
 	size := 0
@@ -87,6 +120,9 @@ func (s *Scanner) Emit() parse.Token {
 		case unicode.IsSpace(r):
 			skip = width
 			found = false
+		case r == '#':
+			skip = s.MatchComment()
+			found = false
 		case r == '{':
 			t.Type = TOK_CURLY_O
 			skip = width
@@ -99,12 +135,24 @@ func (s *Scanner) Emit() parse.Token {
 		case r == ']':
 			t.Type = TOK_BRACKET_X
 			skip = width
+		case r == '(':
+			t.Type = TOK_PAREN_O
+			skip = width
+		case r == ')':
+			t.Type = TOK_PAREN_X
+			skip = width
 		case r == ':':
 			t.Type = TOK_COLON
 			skip = width
 		case r == ',':
 			t.Type = TOK_COMMA
 			skip = width
+		case r == '?':
+			t.Type = TOK_QUESTION
+			skip = width
+		case r == '=':
+			t.Type = TOK_EQUALS
+			skip = width
 		case unicode.IsDigit(r):
 			skip = s.MatchNumber()
 			if skip == 0 {
@@ -132,6 +180,22 @@ func (s *Scanner) Emit() parse.Token {
 			}
 			t.Type = TOK_INVALID
 			skip = s.SkipToBoundary(isDelimiter)
+		case r == 'd':
+			if strings.HasPrefix(s.Input[s.Pos:], "duration") {
+				t.Type = TOK_TYPE
+				skip = len("duration")
+				break
+			}
+			t.Type = TOK_INVALID
+			skip = s.SkipToBoundary(isDelimiter)
+		case r == 'e':
+			if strings.HasPrefix(s.Input[s.Pos:], "enum") {
+				t.Type = TOK_ENUM
+				skip = len("enum")
+				break
+			}
+			t.Type = TOK_INVALID
+			skip = s.SkipToBoundary(isDelimiter)
 		case r == 'f':
 			if strings.HasPrefix(s.Input[s.Pos:], "float") {
 				if strings.HasPrefix(s.Input[s.Pos+5:], "32") ||
@@ -169,6 +233,14 @@ func (s *Scanner) Emit() parse.Token {
 			}
 			t.Type = TOK_INVALID
 			skip = s.SkipToBoundary(isDelimiter)
+		case r == 't':
+			if strings.HasPrefix(s.Input[s.Pos:], "timestamp") {
+				t.Type = TOK_TYPE
+				skip = len("timestamp")
+				break
+			}
+			t.Type = TOK_INVALID
+			skip = s.SkipToBoundary(isDelimiter)
 		case r == 'u':
 			if strings.HasPrefix(s.Input[s.Pos:], "uint") {
 				if strings.HasPrefix(s.Input[s.Pos+4:], "8") {
@@ -202,6 +274,46 @@ func (s *Scanner) Emit() parse.Token {
 	return t
 }
 
+// EmitLiteral emits the default value literal found on Scanner.Input, which
+// is either a quoted string or runs until the next delimiter
+//
+// Grammar:
+//
+//	literal = quoted-string / 1*( ALPHA / DIGIT / "-" / "+" / "." )
+func (s *Scanner) EmitLiteral() parse.Token {
+	var t parse.Token
+
+	oldStart := s.Start
+
+	s.SkipIgnored()
+	s.Start = s.Pos
+
+	t.Type = TOK_LITERAL
+	if strings.HasPrefix(s.Input[s.Pos:], "\"") || strings.HasPrefix(s.Input[s.Pos:], "'") {
+		n := parse.MatchQuoted(s.Input[s.Pos:])
+		if _, err := parse.Unquote(s.Input[s.Pos : s.Pos+n]); n == 0 || err != nil {
+			t.Type = TOK_INVALID
+			s.Pos += s.SkipToBoundary(isDelimiter)
+		} else {
+			s.Pos += n
+		}
+	} else {
+		s.Pos += s.SkipToBoundary(isDelimiter)
+	}
+
+	if s.Pos == s.Start {
+		t.Type = TOK_INVALID
+	}
+
+	t.Lexeme = s.Input[s.Start:s.Pos]
+	t.Location = parse.Location{Start: s.Start, End: s.Pos}
+	s.Start = s.Pos
+
+	s.LastWidth = s.Start - oldStart
+
+	return t
+}
+
 // Rewind the last read token
 func (s *Scanner) Rewind() {
 	s.Start -= s.LastWidth
@@ -212,7 +324,7 @@ func (s *Scanner) Rewind() {
 type boundaryFunc func(rune) bool
 
 func isDelimiter(r rune) bool {
-	return unicode.IsSpace(r) || r == ':' || r == ',' || r == '"' || r == '}'
+	return unicode.IsSpace(r) || r == ':' || r == ',' || r == '"' || r == '}' || r == ')' || r == '#'
 }
 
 // SkipToBoundary returns the number of bytes until the next delimiter.
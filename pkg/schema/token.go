@@ -23,6 +23,14 @@ const (
 
 	TOK_CURLY_O
 	TOK_CURLY_X
+
+	TOK_ENUM
+	TOK_PAREN_O
+	TOK_PAREN_X
+
+	TOK_QUESTION
+	TOK_EQUALS
+	TOK_LITERAL
 )
 
 func (t TokenType) ToString() string {
@@ -49,6 +57,18 @@ func (t TokenType) ToString() string {
 		return "TOK_CURLY_O"
 	case TOK_CURLY_X:
 		return "TOK_CURLY_X"
+	case TOK_ENUM:
+		return "TOK_ENUM"
+	case TOK_PAREN_O:
+		return "TOK_PAREN_O"
+	case TOK_PAREN_X:
+		return "TOK_PAREN_X"
+	case TOK_QUESTION:
+		return "TOK_QUESTION"
+	case TOK_EQUALS:
+		return "TOK_EQUALS"
+	case TOK_LITERAL:
+		return "TOK_LITERAL"
 	}
 	return "TOK_UNKNOWN"
 }
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package schema
+
+import "encoding/binary"
+
+// Validator checks values against a schema, accepting exactly what the
+// schema's Validate does. Compiling one works out the layout of the schema
+// once, rather than on every value, which matters for composites.
+type Validator interface {
+	Validate([]byte) bool
+}
+
+// Compile returns a Validator for obj
+func Compile(obj Object) Validator {
+	switch t := obj.(type) {
+	case *Type:
+		if t.Name == "string" || t.Name == "binary" {
+			return anyValue{}
+		}
+		if size := t.Size(); size > 0 {
+			return fixedSize(size)
+		}
+	case *Array:
+		return fixedSize(t.Size())
+	case *Composite:
+		return compileComposite(t)
+	}
+	return obj
+}
+
+// anyValue accepts every value
+type anyValue struct{}
+
+func (anyValue) Validate([]byte) bool { return true }
+
+// fixedSize accepts values of exactly its size
+type fixedSize int
+
+func (s fixedSize) Validate(val []byte) bool { return len(val) == int(s) }
+
+// variableSize marks a composite field whose size is given by a length prefix
+const variableSize = -1
+
+// compositeField is the layout of one key of a composite
+type compositeField struct {
+	size     int
+	optional bool
+}
+
+// compositeLayout accepts values with its fields, in order, and nothing after
+// them
+type compositeLayout []compositeField
+
+func compileComposite(c *Composite) Validator {
+	layout := make(compositeLayout, len(c.Keys))
+	fixed := true
+	total := 0
+
+	for i, key := range c.Keys {
+		f := compositeField{optional: c.Optional[key]}
+		switch t := c.Values[i].(type) {
+		case *Type:
+			f.size = t.Size()
+			if t.Name == "string" || t.Name == "binary" {
+				f.size = variableSize
+			}
+		case *Array:
+			f.size = t.Size()
+		case *Enum:
+			f.size = t.Size()
+		default:
+			// Composites holding anything else never validate
+			return Unknown{}
+		}
+		if f.optional || f.size == variableSize {
+			fixed = false
+		}
+		total += f.size
+		layout[i] = f
+	}
+
+	if fixed {
+		return fixedSize(total)
+	}
+	return layout
+}
+
+func (l compositeLayout) Validate(val []byte) bool {
+	index := 0
+
+	for _, f := range l {
+		if f.optional {
+			if index >= len(val) {
+				return false
+			}
+			present := val[index]
+			index += 1
+			if present == 0 {
+				continue
+			}
+		}
+
+		size := f.size
+		if size == variableSize {
+			if index+4 > len(val) {
+				return false
+			}
+			size = int(binary.LittleEndian.Uint32(val[index : index+4]))
+			index += 4
+		}
+
+		if size < 0 || index+size > len(val) {
+			return false
+		}
+		index += size
+	}
+
+	return index == len(val)
+}
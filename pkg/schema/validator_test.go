@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package schema
+
+import "testing"
+
+func TestCompile(t *testing.T) {
+	schemas := []string{
+		"int32",
+		"string",
+		"binary",
+		"[4]float64",
+		`enum("low","high")`,
+		`{"x":int32,"y":int32}`,
+		`{"x":int32,"level":enum("low","high"),"v":[2]uint8}`,
+		`{"x":int32,"name":string}`,
+		`{"x":int32?,"note":string?,"b":binary}`,
+	}
+	values := [][]byte{
+		nil,
+		{0},
+		{1},
+		{7},
+		{0, 0, 0, 0},
+		{1, 2, 3, 4, 5, 6, 7, 8},
+		{1, 2, 3, 4, 3, 0, 0, 0, 'a', 'b', 'c'},
+		{1, 2, 3, 4, 3, 0, 0, 0, 'a', 'b'},
+		{1, 2, 3, 4, 0, 0, 0, 0},
+		{0, 1, 2, 0, 0, 0, 'h', 'i', 0, 0, 0, 0},
+		{1, 9, 9, 9, 9, 0, 0, 0, 0, 0},
+		make([]byte, 32),
+	}
+
+	for _, s := range schemas {
+		obj, err := Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := Compile(obj)
+		for _, val := range values {
+			if got, want := v.Validate(val), obj.Validate(val); got != want {
+				t.Errorf("%s: expected the compiled validator to return %v for %v, got %v", s, want, val, got)
+			}
+		}
+	}
+}
+
+// benchmarkSchema is a composite with a mix of fixed and variable length keys
+const benchmarkSchema = `{"temperature":float32,"humidity":float32,"pressure":float64,"station":string,"level":enum("low","high")}`
+
+func benchmarkValidate(b *testing.B, obj Object, validate func([]byte) bool) {
+	val, err := EncodeStringForSchema(`"temperature":21.5,"humidity":40,"pressure":1013.25,"station":north,"level":"low"`, obj)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !validate(val) {
+			b.Fatal("expected value to validate")
+		}
+	}
+}
+
+func BenchmarkCompositeValidate(b *testing.B) {
+	obj, _ := Parse(benchmarkSchema)
+	benchmarkValidate(b, obj, obj.Validate)
+}
+
+func BenchmarkCompiledCompositeValidate(b *testing.B) {
+	obj, _ := Parse(benchmarkSchema)
+	benchmarkValidate(b, obj, Compile(obj).Validate)
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+// adminCommands administer a database rather than read or write its data.
+// When the server has an admin port, they're only served there.
+var adminCommands = []string{proto.CommandFlush, proto.CommandSchema, proto.CommandTemplate}
+
+var (
+	messageErrorUnauthenticated = proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 401, Err: errors.New("authenticate with AUTH before sending commands to the admin port")})
+	messageErrorBadToken        = proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 401, Err: errors.New("invalid admin token")})
+)
+
+// SeparateAdmin moves the admin commands onto an admin port, on which
+// connections must authenticate with token before sending any command but
+// VERSION, AUTH or PING. The data port then rejects admin commands. It must
+// be called before the server starts serving.
+func (s *Server) SeparateAdmin(port int, token string) {
+	s.adminPort = port
+	s.adminToken = token
+}
+
+// ServeAdmin serves the databases on the admin port, if the server has one
+func (s *Server) ServeAdmin() {
+	if s.adminPort == 0 {
+		return
+	}
+
+	srv := s.messageServer(AdminListener)
+
+	err := srv.ListenAndServe(s.adminPort, authMux{s.adminMux()})
+	if err != nil {
+		s.log.Error().Err(err).Msg("error listening and serving admin port")
+	}
+}
+
+// adminMux returns a MessageMux with every handler of the admin port
+func (s *Server) adminMux() MessageMux {
+	mux := s.handlers()
+	mux.HandleState(proto.CommandAuth, s.accessLogState(s.log, s.HandleAuth))
+	return mux
+}
+
+// dataOnly replaces the handlers of admin commands in mux with ones which
+// reject them, for the data port of servers with an admin port
+func dataOnly(mux MessageMux) MessageMux {
+	for _, command := range append(adminCommands, proto.CommandAuth) {
+		err := fmt.Errorf("%s is only served on the admin port", command)
+		mux.Handle(command, func(rw proto.ResponseWriter, r *proto.Request) {
+			rw.WriteMessage(proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 403, Err: err}))
+		})
+	}
+	return mux
+}
+
+// authMux serves connections which have authenticated, and only serves
+// VERSION, AUTH and PING to the rest
+type authMux struct {
+	MessageMux
+}
+
+func (m authMux) ServeMessage(rw proto.ResponseWriter, c *conn, r *proto.Request) {
+	switch r.Command() {
+	case proto.CommandVersion, proto.CommandAuth, proto.CommandPing:
+	default:
+		if !c.authenticated.Load() {
+			rw.WriteMessage(messageErrorUnauthenticated)
+			return
+		}
+	}
+	m.MessageMux.ServeMessage(rw, c, r)
+}
+
+func (s *Server) HandleAuth(rw proto.ResponseWriter, c *conn, r *proto.Request) {
+	a := proto.AuthRequest{}
+	err := proto.Unmarshal(r.Data(), &a)
+	if err != nil {
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
+		rw.WriteMessage(proto.MessageErrorUnmarshaling)
+		return
+	}
+
+	if s.adminToken == "" || subtle.ConstantTimeCompare([]byte(a.Token), []byte(s.adminToken)) != 1 {
+		r.Log(s.log).Warn().Str("client", r.RemoteAddr()).Msg("rejected admin token")
+		rw.WriteMessage(messageErrorBadToken)
+		return
+	}
+
+	c.authenticated.Store(true)
+	rw.WriteMessage(proto.MessageOk)
+}
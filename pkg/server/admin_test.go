@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/tracing"
+	"github.com/rs/zerolog"
+)
+
+// dialMux returns a function which sends messages over a connection served by
+// mux, and returns the code of each response
+func dialMux(t *testing.T, mux MessageMux) func(proto.Message) uint32 {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go newConn(zerolog.Nop(), mux, proto.Limits{}).Handle(server)
+
+	return func(m proto.Message) uint32 {
+		b, _ := m.Marshal()
+		go client.Write(b)
+		resp, err := proto.ReadMessageFull(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Command() != proto.CommandError {
+			return 200
+		}
+		e := proto.ErrResponse{}
+		if err = e.Unmarshal(resp.Data()); err != nil {
+			t.Fatal(err)
+		}
+		return e.Code
+	}
+}
+
+func TestAdminPort(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		log:     zerolog.Nop(),
+		metrics: NewMetricsStore(),
+		dbMap:   map[string]*database.Database{"test": db},
+		tracer:  tracing.Nop,
+	}
+
+	use := proto.NewMessageWithType(proto.CommandUse, proto.UseRequest{DbName: "test"})
+	flush := proto.NewMessageWithType(proto.CommandFlush, proto.FlushRequest{})
+	query := proto.NewMessageWithType(proto.CommandQuery, proto.QueryRequest{Query: "all"})
+	auth := func(token string) proto.Message {
+		return proto.NewMessageWithType(proto.CommandAuth, proto.AuthRequest{Token: token})
+	}
+
+	// Without an admin port, admin commands are served with everything else
+	send := dialMux(t, s.mux())
+	if code := send(use); code != 200 {
+		t.Fatalf("expected USE to succeed, got %d", code)
+	}
+	if code := send(flush); code != 200 {
+		t.Errorf("expected FLUSH to be served on the data port, got %d", code)
+	}
+
+	s.SeparateAdmin(8002, "s3cret")
+
+	// The data port serves data commands, but rejects admin ones
+	send = dialMux(t, s.mux())
+	send(use)
+	if code := send(query); code != 200 {
+		t.Errorf("expected QUERY to be served on the data port, got %d", code)
+	}
+	for _, m := range []proto.Message{flush, auth("s3cret")} {
+		if code := send(m); code != 403 {
+			t.Errorf("expected %s to be rejected on the data port, got %d", m.Command(), code)
+		}
+	}
+
+	// The admin port serves everything, once the connection authenticates
+	send = dialMux(t, authMux{s.adminMux()})
+	if code := send(proto.NewMessageWithType(proto.CommandPing, proto.PingRequest{})); code != 200 {
+		t.Errorf("expected PING to be served before authenticating, got %d", code)
+	}
+	for _, m := range []proto.Message{use, flush, auth("guess")} {
+		if code := send(m); code != 401 {
+			t.Errorf("expected %s to be rejected before authenticating, got %d", m.Command(), code)
+		}
+	}
+	if code := send(auth("s3cret")); code != 200 {
+		t.Fatalf("expected the admin token to be accepted, got %d", code)
+	}
+	for _, m := range []proto.Message{use, flush, query} {
+		if code := send(m); code != 200 {
+			t.Errorf("expected %s to be served after authenticating, got %d", m.Command(), code)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+// AuditConfig configures where the audit log is written. Records are written
+// to File, Topic, or both.
+type AuditConfig struct {
+	// File is the path of the file records are written to, one JSON object
+	// per line
+	File string
+	// MaxSize is the size in bytes File may grow to before it's rotated, or 0
+	// to never rotate it
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept, as File.1, File.2, and
+	// so on, from newest to oldest
+	MaxBackups int
+	// Topic is appended each record, in the database the command ran against
+	Topic string
+	// Appends includes APPEND commands, which are otherwise left out since
+	// there are so many of them
+	Appends bool
+}
+
+// AuditRecord describes a mutating command and its result
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// Client is the address the command came from, and ACL the name of the
+	// ACL the client was restricted by, if any
+	Client   string         `json:"client"`
+	ACL      string         `json:"acl,omitempty"`
+	Database string         `json:"db"`
+	Command  string         `json:"command"`
+	Args     map[string]any `json:"args,omitempty"`
+	// RequestID ties the record to the server's logs for the command
+	RequestID string `json:"request_id,omitempty"`
+	// Code is 200 if the command succeeded, or the code of the ERR returned
+	Code  uint32 `json:"code"`
+	Error string `json:"error,omitempty"`
+}
+
+// AuditLog records mutating commands
+type AuditLog struct {
+	config AuditConfig
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+}
+
+// NewAuditLog opens the audit log described by config
+func NewAuditLog(config AuditConfig) (*AuditLog, error) {
+	a := &AuditLog{config: config}
+	if config.File != "" {
+		err := a.open()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// rotate moves each backup up a place, dropping the oldest, and starts a new
+// file
+func (a *AuditLog) rotate() error {
+	err := a.file.Close()
+	if err != nil {
+		return err
+	}
+
+	if a.config.MaxBackups < 1 {
+		err = os.Remove(a.config.File)
+	} else {
+		for i := a.config.MaxBackups - 1; i > 0; i-- {
+			err = os.Rename(fmt.Sprintf("%s.%d", a.config.File, i), fmt.Sprintf("%s.%d", a.config.File, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		err = os.Rename(a.config.File, a.config.File+".1")
+	}
+	if err != nil {
+		return err
+	}
+
+	return a.open()
+}
+
+// audits returns whether commands of type cmd are recorded
+func (a *AuditLog) audits(cmd string) bool {
+	switch cmd {
+	case proto.CommandCreate, proto.CommandSchema, proto.CommandTemplate, proto.CommandFlush:
+		return true
+	case proto.CommandAppend:
+		return a.config.Appends
+	}
+	return false
+}
+
+// Record writes rec to the audit log
+func (a *AuditLog) Record(r *proto.Request, rec AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if a.config.Topic != "" && r.Database() != nil {
+		err = r.Database().AppendOrCreate(line, a.config.Topic)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.config.File == "" {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	line = append(line, '\n')
+	if a.config.MaxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.config.MaxSize {
+		err = a.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// Close closes the audit log's file
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// auditArgs returns the arguments of the command in r worth recording
+func auditArgs(r *proto.Request) map[string]any {
+	switch r.Command() {
+	case proto.CommandCreate:
+		c := proto.CreateTopicRequest{}
+		if proto.Unmarshal(r.Data(), &c) != nil {
+			return nil
+		}
+		args := map[string]any{"topic": c.Topic, "schema": c.Schema}
+		if c.Codec != "" {
+			args["codec"] = c.Codec
+		}
+		if c.Encoding != "" {
+			args["encoding"] = c.Encoding
+		}
+		if c.Override {
+			args["override"] = true
+		}
+		return args
+	case proto.CommandSchema:
+		c := proto.CreateSchemaRequest{}
+		if proto.Unmarshal(r.Data(), &c) != nil {
+			return nil
+		}
+		return map[string]any{"name": c.Name, "schema": c.Schema}
+	case proto.CommandTemplate:
+		c := proto.CreateTemplateRequest{}
+		if proto.Unmarshal(r.Data(), &c) != nil {
+			return nil
+		}
+		return map[string]any{"pattern": c.Pattern, "schema": c.Schema}
+	case proto.CommandAppend:
+		a := proto.AppendRequest{}
+		if proto.Unmarshal(r.Data(), &a) != nil {
+			return nil
+		}
+		args := map[string]any{"topic": a.Topic, "size": len(a.Data)}
+		if a.TTL > 0 {
+			args["ttl"] = a.TTL.String()
+		}
+		return args
+	}
+	return nil
+}
+
+// responseRecorder keeps a copy of the response written through it
+type responseRecorder struct {
+	rw       proto.ResponseWriter
+	response bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.response.Write(b)
+	return r.rw.Write(b)
+}
+
+// result returns the code and error of the recorded response, skipping any
+// notices written ahead of it
+func (r *responseRecorder) result() (uint32, string) {
+	msg, err := proto.ReadMessageFull(&r.response)
+	for err == nil && msg.Command() == proto.CommandNotice {
+		msg, err = proto.ReadMessageFull(&r.response)
+	}
+	if err != nil {
+		return 0, err.Error()
+	}
+	if msg.Command() == proto.CommandError {
+		e := proto.ErrResponse{}
+		err = e.Unmarshal(msg.Data())
+		if err != nil {
+			return 0, err.Error()
+		}
+		return e.Code, e.Err.Error()
+	}
+	return 200, ""
+}
+
+// audit records the commands h handles in the audit log, if there is one and
+// it records commands of that type
+func (s *Server) audit(cmd string, h MessageHandler) MessageHandler {
+	if s.auditLog == nil || !s.auditLog.audits(cmd) {
+		return h
+	}
+
+	return func(rw proto.ResponseWriter, r *proto.Request) {
+		rec := &responseRecorder{rw: rw}
+		h(proto.NewResponseWriter(rec).WithRequestID(rw.RequestID()).WithNotices(rw.Notices()), r)
+
+		record := AuditRecord{
+			Time:      time.Now(),
+			Client:    r.RemoteAddr(),
+			Command:   r.Command(),
+			Args:      auditArgs(r),
+			RequestID: r.RequestID(),
+		}
+		if r.ACL() != nil {
+			record.ACL = r.ACL().Name
+		}
+		if r.Database() != nil {
+			record.Database = r.Database().Name
+		}
+		record.Code, record.Error = rec.result()
+
+		err := s.auditLog.Record(r, record)
+		if err != nil {
+			r.Log(s.log).Error().Err(err).Str("cmd", r.Command()).Msg("error writing audit log")
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/rs/zerolog"
+)
+
+func readAuditRecords(t *testing.T, file string) []AuditRecord {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec AuditRecord
+		err = json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	db, err := database.NewDatabase("test", filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "audit.log")
+	auditLog, err := NewAuditLog(AuditConfig{File: file, MaxSize: 200, MaxBackups: 1, Topic: "/audit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+
+	s := &Server{log: zerolog.Nop(), auditLog: auditLog}
+	create := s.audit(proto.CommandCreate, s.HandleCreate)
+	appendHandler := s.audit(proto.CommandAppend, s.HandleAppend)
+
+	send := func(h MessageHandler, msg proto.Message) {
+		r := proto.NewRequest(msg, db).WithRemoteAddr("127.0.0.1:5000")
+		h(proto.NewResponseWriter(&bytes.Buffer{}), r)
+	}
+
+	send(create, proto.NewMessageWithType(proto.CommandCreate, proto.CreateTopicRequest{Topic: "/sensors", Schema: "int32"}))
+	send(create, proto.NewMessageWithType(proto.CommandCreate, proto.CreateTopicRequest{Topic: "/sensors/temp", Schema: "float64"}))
+	// Appends aren't audited unless asked for
+	send(appendHandler, proto.NewMessageWithType(proto.CommandAppend, proto.AppendRequest{Topic: "/sensors", Data: []byte{1, 0, 0, 0}}))
+
+	// Each record is bigger than half of MaxSize, so the first was rotated
+	rotated := readAuditRecords(t, file+".1")
+	if len(rotated) != 1 || rotated[0].Code != 200 || rotated[0].Args["topic"] != "/sensors" {
+		t.Errorf("unexpected rotated records %+v", rotated)
+	}
+
+	current := readAuditRecords(t, file)
+	if len(current) != 1 {
+		t.Fatalf("expected 1 record, got %+v", current)
+	}
+	rec := current[0]
+	if rec.Command != proto.CommandCreate || rec.Client != "127.0.0.1:5000" || rec.Database != "test" {
+		t.Errorf("unexpected record %+v", rec)
+	}
+	if rec.Code != 508 || rec.Error == "" {
+		t.Errorf("expected the conflicting create to be recorded as failing, got %+v", rec)
+	}
+
+	// Records are also appended to the audit topic
+	audited := 0
+	for _, entry := range db.Retrieve(database.Query{Quantifier: "all"}) {
+		if entry.Topic == "/audit" {
+			audited++
+		}
+	}
+	if audited != 2 {
+		t.Errorf("expected 2 entries in /audit, got %d", audited)
+	}
+}
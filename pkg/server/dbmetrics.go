@@ -14,22 +14,107 @@ import (
 type dbStatsCollector struct {
 	db *database.Database
 
-	segments   *prometheus.Desc
-	topicCount *prometheus.Desc
+	segments          *prometheus.Desc
+	topicCount        *prometheus.Desc
+	walSize           *prometheus.Desc
+	pendingAppends    *prometheus.Desc
+	serializeDuration *prometheus.Desc
+	appendDuration    *prometheus.Desc
+	retrievedEntries  *prometheus.Desc
+	diskBytes         *prometheus.Desc
+	appends           *prometheus.Desc
+	serializations    *prometheus.Desc
+	clockSkews        *prometheus.Desc
+	planCacheHits     *prometheus.Desc
+	planCacheMisses   *prometheus.Desc
+	duplicateAppends  *prometheus.Desc
+	slowAppends       *prometheus.Desc
+	slowFlushes       *prometheus.Desc
 }
 
 func NewDBStatsCollector(db *database.Database) prometheus.Collector {
+	labels := prometheus.Labels{"db_name": db.Name}
 	return &dbStatsCollector{
 		db: db,
 		segments: prometheus.NewDesc(
 			"fossil_database_segments",
 			"Number of segments in the database.",
-			nil, prometheus.Labels{"db_name": db.Name},
+			nil, labels,
 		),
 		topicCount: prometheus.NewDesc(
 			"fossil_database_topics",
 			"Number of topics in the database.",
-			nil, prometheus.Labels{"db_name": db.Name},
+			nil, labels,
+		),
+		walSize: prometheus.NewDesc(
+			"fossil_database_wal_bytes",
+			"Size of the database's write-ahead log.",
+			nil, labels,
+		),
+		pendingAppends: prometheus.NewDesc(
+			"fossil_database_pending_appends",
+			"Number of appends since the database was last serialized.",
+			nil, labels,
+		),
+		serializeDuration: prometheus.NewDesc(
+			"fossil_database_last_serialize_duration_seconds",
+			"How long the last serialization of the database took.",
+			nil, labels,
+		),
+		appendDuration: prometheus.NewDesc(
+			"fossil_database_append_duration_seconds",
+			"Time taken by appends, including writing them to the write-ahead log.",
+			nil, labels,
+		),
+		retrievedEntries: prometheus.NewDesc(
+			"fossil_database_query_retrieved_entries",
+			"Number of entries retrieved by each query, before its pipeline runs.",
+			nil, labels,
+		),
+		diskBytes: prometheus.NewDesc(
+			"fossil_database_disk_bytes",
+			"Size of the database on disk, including its segments, metadata and write-ahead log.",
+			nil, labels,
+		),
+		appends: prometheus.NewDesc(
+			"fossil_database_appends_total",
+			"Number of entries appended since the database was opened.",
+			nil, labels,
+		),
+		serializations: prometheus.NewDesc(
+			"fossil_database_serializations_total",
+			"Number of times the database was serialized since it was opened.",
+			nil, labels,
+		),
+		clockSkews: prometheus.NewDesc(
+			"fossil_database_clock_skews_total",
+			"Number of appends made while the clock was behind the previous append, which were clamped to its timestamp.",
+			nil, labels,
+		),
+		planCacheHits: prometheus.NewDesc(
+			"fossil_database_plan_cache_hits_total",
+			"Number of queries whose type checked plan was reused from the plan cache.",
+			nil, labels,
+		),
+		planCacheMisses: prometheus.NewDesc(
+			"fossil_database_plan_cache_misses_total",
+			"Number of queries which had to be parsed and type checked, since no current plan was cached.",
+			nil, labels,
+		),
+		duplicateAppends: prometheus.NewDesc(
+			"fossil_database_duplicate_appends_total",
+			"Number of appends acknowledged but not stored, since their payload was appended to the same topic within its dedup window.",
+			nil, labels,
+		),
+		slowAppends: prometheus.NewDesc(
+			"fossil_database_slow_appends_total",
+			"Number of appends which took longer than the slow append threshold.",
+			nil, labels,
+		),
+		slowFlushes: prometheus.NewDesc(
+			"fossil_database_slow_flushes_total",
+			"Number of write-ahead log writes and serializations which took longer than the slow flush threshold.",
+			nil, labels,
 		),
 	}
 }
@@ -38,6 +123,20 @@ func NewDBStatsCollector(db *database.Database) prometheus.Collector {
 func (c *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.segments
 	ch <- c.topicCount
+	ch <- c.walSize
+	ch <- c.pendingAppends
+	ch <- c.serializeDuration
+	ch <- c.appendDuration
+	ch <- c.retrievedEntries
+	ch <- c.diskBytes
+	ch <- c.appends
+	ch <- c.serializations
+	ch <- c.clockSkews
+	ch <- c.planCacheHits
+	ch <- c.planCacheMisses
+	ch <- c.duplicateAppends
+	ch <- c.slowAppends
+	ch <- c.slowFlushes
 }
 
 // Collect implements Collector.
@@ -45,4 +144,19 @@ func (c *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
 	stats := c.db.Stats()
 	ch <- prometheus.MustNewConstMetric(c.segments, prometheus.GaugeValue, float64(stats.Segments))
 	ch <- prometheus.MustNewConstMetric(c.topicCount, prometheus.GaugeValue, float64(stats.TopicCount))
+	ch <- prometheus.MustNewConstMetric(c.walSize, prometheus.GaugeValue, float64(stats.WALSize))
+	ch <- prometheus.MustNewConstMetric(c.pendingAppends, prometheus.GaugeValue, float64(stats.PendingAppends))
+	ch <- prometheus.MustNewConstMetric(c.serializeDuration, prometheus.GaugeValue, stats.SerializeDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.diskBytes, prometheus.GaugeValue, float64(stats.DiskSize))
+	ch <- prometheus.MustNewConstMetric(c.appends, prometheus.CounterValue, float64(stats.Appends))
+	ch <- prometheus.MustNewConstMetric(c.serializations, prometheus.CounterValue, float64(stats.Serializations))
+	ch <- prometheus.MustNewConstMetric(c.clockSkews, prometheus.CounterValue, float64(stats.ClockSkews))
+	ch <- prometheus.MustNewConstMetric(c.planCacheHits, prometheus.CounterValue, float64(stats.PlanCacheHits))
+	ch <- prometheus.MustNewConstMetric(c.planCacheMisses, prometheus.CounterValue, float64(stats.PlanCacheMisses))
+	ch <- prometheus.MustNewConstMetric(c.duplicateAppends, prometheus.CounterValue, float64(stats.DuplicateAppends))
+	ch <- prometheus.MustNewConstMetric(c.slowAppends, prometheus.CounterValue, float64(stats.SlowAppends))
+	ch <- prometheus.MustNewConstMetric(c.slowFlushes, prometheus.CounterValue, float64(stats.SlowFlushes))
+	// The database only keeps totals, so these are summaries without quantiles
+	ch <- prometheus.MustNewConstSummary(c.appendDuration, stats.Appends, stats.AppendTime.Seconds(), nil)
+	ch <- prometheus.MustNewConstSummary(c.retrievedEntries, stats.Queries, float64(stats.RetrievedEntries), nil)
 }
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd
+
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+// diskFree can't determine free space on this platform
+func diskFree(path string) (uint64, bool) {
+	return 0, false
+}
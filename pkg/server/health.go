@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/database"
+)
+
+// MinDiskHeadroom is the free space a database's disk needs for the database
+// to be ready
+const MinDiskHeadroom = 64 << 20
+
+// DatabaseHealth is the health of a single database
+type DatabaseHealth struct {
+	Ready bool `json:"ready"`
+	// LastFlush is when the database was last serialized to disk
+	LastFlush time.Time `json:"last_flush"`
+	// FlushError is the error the last flush failed with, if it did
+	FlushError string `json:"flush_error,omitempty"`
+	// WALBytes and PendingAppends are the backlog of data which only lives
+	// in the write-ahead log
+	WALBytes       int64 `json:"wal_bytes"`
+	PendingAppends int   `json:"pending_appends"`
+	// DiskFreeBytes is the space available on the database's disk, if it
+	// can be determined on this platform
+	DiskFreeBytes *uint64 `json:"disk_free_bytes,omitempty"`
+	// Problems lists why the database isn't ready
+	Problems []string `json:"problems,omitempty"`
+}
+
+// Health is the health of a server and its databases
+type Health struct {
+	Ready     bool                      `json:"ready"`
+	Uptime    string                    `json:"uptime"`
+	Databases map[string]DatabaseHealth `json:"databases"`
+}
+
+// Health reports the health of each database served by s. A server is ready
+// when all of its databases are: their last flush succeeded, and their disk
+// has at least MinDiskHeadroom free.
+func (s *Server) Health() Health {
+	h := Health{
+		Ready:     true,
+		Uptime:    time.Since(s.startupTime).Round(time.Second).String(),
+		Databases: make(map[string]DatabaseHealth, len(s.dbMap)),
+	}
+
+	for name, db := range s.dbMap {
+		dbHealth := databaseHealth(db)
+		h.Ready = h.Ready && dbHealth.Ready
+		h.Databases[name] = dbHealth
+	}
+	return h
+}
+
+func databaseHealth(db *database.Database) DatabaseHealth {
+	stats := db.Stats()
+	h := DatabaseHealth{
+		LastFlush:      stats.SerializeTime,
+		WALBytes:       stats.WALSize,
+		PendingAppends: stats.PendingAppends,
+	}
+
+	if stats.FlushError != nil {
+		h.FlushError = stats.FlushError.Error()
+		h.Problems = append(h.Problems, "the last flush failed")
+	}
+	if free, ok := diskFree(db.Path); ok {
+		h.DiskFreeBytes = &free
+		if free < MinDiskHeadroom {
+			h.Problems = append(h.Problems, fmt.Sprintf("less than %d bytes of disk are free", MinDiskHeadroom))
+		}
+	}
+
+	h.Ready = len(h.Problems) == 0
+	return h
+}
+
+// healthHandler serves the server's health as JSON. For readiness checks, the
+// status is 503 if the server isn't ready; liveness checks only need a
+// response.
+func (s *Server) healthHandler(readiness bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := s.Health()
+
+		w.Header().Set("Content-Type", "application/json")
+		if readiness && !h.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(h)
+	})
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/database"
+)
+
+func TestHealth(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Append([]byte("data"), "/logs"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{startupTime: time.Now(), dbMap: map[string]*database.Database{"test": db}}
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		rec := httptest.NewRecorder()
+		s.healthHandler(path == "/readyz").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", path, rec.Code)
+		}
+
+		h := Health{}
+		if err = json.Unmarshal(rec.Body.Bytes(), &h); err != nil {
+			t.Fatal(err)
+		}
+		dbHealth, ok := h.Databases["test"]
+		if !ok || !h.Ready || !dbHealth.Ready {
+			t.Errorf("%s: expected a ready database, got %+v", path, h)
+		}
+		if dbHealth.PendingAppends != 1 || dbHealth.WALBytes == 0 {
+			t.Errorf("%s: expected the append to be pending in the WAL, got %+v", path, dbHealth)
+		}
+	}
+
+	if err = db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	dbHealth := s.Health().Databases["test"]
+	if dbHealth.PendingAppends != 0 || dbHealth.LastFlush.IsZero() {
+		t.Errorf("expected nothing to be pending after a flush, got %+v", dbHealth)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+// DefaultIdempotencyWindow is how long the server remembers the idempotency
+// keys of appends, unless configured otherwise
+const DefaultIdempotencyWindow = 10 * time.Minute
+
+// appendKey identifies an append sent with an idempotency key. Keys are
+// scoped to the database appended to.
+type appendKey struct {
+	db  string
+	key string
+}
+
+// keyedAppend is an append sent with an idempotency key. done is closed once
+// it has been applied, after which expires is set.
+type keyedAppend struct {
+	done     chan struct{}
+	response proto.Message
+	expires  time.Time
+}
+
+// appendKeys remembers the responses to appends sent with idempotency keys
+// for a window of time, so that a client retrying an append which already
+// landed is acknowledged without it being appended twice
+type appendKeys struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	appends map[appendKey]*keyedAppend
+	// applied lists the keys of applied appends, oldest first, so that they
+	// can be forgotten once they expire
+	applied []appendKey
+}
+
+func newAppendKeys(window time.Duration) *appendKeys {
+	return &appendKeys{window: window, appends: make(map[appendKey]*keyedAppend)}
+}
+
+// apply calls fn to apply the append identified by db and key, unless an
+// append with the same key was already applied within the window, in which
+// case its response is returned instead. Duplicates sent while the first is
+// being applied wait for it. Failed appends aren't remembered, so that they
+// can be retried. The returned bool is true for duplicates.
+func (k *appendKeys) apply(db, key string, fn func() proto.Message) (proto.Message, bool) {
+	id := appendKey{db: db, key: key}
+
+	for {
+		k.mu.Lock()
+		k.expire(time.Now())
+		a, ok := k.appends[id]
+		if !ok {
+			a = &keyedAppend{done: make(chan struct{})}
+			k.appends[id] = a
+			k.mu.Unlock()
+			break
+		}
+		k.mu.Unlock()
+
+		<-a.done
+		if a.response != nil {
+			return a.response, true
+		}
+		// The first attempt failed, so go again
+	}
+
+	resp := fn()
+
+	k.mu.Lock()
+	a := k.appends[id]
+	if resp.Command() == proto.CommandError {
+		delete(k.appends, id)
+	} else {
+		a.response = resp
+		a.expires = time.Now().Add(k.window)
+		k.applied = append(k.applied, id)
+	}
+	k.mu.Unlock()
+	close(a.done)
+
+	return resp, false
+}
+
+// expire forgets the keys of appends applied longer than the window ago. It
+// must be called with mu held.
+func (k *appendKeys) expire(now time.Time) {
+	n := 0
+	for n < len(k.applied) && !k.appends[k.applied[n]].expires.After(now) {
+		delete(k.appends, k.applied[n])
+		n++
+	}
+	k.applied = k.applied[n:]
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/rs/zerolog"
+)
+
+func TestDeduplicateAppends(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{log: zerolog.Nop()}
+	s.DeduplicateAppends(time.Hour)
+
+	appendWithKey := func(key string) proto.Message {
+		t.Helper()
+		var buf bytes.Buffer
+		m := proto.NewMessageWithType(proto.CommandAppend, proto.AppendRequest{Topic: "/foo", Data: []byte("data"), IdempotencyKey: key})
+		s.HandleAppend(proto.NewResponseWriter(&buf), proto.NewRequest(m, db))
+		resp, err := proto.ReadMessageFull(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, key := range []string{"a", "a", "b", ""} {
+		if resp := appendWithKey(key); resp.Command() != proto.CommandOk {
+			t.Fatalf("expected append with key %q to be acknowledged, got %s", key, resp.Command())
+		}
+	}
+	if entries := db.Retrieve(database.Query{}); len(entries) != 3 {
+		t.Errorf("expected the retried append to be applied once, got %d entries", len(entries))
+	}
+
+	// Keys are forgotten once the window passes
+	s.DeduplicateAppends(time.Nanosecond)
+	appendWithKey("c")
+	time.Sleep(time.Millisecond)
+	appendWithKey("c")
+	if entries := db.Retrieve(database.Query{}); len(entries) != 5 {
+		t.Errorf("expected appends to be applied again once their key expires, got %d entries", len(entries))
+	}
+}
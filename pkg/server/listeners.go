@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Names of the listeners the server always has, which label their metrics
+const (
+	DefaultListener = "default"
+	UnixListener    = "unix"
+	AdminListener   = "admin"
+)
+
+// ListenerConfig configures an extra listener the server serves its databases
+// on, alongside its port
+type ListenerConfig struct {
+	// Name labels the metrics of the listener
+	Name string
+	// Address is the address of the interface to listen on, or every
+	// interface if empty
+	Address string
+	Port    int
+	// Database, if set, is the only database served on the listener, which
+	// connections start out using
+	Database string
+	// TLSCert and TLSKey are the paths of a PEM encoded certificate and its
+	// key. If set, the listener only accepts TLS connections.
+	TLSCert string
+	TLSKey  string
+}
+
+// ServeListener serves the databases on the listener configured by l
+func (s *Server) ServeListener(l ListenerConfig) {
+	log := s.log.With().Str("listener", l.Name).Logger()
+
+	err := s.serveListener(l)
+	if err != nil {
+		log.Error().Err(err).Msg("error listening and serving")
+	}
+}
+
+func (s *Server) serveListener(l ListenerConfig) error {
+	srv := s.messageServer(l.Name)
+	if l.Database != "" {
+		db, ok := s.dbMap[l.Database]
+		if !ok {
+			return fmt.Errorf("unknown database '%s'", l.Database)
+		}
+		srv.dbName, srv.db = l.Database, db
+	}
+
+	sock, err := net.Listen("tcp", net.JoinHostPort(l.Address, strconv.Itoa(l.Port)))
+	if err != nil {
+		return err
+	}
+
+	if l.TLSCert != "" || l.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(l.TLSCert, l.TLSKey)
+		if err != nil {
+			sock.Close()
+			return err
+		}
+		sock = tls.NewListener(sock, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	s.log.Info().Str("listener", l.Name).Str("address", sock.Addr().String()).Str("database", l.Database).Msg("listening...")
+
+	return srv.Serve(sock, s.mux())
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/tracing"
+	"github.com/rs/zerolog"
+)
+
+func TestListenerDatabase(t *testing.T) {
+	dbMap := make(map[string]*database.Database)
+	for _, name := range []string{"default", "billing"} {
+		db, err := database.NewDatabase(name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbMap[name] = db
+	}
+
+	s := &Server{
+		log:     zerolog.Nop(),
+		metrics: NewMetricsStore(),
+		dbMap:   dbMap,
+		tracer:  tracing.Nop,
+	}
+
+	srv := s.messageServer("billing")
+	srv.dbName, srv.db = "billing", dbMap["billing"]
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	go srv.Serve(sock, s.mux())
+
+	client, err := net.Dial("tcp", sock.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	send := func(m proto.Message) string {
+		b, _ := m.Marshal()
+		if _, err := client.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := proto.ReadMessageFull(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Command()
+	}
+
+	// Connections start out using the listener's database
+	create := proto.NewMessageWithType(proto.CommandCreate, proto.CreateTopicRequest{Topic: "/invoices"})
+	if cmd := send(create); cmd != proto.CommandOk {
+		t.Fatalf("expected CREATE to use the listener's database, got %s", cmd)
+	}
+	if !dbMap["billing"].TopicExists("/invoices") || dbMap["default"].TopicExists("/invoices") {
+		t.Error("expected the topic to be created in the listener's database")
+	}
+
+	// and can't use any other
+	if cmd := send(proto.NewMessageWithType(proto.CommandUse, proto.UseRequest{DbName: "default"})); cmd != proto.MessageErrorUnknownDb.Command() {
+		t.Errorf("expected USE of another database to be rejected like an unknown one, got %s", cmd)
+	}
+	if cmd := send(proto.NewMessageWithType(proto.CommandUse, proto.UseRequest{DbName: "billing"})); cmd != proto.CommandOk {
+		t.Errorf("expected USE of the listener's database to succeed, got %s", cmd)
+	}
+}
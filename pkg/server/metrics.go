@@ -22,14 +22,14 @@ type MetricsStore interface {
 	Handler() http.Handler
 
 	// Collection
-	IncClientConnection()
-	IncRequests(db, cmd string)
-	ObserveResponseNS(db, cmd string, t int64)
+	IncClientConnection(listener string)
+	IncRequests(listener, db, cmd string)
+	ObserveResponseNS(listener, db, cmd string, t int64)
 }
 
 type metricsStore struct {
 	registry          *prometheus.Registry
-	ClientConnections prometheus.Counter
+	ClientConnections *prometheus.CounterVec
 	Requests          *prometheus.CounterVec
 	ResponseNS        *prometheus.HistogramVec
 }
@@ -37,6 +37,7 @@ type metricsStore struct {
 var (
 	DatabaseLabel = "database"
 	CommandLabel  = "cmd"
+	ListenerLabel = "listener"
 )
 
 func NewMetricsStore() MetricsStore {
@@ -55,19 +56,19 @@ func NewMetricsStore() MetricsStore {
 	factory := promauto.With(reg)
 	return &metricsStore{
 		registry: reg,
-		ClientConnections: factory.NewCounter(prometheus.CounterOpts{
+		ClientConnections: factory.NewCounterVec(prometheus.CounterOpts{
 			Name: "fossil_client_connections",
 			Help: "The total number of client connections",
-		}),
+		}, []string{ListenerLabel}),
 		Requests: factory.NewCounterVec(prometheus.CounterOpts{
 			Name: "fossil_requests",
 			Help: "Request counts for the fossil commands",
-		}, []string{DatabaseLabel, CommandLabel}),
+		}, []string{ListenerLabel, DatabaseLabel, CommandLabel}),
 		ResponseNS: factory.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    "fossil_response_ns",
 			Help:    "Response times on commands made against a database",
 			Buckets: buckets,
-		}, []string{DatabaseLabel, CommandLabel}),
+		}, []string{ListenerLabel, DatabaseLabel, CommandLabel}),
 	}
 }
 
@@ -83,16 +84,16 @@ func (ms *metricsStore) Handler() http.Handler {
 	return promhttp.HandlerFor(ms.Registry(), promhttp.HandlerOpts{Registry: ms.Registry()})
 }
 
-func (ms *metricsStore) IncClientConnection() {
-	ms.ClientConnections.Inc()
+func (ms *metricsStore) IncClientConnection(listener string) {
+	ms.ClientConnections.With(prometheus.Labels{ListenerLabel: listener}).Inc()
 }
 
-func (ms *metricsStore) IncRequests(db, cmd string) {
-	ms.Requests.With(prometheus.Labels{CommandLabel: cmd, DatabaseLabel: db}).Inc()
+func (ms *metricsStore) IncRequests(listener, db, cmd string) {
+	ms.Requests.With(prometheus.Labels{ListenerLabel: listener, CommandLabel: cmd, DatabaseLabel: db}).Inc()
 }
 
-func (ms *metricsStore) ObserveResponseNS(db, cmd string, t int64) {
+func (ms *metricsStore) ObserveResponseNS(listener, db, cmd string, t int64) {
 	ms.ResponseNS.
-		With(prometheus.Labels{CommandLabel: cmd, DatabaseLabel: db}).
+		With(prometheus.Labels{ListenerLabel: listener, CommandLabel: cmd, DatabaseLabel: db}).
 		Observe(float64(t))
 }
@@ -7,8 +7,13 @@
 package server
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync/atomic"
 
 	"github.com/dburkart/fossil/pkg/database"
 	"github.com/dburkart/fossil/pkg/proto"
@@ -16,7 +21,7 @@ import (
 )
 
 type MessageMux interface {
-	ServeMessage(c *conn, r *proto.Request)
+	ServeMessage(rw proto.ResponseWriter, c *conn, r *proto.Request)
 	Handle(s string, f MessageHandler)
 	HandleState(s string, f MessageStateHandler)
 }
@@ -36,20 +41,20 @@ func NewMapMux() MessageMux {
 	}
 }
 
-func (mm *MapMux) ServeMessage(c *conn, r *proto.Request) {
+func (mm *MapMux) ServeMessage(rw proto.ResponseWriter, c *conn, r *proto.Request) {
 	sf, ok := mm.stateHandlers[r.Command()]
 	if ok {
-		sf(c.rw, c, r)
+		sf(rw, c, r)
 		return
 	}
 
 	f, ok := mm.handlers[r.Command()]
 	if !ok {
 		// NO OP for commands that do not exist
-		c.rw.WriteMessage(proto.MessageErrorCommandNotFound)
+		rw.WriteMessage(proto.MessageErrorCommandNotFound)
 		return
 	}
-	f(c.rw, r)
+	f(rw, r)
 }
 
 func (mm *MapMux) Handle(s string, f MessageHandler) {
@@ -63,51 +68,119 @@ func (mm *MapMux) HandleState(s string, f MessageStateHandler) {
 type MessageServer struct {
 	log          zerolog.Logger
 	metricsStore MetricsStore
+	limits       proto.Limits
+	acls         proto.TopicACLs
+	timeouts     Timeouts
+	// listener names the listener in metrics and requests
+	listener string
+	// dbName and db, if set, are the only database connections may use
+	dbName string
+	db     *database.Database
 }
 
-func NewMessageServer(log zerolog.Logger, metricsStore MetricsStore) MessageServer {
+func NewMessageServer(log zerolog.Logger, metricsStore MetricsStore, limits proto.Limits, acls proto.TopicACLs, timeouts Timeouts) MessageServer {
 	return MessageServer{
 		log,
 		metricsStore,
+		limits,
+		acls,
+		timeouts,
+		"",
+		"",
+		nil,
 	}
 }
 
+// ListenAndServe serves mux on port, over both IPv4 and IPv6
 func (ms *MessageServer) ListenAndServe(port int, mux MessageMux) error {
-	sock, err := net.ListenTCP("tcp4", &net.TCPAddr{Port: port})
+	sock, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		ms.log.Error().Err(err).Int("port", port).Msg("unable to listen on port")
 		return nil
 	}
 	ms.log.Info().Int("port", port).Msg("listening...")
 
+	return ms.Serve(sock, mux)
+}
+
+// ListenAndServeUnix serves mux on the unix socket at path. A socket left
+// behind at path by a previous server is removed first.
+func (ms *MessageServer) ListenAndServeUnix(path string, mux MessageMux) error {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		ms.log.Error().Err(err).Str("socket", path).Msg("unable to listen on unix socket")
+		return nil
+	}
+	ms.log.Info().Str("socket", path).Msg("listening...")
+
+	return ms.Serve(sock, mux)
+}
+
+// Serve serves mux on each connection accepted from sock
+func (ms *MessageServer) Serve(sock net.Listener, mux MessageMux) error {
 	for {
-		conn, err := sock.AcceptTCP()
+		conn, err := sock.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
 			ms.log.Error().Err(err).Msg("unable to accept connection on collection socket")
+			continue
 		}
 
-		c := newConn(ms.log, mux)
+		c := newConn(ms.log, mux, ms.limits)
+		c.acl = ms.acls.For(conn.RemoteAddr())
+		c.timeouts = ms.timeouts
+		c.listener = ms.listener
+		if ms.db != nil {
+			c.SetDatabase(ms.dbName, ms.db)
+			c.pinned = true
+		}
 		go c.Handle(conn)
-		ms.metricsStore.IncClientConnection()
+		ms.metricsStore.IncClientConnection(ms.listener)
 	}
 }
 
 type conn struct {
 	log zerolog.Logger
-	c   *net.TCPConn
-	rw  proto.ResponseWriter
+	c   net.Conn
+	// responses is the queue every response to the connection is written
+	// through
+	responses *responseQueue
 
-	mux MessageMux
+	mux      MessageMux
+	limits   proto.Limits
+	timeouts Timeouts
+	acl      *proto.TopicACL
+
+	// compression is the algorithm negotiated with VERSION, which large
+	// responses are compressed with. It's set by the VERSION handler while
+	// the connection reads its next message, so is accessed atomically.
+	compression atomic.Pointer[string]
+	// notices is set once the client negotiates a version which accepts
+	// notices
+	notices atomic.Bool
+	// authenticated is set once the connection authenticates with AUTH
+	authenticated atomic.Bool
+	// listener is the name of the listener the connection was accepted on
+	listener string
+	// pinned is set for connections which may only use their database
+	pinned bool
 
 	// state
 	dbName string
 	db     *database.Database
 }
 
-func newConn(log zerolog.Logger, mux MessageMux) *conn {
+func newConn(log zerolog.Logger, mux MessageMux, limits proto.Limits) *conn {
 	return &conn{
-		log: log,
-		mux: mux,
+		log:    log,
+		mux:    mux,
+		limits: limits,
 	}
 }
 
@@ -116,27 +189,72 @@ func (c *conn) SetDatabase(name string, db *database.Database) {
 	c.db = db
 }
 
-func (c conn) DatabaseName() string {
+func (c *conn) DatabaseName() string {
 	return c.dbName
 }
 
-func (c *conn) Handle(conn *net.TCPConn) {
+// Compression returns the algorithm negotiated with VERSION, or "" if there
+// is none
+func (c *conn) Compression() string {
+	if algorithm := c.compression.Load(); algorithm != nil {
+		return *algorithm
+	}
+	return ""
+}
+
+func (c *conn) Handle(conn net.Conn) {
 	c.c = conn
 	defer c.c.Close()
 
-	c.rw = proto.NewResponseWriter(c.c)
+	c.responses = newResponseQueue(c.c)
+	r := bufio.NewReader(c.c)
 
 	for {
-		msg, err := proto.ReadMessageFull(c.c)
+		msg, waitingFor, err := c.readMessage(r)
+		var limitErr proto.LimitError
 		if err == io.EOF {
 			c.log.Info().Msg("client disconnected")
 			return
+		} else if isTimeout(err) {
+			if waitingFor == "idle" {
+				c.notify(proto.Notice{
+					Level:   proto.NoticeInfo,
+					Message: fmt.Sprintf("closing connection, which was idle for longer than %s", c.timeouts.Idle),
+				})
+			}
+			c.log.Warn().Str("client", c.c.RemoteAddr().String()).Str("timeout", waitingFor).Msg("disconnecting client which timed out")
+			return
+		} else if errors.Is(err, io.ErrUnexpectedEOF) {
+			c.log.Warn().Str("client", c.c.RemoteAddr().String()).Msg("client disconnected partway through a message")
+			return
+		} else if errors.As(err, &limitErr) {
+			c.respond(proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 509, Err: err}))
+			c.log.Warn().Err(err).Msg("rejected message")
+			continue
 		} else if err != nil {
-			c.rw.WriteMessage(proto.MessageErrorMalformedMessage)
+			c.respond(proto.MessageErrorMalformedMessage)
 			c.log.Error().Err(err).Msg("error parsing message from []bytes")
 			continue
 		}
 		c.log.Trace().Object("msg", msg).Msg("parsed message")
-		go c.mux.ServeMessage(c, proto.NewRequest(msg, c.db))
+		r := proto.NewRequestWithACL(msg, c.db, c.acl).WithCompression(c.Compression()).WithRemoteAddr(c.c.RemoteAddr().String()).WithListener(c.listener)
+		if msg.RequestID() == "" {
+			r.WithRequestID(proto.NewRequestID())
+		}
+
+		// Clients which sent a request ID get it back with the response
+		rw, done := c.responses.writerFor(r)
+		rw = rw.WithNotices(c.notices.Load())
+		go func() {
+			defer done()
+			c.mux.ServeMessage(rw, c, r)
+		}()
 	}
 }
+
+// respond writes m in response to a message which couldn't be read
+func (c *conn) respond(m proto.Message) {
+	rw, done := c.responses.ordered()
+	rw.WriteMessage(m)
+	done()
+}
@@ -7,9 +7,13 @@
 package server
 
 import (
+	"io"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/rs/zerolog"
 )
 
 var resCmd string
@@ -74,10 +78,11 @@ func BenchmarkAllMessageTypes(b *testing.B) {
 	}
 
 	c := &conn{}
+	rw := proto.NewResponseWriter(io.Discard)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		mux.ServeMessage(c, tests[i%len(tests)])
+		mux.ServeMessage(rw, c, tests[i%len(tests)])
 	}
 }
 
@@ -94,10 +99,11 @@ func BenchmarkAppendMessageUnmarshal(b *testing.B) {
 	}
 
 	c := &conn{}
+	rw := proto.NewResponseWriter(io.Discard)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		mux.ServeMessage(c, tests[i%len(tests)])
+		mux.ServeMessage(rw, c, tests[i%len(tests)])
 	}
 }
 
@@ -114,10 +120,11 @@ func BenchmarkQueryMessageUnmarshal(b *testing.B) {
 	}
 
 	c := &conn{}
+	rw := proto.NewResponseWriter(io.Discard)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		mux.ServeMessage(c, tests[i%len(tests)])
+		mux.ServeMessage(rw, c, tests[i%len(tests)])
 	}
 }
 
@@ -134,9 +141,183 @@ func BenchmarkUseMessageUnmarshal(b *testing.B) {
 	}
 
 	c := &conn{}
+	rw := proto.NewResponseWriter(io.Discard)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		mux.ServeMessage(c, tests[i%len(tests)])
+		mux.ServeMessage(rw, c, tests[i%len(tests)])
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	ids := make(chan string, 1)
+	mux := NewMapMux()
+	mux.Handle(proto.CommandFlush, func(rw proto.ResponseWriter, r *proto.Request) {
+		ids <- r.RequestID()
+		rw.WriteMessage(proto.MessageOk)
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go newConn(zerolog.Nop(), mux, proto.Limits{}).Handle(server)
+
+	send := func(m proto.Message) (proto.Message, string) {
+		b, _ := m.Marshal()
+		go client.Write(b)
+		resp, err := proto.ReadMessageFull(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, <-ids
+	}
+
+	// A client's request ID is handled under, and returned with the response
+	resp, id := send(proto.WithRequestID(proto.NewMessage(proto.CommandFlush, nil), "abc123"))
+	if id != "abc123" || resp.RequestID() != "abc123" {
+		t.Errorf("expected request ID abc123 to be used and returned, got %q and %q", id, resp.RequestID())
+	}
+
+	// Requests without one get one generated, which isn't sent back to clients
+	// which wouldn't understand it
+	resp, id = send(proto.NewMessage(proto.CommandFlush, nil))
+	if id == "" || resp.RequestID() != "" {
+		t.Errorf("expected a generated request ID which isn't returned, got %q and %q", id, resp.RequestID())
+	}
+}
+
+func TestResponseOrder(t *testing.T) {
+	release := make(chan struct{})
+	mux := NewMapMux()
+	mux.Handle(proto.CommandFlush, func(rw proto.ResponseWriter, r *proto.Request) {
+		<-release
+		rw.WriteMessage(proto.NewMessage(proto.CommandOk, []byte(r.Command())))
+	})
+	mux.Handle(proto.CommandPing, func(rw proto.ResponseWriter, r *proto.Request) {
+		rw.WriteMessage(proto.NewMessage(proto.CommandOk, []byte(r.Command())))
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go newConn(zerolog.Nop(), mux, proto.Limits{}).Handle(server)
+
+	pipeline := func(msgs ...proto.Message) {
+		var b []byte
+		for _, m := range msgs {
+			mb, _ := m.Marshal()
+			b = append(b, mb...)
+		}
+		go client.Write(b)
+	}
+	expect := func(command string) {
+		t.Helper()
+		resp, err := proto.ReadMessageFull(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Data()) != command {
+			t.Errorf("expected the response to %s, got the response to %s", command, resp.Data())
+		}
+	}
+
+	// Without request IDs, responses are written in the order of requests,
+	// even when a later one is handled first
+	pipeline(proto.NewMessage(proto.CommandFlush, nil), proto.NewMessage(proto.CommandPing, nil))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		release <- struct{}{}
+	}()
+	expect(proto.CommandFlush)
+	expect(proto.CommandPing)
+
+	// With request IDs, responses are written as soon as they're ready
+	pipeline(
+		proto.WithRequestID(proto.NewMessage(proto.CommandFlush, nil), "a"),
+		proto.WithRequestID(proto.NewMessage(proto.CommandPing, nil), "b"),
+	)
+	expect(proto.CommandPing)
+	release <- struct{}{}
+	expect(proto.CommandFlush)
+}
+
+func TestNotices(t *testing.T) {
+	mux := NewMapMux()
+	mux.Handle(proto.CommandFlush, func(rw proto.ResponseWriter, r *proto.Request) {
+		rw.WriteNotice(proto.Notice{Level: proto.NoticeWarning, Message: "heads up"})
+		rw.WriteMessage(proto.MessageOk)
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newConn(zerolog.Nop(), mux, proto.Limits{})
+	go c.Handle(server)
+
+	send := func(m proto.Message) proto.Message {
+		b, _ := m.Marshal()
+		go client.Write(b)
+		resp, err := proto.ReadMessageFull(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Clients which haven't negotiated a version accepting notices would take
+	// one for their response, so aren't sent any
+	if resp := send(proto.NewMessage(proto.CommandFlush, nil)); resp.Command() != proto.CommandOk {
+		t.Fatalf("expected no notice ahead of the response, got %s", resp.Command())
+	}
+
+	// Otherwise notices come ahead of the response, with its request ID
+	c.notices.Store(true)
+	resp := send(proto.WithRequestID(proto.NewMessage(proto.CommandFlush, nil), "abc123"))
+	n := proto.Notice{}
+	if resp.Command() != proto.CommandNotice || resp.RequestID() != "abc123" || proto.Unmarshal(resp.Data(), &n) != nil || n.Message != "heads up" {
+		t.Fatalf("expected a notice for request abc123, got %s %q for %q", resp.Command(), resp.Data(), resp.RequestID())
+	}
+	resp, err := proto.ReadMessageFull(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Command() != proto.CommandOk {
+		t.Errorf("expected the response after the notice, got %s", resp.Command())
+	}
+}
+
+func TestConnNegotiatesCompression(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	negotiated := make(chan string, 100)
+	s := &Server{log: zerolog.Nop()}
+	mux := NewMapMux()
+	mux.HandleState(proto.CommandVersion, s.HandleVersion)
+	mux.Handle(proto.CommandPing, func(rw proto.ResponseWriter, r *proto.Request) {
+		negotiated <- r.Compression()
+		rw.WriteMessage(proto.MessageOk)
+	})
+	go newConn(zerolog.Nop(), mux, proto.Limits{}).Handle(server)
+
+	version, _ := proto.NewMessageWithType(proto.CommandVersion, proto.VersionRequest{Version: proto.Version, Compression: []string{proto.CompressionGzip}}).Marshal()
+	ping, _ := proto.NewMessageWithType(proto.CommandPing, proto.PingRequest{}).Marshal()
+
+	// Pings sent right behind the version are read while it's handled, and
+	// may or may not be compressed
+	pipelined := append(append([]byte{}, version...), append(ping, ping...)...)
+	go client.Write(pipelined)
+	for i := 0; i < 3; i++ {
+		if _, err := proto.ReadMessageFull(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-negotiated
+	<-negotiated
+
+	// Once the version is acknowledged, every request is compressed
+	go client.Write(ping)
+	if _, err := proto.ReadMessageFull(client); err != nil {
+		t.Fatal(err)
+	}
+	if algorithm := <-negotiated; algorithm != proto.CompressionGzip {
+		t.Errorf("expected requests to be compressed with %s once it's negotiated, got %q", proto.CompressionGzip, algorithm)
 	}
 }
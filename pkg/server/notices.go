@@ -0,0 +1,33 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+// Notices tell clients speaking proto.NoticesVersion or newer something which
+// isn't an error. A notice about a request is written ahead of its response,
+// through the request's ResponseWriter, so that it carries the request's ID
+// and isn't reordered with the response. Notices about the connection are
+// written on their own with notify.
+
+func notifyOrNop(notify func(proto.Notice)) func(proto.Notice) {
+	if notify == nil {
+		return func(proto.Notice) {}
+	}
+	return notify
+}
+
+// notify writes n to the connection out of turn, between responses, if the
+// client accepts notices
+func (c *conn) notify(n proto.Notice) {
+	if !c.notices.Load() {
+		return
+	}
+	proto.NewResponseWriter(c.responses).WithNotices(true).WriteNotice(n)
+}
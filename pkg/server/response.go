@@ -8,29 +8,114 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/dburkart/fossil/pkg/codec"
 	"github.com/dburkart/fossil/pkg/database"
 	"github.com/dburkart/fossil/pkg/proto"
 	"github.com/dburkart/fossil/pkg/query"
+	"github.com/dburkart/fossil/pkg/query/plan"
+	"github.com/dburkart/fossil/pkg/schema"
+	"github.com/dburkart/fossil/pkg/tracing"
+	"sort"
+	"strings"
+	"time"
 )
 
-func VersionResponse(_ proto.VersionRequest) proto.Message {
-	// We don't currently reject any versions, so respond with our own version
-	// announcement with an OK code.
-	versionResponse := proto.VersionResponse{Code: 200}
+// VersionResponse announces our own version, capabilities, and the oldest
+// client version we serve. Clients older than that are rejected with a 426
+// code; otherwise the code is 200, along with the compression we'll use.
+func VersionResponse(v proto.VersionRequest) proto.Message {
+	versionResponse := proto.VersionResponse{
+		Code:             200,
+		Capabilities:     proto.SupportedCapabilities,
+		MinClientVersion: proto.MinClientVersion,
+	}
+	if proto.CheckClientVersion(v.Version) != nil {
+		versionResponse.Code = 426
+	} else {
+		versionResponse.Compression = proto.NegotiateCompression(v.Compression)
+	}
 	return proto.NewMessageWithType(proto.CommandVersion, versionResponse)
 }
 
+// PingResponse echoes the time the ping was sent, along with when it was
+// received
+func PingResponse(p proto.PingRequest) proto.Message {
+	return proto.NewMessageWithType(proto.CommandPing, proto.PingResponse{Sent: p.Sent, Received: time.Now().UTC()})
+}
+
 func AppendResponse(a proto.AppendRequest, db *database.Database) proto.Message {
-	err := db.Append(a.Data, a.Topic)
+	return AppendResponseWithNotices(a, db, nil)
+}
+
+// AppendResponseWithNotices appends like AppendResponse, calling notify with
+// any notices about the append, such as that the topic it created inherited
+// its parent's schema
+func AppendResponseWithNotices(a proto.AppendRequest, db *database.Database, notify func(proto.Notice)) proto.Message {
+	notify = notifyOrNop(notify)
+	existed := db.TopicExists(a.Topic)
+	if !existed && !a.CreateTopic && db.StrictTopics() {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 404, Err: database.ErrTopicNotFound})
+	}
+
+	data, err := decodePayload(a, db)
+	if errors.Is(err, database.ErrTooManyTopics) {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 509, Err: err})
+	} else if err != nil {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 503, Err: err})
+	}
+
+	receipt, err := db.AppendOrCreateWithReceipt(data, a.Topic, a.TTL)
 	if err != nil {
 		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 503, Err: err})
-	} else {
+	}
+
+	// Topics created by appending to them take their parent's schema, which
+	// their data may not have been meant for
+	if !existed {
+		if s := db.InheritedSchema(a.Topic); s != nil {
+			notify(proto.Notice{
+				Level:   proto.NoticeInfo,
+				Message: fmt.Sprintf("created %s, which inherited the schema %s from its parent", a.Topic, s.ToSchema()),
+			})
+		}
+	}
+	if !a.Ack {
 		return proto.MessageOk
 	}
+
+	// Clients which asked for an acknowledgment are told where their data
+	// landed, so that they can find it again
+	resp := proto.AppendResponse{Code: 200, Time: receipt.Time.UTC(), Sequence: receipt.Sequence}
+	if receipt.Duplicate {
+		resp.Code = 208
+	}
+	return proto.NewMessageWithType(proto.CommandAppend, resp)
+}
+
+// decodePayload converts the data of an AppendRequest from the codec of its
+// topic into fossil's binary encoding
+func decodePayload(a proto.AppendRequest, db *database.Database) ([]byte, error) {
+	// Make sure the topic exists, so that implicitly created topics pick up
+	// the schema and codec of their parent
+	_, err := db.CreateTopic(a.Topic, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := codec.Lookup(db.CodecForTopic(a.Topic))
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Decode(a.Data, db.SchemaForTopic(a.Topic))
 }
 
-func ListResponse(l proto.ListRequest, db *database.Database, dbMap map[string]*database.Database) proto.Message {
+// ListResponse lists the objects l asks for. Topics, and their schemas, are
+// only listed if acl permits them.
+func ListResponse(l proto.ListRequest, db *database.Database, dbMap map[string]*database.Database, acl *proto.TopicACL) proto.Message {
 	resp := proto.ListResponse{
 		ObjectList: []string{},
 	}
@@ -45,15 +130,31 @@ func ListResponse(l proto.ListRequest, db *database.Database, dbMap map[string]*
 		}
 	} else if l.Object == "topics" {
 		for _, v := range db.TopicLookup {
-			resp.ObjectList = append(resp.ObjectList, v)
+			if acl.Permits(v) {
+				resp.ObjectList = append(resp.ObjectList, v)
+			}
+		}
+	} else if l.Object == "named-schemas" {
+		for name, schema := range db.NamedSchemas() {
+			resp.ObjectList = append(resp.ObjectList, fmt.Sprintf("%s %s", name, schema))
+		}
+		sort.Strings(resp.ObjectList)
+	} else if l.Object == "templates" {
+		// Templates are listed in the order they're matched
+		for _, t := range db.TopicTemplates() {
+			resp.ObjectList = append(resp.ObjectList, fmt.Sprintf("%s %s", t.Pattern, t.Schema))
 		}
 	} else if l.Object == "schemas" {
 		// Get our string object
 		str := db.SchemaLookup[0]
 		for idx, v := range db.TopicLookup {
 			schema := db.SchemaLookup[idx]
-			if schema != str {
-				resp.ObjectList = append(resp.ObjectList, fmt.Sprintf("%s %s", v, schema.ToSchema()))
+			if schema != str && acl.Permits(v) {
+				line := fmt.Sprintf("%s %s", v, schema.ToSchema())
+				if c := db.CodecForTopic(v); c != "" {
+					line += " " + c
+				}
+				resp.ObjectList = append(resp.ObjectList, line)
 			}
 		}
 	}
@@ -61,20 +162,311 @@ func ListResponse(l proto.ListRequest, db *database.Database, dbMap map[string]*
 	return proto.NewMessageWithType(proto.CommandList, resp)
 }
 
+// ListTopicsResponse returns a page of the topics in db which acl permits,
+// sorted by name
+func ListTopicsResponse(l proto.ListTopicsRequest, db *database.Database, acl *proto.TopicACL) proto.Message {
+	resp := proto.ListTopicsResponse{
+		Topics: []proto.TopicSummary{},
+	}
+
+	for _, info := range db.ListTopics() {
+		if !strings.HasPrefix(info.Topic, l.Prefix) || (l.After != "" && info.Topic <= l.After) || !acl.Permits(info.Topic) {
+			continue
+		}
+
+		// There's at least one more topic than fits on this page
+		if l.Limit > 0 && len(resp.Topics) == int(l.Limit) {
+			resp.Next = resp.Topics[len(resp.Topics)-1].Topic
+			break
+		}
+
+		resp.Topics = append(resp.Topics, proto.TopicSummary{
+			Topic:  info.Topic,
+			Schema: info.Schema.ToSchema(),
+			Codec:  info.Codec,
+			Count:  uint64(info.Count),
+		})
+	}
+
+	return proto.NewMessageWithType(proto.CommandTopics, resp)
+}
+
+// DatabaseStatusResponse describes each database in dbMap, sorted by name, or
+// just db if dbMap is nil. The databases have been open for uptime.
+func DatabaseStatusResponse(_ proto.DatabaseStatusRequest, db *database.Database, dbMap map[string]*database.Database, uptime time.Duration) proto.Message {
+	if dbMap == nil {
+		dbMap = map[string]*database.Database{db.Name: db}
+	}
+
+	resp := proto.DatabaseStatusResponse{
+		Databases: make([]proto.DatabaseStatus, 0, len(dbMap)),
+	}
+	for name, db := range dbMap {
+		stats := db.Stats()
+		status := proto.DatabaseOpen
+		if !databaseHealth(db).Ready {
+			status = proto.DatabaseDegraded
+		}
+		resp.Databases = append(resp.Databases, proto.DatabaseStatus{
+			Name:      name,
+			Status:    status,
+			Size:      uint64(stats.DiskSize),
+			Topics:    uint64(stats.TopicCount),
+			LastFlush: stats.SerializeTime,
+			Uptime:    uptime,
+		})
+	}
+	sort.Slice(resp.Databases, func(i, j int) bool {
+		return resp.Databases[i].Name < resp.Databases[j].Name
+	})
+
+	return proto.NewMessageWithType(proto.CommandDatabaseStatus, resp)
+}
+
 func QueryResponse(q proto.QueryRequest, db *database.Database) proto.Message {
-	stmt, err := query.Prepare(db, q.Query)
+	return RestrictedQueryResponse(q, db, nil)
+}
+
+// QueryResponseWithNotices runs a query like QueryResponse, calling notify
+// with any notices about it
+func QueryResponseWithNotices(q proto.QueryRequest, db *database.Database, notify func(proto.Notice)) proto.Message {
+	return tracedQueryResponse(context.Background(), tracing.Nop, q, db, nil, notify)
+}
+
+// RestrictedQueryResponse runs a query like QueryResponse, restricted to the
+// topics acl permits
+func RestrictedQueryResponse(q proto.QueryRequest, db *database.Database, acl *proto.TopicACL) proto.Message {
+	return tracedQueryResponse(context.Background(), tracing.Nop, q, db, acl, nil)
+}
+
+// tracedQueryResponse runs a query like RestrictedQueryResponse, with spans
+// around planning and executing it. Notices about the query are passed to
+// notify, unless it's nil.
+func tracedQueryResponse(ctx context.Context, tracer tracing.Tracer, q proto.QueryRequest, db *database.Database, acl *proto.TopicACL, notify func(proto.Notice)) proto.Message {
+	notify = notifyOrNop(notify)
+
+	var allowed func(string) bool
+	if acl != nil {
+		allowed = acl.Permits
+	}
+
+	_, span := tracer.Start(ctx, "fossil.query.prepare", tracing.String("fossil.query", q.Query))
+	stmt, err := query.PrepareRestricted(db, q.Query, allowed)
 	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+
+	if errors.Is(err, plan.ErrTopicDenied) {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 403, Err: err})
+	} else if errors.Is(err, query.ErrLimitExceeded) {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 509, Err: err})
+	} else if err != nil {
 		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 504, Err: err})
 	}
-	result := stmt.Execute()
+	resp := proto.QueryResponse{Sequences: q.Sequences}
+	var result database.Result
+
+	_, span = tracer.Start(ctx, "fossil.query.execute", tracing.String("fossil.query", q.Query))
+	defer span.End()
+	if q.Profile {
+		var stats []plan.StageStats
+		result, stats = stmt.ExecuteWithProfile()
+		resp.Profile = make(proto.QueryProfile, 0, len(stats))
+		for _, stage := range stats {
+			resp.Profile = append(resp.Profile, proto.QueryStage{
+				Name:     stage.Name,
+				RowsIn:   uint64(stage.RowsIn),
+				RowsOut:  uint64(stage.RowsOut),
+				Duration: stage.Duration,
+			})
+		}
+	} else {
+		result = stmt.Execute()
+	}
 
-	resp := proto.QueryResponse{}
+	span.SetAttributes(tracing.Int("fossil.results", len(result.Data)))
+
+	// Clients which asked for metadata can tell when results were
+	// truncated, so are sent as many as are allowed rather than an error
+	if q.Metadata {
+		matched := stmt.Truncate(&result)
+		resp.Metadata = &proto.QueryMetadata{
+			Matched:   uint64(matched),
+			Returned:  uint64(len(result.Data)),
+			Truncated: matched > len(result.Data),
+			Start:     stmt.Range.Start.UTC(),
+			End:       stmt.Range.End.UTC(),
+		}
+		if resp.Metadata.Truncated {
+			notify(proto.Notice{
+				Level:   proto.NoticeWarning,
+				Message: fmt.Sprintf("results truncated to %d of the %d entries matched", len(result.Data), matched),
+			})
+		}
+	} else if err = stmt.CheckResults(result); err != nil {
+		span.RecordError(err)
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 509, Err: err})
+	}
 	resp.Results = result.Data
 
 	return proto.NewMessageWithType(proto.CommandQuery, resp)
 }
 
 func CreateResponse(c proto.CreateTopicRequest, db *database.Database) proto.Message {
-	db.AddTopic(c.Topic, c.Schema)
+	cd, err := codec.Lookup(c.Codec)
+	if err != nil {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 508, Err: err})
+	}
+
+	// Binary is the default, so there's no need to record it
+	if cd.Name() == (codec.Binary{}).Name() {
+		c.Codec = ""
+	}
+
+	// Check the encoding applies to the topic's schema before creating it
+	if c.Encoding != "" {
+		var s schema.Object
+		s, _, err = db.ValidateTopic(c.Topic, c.Schema, c.Codec, c.Override)
+		if err == nil {
+			err = database.CheckEncoding(c.Encoding, s)
+		}
+	}
+
+	if err == nil && c.Override {
+		_, err = db.CreateTopicWithOverride(c.Topic, c.Schema, c.Codec)
+	} else if err == nil {
+		_, err = db.CreateTopic(c.Topic, c.Schema, c.Codec)
+	}
+	if err == nil && c.Encoding != "" {
+		err = db.SetTopicEncoding(c.Topic, c.Encoding)
+	}
+	if errors.Is(err, database.ErrTooManyTopics) {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 509, Err: err})
+	} else if err != nil {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 508, Err: err})
+	}
+	return proto.MessageOk
+}
+
+func CreateSchemaResponse(c proto.CreateSchemaRequest, db *database.Database) proto.Message {
+	err := db.AddSchema(c.Name, c.Schema)
+	if err != nil {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 508, Err: err})
+	}
+	return proto.MessageOk
+}
+
+func CreateTemplateResponse(c proto.CreateTemplateRequest, db *database.Database) proto.Message {
+	err := db.AddTopicTemplate(c.Pattern, c.Schema)
+	if err != nil {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 508, Err: err})
+	}
+	return proto.MessageOk
+}
+
+// ValidateResponse checks whether the append or topic creation described by v
+// would succeed, returning the ERR it would fail with if not. Payloads which
+// don't conform to the topic's schema are rejected with an error per field.
+func ValidateResponse(v proto.ValidateRequest, db *database.Database) proto.Message {
+	if !v.CreateTopic && !db.TopicExists(v.Topic) && db.StrictTopics() {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 404, Err: database.ErrTopicNotFound})
+	}
+
+	if v.Codec != "" {
+		if _, err := codec.Lookup(v.Codec); err != nil {
+			return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 508, Err: err})
+		}
+	}
+
+	s, codecName, err := db.ValidateTopic(v.Topic, v.Schema, v.Codec, v.Override)
+	if errors.Is(err, database.ErrTooManyTopics) {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 509, Err: err})
+	} else if err != nil {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 508, Err: err})
+	}
+
+	if v.Data == nil {
+		return proto.MessageOk
+	}
+
+	c, err := codec.Lookup(codecName)
+	if err != nil {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 503, Err: err})
+	}
+	data, err := c.Decode(v.Data, s)
+	if err == nil {
+		err = schema.Check(s, data)
+	}
+	if err != nil {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{
+			Code: 503,
+			Err:  fmt.Errorf("data does not conform to %s:\n%w", s.ToSchema(), err),
+		})
+	}
+	return proto.MessageOk
+}
+
+// MaxChangesWait is the longest a ChangesRequest waits for a change
+const MaxChangesWait = 30 * time.Second
+
+// ChangesResponse returns the changes committed to db which c asks for,
+// leaving out changes to topics acl doesn't permit. If there are none, it
+// waits up to c.Wait, or MaxChangesWait, for some, unless ctx is done first.
+func ChangesResponse(ctx context.Context, c proto.ChangesRequest, db *database.Database, acl *proto.TopicACL) proto.Message {
+	wait := c.Wait
+	if wait > MaxChangesWait {
+		wait = MaxChangesWait
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	changes, next, err := db.Changes(ctx, c.From, int(c.Limit))
+	if errors.Is(err, database.ErrChangesExpired) {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{
+			Code: 404,
+			Err:  fmt.Errorf("%w: the oldest change held is %d", err, next),
+		})
+	} else if err != nil {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 504, Err: err})
+	}
+
+	resp := proto.ChangesResponse{Changes: []database.Change{}, Next: next}
+	for _, change := range changes {
+		if change.Topic != "" && !acl.Permits(change.Topic) {
+			continue
+		}
+		resp.Changes = append(resp.Changes, change)
+	}
+	return proto.NewMessageWithType(proto.CommandChanges, resp)
+}
+
+func FlushResponse(_ proto.FlushRequest, db *database.Database) proto.Message {
+	err := db.Flush()
+	if err != nil {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 507, Err: err})
+	}
 	return proto.MessageOk
 }
+
+func DescribeResponse(d proto.DescribeRequest, db *database.Database) proto.Message {
+	info, ok := db.DescribeTopic(d.Topic)
+	if !ok {
+		return proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 404, Err: fmt.Errorf("topic '%s' not found", d.Topic)})
+	}
+
+	resp := proto.DescribeResponse{
+		Topic:    info.Topic,
+		Schema:   info.Schema.ToSchema(),
+		Codec:    info.Codec,
+		Encoding: info.Encoding,
+		Count:    uint64(info.Count),
+		First:    info.First,
+		Last:     info.Last,
+	}
+	if info.ParentSchema != nil {
+		resp.ParentSchema = info.ParentSchema.ToSchema()
+	}
+
+	return proto.NewMessageWithType(proto.CommandDescribe, resp)
+}
@@ -0,0 +1,1285 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/database"
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/query"
+	"github.com/dburkart/fossil/pkg/schema"
+	"github.com/dburkart/fossil/pkg/tracing"
+	"github.com/rs/zerolog"
+)
+
+func TestVersionResponse(t *testing.T) {
+	tt := []struct {
+		version string
+		code    uint32
+	}{
+		{proto.Version, 200},
+		{"v0.1.0", 426},
+		{"bogus", 426},
+	}
+
+	for _, tc := range tt {
+		msg := VersionResponse(proto.VersionRequest{Version: tc.version, Compression: []string{proto.CompressionGzip}})
+		resp := proto.VersionResponse{}
+		if err := resp.Unmarshal(msg.Data()); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != tc.code || resp.MinClientVersion != proto.MinClientVersion || !resp.Supports(proto.CapabilityChanges) {
+			t.Errorf("expected code %d for client %s with our capabilities, got %+v", tc.code, tc.version, resp)
+		}
+		if (resp.Compression != "") != (tc.code == 200) {
+			t.Errorf("expected compression only to be negotiated for accepted clients, got %+v", resp)
+		}
+	}
+}
+
+func TestPingResponse(t *testing.T) {
+	sent := time.Now().Add(-time.Millisecond)
+	msg := PingResponse(proto.PingRequest{Sent: sent})
+	if msg.Command() != proto.CommandPing {
+		t.Fatalf("expected a ping response, got %s", msg.Command())
+	}
+
+	resp := proto.PingResponse{}
+	if err := resp.Unmarshal(msg.Data()); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Sent.Equal(sent) || resp.Received.Before(sent) {
+		t.Errorf("expected the sent time to be echoed before the received time, got %+v", resp)
+	}
+}
+
+func TestAppendAcks(t *testing.T) {
+	config := database.Config{DedupWindows: map[string]time.Duration{"/dedup": time.Hour}}
+	db, err := database.NewDatabaseWithConfig("test", t.TempDir(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := AppendResponse(proto.AppendRequest{Topic: "/plain", Data: []byte("a")}, db); msg.Command() != proto.CommandOk {
+		t.Errorf("expected appends which don't ask for an ack to get an Ok, got %s", msg.Command())
+	}
+
+	ack := func(topic, data string) proto.AppendResponse {
+		t.Helper()
+		msg := AppendResponse(proto.AppendRequest{Topic: topic, Data: []byte(data), Ack: true}, db)
+		if msg.Command() != proto.CommandAppend {
+			t.Fatalf("expected an append response, got %s", msg.Command())
+		}
+		resp := proto.AppendResponse{}
+		if err := resp.Unmarshal(msg.Data()); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	first := ack("/dedup", "b")
+	if first.Code != 200 || first.Sequence == 0 {
+		t.Fatalf("expected the append to be acknowledged with its sequence number, got %+v", first)
+	}
+	entries := db.Retrieve(database.Query{Topics: []string{"/dedup"}, OnlyTopics: true})
+	if len(entries) != 1 || !entries[0].Time.Equal(first.Time) || entries[0].Sequence != first.Sequence {
+		t.Errorf("expected the ack to match the appended entry, got %+v for %+v", first, entries)
+	}
+
+	// Duplicates are acknowledged with the append they duplicate
+	if dup := ack("/dedup", "b"); dup.Code != 208 || !dup.Time.Equal(first.Time) || dup.Sequence != first.Sequence {
+		t.Errorf("expected a duplicate to be acknowledged as %+v, got %+v", first, dup)
+	}
+	if next := ack("/dedup", "c"); next.Code != 200 || next.Sequence <= first.Sequence {
+		t.Errorf("expected a later append to have a later sequence number than %d, got %+v", first.Sequence, next)
+	}
+}
+
+func TestRestrictedQueryResponse(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"/metrics/cpu", "/metrics/billing", "/secrets"} {
+		err = db.Append([]byte("data"), topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	acl := &proto.TopicACL{Allow: []string{"/metrics"}, Deny: []string{"/metrics/billing"}}
+
+	tt := []struct {
+		query  string
+		topics []string
+		code   uint32
+	}{
+		{"all", []string{"/metrics/cpu"}, 0},
+		{"all in /", []string{"/metrics/cpu"}, 0},
+		{"all in /metrics", []string{"/metrics/cpu"}, 0},
+		{"all in /secrets", nil, 403},
+		{"all in /metrics/billing", nil, 403},
+		{"all in /nonexistent", nil, 403},
+	}
+
+	for _, tc := range tt {
+		msg := RestrictedQueryResponse(proto.QueryRequest{Query: tc.query}, db, acl)
+
+		if tc.code != 0 {
+			if msg.Command() != proto.CommandError {
+				t.Errorf("%s: expected an error, got %s", tc.query, msg.Command())
+				continue
+			}
+			resp := proto.ErrResponse{}
+			err = proto.Unmarshal(msg.Data(), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code != tc.code {
+				t.Errorf("%s: expected code %d, got %d", tc.query, tc.code, resp.Code)
+			}
+			continue
+		}
+
+		resp := proto.QueryResponse{}
+		err = proto.Unmarshal(msg.Data(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Results) != len(tc.topics) {
+			t.Errorf("%s: expected %d results, got %d", tc.query, len(tc.topics), len(resp.Results))
+			continue
+		}
+		for i, topic := range tc.topics {
+			if resp.Results[i].Topic != topic {
+				t.Errorf("%s: expected result %d to be in %s, got %s", tc.query, i, topic, resp.Results[i].Topic)
+			}
+		}
+	}
+
+	// Unrestricted clients see everything
+	msg := QueryResponse(proto.QueryRequest{Query: "all"}, db)
+	resp := proto.QueryResponse{}
+	err = proto.Unmarshal(msg.Data(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 3 {
+		t.Errorf("expected 3 results without an acl, got %d", len(resp.Results))
+	}
+}
+
+func TestCounterRate(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter, _ := schema.Parse("int64")
+	for _, topic := range []string{"/requests", "/requests/a", "/requests/b"} {
+		if _, err = db.CreateTopic(topic, "int64", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The counter of /requests/a is reset, and /requests/b's values are
+	// interleaved with it
+	for _, append := range [][2]string{{"/requests/a", "10"}, {"/requests/b", "1000"}, {"/requests/a", "20"}, {"/requests/b", "2000"}, {"/requests/a", "5"}} {
+		data, _ := schema.EncodeStringForSchema(append[1], counter)
+		if err = db.Append(data, append[0]); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	msg := QueryResponse(proto.QueryRequest{Query: "all in /requests | map x -> counter_rate(x)"}, db)
+	resp := proto.QueryResponse{}
+	err = proto.Unmarshal(msg.Data(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first entry of each topic has no rate
+	if len(resp.Results) != 3 {
+		t.Fatalf("expected 3 rates, got %v", resp.Values())
+	}
+	for _, row := range resp.Values() {
+		rate, err := strconv.ParseFloat(row[3], 64)
+		if err != nil || rate <= 0 {
+			t.Errorf("expected a positive rate, got %v", row)
+		}
+	}
+}
+
+func TestSamplePerTopic(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// /chatty appends far more often than /quiet
+	for _, topic := range []string{"/chatty", "/chatty", "/chatty", "/quiet", "/chatty"} {
+		if err = db.AppendOrCreate([]byte("data"), topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt := []struct {
+		query  string
+		topics []string
+	}{
+		{"sample(@year * 100) in /", []string{"/chatty"}},
+		{"sample(@year * 100) per topic in /", []string{"/chatty", "/quiet"}},
+		{"sample(3 entries) in /", []string{"/chatty", "/quiet"}},
+		{"sample(3 entries) per topic in /", []string{"/chatty", "/quiet", "/chatty"}},
+	}
+
+	for _, tc := range tt {
+		msg := QueryResponse(proto.QueryRequest{Query: tc.query}, db)
+		resp := proto.QueryResponse{}
+		err = proto.Unmarshal(msg.Data(), &resp)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+
+		var topics []string
+		for _, e := range resp.Results {
+			topics = append(topics, e.Topic)
+		}
+		if strings.Join(topics, " ") != strings.Join(tc.topics, " ") {
+			t.Errorf("%s: expected entries of %v, got %v", tc.query, tc.topics, topics)
+		}
+	}
+}
+
+func TestTimestampArithmetic(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = db.Append([]byte("ping"), "/pings"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	tt := []struct {
+		query string
+		// results is the number of results, and check is run on each
+		results int
+		check   func(string) bool
+	}{
+		{"all in /pings | map x -> time(x) - ~(2023-01-01)", 3, func(s string) bool {
+			d, err := time.ParseDuration(s)
+			return err == nil && d > 0
+		}},
+		{"all in /pings | map x -> interval(x)", 2, func(s string) bool {
+			d, err := time.ParseDuration(s)
+			return err == nil && d >= time.Millisecond && d < time.Minute
+		}},
+		{"all in /pings | map x -> time(x) - @day", 3, func(s string) bool {
+			ts, err := time.Parse(time.RFC3339Nano, s)
+			return err == nil && time.Since(ts) > 23*time.Hour
+		}},
+		{"all in /pings | map x -> (~now - time(x)) / @second", 3, func(s string) bool {
+			f, err := strconv.ParseFloat(s, 64)
+			return err == nil && f >= 0 && f < 60
+		}},
+		{"all in /pings | filter x -> interval(x) < @minute", 2, func(s string) bool { return s == "ping" }},
+	}
+
+	for _, tc := range tt {
+		msg := QueryResponse(proto.QueryRequest{Query: tc.query}, db)
+		resp := proto.QueryResponse{}
+		if err = proto.Unmarshal(msg.Data(), &resp); err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+		if len(resp.Results) != tc.results {
+			t.Errorf("%s: expected %d results, got %v", tc.query, tc.results, resp.Values())
+			continue
+		}
+		for _, row := range resp.Values() {
+			if !tc.check(row[3]) {
+				t.Errorf("%s: unexpected result %v", tc.query, row)
+			}
+		}
+	}
+
+	msg := QueryResponse(proto.QueryRequest{Query: "all in /pings | map x -> time(x) + ~now"}, db)
+	if msg.Command() != proto.CommandError {
+		t.Errorf("expected adding timestamps to be a type error, got %s", msg.Command())
+	}
+}
+
+func TestCachedQueries(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateTopic("/numbers", "int64", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	values := func(query string) []string {
+		msg := QueryResponse(proto.QueryRequest{Query: query}, db)
+		resp := proto.QueryResponse{}
+		if err := proto.Unmarshal(msg.Data(), &resp); err != nil {
+			t.Fatalf("%s: %s", query, err)
+		}
+		var values []string
+		for _, row := range resp.Values() {
+			values = append(values, row[3])
+		}
+		return values
+	}
+	appendNumber := func(n int64) {
+		data, _ := schema.EncodeType(n)
+		if err := db.Append(data, "/numbers"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	appendNumber(1)
+
+	// ~now is evaluated each time a query runs, not when it's cached, and
+	// folding constants doesn't change the cached query
+	query := "all in /numbers before ~now | map x -> x + 2 * 3"
+	if got := values(query); strings.Join(got, " ") != "7" {
+		t.Errorf("expected [7], got %v", got)
+	}
+	appendNumber(2)
+	if got := values(query); strings.Join(got, " ") != "7 8" {
+		t.Errorf("expected [7 8] from the cached query, got %v", got)
+	}
+
+	stats := db.Stats()
+	if stats.PlanCacheHits != 1 || stats.PlanCacheMisses != 1 {
+		t.Errorf("expected 1 hit and 1 miss, got %d and %d", stats.PlanCacheHits, stats.PlanCacheMisses)
+	}
+
+	// A new topic invalidates the cache
+	if _, err = db.CreateTopic("/strings", "string", ""); err != nil {
+		t.Fatal(err)
+	}
+	values(query)
+	if misses := db.Stats().PlanCacheMisses; misses != 2 {
+		t.Errorf("expected 2 misses after creating a topic, got %d", misses)
+	}
+}
+
+func TestSystemTopicQueries(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateTopic("/n", "int64", ""); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		data, _ := schema.EncodeType(int64(i))
+		if err = db.Append(data, "/n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Append([]byte("data"), "/secrets"); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		query string
+		want  []string
+	}{
+		{"all in /_system/topics | map t -> t.name", []string{"/", "/n", "/secrets"}},
+		{"all in /_system/topics | filter t -> t.entries > 1 | map t -> t.schema", []string{"int64"}},
+		{"all in /_system/topics | map t -> t.entries | reduce a, b -> a + b", []string{"4"}},
+		{"all in /_system/stats | map s -> s.topics", []string{"3"}},
+		{"latest in /_system/stats | map s -> s.appends", []string{"4"}},
+	}
+
+	for _, tc := range tt {
+		msg := QueryResponse(proto.QueryRequest{Query: tc.query}, db)
+		resp := proto.QueryResponse{}
+		if err = proto.Unmarshal(msg.Data(), &resp); err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+		var got []string
+		for _, row := range resp.Values() {
+			got = append(got, row[3])
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s: expected %v, got %v", tc.query, tc.want, got)
+		}
+	}
+
+	// Restricted clients only see the topics they're allowed
+	acl := &proto.TopicACL{Allow: []string{"/n", "/_system"}}
+	msg := RestrictedQueryResponse(proto.QueryRequest{Query: "all in /_system/topics"}, db, acl)
+	resp := proto.QueryResponse{}
+	if err = proto.Unmarshal(msg.Data(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 1 {
+		t.Errorf("expected a restricted client to see one topic, got %d", len(resp.Results))
+	}
+
+	// Queries of every topic leave system topics out
+	msg = QueryResponse(proto.QueryRequest{Query: "all in /"}, db)
+	resp = proto.QueryResponse{}
+	if err = proto.Unmarshal(msg.Data(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 4 {
+		t.Errorf("expected 4 results, got %d", len(resp.Results))
+	}
+}
+
+func TestDestructuringPipeline(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateTopic("/n", "int64", ""); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		data, _ := schema.EncodeType(int64(i))
+		if err = db.Append(data, "/n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt := []struct {
+		query string
+		want  []string
+	}{
+		{"all in /n | map x -> x, x * 2 | map a, b -> a + b", []string{"3", "6", "9"}},
+		{"all in /n | map x -> x, x * 2 | filter a, b -> b > 2 | map a, b -> b - a", []string{"2", "3"}},
+		{"all in /n | map x -> x, x * 2 | filter p -> p[0] > 1 | map a, b -> a * b", []string{"8", "18"}},
+		{"all in /n | map x -> x, x * 2 | reduce a, b -> a[0] + b[0], a[1] + b[1] | map sum, doubled -> doubled - sum", []string{"6"}},
+		{"all in /n | map x -> x, x * 2 | map a, b, c -> a", nil},
+		{"all in /n | map x -> x, x * 2 | filter a, b -> a > 1 | map a -> a", nil},
+	}
+
+	for _, tc := range tt {
+		msg := QueryResponse(proto.QueryRequest{Query: tc.query}, db)
+		if tc.want == nil {
+			if msg.Command() != proto.CommandError {
+				t.Errorf("%s: expected an argument mismatch, got %s", tc.query, msg.Command())
+			}
+			continue
+		}
+
+		resp := proto.QueryResponse{}
+		if err = proto.Unmarshal(msg.Data(), &resp); err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+		var got []string
+		for _, row := range resp.Values() {
+			got = append(got, row[3])
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s: expected %v, got %v", tc.query, tc.want, got)
+		}
+	}
+}
+
+func TestArraySubscripts(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateTopic("/v", "[4]int32", ""); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for _, n := range []uint32{10, 20, 30, 40} {
+		data = binary.LittleEndian.AppendUint32(data, n)
+	}
+	if err = db.Append(data, "/v"); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		query  string
+		schema string
+		want   string
+	}{
+		{"all in /v | map v -> v[-1]", "int64", "40"},
+		{"all in /v | map v -> v[-4] + v[0]", "int64", "20"},
+		{"all in /v | map v -> v[1:3]", "[2]int64", ""},
+		{"all in /v | map v -> v[1:3] | map a, b -> a + b", "int64", "50"},
+		{"all in /v | map v -> v[:2] | map a, b -> b - a", "int64", "10"},
+		{"all in /v | map v -> v[-2:] | map a, b -> b - a", "int64", "10"},
+		{"all in /v | map v -> v[-3:-1] | map a, b -> a + b", "int64", "50"},
+		{"all in /v | map v -> v[:10]", "[4]int64", ""},
+		{"all in /v | map v -> v[4]", "", ""},
+		{"all in /v | map v -> v[-5]", "", ""},
+		{"all in /v | map v -> v[3:1]", "", ""},
+		{"all in /v | map v -> v[4:]", "", ""},
+	}
+
+	for _, tc := range tt {
+		msg := QueryResponse(proto.QueryRequest{Query: tc.query}, db)
+		if tc.schema == "" {
+			if msg.Command() != proto.CommandError {
+				t.Errorf("%s: expected an out of bounds error, got %s", tc.query, msg.Command())
+			}
+			continue
+		}
+
+		resp := proto.QueryResponse{}
+		if err = proto.Unmarshal(msg.Data(), &resp); err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+		rows := resp.Values()
+		if len(rows) != 1 || resp.Results[0].Schema != tc.schema {
+			t.Errorf("%s: expected one entry with schema %s, got %v", tc.query, tc.schema, resp.Results)
+			continue
+		}
+		if tc.want != "" && rows[0][3] != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.query, tc.want, rows[0][3])
+		}
+	}
+}
+
+func TestNumericLiteralUnits(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateTopic("/sizes", "int64", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []uint64{500, 2000, 3000000} {
+		if err = db.Append(binary.LittleEndian.AppendUint64(nil, n), "/sizes"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt := []struct {
+		query string
+		want  string
+	}{
+		{"all in /sizes where value > 1_000", "2000 3000000"},
+		{"all in /sizes where value > 1kib", "2000 3000000"},
+		{"all in /sizes where value < 2.5MB | map x -> x + 1kb", "1500 3000"},
+		{"all in /sizes since ~now - 5m where value < 1_000", "500"},
+		{"all in /sizes before ~now - 1d", ""},
+		{"all in /sizes where value == 500 | map x -> 90s", "1m30s"},
+	}
+
+	for _, tc := range tt {
+		msg := QueryResponse(proto.QueryRequest{Query: tc.query}, db)
+		if msg.Command() != proto.CommandQuery {
+			t.Errorf("%s: expected a query response, got %s", tc.query, msg.Command())
+			continue
+		}
+
+		resp := proto.QueryResponse{}
+		if err = proto.Unmarshal(msg.Data(), &resp); err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+		var got []string
+		for _, row := range resp.Values() {
+			got = append(got, row[3])
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("%s: expected %s, got %v", tc.query, tc.want, got)
+		}
+	}
+
+	msg := QueryResponse(proto.QueryRequest{Query: "all in /sizes since ~now - 99999999999d"}, db)
+	if msg.Command() != proto.CommandError {
+		t.Errorf("expected an out of range duration to be an error, got %s", msg.Command())
+	}
+}
+
+// handleAs has handle handle msg for a client of db restricted by acl, and
+// returns its response
+func handleAs(t *testing.T, handle func(proto.ResponseWriter, *proto.Request), msg proto.Message, db *database.Database, acl *proto.TopicACL) proto.Message {
+	t.Helper()
+	var out bytes.Buffer
+	handle(proto.NewResponseWriter(&out), proto.NewRequestWithACL(msg, db, acl))
+	resp, err := proto.ReadMessageFull(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// responseCode returns the code of an error response, or 200 for any other
+func responseCode(t *testing.T, resp proto.Message) uint32 {
+	t.Helper()
+	if resp.Command() != proto.CommandError {
+		return 200
+	}
+	e := proto.ErrResponse{}
+	if err := e.Unmarshal(resp.Data()); err != nil {
+		t.Fatal(err)
+	}
+	return e.Code
+}
+
+func TestStrictTopicsTrustedClients(t *testing.T) {
+	db, err := database.NewDatabaseWithConfig("test", t.TempDir(), database.Config{StrictTopics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{log: zerolog.Nop()}
+
+	send := func(msg proto.Message, handle func(proto.ResponseWriter, *proto.Request), acl *proto.TopicACL) uint32 {
+		return responseCode(t, handleAs(t, handle, msg, db, acl))
+	}
+	appendTo := func(topic string) proto.Message {
+		return proto.NewMessageWithType(proto.CommandAppend, proto.AppendRequest{Topic: topic, Data: []byte("x"), CreateTopic: true})
+	}
+	validate := func(topic string) proto.Message {
+		return proto.NewMessageWithType(proto.CommandValidate, proto.ValidateRequest{Topic: topic, Data: []byte("x"), CreateTopic: true})
+	}
+
+	untrusted := []*proto.TopicACL{nil, {Name: "sensors"}}
+	for _, acl := range untrusted {
+		if code := send(validate("/new"), s.HandleValidate, acl); code != 404 {
+			t.Errorf("expected validating topic creation to fail for an untrusted client, got %d", code)
+		}
+		if code := send(appendTo("/new"), s.HandleAppend, acl); code != 404 {
+			t.Errorf("expected an untrusted client not to create a topic in strict mode, got %d", code)
+		}
+	}
+	if db.TopicExists("/new") {
+		t.Fatal("expected /new not to be created")
+	}
+
+	trusted := &proto.TopicACL{Name: "agents", CreateTopics: true}
+	if code := send(validate("/new"), s.HandleValidate, trusted); code != 200 {
+		t.Errorf("expected validating topic creation to succeed for a trusted client, got %d", code)
+	}
+	if code := send(appendTo("/new"), s.HandleAppend, trusted); code != 200 {
+		t.Errorf("expected a trusted client to create a topic in strict mode, got %d", code)
+	}
+	if !db.TopicExists("/new") {
+		t.Error("expected /new to be created")
+	}
+}
+
+func TestTopicListingACL(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"/metrics/cpu", "/metrics/billing", "/secrets"} {
+		if _, err = db.CreateTopic(topic, "int32", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{log: zerolog.Nop()}
+	acl := &proto.TopicACL{Allow: []string{"/metrics"}, Deny: []string{"/metrics/billing"}}
+
+	describe := func(topic string) proto.Message {
+		return proto.NewMessageWithType(proto.CommandDescribe, proto.DescribeRequest{Topic: topic})
+	}
+	if code := responseCode(t, handleAs(t, s.HandleDescribe, describe("/metrics/cpu"), db, acl)); code != 200 {
+		t.Errorf("expected an allowed topic to be described, got %d", code)
+	}
+	for _, topic := range []string{"/metrics/billing", "/secrets", "/missing"} {
+		if code := responseCode(t, handleAs(t, s.HandleDescribe, describe(topic), db, acl)); code != 403 {
+			t.Errorf("expected describing %s to be denied, got %d", topic, code)
+		}
+	}
+
+	// Denied topics are left out before paging, so pages stay full
+	topics := proto.ListTopicsResponse{}
+	msg := proto.NewMessageWithType(proto.CommandTopics, proto.ListTopicsRequest{Limit: 1})
+	if err = topics.Unmarshal(handleAs(t, s.HandleTopics, msg, db, acl).Data()); err != nil {
+		t.Fatal(err)
+	}
+	if len(topics.Topics) != 1 || topics.Topics[0].Topic != "/metrics/cpu" || topics.Next != "" {
+		t.Errorf("expected only /metrics/cpu to be listed, got %+v", topics)
+	}
+
+	for _, object := range []string{"topics", "schemas"} {
+		list := proto.ListResponse{}
+		msg = proto.NewMessageWithType(proto.CommandList, proto.ListRequest{Object: object})
+		if err = list.Unmarshal(handleAs(t, s.HandleList, msg, db, acl).Data()); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.ObjectList) != 1 || !strings.HasPrefix(list.ObjectList[0], "/metrics/cpu") {
+			t.Errorf("expected only /metrics/cpu in the list of %s, got %v", object, list.ObjectList)
+		}
+	}
+}
+
+func TestProjection(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	climate := `{"temperature": int32, "humidity": int32, "wind": int32}`
+	if _, err = db.CreateTopic("/climate", climate, ""); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := schema.Parse(climate)
+	data, _ := schema.EncodeStringForSchema("temperature: 21, humidity: 40, wind: 5", s)
+	if err = db.Append(data, "/climate"); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		query string
+		want  string
+	}{
+		{"all in /climate | project temperature, humidity", `{"humidity":int64,"temperature":int64,}`},
+		{"all in /climate | project wind | map c -> c.wind * 2", "int64"},
+		{"all in /climate | project humidity | filter c -> c.temperature > 20", ""},
+		{"all in /climate | project pressure", ""},
+		{"all in /climate | map c -> c.wind | project wind", ""},
+	}
+
+	for _, tc := range tt {
+		msg := QueryResponse(proto.QueryRequest{Query: tc.query}, db)
+		if tc.want == "" {
+			if msg.Command() != proto.CommandError {
+				t.Errorf("%s: expected an unknown key error, got %s", tc.query, msg.Command())
+			}
+			continue
+		}
+
+		resp := proto.QueryResponse{}
+		if err = proto.Unmarshal(msg.Data(), &resp); err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+		if len(resp.Results) != 1 || resp.Results[0].Schema != tc.want {
+			t.Errorf("%s: expected one entry with schema %s, got %v", tc.query, tc.want, resp.Results)
+		}
+	}
+}
+
+func TestStageOrder(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"/n", "/pairs"} {
+		s := "int32"
+		if topic == "/pairs" {
+			s = "[2]int32"
+		}
+		if _, err = db.CreateTopic(topic, s, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		n := binary.LittleEndian.AppendUint32(nil, uint32(i))
+		if err = db.Append(n, "/n"); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Append(append(n, n...), "/pairs"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt := []struct {
+		query string
+		// want is the single result, or empty if the query is rejected
+		want string
+	}{
+		// A reduce as the first stage reduces the entries selected
+		{"all in /n | reduce a, b -> a + b", "6"},
+		{"all in /n | reduce a, b -> a + b | filter x -> x > 1", "6"},
+		{"all in /n | filter x -> x > 1 | reduce a, b -> a + b | map x -> x * 2", "10"},
+		{"all in /pairs | reduce a, b -> a[0] + b[0], a[1] + b[1] | map x, y -> x * y", "36"},
+		// Entries are destructured into the arguments of the first stage
+		{"all in /pairs | map x, y -> x + y | reduce a, b -> a + b", "12"},
+		// Stages whose arguments don't match their input are rejected
+		{"all in /n | filter a, b -> a > b", ""},
+		{"all in /n | reduce a, b -> a + b | filter x, y -> x > y", ""},
+		{"all in /n | reduce a, b -> a, b | map x, y -> x + y", ""},
+		{"all in /n | reduce a, b -> a > b", ""},
+	}
+
+	for _, tc := range tt {
+		msg := QueryResponse(proto.QueryRequest{Query: tc.query}, db)
+		if tc.want == "" {
+			if msg.Command() != proto.CommandError {
+				t.Errorf("%s: expected the query to be rejected, got %s", tc.query, msg.Command())
+			}
+			continue
+		}
+
+		resp := proto.QueryResponse{}
+		if err = proto.Unmarshal(msg.Data(), &resp); err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+		if len(resp.Results) != 1 {
+			t.Fatalf("%s: expected one result, got %v", tc.query, resp.Results)
+		}
+		if got := strconv.FormatInt(int64(binary.LittleEndian.Uint64(resp.Results[0].Data)), 10); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.query, tc.want, got)
+		}
+	}
+}
+
+func TestAggregateQuery(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"/events", "/events/a", "/events/b"} {
+		if _, err = db.CreateTopic(topic, "int64", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, append := range []struct {
+		topic string
+		value int64
+	}{{"/events/a", 1}, {"/events/b", 10}, {"/events/a", 2}, {"/events/a", 3}, {"/events/b", 20}, {"/events/a", 4}, {"/events/a", 5}} {
+		data, _ := schema.EncodeType(append.value)
+		if err = db.Append(data, append.topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt := []struct {
+		query string
+		topic string
+		value string
+	}{
+		{"all in /events/a | reduce a, b -> a + b", "N/A", "15"},
+		{"all in /events | map x -> 1 | reduce a, b -> a + b", "N/A", "7"},
+		{"all in /events | filter x -> x > 3 | reduce a, b -> a + b", "N/A", "39"},
+		{"all in /events/a | map x -> 1, x | reduce a, b -> a[0] + b[0], a[1] + b[1] | map count, sum -> sum / count", "N/A", "3.000000"},
+		{"all in /events/b | filter x -> x > 15 | reduce a, b -> a + b", "/events/b", "20"},
+		{"all in /events/a before ~now - @day | reduce a, b -> a + b", "", ""},
+	}
+
+	for _, tc := range tt {
+		q, err := query.Prepare(db, tc.query)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+		result, stats := q.ExecuteWithProfile()
+		if len(stats) != 1 || stats[0].Name != "aggregate" {
+			t.Errorf("%s: expected the query to run as an aggregate, got stages %+v", tc.query, stats)
+		}
+
+		msg := QueryResponse(proto.QueryRequest{Query: tc.query}, db)
+		resp := proto.QueryResponse{}
+		if err = proto.Unmarshal(msg.Data(), &resp); err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+		rows := resp.Values()
+		if tc.value == "" {
+			if len(rows) != 0 || len(result.Data) != 0 {
+				t.Errorf("%s: expected no results, got %v", tc.query, rows)
+			}
+			continue
+		}
+		if len(rows) != 1 || rows[0][1] != tc.topic || rows[0][3] != tc.value {
+			t.Errorf("%s: expected %s from %s, got %v", tc.query, tc.value, tc.topic, rows)
+		}
+	}
+
+	// Only topics allowed by an ACL are aggregated
+	acl := &proto.TopicACL{Allow: []string{"/events/b"}}
+	msg := RestrictedQueryResponse(proto.QueryRequest{Query: "all | map x -> 1 | reduce a, b -> a + b"}, db, acl)
+	resp := proto.QueryResponse{}
+	if err = proto.Unmarshal(msg.Data(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if rows := resp.Values(); len(rows) != 1 || rows[0][3] != "2" {
+		t.Errorf("expected 2 allowed entries to be counted, got %v", rows)
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateTopic("/points", `{"x": int32, "y": int32}`, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	point, _ := schema.Parse(`{"x": int32, "y": int32}`)
+	valid, _ := schema.EncodeStringForSchema("x: 1, y: 2", point)
+
+	tests := []struct {
+		name string
+		req  proto.ValidateRequest
+		code uint32
+	}{
+		{"conforming payload", proto.ValidateRequest{Topic: "/points", Data: valid}, 200},
+		{"truncated payload", proto.ValidateRequest{Topic: "/points", Data: valid[:6]}, 503},
+		{"sub-topic payload", proto.ValidateRequest{Topic: "/points/a", Data: valid}, 200},
+		{"new topic", proto.ValidateRequest{Topic: "/temp", Schema: "float32", CreateTopic: true}, 200},
+		{"conflicting schema", proto.ValidateRequest{Topic: "/points/b", Schema: "float32", CreateTopic: true}, 508},
+		{"invalid schema", proto.ValidateRequest{Topic: "/temp", Schema: "{float32", CreateTopic: true}, 508},
+		{"unknown codec", proto.ValidateRequest{Topic: "/temp", Codec: "xml", CreateTopic: true}, 508},
+	}
+
+	for _, tc := range tests {
+		msg := ValidateResponse(tc.req, db)
+		code := uint32(200)
+		if msg.Command() == proto.CommandError {
+			e := proto.ErrResponse{}
+			if err = e.Unmarshal(msg.Data()); err != nil {
+				t.Fatal(err)
+			}
+			code = e.Code
+		}
+		if code != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.code, code)
+		}
+	}
+
+	// Nothing was written
+	if db.TopicExists("/points/a") || db.TopicExists("/temp") {
+		t.Error("expected validation not to create topics")
+	}
+	if db.Stats().Appends != 0 {
+		t.Error("expected validation not to append data")
+	}
+}
+
+func TestCreateResponseEncoding(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		req  proto.CreateTopicRequest
+		code uint32
+	}{
+		{"float topic", proto.CreateTopicRequest{Topic: "/cpu", Schema: "float64", Encoding: "gorilla"}, 200},
+		{"integer topic", proto.CreateTopicRequest{Topic: "/count", Schema: "uint32", Encoding: "delta"}, 200},
+		{"mismatched schema", proto.CreateTopicRequest{Topic: "/names", Schema: "string", Encoding: "gorilla"}, 508},
+		{"unknown encoding", proto.CreateTopicRequest{Topic: "/temp", Schema: "float32", Encoding: "lz4"}, 508},
+	}
+
+	for _, tc := range tests {
+		msg := CreateResponse(tc.req, db)
+		code := uint32(200)
+		if msg.Command() == proto.CommandError {
+			e := proto.ErrResponse{}
+			if err = e.Unmarshal(msg.Data()); err != nil {
+				t.Fatal(err)
+			}
+			code = e.Code
+		}
+		if code != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.code, code)
+		}
+	}
+
+	if db.EncodingForTopic("/cpu") != database.EncodingGorilla || db.EncodingForTopic("/count") != database.EncodingDelta {
+		t.Error("expected created topics to have their encodings")
+	}
+	// Topics aren't created with an encoding which doesn't apply
+	if db.TopicExists("/names") || db.TopicExists("/temp") {
+		t.Error("expected topics with invalid encodings not to be created")
+	}
+}
+
+func TestChangesResponse(t *testing.T) {
+	db, err := database.NewDatabaseWithConfig("test", t.TempDir(), database.Config{ChangeFeedSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"/metrics/cpu", "/secrets"} {
+		if err = db.Append([]byte("data"), topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	acl := &proto.TopicACL{Allow: []string{"/metrics"}}
+	msg := ChangesResponse(context.Background(), proto.ChangesRequest{}, db, acl)
+	if msg.Command() != proto.CommandChanges {
+		t.Fatalf("expected changes, got %s", msg.Command())
+	}
+	resp := proto.ChangesResponse{}
+	if err = resp.Unmarshal(msg.Data()); err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range resp.Changes {
+		if change.Topic != "" && !strings.HasPrefix(change.Topic, "/metrics") {
+			t.Errorf("expected changes to %s to be filtered, got %+v", change.Topic, change)
+		}
+	}
+	if len(resp.Changes) == 0 {
+		t.Error("expected changes to /metrics/cpu")
+	}
+
+	// Nothing has been written since, so the response is empty once the
+	// wait is over
+	msg = ChangesResponse(context.Background(), proto.ChangesRequest{From: resp.Next, Wait: time.Millisecond}, db, acl)
+	empty := proto.ChangesResponse{}
+	if err = empty.Unmarshal(msg.Data()); err != nil {
+		t.Fatal(err)
+	}
+	if len(empty.Changes) != 0 || empty.Next != resp.Next {
+		t.Errorf("expected no changes, got %+v", empty)
+	}
+
+	// Only the 3 most recent changes are held
+	msg = ChangesResponse(context.Background(), proto.ChangesRequest{From: 1}, db, nil)
+	if msg.Command() != proto.CommandError {
+		t.Fatalf("expected an error, got %s", msg.Command())
+	}
+	e := proto.ErrResponse{}
+	if err = e.Unmarshal(msg.Data()); err != nil {
+		t.Fatal(err)
+	}
+	if e.Code != 404 {
+		t.Errorf("expected 404, got %d", e.Code)
+	}
+}
+
+func TestDatabaseStatusResponse(t *testing.T) {
+	dbMap := map[string]*database.Database{}
+	for _, name := range []string{"metrics", "default"} {
+		db, err := database.NewDatabaseWithConfig(name, t.TempDir(), database.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbMap[name] = db
+	}
+	if err := dbMap["default"].Append([]byte("data"), "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbMap["default"].Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := DatabaseStatusResponse(proto.DatabaseStatusRequest{}, dbMap["default"], dbMap, time.Hour)
+	if msg.Command() != proto.CommandDatabaseStatus {
+		t.Fatalf("expected a database status, got %s", msg.Command())
+	}
+	resp := proto.DatabaseStatusResponse{}
+	if err := resp.Unmarshal(msg.Data()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Databases) != 2 || resp.Databases[0].Name != "default" || resp.Databases[1].Name != "metrics" {
+		t.Fatalf("expected both databases sorted by name, got %+v", resp.Databases)
+	}
+	flushed := resp.Databases[0]
+	if flushed.Status != proto.DatabaseOpen || flushed.Size == 0 || flushed.Topics < 2 || flushed.LastFlush.IsZero() || flushed.Uptime != time.Hour {
+		t.Errorf("unexpected status of the flushed database %+v", flushed)
+	}
+	if !resp.Databases[1].LastFlush.IsZero() {
+		t.Errorf("expected a database which was never flushed to have no last flush, got %+v", resp.Databases[1])
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	db, err := database.NewDatabaseWithConfig("test", t.TempDir(), database.Config{MaxQueryRange: time.Hour, MaxQueryResults: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err = db.Append([]byte("data"), "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt := []struct {
+		query string
+		code  uint32
+	}{
+		{"all in /metrics since ~now - @minute", 509},
+		{"sample(2 entries) in /metrics since ~now - @minute", 0},
+		{"all in /metrics since ~now - @day", 509},
+		{"all in /metrics between ~now - @day, ~now - @minute * 1410 | reduce a, b -> a", 0},
+		{"latest in /metrics", 0},
+		{"all | reduce a, b -> a", 0},
+	}
+
+	for _, tc := range tt {
+		msg := QueryResponse(proto.QueryRequest{Query: tc.query}, db)
+		if tc.code == 0 {
+			if msg.Command() != proto.CommandQuery {
+				t.Errorf("%s: expected results, got %s", tc.query, msg.Command())
+			}
+			continue
+		}
+
+		resp := proto.ErrResponse{}
+		err = proto.Unmarshal(msg.Data(), &resp)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+		if resp.Code != tc.code {
+			t.Errorf("%s: expected code %d, got %d", tc.query, tc.code, resp.Code)
+		}
+	}
+}
+
+func TestQueryMetadata(t *testing.T) {
+	db, err := database.NewDatabaseWithConfig("test", t.TempDir(), database.Config{MaxQueryResults: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err = db.Append([]byte("data"), "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt := []struct {
+		query     string
+		matched   uint64
+		returned  uint64
+		truncated bool
+	}{
+		{"all in /metrics", 3, 2, true},
+		{"sample(2 entries) in /metrics", 2, 2, false},
+		{"all in /metrics | reduce a, b -> a", 1, 1, false},
+		{"all in /missing", 0, 0, false},
+	}
+
+	for _, tc := range tt {
+		msg := QueryResponse(proto.QueryRequest{Query: tc.query, Metadata: true}, db)
+		if msg.Command() != proto.CommandQuery {
+			t.Fatalf("%s: expected results, got %s", tc.query, msg.Command())
+		}
+
+		resp := proto.QueryResponse{}
+		err = proto.Unmarshal(msg.Data(), &resp)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+		md := resp.Metadata
+		if md == nil {
+			t.Fatalf("%s: expected metadata", tc.query)
+		}
+		if md.Matched != tc.matched || md.Returned != tc.returned || md.Truncated != tc.truncated {
+			t.Errorf("%s: expected %d matched, %d returned and truncated %v, got %+v", tc.query, tc.matched, tc.returned, tc.truncated, *md)
+		}
+		if uint64(len(resp.Results)) != md.Returned {
+			t.Errorf("%s: expected %d results, got %d", tc.query, md.Returned, len(resp.Results))
+		}
+	}
+
+	// The time range is the query's, when it has one
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	msg := QueryResponse(proto.QueryRequest{Query: "all between ~(2023-01-01T00:00:00Z), ~(2023-01-02T00:00:00Z)", Metadata: true}, db)
+	resp := proto.QueryResponse{}
+	err = proto.Unmarshal(msg.Data(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Metadata == nil || !resp.Metadata.Start.Equal(start) || !resp.Metadata.End.Equal(start.Add(24*time.Hour)) {
+		t.Errorf("expected a range of a day from %s, got %+v", start, resp.Metadata)
+	}
+
+	// Without metadata, too many results is still an error
+	msg = QueryResponse(proto.QueryRequest{Query: "all in /metrics"}, db)
+	if msg.Command() != proto.CommandError {
+		t.Errorf("expected an error, got %s", msg.Command())
+	}
+}
+
+func TestResponseNotices(t *testing.T) {
+	db, err := database.NewDatabaseWithConfig("test", t.TempDir(), database.Config{MaxQueryResults: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err = db.Append([]byte("data"), "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var notices []proto.Notice
+	notify := func(n proto.Notice) {
+		notices = append(notices, n)
+	}
+
+	QueryResponseWithNotices(proto.QueryRequest{Query: "sample(2 entries) in /metrics", Metadata: true}, db, notify)
+	if len(notices) != 0 {
+		t.Errorf("expected no notices for results which weren't truncated, got %+v", notices)
+	}
+	QueryResponseWithNotices(proto.QueryRequest{Query: "all in /metrics", Metadata: true}, db, notify)
+	if len(notices) != 1 || notices[0].Level != proto.NoticeWarning || notices[0].Message != "results truncated to 2 of the 3 entries matched" {
+		t.Errorf("expected a warning that results were truncated, got %+v", notices)
+	}
+
+	if _, err = db.CreateTopic("/sensors", "int32", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateTopicWithOverride("/sensors/names", "string", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only topics created by the append, which took their parent's schema,
+	// get a notice
+	tests := []struct {
+		topic  string
+		notice string
+	}{
+		{"/sensors/temp", "created /sensors/temp, which inherited the schema int32 from its parent"},
+		{"/sensors/temp", ""},
+		{"/sensors/names", ""},
+		{"/logs", ""},
+	}
+	for _, tc := range tests {
+		notices = nil
+		msg := AppendResponseWithNotices(proto.AppendRequest{Topic: tc.topic, Data: []byte{1, 0, 0, 0}}, db, notify)
+		if msg.Command() != proto.CommandOk {
+			t.Fatalf("%s: expected the append to succeed, got %s", tc.topic, msg.Command())
+		}
+		if tc.notice == "" && len(notices) != 0 {
+			t.Errorf("%s: expected no notices, got %+v", tc.topic, notices)
+		} else if tc.notice != "" && (len(notices) != 1 || notices[0].Message != tc.notice) {
+			t.Errorf("%s: expected the notice %q, got %+v", tc.topic, tc.notice, notices)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	db, err := database.NewDatabase("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Append([]byte("data"), "/foo")
+
+	recorder := &tracing.Recorder{}
+	s := &Server{log: zerolog.Nop()}
+	s.Trace(recorder)
+	h := s.trace(s.HandleQuery)
+
+	r := proto.NewRequest(proto.NewMessageWithType(proto.CommandQuery, proto.QueryRequest{Query: "all in /foo"}), db).WithRequestID("abc123")
+	h(proto.NewResponseWriter(&bytes.Buffer{}), r)
+
+	spans := recorder.Spans()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %+v", spans)
+	}
+	if spans[0].Name != "fossil.query.prepare" || spans[0].Parent != "fossil.server QUERY" {
+		t.Errorf("unexpected prepare span %+v", spans[0])
+	}
+	if spans[1].Name != "fossil.query.execute" || spans[1].Attributes["fossil.results"] != 1 {
+		t.Errorf("unexpected execute span %+v", spans[1])
+	}
+	handled := spans[2]
+	if handled.Attributes["fossil.request_id"] != "abc123" || handled.Attributes["fossil.db"] != "test" || handled.Attributes["fossil.code"] != 200 {
+		t.Errorf("unexpected handler span %+v", handled)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+// responseQueue serializes the responses written to a connection, whose
+// requests are each handled in their own goroutine. Each write is made whole,
+// so that concurrent responses don't interleave. Responses to requests sent
+// without a request ID are also written in the order the requests were read,
+// since the client has no other way of matching them up; responses to
+// requests with one are written as soon as they're ready.
+type responseQueue struct {
+	w io.Writer
+
+	mu sync.Mutex
+	// next is the turn whose responses are written straight through, and
+	// last is the turn the next ordered request is given
+	next, last uint64
+	// turns holds the responses of ordered requests written before their turn
+	turns map[uint64]*turn
+}
+
+// turn is the place of an ordered request in the queue
+type turn struct {
+	buf  bytes.Buffer
+	done bool
+}
+
+func newResponseQueue(w io.Writer) *responseQueue {
+	return &responseQueue{w: w, turns: make(map[uint64]*turn)}
+}
+
+// writerFor returns the ResponseWriter the response to r is written through,
+// and a function to call once the request has been handled
+func (q *responseQueue) writerFor(r *proto.Request) (proto.ResponseWriter, func()) {
+	if id := r.SentRequestID(); id != "" {
+		return proto.NewResponseWriter(q).WithRequestID(id), func() {}
+	}
+	return q.ordered()
+}
+
+// ordered returns a ResponseWriter whose writes wait for the responses of
+// every ordered request before it, and a function to call once the response
+// has been written
+func (q *responseQueue) ordered() (proto.ResponseWriter, func()) {
+	q.mu.Lock()
+	n := q.last
+	q.last++
+	q.turns[n] = &turn{}
+	q.mu.Unlock()
+
+	return proto.NewResponseWriter(orderedWriter{q, n}), func() { q.finish(n) }
+}
+
+// Write writes b whole, out of turn
+func (q *responseQueue) Write(b []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.w.Write(b)
+}
+
+// finish marks turn n as done, writing the responses of any turns after it
+// which were waiting on it
+func (q *responseQueue) finish(n uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if n != q.next {
+		q.turns[n].done = true
+		return
+	}
+
+	delete(q.turns, n)
+	for q.next++; q.next < q.last; q.next++ {
+		t := q.turns[q.next]
+		q.w.Write(t.buf.Bytes())
+		t.buf.Reset()
+		if !t.done {
+			return
+		}
+		delete(q.turns, q.next)
+	}
+}
+
+// orderedWriter writes the responses of turn n
+type orderedWriter struct {
+	q *responseQueue
+	n uint64
+}
+
+func (o orderedWriter) Write(b []byte) (int, error) {
+	o.q.mu.Lock()
+	defer o.q.mu.Unlock()
+
+	if o.n == o.q.next {
+		return o.q.w.Write(b)
+	}
+	return o.q.turns[o.n].buf.Write(b)
+}
@@ -7,7 +7,9 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"path"
 	"runtime"
@@ -15,6 +17,8 @@ import (
 
 	"github.com/dburkart/fossil/pkg/database"
 	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/dburkart/fossil/pkg/query/plan"
+	"github.com/dburkart/fossil/pkg/tracing"
 	"github.com/rs/zerolog"
 )
 
@@ -26,14 +30,49 @@ type Server struct {
 	dbMap       map[string]*database.Database
 	port        int
 	metricsPort int
+	limits      proto.Limits
+	acls        proto.TopicACLs
+	auditLog    *AuditLog
+	tracer      tracing.Tracer
+	appendKeys  *appendKeys
+	// adminPort, if set, is the only port admin commands are served on, to
+	// connections authenticated with adminToken
+	adminPort  int
+	adminToken string
+	timeouts   Timeouts
 }
 
 type DatabaseConfig struct {
-	Name      string
-	Directory string
+	Name          string
+	Directory     string
+	SyncWrites    bool
+	FlushInterval time.Duration
+	StrictTopics  bool
+	MaxTopics     int
+	// MaxQueryRange and MaxQueryResults limit queries, see database.Config
+	MaxQueryRange   time.Duration
+	MaxQueryResults int
+	// RawRetention and RollupInterval configure rollups, see database.Config
+	RawRetention   time.Duration
+	RollupInterval time.Duration
+	RecoverTopics  bool
+	// ChangeFeedSize is the number of changes held for CHANGES consumers
+	ChangeFeedSize int
+	// ColumnarSegments lays out full segments of fixed-size data in columns
+	ColumnarSegments bool
+	// DedupWindows deduplicates appends to topics, see database.Config
+	DedupWindows map[string]time.Duration
+	// SlowAppendThreshold and SlowFlushThreshold log slow appends and
+	// flushes, see database.Config
+	SlowAppendThreshold time.Duration
+	SlowFlushThreshold  time.Duration
+	// ManualMigrations refuses to open databases which need migrating
+	ManualMigrations bool
 }
 
-func New(log zerolog.Logger, dbConfigs map[string]DatabaseConfig, port, metricsPort int) Server {
+// New creates a server for the databases in dbConfigs. Mutating commands are
+// recorded in auditLog, unless it's nil.
+func New(log zerolog.Logger, dbConfigs map[string]DatabaseConfig, port, metricsPort int, limits proto.Limits, acls proto.TopicACLs, auditLog *AuditLog) Server {
 	// TODO: We need a filesystem lock to ensure we don't double run a server on the same database
 	// https://pkg.go.dev/io/fs#FileMode ModeExclusive
 
@@ -45,12 +84,36 @@ func New(log zerolog.Logger, dbConfigs map[string]DatabaseConfig, port, metricsP
 	for k, v := range dbConfigs {
 		log.Info().Str("name", v.Name).Str("directory", v.Directory).Msg("initializing database")
 		dbLogger := log.With().Str("db", v.Name).Logger()
-		db, err := database.NewDatabase(v.Name, path.Join(v.Directory, v.Name))
+		db, err := database.NewDatabaseWithConfig(v.Name, path.Join(v.Directory, v.Name), database.Config{
+			SyncWrites:       v.SyncWrites,
+			StrictTopics:     v.StrictTopics,
+			MaxTopics:        v.MaxTopics,
+			MaxQueryRange:    v.MaxQueryRange,
+			MaxQueryResults:  v.MaxQueryResults,
+			RawRetention:     v.RawRetention,
+			RollupInterval:   v.RollupInterval,
+			RecoverTopics:    v.RecoverTopics,
+			ChangeFeedSize:   v.ChangeFeedSize,
+			ManualMigrations: v.ManualMigrations,
+			ColumnarSegments: v.ColumnarSegments,
+			DedupWindows:     v.DedupWindows,
+			Logger:           dbLogger,
+
+			SlowAppendThreshold: v.SlowAppendThreshold,
+			SlowFlushThreshold:  v.SlowFlushThreshold,
+		})
+		if errors.Is(err, database.ErrMigrationNeeded) {
+			dbLogger.Fatal().Err(err).Msg("database needs migrating, run 'fossil admin migrate' first")
+		}
 		if err != nil {
 			dbLogger.Fatal().Err(err).Msg("error initializing database")
 		}
 		dbMap[k] = db
 		ms.RegisterCollector(NewDBStatsCollector(db))
+
+		if v.FlushInterval > 0 {
+			go flushPeriodically(dbLogger, db, v.FlushInterval)
+		}
 	}
 
 	return Server{
@@ -60,9 +123,69 @@ func New(log zerolog.Logger, dbConfigs map[string]DatabaseConfig, port, metricsP
 		dbMap,
 		port,
 		metricsPort,
+		limits,
+		acls,
+		auditLog,
+		tracing.Nop,
+		newAppendKeys(DefaultIdempotencyWindow),
+		0,
+		"",
+		Timeouts{},
+	}
+}
+
+// Trace has the server create spans with t around each command it handles,
+// and around planning and executing queries. It must be called before the
+// server starts serving.
+func (s *Server) Trace(t tracing.Tracer) {
+	s.tracer = tracing.OrNop(t)
+}
+
+// DeduplicateAppends has the server remember the idempotency keys of appends
+// for window, acknowledging appends sent again with the same key in that time
+// without applying them twice. A window of 0 stops the server deduplicating
+// appends. It must be called before the server starts serving.
+func (s *Server) DeduplicateAppends(window time.Duration) {
+	s.appendKeys = nil
+	if window > 0 {
+		s.appendKeys = newAppendKeys(window)
+	}
+}
+
+// TimeOut has the server disconnect clients which exceed timeouts. It must be
+// called before the server starts serving.
+func (s *Server) TimeOut(timeouts Timeouts) {
+	s.timeouts = timeouts
+}
+
+// flushPeriodically serializes db every interval, so that an idle database
+// doesn't keep data around only in its write-ahead log.
+func flushPeriodically(log zerolog.Logger, db *database.Database, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := db.Flush()
+		if err != nil {
+			log.Error().Err(err).Msg("error flushing database")
+		}
 	}
 }
 
+// Databases returns the databases served by s, keyed by name
+func (s *Server) Databases() map[string]*database.Database {
+	return s.dbMap
+}
+
+// ACLs returns the topic ACLs s restricts clients with
+func (s *Server) ACLs() proto.TopicACLs {
+	return s.acls
+}
+
+func errTopicDenied(topic string) error {
+	return fmt.Errorf("%w to topic %s", plan.ErrTopicDenied, topic)
+}
+
 func (s *Server) accessLog(log zerolog.Logger, h MessageHandler) MessageHandler {
 	return func(rw proto.ResponseWriter, r *proto.Request) {
 		t := time.Now()
@@ -72,36 +195,125 @@ func (s *Server) accessLog(log zerolog.Logger, h MessageHandler) MessageHandler
 			if r.Database() != nil {
 				db = r.Database().Name
 			}
-			log.Info().Int64("ns", dur).Str("cmd", r.Command()).Str("db", db).Send()
-			s.metrics.IncRequests(db, r.Command())
-			s.metrics.ObserveResponseNS(db, r.Command(), dur)
+			r.Log(log).Info().Int64("ns", dur).Str("cmd", r.Command()).Str("db", db).Send()
+			s.metrics.IncRequests(r.Listener(), db, r.Command())
+			s.metrics.ObserveResponseNS(r.Listener(), db, r.Command(), dur)
 		}()
 		h(rw, r)
 	}
 }
 
+// trace wraps the handling of each request in a span, which is passed to h
+// in the request's context
+func (s *Server) trace(h MessageHandler) MessageHandler {
+	if s.tracer == tracing.Nop {
+		return h
+	}
+
+	return func(rw proto.ResponseWriter, r *proto.Request) {
+		ctx, span := s.tracer.Start(r.Context(), "fossil.server "+r.Command(),
+			tracing.String("fossil.command", r.Command()),
+			tracing.String("fossil.request_id", r.RequestID()),
+		)
+		defer span.End()
+		if r.Database() != nil {
+			span.SetAttributes(tracing.String("fossil.db", r.Database().Name))
+		}
+
+		rec := &responseRecorder{rw: rw}
+		h(proto.NewResponseWriter(rec).WithRequestID(rw.RequestID()).WithNotices(rw.Notices()), r.WithContext(ctx))
+
+		code, msg := rec.result()
+		span.SetAttributes(tracing.Int("fossil.code", int(code)))
+		if code != 200 {
+			span.RecordError(errors.New(msg))
+		}
+	}
+}
+
+// accessLogState logs requests like accessLog, for handlers of commands which
+// change the state of the connection
+func (s *Server) accessLogState(log zerolog.Logger, h MessageStateHandler) MessageStateHandler {
+	return func(rw proto.ResponseWriter, c *conn, r *proto.Request) {
+		s.accessLog(log, func(rw proto.ResponseWriter, r *proto.Request) {
+			h(rw, c, r)
+		})(rw, r)
+	}
+}
+
 func (s *Server) ServeDatabase() {
-	srv := NewMessageServer(s.log, s.metrics)
-	mux := NewMapMux()
+	srv := s.messageServer(DefaultListener)
 
-	// Wire up handlers
-	mux.HandleState(proto.CommandUse, s.HandleUse)
-	mux.Handle(proto.CommandVersion, s.accessLog(s.log, s.HandleVersion))
-	mux.Handle(proto.CommandQuery, s.accessLog(s.log, s.HandleQuery))
-	mux.Handle(proto.CommandAppend, s.accessLog(s.log, s.HandleAppend))
-	mux.Handle(proto.CommandStats, s.accessLog(s.log, s.HandleStats))
-	mux.Handle(proto.CommandList, s.accessLog(s.log, s.HandleList))
-	mux.Handle(proto.CommandCreate, s.accessLog(s.log, s.HandleCreate))
+	err := srv.ListenAndServe(s.port, s.mux())
+	if err != nil {
+		s.log.Error().Err(err).Msg("error listening and serving")
+	}
+}
 
-	err := srv.ListenAndServe(s.port, mux)
+// ServeUnix serves the databases on the unix socket at path, for clients on
+// the same machine
+func (s *Server) ServeUnix(path string) {
+	srv := s.messageServer(UnixListener)
+
+	err := srv.ListenAndServeUnix(path, s.mux())
 	if err != nil {
 		s.log.Error().Err(err).Msg("error listening and serving")
 	}
 }
 
+// Serve serves the databases on sock, which the caller has already opened,
+// until it's closed. Tests use it to serve on an ephemeral port.
+func (s *Server) Serve(sock net.Listener) error {
+	srv := s.messageServer(DefaultListener)
+	return srv.Serve(sock, s.mux())
+}
+
+// messageServer returns a MessageServer for the listener named listener
+func (s *Server) messageServer(listener string) MessageServer {
+	srv := NewMessageServer(s.log, s.metrics, s.limits, s.acls, s.timeouts)
+	srv.listener = listener
+	return srv
+}
+
+// mux returns a MessageMux with the handlers of the data port
+func (s *Server) mux() MessageMux {
+	if s.adminPort > 0 {
+		return dataOnly(s.handlers())
+	}
+	return s.handlers()
+}
+
+// handlers returns a MessageMux with the server's handlers
+func (s *Server) handlers() MessageMux {
+	mux := NewMapMux()
+
+	// Wire up handlers
+	mux.HandleState(proto.CommandUse, s.HandleUse)
+	mux.HandleState(proto.CommandVersion, s.accessLogState(s.log, s.HandleVersion))
+	mux.Handle(proto.CommandQuery, s.trace(s.accessLog(s.log, s.HandleQuery)))
+	mux.Handle(proto.CommandAppend, s.trace(s.accessLog(s.log, s.audit(proto.CommandAppend, s.HandleAppend))))
+	mux.Handle(proto.CommandStats, s.trace(s.accessLog(s.log, s.HandleStats)))
+	mux.Handle(proto.CommandList, s.trace(s.accessLog(s.log, s.HandleList)))
+	mux.Handle(proto.CommandCreate, s.trace(s.accessLog(s.log, s.audit(proto.CommandCreate, s.HandleCreate))))
+	mux.Handle(proto.CommandFlush, s.trace(s.accessLog(s.log, s.audit(proto.CommandFlush, s.HandleFlush))))
+	mux.Handle(proto.CommandDescribe, s.trace(s.accessLog(s.log, s.HandleDescribe)))
+	mux.Handle(proto.CommandTopics, s.trace(s.accessLog(s.log, s.HandleTopics)))
+	mux.Handle(proto.CommandDatabaseStatus, s.trace(s.accessLog(s.log, s.HandleDatabaseStatus)))
+	mux.Handle(proto.CommandSchema, s.trace(s.accessLog(s.log, s.audit(proto.CommandSchema, s.HandleCreateSchema))))
+	mux.Handle(proto.CommandTemplate, s.trace(s.accessLog(s.log, s.audit(proto.CommandTemplate, s.HandleCreateTemplate))))
+	mux.Handle(proto.CommandValidate, s.trace(s.accessLog(s.log, s.HandleValidate)))
+	mux.Handle(proto.CommandChanges, s.trace(s.accessLog(s.log, s.HandleChanges)))
+	// Pings are sent often by health checks, so aren't logged
+	mux.Handle(proto.CommandPing, s.trace(s.HandlePing))
+
+	return mux
+}
+
 func (s *Server) ServeMetrics() {
 	s.log.Info().Int("port", s.metricsPort).Msg("/metrics endpoint started")
 	http.Handle("/metrics", s.metrics.Handler())
+	http.Handle("/healthz", s.healthHandler(false))
+	http.Handle("/readyz", s.healthHandler(true))
 	http.ListenAndServe(fmt.Sprintf(":%d", s.metricsPort), nil)
 }
 
@@ -109,13 +321,17 @@ func (s *Server) HandleUse(rw proto.ResponseWriter, c *conn, r *proto.Request) {
 	use := proto.UseRequest{}
 	err := proto.Unmarshal(r.Data(), &use)
 	if err != nil {
-		s.log.Error().Err(err).Msg("error unmarshaling")
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
 		rw.WriteMessage(proto.MessageErrorUnmarshaling)
 		return
 	}
 	db, ok := s.dbMap[use.DbName]
+	// Connections to a listener serving a single database can't leave it
+	if c.pinned && use.DbName != c.dbName {
+		ok = false
+	}
 	if !ok {
-		s.log.Error().Err(err).Str("dbName", use.DbName).Msg("error unknown db")
+		r.Log(s.log).Error().Err(err).Str("dbName", use.DbName).Msg("error unknown db")
 		rw.WriteMessage(proto.MessageErrorUnknownDb)
 		return
 	}
@@ -124,15 +340,23 @@ func (s *Server) HandleUse(rw proto.ResponseWriter, c *conn, r *proto.Request) {
 	rw.WriteMessage(proto.MessageOkDatabaseChanged)
 }
 
-func (s *Server) HandleVersion(rw proto.ResponseWriter, r *proto.Request) {
+func (s *Server) HandleVersion(rw proto.ResponseWriter, c *conn, r *proto.Request) {
 	version := proto.VersionRequest{}
 	err := proto.Unmarshal(r.Data(), &version)
 	if err != nil {
-		s.log.Error().Err(err).Msg("error unmarshaling")
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
 		rw.WriteMessage(proto.MessageErrorUnmarshaling)
 		return
 	}
-	s.log.Trace().Str("client-version", version.Version).Msg("got client version")
+	r.Log(s.log).Trace().Str("client-version", version.Version).Strs("compression", version.Compression).Msg("got client version")
+	if err := proto.CheckClientVersion(version.Version); err != nil {
+		r.Log(s.log).Warn().Err(err).Str("client-version", version.Version).Msg("rejected client version")
+		c.compression.Store(new(string))
+	} else {
+		algorithm := proto.NegotiateCompression(version.Compression)
+		c.compression.Store(&algorithm)
+	}
+	c.notices.Store(proto.AcceptsNotices(version.Version))
 	rw.WriteMessage(VersionResponse(version))
 }
 
@@ -140,13 +364,44 @@ func (s *Server) HandleAppend(rw proto.ResponseWriter, r *proto.Request) {
 	a := proto.AppendRequest{}
 	err := proto.Unmarshal(r.Data(), &a)
 	if err != nil {
-		s.log.Error().Err(err).Msg("error unmarshaling")
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
 		rw.WriteMessage(proto.MessageErrorUnmarshaling)
 		return
 	}
 
-	s.log.Trace().Str("topic", a.Topic).Msg("append")
-	rw.WriteMessage(AppendResponse(a, r.Database()))
+	err = s.limits.CheckAppend(a)
+	if err != nil {
+		r.Log(s.log).Warn().Err(err).Str("topic", a.Topic).Msg("rejected append")
+		rw.WriteMessage(proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 509, Err: err}))
+		return
+	}
+
+	if !r.ACL().Permits(a.Topic) {
+		r.Log(s.log).Warn().Str("acl", r.ACL().Name).Str("topic", a.Topic).Msg("denied append")
+		rw.WriteMessage(proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 403, Err: errTopicDenied(a.Topic)}))
+		return
+	}
+
+	// Only trusted clients may create topics in strict mode, so the request
+	// of anyone else to is treated as an ordinary append
+	if a.CreateTopic && !r.ACL().MayCreateTopics() {
+		r.Log(s.log).Debug().Str("topic", a.Topic).Msg("ignored topic creation from untrusted client")
+		a.CreateTopic = false
+	}
+
+	r.Log(s.log).Trace().Str("topic", a.Topic).Msg("append")
+	if a.IdempotencyKey == "" || s.appendKeys == nil {
+		rw.WriteMessage(AppendResponseWithNotices(a, r.Database(), rw.WriteNotice))
+		return
+	}
+
+	resp, duplicate := s.appendKeys.apply(r.Database().Name, a.IdempotencyKey, func() proto.Message {
+		return AppendResponseWithNotices(a, r.Database(), rw.WriteNotice)
+	})
+	if duplicate {
+		r.Log(s.log).Debug().Str("topic", a.Topic).Str("idempotency_key", a.IdempotencyKey).Msg("acknowledged duplicate append")
+	}
+	rw.WriteMessage(resp)
 }
 
 func (s *Server) HandleQuery(rw proto.ResponseWriter, r *proto.Request) {
@@ -154,14 +409,15 @@ func (s *Server) HandleQuery(rw proto.ResponseWriter, r *proto.Request) {
 
 	err := proto.Unmarshal(r.Data(), &q)
 	if err != nil {
-		s.log.Error().Err(err).Msg("error unmarshaling")
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
 		rw.WriteMessage(proto.MessageErrorUnmarshaling)
 		return
 	}
 
-	_, err = rw.WriteMessage(QueryResponse(q, r.Database()))
+	resp := proto.Compress(tracedQueryResponse(r.Context(), s.tracer, q, r.Database(), r.ACL(), rw.WriteNotice), r.Compression(), proto.CompressionThreshold)
+	_, err = rw.WriteMessage(resp)
 	if err != nil {
-		s.log.Error().Err(err).Msg("unable to write response")
+		r.Log(s.log).Error().Err(err).Msg("unable to write response")
 		rw.WriteMessage(proto.MessageErrorUnmarshaling)
 		return
 	}
@@ -175,7 +431,7 @@ func (s *Server) HandleStats(rw proto.ResponseWriter, r *proto.Request) {
 		AllocHeap: m.Alloc,
 		TotalMem:  m.Sys,
 		Uptime:    time.Since(s.startupTime),
-		Segments:  len(r.Database().Segments),
+		Segments:  r.Database().Stats().Segments,
 		Topics:    r.Database().TopicCount,
 	}
 	rw.WriteMessage(proto.NewMessageWithType(proto.CommandStats, resp))
@@ -186,12 +442,25 @@ func (s *Server) HandleList(rw proto.ResponseWriter, r *proto.Request) {
 
 	err := proto.Unmarshal(r.Data(), &l)
 	if err != nil {
-		s.log.Error().Err(err).Msg("error unmarshaling")
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
 		rw.WriteMessage(proto.MessageErrorUnmarshaling)
 		return
 	}
 
-	rw.WriteMessage(ListResponse(l, r.Database(), s.dbMap))
+	rw.WriteMessage(ListResponse(l, r.Database(), s.dbMap, r.ACL()))
+}
+
+func (s *Server) HandleDatabaseStatus(rw proto.ResponseWriter, r *proto.Request) {
+	d := proto.DatabaseStatusRequest{}
+
+	err := proto.Unmarshal(r.Data(), &d)
+	if err != nil {
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
+		rw.WriteMessage(proto.MessageErrorUnmarshaling)
+		return
+	}
+
+	rw.WriteMessage(DatabaseStatusResponse(d, r.Database(), s.dbMap, time.Since(s.startupTime)))
 }
 
 func (s *Server) HandleCreate(rw proto.ResponseWriter, r *proto.Request) {
@@ -199,10 +468,156 @@ func (s *Server) HandleCreate(rw proto.ResponseWriter, r *proto.Request) {
 
 	err := proto.Unmarshal(r.Data(), &c)
 	if err != nil {
-		s.log.Error().Err(err).Msg("error unmarshaling")
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
 		rw.WriteMessage(proto.MessageErrorUnmarshaling)
 		return
 	}
 
+	err = s.limits.CheckTopic(c.Topic)
+	if err != nil {
+		rw.WriteMessage(proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 509, Err: err}))
+		return
+	}
+
+	if !r.ACL().Permits(c.Topic) {
+		r.Log(s.log).Warn().Str("acl", r.ACL().Name).Str("topic", c.Topic).Msg("denied topic creation")
+		rw.WriteMessage(proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 403, Err: errTopicDenied(c.Topic)}))
+		return
+	}
+
 	rw.WriteMessage(CreateResponse(c, r.Database()))
 }
+
+func (s *Server) HandleCreateSchema(rw proto.ResponseWriter, r *proto.Request) {
+	c := proto.CreateSchemaRequest{}
+
+	err := proto.Unmarshal(r.Data(), &c)
+	if err != nil {
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
+		rw.WriteMessage(proto.MessageErrorUnmarshaling)
+		return
+	}
+
+	rw.WriteMessage(CreateSchemaResponse(c, r.Database()))
+}
+
+func (s *Server) HandleCreateTemplate(rw proto.ResponseWriter, r *proto.Request) {
+	c := proto.CreateTemplateRequest{}
+
+	err := proto.Unmarshal(r.Data(), &c)
+	if err != nil {
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
+		rw.WriteMessage(proto.MessageErrorUnmarshaling)
+		return
+	}
+
+	rw.WriteMessage(CreateTemplateResponse(c, r.Database()))
+}
+
+// HandleValidate checks a payload or topic creation against the same limits
+// and ACLs as HandleAppend and HandleCreate, without writing anything
+func (s *Server) HandleValidate(rw proto.ResponseWriter, r *proto.Request) {
+	v := proto.ValidateRequest{}
+
+	err := proto.Unmarshal(r.Data(), &v)
+	if err != nil {
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
+		rw.WriteMessage(proto.MessageErrorUnmarshaling)
+		return
+	}
+
+	err = s.limits.CheckTopic(v.Topic)
+	if err == nil && v.Data != nil {
+		err = s.limits.CheckAppend(proto.AppendRequest{Topic: v.Topic, Data: v.Data})
+	}
+	if err != nil {
+		rw.WriteMessage(proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 509, Err: err}))
+		return
+	}
+
+	if !r.ACL().Permits(v.Topic) {
+		r.Log(s.log).Warn().Str("acl", r.ACL().Name).Str("topic", v.Topic).Msg("denied validation")
+		rw.WriteMessage(proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 403, Err: errTopicDenied(v.Topic)}))
+		return
+	}
+
+	// Validate as the append would be made, which only creates the topic in
+	// strict mode for trusted clients
+	if v.CreateTopic && !r.ACL().MayCreateTopics() {
+		v.CreateTopic = false
+	}
+
+	rw.WriteMessage(ValidateResponse(v, r.Database()))
+}
+
+func (s *Server) HandleChanges(rw proto.ResponseWriter, r *proto.Request) {
+	c := proto.ChangesRequest{}
+
+	err := proto.Unmarshal(r.Data(), &c)
+	if err != nil {
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
+		rw.WriteMessage(proto.MessageErrorUnmarshaling)
+		return
+	}
+
+	resp := proto.Compress(ChangesResponse(r.Context(), c, r.Database(), r.ACL()), r.Compression(), proto.CompressionThreshold)
+	rw.WriteMessage(resp)
+}
+
+func (s *Server) HandlePing(rw proto.ResponseWriter, r *proto.Request) {
+	p := proto.PingRequest{}
+
+	err := proto.Unmarshal(r.Data(), &p)
+	if err != nil {
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
+		rw.WriteMessage(proto.MessageErrorUnmarshaling)
+		return
+	}
+
+	rw.WriteMessage(PingResponse(p))
+}
+
+func (s *Server) HandleFlush(rw proto.ResponseWriter, r *proto.Request) {
+	f := proto.FlushRequest{}
+
+	err := proto.Unmarshal(r.Data(), &f)
+	if err != nil {
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
+		rw.WriteMessage(proto.MessageErrorUnmarshaling)
+		return
+	}
+
+	rw.WriteMessage(FlushResponse(f, r.Database()))
+}
+
+func (s *Server) HandleDescribe(rw proto.ResponseWriter, r *proto.Request) {
+	d := proto.DescribeRequest{}
+
+	err := proto.Unmarshal(r.Data(), &d)
+	if err != nil {
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
+		rw.WriteMessage(proto.MessageErrorUnmarshaling)
+		return
+	}
+
+	if !r.ACL().Permits(d.Topic) {
+		r.Log(s.log).Warn().Str("acl", r.ACL().Name).Str("topic", d.Topic).Msg("denied describe")
+		rw.WriteMessage(proto.NewMessageWithType(proto.CommandError, proto.ErrResponse{Code: 403, Err: errTopicDenied(d.Topic)}))
+		return
+	}
+
+	rw.WriteMessage(DescribeResponse(d, r.Database()))
+}
+
+func (s *Server) HandleTopics(rw proto.ResponseWriter, r *proto.Request) {
+	l := proto.ListTopicsRequest{}
+
+	err := proto.Unmarshal(r.Data(), &l)
+	if err != nil {
+		r.Log(s.log).Error().Err(err).Msg("error unmarshaling")
+		rw.WriteMessage(proto.MessageErrorUnmarshaling)
+		return
+	}
+
+	rw.WriteMessage(ListTopicsResponse(l, r.Database(), r.ACL()))
+}
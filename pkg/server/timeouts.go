@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/proto"
+)
+
+// Timeouts bound how long the server waits on a client, so that clients which
+// stop sending halfway through a message don't hold a connection forever.
+// Clients which exceed a timeout are disconnected. A timeout of 0 means there
+// is no limit.
+type Timeouts struct {
+	// Idle is how long a connection may go without starting a message
+	Idle time.Duration
+	// Header is how long a client has to send the length and command of a
+	// message, once it has started it
+	Header time.Duration
+	// Message is how long a client has to send the whole of a message, once
+	// it has started it
+	Message time.Duration
+}
+
+// headerWidth is the length prefix and command which start every message
+const headerWidth = 4 + 8
+
+// deadline returns the time timeout after from, or no deadline if timeout is 0
+func deadline(from time.Time, timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return from.Add(timeout)
+}
+
+// isTimeout returns whether err is a read which passed its deadline
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// readMessage reads the next message from r, which buffers c.c, enforcing
+// c.timeouts. The returned string names the timeout exceeded, if one was.
+func (c *conn) readMessage(r *bufio.Reader) (proto.Message, string, error) {
+	// Wait for the client to start a message
+	c.c.SetReadDeadline(deadline(time.Now(), c.timeouts.Idle))
+	if _, err := r.Peek(1); err != nil {
+		return nil, "idle", err
+	}
+
+	started := time.Now()
+	c.c.SetReadDeadline(deadline(started, c.timeouts.Header))
+	if _, err := r.Peek(headerWidth); err != nil {
+		return nil, "header", err
+	}
+
+	c.c.SetReadDeadline(deadline(started, c.timeouts.Message))
+	msg, err := proto.ReadMessageLimited(r, c.limits.MaxMessageSize)
+	return msg, "message", err
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dburkart/fossil/pkg/proto"
+	"github.com/rs/zerolog"
+)
+
+func TestTimeouts(t *testing.T) {
+	ping, _ := proto.NewMessageWithType(proto.CommandPing, proto.PingRequest{}).Marshal()
+
+	tests := []struct {
+		name     string
+		timeouts Timeouts
+		// sent is what the client sends before stalling
+		sent []byte
+	}{
+		{"idle", Timeouts{Idle: 50 * time.Millisecond}, nil},
+		{"mid-header", Timeouts{Header: 50 * time.Millisecond}, ping[:6]},
+		{"mid-message", Timeouts{Message: 50 * time.Millisecond}, ping[:len(ping)-1]},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+
+			c := newConn(zerolog.Nop(), NewMapMux(), proto.Limits{})
+			c.timeouts = tc.timeouts
+			done := make(chan struct{})
+			go func() {
+				c.Handle(server)
+				close(done)
+			}()
+
+			if len(tc.sent) > 0 {
+				if _, err := client.Write(tc.sent); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the stalled connection to be closed")
+			}
+		})
+	}
+}
+
+func TestTimeoutsAllowPromptMessages(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	mux := NewMapMux()
+	mux.Handle(proto.CommandPing, func(rw proto.ResponseWriter, r *proto.Request) {
+		rw.WriteMessage(proto.MessageOk)
+	})
+	c := newConn(zerolog.Nop(), mux, proto.Limits{})
+	c.timeouts = Timeouts{Idle: time.Second, Header: time.Second, Message: time.Second}
+	go c.Handle(server)
+
+	ping, _ := proto.NewMessageWithType(proto.CommandPing, proto.PingRequest{}).Marshal()
+	for i := 0; i < 3; i++ {
+		go client.Write(ping)
+		if _, err := proto.ReadMessageFull(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
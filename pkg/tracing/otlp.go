@@ -0,0 +1,79 @@
+//go:build otlp
+
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OTLPEnabled reports whether fossil was built with OTLP support
+const OTLPEnabled = true
+
+// NewOTLP returns a Tracer whose spans are batched and exported over OTLP/HTTP
+// to endpoint, a host:port, as the service named service
+func NewOTLP(ctx context.Context, endpoint string, insecure bool, service string) (Tracer, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+	)
+	return otelTracer{provider.Tracer("github.com/dburkart/fossil")}, nil
+}
+
+type otelTracer struct{ t trace.Tracer }
+type otelSpan struct{ s trace.Span }
+
+func (o otelTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	ctx, span := o.t.Start(ctx, name, trace.WithAttributes(otelAttributes(attrs)...))
+	return ctx, otelSpan{span}
+}
+
+func (o otelSpan) SetAttributes(attrs ...Attribute) {
+	o.s.SetAttributes(otelAttributes(attrs)...)
+}
+
+func (o otelSpan) RecordError(err error) {
+	o.s.RecordError(err)
+	o.s.SetStatus(codes.Error, err.Error())
+}
+
+func (o otelSpan) End() {
+	o.s.End()
+}
+
+func otelAttributes(attrs []Attribute) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		switch v := attr.Value.(type) {
+		case string:
+			kvs = append(kvs, attribute.String(attr.Key, v))
+		case int:
+			kvs = append(kvs, attribute.Int(attr.Key, v))
+		default:
+			kvs = append(kvs, attribute.String(attr.Key, fmt.Sprint(v)))
+		}
+	}
+	return kvs
+}
@@ -0,0 +1,22 @@
+//go:build !otlp
+
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package tracing
+
+import (
+	"context"
+	"errors"
+)
+
+// OTLPEnabled reports whether fossil was built with OTLP support
+const OTLPEnabled = false
+
+// NewOTLP always fails, since fossil was built without OTLP support
+func NewOTLP(_ context.Context, _ string, _ bool, _ string) (Tracer, error) {
+	return nil, errors.New("fossil was built without OTLP support, rebuild with -tags otlp")
+}
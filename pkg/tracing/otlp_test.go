@@ -0,0 +1,51 @@
+//go:build otlp
+
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestOTelTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := otelTracer{sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")}
+
+	ctx, parent := tracer.Start(context.Background(), "parent", String("fossil.command", "QUERY"))
+	_, child := tracer.Start(ctx, "child")
+	child.SetAttributes(Int("fossil.results", 3))
+	child.RecordError(errors.New("failed"))
+	child.End()
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+
+	c, p := spans[0], spans[1]
+	if c.Parent().SpanID() != p.SpanContext().SpanID() {
+		t.Errorf("expected child to be parented to %s, got %s", p.SpanContext().SpanID(), c.Parent().SpanID())
+	}
+	if got := p.Attributes(); len(got) != 1 || got[0] != attribute.String("fossil.command", "QUERY") {
+		t.Errorf("unexpected parent attributes %v", got)
+	}
+	if got := c.Attributes(); len(got) != 1 || got[0] != attribute.Int("fossil.results", 3) {
+		t.Errorf("unexpected child attributes %v", got)
+	}
+	if c.Status().Code != codes.Error || c.Status().Description != "failed" {
+		t.Errorf("expected child to have an error status, got %v", c.Status())
+	}
+}
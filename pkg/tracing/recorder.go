@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package tracing
+
+import (
+	"context"
+	"sync"
+)
+
+// RecordedSpan is a span ended by a Recorder's tracer
+type RecordedSpan struct {
+	Name string
+	// Parent is the name of the span's parent, or empty if it has none
+	Parent     string
+	Attributes map[string]any
+	Errors     []error
+}
+
+// Recorder is a Tracer which keeps the spans it starts once they end, for
+// checking what was traced in tests
+type Recorder struct {
+	mu    sync.Mutex
+	spans []RecordedSpan
+}
+
+type recorderKey struct{}
+
+type recordingSpan struct {
+	r    *Recorder
+	mu   sync.Mutex
+	span RecordedSpan
+}
+
+func (r *Recorder) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	s := &recordingSpan{r: r, span: RecordedSpan{Name: name, Attributes: map[string]any{}}}
+	if parent, ok := ctx.Value(recorderKey{}).(*recordingSpan); ok {
+		s.span.Parent = parent.span.Name
+	}
+	s.SetAttributes(attrs...)
+	return context.WithValue(ctx, recorderKey{}, s), s
+}
+
+// Spans returns the spans which have ended, in the order they ended
+func (r *Recorder) Spans() []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RecordedSpan{}, r.spans...)
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...Attribute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, attr := range attrs {
+		s.span.Attributes[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordingSpan) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.span.Errors = append(s.span.Errors, err)
+}
+
+func (s *recordingSpan) End() {
+	s.mu.Lock()
+	span := s.span
+	s.mu.Unlock()
+
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	s.r.spans = append(s.r.spans, span)
+}
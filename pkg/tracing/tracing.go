@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2023, Dana Burkart <dana.burkart@gmail.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+// Package tracing holds the hooks the api client and server create spans
+// through. The interfaces mirror the parts of OpenTelemetry's tracing API
+// fossil needs, so that an adapter for an OpenTelemetry tracer is a few lines
+// long. When built with the otlp tag, NewOTLP provides one exporting over
+// OTLP; otherwise fossil doesn't depend on OpenTelemetry itself.
+package tracing
+
+import "context"
+
+// Attribute is a key/value pair describing a span
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// String returns a string-valued Attribute
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int returns an integer-valued Attribute
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Tracer starts spans. Implementations must be safe for concurrent use.
+type Tracer interface {
+	// Start starts a span named name, as a child of the span in ctx if there
+	// is one, returning a context holding the new span
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a single operation within a trace
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	// RecordError records that the operation failed with err
+	RecordError(err error)
+	// End completes the span
+	End()
+}
+
+// Nop is a Tracer whose spans do nothing
+var Nop Tracer = nopTracer{}
+
+type nopTracer struct{}
+type nopSpan struct{}
+
+func (nopTracer) Start(ctx context.Context, _ string, _ ...Attribute) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+func (nopSpan) SetAttributes(...Attribute) {}
+func (nopSpan) RecordError(error)          {}
+func (nopSpan) End()                       {}
+
+// OrNop returns t, or Nop if t is nil
+func OrNop(t Tracer) Tracer {
+	if t == nil {
+		return Nop
+	}
+	return t
+}